@@ -0,0 +1,95 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package audit
+
+import (
+	"sync"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Operation is the key operation an Event was emitted for
+type Operation string
+
+const (
+	// OperationWrap denotes the wrapping of a layer key for recipients
+	OperationWrap Operation = "wrap"
+	// OperationUnwrap denotes the unwrapping of a layer key
+	OperationUnwrap Operation = "unwrap"
+	// OperationUnwrapThrottled denotes an unwrap of a layer key that was
+	// refused by the guard after repeated failed attempts
+	OperationUnwrapThrottled Operation = "unwrap-throttled"
+)
+
+// Event describes the usage of keys for wrapping or unwrapping a layer key
+type Event struct {
+	// Time is the time when the operation finished
+	Time time.Time
+	// Operation is the key operation that was performed
+	Operation Operation
+	// Tenant is the tenant of the keys used for unwrapping, if the
+	// DecryptConfig has one
+	Tenant string
+	// LayerDigest is the digest of the layer, if known
+	LayerDigest digest.Digest
+	// Scheme is the keywrap scheme, such as jwe, pgp or pkcs7
+	Scheme string
+	// Recipients holds the recipients or key IDs as far as the scheme
+	// can tell them
+	Recipients []string
+	// KeyID identifies the private key that unwrapped the layer key if the
+	// scheme can tell it; it is empty for other operations and on failure
+	KeyID string
+	// Err is the error the operation failed with; it is nil on success
+	Err error
+}
+
+// Sink receives an Event for every wrap and unwrap operation. Implementations
+// must be safe for concurrent use and should not block.
+type Sink interface {
+	Audit(event Event)
+}
+
+type noopSink struct{}
+
+func (noopSink) Audit(Event) {}
+
+var (
+	sinkLock sync.RWMutex
+	sink     Sink = noopSink{}
+)
+
+// SetSink sets the Sink audit events are sent to; passing nil restores the
+// default that discards all events
+func SetSink(s Sink) {
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+
+	if s == nil {
+		s = noopSink{}
+	}
+	sink = s
+}
+
+// S returns the Sink audit events are currently sent to
+func S() Sink {
+	sinkLock.RLock()
+	defer sinkLock.RUnlock()
+
+	return sink
+}
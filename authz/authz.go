@@ -0,0 +1,138 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package authz provides the hook that authorizes unwrapping the key of a
+// layer before ocicrypt attempts it, so that platforms can centrally decide
+// who may decrypt which images, for example with an OPA policy such as "only
+// namespace X may decrypt images labeled Y".
+package authz
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/open-policy-agent/opa/v1/rego"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// DefaultQuery is the query an OPAAuthorizer evaluates
+const DefaultQuery = "data.ocicrypt.allow"
+
+// Request describes an attempt to unwrap the key of a layer
+type Request struct {
+	// Reference is the reference of the image, such as
+	// registry.example.com/app:1.0
+	Reference string `json:"reference,omitempty"`
+	// Labels are the labels of the image
+	Labels map[string]string `json:"labels,omitempty"`
+	// Caller describes who is decrypting, such as the Kubernetes namespace
+	// and service account of a pod
+	Caller map[string]string `json:"caller,omitempty"`
+	// Layer is the digest of the layer
+	Layer digest.Digest `json:"layer"`
+	// Scheme is the keywrap scheme, such as jwe or pgp
+	Scheme string `json:"scheme"`
+	// Recipients are the recipients the layer key is wrapped for, as far
+	// as the keywrap scheme tells them
+	Recipients []string `json:"recipients,omitempty"`
+}
+
+// Authorizer decides whether the key of a layer may be unwrapped
+type Authorizer interface {
+	// Authorize returns an error unless the request is allowed
+	Authorize(ctx context.Context, req Request) error
+}
+
+// Authorization authorizes unwrapping the keys of the layers of an image; it
+// is set per image in the DecryptConfig along with the context of the image
+// and the caller
+type Authorization struct {
+	// Authorizer decides about the requests
+	Authorizer Authorizer
+	// Reference is the reference of the image
+	Reference string
+	// Labels are the labels of the image
+	Labels map[string]string
+	// Caller describes who is decrypting
+	Caller map[string]string
+}
+
+// Authorize asks the Authorizer whether the layer key wrapped with the given
+// scheme for the recipients may be unwrapped. Denials wrap ErrNotAuthorized.
+func (a *Authorization) Authorize(ctx context.Context, layer digest.Digest, scheme string, recipients []string) error {
+	if a.Authorizer == nil {
+		return fmt.Errorf("no authorizer set: %w", errdefs.ErrConfiguration)
+	}
+	req := Request{
+		Reference:  a.Reference,
+		Labels:     a.Labels,
+		Caller:     a.Caller,
+		Layer:      layer,
+		Scheme:     scheme,
+		Recipients: recipients,
+	}
+	if err := a.Authorizer.Authorize(ctx, req); err != nil {
+		return errdefs.WithCategory(errdefs.ErrNotAuthorized, fmt.Errorf("unwrapping the key of layer %s of %s with %s was denied: %w", layer, a.Reference, scheme, err))
+	}
+	return nil
+}
+
+// AuthorizerFunc is a function that implements Authorizer
+type AuthorizerFunc func(ctx context.Context, req Request) error
+
+// Authorize calls f
+func (f AuthorizerFunc) Authorize(ctx context.Context, req Request) error {
+	return f(ctx, req)
+}
+
+// OPAAuthorizer decides by evaluating a rego policy; the Request is the input
+// of the policy, which must define the query as true for requests that are
+// allowed
+type OPAAuthorizer struct {
+	query    string
+	prepared rego.PreparedEvalQuery
+}
+
+// NewOPAAuthorizer loads the policy and data files or bundles at the paths
+// and prepares the query for evaluation; if query is empty, DefaultQuery is
+// used
+func NewOPAAuthorizer(ctx context.Context, query string, paths ...string) (*OPAAuthorizer, error) {
+	if query == "" {
+		query = DefaultQuery
+	}
+	prepared, err := rego.New(rego.Query(query), rego.Load(paths, nil)).PrepareForEval(ctx)
+	if err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("could not prepare the rego policy: %w", err))
+	}
+	return &OPAAuthorizer{
+		query:    query,
+		prepared: prepared,
+	}, nil
+}
+
+// Authorize evaluates the query with the request as input
+func (oa *OPAAuthorizer) Authorize(ctx context.Context, req Request) error {
+	rs, err := oa.prepared.Eval(ctx, rego.EvalInput(req))
+	if err != nil {
+		return fmt.Errorf("could not evaluate %s: %w", oa.query, err)
+	}
+	// an undefined query has no result and denies
+	if !rs.Allowed() {
+		return fmt.Errorf("%s is not true", oa.query)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package authz
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/opencontainers/go-digest"
+)
+
+// writePolicy writes the rego policy to a file
+func writePolicy(t *testing.T, policy string) string {
+	path := filepath.Join(t.TempDir(), "policy.rego")
+	if err := os.WriteFile(path, []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOPAAuthorizer(t *testing.T) {
+	ctx := context.Background()
+	oa, err := NewOPAAuthorizer(ctx, "", writePolicy(t, `package ocicrypt
+
+allow if input.caller.namespace == "prod"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Authorization{
+		Authorizer: oa,
+		Reference:  "registry.example.com/app:1.0",
+		Labels:     map[string]string{"confidential": "true"},
+		Caller:     map[string]string{"namespace": "prod"},
+	}
+	layer := digest.FromString("layer")
+
+	if err := a.Authorize(ctx, layer, "jwe", []string{"[jwe]"}); err != nil {
+		t.Fatal(err)
+	}
+
+	a.Caller["namespace"] = "dev"
+	err = a.Authorize(ctx, layer, "jwe", []string{"[jwe]"})
+	if !errors.Is(err, errdefs.ErrNotAuthorized) || !strings.Contains(err.Error(), "is not true") {
+		t.Fatalf("expected ErrNotAuthorized, got %v", err)
+	}
+
+	// the query is undefined without a policy
+	a.Authorizer, err = NewOPAAuthorizer(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Caller["namespace"] = "prod"
+	if err := a.Authorize(ctx, layer, "jwe", nil); !errors.Is(err, errdefs.ErrNotAuthorized) {
+		t.Fatalf("expected ErrNotAuthorized, got %v", err)
+	}
+
+	if _, err := NewOPAAuthorizer(ctx, "", filepath.Join(t.TempDir(), "missing.rego")); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+	if _, err := NewOPAAuthorizer(ctx, "", writePolicy(t, "package ocicrypt\n\nallow if {")); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+}
+
+func TestAuthorizerFunc(t *testing.T) {
+	var got Request
+	a := &Authorization{
+		Authorizer: AuthorizerFunc(func(_ context.Context, req Request) error {
+			got = req
+			return nil
+		}),
+		Reference: "registry.example.com/app:1.0",
+	}
+	layer := digest.FromString("layer")
+	if err := a.Authorize(context.Background(), layer, "pgp", []string{"0x1234"}); err != nil {
+		t.Fatal(err)
+	}
+	if got.Reference != a.Reference || got.Layer != layer || got.Scheme != "pgp" || len(got.Recipients) != 1 {
+		t.Fatalf("unexpected request %+v", got)
+	}
+
+	if err := (&Authorization{}).Authorize(context.Background(), layer, "pgp", nil); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+}
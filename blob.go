@@ -0,0 +1,104 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ocicrypt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/utils"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// BlobMetadataVersion is the version of the BlobMetadata written by EncryptBlob
+const BlobMetadataVersion = 1
+
+// BlobMetadata is the detached metadata of a blob encrypted with EncryptBlob,
+// such as a file or a tar stream outside of an OCI image. It holds what the
+// annotations of the descriptor hold for an encrypted layer and is stored
+// next to the encrypted blob as JSON.
+type BlobMetadata struct {
+	// Version is the version of the metadata
+	Version int `json:"version"`
+	// Digest is the digest of the encrypted blob
+	Digest digest.Digest `json:"digest"`
+	// Size is the size of the encrypted blob in bytes
+	Size int64 `json:"size"`
+	// Annotations are the encryption annotations, holding the wrapped keys
+	// and the options of the block cipher
+	Annotations map[string]string `json:"annotations"`
+}
+
+// EncryptBlobFinalizer is run once the encrypted blob was read to the end and
+// returns the metadata needed to decrypt it
+type EncryptBlobFinalizer func() (*BlobMetadata, error)
+
+// ParseBlobMetadata parses the JSON of the metadata of an encrypted blob
+func ParseBlobMetadata(data []byte) (*BlobMetadata, error) {
+	var md BlobMetadata
+	if err := json.Unmarshal(data, &md); err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrProtocol, fmt.Errorf("could not JSON unmarshal blob metadata: %w", err))
+	}
+	if md.Version != BlobMetadataVersion {
+		return nil, fmt.Errorf("unsupported blob metadata version %d: %w", md.Version, errdefs.ErrProtocol)
+	}
+	return &md, nil
+}
+
+// EncryptBlob encrypts an arbitrary blob for the recipients of the
+// EncryptConfig the same way EncryptLayer encrypts a layer. The finalizer
+// returns the metadata that DecryptBlob needs along with the encrypted blob.
+func EncryptBlob(ec *config.EncryptConfig, plainReader io.Reader) (io.Reader, EncryptBlobFinalizer, error) {
+	encReader, finalizer, err := EncryptLayerContext(context.Background(), ec, plainReader, ocispec.Descriptor{})
+	if err != nil {
+		return nil, nil, err
+	}
+	dr := utils.NewDigestingReader(encReader)
+	return dr, func() (*BlobMetadata, error) {
+		annotations, err := finalizer()
+		if err != nil {
+			return nil, err
+		}
+		return &BlobMetadata{
+			Version:     BlobMetadataVersion,
+			Digest:      dr.Digest(),
+			Size:        dr.Size(),
+			Annotations: annotations,
+		}, nil
+	}, nil
+}
+
+// DecryptBlob decrypts a blob encrypted with EncryptBlob using the keys of the
+// DecryptConfig and the metadata of the blob. The integrity of the blob is
+// verified by the block cipher once the returned reader reaches the end.
+func DecryptBlob(dc *config.DecryptConfig, encReader io.Reader, md *BlobMetadata) (io.Reader, error) {
+	if md == nil {
+		return nil, fmt.Errorf("blob metadata must not be nil: %w", errdefs.ErrConfiguration)
+	}
+	desc := ocispec.Descriptor{
+		Digest:      md.Digest,
+		Size:        md.Size,
+		Annotations: md.Annotations,
+	}
+	plainReader, _, err := DecryptLayerContext(context.Background(), dc, encReader, desc, false)
+	return plainReader, err
+}
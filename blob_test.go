@@ -0,0 +1,80 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ocicrypt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestEncryptDecryptBlob(t *testing.T) {
+	data := bytes.Repeat([]byte("backup data "), 1000)
+
+	encReader, finalizer, err := EncryptBlob(ec, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encBlob, err := ioutil.ReadAll(encReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := finalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Digest != digest.FromBytes(encBlob) || md.Size != int64(len(encBlob)) {
+		t.Fatalf("Metadata %s/%d does not describe the encrypted blob", md.Digest, md.Size)
+	}
+
+	mdData, err := json.Marshal(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err = ParseBlobMetadata(mdData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainReader, err := DecryptBlob(dc, bytes.NewReader(encBlob), md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ioutil.ReadAll(plainReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, data) {
+		t.Fatal("Decrypted blob differs")
+	}
+
+	encBlob[10] ^= 1
+	plainReader, err = DecryptBlob(dc, bytes.NewReader(encBlob), md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(plainReader); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("Expected ErrIntegrity, got %v", err)
+	}
+
+	if _, err := ParseBlobMetadata([]byte(`{"version":2}`)); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("Expected ErrProtocol, got %v", err)
+	}
+}
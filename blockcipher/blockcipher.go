@@ -17,10 +17,12 @@
 package blockcipher
 
 import (
+	"fmt"
 	"io"
 
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/utils"
 	"github.com/opencontainers/go-digest"
-	"github.com/pkg/errors"
 )
 
 // LayerCipherType is the ciphertype as specified in the layer metadata
@@ -29,8 +31,52 @@ type LayerCipherType string
 // TODO: Should be obtained from OCI spec once included
 const (
 	AES256CTR LayerCipherType = "AES_256_CTR_HMAC_SHA256"
+	// AES256GCMChunked authenticates the layer in chunks, which allows
+	// decrypting parts of it without reading the whole layer
+	AES256GCMChunked LayerCipherType = "AES_256_GCM_CHUNKED"
+	// ChaCha20Poly1305Chunked is like AES256GCMChunked, but faster on hosts
+	// without AES hardware acceleration, such as small ARM devices
+	ChaCha20Poly1305Chunked LayerCipherType = "CHACHA20_POLY1305_CHUNKED"
 )
 
+// DefaultBufferSize is the number of bytes AES256CTR holds back while
+// decrypting until the integrity of the layer has been verified, unless the
+// BufferSize of the LayerBlockCipherOptions is set
+const DefaultBufferSize = 10 * 1024
+
+// MaxBufferSize is the largest BufferSize of LayerBlockCipherOptions
+const MaxBufferSize = 16 * 1024 * 1024
+
+// DecryptionBufferSize is the upper bound of the memory in bytes the block
+// ciphers use for buffering while decrypting a layer with AES256CTR and the
+// DefaultBufferSize; it does not depend on the size of the layer
+const DecryptionBufferSize = 2 * DefaultBufferSize
+
+// GetDecryptionBufferSize returns the upper bound of the memory in bytes the
+// block cipher described by the public options uses for buffering while
+// decrypting a layer with the DefaultBufferSize
+func GetDecryptionBufferSize(pub PublicLayerBlockCipherOptions) int64 {
+	return GetDecryptionBufferSizeOpts(LayerBlockCipherOptions{Public: pub})
+}
+
+// GetDecryptionBufferSizeOpts returns the upper bound of the memory in bytes
+// the block cipher described by the options uses for buffering while
+// decrypting a layer, taking their BufferSize into account
+func GetDecryptionBufferSizeOpts(opts LayerBlockCipherOptions) int64 {
+	pub := opts.Public
+	if pub.CipherType != AES256GCMChunked && pub.CipherType != ChaCha20Poly1305Chunked {
+		return 2 * int64(opts.getBufferSize())
+	}
+	chunkSize := DefaultChunkSize
+	if v, ok := pub.CipherOptions["chunksize"]; ok {
+		if cs, err := decodeChunkSize(v); err == nil {
+			chunkSize = cs
+		}
+	}
+	// a chunk with its tag and the buffered source
+	return int64(chunkSize + 16 + 4096)
+}
+
 // PrivateLayerBlockCipherOptions includes the information required to encrypt/decrypt
 // an image which are sensitive and should not be in plaintext
 type PrivateLayerBlockCipherOptions struct {
@@ -68,6 +114,56 @@ type PublicLayerBlockCipherOptions struct {
 type LayerBlockCipherOptions struct {
 	Public  PublicLayerBlockCipherOptions
 	Private PrivateLayerBlockCipherOptions
+
+	// Rand is the source of randomness for generating nonces when encrypting;
+	// crypto/rand is used if it is nil
+	Rand io.Reader
+
+	// BufferSize is the number of bytes AES256CTR holds back while decrypting
+	// until the integrity of the layer has been verified; larger buffers read
+	// the layer in fewer, larger reads. DefaultBufferSize is used if it is 0.
+	// It is not stored with the layer.
+	BufferSize int
+
+	// Parallelism is the number of chunks the chunked block ciphers seal
+	// concurrently when encrypting; below 2 the chunks are sealed one after
+	// the other. AES256CTR ignores it.
+	Parallelism int
+
+	// AdditionalData is authenticated along with the layer, but not
+	// encrypted, so the layer cannot be decrypted in another context, such
+	// as that of another layer; it is kept in the private cipher options,
+	// which decryption takes it from if it is not set. The private cipher
+	// options come along with the layer, so to bind the layer to a context
+	// callers must set it from a trusted source when decrypting.
+	AdditionalData []byte
+
+	// PlaintextDigest and PlaintextSize are the digest and the size of the
+	// plaintext layer, CiphertextDigest and CiphertextSize those of the
+	// encrypted layer; the Finalizer of the LayerBlockCipherHandler sets them
+	// once the layer has been encrypted. They are not stored with the layer.
+	PlaintextDigest  digest.Digest
+	PlaintextSize    int64
+	CiphertextDigest digest.Digest
+	CiphertextSize   int64
+}
+
+// getAdditionalData returns the AdditionalData or the additional data kept in
+// the private cipher options; the public cipher options are not authenticated
+// and must not provide it
+func (lbco LayerBlockCipherOptions) getAdditionalData() []byte {
+	if len(lbco.AdditionalData) > 0 {
+		return lbco.AdditionalData
+	}
+	return lbco.Private.CipherOptions["aad"]
+}
+
+// getBufferSize returns the BufferSize or the DefaultBufferSize if it is not set
+func (lbco LayerBlockCipherOptions) getBufferSize() int {
+	if lbco.BufferSize > 0 {
+		return lbco.BufferSize
+	}
+	return DefaultBufferSize
 }
 
 // LayerBlockCipher returns a provider for encrypt/decrypt functionality
@@ -81,6 +177,12 @@ type LayerBlockCipher interface {
 	Decrypt(layerDataReader io.Reader, opt LayerBlockCipherOptions) (io.Reader, LayerBlockCipherOptions, error)
 }
 
+// randKeyGenerator is implemented by the LayerBlockCiphers that can generate
+// their symmetric key using a given source of randomness
+type randKeyGenerator interface {
+	generateKey(rand io.Reader) ([]byte, error)
+}
+
 // LayerBlockCipherHandler is the handler for encrypt/decrypt for layers
 type LayerBlockCipherHandler struct {
 	cipherMap map[LayerCipherType]LayerBlockCipher
@@ -100,48 +202,112 @@ func (lbco LayerBlockCipherOptions) GetOpt(key string) (value []byte, ok bool) {
 	}
 }
 
-func wrapFinalizerWithType(fin Finalizer, typ LayerCipherType) Finalizer {
+// wrapFinalizer wraps the finalizer of a block cipher so that it sets the type
+// of the cipher and the digests and sizes of the plaintext and the ciphertext
+func wrapFinalizer(fin Finalizer, typ LayerCipherType, plain, enc *utils.DigestingReader) Finalizer {
 	return func() (LayerBlockCipherOptions, error) {
 		lbco, err := fin()
 		if err != nil {
 			return LayerBlockCipherOptions{}, err
 		}
 		lbco.Public.CipherType = typ
+		lbco.PlaintextDigest = plain.Digest()
+		lbco.PlaintextSize = plain.Size()
+		lbco.CiphertextDigest = enc.Digest()
+		lbco.CiphertextSize = enc.Size()
 		return lbco, err
 	}
 }
 
 // Encrypt is the handler for the layer decryption routine
 func (h *LayerBlockCipherHandler) Encrypt(plainDataReader io.Reader, typ LayerCipherType) (io.Reader, Finalizer, error) {
+	return h.EncryptWithRand(plainDataReader, typ, nil)
+}
+
+// EncryptWithRand is the handler for the layer encryption routine using the
+// given source of randomness for the symmetric key and the nonces; if rand is
+// nil, crypto/rand is used. Only tests and reproducible builds should pass a
+// rand other than nil.
+func (h *LayerBlockCipherHandler) EncryptWithRand(plainDataReader io.Reader, typ LayerCipherType, rand io.Reader) (io.Reader, Finalizer, error) {
+	return h.EncryptWithKey(plainDataReader, typ, nil, rand)
+}
+
+// EncryptWithKey is the handler for the layer encryption routine using the
+// given symmetric key, which must have the key length of the cipher; if sk is
+// nil, a new symmetric key is generated from rand like EncryptWithRand does.
+func (h *LayerBlockCipherHandler) EncryptWithKey(plainDataReader io.Reader, typ LayerCipherType, sk []byte, rand io.Reader) (io.Reader, Finalizer, error) {
+	return h.EncryptWithOptions(plainDataReader, typ, LayerBlockCipherOptions{
+		Private: PrivateLayerBlockCipherOptions{
+			SymmetricKey: sk,
+		},
+		Rand: rand,
+	})
+}
+
+// EncryptWithOptions is the handler for the layer encryption routine using the
+// symmetric key, the source of randomness and the parallelism of the given
+// options; if the options have no symmetric key, a new one is generated like
+// EncryptWithKey does.
+func (h *LayerBlockCipherHandler) EncryptWithOptions(plainDataReader io.Reader, typ LayerCipherType, opt LayerBlockCipherOptions) (io.Reader, Finalizer, error) {
 	if c, ok := h.cipherMap[typ]; ok {
-		sk, err := c.GenerateKey()
+		if opt.Private.SymmetricKey == nil {
+			var err error
+			if g, ok := c.(randKeyGenerator); ok && opt.Rand != nil {
+				opt.Private.SymmetricKey, err = g.generateKey(opt.Rand)
+			} else {
+				opt.Private.SymmetricKey, err = c.GenerateKey()
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		plainDigester := utils.NewDigestingReader(plainDataReader)
+		encDataReader, fin, err := c.Encrypt(plainDigester, opt)
 		if err != nil {
 			return nil, nil, err
 		}
-		opt := LayerBlockCipherOptions{
-			Private: PrivateLayerBlockCipherOptions{
-				SymmetricKey: sk,
-			},
-		}
-		encDataReader, fin, err := c.Encrypt(plainDataReader, opt)
-		if err == nil {
-			fin = wrapFinalizerWithType(fin, typ)
-		}
-		return encDataReader, fin, err
+		encDigester := utils.NewDigestingReader(encDataReader)
+		return encDigester, wrapFinalizer(fin, typ, plainDigester, encDigester), nil
+	}
+	return nil, nil, fmt.Errorf("%w: %s", errdefs.ErrUnsupportedCipher, typ)
+}
+
+// DecryptReaderAt is the handler for decrypting the size bytes of ciphertext
+// in encDataReaderAt on demand; it returns an io.ReaderAt for the plaintext
+// along with the size of the plaintext. Only SeekableLayerBlockCipher types
+// support it.
+func (h *LayerBlockCipherHandler) DecryptReaderAt(encDataReaderAt io.ReaderAt, size int64, opt LayerBlockCipherOptions) (io.ReaderAt, int64, error) {
+	typ := opt.Public.CipherType
+	if typ == "" {
+		return nil, 0, fmt.Errorf("no cipher type provided: %w", errdefs.ErrProtocol)
 	}
-	return nil, nil, errors.Errorf("unsupported cipher type: %s", typ)
+	c, ok := h.cipherMap[typ]
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %s", errdefs.ErrUnsupportedCipher, typ)
+	}
+	sc, ok := c.(SeekableLayerBlockCipher)
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %s does not support random access", errdefs.ErrUnsupportedCipher, typ)
+	}
+	return sc.DecryptReaderAt(encDataReaderAt, size, opt)
 }
 
 // Decrypt is the handler for the layer decryption routine
 func (h *LayerBlockCipherHandler) Decrypt(encDataReader io.Reader, opt LayerBlockCipherOptions) (io.Reader, LayerBlockCipherOptions, error) {
 	typ := opt.Public.CipherType
 	if typ == "" {
-		return nil, LayerBlockCipherOptions{}, errors.New("no cipher type provided")
+		return nil, LayerBlockCipherOptions{}, fmt.Errorf("no cipher type provided: %w", errdefs.ErrProtocol)
 	}
 	if c, ok := h.cipherMap[LayerCipherType(typ)]; ok {
-		return c.Decrypt(encDataReader, opt)
+		plainDataReader, lbco, err := c.Decrypt(encDataReader, opt)
+		if err != nil {
+			return nil, LayerBlockCipherOptions{}, err
+		}
+		// the block ciphers do not pass on the digest of the plaintext
+		lbco.Private.Digest = opt.Private.Digest
+		return plainDataReader, lbco, nil
 	}
-	return nil, LayerBlockCipherOptions{}, errors.Errorf("unsupported cipher type: %s", typ)
+	return nil, LayerBlockCipherOptions{}, fmt.Errorf("%w: %s", errdefs.ErrUnsupportedCipher, typ)
 }
 
 // NewLayerBlockCipherHandler returns a new default handler
@@ -153,7 +319,15 @@ func NewLayerBlockCipherHandler() (*LayerBlockCipherHandler, error) {
 	var err error
 	h.cipherMap[AES256CTR], err = NewAESCTRLayerBlockCipher(256)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to set up Cipher AES-256-CTR")
+		return nil, fmt.Errorf("unable to set up Cipher AES-256-CTR: %w", err)
+	}
+	h.cipherMap[AES256GCMChunked], err = NewAESGCMChunkedLayerBlockCipher(256)
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up Cipher AES-256-GCM-CHUNKED: %w", err)
+	}
+	h.cipherMap[ChaCha20Poly1305Chunked], err = NewChaCha20Poly1305ChunkedLayerBlockCipher(256)
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up Cipher CHACHA20-POLY1305-CHUNKED: %w", err)
 	}
 
 	return &h, nil
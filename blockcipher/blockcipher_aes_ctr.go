@@ -22,12 +22,14 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
 
+	"github.com/containers/ocicrypt/errdefs"
 	"github.com/containers/ocicrypt/utils"
-	"github.com/pkg/errors"
 )
 
 // AESCTRLayerBlockCipher implements the AES CTR stream cipher
@@ -39,6 +41,8 @@ type AESCTRLayerBlockCipher struct {
 	err            error
 	hmac           hash.Hash
 	expHmac        []byte
+	aad            []byte
+	mac            []byte
 	doneEncrypting bool
 }
 
@@ -74,15 +78,15 @@ func (r *aesctrcryptor) Read(p []byte) (int, error) {
 
 	if !r.bc.encrypt {
 		if _, err := r.bc.hmac.Write(p[:o]); err != nil {
-			r.bc.err = errors.Wrapf(err, "could not write to hmac")
+			r.bc.err = fmt.Errorf("could not write to hmac: %w", err)
 			return 0, r.bc.err
 		}
 
 		if r.bc.err == io.EOF {
 			// Before we return EOF we let the HMAC comparison
 			// provide a verdict
-			if !hmac.Equal(r.bc.hmac.Sum(nil), r.bc.expHmac) {
-				r.bc.err = fmt.Errorf("could not properly decrypt byte stream; exp hmac: '%x', actual hmac: '%s'", r.bc.expHmac, r.bc.hmac.Sum(nil))
+			if mac := r.bc.sum(); !hmac.Equal(mac, r.bc.expHmac) {
+				r.bc.err = fmt.Errorf("could not properly decrypt byte stream; exp hmac: '%x', actual hmac: '%x': %w", r.bc.expHmac, mac, errdefs.ErrIntegrity)
 				return 0, r.bc.err
 			}
 		}
@@ -92,7 +96,7 @@ func (r *aesctrcryptor) Read(p []byte) (int, error) {
 
 	if r.bc.encrypt {
 		if _, err := r.bc.hmac.Write(p[:o]); err != nil {
-			r.bc.err = errors.Wrapf(err, "could not write to hmac")
+			r.bc.err = fmt.Errorf("could not write to hmac: %w", err)
 			return 0, r.bc.err
 		}
 
@@ -113,20 +117,24 @@ func (bc *AESCTRLayerBlockCipher) init(encrypt bool, reader io.Reader, opts Laye
 
 	key := opts.Private.SymmetricKey
 	if len(key) != bc.keylen {
-		return LayerBlockCipherOptions{}, fmt.Errorf("invalid key length of %d bytes; need %d bytes", len(key), bc.keylen)
+		return LayerBlockCipherOptions{}, fmt.Errorf("invalid key length of %d bytes; need %d bytes: %w", len(key), bc.keylen, errdefs.ErrKeyMaterial)
 	}
 
 	nonce, ok := opts.GetOpt("nonce")
 	if !ok {
+		r := opts.Rand
+		if r == nil {
+			r = rand.Reader
+		}
 		nonce = make([]byte, aes.BlockSize)
-		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-			return LayerBlockCipherOptions{}, errors.Wrap(err, "unable to generate random nonce")
+		if _, err := io.ReadFull(r, nonce); err != nil {
+			return LayerBlockCipherOptions{}, fmt.Errorf("unable to generate random nonce: %w", err)
 		}
 	}
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return LayerBlockCipherOptions{}, errors.Wrap(err, "aes.NewCipher failed")
+		return LayerBlockCipherOptions{}, fmt.Errorf("aes.NewCipher failed: %w", err)
 	}
 
 	bc.reader = reader
@@ -135,10 +143,12 @@ func (bc *AESCTRLayerBlockCipher) init(encrypt bool, reader io.Reader, opts Laye
 	bc.err = nil
 	bc.hmac = hmac.New(sha256.New, key)
 	bc.expHmac = opts.Public.Hmac
+	bc.aad = opts.getAdditionalData()
+	bc.mac = nil
 	bc.doneEncrypting = false
 
 	if !encrypt && len(bc.expHmac) == 0 {
-		return LayerBlockCipherOptions{}, errors.New("HMAC is not provided for decryption process")
+		return LayerBlockCipherOptions{}, fmt.Errorf("HMAC is not provided for decryption process: %w", errdefs.ErrIntegrity)
 	}
 
 	lbco := LayerBlockCipherOptions{
@@ -149,14 +159,37 @@ func (bc *AESCTRLayerBlockCipher) init(encrypt bool, reader io.Reader, opts Laye
 			},
 		},
 	}
+	if len(bc.aad) > 0 {
+		lbco.Private.CipherOptions["aad"] = bc.aad
+	}
 
 	return lbco, nil
 }
 
+// sum returns the HMAC of the ciphertext followed by the additional data and
+// its length, if there is additional data
+func (bc *AESCTRLayerBlockCipher) sum() []byte {
+	if bc.mac == nil {
+		if len(bc.aad) > 0 {
+			var l [8]byte
+			binary.BigEndian.PutUint64(l[:], uint64(len(bc.aad)))
+			bc.hmac.Write(bc.aad)
+			bc.hmac.Write(l[:])
+		}
+		bc.mac = bc.hmac.Sum(nil)
+	}
+	return bc.mac
+}
+
 // GenerateKey creates a synmmetric key
 func (bc *AESCTRLayerBlockCipher) GenerateKey() ([]byte, error) {
+	return bc.generateKey(rand.Reader)
+}
+
+// generateKey creates a symmetric key using the given source of randomness
+func (bc *AESCTRLayerBlockCipher) generateKey(rand io.Reader) ([]byte, error) {
 	key := make([]byte, bc.keylen)
-	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+	if _, err := io.ReadFull(rand, key); err != nil {
 		return nil, err
 	}
 	return key, nil
@@ -176,7 +209,7 @@ func (bc *AESCTRLayerBlockCipher) Encrypt(plainDataReader io.Reader, opt LayerBl
 		if lbco.Public.CipherOptions == nil {
 			lbco.Public.CipherOptions = map[string][]byte{}
 		}
-		lbco.Public.Hmac = bc.hmac.Sum(nil)
+		lbco.Public.Hmac = bc.sum()
 		return lbco, nil
 	}
 	return &aesctrcryptor{bc}, finalizer, nil
@@ -184,10 +217,13 @@ func (bc *AESCTRLayerBlockCipher) Encrypt(plainDataReader io.Reader, opt LayerBl
 
 // Decrypt takes in layer ciphertext data and returns the plaintext and relevant LayerBlockCipherOptions
 func (bc *AESCTRLayerBlockCipher) Decrypt(encDataReader io.Reader, opt LayerBlockCipherOptions) (io.Reader, LayerBlockCipherOptions, error) {
+	if opt.BufferSize < 0 || opt.BufferSize > MaxBufferSize {
+		return nil, LayerBlockCipherOptions{}, fmt.Errorf("buffer size of %d bytes is not between 0 and %d bytes: %w", opt.BufferSize, MaxBufferSize, errdefs.ErrConfiguration)
+	}
 	lbco, err := bc.init(false, encDataReader, opt)
 	if err != nil {
 		return nil, LayerBlockCipherOptions{}, err
 	}
 
-	return utils.NewDelayedReader(&aesctrcryptor{bc}, 1024*10), lbco, nil
+	return utils.NewDelayedReader(&aesctrcryptor{bc}, uint(opt.getBufferSize())), lbco, nil
 }
@@ -19,8 +19,12 @@ package blockcipher
 import (
 	"bytes"
 	_ "crypto/sha256"
+	"errors"
 	"io"
+	"io/ioutil"
 	"testing"
+
+	"github.com/containers/ocicrypt/errdefs"
 )
 
 func TestBlockCipherAesCtrCreateValid(t *testing.T) {
@@ -232,3 +236,49 @@ func TestBlockCipherAesCtrEncryptionInvalidHMAC(t *testing.T) {
 		t.Fatal("Read() should have failed due to Invalid HMAC verification")
 	}
 }
+
+func TestBlockCipherAesCtrBufferSize(t *testing.T) {
+	h, err := NewLayerBlockCipherHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerData := bytes.Repeat([]byte("this is some data"), 10000)
+
+	ciphertextReader, finalizer, err := h.Encrypt(bytes.NewReader(layerData), AES256CTR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := ioutil.ReadAll(ciphertextReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lbco, err := finalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bufferSize := range []int{0, 1, 100, 1024 * 1024} {
+		lbco.BufferSize = bufferSize
+		if n := GetDecryptionBufferSizeOpts(lbco); bufferSize > 0 && n != int64(2*bufferSize) {
+			t.Fatalf("unexpected decryption buffer size %d for buffer size %d", n, bufferSize)
+		}
+		plaintextReader, _, err := h.Decrypt(bytes.NewReader(ciphertext), lbco)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := ioutil.ReadAll(plaintextReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plaintext, layerData) {
+			t.Fatalf("decrypted data is different from the original for buffer size %d", bufferSize)
+		}
+	}
+
+	for _, bufferSize := range []int{-1, MaxBufferSize + 1} {
+		lbco.BufferSize = bufferSize
+		if _, _, err := h.Decrypt(bytes.NewReader(ciphertext), lbco); !errors.Is(err, errdefs.ErrConfiguration) {
+			t.Fatalf("expected ErrConfiguration for buffer size %d, got %v", bufferSize, err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package blockcipher
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
+)
+
+// NewAESGCMChunkedLayerBlockCipher returns a new chunked AES GCM block cipher of 256 bits.
+// The nonces of the chunks are derived from the chunk index, which the Go
+// Cryptographic Module does not allow in FIPS 140-only mode, so the block
+// cipher is not available there.
+func NewAESGCMChunkedLayerBlockCipher(bits int) (LayerBlockCipher, error) {
+	if bits != 256 {
+		return nil, errors.New("AES GCM bit count not supported")
+	}
+	return &chunkedLayerBlockCipher{
+		keylen: bits / 8,
+		newAEAD: func(key []byte) (cipher.AEAD, error) {
+			if fips.Enforced() {
+				return nil, fmt.Errorf("AES-GCM with nonces derived from the chunk index is not allowed in FIPS 140-only mode: %w", errdefs.ErrDisallowedAlgorithm)
+			}
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		},
+	}, nil
+}
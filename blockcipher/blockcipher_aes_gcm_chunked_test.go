@@ -0,0 +1,241 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package blockcipher
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
+	"github.com/containers/ocicrypt/utils"
+)
+
+func encryptChunked(t *testing.T, layerData []byte, chunkSize int) ([]byte, LayerBlockCipherOptions) {
+	t.Helper()
+
+	bc, err := NewAESGCMChunkedLayerBlockCipher(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := LayerBlockCipherOptions{
+		Private: PrivateLayerBlockCipherOptions{
+			SymmetricKey: []byte("01234567890123456789012345678912"),
+		},
+	}
+	if chunkSize != 0 {
+		opt.Public.CipherOptions = map[string][]byte{"chunksize": encodeChunkSize(chunkSize)}
+	}
+	ciphertextReader, finalizer, err := bc.Encrypt(bytes.NewReader(layerData), opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := ioutil.ReadAll(ciphertextReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lbco, err := finalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lbco.Public.CipherType = AES256GCMChunked
+	return ciphertext, lbco
+}
+
+func TestBlockCipherAesGcmChunkedCreateInvalid(t *testing.T) {
+	if _, err := NewAESGCMChunkedLayerBlockCipher(128); err == nil {
+		t.Fatal("Test should have failed due to invalid cipher size")
+	}
+}
+
+func TestBlockCipherAesGcmChunkedFIPS(t *testing.T) {
+	if !fips.Enforced() {
+		t.Skip("FIPS 140-only mode is not enforced")
+	}
+	h, err := NewLayerBlockCipherHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := h.Encrypt(bytes.NewReader([]byte("this is some data")), AES256GCMChunked); !errors.Is(err, errdefs.ErrDisallowedAlgorithm) {
+		t.Fatalf("expected ErrDisallowedAlgorithm in FIPS 140-only mode, got %v", err)
+	}
+}
+
+func TestBlockCipherAesGcmChunkedEncryption(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the AES_256_GCM_CHUNKED block cipher")
+
+	bc, err := NewAESGCMChunkedLayerBlockCipher(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, 99, 100, 101, 1000} {
+		layerData := bytes.Repeat([]byte("a"), size)
+		ciphertext, lbco := encryptChunked(t, layerData, 100)
+
+		plaintextReader, _, err := bc.Decrypt(bytes.NewReader(ciphertext), lbco)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := ioutil.ReadAll(plaintextReader)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(plaintext, layerData) {
+			t.Fatalf("size %d: plaintext differs", size)
+		}
+	}
+}
+
+func TestBlockCipherAesGcmChunkedParallelism(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the AES_256_GCM_CHUNKED block cipher")
+
+	bc, err := NewAESGCMChunkedLayerBlockCipher(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, 99, 100, 101, 1000, 12345} {
+		layerData := make([]byte, size)
+		for i := range layerData {
+			layerData[i] = byte(i)
+		}
+		expected, lbco := encryptChunked(t, layerData, 100)
+
+		// sealing chunks concurrently yields the same ciphertext
+		for _, parallelism := range []int{2, 3, 16} {
+			opt := lbco
+			opt.Parallelism = parallelism
+			ciphertextReader, finalizer, err := bc.Encrypt(bytes.NewReader(layerData), opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ciphertext, err := ioutil.ReadAll(iotest.OneByteReader(ciphertextReader))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := finalizer(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(ciphertext, expected) {
+				t.Fatalf("ciphertext of %d bytes with parallelism %d differs", size, parallelism)
+			}
+		}
+	}
+}
+
+func TestBlockCipherAesGcmChunkedTampering(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the AES_256_GCM_CHUNKED block cipher")
+
+	bc, err := NewAESGCMChunkedLayerBlockCipher(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerData := bytes.Repeat([]byte("this is some data"), 20)
+	ciphertext, lbco := encryptChunked(t, layerData, 100)
+	encChunkSize := 100 + 16
+
+	flipped := append([]byte{}, ciphertext...)
+	flipped[len(flipped)-1] ^= 1
+	reordered := append(append(append([]byte{}, ciphertext[encChunkSize:2*encChunkSize]...), ciphertext[:encChunkSize]...), ciphertext[2*encChunkSize:]...)
+
+	for name, tampered := range map[string][]byte{
+		"flipped":   flipped,
+		"truncated": ciphertext[:2*encChunkSize],
+		"extended":  append(append([]byte{}, ciphertext...), ciphertext[:encChunkSize]...),
+		"reordered": reordered,
+		"empty":     nil,
+	} {
+		plaintextReader, _, err := bc.Decrypt(bytes.NewReader(tampered), lbco)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(plaintextReader); !errors.Is(err, errdefs.ErrIntegrity) {
+			t.Fatalf("%s: expected ErrIntegrity, got %v", name, err)
+		}
+	}
+}
+
+func TestBlockCipherAesGcmChunkedDecryptReaderAt(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the AES_256_GCM_CHUNKED block cipher")
+
+	h, err := NewLayerBlockCipherHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerData := make([]byte, 1000)
+	for i := range layerData {
+		layerData[i] = byte(i)
+	}
+	ciphertext, lbco := encryptChunked(t, layerData, 100)
+
+	ra, size, err := h.DecryptReaderAt(bytes.NewReader(ciphertext), int64(len(ciphertext)), lbco)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(layerData)) {
+		t.Fatalf("expected plaintext size %d, got %d", len(layerData), size)
+	}
+	for _, r := range []struct{ off, n int }{{0, 10}, {95, 10}, {250, 300}, {990, 10}, {0, 1000}} {
+		p := make([]byte, r.n)
+		if _, err := ra.ReadAt(p, int64(r.off)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, layerData[r.off:r.off+r.n]) {
+			t.Fatalf("range %d+%d differs", r.off, r.n)
+		}
+	}
+	p := make([]byte, 20)
+	if n, err := ra.ReadAt(p, 990); n != 10 || err != io.EOF {
+		t.Fatalf("expected 10 bytes and EOF at the end, got %d and %v", n, err)
+	}
+
+	// a chunk that was tampered with fails when it is read
+	ciphertext[300] ^= 1
+	ra, _, err = h.DecryptReaderAt(bytes.NewReader(ciphertext), int64(len(ciphertext)), lbco)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ra.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ra.ReadAt(p, 250); !errors.Is(err, errdefs.ErrIntegrity) {
+		t.Fatalf("expected ErrIntegrity, got %v", err)
+	}
+
+	// a truncated layer cannot pass as a shorter one
+	ra, _, err = h.DecryptReaderAt(bytes.NewReader(ciphertext), 3*116, lbco)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ra.ReadAt(p, 210); !errors.Is(err, errdefs.ErrIntegrity) {
+		t.Fatalf("expected ErrIntegrity, got %v", err)
+	}
+}
+
+func TestBlockCipherDecryptReaderAtUnsupported(t *testing.T) {
+	h, err := NewLayerBlockCipherHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := LayerBlockCipherOptions{Public: PublicLayerBlockCipherOptions{CipherType: AES256CTR}}
+	if _, _, err := h.DecryptReaderAt(bytes.NewReader(nil), 0, opt); !errors.Is(err, errdefs.ErrUnsupportedCipher) {
+		t.Fatalf("expected ErrUnsupportedCipher, got %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package blockcipher
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// NewChaCha20Poly1305ChunkedLayerBlockCipher returns a new chunked
+// ChaCha20-Poly1305 block cipher of 256 bits
+func NewChaCha20Poly1305ChunkedLayerBlockCipher(bits int) (LayerBlockCipher, error) {
+	if bits != 256 {
+		return nil, errors.New("ChaCha20-Poly1305 bit count not supported")
+	}
+	return &chunkedLayerBlockCipher{
+		keylen: bits / 8,
+		newAEAD: func(key []byte) (cipher.AEAD, error) {
+			if fips.Enforced() {
+				return nil, fmt.Errorf("ChaCha20-Poly1305 is not FIPS 140 approved: %w", errdefs.ErrDisallowedAlgorithm)
+			}
+			return chacha20poly1305.New(key)
+		},
+	}, nil
+}
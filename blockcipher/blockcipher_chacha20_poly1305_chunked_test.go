@@ -0,0 +1,81 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package blockcipher
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/utils"
+)
+
+func TestBlockCipherChaCha20Poly1305ChunkedCreateInvalid(t *testing.T) {
+	if _, err := NewChaCha20Poly1305ChunkedLayerBlockCipher(128); err == nil {
+		t.Fatal("Test should have failed due to invalid cipher size")
+	}
+}
+
+func TestBlockCipherChaCha20Poly1305ChunkedEncryption(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the CHACHA20_POLY1305_CHUNKED block cipher")
+
+	h, err := NewLayerBlockCipherHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerData := bytes.Repeat([]byte("this is some data"), 10000)
+
+	ciphertextReader, finalizer, err := h.Encrypt(bytes.NewReader(layerData), ChaCha20Poly1305Chunked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := ioutil.ReadAll(ciphertextReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lbco, err := finalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lbco.Public.CipherType != ChaCha20Poly1305Chunked {
+		t.Fatalf("unexpected cipher type %s", lbco.Public.CipherType)
+	}
+
+	plaintextReader, _, err := h.Decrypt(bytes.NewReader(ciphertext), lbco)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := ioutil.ReadAll(plaintextReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, layerData) {
+		t.Fatal("decrypted data is different from the original")
+	}
+
+	// the chunks are authenticated with Poly1305
+	ciphertext[len(ciphertext)/2] ^= 1
+	plaintextReader, _, err = h.Decrypt(bytes.NewReader(ciphertext), lbco)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(plaintextReader); !errors.Is(err, errdefs.ErrIntegrity) {
+		t.Fatalf("expected ErrIntegrity, got %v", err)
+	}
+}
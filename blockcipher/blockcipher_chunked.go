@@ -0,0 +1,446 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package blockcipher
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+// DefaultChunkSize is the number of plaintext bytes the chunked block ciphers
+// encrypt and authenticate at a time
+const DefaultChunkSize = 64 * 1024
+
+// MaxChunkSize is the largest chunk size the chunked block ciphers accept
+// when decrypting
+const MaxChunkSize = 1024 * 1024
+
+// SeekableLayerBlockCipher is implemented by the LayerBlockCiphers whose
+// ciphertext can be decrypted and authenticated starting at any offset
+type SeekableLayerBlockCipher interface {
+	LayerBlockCipher
+	// DecryptReaderAt returns an io.ReaderAt for the plaintext of the size bytes
+	// of ciphertext in encDataReaderAt along with the size of the plaintext
+	DecryptReaderAt(encDataReaderAt io.ReaderAt, size int64, opt LayerBlockCipherOptions) (io.ReaderAt, int64, error)
+}
+
+// chunkedLayerBlockCipher implements a block cipher that splits the layer into
+// chunks of a fixed size and seals each of them with an AEAD. The nonce of a
+// chunk is the nonce of the layer XORed with the index of the chunk and the
+// last chunk is sealed with different additional data than the others, so
+// that chunks can neither be reordered nor dropped, and the layer can neither
+// be truncated nor extended, without the decryption failing.
+type chunkedLayerBlockCipher struct {
+	keylen  int // in bytes
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+// chunkedOptions holds the state shared by the readers of a chunked block cipher
+type chunkedOptions struct {
+	aead        cipher.AEAD
+	nonce       []byte
+	chunkSize   int
+	parallelism int
+	aad         []byte
+}
+
+// init checks the key and the cipher options and returns the options that
+// must be passed for decryption
+func (bc *chunkedLayerBlockCipher) init(encrypt bool, opts LayerBlockCipherOptions) (*chunkedOptions, LayerBlockCipherOptions, error) {
+	key := opts.Private.SymmetricKey
+	if len(key) != bc.keylen {
+		return nil, LayerBlockCipherOptions{}, fmt.Errorf("invalid key length of %d bytes; need %d bytes: %w", len(key), bc.keylen, errdefs.ErrKeyMaterial)
+	}
+	aead, err := bc.newAEAD(key)
+	if err != nil {
+		return nil, LayerBlockCipherOptions{}, fmt.Errorf("unable to create AEAD: %w", err)
+	}
+
+	nonce, ok := opts.GetOpt("nonce")
+	if !ok {
+		if !encrypt {
+			return nil, LayerBlockCipherOptions{}, fmt.Errorf("nonce is not provided for decryption process: %w", errdefs.ErrProtocol)
+		}
+		r := opts.Rand
+		if r == nil {
+			r = rand.Reader
+		}
+		nonce = make([]byte, aead.NonceSize())
+		if _, err := io.ReadFull(r, nonce); err != nil {
+			return nil, LayerBlockCipherOptions{}, fmt.Errorf("unable to generate random nonce: %w", err)
+		}
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, LayerBlockCipherOptions{}, fmt.Errorf("invalid nonce length of %d bytes; need %d bytes: %w", len(nonce), aead.NonceSize(), errdefs.ErrProtocol)
+	}
+
+	chunkSize := DefaultChunkSize
+	if v, ok := opts.GetOpt("chunksize"); ok {
+		if chunkSize, err = decodeChunkSize(v); err != nil {
+			return nil, LayerBlockCipherOptions{}, err
+		}
+	}
+
+	lbco := LayerBlockCipherOptions{
+		Public: PublicLayerBlockCipherOptions{
+			CipherOptions: map[string][]byte{
+				"chunksize": encodeChunkSize(chunkSize),
+			},
+		},
+		Private: PrivateLayerBlockCipherOptions{
+			SymmetricKey: key,
+			CipherOptions: map[string][]byte{
+				"nonce": nonce,
+			},
+		},
+	}
+	aad := opts.getAdditionalData()
+	if len(aad) > 0 {
+		lbco.Private.CipherOptions["aad"] = aad
+	}
+	return &chunkedOptions{
+		aead:        aead,
+		nonce:       nonce,
+		chunkSize:   chunkSize,
+		parallelism: opts.Parallelism,
+		aad:         aad,
+	}, lbco, nil
+}
+
+func encodeChunkSize(chunkSize int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(chunkSize))
+	return b
+}
+
+func decodeChunkSize(b []byte) (int, error) {
+	if len(b) != 4 {
+		return 0, fmt.Errorf("invalid chunk size option: %w", errdefs.ErrProtocol)
+	}
+	chunkSize := binary.BigEndian.Uint32(b)
+	if chunkSize == 0 || chunkSize > MaxChunkSize {
+		return 0, fmt.Errorf("chunk size of %d bytes is not between 1 and %d bytes: %w", chunkSize, MaxChunkSize, errdefs.ErrProtocol)
+	}
+	return int(chunkSize), nil
+}
+
+// chunkNonce returns the nonce of the chunk with the given index
+func (co *chunkedOptions) chunkNonce(idx uint64) []byte {
+	nonce := make([]byte, len(co.nonce))
+	copy(nonce, co.nonce)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], idx)
+	for i := range b {
+		nonce[len(nonce)-8+i] ^= b[i]
+	}
+	return nonce
+}
+
+// chunkAdditionalData returns the additional data a chunk is sealed with: a
+// byte telling if it is the final chunk followed by the additional data of the
+// layer
+func (co *chunkedOptions) chunkAdditionalData(final bool) []byte {
+	ad := []byte{0}
+	if final {
+		ad[0] = 1
+	}
+	return append(ad, co.aad...)
+}
+
+// openChunk authenticates and decrypts the chunk with the given index in place
+func (co *chunkedOptions) openChunk(chunk []byte, idx uint64, final bool) ([]byte, error) {
+	plain, err := co.aead.Open(chunk[:0], co.chunkNonce(idx), chunk, co.chunkAdditionalData(final))
+	if err != nil {
+		return nil, fmt.Errorf("could not authenticate chunk %d of the layer: %w", idx, errdefs.ErrIntegrity)
+	}
+	return plain, nil
+}
+
+// chunkedReader seals or opens the chunks read from its source one at a time;
+// when encrypting with a parallelism above 1 it seals that many chunks
+// concurrently and returns them in order
+type chunkedReader struct {
+	co      *chunkedOptions
+	encrypt bool
+	src     *bufio.Reader
+	buf     []byte
+	out     []byte
+	idx     uint64
+	done    bool
+	err     error
+
+	parallelism int
+	pending     []chan []byte // chunks being sealed, in order
+	free        [][]byte      // buffers of chunks that have been read
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.parallelism > 1 {
+			r.out, r.err = r.nextSealedChunk()
+			continue
+		}
+		if r.done {
+			r.err = io.EOF
+			continue
+		}
+		r.out, r.err = r.nextChunk()
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// readChunk fills buf with the next chunk from the source as far as possible
+// and notes if it is the last one
+func (r *chunkedReader) readChunk(buf []byte) (int, error) {
+	n, err := io.ReadFull(r.src, buf)
+	switch err {
+	case nil:
+		// the chunk is the last one if nothing follows it
+		if _, err := r.src.Peek(1); err == io.EOF {
+			r.done = true
+		} else if err != nil {
+			return 0, err
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		r.done = true
+	default:
+		return 0, err
+	}
+	return n, nil
+}
+
+// nextSealedChunk keeps up to parallelism chunks being sealed by goroutines
+// and returns the next sealed chunk in order; the source is only read by the
+// caller of Read, so no goroutine is left behind if reading stops early
+func (r *chunkedReader) nextSealedChunk() ([]byte, error) {
+	if r.buf != nil {
+		// the previous chunk has been read
+		r.free = append(r.free, r.buf)
+		r.buf = nil
+	}
+	for !r.done && len(r.pending) < r.parallelism {
+		var buf []byte
+		if len(r.free) > 0 {
+			buf, r.free = r.free[len(r.free)-1], r.free[:len(r.free)-1]
+		} else {
+			buf = make([]byte, r.co.chunkSize+r.co.aead.Overhead())
+		}
+		n, err := r.readChunk(buf[:r.co.chunkSize])
+		if err != nil {
+			return nil, err
+		}
+		idx, final := r.idx, r.done
+		r.idx++
+		sealed := make(chan []byte, 1)
+		go func() {
+			sealed <- r.co.aead.Seal(buf[:0], r.co.chunkNonce(idx), buf[:n], r.co.chunkAdditionalData(final))
+		}()
+		r.pending = append(r.pending, sealed)
+	}
+	if len(r.pending) == 0 {
+		return nil, io.EOF
+	}
+	out := <-r.pending[0]
+	r.pending = r.pending[1:]
+	r.buf = out[:cap(out)]
+	return out, nil
+}
+
+// nextChunk reads the next chunk from the source and seals or opens it
+func (r *chunkedReader) nextChunk() ([]byte, error) {
+	size := r.co.chunkSize
+	if !r.encrypt {
+		size += r.co.aead.Overhead()
+	}
+	n, err := r.readChunk(r.buf[:size])
+	if err != nil {
+		return nil, err
+	}
+
+	idx := r.idx
+	r.idx++
+	if r.encrypt {
+		return r.co.aead.Seal(r.buf[:0], r.co.chunkNonce(idx), r.buf[:n], r.co.chunkAdditionalData(r.done)), nil
+	}
+	if n < r.co.aead.Overhead() {
+		return nil, fmt.Errorf("layer is truncated: %w", errdefs.ErrIntegrity)
+	}
+	return r.co.openChunk(r.buf[:n], idx, r.done)
+}
+
+func (bc *chunkedLayerBlockCipher) newReader(co *chunkedOptions, encrypt bool, reader io.Reader) *chunkedReader {
+	r := &chunkedReader{
+		co:      co,
+		encrypt: encrypt,
+		src:     bufio.NewReader(reader),
+	}
+	if !encrypt || co.parallelism < 2 {
+		r.buf = make([]byte, co.chunkSize+co.aead.Overhead())
+	} else {
+		r.parallelism = co.parallelism
+	}
+	return r
+}
+
+// GenerateKey creates a symmetric key
+func (bc *chunkedLayerBlockCipher) GenerateKey() ([]byte, error) {
+	return bc.generateKey(rand.Reader)
+}
+
+// generateKey creates a symmetric key using the given source of randomness
+func (bc *chunkedLayerBlockCipher) generateKey(rand io.Reader) ([]byte, error) {
+	key := make([]byte, bc.keylen)
+	if _, err := io.ReadFull(rand, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Encrypt takes in layer data and returns the ciphertext and relevant LayerBlockCipherOptions
+func (bc *chunkedLayerBlockCipher) Encrypt(plainDataReader io.Reader, opt LayerBlockCipherOptions) (io.Reader, Finalizer, error) {
+	co, lbco, err := bc.init(true, opt)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bc.newReader(co, true, plainDataReader)
+
+	finalizer := func() (LayerBlockCipherOptions, error) {
+		if r.err != io.EOF {
+			return LayerBlockCipherOptions{}, errors.New("Read()ing not complete, unable to finalize")
+		}
+		return lbco, nil
+	}
+	return r, finalizer, nil
+}
+
+// Decrypt takes in layer ciphertext data and returns the plaintext and relevant LayerBlockCipherOptions;
+// since every chunk is authenticated before it is returned, no data is held back
+func (bc *chunkedLayerBlockCipher) Decrypt(encDataReader io.Reader, opt LayerBlockCipherOptions) (io.Reader, LayerBlockCipherOptions, error) {
+	co, lbco, err := bc.init(false, opt)
+	if err != nil {
+		return nil, LayerBlockCipherOptions{}, err
+	}
+	return bc.newReader(co, false, encDataReader), lbco, nil
+}
+
+// DecryptReaderAt returns an io.ReaderAt that authenticates and decrypts the
+// chunks holding the requested range of plaintext when it is read
+func (bc *chunkedLayerBlockCipher) DecryptReaderAt(encDataReaderAt io.ReaderAt, size int64, opt LayerBlockCipherOptions) (io.ReaderAt, int64, error) {
+	co, _, err := bc.init(false, opt)
+	if err != nil {
+		return nil, 0, err
+	}
+	overhead := int64(co.aead.Overhead())
+	encChunkSize := int64(co.chunkSize) + overhead
+	chunks := (size + encChunkSize - 1) / encChunkSize
+	if chunks == 0 || size-(chunks-1)*encChunkSize < overhead {
+		return nil, 0, fmt.Errorf("layer is truncated: %w", errdefs.ErrIntegrity)
+	}
+	return &chunkedReaderAt{
+		co:       co,
+		r:        encDataReaderAt,
+		size:     size,
+		chunks:   chunks,
+		cacheIdx: -1,
+	}, size - chunks*overhead, nil
+}
+
+// chunkedReaderAt decrypts the chunks of a layer on demand; it keeps the last
+// chunk it decrypted since reads of consecutive ranges mostly hit the same chunk
+type chunkedReaderAt struct {
+	co     *chunkedOptions
+	r      io.ReaderAt
+	size   int64
+	chunks int64
+
+	mu       sync.Mutex
+	cacheIdx int64
+	cache    []byte
+}
+
+func (ra *chunkedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	chunkSize := int64(ra.co.chunkSize)
+	n := 0
+	for n < len(p) {
+		idx := off / chunkSize
+		if idx >= ra.chunks {
+			return n, io.EOF
+		}
+		chunk, err := ra.chunk(idx)
+		if err != nil {
+			return n, err
+		}
+		start := off - idx*chunkSize
+		if start >= int64(len(chunk)) {
+			return n, io.EOF
+		}
+		c := copy(p[n:], chunk[start:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+// chunk returns the plaintext of the chunk with the given index; the returned
+// slice must not be modified
+func (ra *chunkedReaderAt) chunk(idx int64) ([]byte, error) {
+	ra.mu.Lock()
+	if ra.cacheIdx == idx {
+		defer ra.mu.Unlock()
+		return ra.cache, nil
+	}
+	ra.mu.Unlock()
+
+	encChunkSize := int64(ra.co.chunkSize + ra.co.aead.Overhead())
+	start := idx * encChunkSize
+	end := start + encChunkSize
+	if end > ra.size {
+		end = ra.size
+	}
+	buf := make([]byte, end-start)
+	if n, err := ra.r.ReadAt(buf, start); n < len(buf) {
+		if err == nil || err == io.EOF {
+			err = fmt.Errorf("layer is truncated: %w", errdefs.ErrIntegrity)
+		}
+		return nil, err
+	}
+	plain, err := ra.co.openChunk(buf, uint64(idx), idx == ra.chunks-1)
+	if err != nil {
+		return nil, err
+	}
+
+	ra.mu.Lock()
+	ra.cacheIdx, ra.cache = idx, plain
+	ra.mu.Unlock()
+	return plain, nil
+}
@@ -18,10 +18,31 @@ package blockcipher
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"io/ioutil"
 	"testing"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
+	"github.com/opencontainers/go-digest"
 )
 
+// testCipherTypes returns the given block ciphers but, in FIPS 140-only mode,
+// the chunked ones, which it does not allow
+func testCipherTypes(types ...LayerCipherType) []LayerCipherType {
+	if !fips.Enforced() {
+		return types
+	}
+	var allowed []LayerCipherType
+	for _, typ := range types {
+		if typ == AES256CTR {
+			allowed = append(allowed, typ)
+		}
+	}
+	return allowed
+}
+
 func TestBlockCipherHandlerCreate(t *testing.T) {
 	_, err := NewLayerBlockCipherHandler()
 	if err != nil {
@@ -121,4 +142,174 @@ func TestBlockCipherEncryptionInvalidKey(t *testing.T) {
 	if err == nil || err == io.EOF {
 		t.Fatal("Read() should have failed due to wrong key")
 	}
+	if !errors.Is(err, errdefs.ErrIntegrity) {
+		t.Fatalf("Expected ErrIntegrity, got %v", err)
+	}
+}
+
+func TestBlockCipherUnsupportedCipher(t *testing.T) {
+	h, err := NewLayerBlockCipherHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = h.Encrypt(bytes.NewReader(nil), LayerCipherType("DES"))
+	if !errors.Is(err, errdefs.ErrUnsupportedCipher) {
+		t.Fatalf("Expected ErrUnsupportedCipher, got %v", err)
+	}
+
+	lbco := LayerBlockCipherOptions{
+		Public: PublicLayerBlockCipherOptions{
+			CipherType: LayerCipherType("DES"),
+		},
+	}
+	_, _, err = h.Decrypt(bytes.NewReader(nil), lbco)
+	if !errors.Is(err, errdefs.ErrUnsupportedCipher) {
+		t.Fatalf("Expected ErrUnsupportedCipher, got %v", err)
+	}
+}
+
+// detRand is a deterministic source of "randomness" for tests
+type detRand struct {
+	b byte
+}
+
+func (r *detRand) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.b
+		r.b++
+	}
+	return len(p), nil
+}
+
+func TestBlockCipherEncryptionWithRand(t *testing.T) {
+	var (
+		layerData = []byte("this is some data")
+	)
+
+	h, err := NewLayerBlockCipherHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ciphertexts [][]byte
+	for i := 0; i < 2; i++ {
+		ciphertextReader, finalizer, err := h.EncryptWithRand(bytes.NewReader(layerData), AES256CTR, &detRand{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext, err := ioutil.ReadAll(ciphertextReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := finalizer(); err != nil {
+			t.Fatal(err)
+		}
+		ciphertexts = append(ciphertexts, ciphertext)
+	}
+	if !bytes.Equal(ciphertexts[0], ciphertexts[1]) {
+		t.Fatal("Expected the same source of randomness to produce the same ciphertext")
+	}
+
+	ciphertextReader, _, err := h.Encrypt(bytes.NewReader(layerData), AES256CTR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := ioutil.ReadAll(ciphertextReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(ciphertext, ciphertexts[0]) {
+		t.Fatal("Expected crypto/rand to produce a different ciphertext")
+	}
+}
+
+func TestBlockCipherAdditionalData(t *testing.T) {
+	h, err := NewLayerBlockCipherHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerData := bytes.Repeat([]byte("this is some data"), 1000)
+	for _, typ := range testCipherTypes(AES256CTR, AES256GCMChunked, ChaCha20Poly1305Chunked) {
+		ciphertextReader, finalizer, err := h.EncryptWithOptions(bytes.NewReader(layerData), typ, LayerBlockCipherOptions{
+			AdditionalData: []byte("sha256:aaaa"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext, err := ioutil.ReadAll(ciphertextReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lbco, err := finalizer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(lbco.Private.CipherOptions["aad"]) != "sha256:aaaa" {
+			t.Fatalf("%s: additional data is not kept in the private options", typ)
+		}
+
+		// the additional data is taken from the private options
+		plaintextReader, _, err := h.Decrypt(bytes.NewReader(ciphertext), lbco)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := ioutil.ReadAll(plaintextReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plaintext, layerData) {
+			t.Fatalf("%s: decrypted data is different from the original", typ)
+		}
+
+		// other additional data or none fails
+		for _, aad := range [][]byte{[]byte("sha256:bbbb"), nil} {
+			lbco.Private.CipherOptions["aad"] = aad
+			plaintextReader, _, err := h.Decrypt(bytes.NewReader(ciphertext), lbco)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ioutil.ReadAll(plaintextReader); !errors.Is(err, errdefs.ErrIntegrity) {
+				t.Fatalf("%s: expected ErrIntegrity for additional data %q, got %v", typ, aad, err)
+			}
+		}
+	}
+}
+
+func TestBlockCipherHandlerDigests(t *testing.T) {
+	h, err := NewLayerBlockCipherHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerData := bytes.Repeat([]byte("this is some data"), 1000)
+	for _, typ := range testCipherTypes(AES256CTR, AES256GCMChunked) {
+		ciphertextReader, finalizer, err := h.Encrypt(bytes.NewReader(layerData), typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext, err := ioutil.ReadAll(ciphertextReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lbco, err := finalizer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lbco.PlaintextDigest != digest.FromBytes(layerData) || lbco.PlaintextSize != int64(len(layerData)) {
+			t.Fatalf("%s: unexpected plaintext digest %s and size %d", typ, lbco.PlaintextDigest, lbco.PlaintextSize)
+		}
+		if lbco.CiphertextDigest != digest.FromBytes(ciphertext) || lbco.CiphertextSize != int64(len(ciphertext)) {
+			t.Fatalf("%s: unexpected ciphertext digest %s and size %d", typ, lbco.CiphertextDigest, lbco.CiphertextSize)
+		}
+
+		// decryption passes on the digest of the plaintext
+		lbco.Private.Digest = lbco.PlaintextDigest
+		_, dlbco, err := h.Decrypt(bytes.NewReader(ciphertext), lbco)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dlbco.Private.Digest != lbco.PlaintextDigest {
+			t.Fatalf("%s: expected digest %s, got %s", typ, lbco.PlaintextDigest, dlbco.Private.Digest)
+		}
+	}
 }
@@ -16,6 +16,60 @@
 
 package config
 
+import (
+	"crypto"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"github.com/containers/ocicrypt/authz"
+	"github.com/containers/ocicrypt/blockcipher"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/keyhelper"
+	"github.com/containers/ocicrypt/limits"
+	"github.com/containers/ocicrypt/oidc"
+	"github.com/containers/ocicrypt/policy"
+	"github.com/containers/ocicrypt/remotekeys"
+	"github.com/containers/ocicrypt/spiffe"
+	"github.com/containers/ocicrypt/verify"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// PartialFailureMode decides how encrypting a layer handles keywrappers that
+// fail to wrap the layer key
+type PartialFailureMode int
+
+const (
+	// FailFast aborts at the first keywrapper that fails to wrap the layer
+	// key; this is the default
+	FailFast PartialFailureMode = iota
+	// BestEffort ignores keywrappers that fail to wrap the layer key as long
+	// as the other keywrappers wrapped it for at least MinWrappedKeys
+	// recipients
+	BestEffort
+	// CollectErrors tries all keywrappers and fails with the errors of all
+	// the keywrappers that failed to wrap the layer key
+	CollectErrors
+)
+
+// Progress reports how far encrypting or decrypting a layer has come
+type Progress struct {
+	// Digest is the digest of the descriptor of the layer: of the plaintext
+	// layer when encrypting, of the encrypted layer when decrypting
+	Digest digest.Digest
+	// Bytes is the number of bytes read so far from the layer that is
+	// encrypted or decrypted, which can be compared to the size of its
+	// descriptor
+	Bytes int64
+	// Done is true once the layer has been read to the end
+	Done bool
+}
+
+// ProgressFunc is called with the progress of encrypting or decrypting a
+// layer whenever data of the layer is read; it is called from the Read method
+// of the reader of the layer, so it must return quickly
+type ProgressFunc func(Progress)
+
 // EncryptConfig is the container image PGP encryption configuration holding
 // the identifiers of those that will be able to decrypt the container and
 // the PGP public keyring file data that contains their public keys.
@@ -23,6 +77,47 @@ type EncryptConfig struct {
 	// map holding 'gpg-recipients', 'gpg-pubkeyringfile', 'pubkeys', 'x509s'
 	Parameters map[string][][]byte
 
+	// Policy decides which keys of recipients may be used; if nil, the global
+	// policy is used
+	Policy *policy.Policy
+
+	// Rand is the source of randomness for the layer keys and nonces and, for
+	// the jwe, pkcs7 (in CMS mode), pgp and threshold schemes, for wrapping
+	// the layer keys; if nil, crypto/rand is used. It must only be set by
+	// tests and for reproducible builds.
+	Rand io.Reader
+
+	// Limits bounds the resources used for encrypting layers; if nil, the
+	// global limits are used
+	Limits *limits.Limits
+
+	// PartialFailures decides how failures of some of the keywrappers to wrap
+	// the layer key are handled
+	PartialFailures PartialFailureMode
+	// MinWrappedKeys is the minimum number of recipients the layer key must
+	// be wrapped for in BestEffort mode; values below 1 mean 1
+	MinWrappedKeys int
+
+	// Cipher is the block cipher for encrypting layers; if empty,
+	// blockcipher.AES256CTR is used
+	Cipher blockcipher.LayerCipherType
+
+	// Parallelism is the number of chunks of a layer that the chunked block
+	// ciphers, such as blockcipher.AES256GCMChunked, encrypt concurrently;
+	// below 2 a layer is encrypted on a single core
+	Parallelism int
+
+	// BindDigest authenticates the digest of the plaintext layer along with
+	// the encrypted layer, so that the wrapped key and the annotations of one
+	// layer cannot be used to decrypt other ciphertext encrypted with the same
+	// key; the descriptor of the layer must have a digest. Decrypting the
+	// layer needs the digest in the BoundDigests of the DecryptConfig.
+	BindDigest bool
+
+	// Progress, if set, is called as the layers are read while they are
+	// encrypted
+	Progress ProgressFunc
+
 	DecryptConfig DecryptConfig
 }
 
@@ -30,6 +125,106 @@ type EncryptConfig struct {
 type DecryptConfig struct {
 	// map holding 'privkeys', 'x509s', 'gpg-privatekeys'
 	Parameters map[string][][]byte
+
+	// Decrypters holds private keys that are only accessible through the
+	// crypto.Decrypter interface, such as keys held by an HSM, a TPM or a
+	// cloud KMS; they are used by the jwe and pkcs7 keywrappers for RSA keys
+	Decrypters []crypto.Decrypter
+
+	// Policy decides which legacy algorithms are accepted; if nil, the global
+	// policy is used
+	Policy *policy.Policy
+
+	// MaxMemory is the maximum amount of memory in bytes that decrypting a
+	// layer may use for the encryption metadata of the layer and for
+	// buffering; 0 means no limit. Decrypting a layer whose metadata would
+	// exceed it fails with an error rather than using up the memory.
+	MaxMemory int64
+
+	// BufferSize is the number of bytes the AES_256_CTR_HMAC_SHA256 block
+	// cipher holds back while decrypting a layer until its integrity has been
+	// verified; 0 means blockcipher.DefaultBufferSize. Larger buffers read
+	// layers in fewer, larger reads at the cost of memory.
+	BufferSize int
+
+	// Progress, if set, is called as the encrypted layers are read while
+	// they are decrypted
+	Progress ProgressFunc
+
+	// BoundDigests maps the digests of encrypted layers to the digests of the
+	// plaintext layers they were bound to with BindDigest, for example taken
+	// from the manifest of the plaintext image. A layer bound to a digest is
+	// only decrypted if the digest of the encrypted layer maps to that digest,
+	// and a layer whose digest is mapped is only decrypted if it is bound to
+	// the digest it maps to; the digest kept with the layer key cannot be
+	// trusted since it comes along with the annotations of the layer.
+	BoundDigests map[digest.Digest]digest.Digest
+
+	// Limits bounds the resources used for decrypting layers; if nil, the
+	// global limits are used
+	Limits *limits.Limits
+
+	// IDTokenSource provides the OIDC ID token that is attached to the calls
+	// to key services for unwrapping layer keys; if nil, no token is sent
+	IDTokenSource oidc.TokenSource
+
+	// SVIDSource provides the X.509-SVID that is presented as client
+	// certificate to the key services that ask for one, such as rewrap
+	// services granting access by SPIFFE ID; if nil, no SVID is presented
+	SVIDSource spiffe.Source
+
+	// Verification verifies the image before the keys of its layers are
+	// unwrapped; if nil, images are not verified
+	Verification *verify.Verification
+
+	// Authorization authorizes unwrapping the keys of the layers of the
+	// image; if nil, no authorization is asked for
+	Authorization *authz.Authorization
+
+	// KeyLookup obtains further private keys from key helpers when the key
+	// of a layer is unwrapped; if nil, only the keys given here are used
+	KeyLookup *keyhelper.Lookup
+
+	// RemoteKeys fetches the wrapped keys of layers that are stored outside
+	// of the image; if nil, such wrapped keys are not fetched
+	RemoteKeys *remotekeys.Resolver
+
+	// GPGDecrypter decrypts the pgp wrapped keys of layers with secret keys
+	// that cannot be exported, such as keys on OpenPGP smartcards; if nil,
+	// only the gpg private keys given here are used
+	GPGDecrypter GPGDecrypter
+
+	// KeyWrappers are the encryption schemes, such as 'pkcs11' or 'jwe', whose
+	// key wrappers are tried for unwrapping the layer keys, in this order; if
+	// empty, all registered key wrappers are tried in the order of their
+	// priorities
+	KeyWrappers []string
+	// DeniedKeyWrappers are the encryption schemes whose key wrappers are
+	// never tried for unwrapping the layer keys, for example those calling
+	// external key services
+	DeniedKeyWrappers []string
+
+	// Tenant is the tenant the keys belong to when a daemon decrypts images
+	// for many tenants; the state kept across decryptions, such as the
+	// throttling of failed attempts and cached wrapped keys, is kept apart
+	// per tenant. Configurations of different tenants cannot be combined.
+	Tenant string
+
+	// mixedTenants is set when configurations of different tenants were
+	// combined into this one
+	mixedTenants bool
+
+	// secrets holds the locked memory allocated by LockSecrets or held by
+	// the configurations this one was combined from
+	secrets []*lockedSecrets
+}
+
+// GPGDecrypter decrypts OpenPGP messages with secret keys that are held by
+// gpg-agent, for example on an OpenPGP smartcard through scdaemon
+type GPGDecrypter interface {
+	// DecryptGPGMessage decrypts the OpenPGP message and returns the
+	// plaintext and the ID of the key that decrypted it
+	DecryptGPGMessage(message []byte) ([]byte, uint64, error)
 }
 
 // CryptoConfig is a common wrapper for EncryptConfig and DecrypConfig that can
@@ -68,27 +263,200 @@ func CombineCryptoConfigs(ccs []CryptoConfig) CryptoConfig {
 	ecparam := map[string][][]byte{}
 	ecdcparam := map[string][][]byte{}
 	dcparam := map[string][][]byte{}
+	var ecdcdecrypters, dcdecrypters []crypto.Decrypter
+	var ecpolicy, ecdcpolicy, dcpolicy *policy.Policy
+	var eclimits, ecdclimits, dclimits *limits.Limits
+	var ecdctokensource, dctokensource oidc.TokenSource
+	var ecdcsvidsource, dcsvidsource spiffe.Source
+	var ecdcverification, dcverification *verify.Verification
+	var ecdcauthorization, dcauthorization *authz.Authorization
+	var ecdckeylookup, dckeylookup *keyhelper.Lookup
+	var ecdcremotekeys, dcremotekeys *remotekeys.Resolver
+	var ecdcgpgdecrypter, dcgpgdecrypter GPGDecrypter
+	var ecdckeywrappers, dckeywrappers, ecdcdeniedkeywrappers, dcdeniedkeywrappers []string
+	var ecdctenant, dctenant string
+	var ecdcmixedtenants, dcmixedtenants bool
+	var ecdcsecrets, dcsecrets []*lockedSecrets
+	var ecrand io.Reader
+	var ecpartialfailures PartialFailureMode
+	var ecminwrappedkeys, ecparallelism int
+	var ecbinddigest bool
+	var eccipher blockcipher.LayerCipherType
+	var ecdcmaxmemory, dcmaxmemory int64
+	var ecdcbuffersize, dcbuffersize int
+	var ecprogress, ecdcprogress, dcprogress ProgressFunc
+	var ecdcbounddigests, dcbounddigests map[digest.Digest]digest.Digest
 
 	for _, cc := range ccs {
 		if ec := cc.EncryptConfig; ec != nil {
 			addToMap(ecparam, ec.Parameters)
+			ecpolicy = intersectPolicies(ecpolicy, ec.Policy)
+			if ecrand == nil {
+				ecrand = ec.Rand
+			}
+			if eclimits == nil {
+				eclimits = ec.Limits
+			}
+			if ecpartialfailures == FailFast {
+				ecpartialfailures = ec.PartialFailures
+			}
+			if ec.MinWrappedKeys > ecminwrappedkeys {
+				ecminwrappedkeys = ec.MinWrappedKeys
+			}
+			if eccipher == "" {
+				eccipher = ec.Cipher
+			}
+			if ec.Parallelism > ecparallelism {
+				ecparallelism = ec.Parallelism
+			}
+			ecbinddigest = ecbinddigest || ec.BindDigest
+			if ecprogress == nil {
+				ecprogress = ec.Progress
+			}
 			addToMap(ecdcparam, ec.DecryptConfig.Parameters)
+			ecdcdecrypters = append(ecdcdecrypters, ec.DecryptConfig.Decrypters...)
+			ecdcpolicy = intersectPolicies(ecdcpolicy, ec.DecryptConfig.Policy)
+			ecdcmaxmemory = minLimit(ecdcmaxmemory, ec.DecryptConfig.MaxMemory)
+			if ecdcbuffersize == 0 {
+				ecdcbuffersize = ec.DecryptConfig.BufferSize
+			}
+			if ecdcprogress == nil {
+				ecdcprogress = ec.DecryptConfig.Progress
+			}
+			ecdcbounddigests = addBoundDigests(ecdcbounddigests, ec.DecryptConfig.BoundDigests)
+			if ecdclimits == nil {
+				ecdclimits = ec.DecryptConfig.Limits
+			}
+			if ecdctokensource == nil {
+				ecdctokensource = ec.DecryptConfig.IDTokenSource
+			}
+			if ecdcsvidsource == nil {
+				ecdcsvidsource = ec.DecryptConfig.SVIDSource
+			}
+			if ecdcverification == nil {
+				ecdcverification = ec.DecryptConfig.Verification
+			}
+			if ecdcauthorization == nil {
+				ecdcauthorization = ec.DecryptConfig.Authorization
+			}
+			if ecdckeylookup == nil {
+				ecdckeylookup = ec.DecryptConfig.KeyLookup
+			}
+			if ecdcremotekeys == nil {
+				ecdcremotekeys = ec.DecryptConfig.RemoteKeys
+			}
+			if ecdcgpgdecrypter == nil {
+				ecdcgpgdecrypter = ec.DecryptConfig.GPGDecrypter
+			}
+			if len(ecdckeywrappers) == 0 {
+				ecdckeywrappers = ec.DecryptConfig.KeyWrappers
+			}
+			ecdcdeniedkeywrappers = append(ecdcdeniedkeywrappers, ec.DecryptConfig.DeniedKeyWrappers...)
+			ecdctenant, ecdcmixedtenants = combineTenants(ecdctenant, ecdcmixedtenants, &ec.DecryptConfig)
+			ecdcsecrets = combineSecrets(ecdcsecrets, &ec.DecryptConfig)
 		}
 
 		if dc := cc.DecryptConfig; dc != nil {
 			addToMap(dcparam, dc.Parameters)
+			dcdecrypters = append(dcdecrypters, dc.Decrypters...)
+			dcpolicy = intersectPolicies(dcpolicy, dc.Policy)
+			dcmaxmemory = minLimit(dcmaxmemory, dc.MaxMemory)
+			if dcbuffersize == 0 {
+				dcbuffersize = dc.BufferSize
+			}
+			if dcprogress == nil {
+				dcprogress = dc.Progress
+			}
+			dcbounddigests = addBoundDigests(dcbounddigests, dc.BoundDigests)
+			if dclimits == nil {
+				dclimits = dc.Limits
+			}
+			if dctokensource == nil {
+				dctokensource = dc.IDTokenSource
+			}
+			if dcsvidsource == nil {
+				dcsvidsource = dc.SVIDSource
+			}
+			if dcverification == nil {
+				dcverification = dc.Verification
+			}
+			if dcauthorization == nil {
+				dcauthorization = dc.Authorization
+			}
+			if dckeylookup == nil {
+				dckeylookup = dc.KeyLookup
+			}
+			if dcremotekeys == nil {
+				dcremotekeys = dc.RemoteKeys
+			}
+			if dcgpgdecrypter == nil {
+				dcgpgdecrypter = dc.GPGDecrypter
+			}
+			if len(dckeywrappers) == 0 {
+				dckeywrappers = dc.KeyWrappers
+			}
+			dcdeniedkeywrappers = append(dcdeniedkeywrappers, dc.DeniedKeyWrappers...)
+			dctenant, dcmixedtenants = combineTenants(dctenant, dcmixedtenants, dc)
+			dcsecrets = combineSecrets(dcsecrets, dc)
 		}
 	}
 
 	return CryptoConfig{
 		EncryptConfig: &EncryptConfig{
-			Parameters: ecparam,
+			Parameters:      ecparam,
+			Policy:          ecpolicy,
+			Rand:            ecrand,
+			Limits:          eclimits,
+			PartialFailures: ecpartialfailures,
+			MinWrappedKeys:  ecminwrappedkeys,
+			Cipher:          eccipher,
+			Parallelism:     ecparallelism,
+			BindDigest:      ecbinddigest,
+			Progress:        ecprogress,
 			DecryptConfig: DecryptConfig{
-				Parameters: ecdcparam,
+				Parameters:        ecdcparam,
+				Decrypters:        ecdcdecrypters,
+				Policy:            ecdcpolicy,
+				MaxMemory:         ecdcmaxmemory,
+				BufferSize:        ecdcbuffersize,
+				Progress:          ecdcprogress,
+				BoundDigests:      ecdcbounddigests,
+				Limits:            ecdclimits,
+				IDTokenSource:     ecdctokensource,
+				SVIDSource:        ecdcsvidsource,
+				Verification:      ecdcverification,
+				Authorization:     ecdcauthorization,
+				KeyLookup:         ecdckeylookup,
+				RemoteKeys:        ecdcremotekeys,
+				GPGDecrypter:      ecdcgpgdecrypter,
+				KeyWrappers:       ecdckeywrappers,
+				DeniedKeyWrappers: ecdcdeniedkeywrappers,
+				Tenant:            ecdctenant,
+				mixedTenants:      ecdcmixedtenants,
+				secrets:           ecdcsecrets,
 			},
 		},
 		DecryptConfig: &DecryptConfig{
-			Parameters: dcparam,
+			Parameters:        dcparam,
+			Decrypters:        dcdecrypters,
+			Policy:            dcpolicy,
+			MaxMemory:         dcmaxmemory,
+			BufferSize:        dcbuffersize,
+			Progress:          dcprogress,
+			BoundDigests:      dcbounddigests,
+			Limits:            dclimits,
+			IDTokenSource:     dctokensource,
+			SVIDSource:        dcsvidsource,
+			Verification:      dcverification,
+			Authorization:     dcauthorization,
+			KeyLookup:         dckeylookup,
+			RemoteKeys:        dcremotekeys,
+			GPGDecrypter:      dcgpgdecrypter,
+			KeyWrappers:       dckeywrappers,
+			DeniedKeyWrappers: dcdeniedkeywrappers,
+			Tenant:            dctenant,
+			mixedTenants:      dcmixedtenants,
+			secrets:           dcsecrets,
 		},
 	}
 
@@ -100,9 +468,101 @@ func CombineCryptoConfigs(ccs []CryptoConfig) CryptoConfig {
 func (ec *EncryptConfig) AttachDecryptConfig(dc *DecryptConfig) {
 	if dc != nil {
 		addToMap(ec.DecryptConfig.Parameters, dc.Parameters)
+		ec.DecryptConfig.Decrypters = append(ec.DecryptConfig.Decrypters, dc.Decrypters...)
+		ec.DecryptConfig.Policy = intersectPolicies(ec.DecryptConfig.Policy, dc.Policy)
+		ec.DecryptConfig.MaxMemory = minLimit(ec.DecryptConfig.MaxMemory, dc.MaxMemory)
+		if ec.DecryptConfig.BufferSize == 0 {
+			ec.DecryptConfig.BufferSize = dc.BufferSize
+		}
+		if ec.DecryptConfig.Progress == nil {
+			ec.DecryptConfig.Progress = dc.Progress
+		}
+		ec.DecryptConfig.BoundDigests = addBoundDigests(ec.DecryptConfig.BoundDigests, dc.BoundDigests)
+		if ec.DecryptConfig.Limits == nil {
+			ec.DecryptConfig.Limits = dc.Limits
+		}
+		if ec.DecryptConfig.IDTokenSource == nil {
+			ec.DecryptConfig.IDTokenSource = dc.IDTokenSource
+		}
+		if ec.DecryptConfig.SVIDSource == nil {
+			ec.DecryptConfig.SVIDSource = dc.SVIDSource
+		}
+		if ec.DecryptConfig.Verification == nil {
+			ec.DecryptConfig.Verification = dc.Verification
+		}
+		if ec.DecryptConfig.Authorization == nil {
+			ec.DecryptConfig.Authorization = dc.Authorization
+		}
+		if ec.DecryptConfig.KeyLookup == nil {
+			ec.DecryptConfig.KeyLookup = dc.KeyLookup
+		}
+		if ec.DecryptConfig.RemoteKeys == nil {
+			ec.DecryptConfig.RemoteKeys = dc.RemoteKeys
+		}
+		if ec.DecryptConfig.GPGDecrypter == nil {
+			ec.DecryptConfig.GPGDecrypter = dc.GPGDecrypter
+		}
+		if len(ec.DecryptConfig.KeyWrappers) == 0 {
+			ec.DecryptConfig.KeyWrappers = dc.KeyWrappers
+		}
+		ec.DecryptConfig.DeniedKeyWrappers = append(ec.DecryptConfig.DeniedKeyWrappers, dc.DeniedKeyWrappers...)
+		ec.DecryptConfig.Tenant, ec.DecryptConfig.mixedTenants = combineTenants(ec.DecryptConfig.Tenant, ec.DecryptConfig.mixedTenants, dc)
 	}
 }
 
+// GetPolicy returns the Policy of the EncryptConfig or the global policy if it
+// has none
+func (ec *EncryptConfig) GetPolicy() *policy.Policy {
+	if ec.Policy != nil {
+		return ec.Policy
+	}
+	return policy.P()
+}
+
+// GetRand returns the source of randomness of the EncryptConfig or crypto/rand
+// if it has none
+func (ec *EncryptConfig) GetRand() io.Reader {
+	if ec.Rand != nil {
+		return ec.Rand
+	}
+	return rand.Reader
+}
+
+// GetCipher returns the block cipher for encrypting layers
+func (ec *EncryptConfig) GetCipher() blockcipher.LayerCipherType {
+	if ec.Cipher != "" {
+		return ec.Cipher
+	}
+	return blockcipher.AES256CTR
+}
+
+// GetLimits returns the Limits of the EncryptConfig or the global limits if
+// it has none
+func (ec *EncryptConfig) GetLimits() *limits.Limits {
+	if ec.Limits != nil {
+		return ec.Limits
+	}
+	return limits.L()
+}
+
+// GetPolicy returns the Policy of the DecryptConfig or the global policy if it
+// has none
+func (dc *DecryptConfig) GetPolicy() *policy.Policy {
+	if dc.Policy != nil {
+		return dc.Policy
+	}
+	return policy.P()
+}
+
+// GetLimits returns the Limits of the DecryptConfig or the global limits if
+// it has none
+func (dc *DecryptConfig) GetLimits() *limits.Limits {
+	if dc.Limits != nil {
+		return dc.Limits
+	}
+	return limits.L()
+}
+
 func addToMap(orig map[string][][]byte, add map[string][][]byte) {
 	for k, v := range add {
 		if ov, ok := orig[k]; ok {
@@ -112,3 +572,67 @@ func addToMap(orig map[string][][]byte, add map[string][][]byte) {
 		}
 	}
 }
+
+// addBoundDigests adds the bound digests of add to those of orig, which it
+// returns; a layer that the two map to different digests is mapped to the
+// empty digest, so that it cannot be decrypted
+func addBoundDigests(orig, add map[digest.Digest]digest.Digest) map[digest.Digest]digest.Digest {
+	if len(add) == 0 {
+		return orig
+	}
+	combined := make(map[digest.Digest]digest.Digest, len(orig)+len(add))
+	for k, v := range orig {
+		combined[k] = v
+	}
+	for k, v := range add {
+		if ov, ok := combined[k]; ok && ov != v {
+			v = ""
+		}
+		combined[k] = v
+	}
+	return combined
+}
+
+// intersectPolicies returns the intersection of two policies of
+// configurations that are combined; a nil Policy, which stands for the global
+// policy, does not restrict the other one
+func intersectPolicies(a, b *policy.Policy) *policy.Policy {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	}
+	return a.Intersect(b)
+}
+
+// combineTenants returns the tenant of the combination of a configuration of
+// the given tenant with the DecryptConfig and whether the combination mixes
+// tenants; configurations without tenant can be combined with any tenant
+func combineTenants(tenant string, mixed bool, dc *DecryptConfig) (string, bool) {
+	mixed = mixed || dc.mixedTenants
+	switch {
+	case dc.Tenant == "":
+		return tenant, mixed
+	case tenant == "":
+		return dc.Tenant, mixed
+	}
+	return tenant, mixed || tenant != dc.Tenant
+}
+
+// CheckTenant returns an error if the DecryptConfig was combined from
+// configurations of different tenants, whose keys must not be used together
+func (dc *DecryptConfig) CheckTenant() error {
+	if dc.mixedTenants {
+		return fmt.Errorf("the decryption configuration combines keys of different tenants: %w", errdefs.ErrConfiguration)
+	}
+	return nil
+}
+
+// minLimit returns the smaller one of two limits where 0 means no limit
+func minLimit(a, b int64) int64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
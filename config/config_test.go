@@ -0,0 +1,105 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package config
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/containers/ocicrypt/policy"
+)
+
+func TestCombineCryptoConfigsPolicies(t *testing.T) {
+	p1 := &policy.Policy{
+		AllowedLegacyAlgorithms: []policy.Algorithm{policy.RSAOAEPSHA1, policy.LegacyLayout},
+		MinRSAKeySize:           2048,
+	}
+	p2 := &policy.Policy{
+		AllowedLegacyAlgorithms: []policy.Algorithm{policy.RSAPKCS1v15, policy.LegacyLayout},
+		MinRSAKeySize:           3072,
+	}
+	cc := CombineCryptoConfigs([]CryptoConfig{
+		{
+			EncryptConfig: &EncryptConfig{Policy: p1, DecryptConfig: DecryptConfig{Policy: p1}},
+			DecryptConfig: &DecryptConfig{Policy: p1},
+		},
+		{
+			DecryptConfig: &DecryptConfig{},
+		},
+		{
+			EncryptConfig: &EncryptConfig{Policy: p2, DecryptConfig: DecryptConfig{Policy: p2}},
+			DecryptConfig: &DecryptConfig{Policy: p2},
+		},
+	})
+	for name, p := range map[string]*policy.Policy{
+		"EncryptConfig":                  cc.EncryptConfig.Policy,
+		"DecryptConfig of EncryptConfig": cc.EncryptConfig.DecryptConfig.Policy,
+		"DecryptConfig":                  cc.DecryptConfig.Policy,
+	} {
+		if p == nil {
+			t.Fatalf("%s: policies were dropped", name)
+		}
+		if p.Allows(policy.RSAOAEPSHA1) || p.Allows(policy.RSAPKCS1v15) || !p.Allows(policy.LegacyLayout) {
+			t.Fatalf("%s: policy allows %v instead of the common legacy algorithms", name, p.AllowedLegacyAlgorithms)
+		}
+		if p.MinRSAKeySize != 3072 {
+			t.Fatalf("%s: minimum RSA key size is %d instead of the larger one", name, p.MinRSAKeySize)
+		}
+	}
+
+	ec := &EncryptConfig{DecryptConfig: DecryptConfig{Policy: p1}}
+	ec.AttachDecryptConfig(&DecryptConfig{Policy: p2})
+	if p := ec.DecryptConfig.Policy; p.Allows(policy.RSAOAEPSHA1) || p.MinRSAKeySize != 3072 {
+		t.Fatalf("attached policy was dropped: %+v", p)
+	}
+}
+
+func TestLockSecrets(t *testing.T) {
+	privKey := []byte("private key")
+	cc, err := DecryptWithPrivKeys([][]byte{privKey}, [][]byte{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := cc.DecryptConfig
+	combined := CombineCryptoConfigs([]CryptoConfig{cc}).DecryptConfig
+	if err := dc.LockSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	// the byte arrays passed in and the configurations sharing them keep
+	// the keys
+	if !bytes.Equal(privKey, []byte("private key")) || !bytes.Equal(combined.Parameters["privkeys"][0], privKey) {
+		t.Fatal("LockSecrets modified the private keys of the caller")
+	}
+	if !bytes.Equal(dc.Parameters["privkeys"][0], privKey) {
+		t.Fatal("LockSecrets did not copy the private keys")
+	}
+
+	// a combined configuration and a running operation keep the locked
+	// memory after the DecryptConfig is wiped
+	lockedCombined := CombineCryptoConfigs([]CryptoConfig{{DecryptConfig: dc}}).DecryptConfig
+	release := dc.HoldSecrets()
+	copied := *dc
+	dc.WipeSecrets()
+	if len(dc.Parameters["privkeys"]) != 0 || len(copied.Parameters["privkeys"]) != 0 {
+		t.Fatal("WipeSecrets did not remove the private keys")
+	}
+	release()
+	if !bytes.Equal(lockedCombined.Parameters["privkeys"][0], privKey) {
+		t.Fatal("The combined configuration lost the private key")
+	}
+	lockedCombined.WipeSecrets()
+}
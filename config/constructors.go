@@ -17,9 +17,14 @@
 package config
 
 import (
+	"fmt"
+	"strconv"
+
 	"github.com/containers/ocicrypt/crypto/pkcs11"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/oidc"
+	"github.com/containers/ocicrypt/spiffe"
 
-	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
 
@@ -39,6 +44,30 @@ func EncryptWithJwe(pubKeys [][]byte) (CryptoConfig, error) {
 	}, nil
 }
 
+// EncryptWithJweAlgorithms returns a CryptoConfig that chooses the algorithms
+// the jwe keywrapper uses: for each public key, the first of the key
+// management algorithms, such as "RSA-OAEP-256" or "ECDH-ES+A256KW", that can
+// be used with the key, and the content encryption algorithm, such as
+// "A256GCM". An empty list or string keeps the defaults.
+func EncryptWithJweAlgorithms(keyAlgorithms []string, contentEncryption string) (CryptoConfig, error) {
+	dc := DecryptConfig{}
+	ep := map[string][][]byte{}
+	for _, alg := range keyAlgorithms {
+		ep["jwe-key-algorithms"] = append(ep["jwe-key-algorithms"], []byte(alg))
+	}
+	if contentEncryption != "" {
+		ep["jwe-content-encryption"] = [][]byte{[]byte(contentEncryption)}
+	}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
 // EncryptWithPkcs7 returns a CryptoConfig to encrypt with pkcs7 x509 certs
 func EncryptWithPkcs7(x509s [][]byte) (CryptoConfig, error) {
 	dc := DecryptConfig{}
@@ -56,6 +85,66 @@ func EncryptWithPkcs7(x509s [][]byte) (CryptoConfig, error) {
 	}, nil
 }
 
+// EncryptWithCMS returns a CryptoConfig to encrypt with x509 certs using CMS
+// authenticated enveloped data with RSA-OAEP or ECDH and AES-256-GCM instead
+// of legacy PKCS7 enveloped data
+func EncryptWithCMS(x509s [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{}
+
+	ep := map[string][][]byte{
+		"x509s":      x509s,
+		"pkcs7-mode": {[]byte("cms")},
+	}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// EncryptWithX509Roots returns a CryptoConfig that makes the pkcs7 keywrapper
+// verify the certificates of the recipients against the given CA certificates
+// before encrypting; the certificates must not be expired, must chain up to
+// one of the CAs through the intermediate certificates in their bundles and
+// must allow key encipherment or key agreement
+func EncryptWithX509Roots(roots [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{}
+
+	ep := map[string][][]byte{
+		"x509-roots": roots,
+	}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// EncryptWithX509SkipVerify returns a CryptoConfig that makes the pkcs7
+// keywrapper skip the verification of the certificates of the recipients
+// even if CA certificates are given
+func EncryptWithX509SkipVerify() (CryptoConfig, error) {
+	dc := DecryptConfig{}
+
+	ep := map[string][][]byte{
+		"x509-skip-verify": {[]byte("true")},
+	}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
 // EncryptWithGpg returns a CryptoConfig to encrypt with configured gpg parameters
 func EncryptWithGpg(gpgRecipients [][]byte, gpgPubRingFile []byte) (CryptoConfig, error) {
 	dc := DecryptConfig{}
@@ -73,6 +162,25 @@ func EncryptWithGpg(gpgRecipients [][]byte, gpgPubRingFile []byte) (CryptoConfig
 	}, nil
 }
 
+// EncryptWithGpgSubkeys returns a CryptoConfig to wrap the layer key for the
+// encryption subkeys with the given fingerprints rather than for the subkeys
+// that would be chosen for the gpg recipients; it is combined with the
+// CryptoConfig of EncryptWithGpg
+func EncryptWithGpgSubkeys(fingerprints [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{}
+	ep := map[string][][]byte{
+		"gpg-subkeys": fingerprints,
+	}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
 // EncryptWithPkcs11 returns a CryptoConfig to encrypt with configured pkcs11 parameters
 func EncryptWithPkcs11(pkcs11Config *pkcs11.Pkcs11Config, pkcs11Pubkeys, pkcs11Yamls [][]byte) (CryptoConfig, error) {
 	dc := DecryptConfig{}
@@ -80,11 +188,11 @@ func EncryptWithPkcs11(pkcs11Config *pkcs11.Pkcs11Config, pkcs11Pubkeys, pkcs11Y
 
 	if len(pkcs11Yamls) > 0 {
 		if pkcs11Config == nil {
-			return CryptoConfig{}, errors.New("pkcs11Config must not be nil")
+			return CryptoConfig{}, fmt.Errorf("pkcs11Config must not be nil: %w", errdefs.ErrConfiguration)
 		}
 		p11confYaml, err := yaml.Marshal(pkcs11Config)
 		if err != nil {
-			return CryptoConfig{}, errors.Wrapf(err, "Could not marshal Pkcs11Config to Yaml")
+			return CryptoConfig{}, fmt.Errorf("Could not marshal Pkcs11Config to Yaml: %w", err)
 		}
 
 		dc = DecryptConfig{
@@ -107,10 +215,247 @@ func EncryptWithPkcs11(pkcs11Config *pkcs11.Pkcs11Config, pkcs11Pubkeys, pkcs11Y
 	}, nil
 }
 
+// EncryptWithKMSv2 returns a CryptoConfig to encrypt with the Kubernetes KMS v2
+// plugins listening at the given endpoints, such as unix:///run/kms.sock
+func EncryptWithKMSv2(endpoints [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{}
+	ep := map[string][][]byte{
+		"kmsv2-endpoints": endpoints,
+	}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// EncryptWithGCPKMS returns a CryptoConfig to encrypt with the Google Cloud KMS
+// keys with the given names, which may be prefixed by gcpkms://; symmetric keys
+// are given as projects/.../cryptoKeys/<key>, asymmetric ones by the name of a
+// key version
+func EncryptWithGCPKMS(keyNames [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{}
+	ep := map[string][][]byte{
+		"gcp-kms-keys": keyNames,
+	}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// EncryptWithAzureKeyVault returns a CryptoConfig to encrypt with the Azure Key
+// Vault keys with the given IDs, as in https://myvault.vault.azure.net/keys/mykey,
+// whose https:// may be replaced by azurekv://
+func EncryptWithAzureKeyVault(keyIDs [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{}
+	ep := map[string][][]byte{
+		"azure-kv-keys": keyIDs,
+	}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// EncryptWithVaultTransit returns a CryptoConfig to encrypt with the keys of the
+// transit secrets engine of HashiCorp Vault with the given references, as in
+// vault.example.com:8200/transit/keys/layers, which may be prefixed by
+// vault-transit://
+func EncryptWithVaultTransit(keyRefs [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{}
+	ep := map[string][][]byte{
+		"vault-transit-keys": keyRefs,
+	}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// EncryptWithTPM returns a CryptoConfig to seal layer keys to the TPM 2.0
+// storage keys with the given public keys, usually those of the SRKs of the
+// hosts that may decrypt. If pcrs are given, as in sha256:7=<hex digest>, the
+// sealed keys are bound to these PCR values.
+func EncryptWithTPM(pubKeys [][]byte, pcrs [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{}
+	ep := map[string][][]byte{
+		"tpm-pubkeys": pubKeys,
+	}
+	if len(pcrs) > 0 {
+		ep["tpm-pcrs"] = pcrs
+	}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// EncryptWithAWSKMS returns a CryptoConfig to encrypt with the AWS KMS keys
+// with the given ARNs, which may be prefixed by aws-kms://
+func EncryptWithAWSKMS(keyARNs [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{}
+	ep := map[string][][]byte{
+		"aws-kms-keys": keyARNs,
+	}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// EncryptWithKeyless returns a CryptoConfig to encrypt for the rewrap service
+// with the given https URL, whose certificate must be issued by one of the
+// roots to the service identity, a URI, email address or DNS name of its
+// subject alternative names, so that it rewraps the layer keys for the
+// identities, given as '<issuer> <subject>' of OIDC ID tokens or as SPIFFE IDs
+// of X.509-SVIDs
+func EncryptWithKeyless(service, serviceIdentity []byte, roots, identities [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{}
+	ep := map[string][][]byte{
+		"keyless-services":         {service},
+		"keyless-service-identity": {serviceIdentity},
+		"keyless-roots":            roots,
+		"keyless-identities":       identities,
+	}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// EncryptWithAge returns a CryptoConfig to encrypt for age recipients, given
+// as age1... strings, as OpenSSH ed25519 or RSA public keys in authorized_keys
+// format or as recipients files with one per line
+func EncryptWithAge(recipients [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{}
+	ep := map[string][][]byte{
+		"age-recipients": recipients,
+	}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// EncryptWithHpke returns a CryptoConfig to encrypt with HPKE for X25519
+// public keys
+func EncryptWithHpke(pubKeys [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{}
+	ep := map[string][][]byte{
+		"hpke-pubkeys": pubKeys,
+	}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// EncryptWithThreshold returns a CryptoConfig to split the layer key among the
+// public keys so that the private keys of k of them are needed to decrypt
+func EncryptWithThreshold(k int, pubKeys [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{}
+	ep := map[string][][]byte{
+		"threshold-pubkeys": pubKeys,
+		"threshold-k":       {[]byte(strconv.Itoa(k))},
+	}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// EncryptWithMLKEM768X25519 returns a CryptoConfig to encrypt with HPKE for
+// MLKEM768-X25519 public keys using the experimental post-quantum keywrapper
+func EncryptWithMLKEM768X25519(pubKeys [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{}
+	ep := map[string][][]byte{
+		"mlkem768x25519-pubkeys": pubKeys,
+	}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// MinConvergentSecretSize is the minimum size of the secret of convergent
+// encryption
+const MinConvergentSecretSize = 32
+
+// EncryptWithConvergentSecret returns a CryptoConfig that makes the encryption
+// of layers convergent: the layer key and the nonces are derived from the
+// secret and the digest of the layer, so that encrypting an identical layer
+// again yields identical ciphertext. The secret must have at least
+// MinConvergentSecretSize bytes; the CryptoConfig is to be combined with the
+// ones of the recipients. The finalizer of the encryption fails with
+// ErrIntegrity if the plaintext does not match the digest of the layer, in
+// which case the ciphertext already read must be discarded since it was
+// encrypted with the key and nonces of another plaintext.
+func EncryptWithConvergentSecret(secret []byte) (CryptoConfig, error) {
+	if len(secret) < MinConvergentSecretSize {
+		return CryptoConfig{}, fmt.Errorf("the convergent secret must have at least %d bytes: %w", MinConvergentSecretSize, errdefs.ErrConfiguration)
+	}
+	dc := DecryptConfig{}
+	ep := map[string][][]byte{
+		"convergent-secret": {secret},
+	}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
 // DecryptWithPrivKeys returns a CryptoConfig to decrypt with configured private keys
 func DecryptWithPrivKeys(privKeys [][]byte, privKeysPasswords [][]byte) (CryptoConfig, error) {
 	if len(privKeys) != len(privKeysPasswords) {
-		return CryptoConfig{}, errors.New("Length of privKeys should match length of privKeysPasswords")
+		return CryptoConfig{}, fmt.Errorf("Length of privKeys should match length of privKeysPasswords: %w", errdefs.ErrConfiguration)
 	}
 
 	dc := DecryptConfig{
@@ -150,6 +495,114 @@ func DecryptWithX509s(x509s [][]byte) (CryptoConfig, error) {
 	}, nil
 }
 
+// DecryptWithMasterKeys returns a CryptoConfig to decrypt the layers whose
+// keys are derived from one of the master keys
+func DecryptWithMasterKeys(masterKeys [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{
+		Parameters: map[string][][]byte{
+			"masterkeys": masterKeys,
+		},
+	}
+
+	ep := map[string][][]byte{}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// DecryptWithAgeIdentities returns a CryptoConfig to decrypt with age
+// identities, given as AGE-SECRET-KEY-1... strings, identity files as written
+// by age-keygen or unencrypted OpenSSH ed25519 or RSA private keys
+func DecryptWithAgeIdentities(identities [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{
+		Parameters: map[string][][]byte{
+			"age-identities": identities,
+		},
+	}
+
+	ep := map[string][][]byte{}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// DecryptWithSSHAgent returns a CryptoConfig to decrypt with the age
+// identities derived from the keys of the SSH agent at SSH_AUTH_SOCK with the
+// given public keys in authorized_keys format; layer keys must have been
+// encrypted for the recipients returned by age.SSHAgentRecipient
+func DecryptWithSSHAgent(pubKeys [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{
+		Parameters: map[string][][]byte{
+			"age-ssh-agent": pubKeys,
+		},
+	}
+
+	ep := map[string][][]byte{}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// DecryptWithHpkePrivKeys returns a CryptoConfig to decrypt with HPKE using
+// X25519 private keys
+func DecryptWithHpkePrivKeys(privKeys [][]byte, privKeysPasswords [][]byte) (CryptoConfig, error) {
+	if len(privKeys) != len(privKeysPasswords) {
+		return CryptoConfig{}, fmt.Errorf("Length of privKeys should match length of privKeysPasswords: %w", errdefs.ErrConfiguration)
+	}
+
+	dc := DecryptConfig{
+		Parameters: map[string][][]byte{
+			"hpke-privkeys":           privKeys,
+			"hpke-privkeys-passwords": privKeysPasswords,
+		},
+	}
+
+	ep := map[string][][]byte{}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// DecryptWithMLKEM768X25519 returns a CryptoConfig to decrypt with HPKE using
+// MLKEM768-X25519 private keys
+func DecryptWithMLKEM768X25519(privKeys [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{
+		Parameters: map[string][][]byte{
+			"mlkem768x25519-privkeys": privKeys,
+		},
+	}
+
+	ep := map[string][][]byte{}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
 // DecryptWithGpgPrivKeys returns a CryptoConfig to decrypt with configured gpg private keys
 func DecryptWithGpgPrivKeys(gpgPrivKeys, gpgPrivKeysPwds [][]byte) (CryptoConfig, error) {
 	dc := DecryptConfig{
@@ -170,11 +623,33 @@ func DecryptWithGpgPrivKeys(gpgPrivKeys, gpgPrivKeysPwds [][]byte) (CryptoConfig
 	}, nil
 }
 
+// DecryptWithGPGDecrypter returns a CryptoConfig to decrypt the pgp wrapped
+// keys of layers with the secret keys of the GPGDecrypter, such as keys on
+// OpenPGP smartcards that gpg cannot export
+func DecryptWithGPGDecrypter(gpgDecrypter GPGDecrypter) (CryptoConfig, error) {
+	if gpgDecrypter == nil {
+		return CryptoConfig{}, fmt.Errorf("gpgDecrypter must not be nil: %w", errdefs.ErrConfiguration)
+	}
+	dc := DecryptConfig{
+		GPGDecrypter: gpgDecrypter,
+	}
+
+	ep := map[string][][]byte{}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
 // DecryptWithPkcs11Yaml returns a CryptoConfig to decrypt with pkcs11 YAML formatted key files
 func DecryptWithPkcs11Yaml(pkcs11Config *pkcs11.Pkcs11Config, pkcs11Yamls [][]byte) (CryptoConfig, error) {
 	p11confYaml, err := yaml.Marshal(pkcs11Config)
 	if err != nil {
-		return CryptoConfig{}, errors.Wrapf(err, "Could not marshal Pkcs11Config to Yaml")
+		return CryptoConfig{}, fmt.Errorf("Could not marshal Pkcs11Config to Yaml: %w", err)
 	}
 
 	dc := DecryptConfig{
@@ -194,3 +669,203 @@ func DecryptWithPkcs11Yaml(pkcs11Config *pkcs11.Pkcs11Config, pkcs11Yamls [][]by
 		DecryptConfig: &dc,
 	}, nil
 }
+
+// DecryptWithKMSv2 returns a CryptoConfig to decrypt with the Kubernetes KMS v2
+// plugins listening at the given endpoints
+func DecryptWithKMSv2(endpoints [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{
+		Parameters: map[string][][]byte{
+			"kmsv2-endpoints": endpoints,
+		},
+	}
+
+	ep := map[string][][]byte{}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// DecryptWithGCPKMS returns a CryptoConfig to decrypt with the Google Cloud KMS
+// keys with the given names; the name of an asymmetric key stands for all of
+// its versions
+func DecryptWithGCPKMS(keyNames [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{
+		Parameters: map[string][][]byte{
+			"gcp-kms-keys": keyNames,
+		},
+	}
+
+	ep := map[string][][]byte{}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// DecryptWithAzureKeyVault returns a CryptoConfig to decrypt with the Azure Key
+// Vault keys with the given IDs; the ID of a key without a version stands for
+// all of its versions
+func DecryptWithAzureKeyVault(keyIDs [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{
+		Parameters: map[string][][]byte{
+			"azure-kv-keys": keyIDs,
+		},
+	}
+
+	ep := map[string][][]byte{}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// DecryptWithVaultTransit returns a CryptoConfig to decrypt with the keys of
+// the transit secrets engine of HashiCorp Vault with the given references
+func DecryptWithVaultTransit(keyRefs [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{
+		Parameters: map[string][][]byte{
+			"vault-transit-keys": keyRefs,
+		},
+	}
+
+	ep := map[string][][]byte{}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// DecryptWithTPM returns a CryptoConfig to unseal layer keys with the TPM 2.0
+// at the given device, or the default device if it is empty. The storage keys
+// are given as srk or srk-ecc for the SRK templates, as persistent handles
+// such as 0x81000001 or as the contents of context files saved by tpm2-tools.
+func DecryptWithTPM(device string, keys [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{
+		Parameters: map[string][][]byte{
+			"tpm-keys": keys,
+		},
+	}
+	if device != "" {
+		dc.Parameters["tpm-device"] = [][]byte{[]byte(device)}
+	}
+
+	ep := map[string][][]byte{}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// DecryptWithAWSKMS returns a CryptoConfig to decrypt with the AWS KMS keys or
+// aliases with the given ARNs
+func DecryptWithAWSKMS(keyARNs [][]byte) (CryptoConfig, error) {
+	dc := DecryptConfig{
+		Parameters: map[string][][]byte{
+			"aws-kms-keys": keyARNs,
+		},
+	}
+
+	ep := map[string][][]byte{}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// DecryptWithKeyless returns a CryptoConfig to decrypt with the rewrap services
+// with the given URLs, which are trusted with the ID tokens of the token source
+func DecryptWithKeyless(services [][]byte, tokenSource oidc.TokenSource) (CryptoConfig, error) {
+	if tokenSource == nil {
+		return CryptoConfig{}, fmt.Errorf("tokenSource must not be nil: %w", errdefs.ErrConfiguration)
+	}
+	dc := DecryptConfig{
+		Parameters: map[string][][]byte{
+			"keyless-services": services,
+		},
+		IDTokenSource: tokenSource,
+	}
+
+	ep := map[string][][]byte{}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// DecryptWithKeylessSVID returns a CryptoConfig to decrypt with the rewrap
+// services with the given URLs, which authenticate the workload by the SPIFFE
+// ID of the X.509-SVID of the source, presented as client certificate
+func DecryptWithKeylessSVID(services [][]byte, source spiffe.Source) (CryptoConfig, error) {
+	if source == nil {
+		return CryptoConfig{}, fmt.Errorf("source must not be nil: %w", errdefs.ErrConfiguration)
+	}
+	dc := DecryptConfig{
+		Parameters: map[string][][]byte{
+			"keyless-services": services,
+		},
+		SVIDSource: source,
+	}
+
+	ep := map[string][][]byte{}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
+
+// AuthenticateWithSVID returns a CryptoConfig that presents the X.509-SVID of
+// the source to the key services that ask for a client certificate when
+// layer keys are wrapped or unwrapped, so that they can authenticate the
+// workload by its SPIFFE ID
+func AuthenticateWithSVID(source spiffe.Source) (CryptoConfig, error) {
+	if source == nil {
+		return CryptoConfig{}, fmt.Errorf("source must not be nil: %w", errdefs.ErrConfiguration)
+	}
+	dc := DecryptConfig{
+		Parameters: map[string][][]byte{},
+		SVIDSource: source,
+	}
+
+	ep := map[string][][]byte{}
+
+	return CryptoConfig{
+		EncryptConfig: &EncryptConfig{
+			Parameters:    ep,
+			DecryptConfig: dc,
+		},
+		DecryptConfig: &dc,
+	}, nil
+}
@@ -0,0 +1,329 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/ocicrypt/config/pkcs11config"
+	"github.com/containers/ocicrypt/crypto/pkcs11"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/utils"
+
+	"gopkg.in/yaml.v2"
+)
+
+// recipientsFile is the document read by LoadCryptoConfigFromBytes
+type recipientsFile struct {
+	// Recipients are given as '<protocol>:<value>' like on the command
+	// line of imgcrypt: jwe:<public key file>, pkcs7:<certificate file>,
+	// pgp:<name or email address>, pkcs11:<public key or yaml file>,
+	// kmsv2:<endpoint>, age:<age1... recipient, ssh-ed25519 or ssh-rsa
+	// public key or recipients file>,
+	// hpke:<X25519 public key file>, mlkem768x25519:<public key file>,
+	// aws-kms://<key ARN>, gcpkms://<key or key version name>,
+	// azurekv://<vault host>/keys/<key name>[/<version>] and
+	// vault-transit://<Vault host>/<mount path>/keys/<key name>
+	Recipients []string `yaml:"recipients"`
+	// Keys are the files of the private keys, gpg secret key rings, pkcs11
+	// yaml files, age identities and certificates for decrypting
+	Keys []recipientsFileKey `yaml:"keys"`
+	// GPGPubRingFile is the gpg public key ring holding the keys of the
+	// pgp recipients, such as the pubring.kbx or pubring.gpg of gpg
+	GPGPubRingFile string `yaml:"gpgPubRingFile"`
+	// Pkcs11Config is the file of the pkcs11 configuration; if empty, the
+	// configuration of the user is used
+	Pkcs11Config string `yaml:"pkcs11Config"`
+}
+
+// recipientsFileKey is a key file and its password
+type recipientsFileKey struct {
+	Path         string `yaml:"path"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"passwordFile"`
+}
+
+// LoadCryptoConfigFromFile reads a recipients file, see
+// LoadCryptoConfigFromBytes; relative paths in it are relative to the
+// directory of the file
+func LoadCryptoConfigFromFile(path string) (CryptoConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return CryptoConfig{}, fmt.Errorf("could not read recipients file: %w", err)
+	}
+	return LoadCryptoConfigFromBytes(data, filepath.Dir(path))
+}
+
+// LoadCryptoConfigFromBytes returns the CryptoConfig described by a recipients
+// file in YAML or JSON, such as
+//
+//	recipients:
+//	- jwe:keys/alice.pub.pem
+//	- pkcs7:certs/bob.crt
+//	- pgp:carol@example.com
+//	- kmsv2:unix:///run/kms.sock
+//	- age:age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+//	keys:
+//	- path: ~/.ocicrypt/alice.pem
+//	  passwordFile: $CREDENTIALS_DIRECTORY/alice
+//	gpgPubRingFile: ~/.gnupg/pubring.kbx
+//
+// Environment variables and a leading ~ in paths are expanded; other relative
+// paths are relative to baseDir. The CryptoConfig is built with New and
+// validated.
+func LoadCryptoConfigFromBytes(data []byte, baseDir string) (CryptoConfig, error) {
+	var rf recipientsFile
+	if err := yaml.UnmarshalStrict(data, &rf); err != nil {
+		return CryptoConfig{}, errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("could not parse recipients file: %w", err))
+	}
+	readFile := func(path string) ([]byte, error) {
+		data, err := ioutil.ReadFile(expandPath(path, baseDir))
+		if err != nil {
+			return nil, errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("recipients file: %w", err))
+		}
+		return data, nil
+	}
+
+	var (
+		opts                                        []Option
+		gpgRecipients, pubKeys, x509s, kmsEndpoints [][]byte
+		pkcs11Pubkeys, pkcs11Yamls, ageRecipients   [][]byte
+		hpkePubKeys, mlkemPubKeys, awsKMSKeys       [][]byte
+		gcpKMSKeys, azureKVKeys, vaultTransitKeys   [][]byte
+	)
+	for _, recipient := range rf.Recipients {
+		idx := strings.Index(recipient, ":")
+		if idx < 0 {
+			return CryptoConfig{}, fmt.Errorf("recipients file: invalid recipient %q: %w", recipient, errdefs.ErrConfiguration)
+		}
+		protocol, value := recipient[:idx], recipient[idx+1:]
+		if protocol == "pgp" {
+			gpgRecipients = append(gpgRecipients, []byte(value))
+			continue
+		}
+		if protocol == "kmsv2" {
+			kmsEndpoints = append(kmsEndpoints, []byte(value))
+			continue
+		}
+		if protocol == "aws-kms" {
+			awsKMSKeys = append(awsKMSKeys, []byte(recipient))
+			continue
+		}
+		if protocol == "gcpkms" {
+			gcpKMSKeys = append(gcpKMSKeys, []byte(recipient))
+			continue
+		}
+		if protocol == "azurekv" {
+			azureKVKeys = append(azureKVKeys, []byte(recipient))
+			continue
+		}
+		if protocol == "vault-transit" {
+			vaultTransitKeys = append(vaultTransitKeys, []byte(recipient))
+			continue
+		}
+		if protocol == "age" && (strings.HasPrefix(value, "age1") || strings.HasPrefix(value, "ssh-")) {
+			ageRecipients = append(ageRecipients, []byte(value))
+			continue
+		}
+		data, err := readFile(value)
+		if err != nil {
+			return CryptoConfig{}, err
+		}
+		switch {
+		case protocol == "jwe" && utils.IsPublicKey(data):
+			pubKeys = append(pubKeys, data)
+		case protocol == "pkcs7" && utils.IsCertificate(data):
+			x509s = append(x509s, data)
+		case protocol == "pkcs11" && utils.IsPkcs11PublicKey(data):
+			pkcs11Yamls = append(pkcs11Yamls, data)
+		case protocol == "pkcs11" && utils.IsPublicKey(data):
+			pkcs11Pubkeys = append(pkcs11Pubkeys, data)
+		case protocol == "age":
+			ageRecipients = append(ageRecipients, data)
+		case protocol == "hpke" && utils.IsX25519PublicKey(data):
+			hpkePubKeys = append(hpkePubKeys, data)
+		case protocol == "mlkem768x25519" && utils.IsMLKEM768X25519PublicKey(data):
+			mlkemPubKeys = append(mlkemPubKeys, data)
+		case protocol == "jwe" || protocol == "pkcs7" || protocol == "pkcs11" || protocol == "hpke" || protocol == "mlkem768x25519":
+			return CryptoConfig{}, fmt.Errorf("recipients file: %s is not a %s recipient: %w", value, protocol, errdefs.ErrKeyMaterial)
+		default:
+			return CryptoConfig{}, fmt.Errorf("recipients file: unknown protocol of recipient %q: %w", recipient, errdefs.ErrConfiguration)
+		}
+	}
+
+	var (
+		privKeys, privKeysPasswords, gpgPrivKeys, gpgPrivKeysPwds [][]byte
+		pkcs11PrivYamls, decryptX509s, ageIdentities              [][]byte
+		hpkePrivKeys, hpkePrivKeysPasswords, mlkemPrivKeys        [][]byte
+	)
+	for _, key := range rf.Keys {
+		data, err := readFile(key.Path)
+		if err != nil {
+			return CryptoConfig{}, err
+		}
+		password := []byte(key.Password)
+		if key.PasswordFile != "" {
+			if password, err = readFile(key.PasswordFile); err != nil {
+				return CryptoConfig{}, err
+			}
+			password = []byte(strings.TrimRight(string(password), "\r\n"))
+		}
+		isPrivKey, err := utils.IsPrivateKey(data, password)
+		if utils.IsPasswordError(err) {
+			return CryptoConfig{}, fmt.Errorf("recipients file: %s: %w", key.Path, err)
+		}
+		switch {
+		case utils.IsPkcs11PrivateKey(data):
+			pkcs11PrivYamls = append(pkcs11PrivYamls, data)
+		case utils.IsMLKEM768X25519PrivateKey(data):
+			mlkemPrivKeys = append(mlkemPrivKeys, data)
+		case isPrivKey && utils.IsX25519PrivateKey(data, password):
+			hpkePrivKeys = append(hpkePrivKeys, data)
+			hpkePrivKeysPasswords = append(hpkePrivKeysPasswords, password)
+			// X25519 keys also decrypt JWE recipients
+			privKeys = append(privKeys, data)
+			privKeysPasswords = append(privKeysPasswords, password)
+		case isPrivKey:
+			privKeys = append(privKeys, data)
+			privKeysPasswords = append(privKeysPasswords, password)
+		case utils.IsGPGPrivateKeyRing(data):
+			gpgPrivKeys = append(gpgPrivKeys, data)
+			gpgPrivKeysPwds = append(gpgPrivKeysPwds, password)
+		case utils.IsCertificate(data):
+			decryptX509s = append(decryptX509s, data)
+		case isAgeIdentityFile(data):
+			ageIdentities = append(ageIdentities, data)
+		default:
+			return CryptoConfig{}, fmt.Errorf("recipients file: %s is not a private key, key ring, age identity or certificate: %w", key.Path, errdefs.ErrKeyMaterial)
+		}
+	}
+
+	var pkcs11Config *pkcs11.Pkcs11Config
+	if len(pkcs11Yamls) > 0 || len(pkcs11PrivYamls) > 0 {
+		var err error
+		if rf.Pkcs11Config != "" {
+			data, err := readFile(rf.Pkcs11Config)
+			if err != nil {
+				return CryptoConfig{}, err
+			}
+			pkcs11Config, err = pkcs11.ParsePkcs11ConfigFile(data)
+		} else {
+			pkcs11Config, err = pkcs11config.GetUserPkcs11Config()
+		}
+		if err != nil {
+			return CryptoConfig{}, errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("recipients file: could not get pkcs11 configuration: %w", err))
+		}
+	}
+	if len(gpgRecipients) > 0 {
+		if rf.GPGPubRingFile == "" {
+			return CryptoConfig{}, fmt.Errorf("recipients file: gpgPubRingFile is required by pgp recipients: %w", errdefs.ErrConfiguration)
+		}
+		gpgPubRingFile, err := readFile(rf.GPGPubRingFile)
+		if err != nil {
+			return CryptoConfig{}, err
+		}
+		opts = append(opts, WithGPGRecipients(gpgRecipients, gpgPubRingFile))
+	}
+
+	if len(pubKeys) > 0 {
+		opts = append(opts, WithJWEPubKeys(pubKeys))
+	}
+	if len(x509s) > 0 {
+		opts = append(opts, WithX509Certs(x509s))
+	}
+	if len(pkcs11Pubkeys) > 0 || len(pkcs11Yamls) > 0 {
+		opts = append(opts, WithPkcs11(pkcs11Config, pkcs11Pubkeys, pkcs11Yamls))
+	}
+	if len(kmsEndpoints) > 0 {
+		opts = append(opts, WithKMSv2(kmsEndpoints))
+	}
+	if len(awsKMSKeys) > 0 {
+		opts = append(opts, WithAWSKMS(awsKMSKeys))
+	}
+	if len(gcpKMSKeys) > 0 {
+		opts = append(opts, WithGCPKMS(gcpKMSKeys))
+	}
+	if len(azureKVKeys) > 0 {
+		opts = append(opts, WithAzureKeyVault(azureKVKeys))
+	}
+	if len(vaultTransitKeys) > 0 {
+		opts = append(opts, WithVaultTransit(vaultTransitKeys))
+	}
+	if len(ageRecipients) > 0 {
+		opts = append(opts, WithAgeRecipients(ageRecipients))
+	}
+	if len(hpkePubKeys) > 0 {
+		opts = append(opts, WithHPKEPubKeys(hpkePubKeys))
+	}
+	if len(mlkemPubKeys) > 0 {
+		opts = append(opts, WithMLKEM768X25519PubKeys(mlkemPubKeys))
+	}
+	if len(privKeys) > 0 {
+		opts = append(opts, WithPrivKeys(privKeys, privKeysPasswords))
+	}
+	if len(gpgPrivKeys) > 0 {
+		opts = append(opts, WithGPGPrivKeys(gpgPrivKeys, gpgPrivKeysPwds))
+	}
+	if len(pkcs11PrivYamls) > 0 {
+		opts = append(opts, WithPkcs11Yamls(pkcs11Config, pkcs11PrivYamls))
+	}
+	if len(decryptX509s) > 0 {
+		opts = append(opts, WithDecryptX509Certs(decryptX509s))
+	}
+	if len(ageIdentities) > 0 {
+		opts = append(opts, WithAgeIdentities(ageIdentities))
+	}
+	if len(hpkePrivKeys) > 0 {
+		opts = append(opts, WithHPKEPrivKeys(hpkePrivKeys, hpkePrivKeysPasswords))
+	}
+	if len(mlkemPrivKeys) > 0 {
+		opts = append(opts, WithMLKEM768X25519PrivKeys(mlkemPrivKeys))
+	}
+	return New(opts...)
+}
+
+// isAgeIdentityFile returns true if the first line of the data that is neither
+// empty nor a comment is an age identity; the age keywrapper parses the rest
+func isAgeIdentityFile(data []byte) bool {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return strings.HasPrefix(line, "AGE-SECRET-KEY-1")
+	}
+	return false
+}
+
+// expandPath expands the environment variables and a leading ~ in the path
+// and makes it relative to baseDir unless it is absolute
+func expandPath(path, baseDir string) string {
+	path = os.ExpandEnv(path)
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[1:])
+		}
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(baseDir, path)
+	}
+	return path
+}
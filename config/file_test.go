@@ -0,0 +1,116 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/utils"
+)
+
+func TestLoadCryptoConfigFromFile(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "an encrypted PEM private key")
+
+	dir := t.TempDir()
+	password := []byte("password")
+	pubKey, privKey, err := utils.CreateRSATestKey(2048, password, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"keys/alice.pub.pem": pubKey,
+		"keys/alice.pem":     privKey,
+		"secrets/alice":      append(password, '\n'),
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("OCICRYPT_TEST_SECRETS", filepath.Join(dir, "secrets"))
+	defer os.Unsetenv("OCICRYPT_TEST_SECRETS")
+
+	for _, document := range []string{`
+recipients:
+- jwe:keys/alice.pub.pem
+- kmsv2:unix:///run/kms.sock
+keys:
+- path: keys/alice.pem
+  passwordFile: $OCICRYPT_TEST_SECRETS/alice
+`, `{
+  "recipients": ["jwe:keys/alice.pub.pem", "kmsv2:unix:///run/kms.sock"],
+  "keys": [{"path": "keys/alice.pem", "password": "password"}]
+}`} {
+		path := filepath.Join(dir, "recipients")
+		if err := ioutil.WriteFile(path, []byte(document), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cc, err := LoadCryptoConfigFromFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ec := cc.EncryptConfig
+		if len(ec.Parameters["pubkeys"]) != 1 || len(ec.Parameters["kmsv2-endpoints"]) != 1 {
+			t.Fatalf("unexpected encryption parameters %v", ec.Parameters)
+		}
+		dc := cc.DecryptConfig
+		if len(dc.Parameters["privkeys"]) != 1 || string(dc.Parameters["privkeys-passwords"][0]) != "password" {
+			t.Fatalf("unexpected decryption parameters %v", dc.Parameters)
+		}
+	}
+
+	for _, document := range []string{
+		"recipient:\n- jwe:keys/alice.pub.pem\n",
+		"recipients:\n- pgp:alice@example.com\n",
+		"recipients:\n- jwe:keys/bob.pub.pem\n",
+		"recipients:\n- foo:bar\n",
+		"keys:\n- path: keys/alice.pem\n",
+	} {
+		if _, err := LoadCryptoConfigFromBytes([]byte(document), dir); !errors.Is(err, errdefs.ErrConfiguration) && !errors.Is(err, errdefs.ErrWrongPassword) {
+			t.Fatalf("unexpected error for %q: %v", document, err)
+		}
+	}
+}
+
+func TestLoadCryptoConfigFromFileAge(t *testing.T) {
+	dir := t.TempDir()
+	identity := "# public key: age1zvkyg2lqzraa2lnjvqej32nkuu0ues2s82hzrye869xeexvn73equnujwj\n" +
+		"AGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "identity.txt"), []byte(identity), 0600); err != nil {
+		t.Fatal(err)
+	}
+	document := `
+recipients:
+- age:age1zvkyg2lqzraa2lnjvqej32nkuu0ues2s82hzrye869xeexvn73equnujwj
+keys:
+- path: identity.txt
+`
+	cc, err := LoadCryptoConfigFromBytes([]byte(document), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cc.EncryptConfig.Parameters["age-recipients"]) != 1 || len(cc.DecryptConfig.Parameters["age-identities"]) != 1 {
+		t.Fatalf("unexpected parameters %v, %v", cc.EncryptConfig.Parameters, cc.DecryptConfig.Parameters)
+	}
+}
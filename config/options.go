@@ -0,0 +1,383 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+
+	"github.com/containers/ocicrypt/crypto/pkcs11"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/oidc"
+	"github.com/containers/ocicrypt/spiffe"
+)
+
+// Option adds recipients or decryption keys to the CryptoConfig built by New
+type Option func() (CryptoConfig, error)
+
+// New builds a single CryptoConfig from the recipients and decryption keys of
+// all options, for example
+//
+//	cc, err := config.New(config.WithJWEPubKeys(pubKeys), config.WithX509Certs(certs))
+//
+// It fails with an error wrapping errdefs.ErrConfiguration if no option is
+// given or an option has no recipients or keys, and with a *ValidationError if
+// the CryptoConfig is not coherent.
+func New(opts ...Option) (CryptoConfig, error) {
+	if len(opts) == 0 {
+		return CryptoConfig{}, fmt.Errorf("no recipients or keys given: %w", errdefs.ErrConfiguration)
+	}
+	ccs := make([]CryptoConfig, 0, len(opts))
+	for _, opt := range opts {
+		cc, err := opt()
+		if err != nil {
+			return CryptoConfig{}, err
+		}
+		ccs = append(ccs, cc)
+	}
+	cc := CombineCryptoConfigs(ccs)
+	if err := cc.Validate(); err != nil {
+		return CryptoConfig{}, err
+	}
+	return cc, nil
+}
+
+// newOption returns an Option that calls the constructor unless the given list
+// of recipients or keys is empty
+func newOption(what string, list [][]byte, constructor func() (CryptoConfig, error)) Option {
+	return func() (CryptoConfig, error) {
+		if len(list) == 0 {
+			return CryptoConfig{}, fmt.Errorf("no %s given: %w", what, errdefs.ErrConfiguration)
+		}
+		return constructor()
+	}
+}
+
+// WithJWEPubKeys encrypts for the public keys using JWE
+func WithJWEPubKeys(pubKeys [][]byte) Option {
+	return newOption("JWE public keys", pubKeys, func() (CryptoConfig, error) {
+		return EncryptWithJwe(pubKeys)
+	})
+}
+
+// WithJWEAlgorithms chooses the key management and content encryption
+// algorithms for the JWE public keys; see EncryptWithJweAlgorithms
+func WithJWEAlgorithms(keyAlgorithms []string, contentEncryption string) Option {
+	return func() (CryptoConfig, error) {
+		if len(keyAlgorithms) == 0 && contentEncryption == "" {
+			return CryptoConfig{}, fmt.Errorf("no JWE algorithms given: %w", errdefs.ErrConfiguration)
+		}
+		return EncryptWithJweAlgorithms(keyAlgorithms, contentEncryption)
+	}
+}
+
+// WithX509Certs encrypts for the x509 certificates using PKCS7
+func WithX509Certs(x509s [][]byte) Option {
+	return newOption("x509 certificates", x509s, func() (CryptoConfig, error) {
+		return EncryptWithPkcs7(x509s)
+	})
+}
+
+// WithCMSX509Certs encrypts for the x509 certificates using CMS with RSA-OAEP
+// or ECDH and AES-256-GCM
+func WithCMSX509Certs(x509s [][]byte) Option {
+	return newOption("x509 certificates", x509s, func() (CryptoConfig, error) {
+		return EncryptWithCMS(x509s)
+	})
+}
+
+// WithX509Roots verifies the certificates of the recipients against the CA
+// certificates before encrypting; see EncryptWithX509Roots
+func WithX509Roots(roots [][]byte) Option {
+	return newOption("x509 root certificates", roots, func() (CryptoConfig, error) {
+		return EncryptWithX509Roots(roots)
+	})
+}
+
+// WithX509SkipVerify skips the verification of the certificates of the
+// recipients even if CA certificates are given
+func WithX509SkipVerify() Option {
+	return EncryptWithX509SkipVerify
+}
+
+// WithGPGRecipients encrypts for the gpg recipients found in the public key
+// ring
+func WithGPGRecipients(gpgRecipients [][]byte, gpgPubRingFile []byte) Option {
+	return newOption("gpg recipients", gpgRecipients, func() (CryptoConfig, error) {
+		return EncryptWithGpg(gpgRecipients, gpgPubRingFile)
+	})
+}
+
+// WithGPGSubkeys wraps the layer key for the encryption subkeys of the gpg
+// recipients with the given fingerprints, see EncryptWithGpgSubkeys
+func WithGPGSubkeys(fingerprints [][]byte) Option {
+	return newOption("gpg subkey fingerprints", fingerprints, func() (CryptoConfig, error) {
+		return EncryptWithGpgSubkeys(fingerprints)
+	})
+}
+
+// WithPkcs11 encrypts for the public keys and the pkcs11 keys described by the
+// yaml files
+func WithPkcs11(pkcs11Config *pkcs11.Pkcs11Config, pkcs11Pubkeys, pkcs11Yamls [][]byte) Option {
+	keys := append(append([][]byte{}, pkcs11Pubkeys...), pkcs11Yamls...)
+	return newOption("pkcs11 keys", keys, func() (CryptoConfig, error) {
+		return EncryptWithPkcs11(pkcs11Config, pkcs11Pubkeys, pkcs11Yamls)
+	})
+}
+
+// WithKMSv2 encrypts and decrypts with the Kubernetes KMS v2 plugins listening
+// at the given endpoints
+func WithKMSv2(endpoints [][]byte) Option {
+	return newOption("KMS v2 endpoints", endpoints, func() (CryptoConfig, error) {
+		ecc, err := EncryptWithKMSv2(endpoints)
+		if err != nil {
+			return CryptoConfig{}, err
+		}
+		dcc, err := DecryptWithKMSv2(endpoints)
+		if err != nil {
+			return CryptoConfig{}, err
+		}
+		return CombineCryptoConfigs([]CryptoConfig{ecc, dcc}), nil
+	})
+}
+
+// WithAWSKMS encrypts and decrypts with the AWS KMS keys with the given ARNs
+func WithAWSKMS(keyARNs [][]byte) Option {
+	return newOption("AWS KMS keys", keyARNs, func() (CryptoConfig, error) {
+		ecc, err := EncryptWithAWSKMS(keyARNs)
+		if err != nil {
+			return CryptoConfig{}, err
+		}
+		dcc, err := DecryptWithAWSKMS(keyARNs)
+		if err != nil {
+			return CryptoConfig{}, err
+		}
+		return CombineCryptoConfigs([]CryptoConfig{ecc, dcc}), nil
+	})
+}
+
+// WithGCPKMS encrypts and decrypts with the Google Cloud KMS keys with the
+// given names
+func WithGCPKMS(keyNames [][]byte) Option {
+	return newOption("GCP KMS keys", keyNames, func() (CryptoConfig, error) {
+		ecc, err := EncryptWithGCPKMS(keyNames)
+		if err != nil {
+			return CryptoConfig{}, err
+		}
+		dcc, err := DecryptWithGCPKMS(keyNames)
+		if err != nil {
+			return CryptoConfig{}, err
+		}
+		return CombineCryptoConfigs([]CryptoConfig{ecc, dcc}), nil
+	})
+}
+
+// WithAzureKeyVault encrypts and decrypts with the Azure Key Vault keys with
+// the given IDs
+func WithAzureKeyVault(keyIDs [][]byte) Option {
+	return newOption("Azure Key Vault keys", keyIDs, func() (CryptoConfig, error) {
+		ecc, err := EncryptWithAzureKeyVault(keyIDs)
+		if err != nil {
+			return CryptoConfig{}, err
+		}
+		dcc, err := DecryptWithAzureKeyVault(keyIDs)
+		if err != nil {
+			return CryptoConfig{}, err
+		}
+		return CombineCryptoConfigs([]CryptoConfig{ecc, dcc}), nil
+	})
+}
+
+// WithVaultTransit encrypts and decrypts with the Vault transit keys with the
+// given references
+func WithVaultTransit(keyRefs [][]byte) Option {
+	return newOption("Vault transit keys", keyRefs, func() (CryptoConfig, error) {
+		ecc, err := EncryptWithVaultTransit(keyRefs)
+		if err != nil {
+			return CryptoConfig{}, err
+		}
+		dcc, err := DecryptWithVaultTransit(keyRefs)
+		if err != nil {
+			return CryptoConfig{}, err
+		}
+		return CombineCryptoConfigs([]CryptoConfig{ecc, dcc}), nil
+	})
+}
+
+// WithTPMRecipients seals layer keys to the TPM storage keys with the given
+// public keys, bound to the PCR values if any are given
+func WithTPMRecipients(pubKeys [][]byte, pcrs [][]byte) Option {
+	return newOption("TPM storage keys", pubKeys, func() (CryptoConfig, error) {
+		return EncryptWithTPM(pubKeys, pcrs)
+	})
+}
+
+// WithTPMKeys unseals layer keys with the storage keys of the TPM at the
+// device, see DecryptWithTPM
+func WithTPMKeys(device string, keys [][]byte) Option {
+	return newOption("TPM keys", keys, func() (CryptoConfig, error) {
+		return DecryptWithTPM(device, keys)
+	})
+}
+
+// WithKeyless encrypts for the identities using the rewrap service, see
+// EncryptWithKeyless
+func WithKeyless(service, serviceIdentity []byte, roots, identities [][]byte) Option {
+	return newOption("keyless identities", identities, func() (CryptoConfig, error) {
+		return EncryptWithKeyless(service, serviceIdentity, roots, identities)
+	})
+}
+
+// WithAgeRecipients encrypts for the age recipients, see EncryptWithAge
+func WithAgeRecipients(recipients [][]byte) Option {
+	return newOption("age recipients", recipients, func() (CryptoConfig, error) {
+		return EncryptWithAge(recipients)
+	})
+}
+
+// WithHPKEPubKeys encrypts for the X25519 public keys using HPKE
+func WithHPKEPubKeys(pubKeys [][]byte) Option {
+	return newOption("HPKE public keys", pubKeys, func() (CryptoConfig, error) {
+		return EncryptWithHpke(pubKeys)
+	})
+}
+
+// WithThreshold splits the layer key among the public keys so that the
+// private keys of k of them are needed to decrypt, see EncryptWithThreshold
+func WithThreshold(k int, pubKeys [][]byte) Option {
+	return newOption("threshold public keys", pubKeys, func() (CryptoConfig, error) {
+		return EncryptWithThreshold(k, pubKeys)
+	})
+}
+
+// WithMLKEM768X25519PubKeys encrypts for the MLKEM768-X25519 public keys
+// using HPKE
+func WithMLKEM768X25519PubKeys(pubKeys [][]byte) Option {
+	return newOption("MLKEM768-X25519 public keys", pubKeys, func() (CryptoConfig, error) {
+		return EncryptWithMLKEM768X25519(pubKeys)
+	})
+}
+
+// WithConvergentSecret encrypts the layers convergently with the secret, see
+// EncryptWithConvergentSecret
+func WithConvergentSecret(secret []byte) Option {
+	return newOption("convergent secret", [][]byte{secret}, func() (CryptoConfig, error) {
+		return EncryptWithConvergentSecret(secret)
+	})
+}
+
+// WithPrivKeys decrypts with the private keys, which are protected by the
+// passwords
+func WithPrivKeys(privKeys, privKeysPasswords [][]byte) Option {
+	return newOption("private keys", privKeys, func() (CryptoConfig, error) {
+		return DecryptWithPrivKeys(privKeys, privKeysPasswords)
+	})
+}
+
+// WithDecryptX509Certs adds the x509 certificates of the private keys, which
+// decrypting with PKCS7 requires
+func WithDecryptX509Certs(x509s [][]byte) Option {
+	return newOption("x509 certificates", x509s, func() (CryptoConfig, error) {
+		return DecryptWithX509s(x509s)
+	})
+}
+
+// WithGPGPrivKeys decrypts with the gpg private keys, which are protected by
+// the passwords
+func WithGPGPrivKeys(gpgPrivKeys, gpgPrivKeysPwds [][]byte) Option {
+	return newOption("gpg private keys", gpgPrivKeys, func() (CryptoConfig, error) {
+		return DecryptWithGpgPrivKeys(gpgPrivKeys, gpgPrivKeysPwds)
+	})
+}
+
+// WithGPGDecrypter decrypts with the secret keys of the GPGDecrypter, see
+// DecryptWithGPGDecrypter
+func WithGPGDecrypter(gpgDecrypter GPGDecrypter) Option {
+	return func() (CryptoConfig, error) {
+		return DecryptWithGPGDecrypter(gpgDecrypter)
+	}
+}
+
+// WithPkcs11Yamls decrypts with the pkcs11 keys described by the yaml files
+func WithPkcs11Yamls(pkcs11Config *pkcs11.Pkcs11Config, pkcs11Yamls [][]byte) Option {
+	return newOption("pkcs11 yaml files", pkcs11Yamls, func() (CryptoConfig, error) {
+		return DecryptWithPkcs11Yaml(pkcs11Config, pkcs11Yamls)
+	})
+}
+
+// WithKeylessServices decrypts with the rewrap services, which are trusted with
+// the ID tokens of the token source
+func WithKeylessServices(services [][]byte, tokenSource oidc.TokenSource) Option {
+	return newOption("keyless services", services, func() (CryptoConfig, error) {
+		return DecryptWithKeyless(services, tokenSource)
+	})
+}
+
+// WithKeylessSVID decrypts with the rewrap services, which authenticate the
+// workload by the X.509-SVID of the source, see DecryptWithKeylessSVID
+func WithKeylessSVID(services [][]byte, source spiffe.Source) Option {
+	return newOption("keyless services", services, func() (CryptoConfig, error) {
+		return DecryptWithKeylessSVID(services, source)
+	})
+}
+
+// WithSVID presents the X.509-SVID of the source to the key services that ask
+// for a client certificate, see AuthenticateWithSVID
+func WithSVID(source spiffe.Source) Option {
+	return func() (CryptoConfig, error) {
+		return AuthenticateWithSVID(source)
+	}
+}
+
+// WithAgeIdentities decrypts with the age identities, see
+// DecryptWithAgeIdentities
+func WithAgeIdentities(identities [][]byte) Option {
+	return newOption("age identities", identities, func() (CryptoConfig, error) {
+		return DecryptWithAgeIdentities(identities)
+	})
+}
+
+// WithSSHAgent decrypts with the identities derived from the SSH agent keys,
+// see DecryptWithSSHAgent
+func WithSSHAgent(pubKeys [][]byte) Option {
+	return newOption("SSH agent keys", pubKeys, func() (CryptoConfig, error) {
+		return DecryptWithSSHAgent(pubKeys)
+	})
+}
+
+// WithHPKEPrivKeys decrypts with the X25519 private keys using HPKE; the keys
+// are protected by the passwords
+func WithHPKEPrivKeys(privKeys, privKeysPasswords [][]byte) Option {
+	return newOption("HPKE private keys", privKeys, func() (CryptoConfig, error) {
+		return DecryptWithHpkePrivKeys(privKeys, privKeysPasswords)
+	})
+}
+
+// WithMLKEM768X25519PrivKeys decrypts with the MLKEM768-X25519 private keys
+// using HPKE
+func WithMLKEM768X25519PrivKeys(privKeys [][]byte) Option {
+	return newOption("MLKEM768-X25519 private keys", privKeys, func() (CryptoConfig, error) {
+		return DecryptWithMLKEM768X25519(privKeys)
+	})
+}
+
+// WithMasterKeys decrypts the layers whose keys are derived from the master
+// keys
+func WithMasterKeys(masterKeys [][]byte) Option {
+	return newOption("master keys", masterKeys, func() (CryptoConfig, error) {
+		return DecryptWithMasterKeys(masterKeys)
+	})
+}
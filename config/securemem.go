@@ -0,0 +1,145 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package config
+
+import (
+	"sync"
+
+	"github.com/containers/ocicrypt/utils/securemem"
+)
+
+// secretParameters are the DecryptConfig parameters that hold private keys,
+// passwords or PINs
+var secretParameters = []string{
+	"privkeys",
+	"privkeys-passwords",
+	"gpg-privatekeys",
+	"gpg-privatekeys-passwords",
+	"pkcs11-yamls",
+	"masterkeys",
+	"age-identities",
+	"hpke-privkeys",
+	"hpke-privkeys-passwords",
+	"mlkem768x25519-privkeys",
+}
+
+// lockedSecrets is the locked memory allocated by LockSecrets; it is released
+// once the last holder is done with it
+type lockedSecrets struct {
+	lock sync.Mutex
+	refs int
+	bufs []*securemem.Buffer
+}
+
+func (ls *lockedSecrets) hold() {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	ls.refs++
+}
+
+func (ls *lockedSecrets) release() {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	ls.refs--
+	if ls.refs > 0 {
+		return
+	}
+	for _, b := range ls.bufs {
+		_ = b.Destroy()
+	}
+	ls.bufs = nil
+}
+
+// LockSecrets copies the private keys, passwords and PINs held in the
+// Parameters into locked memory, which the Parameters then refer to. The
+// Parameters are replaced by a copy, so the byte arrays passed in and other
+// configurations sharing them are left as they are; callers wipe them on
+// their own once they are no longer needed. Parameters added afterwards are
+// not copied. The locked memory is released with WipeSecrets; copies of the
+// DecryptConfig and configurations combined from it with CombineCryptoConfigs
+// keep it until they are wiped as well.
+func (dc *DecryptConfig) LockSecrets() error {
+	ls := &lockedSecrets{refs: 1}
+	parameters := make(map[string][][]byte, len(dc.Parameters))
+	for k, v := range dc.Parameters {
+		parameters[k] = v
+	}
+	for _, name := range secretParameters {
+		if len(dc.Parameters[name]) == 0 {
+			continue
+		}
+		secrets := make([][]byte, len(dc.Parameters[name]))
+		for i, secret := range dc.Parameters[name] {
+			b, err := securemem.New(len(secret))
+			if err != nil {
+				ls.release()
+				return err
+			}
+			ls.bufs = append(ls.bufs, b)
+			secrets[i] = b.Bytes()
+			copy(secrets[i], secret)
+		}
+		parameters[name] = secrets
+	}
+	dc.Parameters = parameters
+	dc.secrets = append(dc.secrets, ls)
+	return nil
+}
+
+// HoldSecrets keeps the locked memory of LockSecrets from being released by
+// WipeSecrets until the returned function is called. Operations using the
+// private keys of the DecryptConfig hold it while they run, so that wiping
+// the DecryptConfig does not pull the memory from under them.
+func (dc *DecryptConfig) HoldSecrets() func() {
+	held := append([]*lockedSecrets{}, dc.secrets...)
+	for _, ls := range held {
+		ls.hold()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, ls := range held {
+				ls.release()
+			}
+		})
+	}
+}
+
+// WipeSecrets removes the private keys, passwords and PINs from the Parameters
+// and releases the locked memory allocated by LockSecrets, which is wiped and
+// freed once no combined configuration and no operation holds it any longer.
+// It must only be called once, on the DecryptConfig that LockSecrets was
+// called on or on a configuration combined from it.
+func (dc *DecryptConfig) WipeSecrets() {
+	for _, name := range secretParameters {
+		delete(dc.Parameters, name)
+	}
+	for _, ls := range dc.secrets {
+		ls.release()
+	}
+	dc.secrets = nil
+}
+
+// combineSecrets returns the locked memory of the configurations, which the
+// combined configuration holds until it is wiped
+func combineSecrets(secrets []*lockedSecrets, dc *DecryptConfig) []*lockedSecrets {
+	for _, ls := range dc.secrets {
+		ls.hold()
+		secrets = append(secrets, ls)
+	}
+	return secrets
+}
@@ -0,0 +1,269 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/containers/ocicrypt/blockcipher"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/masterkey"
+)
+
+// ValidationError is returned by Validate for a parameter or field of a
+// configuration that is not coherent; it wraps errdefs.ErrConfiguration
+type ValidationError struct {
+	// Config is "EncryptConfig" or "DecryptConfig"
+	Config string
+	// Parameter is the name of the parameter, such as "privkeys", or of the
+	// field, such as "MinWrappedKeys"
+	Parameter string
+	// Reason says what is wrong with the parameter
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Config, e.Parameter, e.Reason)
+}
+
+// Unwrap returns errdefs.ErrConfiguration
+func (e *ValidationError) Unwrap() error {
+	return errdefs.ErrConfiguration
+}
+
+var (
+	parametersLock sync.RWMutex
+	// parameters holds the known parameters and whether they may hold empty
+	// values
+	parameters = map[string]bool{
+		"pubkeys":                   false,
+		"jwe-key-algorithms":        false,
+		"jwe-content-encryption":    false,
+		"x509s":                     false,
+		"pkcs7-mode":                false,
+		"x509-roots":                false,
+		"x509-skip-verify":          false,
+		"gpg-recipients":            false,
+		"gpg-pubkeyringfile":        true,
+		"gpg-subkeys":               false,
+		"pkcs11-pubkeys":            false,
+		"pkcs11-yamls":              false,
+		"pkcs11-config":             false,
+		"kmsv2-endpoints":           false,
+		"aws-kms-keys":              false,
+		"gcp-kms-keys":              false,
+		"azure-kv-keys":             false,
+		"vault-transit-keys":        false,
+		"tpm-pubkeys":               false,
+		"tpm-pcrs":                  false,
+		"tpm-keys":                  false,
+		"tpm-device":                false,
+		"keyless-services":          false,
+		"keyless-service-identity":  false,
+		"keyless-roots":             false,
+		"keyless-identities":        false,
+		"age-recipients":            false,
+		"hpke-pubkeys":              false,
+		"mlkem768x25519-pubkeys":    false,
+		"threshold-pubkeys":         false,
+		"threshold-k":               false,
+		"convergent-secret":         false,
+		"privkeys":                  false,
+		"privkeys-passwords":        true,
+		"gpg-privatekeys":           false,
+		"gpg-privatekeys-passwords": true,
+		"masterkeys":                false,
+		"age-identities":            false,
+		"age-ssh-agent":             false,
+		"hpke-privkeys":             false,
+		"hpke-privkeys-passwords":   true,
+		"mlkem768x25519-privkeys":   false,
+	}
+)
+
+// RegisterParameters makes the parameters of a keywrapper registered by
+// another package known to Validate; their values must not be empty
+func RegisterParameters(names ...string) {
+	parametersLock.Lock()
+	defer parametersLock.Unlock()
+
+	for _, name := range names {
+		parameters[name] = false
+	}
+}
+
+// Validate checks that the configurations of the CryptoConfig are coherent,
+// so that mistakes are reported before encrypting or decrypting rather than
+// deep inside a keywrapper. It returns a *ValidationError for the first
+// problem it finds.
+func (cc *CryptoConfig) Validate() error {
+	if cc.EncryptConfig != nil {
+		if err := cc.EncryptConfig.Validate(); err != nil {
+			return err
+		}
+	}
+	if cc.DecryptConfig != nil {
+		if err := cc.DecryptConfig.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks that the parameters and fields of the EncryptConfig and of
+// its DecryptConfig are coherent and returns a *ValidationError for the first
+// problem it finds
+func (ec *EncryptConfig) Validate() error {
+	if err := validateParameters("EncryptConfig", ec.Parameters); err != nil {
+		return err
+	}
+	if ec.MinWrappedKeys < 0 {
+		return &ValidationError{Config: "EncryptConfig", Parameter: "MinWrappedKeys", Reason: "must not be negative"}
+	}
+	if ec.Parallelism < 0 {
+		return &ValidationError{Config: "EncryptConfig", Parameter: "Parallelism", Reason: "must not be negative"}
+	}
+	if ec.PartialFailures < FailFast || ec.PartialFailures > CollectErrors {
+		return &ValidationError{Config: "EncryptConfig", Parameter: "PartialFailures", Reason: fmt.Sprintf("unknown mode %d", ec.PartialFailures)}
+	}
+	for _, name := range []string{"jwe-content-encryption", "pkcs7-mode"} {
+		if n := len(ec.Parameters[name]); n > 1 {
+			return &ValidationError{Config: "EncryptConfig", Parameter: name, Reason: fmt.Sprintf("has %d values instead of one", n)}
+		}
+	}
+	if len(ec.Parameters["gpg-subkeys"]) > 0 && len(ec.Parameters["gpg-recipients"]) == 0 {
+		return &ValidationError{Config: "EncryptConfig", Parameter: "gpg-recipients", Reason: "required by gpg-subkeys"}
+	}
+	if len(ec.Parameters["tpm-pcrs"]) > 0 && len(ec.Parameters["tpm-pubkeys"]) == 0 {
+		return &ValidationError{Config: "EncryptConfig", Parameter: "tpm-pubkeys", Reason: "required by tpm-pcrs"}
+	}
+	if len(ec.Parameters["threshold-pubkeys"]) > 0 || len(ec.Parameters["threshold-k"]) > 0 {
+		if err := validateThreshold(ec.Parameters); err != nil {
+			return err
+		}
+	}
+	if secrets, ok := ec.Parameters["convergent-secret"]; ok {
+		if len(secrets) != 1 {
+			return &ValidationError{Config: "EncryptConfig", Parameter: "convergent-secret", Reason: fmt.Sprintf("has %d values instead of one", len(secrets))}
+		}
+		if len(secrets[0]) < MinConvergentSecretSize {
+			return &ValidationError{Config: "EncryptConfig", Parameter: "convergent-secret", Reason: fmt.Sprintf("must have at least %d bytes", MinConvergentSecretSize)}
+		}
+	}
+	if len(ec.Parameters["keyless-services"]) > 0 {
+		for _, name := range []string{"keyless-service-identity", "keyless-roots", "keyless-identities"} {
+			if len(ec.Parameters[name]) == 0 {
+				return &ValidationError{Config: "EncryptConfig", Parameter: name, Reason: "required by keyless-services"}
+			}
+		}
+	}
+	return ec.DecryptConfig.Validate()
+}
+
+// validateThreshold checks that threshold-k is a number of keys between 1 and
+// the number of threshold-pubkeys
+func validateThreshold(params map[string][][]byte) error {
+	if len(params["threshold-pubkeys"]) == 0 {
+		return &ValidationError{Config: "EncryptConfig", Parameter: "threshold-pubkeys", Reason: "required by threshold-k"}
+	}
+	values := params["threshold-k"]
+	if len(values) != 1 {
+		return &ValidationError{Config: "EncryptConfig", Parameter: "threshold-k", Reason: fmt.Sprintf("has %d values instead of one", len(values))}
+	}
+	k, err := strconv.Atoi(string(values[0]))
+	if err != nil || k < 1 || k > len(params["threshold-pubkeys"]) {
+		return &ValidationError{Config: "EncryptConfig", Parameter: "threshold-k", Reason: fmt.Sprintf("must be a number from 1 to the %d threshold-pubkeys", len(params["threshold-pubkeys"]))}
+	}
+	return nil
+}
+
+// Validate checks that the parameters and fields of the DecryptConfig are
+// coherent and returns a *ValidationError for the first problem it finds
+func (dc *DecryptConfig) Validate() error {
+	if err := validateParameters("DecryptConfig", dc.Parameters); err != nil {
+		return err
+	}
+	for _, p := range [][2]string{
+		{"privkeys", "privkeys-passwords"},
+		{"gpg-privatekeys", "gpg-privatekeys-passwords"},
+		{"hpke-privkeys", "hpke-privkeys-passwords"},
+	} {
+		keys, passwords := p[0], p[1]
+		if len(dc.Parameters[keys]) != len(dc.Parameters[passwords]) {
+			return &ValidationError{Config: "DecryptConfig", Parameter: passwords, Reason: fmt.Sprintf("has %d values for %d %s", len(dc.Parameters[passwords]), len(dc.Parameters[keys]), keys)}
+		}
+	}
+	if len(dc.Parameters["pkcs11-yamls"]) > 0 && len(dc.Parameters["pkcs11-config"]) != 1 {
+		return &ValidationError{Config: "DecryptConfig", Parameter: "pkcs11-config", Reason: "exactly one value is required by pkcs11-yamls"}
+	}
+	if n := len(dc.Parameters["tpm-device"]); n > 1 {
+		return &ValidationError{Config: "DecryptConfig", Parameter: "tpm-device", Reason: fmt.Sprintf("has %d values instead of one", n)}
+	}
+	for i, masterKey := range dc.Parameters["masterkeys"] {
+		if len(masterKey) != masterkey.KeySize {
+			return &ValidationError{Config: "DecryptConfig", Parameter: "masterkeys", Reason: fmt.Sprintf("value %d has %d bytes instead of %d", i, len(masterKey), masterkey.KeySize)}
+		}
+	}
+	if dc.MaxMemory < 0 {
+		return &ValidationError{Config: "DecryptConfig", Parameter: "MaxMemory", Reason: "must not be negative"}
+	}
+	if dc.BufferSize < 0 || dc.BufferSize > blockcipher.MaxBufferSize {
+		return &ValidationError{Config: "DecryptConfig", Parameter: "BufferSize", Reason: fmt.Sprintf("must be between 0 and %d", blockcipher.MaxBufferSize)}
+	}
+	seen := make(map[string]bool)
+	for _, scheme := range dc.KeyWrappers {
+		if scheme == "" || seen[scheme] {
+			return &ValidationError{Config: "DecryptConfig", Parameter: "KeyWrappers", Reason: fmt.Sprintf("has an empty or duplicate scheme %q", scheme)}
+		}
+		seen[scheme] = true
+	}
+	if dc.mixedTenants {
+		return &ValidationError{Config: "DecryptConfig", Parameter: "Tenant", Reason: "keys of different tenants are combined"}
+	}
+	return nil
+}
+
+// validateParameters checks that the parameters are known and hold values
+func validateParameters(configName string, params map[string][][]byte) error {
+	parametersLock.RLock()
+	defer parametersLock.RUnlock()
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mayBeEmpty, ok := parameters[name]
+		if !ok {
+			return &ValidationError{Config: configName, Parameter: name, Reason: "unknown parameter"}
+		}
+		values := params[name]
+		if len(values) == 0 && !mayBeEmpty {
+			return &ValidationError{Config: configName, Parameter: name, Reason: "no values given"}
+		}
+		for i, v := range values {
+			if len(v) == 0 && !mayBeEmpty {
+				return &ValidationError{Config: configName, Parameter: name, Reason: fmt.Sprintf("value %d is empty", i)}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package config
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+func TestValidate(t *testing.T) {
+	key := []byte("key")
+	for _, tc := range []struct {
+		name      string
+		cc        func() (CryptoConfig, error)
+		parameter string
+	}{
+		{
+			name: "valid",
+			cc: func() (CryptoConfig, error) {
+				return CombineCryptoConfigs(mustCryptoConfigs(t,
+					func() (CryptoConfig, error) { return EncryptWithJwe([][]byte{key}) },
+					func() (CryptoConfig, error) { return DecryptWithPrivKeys([][]byte{key}, [][]byte{nil}) },
+				)), nil
+			},
+		},
+		{
+			name:      "empty recipient list",
+			cc:        func() (CryptoConfig, error) { return EncryptWithJwe(nil) },
+			parameter: "pubkeys",
+		},
+		{
+			name:      "empty recipient",
+			cc:        func() (CryptoConfig, error) { return EncryptWithPkcs7([][]byte{key, {}}) },
+			parameter: "x509s",
+		},
+		{
+			name: "passwords mismatch",
+			cc: func() (CryptoConfig, error) {
+				return InitDecryption(map[string][][]byte{"privkeys": {key, key}, "privkeys-passwords": {nil}}), nil
+			},
+			parameter: "privkeys-passwords",
+		},
+		{
+			name: "unknown parameter",
+			cc: func() (CryptoConfig, error) {
+				return InitEncryption(map[string][][]byte{"pubkey": {key}}, nil), nil
+			},
+			parameter: "pubkey",
+		},
+		{
+			name:      "master key length",
+			cc:        func() (CryptoConfig, error) { return DecryptWithMasterKeys([][]byte{key}) },
+			parameter: "masterkeys",
+		},
+		{
+			name:      "keyless without roots",
+			cc:        func() (CryptoConfig, error) { return EncryptWithKeyless(key, key, nil, [][]byte{key}) },
+			parameter: "keyless-roots",
+		},
+		{
+			name:      "gpg subkeys without recipients",
+			cc:        func() (CryptoConfig, error) { return EncryptWithGpgSubkeys([][]byte{key}) },
+			parameter: "gpg-recipients",
+		},
+		{
+			name: "convergent secret length",
+			cc: func() (CryptoConfig, error) {
+				return InitEncryption(map[string][][]byte{"convergent-secret": {[]byte("short")}}, nil), nil
+			},
+			parameter: "convergent-secret",
+		},
+	} {
+		cc, err := tc.cc()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		err = cc.Validate()
+		if tc.parameter == "" {
+			if err != nil {
+				t.Fatalf("%s: unexpected error %v", tc.name, err)
+			}
+			continue
+		}
+		var ve *ValidationError
+		if !errors.As(err, &ve) || ve.Parameter != tc.parameter {
+			t.Fatalf("%s: expected a ValidationError for %s, got %v", tc.name, tc.parameter, err)
+		}
+		if !errors.Is(err, errdefs.ErrConfiguration) {
+			t.Fatalf("%s: %v does not wrap ErrConfiguration", tc.name, err)
+		}
+	}
+
+	RegisterParameters("test-recipients")
+	cc := InitEncryption(map[string][][]byte{"test-recipients": {key}}, nil)
+	if err := cc.Validate(); err != nil {
+		t.Fatalf("registered parameter was not accepted: %v", err)
+	}
+}
+
+func mustCryptoConfigs(t *testing.T, constructors ...func() (CryptoConfig, error)) []CryptoConfig {
+	var ccs []CryptoConfig
+	for _, constructor := range constructors {
+		cc, err := constructor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ccs = append(ccs, cc)
+	}
+	return ccs
+}
@@ -15,11 +15,20 @@ package pkcs11
 
 import (
 	"fmt"
-	"github.com/pkg/errors"
+
+	"github.com/containers/ocicrypt/errdefs"
 	pkcs11uri "github.com/stefanberger/go-pkcs11uri"
 	"gopkg.in/yaml.v2"
 )
 
+// maxKeyFileSize is the maximum size of a pkcs11 key file; the ones we write
+// only hold a pkcs11 URI and a few environment variables
+const maxKeyFileSize = 64 * 1024
+
+// DefaultMaxSessions is the default maximum number of sessions that are kept
+// open with a token
+const DefaultMaxSessions = 8
+
 // Pkcs11KeyFile describes the format of the pkcs11 (private) key file.
 // It also carries pkcs11 module related environment variables that are transferred to the
 // Pkcs11URI object and activated when the pkcs11 module is used.
@@ -42,7 +51,7 @@ func ParsePkcs11Uri(uri string) (*pkcs11uri.Pkcs11URI, error) {
 	p11uri := pkcs11uri.New()
 	err := p11uri.Parse(uri)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Could not parse Pkcs11URI from file")
+		return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("Could not parse Pkcs11URI from file: %w", err))
 	}
 	return p11uri, err
 }
@@ -53,11 +62,14 @@ func ParsePkcs11Uri(uri string) (*pkcs11uri.Pkcs11URI, error) {
 //  - uri : <pkcs11 uri>
 // An error is returned if the pkcs11 URI is malformed
 func ParsePkcs11KeyFile(yamlstr []byte) (*Pkcs11KeyFileObject, error) {
+	if len(yamlstr) > maxKeyFileSize {
+		return nil, fmt.Errorf("pkcs11 keyfile is larger than the maximum of %d bytes: %w", maxKeyFileSize, errdefs.ErrLimitExceeded)
+	}
 	p11keyfile := Pkcs11KeyFile{}
 
 	err := yaml.Unmarshal([]byte(yamlstr), &p11keyfile)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Could not unmarshal pkcs11 keyfile")
+		return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("Could not unmarshal pkcs11 keyfile: %w", err))
 	}
 
 	p11uri, err := ParsePkcs11Uri(p11keyfile.Pkcs11.Uri)
@@ -87,9 +99,13 @@ func IsPkcs11PublicKey(yamlstr []byte) bool {
 // - /usr/lib64/pkcs11/
 // allowd-module-paths
 // - /usr/lib64/pkcs11/libsofthsm2.so
+// max-sessions: 8
 type Pkcs11Config struct {
 	ModuleDirectories  []string `yaml:"module-directories"`
 	AllowedModulePaths []string `yaml:"allowed-module-paths"`
+	// MaxSessions is the maximum number of sessions opened with a token;
+	// see SetMaxSessions
+	MaxSessions int `yaml:"max-sessions,omitempty"`
 }
 
 // GetDefaultModuleDirectories returns module directories covering
@@ -128,7 +144,7 @@ func ParsePkcs11ConfigFile(yamlstr []byte) (*Pkcs11Config, error) {
 
 	err := yaml.Unmarshal([]byte(yamlstr), &p11conf)
 	if err != nil {
-		return &p11conf, errors.Wrapf(err, "Could not parse Pkcs11Config")
+		return &p11conf, errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("Could not parse Pkcs11Config: %w", err))
 	}
 	return &p11conf, nil
 }
@@ -0,0 +1,279 @@
+// +build cgo
+
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
+	"github.com/miekg/pkcs11"
+	josecipher "gopkg.in/square/go-jose.v2/cipher"
+)
+
+// ECDHAlgorithm is the algorithm of the recipients for EC keys: the layer key
+// options are encrypted with AES-256-GCM using a random key, which is wrapped
+// with AES key wrap using a key derived from an ephemeral-static ECDH key
+// agreement with the Concat KDF as for JWE 'ECDH-ES+A256KW'
+const ECDHAlgorithm = "ECDH-ES+A256KW"
+
+var (
+	oidNamedCurveP256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidNamedCurveP384 = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidNamedCurveP521 = asn1.ObjectIdentifier{1, 3, 132, 0, 35}
+)
+
+// curveFromParams returns the curve of the DER encoded CKA_EC_PARAMS of an EC
+// key
+func curveFromParams(ecParams []byte) (elliptic.Curve, error) {
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(ecParams, &oid); err != nil {
+		return nil, fmt.Errorf("could not parse the EC parameters: %w", err)
+	}
+	switch {
+	case oid.Equal(oidNamedCurveP256):
+		return elliptic.P256(), nil
+	case oid.Equal(oidNamedCurveP384):
+		return elliptic.P384(), nil
+	case oid.Equal(oidNamedCurveP521):
+		return elliptic.P521(), nil
+	}
+	return nil, fmt.Errorf("unsupported curve %s", oid)
+}
+
+// isECKey tells whether a key object is an EC key
+func isECKey(p11ctx *pkcs11.Ctx, session pkcs11.SessionHandle, obj pkcs11.ObjectHandle) (bool, error) {
+	attrs, err := p11ctx.GetAttributeValue(session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+	if err != nil {
+		return false, fmt.Errorf("GetAttributeValue failed: %w", err)
+	}
+	return bytes.Equal(attrs[0].Value, pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC).Value), nil
+}
+
+// getECPublicKey reads the curve and the point of an EC public key object
+func getECPublicKey(p11ctx *pkcs11.Ctx, session pkcs11.SessionHandle, obj pkcs11.ObjectHandle) (*ecdsa.PublicKey, error) {
+	attrs, err := p11ctx.GetAttributeValue(session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetAttributeValue failed: %w", err)
+	}
+	curve, err := curveFromParams(attrs[0].Value)
+	if err != nil {
+		return nil, err
+	}
+	// CKA_EC_POINT holds the DER encoding of an OCTET STRING, but some
+	// devices return the bare point
+	point := attrs[1].Value
+	var inner []byte
+	if rest, err := asn1.Unmarshal(point, &inner); err == nil && len(rest) == 0 {
+		point = inner
+	}
+	x, y := elliptic.Unmarshal(curve, point)
+	if x == nil {
+		return nil, errors.New("invalid EC point")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// ecdhSharedSecret returns the x-coordinate of the ECDH shared point padded to
+// the size of the curve
+func ecdhSharedSecret(curve elliptic.Curve, x, y *big.Int, priv []byte) []byte {
+	zx, _ := curve.ScalarMult(x, y, priv)
+	return zx.FillBytes(make([]byte, (curve.Params().BitSize+7)/8))
+}
+
+// ecdhKEK derives the key encryption key from the ECDH shared secret with the
+// Concat KDF as for JWE 'ECDH-ES+A256KW'
+func ecdhKEK(z []byte) []byte {
+	lengthPrefixed := func(data []byte) []byte {
+		out := make([]byte, 4+len(data))
+		binary.BigEndian.PutUint32(out, uint32(len(data)))
+		copy(out[4:], data)
+		return out
+	}
+	kek := make([]byte, 32)
+	_, _ = io.ReadFull(josecipher.NewConcatKDF(crypto.SHA256, z, lengthPrefixed([]byte(ECDHAlgorithm)), lengthPrefixed(nil), lengthPrefixed(nil), []byte{0, 0, 1, 0}, nil), kek)
+	return kek
+}
+
+// ecdhEncrypt encrypts the plaintext for an EC public key
+func ecdhEncrypt(pubKey *ecdsa.PublicKey, plaintext []byte) (*Pkcs11Recipient, error) {
+	eph, err := ecdsa.GenerateKey(pubKey.Curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	kek := ecdhKEK(ecdhSharedSecret(pubKey.Curve, pubKey.X, pubKey.Y, eph.D.Bytes()))
+
+	cek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, cek); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := josecipher.KeyWrap(block, cek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return &Pkcs11Recipient{
+		Blob: base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil)),
+		Alg:  ECDHAlgorithm,
+		Epk:  base64.StdEncoding.EncodeToString(elliptic.Marshal(pubKey.Curve, eph.X, eph.Y)),
+		Key:  base64.StdEncoding.EncodeToString(wrappedKey),
+	}, nil
+}
+
+// ecdhOpen decrypts the blob of an ECDH recipient given the ECDH shared secret
+func ecdhOpen(recipient *Pkcs11Recipient, z []byte) ([]byte, error) {
+	wrappedKey, err := base64.StdEncoding.DecodeString(recipient.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Base64 decoding failed: %w", err)
+	}
+	blob, err := base64.StdEncoding.DecodeString(recipient.Blob)
+	if err != nil {
+		return nil, fmt.Errorf("Base64 decoding failed: %w", err)
+	}
+	block, err := aes.NewCipher(ecdhKEK(z))
+	if err != nil {
+		return nil, err
+	}
+	cek, err := josecipher.KeyUnwrap(block, wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap the key: %w", err)
+	}
+	aead, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) < aead.NonceSize() {
+		return nil, errors.New("blob is too short")
+	}
+	return aead.Open(nil, blob[:aead.NonceSize()], blob[aead.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if fips.Enforced() {
+		// the nonces are not generated by the FIPS module
+		return nil, fmt.Errorf("ECDH recipients are not available in FIPS 140-only mode: %w", errdefs.ErrDisallowedAlgorithm)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// privateDecryptECDH uses a pkcs11 URI describing an EC private key to derive
+// the ECDH shared secret with CKM_ECDH1_DERIVE and decrypts the blob of an
+// ECDH recipient. The shared secret is derived into a session object that must
+// be extractable, which some devices only allow when configured to.
+func privateDecryptECDH(privKeyObj *Pkcs11KeyFileObject, recipient *Pkcs11Recipient) (_ []byte, err error) {
+	epk, err := base64.StdEncoding.DecodeString(recipient.Epk)
+	if err != nil {
+		return nil, fmt.Errorf("Base64 decoding failed: %w", err)
+	}
+
+	s, err := pool.getSession(privKeyObj.Uri, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { s.release(err) }()
+	p11ctx, session := s.ctx, s.handle
+
+	keyid, label, err := pkcs11UriGetKeyIdAndLabel(privKeyObj.Uri)
+	if err != nil {
+		return nil, err
+	}
+
+	p11PrivKey, err := findObject(p11ctx, session, pkcs11.CKO_PRIVATE_KEY, keyid, label)
+	if err != nil {
+		return nil, err
+	}
+	isEC, err := isECKey(p11ctx, session, p11PrivKey)
+	if err != nil {
+		return nil, err
+	}
+	if !isEC {
+		return nil, errors.New("ECDH requires an EC private key")
+	}
+	attrs, err := p11ctx.GetAttributeValue(session, p11PrivKey, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetAttributeValue failed: %w", err)
+	}
+	curve, err := curveFromParams(attrs[0].Value)
+	if err != nil {
+		return nil, err
+	}
+	if x, _ := elliptic.Unmarshal(curve, epk); x == nil {
+		return nil, errors.New("invalid ephemeral public key")
+	}
+	size := (curve.Params().BitSize + 7) / 8
+
+	secret, err := p11ctx.DeriveKey(session, []*pkcs11.Mechanism{
+		pkcs11.NewMechanism(pkcs11.CKM_ECDH1_DERIVE, pkcs11.NewECDH1DeriveParams(pkcs11.CKD_NULL, nil, epk)),
+	}, p11PrivKey, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, size),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("DeriveKey failed: %w", err)
+	}
+	defer func() {
+		_ = p11ctx.DestroyObject(session, secret)
+	}()
+	attrs, err = p11ctx.GetAttributeValue(session, secret, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetAttributeValue failed: %w", err)
+	}
+	return ecdhOpen(recipient, attrs[0].Value)
+}
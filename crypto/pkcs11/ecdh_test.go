@@ -0,0 +1,82 @@
+// +build cgo
+
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs11
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/containers/ocicrypt/fips"
+)
+
+// TestECDHEncryptOpen tests the ECDH recipients without a pkcs11 device by
+// computing the shared secret that CKM_ECDH1_DERIVE yields in software
+func TestECDHEncryptOpen(t *testing.T) {
+	if fips.Enforced() {
+		t.Skip("ECDH recipients are not available in FIPS 140-only mode")
+	}
+
+	testinput := "Hello World!"
+
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		privKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p11json, err := EncryptMultiple([]interface{}{&privKey.PublicKey}, []byte(testinput))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pkcs11blob := Pkcs11Blob{}
+		if err := json.Unmarshal(p11json, &pkcs11blob); err != nil {
+			t.Fatal(err)
+		}
+		recipient := pkcs11blob.Recipients[0]
+		if recipient.Alg != ECDHAlgorithm {
+			t.Fatalf("unexpected algorithm '%s'", recipient.Alg)
+		}
+		epk, err := base64.StdEncoding.DecodeString(recipient.Epk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, y := elliptic.Unmarshal(curve, epk)
+		if x == nil {
+			t.Fatal("invalid ephemeral public key")
+		}
+		z := ecdhSharedSecret(curve, x, y, privKey.D.Bytes())
+
+		plaintext, err := ecdhOpen(&recipient, z)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(plaintext) != testinput {
+			t.Fatalf("plaintext '%s' is not expected '%s'", plaintext, testinput)
+		}
+
+		z[0] ^= 1
+		if _, err := ecdhOpen(&recipient, z); err == nil {
+			t.Fatal("decryption with the wrong shared secret must fail")
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs11
+
+import (
+	"fmt"
+
+	"github.com/containers/ocicrypt/errdefs"
+	pkcs11uri "github.com/stefanberger/go-pkcs11uri"
+	"gopkg.in/yaml.v2"
+)
+
+// PIVSlot is a key slot of a PIV smart card, such as a YubiKey
+type PIVSlot string
+
+const (
+	// PIVSlotAuthentication is the slot of the PIV authentication key
+	PIVSlotAuthentication PIVSlot = "9a"
+	// PIVSlotSignature is the slot of the digital signature key
+	PIVSlotSignature PIVSlot = "9c"
+	// PIVSlotKeyManagement is the slot of the key management key
+	PIVSlotKeyManagement PIVSlot = "9d"
+	// PIVSlotCardAuthentication is the slot of the card authentication key
+	PIVSlotCardAuthentication PIVSlot = "9e"
+)
+
+// YubiKeyModuleName is the name of the pkcs11 module shipped with the YubiKey
+// tools (libykcs11.so)
+const YubiKeyModuleName = "ykcs11"
+
+// pivSlotKeyIDs are the object IDs that ykcs11 assigns to the keys in the
+// PIV slots
+var pivSlotKeyIDs = map[PIVSlot]byte{
+	PIVSlotAuthentication:     1,
+	PIVSlotSignature:          2,
+	PIVSlotKeyManagement:      3,
+	PIVSlotCardAuthentication: 4,
+}
+
+// YubiKey describes a YubiKey found by FindYubiKeys
+type YubiKey struct {
+	// Label is the label of the PIV token, such as 'YubiKey PIV #12345678'
+	Label string
+	// Serial is the serial number of the YubiKey
+	Serial string
+}
+
+// PINCallback is called to get the PIN of a YubiKey
+type PINCallback func(yubikey YubiKey) (string, error)
+
+// YubiKeyOptions selects a key on a YubiKey
+type YubiKeyOptions struct {
+	// Serial selects the YubiKey by its serial number; it may be empty if
+	// only one YubiKey is connected
+	Serial string
+	// Slot is the PIV slot holding the key; it defaults to PIVSlotAuthentication
+	Slot PIVSlot
+	// PINCallback is called to get the PIN, which is needed for decryption;
+	// for encryption it may be nil
+	PINCallback PINCallback
+	// Config holds the directories where the ykcs11 module is searched and
+	// the allowed module paths
+	Config *Pkcs11Config
+}
+
+// yubiKeyURI returns the pkcs11 URI of the key in the given PIV slot of a YubiKey
+func yubiKeyURI(yubikey YubiKey, slot PIVSlot, pin string) (*pkcs11uri.Pkcs11URI, error) {
+	if slot == "" {
+		slot = PIVSlotAuthentication
+	}
+	keyid, ok := pivSlotKeyIDs[slot]
+	if !ok {
+		return nil, errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("unsupported PIV slot '%s'", slot))
+	}
+
+	p11uri := pkcs11uri.New()
+	if err := p11uri.AddPathAttribute("token", yubikey.Label); err != nil {
+		return nil, err
+	}
+	if err := p11uri.AddPathAttribute("id", string([]byte{keyid})); err != nil {
+		return nil, err
+	}
+	if err := p11uri.AddQueryAttribute("module-name", YubiKeyModuleName); err != nil {
+		return nil, err
+	}
+	if pin != "" {
+		if err := p11uri.AddQueryAttribute("pin-value", pin); err != nil {
+			return nil, err
+		}
+	}
+	return p11uri, nil
+}
+
+// marshalPkcs11KeyFile returns the pkcs11 key file holding the given pkcs11 URI
+func marshalPkcs11KeyFile(p11uri *pkcs11uri.Pkcs11URI) ([]byte, error) {
+	uri, err := p11uri.Format()
+	if err != nil {
+		return nil, err
+	}
+	p11keyfile := Pkcs11KeyFile{}
+	p11keyfile.Pkcs11.Uri = uri
+	return yaml.Marshal(&p11keyfile)
+}
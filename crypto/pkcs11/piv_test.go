@@ -0,0 +1,72 @@
+// +build cgo
+
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs11
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+func TestYubiKeyKeyFile(t *testing.T) {
+	yubikey := YubiKey{Label: "YubiKey PIV #12345678", Serial: "12345678"}
+
+	for _, tc := range []struct {
+		slot  PIVSlot
+		pin   string
+		keyid string
+	}{
+		{slot: "", keyid: "\x01"},
+		{slot: PIVSlotSignature, pin: "123456", keyid: "\x02"},
+		{slot: PIVSlotKeyManagement, keyid: "\x03"},
+		{slot: PIVSlotCardAuthentication, keyid: "\x04"},
+	} {
+		p11uri, err := yubiKeyURI(yubikey, tc.slot, tc.pin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyfile, err := marshalPkcs11KeyFile(p11uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p11keyfileobj, err := ParsePkcs11KeyFile(keyfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyid, _, err := pkcs11UriGetKeyIdAndLabel(p11keyfileobj.Uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keyid != tc.keyid {
+			t.Fatalf("slot '%s': expected key id %q, got %q", tc.slot, tc.keyid, keyid)
+		}
+		if token, _ := p11keyfileobj.Uri.GetPathAttribute("token", false); token != yubikey.Label {
+			t.Fatalf("expected token '%s', got '%s'", yubikey.Label, token)
+		}
+		if pin, _ := p11keyfileobj.Uri.GetPIN(); pin != tc.pin {
+			t.Fatalf("expected PIN '%s', got '%s'", tc.pin, pin)
+		}
+	}
+
+	if _, err := yubiKeyURI(yubikey, "82", ""); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration for an unsupported slot, got %v", err)
+	}
+}
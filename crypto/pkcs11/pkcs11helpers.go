@@ -19,20 +19,24 @@
 package pkcs11
 
 import (
+	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash"
 	"os"
 	"strconv"
 	"strings"
 
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
+	"github.com/containers/ocicrypt/log"
 	"github.com/miekg/pkcs11"
-	"github.com/pkg/errors"
 	pkcs11uri "github.com/stefanberger/go-pkcs11uri"
 )
 
@@ -58,6 +62,16 @@ var (
 	}
 )
 
+// getOAEPHash returns the OAEP hash set in OCICRYPT_OAEP_HASHALG; in FIPS mode
+// it defaults to 'sha256' since SHA-1 may not be available
+func getOAEPHash() string {
+	oaephash := os.Getenv("OCICRYPT_OAEP_HASHALG")
+	if oaephash == "" && fips.Enabled() {
+		return "sha256"
+	}
+	return oaephash
+}
+
 // rsaPublicEncryptOAEP encrypts the given plaintext with the given *rsa.PublicKey; the
 // environment variable OCICRYPT_OAEP_HASHALG can be set to 'sha1' to force usage of sha1 for OAEP (SoftHSM).
 // This function is needed by clients who are using a public key file for pkcs11 encryption
@@ -67,7 +81,7 @@ func rsaPublicEncryptOAEP(pubKey *rsa.PublicKey, plaintext []byte) ([]byte, stri
 		hashalg  string
 	)
 
-	oaephash := os.Getenv("OCICRYPT_OAEP_HASHALG")
+	oaephash := getOAEPHash()
 	// The default is 'sha1'
 	switch strings.ToLower(oaephash) {
 	case "sha1", "":
@@ -77,11 +91,11 @@ func rsaPublicEncryptOAEP(pubKey *rsa.PublicKey, plaintext []byte) ([]byte, stri
 		hashfunc = sha256.New()
 		hashalg = "sha256"
 	default:
-		return nil, "", errors.Errorf("Unsupported OAEP hash '%s'", oaephash)
+		return nil, "", fmt.Errorf("Unsupported OAEP hash '%s'", oaephash)
 	}
 	ciphertext, err := rsa.EncryptOAEP(hashfunc, rand.Reader, pubKey, plaintext, OAEPLabel)
 	if err != nil {
-		return nil, "", errors.Wrapf(err, "rss.EncryptOAEP failed")
+		return nil, "", fmt.Errorf("rss.EncryptOAEP failed: %w", err)
 	}
 
 	return ciphertext, hashalg, nil
@@ -97,7 +111,7 @@ func pkcs11UriGetLoginParameters(p11uri *pkcs11uri.Pkcs11URI, privateKeyOperatio
 	)
 	if privateKeyOperation {
 		if !p11uri.HasPIN() {
-			return "", "", 0, errors.New("Missing PIN for private key operation")
+			return "", "", 0, fmt.Errorf("Missing PIN for private key operation: %w", errdefs.ErrConfiguration)
 		}
 	}
 	// some devices require a PIN to find a *public* key object, others don't
@@ -105,7 +119,7 @@ func pkcs11UriGetLoginParameters(p11uri *pkcs11uri.Pkcs11URI, privateKeyOperatio
 
 	module, err := p11uri.GetModule()
 	if err != nil {
-		return "", "", 0, errors.Wrap(err, "No module available in pkcs11 URI")
+		return "", "", 0, fmt.Errorf("No module available in pkcs11 URI: %w", err)
 	}
 
 	slotid := int64(-1)
@@ -114,7 +128,7 @@ func pkcs11UriGetLoginParameters(p11uri *pkcs11uri.Pkcs11URI, privateKeyOperatio
 	if ok {
 		slotid, err = strconv.ParseInt(slot, 10, 64)
 		if err != nil {
-			return "", "", 0, errors.Wrap(err, "slot-id is not a valid number")
+			return "", "", 0, fmt.Errorf("slot-id is not a valid number: %w", err)
 		}
 		if slotid < 0 {
 			return "", "", 0, fmt.Errorf("slot-id is a negative number")
@@ -137,83 +151,6 @@ func pkcs11UriGetKeyIdAndLabel(p11uri *pkcs11uri.Pkcs11URI) (string, string, err
 	return keyid, label, nil
 }
 
-// pkcs11OpenSession opens a session with a pkcs11 device at the given slot and logs in with the given PIN
-func pkcs11OpenSession(p11ctx *pkcs11.Ctx, slotid uint, pin string) (session pkcs11.SessionHandle, err error) {
-	session, err = p11ctx.OpenSession(uint(slotid), pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
-	if err != nil {
-		return 0, errors.Wrapf(err, "OpenSession to slot %d failed", slotid)
-	}
-	if len(pin) > 0 {
-		err = p11ctx.Login(session, pkcs11.CKU_USER, pin)
-		if err != nil {
-			_ = p11ctx.CloseSession(session)
-			return 0, errors.Wrap(err, "Could not login to device")
-		}
-	}
-	return session, nil
-}
-
-// pkcs11UriLogin uses the given pkcs11 URI to select the pkcs11 module (share libary) and to get
-// the PIN to use for login; if the URI contains a slot-id, the given slot-id will be used, otherwise
-// one slot after the other will be attempted and the first one where login succeeds will be used
-func pkcs11UriLogin(p11uri *pkcs11uri.Pkcs11URI, privateKeyOperation bool) (ctx *pkcs11.Ctx, session pkcs11.SessionHandle, err error) {
-	pin, module, slotid, err := pkcs11UriGetLoginParameters(p11uri, privateKeyOperation)
-	if err != nil {
-		return nil, 0, err
-	}
-
-	p11ctx := pkcs11.New(module)
-	if p11ctx == nil {
-		return nil, 0, errors.New("Please check module path, input is: " + module)
-	}
-
-	err = p11ctx.Initialize()
-	if err != nil {
-		p11Err := err.(pkcs11.Error)
-		if p11Err != pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED {
-			return nil, 0, errors.Wrap(err, "Initialize failed")
-		}
-	}
-
-	if slotid >= 0 {
-		session, err := pkcs11OpenSession(p11ctx, uint(slotid), pin)
-		return p11ctx, session, err
-	} else {
-		slots, err := p11ctx.GetSlotList(true)
-		if err != nil {
-			return nil, 0, errors.Wrap(err, "GetSlotList failed")
-		}
-
-		tokenlabel, ok := p11uri.GetPathAttribute("token", false)
-		if !ok {
-			return nil, 0, errors.New("Missing 'token' attribute since 'slot-id' was not given")
-		}
-
-		for _, slot := range slots {
-			ti, err := p11ctx.GetTokenInfo(slot)
-			if err != nil || ti.Label != tokenlabel {
-				continue
-			}
-
-			session, err = pkcs11OpenSession(p11ctx, slot, pin)
-			if err == nil {
-				return p11ctx, session, err
-			}
-		}
-		if len(pin) > 0 {
-			return nil, 0, errors.New("Could not create session to any slot and/or log in")
-		}
-		return nil, 0, errors.New("Could not create session to any slot")
-	}
-}
-
-func pkcs11Logout(ctx *pkcs11.Ctx, session pkcs11.SessionHandle) {
-	_ = ctx.Logout(session)
-	_ = ctx.CloseSession(session)
-	_ = ctx.Finalize()
-	ctx.Destroy()
-}
-
 // findObject finds an object of the given class with the given keyid and/or label
 func findObject(p11ctx *pkcs11.Ctx, session pkcs11.SessionHandle, class uint, keyid, label string) (pkcs11.ObjectHandle, error) {
 	msg := ""
@@ -234,54 +171,63 @@ func findObject(p11ctx *pkcs11.Ctx, session pkcs11.SessionHandle, class uint, ke
 	}
 
 	if err := p11ctx.FindObjectsInit(session, template); err != nil {
-		return 0, errors.Wrap(err, "FindObjectsInit failed")
+		return 0, fmt.Errorf("FindObjectsInit failed: %w", err)
 	}
 
 	obj, _, err := p11ctx.FindObjects(session, 100)
 	if err != nil {
-		return 0, errors.Wrap(err, "FindObjects failed")
+		return 0, fmt.Errorf("FindObjects failed: %w", err)
 	}
 
 	if err := p11ctx.FindObjectsFinal(session); err != nil {
-		return 0, errors.Wrap(err, "FindObjectsFinal failed")
+		return 0, fmt.Errorf("FindObjectsFinal failed: %w", err)
 	}
 	if len(obj) > 1 {
-		return 0, errors.Errorf("There are too many (=%d) keys with %s", len(obj), msg)
+		return 0, fmt.Errorf("There are too many (=%d) keys with %s", len(obj), msg)
 	} else if len(obj) == 1 {
 		return obj[0], nil
 	}
 
-	return 0, errors.Errorf("Could not find any object with %s", msg)
+	return 0, fmt.Errorf("Could not find any object with %s", msg)
 }
 
-// publicEncryptOAEP uses a public key described by a pkcs11 URI to OAEP encrypt the given plaintext
-func publicEncryptOAEP(pubKey *Pkcs11KeyFileObject, plaintext []byte) ([]byte, string, error) {
-	oldenv, err := setEnvVars(pubKey.Uri.GetEnvMap())
+// publicEncrypt uses a public key described by a pkcs11 URI to encrypt the given plaintext;
+// RSA keys OAEP encrypt it on the device while for EC keys the public key is read from the
+// device and the plaintext is encrypted using ECDH
+func publicEncrypt(pubKey *Pkcs11KeyFileObject, plaintext []byte) (_ *Pkcs11Recipient, err error) {
+	s, err := pool.getSession(pubKey.Uri, false)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
-	defer restoreEnv(oldenv)
+	defer func() { s.release(err) }()
+	p11ctx, session := s.ctx, s.handle
 
-	p11ctx, session, err := pkcs11UriLogin(pubKey.Uri, false)
+	keyid, label, err := pkcs11UriGetKeyIdAndLabel(pubKey.Uri)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
-	defer pkcs11Logout(p11ctx, session)
 
-	keyid, label, err := pkcs11UriGetKeyIdAndLabel(pubKey.Uri)
+	p11PubKey, err := findObject(p11ctx, session, pkcs11.CKO_PUBLIC_KEY, keyid, label)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 
-	p11PubKey, err := findObject(p11ctx, session, pkcs11.CKO_PUBLIC_KEY, keyid, label)
+	isEC, err := isECKey(p11ctx, session, p11PubKey)
 	if err != nil {
-		return nil, "", err
+		return nil, err
+	}
+	if isEC {
+		ecPubKey, err := getECPublicKey(p11ctx, session, p11PubKey)
+		if err != nil {
+			return nil, err
+		}
+		return ecdhEncrypt(ecPubKey, plaintext)
 	}
 
 	var hashalg string
 
 	var oaep *pkcs11.OAEPParams
-	oaephash := os.Getenv("OCICRYPT_OAEP_HASHALG")
+	oaephash := getOAEPHash()
 	// the default is sha1
 	switch strings.ToLower(oaephash) {
 	case "sha1", "":
@@ -291,34 +237,29 @@ func publicEncryptOAEP(pubKey *Pkcs11KeyFileObject, plaintext []byte) ([]byte, s
 		oaep = OAEPSha256Params
 		hashalg = "sha256"
 	default:
-		return nil, "", errors.Errorf("Unsupported OAEP hash '%s'", oaephash)
+		return nil, fmt.Errorf("Unsupported OAEP hash '%s'", oaephash)
 	}
 
 	err = p11ctx.EncryptInit(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, oaep)}, p11PubKey)
 	if err != nil {
-		return nil, "", errors.Wrap(err, "EncryptInit error")
+		return nil, fmt.Errorf("EncryptInit error: %w", err)
 	}
 
 	ciphertext, err := p11ctx.Encrypt(session, plaintext)
 	if err != nil {
-		return nil, "", errors.Wrap(err, "Encrypt failed")
+		return nil, fmt.Errorf("Encrypt failed: %w", err)
 	}
-	return ciphertext, hashalg, nil
+	return oaepRecipient(ciphertext, hashalg), nil
 }
 
 // privateDecryptOAEP uses a pkcs11 URI describing a private key to OAEP decrypt a ciphertext
-func privateDecryptOAEP(privKeyObj *Pkcs11KeyFileObject, ciphertext []byte, hashalg string) ([]byte, error) {
-	oldenv, err := setEnvVars(privKeyObj.Uri.GetEnvMap())
-	if err != nil {
-		return nil, err
-	}
-	defer restoreEnv(oldenv)
-
-	p11ctx, session, err := pkcs11UriLogin(privKeyObj.Uri, true)
+func privateDecryptOAEP(privKeyObj *Pkcs11KeyFileObject, ciphertext []byte, hashalg string) (_ []byte, err error) {
+	s, err := pool.getSession(privKeyObj.Uri, true)
 	if err != nil {
 		return nil, err
 	}
-	defer pkcs11Logout(p11ctx, session)
+	defer func() { s.release(err) }()
+	p11ctx, session := s.ctx, s.handle
 
 	keyid, label, err := pkcs11UriGetKeyIdAndLabel(privKeyObj.Uri)
 	if err != nil {
@@ -339,16 +280,16 @@ func privateDecryptOAEP(privKeyObj *Pkcs11KeyFileObject, ciphertext []byte, hash
 	case "sha256":
 		oaep = OAEPSha256Params
 	default:
-		return nil, errors.Errorf("Unsupported hash algorithm '%s' for decryption", hashalg)
+		return nil, fmt.Errorf("Unsupported hash algorithm '%s' for decryption", hashalg)
 	}
 
 	err = p11ctx.DecryptInit(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, oaep)}, p11PrivKey)
 	if err != nil {
-		return nil, errors.Wrapf(err, "DecryptInit failed")
+		return nil, fmt.Errorf("DecryptInit failed: %w", err)
 	}
 	plaintext, err := p11ctx.Decrypt(session, ciphertext)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Decrypt failed")
+		return nil, fmt.Errorf("Decrypt failed: %w", err)
 	}
 	return plaintext, err
 }
@@ -366,11 +307,27 @@ type Pkcs11Blob struct {
 type Pkcs11Recipient struct {
 	Blob string `json:"blob"`
 	Hash string `json:"hash,omitempty"`
+	// Alg, Epk and Key are only set for EC keys, where Blob is encrypted with
+	// AES-256-GCM under a key that is wrapped into Key using ECDH with the
+	// ephemeral public key Epk
+	Alg string `json:"alg,omitempty"`
+	Epk string `json:"epk,omitempty"`
+	Key string `json:"key,omitempty"`
+}
+
+func oaepRecipient(ciphertext []byte, hashalg string) *Pkcs11Recipient {
+	if hashalg == OAEPDefaultHash {
+		hashalg = ""
+	}
+	return &Pkcs11Recipient{
+		Blob: base64.StdEncoding.EncodeToString(ciphertext),
+		Hash: hashalg,
+	}
 }
 
 // EncryptMultiple encrypts for one or multiple pkcs11 devices; the public keys passed to this function
-// may either be *rsa.PublicKey or *pkcs11uri.Pkcs11URI; the returned byte array is a JSON string of the
-// following format:
+// may either be *rsa.PublicKey, *ecdsa.PublicKey or *pkcs11uri.Pkcs11URI; the returned byte array is a
+// JSON string of the following format:
 // {
 //   recipients: [  // recipient list
 //     {
@@ -381,39 +338,45 @@ type Pkcs11Recipient struct {
 //        "blob": <base64 encoded RSA OAEP encrypted blob>
 //        "hash": <hash used for OAEP other than 'sha256'>
 //     } ,
+//     {
+//        "blob": <base64 encoded AES-256-GCM nonce and ciphertext>
+//        "alg": "ECDH-ES+A256KW"
+//        "epk": <base64 encoded uncompressed ephemeral EC public key>
+//        "key": <base64 encoded AES key wrapped AES-256-GCM key>
+//     } ,
 //     [...]
 //   ]
 // }
 func EncryptMultiple(pubKeys []interface{}, data []byte) ([]byte, error) {
 	var (
-		ciphertext []byte
+		recipient  *Pkcs11Recipient
 		err        error
 		pkcs11blob Pkcs11Blob = Pkcs11Blob{}
-		hashalg    string
 	)
 
 	for _, pubKey := range pubKeys {
 		switch pkey := pubKey.(type) {
 		case *rsa.PublicKey:
+			var (
+				ciphertext []byte
+				hashalg    string
+			)
 			ciphertext, hashalg, err = rsaPublicEncryptOAEP(pkey, data)
+			if err == nil {
+				recipient = oaepRecipient(ciphertext, hashalg)
+			}
+		case *ecdsa.PublicKey:
+			recipient, err = ecdhEncrypt(pkey, data)
 		case *Pkcs11KeyFileObject:
-			ciphertext, hashalg, err = publicEncryptOAEP(pkey, data)
+			recipient, err = publicEncrypt(pkey, data)
 		default:
-			err = errors.Errorf("Unsupported key object type for pkcs11 public key")
+			err = fmt.Errorf("Unsupported key object type for pkcs11 public key")
 		}
 		if err != nil {
 			return nil, err
 		}
 
-		if hashalg == OAEPDefaultHash {
-			hashalg = ""
-		}
-		recipient := Pkcs11Recipient{
-			Blob: base64.StdEncoding.EncodeToString(ciphertext),
-			Hash: hashalg,
-		}
-
-		pkcs11blob.Recipients = append(pkcs11blob.Recipients, recipient)
+		pkcs11blob.Recipients = append(pkcs11blob.Recipients, *recipient)
 	}
 	return json.Marshal(&pkcs11blob)
 }
@@ -433,16 +396,38 @@ func EncryptMultiple(pubKeys []interface{}, data []byte) ([]byte, error) {
 //     [...]
 // }
 func Decrypt(privKeyObjs []*Pkcs11KeyFileObject, pkcs11blobstr []byte) ([]byte, error) {
+	plaintext, _, err := DecryptWithKey(privKeyObjs, pkcs11blobstr)
+	return plaintext, err
+}
+
+// DecryptWithKey decrypts the pkcs11 blob like Decrypt and also returns the
+// private key that decrypted it
+func DecryptWithKey(privKeyObjs []*Pkcs11KeyFileObject, pkcs11blobstr []byte) ([]byte, *Pkcs11KeyFileObject, error) {
 	pkcs11blob := Pkcs11Blob{}
 	err := json.Unmarshal(pkcs11blobstr, &pkcs11blob)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Could not parse Pkcs11Blob")
+		return nil, nil, errdefs.WithCategory(errdefs.ErrProtocol, fmt.Errorf("Could not parse Pkcs11Blob: %w", err))
 	}
 
 	// since we do trial and error, collect all encountered errors
 	errs := ""
 
 	for _, recipient := range pkcs11blob.Recipients {
+		recipient := recipient
+		if recipient.Alg != "" {
+			if recipient.Alg != ECDHAlgorithm {
+				errs += fmt.Sprintf("Unsupported algorithm '%s'\n", recipient.Alg)
+				continue
+			}
+			for _, privKeyObj := range privKeyObjs {
+				plaintext, err := privateDecryptECDH(privKeyObj, &recipient)
+				if err == nil {
+					return plaintext, privKeyObj, nil
+				}
+				errs += decryptError(privKeyObj, err)
+			}
+			continue
+		}
 		ciphertext, err := base64.StdEncoding.DecodeString(recipient.Blob)
 		if err != nil || len(ciphertext) == 0 {
 			// This should never happen... we skip over decoding issues
@@ -453,15 +438,22 @@ func Decrypt(privKeyObjs []*Pkcs11KeyFileObject, pkcs11blobstr []byte) ([]byte,
 		for _, privKeyObj := range privKeyObjs {
 			plaintext, err := privateDecryptOAEP(privKeyObj, ciphertext, recipient.Hash)
 			if err == nil {
-				return plaintext, nil
-			}
-			if uri, err2 := privKeyObj.Uri.Format(); err2 == nil {
-				errs += fmt.Sprintf("%s : %s\n", uri, err)
-			} else {
-				errs += fmt.Sprintf("%s\n", err)
+				return plaintext, privKeyObj, nil
 			}
+			errs += decryptError(privKeyObj, err)
 		}
 	}
 
-	return nil, errors.Errorf("Could not find a pkcs11 key for decryption:\n%s", errs)
+	return nil, nil, fmt.Errorf("Could not find a pkcs11 key for decryption:\n%s: %w", errs, errdefs.ErrNoDecryptionKey)
+}
+
+// decryptError logs the error of a private key that could not decrypt a blob
+// and returns the line to report for it
+func decryptError(privKeyObj *Pkcs11KeyFileObject, err error) string {
+	module, _ := privKeyObj.Uri.GetModule()
+	log.L().Debug("pkcs11 key could not decrypt blob", log.KeyKeyWrapper, "pkcs11", log.KeyProvider, module, log.KeyError, err)
+	if uri, err2 := privKeyObj.Uri.Format(); err2 == nil {
+		return fmt.Sprintf("%s : %s\n", uri, err)
+	}
+	return fmt.Sprintf("%s\n", err)
 }
@@ -19,13 +19,31 @@
 package pkcs11
 
 import (
-	"github.com/pkg/errors"
+	"fmt"
 )
 
 func EncryptMultiple(pubKeys []interface{}, data []byte) ([]byte, error) {
-	return nil, errors.Errorf("ocicrypt pkcs11 not supported on this build")
+	return nil, fmt.Errorf("ocicrypt pkcs11 not supported on this build")
 }
 
 func Decrypt(privKeyObjs []*Pkcs11KeyFileObject, pkcs11blobstr []byte) ([]byte, error) {
-	return nil, errors.Errorf("ocicrypt pkcs11 not supported on this build")
+	return nil, fmt.Errorf("ocicrypt pkcs11 not supported on this build")
+}
+
+func DecryptWithKey(privKeyObjs []*Pkcs11KeyFileObject, pkcs11blobstr []byte) ([]byte, *Pkcs11KeyFileObject, error) {
+	return nil, nil, fmt.Errorf("ocicrypt pkcs11 not supported on this build")
+}
+
+func SetMaxSessions(maxSessions int) {
+}
+
+func CloseSessions() {
+}
+
+func FindYubiKeys(p11conf *Pkcs11Config) ([]YubiKey, error) {
+	return nil, fmt.Errorf("ocicrypt pkcs11 not supported on this build")
+}
+
+func YubiKeyPIVKeyFile(opts YubiKeyOptions) ([]byte, error) {
+	return nil, fmt.Errorf("ocicrypt pkcs11 not supported on this build")
 }
@@ -0,0 +1,305 @@
+// +build cgo
+
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs11
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/miekg/pkcs11"
+	pkcs11uri "github.com/stefanberger/go-pkcs11uri"
+)
+
+// pool is the session pool used for all pkcs11 operations; a pkcs11 module can
+// only be initialized once per process, so there is a single one
+var pool = &sessionPool{
+	maxSessions: DefaultMaxSessions,
+	modules:     make(map[string]*poolModule),
+}
+
+// sessionPool keeps the pkcs11 modules initialized and the sessions with their
+// tokens open so that concurrent operations need not initialize the module
+// and log in each time and can use several sessions in parallel
+type sessionPool struct {
+	mu          sync.Mutex
+	maxSessions int
+	modules     map[string]*poolModule
+}
+
+// poolModule is an initialized pkcs11 module along with the environment
+// variables it was initialized with
+type poolModule struct {
+	ctx    *pkcs11.Ctx
+	env    map[string]string
+	tokens map[uint]*poolToken
+}
+
+// poolToken holds the sessions with the token in a slot; sem holds a value for
+// every session in use and limits their number to the maximum number of
+// sessions
+type poolToken struct {
+	sem      chan struct{}
+	mu       sync.Mutex
+	idle     []pkcs11.SessionHandle
+	loggedIn bool
+	pin      string
+}
+
+// pkcs11Session is a session taken from the session pool; it must be returned
+// by calling release
+type pkcs11Session struct {
+	ctx    *pkcs11.Ctx
+	handle pkcs11.SessionHandle
+	token  *poolToken
+}
+
+// SetMaxSessions sets the maximum number of sessions that are opened with a
+// token; operations beyond that number wait for a session to be released.
+// The number applies to tokens that are used for the first time after the call
+// or after the sessions were closed with CloseSessions. A number less than one
+// selects DefaultMaxSessions.
+func SetMaxSessions(maxSessions int) {
+	if maxSessions < 1 {
+		maxSessions = DefaultMaxSessions
+	}
+	pool.mu.Lock()
+	pool.maxSessions = maxSessions
+	pool.mu.Unlock()
+}
+
+// CloseSessions waits for the sessions in use to be released, closes all
+// sessions, which logs out of the tokens, and finalizes the pkcs11 modules.
+// It should be called when no more pkcs11 operations are expected, for example
+// before the process exits.
+func CloseSessions() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for module, m := range pool.modules {
+		m.close()
+		delete(pool.modules, module)
+	}
+}
+
+// close waits for the sessions of the module in use to be released, closes all
+// its sessions and finalizes it; the pool must be locked
+func (m *poolModule) close() {
+	for slot, t := range m.tokens {
+		// take all the sessions so that none is in use
+		for i := 0; i < cap(t.sem); i++ {
+			t.sem <- struct{}{}
+		}
+		_ = m.ctx.CloseAllSessions(slot)
+	}
+	_ = m.ctx.Finalize()
+	m.ctx.Destroy()
+}
+
+// getModule returns the initialized pkcs11 module; the environment variables
+// are only set while the module is initialized, which is done again if they
+// differ from the ones the module was initialized with before
+func (p *sessionPool) getModule(module string, env map[string]string) (*poolModule, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if m, ok := p.modules[module]; ok {
+		if envEqual(m.env, env) {
+			return m, nil
+		}
+		m.close()
+		delete(p.modules, module)
+	}
+
+	oldenv, err := setEnvVars(env)
+	if err != nil {
+		return nil, err
+	}
+	defer restoreEnv(oldenv)
+
+	p11ctx := pkcs11.New(module)
+	if p11ctx == nil {
+		return nil, fmt.Errorf("Please check module path, input is: %s: %w", module, errdefs.ErrProviderUnreachable)
+	}
+
+	err = p11ctx.Initialize()
+	if err != nil {
+		p11Err := err.(pkcs11.Error)
+		if p11Err != pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED {
+			p11ctx.Destroy()
+			return nil, fmt.Errorf("Initialize failed: %s: %w", err, errdefs.ErrProviderUnreachable)
+		}
+	}
+
+	m := &poolModule{
+		ctx:    p11ctx,
+		env:    env,
+		tokens: make(map[uint]*poolToken),
+	}
+	p.modules[module] = m
+	return m, nil
+}
+
+// getToken returns the token in the given slot of the module
+func (p *sessionPool) getToken(m *poolModule, slot uint) *poolToken {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t, ok := m.tokens[slot]
+	if !ok {
+		t = &poolToken{
+			sem: make(chan struct{}, p.maxSessions),
+		}
+		m.tokens[slot] = t
+	}
+	return t
+}
+
+func envEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if vb, ok := b[k]; !ok || vb != v {
+			return false
+		}
+	}
+	return true
+}
+
+// getSession gets a session from the pool using the given pkcs11 URI to select the pkcs11 module
+// (shared library) and to get the PIN to use for login; if the URI contains a slot-id, the given
+// slot-id will be used, otherwise one slot after the other will be attempted and the first one where
+// login succeeds will be used
+func (p *sessionPool) getSession(p11uri *pkcs11uri.Pkcs11URI, privateKeyOperation bool) (*pkcs11Session, error) {
+	pin, module, slotid, err := pkcs11UriGetLoginParameters(p11uri, privateKeyOperation)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := p.getModule(module, p11uri.GetEnvMap())
+	if err != nil {
+		return nil, err
+	}
+
+	if slotid >= 0 {
+		return p.openSession(m, uint(slotid), pin)
+	}
+
+	slots, err := m.ctx.GetSlotList(true)
+	if err != nil {
+		return nil, fmt.Errorf("GetSlotList failed: %w", err)
+	}
+
+	tokenlabel, ok := p11uri.GetPathAttribute("token", false)
+	if !ok {
+		return nil, errors.New("Missing 'token' attribute since 'slot-id' was not given")
+	}
+
+	for _, slot := range slots {
+		ti, err := m.ctx.GetTokenInfo(slot)
+		if err != nil || ti.Label != tokenlabel {
+			continue
+		}
+
+		s, err := p.openSession(m, slot, pin)
+		if err == nil {
+			return s, nil
+		}
+	}
+	if len(pin) > 0 {
+		return nil, fmt.Errorf("Could not create session to any slot and/or log in: %w", errdefs.ErrProviderUnreachable)
+	}
+	return nil, fmt.Errorf("Could not create session to any slot: %w", errdefs.ErrProviderUnreachable)
+}
+
+// openSession takes an idle session with the token in the given slot or opens a new one, waiting
+// while the maximum number of sessions is in use, and logs in to the token with the given PIN
+// unless already logged in
+func (p *sessionPool) openSession(m *poolModule, slot uint, pin string) (*pkcs11Session, error) {
+	t := p.getToken(m, slot)
+	t.sem <- struct{}{}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var session pkcs11.SessionHandle
+	if n := len(t.idle); n > 0 {
+		session = t.idle[n-1]
+		t.idle = t.idle[:n-1]
+	} else {
+		var err error
+		session, err = m.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			<-t.sem
+			return nil, fmt.Errorf("OpenSession to slot %d failed: %w", slot, err)
+		}
+	}
+
+	if len(pin) > 0 {
+		if t.loggedIn {
+			// the login state is shared by all sessions with a token, so a
+			// different PIN cannot be verified without logging out the others
+			if pin != t.pin {
+				t.idle = append(t.idle, session)
+				<-t.sem
+				return nil, fmt.Errorf("Token in slot %d is logged in with a different PIN: %w", slot, errdefs.ErrWrongPassword)
+			}
+		} else {
+			err := m.ctx.Login(session, pkcs11.CKU_USER, pin)
+			if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+				_ = m.ctx.CloseSession(session)
+				<-t.sem
+				if err == pkcs11.Error(pkcs11.CKR_PIN_INCORRECT) {
+					return nil, fmt.Errorf("Could not login to device: %s: %w", err, errdefs.ErrWrongPassword)
+				}
+				return nil, fmt.Errorf("Could not login to device: %w", err)
+			}
+			t.loggedIn = true
+			t.pin = pin
+		}
+	}
+
+	return &pkcs11Session{
+		ctx:    m.ctx,
+		handle: session,
+		token:  t,
+	}, nil
+}
+
+// release returns the session to the pool; a session used by an operation that failed is closed
+// since the failure may have left it with an active operation or it may have become invalid
+func (s *pkcs11Session) release(err error) {
+	t := s.token
+
+	t.mu.Lock()
+	if err != nil {
+		_ = s.ctx.CloseSession(s.handle)
+		if len(t.idle) == 0 && len(t.sem) == 1 {
+			// closing the last session with a token logs out of it
+			t.loggedIn = false
+		}
+	} else {
+		t.idle = append(t.idle, s.handle)
+	}
+	t.mu.Unlock()
+
+	<-t.sem
+}
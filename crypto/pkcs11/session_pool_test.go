@@ -0,0 +1,64 @@
+// +build cgo
+
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs11
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+func TestSessionPoolUnreachableModule(t *testing.T) {
+	// a file that is not a shared library cannot be loaded as pkcs11 module
+	module := filepath.Join(t.TempDir(), "libnone.so")
+	if err := os.WriteFile(module, []byte("no module"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p11uri, err := ParsePkcs11Uri("pkcs11:token=mytoken;object=mykey?module-path=" + module + "&pin-value=1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p11uri.SetAllowedModulePaths([]string{module})
+
+	_, err = pool.getSession(p11uri, true)
+	if !errors.Is(err, errdefs.ErrProviderUnreachable) {
+		t.Fatalf("expected ErrProviderUnreachable, got %v", err)
+	}
+	if _, ok := pool.modules[module]; ok {
+		t.Fatal("module that could not be loaded must not be kept in the pool")
+	}
+}
+
+func TestSetMaxSessions(t *testing.T) {
+	defer SetMaxSessions(DefaultMaxSessions)
+
+	SetMaxSessions(2)
+	m := &poolModule{tokens: make(map[uint]*poolToken)}
+	if tok := pool.getToken(m, 0); cap(tok.sem) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", cap(tok.sem))
+	}
+
+	SetMaxSessions(0)
+	if tok := pool.getToken(m, 1); cap(tok.sem) != DefaultMaxSessions {
+		t.Fatalf("expected %d sessions, got %d", DefaultMaxSessions, cap(tok.sem))
+	}
+}
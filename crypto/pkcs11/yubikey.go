@@ -0,0 +1,149 @@
+// +build cgo
+
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs11
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/miekg/pkcs11"
+	pkcs11uri "github.com/stefanberger/go-pkcs11uri"
+)
+
+// yubiKeyModule returns the path of the ykcs11 module
+func yubiKeyModule(p11conf *Pkcs11Config) (string, error) {
+	p11uri := pkcs11uri.New()
+	if err := p11uri.AddQueryAttribute("module-name", YubiKeyModuleName); err != nil {
+		return "", err
+	}
+	if p11conf != nil {
+		p11uri.SetModuleDirectories(p11conf.ModuleDirectories)
+		p11uri.SetAllowedModulePaths(p11conf.AllowedModulePaths)
+	}
+	module, err := p11uri.GetModule()
+	if err != nil {
+		return "", fmt.Errorf("Could not find the %s module: %s: %w", YubiKeyModuleName, err, errdefs.ErrProviderUnreachable)
+	}
+	return module, nil
+}
+
+// FindYubiKeys returns the YubiKeys that are connected; the ykcs11 module is searched in the
+// module directories of the given pkcs11 configuration
+func FindYubiKeys(p11conf *Pkcs11Config) ([]YubiKey, error) {
+	module, err := yubiKeyModule(p11conf)
+	if err != nil {
+		return nil, err
+	}
+	m, err := pool.getModule(module, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	slots, err := m.ctx.GetSlotList(true)
+	if err != nil {
+		return nil, fmt.Errorf("GetSlotList failed: %w", err)
+	}
+
+	var yubikeys []YubiKey
+	for _, slot := range slots {
+		ti, err := m.ctx.GetTokenInfo(slot)
+		if err != nil || !strings.HasPrefix(ti.ManufacturerID, "Yubico") {
+			continue
+		}
+		yubikeys = append(yubikeys, YubiKey{
+			Label:  ti.Label,
+			Serial: strings.TrimSpace(ti.SerialNumber),
+		})
+	}
+	return yubikeys, nil
+}
+
+// YubiKeyPIVKeyFile returns a pkcs11 key file for the key in a PIV slot of a YubiKey, which can be
+// used for encryption and decryption like any other pkcs11 key file. The key must already exist in
+// the slot. If a PIN callback is given, the PIN it returns is verified and put into the key file, so
+// the key file must not be stored.
+func YubiKeyPIVKeyFile(opts YubiKeyOptions) ([]byte, error) {
+	yubikeys, err := FindYubiKeys(opts.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		yubikey YubiKey
+		found   bool
+	)
+	for _, yk := range yubikeys {
+		if opts.Serial == "" || yk.Serial == opts.Serial {
+			if found {
+				return nil, errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("More than one YubiKey is connected; a serial number must be given"))
+			}
+			yubikey, found = yk, true
+		}
+	}
+	if !found {
+		if opts.Serial != "" {
+			return nil, fmt.Errorf("Could not find the YubiKey with serial number %s: %w", opts.Serial, errdefs.ErrProviderUnreachable)
+		}
+		return nil, fmt.Errorf("Could not find a YubiKey: %w", errdefs.ErrProviderUnreachable)
+	}
+
+	var pin string
+	if opts.PINCallback != nil {
+		if pin, err = opts.PINCallback(yubikey); err != nil {
+			return nil, err
+		}
+	}
+
+	p11uri, err := yubiKeyURI(yubikey, opts.Slot, pin)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Config != nil {
+		p11uri.SetModuleDirectories(opts.Config.ModuleDirectories)
+		p11uri.SetAllowedModulePaths(opts.Config.AllowedModulePaths)
+	}
+
+	// make sure the key exists and, if a PIN was given, that it is correct
+	class := uint(pkcs11.CKO_PUBLIC_KEY)
+	if pin != "" {
+		class = pkcs11.CKO_PRIVATE_KEY
+	}
+	if err := findYubiKeyObject(p11uri, class); err != nil {
+		return nil, err
+	}
+
+	return marshalPkcs11KeyFile(p11uri)
+}
+
+// findYubiKeyObject checks that the object described by the pkcs11 URI exists
+func findYubiKeyObject(p11uri *pkcs11uri.Pkcs11URI, class uint) (err error) {
+	s, err := pool.getSession(p11uri, class == pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		return err
+	}
+	defer func() { s.release(err) }()
+
+	keyid, label, err := pkcs11UriGetKeyIdAndLabel(p11uri)
+	if err != nil {
+		return err
+	}
+	_, err = findObject(s.ctx, s.handle, class, keyid, label)
+	return err
+}
@@ -17,49 +17,266 @@
 package ocicrypt
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/containers/ocicrypt/audit"
 	"github.com/containers/ocicrypt/blockcipher"
 	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/guard"
 	"github.com/containers/ocicrypt/keywrap"
+	"github.com/containers/ocicrypt/keywrap/age"
+	"github.com/containers/ocicrypt/keywrap/awskms"
+	"github.com/containers/ocicrypt/keywrap/azurekv"
+	"github.com/containers/ocicrypt/keywrap/gcpkms"
+	"github.com/containers/ocicrypt/keywrap/hpke"
 	"github.com/containers/ocicrypt/keywrap/jwe"
+	"github.com/containers/ocicrypt/keywrap/keyless"
+	"github.com/containers/ocicrypt/keywrap/kmsv2"
 	"github.com/containers/ocicrypt/keywrap/pgp"
 	"github.com/containers/ocicrypt/keywrap/pkcs11"
 	"github.com/containers/ocicrypt/keywrap/pkcs7"
+	"github.com/containers/ocicrypt/keywrap/threshold"
+	"github.com/containers/ocicrypt/keywrap/tpm"
+	"github.com/containers/ocicrypt/keywrap/vaulttransit"
+	"github.com/containers/ocicrypt/limits"
+	"github.com/containers/ocicrypt/log"
+	"github.com/containers/ocicrypt/masterkey"
+	"github.com/containers/ocicrypt/metrics"
+	"github.com/containers/ocicrypt/profiling"
+	"github.com/containers/ocicrypt/remotekeys"
+	"github.com/containers/ocicrypt/tracing"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
-	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
 )
 
 // EncryptLayerFinalizer is a finalizer run to return the annotations to set for
 // the encrypted layer
 type EncryptLayerFinalizer func() (map[string]string, error)
 
+// EncryptLayerDigestsFinalizer is a finalizer run to return the annotations to
+// set for the encrypted layer and its digests; the digests are nil if the layer
+// was already encrypted and only its recipients changed
+type EncryptLayerDigestsFinalizer func() (map[string]string, *LayerDigests, error)
+
+// LayerDigests holds the digests and the sizes of a layer before and after it
+// was encrypted, as the block cipher saw them
+type LayerDigests struct {
+	// PlaintextDigest is the digest of the plaintext layer
+	PlaintextDigest digest.Digest
+	// PlaintextSize is the size of the plaintext layer in bytes
+	PlaintextSize int64
+	// Digest is the digest of the encrypted layer
+	Digest digest.Digest
+	// Size is the size of the encrypted layer in bytes
+	Size int64
+}
+
+// newLayerDigests returns the digests the block cipher tracked while
+// encrypting a layer
+func newLayerDigests(opts blockcipher.LayerBlockCipherOptions) *LayerDigests {
+	return &LayerDigests{
+		PlaintextDigest: opts.PlaintextDigest,
+		PlaintextSize:   opts.PlaintextSize,
+		Digest:          opts.CiphertextDigest,
+		Size:            opts.CiphertextSize,
+	}
+}
+
+// withoutDigests turns a finalizer returning the digests of a layer into an
+// EncryptLayerFinalizer
+func withoutDigests(fin EncryptLayerDigestsFinalizer) EncryptLayerFinalizer {
+	if fin == nil {
+		return nil
+	}
+	return func() (map[string]string, error) {
+		annotations, _, err := fin()
+		return annotations, err
+	}
+}
+
 func init() {
-	keyWrappers = make(map[string]keywrap.KeyWrapper)
+	keyWrappers = make(map[string]*keyWrapperRegistration)
 	keyWrapperAnnotations = make(map[string]string)
 	RegisterKeyWrapper("pgp", pgp.NewKeyWrapper())
 	RegisterKeyWrapper("jwe", jwe.NewKeyWrapper())
 	RegisterKeyWrapper("pkcs7", pkcs7.NewKeyWrapper())
 	RegisterKeyWrapper("pkcs11", pkcs11.NewKeyWrapper())
+	RegisterKeyWrapper("kmsv2", kmsv2.NewKeyWrapper())
+	RegisterKeyWrapper("aws-kms", awskms.NewKeyWrapper())
+	RegisterKeyWrapper("gcp-kms", gcpkms.NewKeyWrapper())
+	RegisterKeyWrapper("azure-kv", azurekv.NewKeyWrapper())
+	RegisterKeyWrapper("vault-transit", vaulttransit.NewKeyWrapper())
+	RegisterKeyWrapper("tpm", tpm.NewKeyWrapper())
+	RegisterKeyWrapper("keyless", keyless.NewKeyWrapper())
+	RegisterKeyWrapper("age", age.NewKeyWrapper())
+	RegisterKeyWrapper("hpke", hpke.NewKeyWrapper())
+	RegisterKeyWrapper("mlkem768x25519", hpke.NewMLKEM768X25519KeyWrapper())
+	RegisterKeyWrapper("threshold", threshold.NewKeyWrapper())
+}
+
+// keyWrapperRegistration is a key wrapper registered for an encryption scheme
+type keyWrapperRegistration struct {
+	scheme       string
+	annotationID string
+	keyWrapper   keywrap.KeyWrapper
+	priority     int
+	// seq orders registrations with the same priority
+	seq uint64
+}
+
+var (
+	keyWrappersLock sync.RWMutex
+	// keyWrappers are the registrations by encryption scheme
+	keyWrappers map[string]*keyWrapperRegistration
+	// keyWrapperAnnotations are the encryption schemes by annotation ID
+	keyWrapperAnnotations map[string]string
+	keyWrapperSeq         uint64
+)
+
+// KeyWrapperOpt is an option for AddKeyWrapper
+type KeyWrapperOpt func(*keyWrapperOpts)
+
+type keyWrapperOpts struct {
+	priority int
+	replace  bool
+}
+
+// WithPriority sets the priority of a key wrapper; key wrappers with higher
+// priorities wrap and are tried for unwrapping layer keys first. The built-in
+// key wrappers have priority 0 and key wrappers with the same priority are
+// used in the order of their registration.
+func WithPriority(priority int) KeyWrapperOpt {
+	return func(o *keyWrapperOpts) {
+		o.priority = priority
+	}
 }
 
-var keyWrappers map[string]keywrap.KeyWrapper
-var keyWrapperAnnotations map[string]string
+// WithReplace allows AddKeyWrapper to replace the key wrappers registered for
+// the same encryption scheme or annotation ID
+func WithReplace() KeyWrapperOpt {
+	return func(o *keyWrapperOpts) {
+		o.replace = true
+	}
+}
+
+// AddKeyWrapper registers a key wrapper for an encryption scheme, which is the
+// prefix of the parameters it uses, such as 'jwe'. The wrapped keys are stored
+// in the annotation with the ID the key wrapper returns, which should start
+// with org.opencontainers.image.enc.keys. for tools like the key rotation to
+// find them. It fails with errdefs.ErrConfiguration if another key wrapper is
+// registered for the scheme or the annotation ID unless WithReplace is given.
+// It may be called while layers are encrypted or decrypted.
+func AddKeyWrapper(scheme string, iface keywrap.KeyWrapper, opts ...KeyWrapperOpt) error {
+	if scheme == "" || iface == nil || iface.GetAnnotationID() == "" {
+		return fmt.Errorf("key wrappers need an encryption scheme and an annotation ID: %w", errdefs.ErrConfiguration)
+	}
+	o := keyWrapperOpts{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	r := &keyWrapperRegistration{
+		scheme:       scheme,
+		annotationID: iface.GetAnnotationID(),
+		keyWrapper:   iface,
+		priority:     o.priority,
+	}
+	return addKeyWrapper(r, o.replace)
+}
 
-// RegisterKeyWrapper allows to register key wrappers by their encryption scheme
+// addKeyWrapper registers r; it only fails if replace is false
+func addKeyWrapper(r *keyWrapperRegistration, replace bool) error {
+	scheme := r.scheme
+	keyWrappersLock.Lock()
+	defer keyWrappersLock.Unlock()
+	old, schemeTaken := keyWrappers[scheme]
+	oldScheme, annotationTaken := keyWrapperAnnotations[r.annotationID]
+	if !replace {
+		if schemeTaken {
+			return fmt.Errorf("a key wrapper is already registered for the scheme %s: %w", scheme, errdefs.ErrConfiguration)
+		}
+		if annotationTaken {
+			return fmt.Errorf("the key wrapper of the scheme %s already uses the annotation %s: %w", oldScheme, r.annotationID, errdefs.ErrConfiguration)
+		}
+	}
+	if schemeTaken {
+		delete(keyWrapperAnnotations, old.annotationID)
+	}
+	if annotationTaken {
+		delete(keyWrappers, oldScheme)
+	}
+	keyWrapperSeq++
+	r.seq = keyWrapperSeq
+	keyWrappers[scheme] = r
+	keyWrapperAnnotations[r.annotationID] = scheme
+	return nil
+}
+
+// RegisterKeyWrapper allows to register key wrappers by their encryption scheme;
+// it may be called while layers are encrypted or decrypted. It replaces the key
+// wrappers registered for the same scheme or annotation ID and ignores a nil
+// key wrapper; AddKeyWrapper validates the key wrapper and detects conflicts
+// instead.
 func RegisterKeyWrapper(scheme string, iface keywrap.KeyWrapper) {
-	keyWrappers[scheme] = iface
-	keyWrapperAnnotations[iface.GetAnnotationID()] = scheme
+	if iface == nil {
+		return
+	}
+	_ = addKeyWrapper(&keyWrapperRegistration{
+		scheme:       scheme,
+		annotationID: iface.GetAnnotationID(),
+		keyWrapper:   iface,
+	}, true)
 }
 
 // GetKeyWrapper looks up the encryptor interface given an encryption scheme (gpg, jwe)
 func GetKeyWrapper(scheme string) keywrap.KeyWrapper {
-	return keyWrappers[scheme]
+	keyWrappersLock.RLock()
+	defer keyWrappersLock.RUnlock()
+	if r, ok := keyWrappers[scheme]; ok {
+		return r.keyWrapper
+	}
+	return nil
+}
+
+// GetKeyWrapperSchemes returns the registered encryption schemes in the order
+// in which their key wrappers are used
+func GetKeyWrapperSchemes() []string {
+	registered := getKeyWrapperAnnotations()
+	schemes := make([]string, 0, len(registered))
+	for _, r := range registered {
+		schemes = append(schemes, r.scheme)
+	}
+	return schemes
+}
+
+// getKeyWrapperAnnotations returns a copy of the registrations ordered by
+// priority that may be iterated over without holding the lock
+func getKeyWrapperAnnotations() []keyWrapperRegistration {
+	keyWrappersLock.RLock()
+	registered := make([]keyWrapperRegistration, 0, len(keyWrappers))
+	for _, r := range keyWrappers {
+		registered = append(registered, *r)
+	}
+	keyWrappersLock.RUnlock()
+	sort.Slice(registered, func(i, j int) bool {
+		if registered[i].priority != registered[j].priority {
+			return registered[i].priority > registered[j].priority
+		}
+		return registered[i].seq < registered[j].seq
+	})
+	return registered
 }
 
 // GetWrappedKeysMap returns a map of wrappedKeys as values in a
@@ -67,7 +284,8 @@ func GetKeyWrapper(scheme string) keywrap.KeyWrapper {
 func GetWrappedKeysMap(desc ocispec.Descriptor) map[string]string {
 	wrappedKeysMap := make(map[string]string)
 
-	for annotationsID, scheme := range keyWrapperAnnotations {
+	for _, r := range getKeyWrapperAnnotations() {
+		annotationsID, scheme := r.annotationID, r.scheme
 		if annotation, ok := desc.Annotations[annotationsID]; ok {
 			wrappedKeysMap[scheme] = annotation
 		}
@@ -76,7 +294,72 @@ func GetWrappedKeysMap(desc ocispec.Descriptor) map[string]string {
 }
 
 // EncryptLayer encrypts the layer by running one encryptor after the other
+//
+// It calls EncryptLayerContext with context.Background().
 func EncryptLayer(ec *config.EncryptConfig, encOrPlainLayerReader io.Reader, desc ocispec.Descriptor) (io.Reader, EncryptLayerFinalizer, error) {
+	return EncryptLayerContext(context.Background(), ec, encOrPlainLayerReader, desc)
+}
+
+// EncryptLayerContext encrypts the layer by running one encryptor after the
+// other. The finalizer wraps the layer key with ctx, which keywrappers calling
+// remote key management services use to cancel their calls, and the tracing
+// spans of the layer are children of the span of ctx.
+func EncryptLayerContext(ctx context.Context, ec *config.EncryptConfig, encOrPlainLayerReader io.Reader, desc ocispec.Descriptor) (io.Reader, EncryptLayerFinalizer, error) {
+	encLayerReader, encLayerFinalizer, err := traceEncryptLayer(ctx, ec, nil, encOrPlainLayerReader, desc)
+	return encLayerReader, withoutDigests(encLayerFinalizer), err
+}
+
+// EncryptLayerWithDigests encrypts the layer like EncryptLayer; its finalizer
+// also returns the digests and the sizes of the plaintext and of the encrypted
+// layer, so callers need not compute them separately
+//
+// It calls EncryptLayerWithDigestsContext with context.Background().
+func EncryptLayerWithDigests(ec *config.EncryptConfig, encOrPlainLayerReader io.Reader, desc ocispec.Descriptor) (io.Reader, EncryptLayerDigestsFinalizer, error) {
+	return EncryptLayerWithDigestsContext(context.Background(), ec, encOrPlainLayerReader, desc)
+}
+
+// EncryptLayerWithDigestsContext encrypts the layer like EncryptLayerContext;
+// its finalizer also returns the digests and the sizes of the plaintext and of
+// the encrypted layer
+func EncryptLayerWithDigestsContext(ctx context.Context, ec *config.EncryptConfig, encOrPlainLayerReader io.Reader, desc ocispec.Descriptor) (io.Reader, EncryptLayerDigestsFinalizer, error) {
+	return traceEncryptLayer(ctx, ec, nil, encOrPlainLayerReader, desc)
+}
+
+// traceEncryptLayer encrypts the layer in a tracing span and adds the digest
+// of the layer to the errors; if dk is not nil, the layer key is derived from
+// the master key
+func traceEncryptLayer(ctx context.Context, ec *config.EncryptConfig, dk *derivedKey, encOrPlainLayerReader io.Reader, desc ocispec.Descriptor) (io.Reader, EncryptLayerDigestsFinalizer, error) {
+	ctx, span := tracing.T().Start(ctx, tracing.SpanEncryptLayer, tracing.String(tracing.KeyLayerDigest, desc.Digest.String()))
+	var (
+		encLayerReader    io.Reader
+		encLayerFinalizer EncryptLayerDigestsFinalizer
+		err               error
+	)
+	if dk != nil {
+		encLayerReader, encLayerFinalizer, err = encryptLayerWithMasterKey(ctx, ec, dk, encOrPlainLayerReader, desc)
+	} else {
+		encLayerReader, encLayerFinalizer, err = encryptLayer(ctx, ec, encOrPlainLayerReader, desc)
+	}
+	if err != nil {
+		err = newLayerError(desc.Digest, "", err)
+		span.End(err)
+		return nil, nil, err
+	}
+	if encLayerReader != nil {
+		encLayerReader = newLayerErrorReader(encLayerReader, desc.Digest)
+	}
+	var once sync.Once
+	return encLayerReader, func() (map[string]string, *LayerDigests, error) {
+		annotations, digests, err := encLayerFinalizer()
+		err = newLayerError(desc.Digest, "", err)
+		once.Do(func() {
+			span.End(err)
+		})
+		return annotations, digests, err
+	}, nil
+}
+
+func encryptLayer(ctx context.Context, ec *config.EncryptConfig, encOrPlainLayerReader io.Reader, desc ocispec.Descriptor) (io.Reader, EncryptLayerDigestsFinalizer, error) {
 	var (
 		encLayerReader io.Reader
 		err            error
@@ -87,17 +370,29 @@ func EncryptLayer(ec *config.EncryptConfig, encOrPlainLayerReader io.Reader, des
 	)
 
 	if ec == nil {
-		return nil, nil, errors.New("EncryptConfig must not be nil")
+		return nil, nil, fmt.Errorf("EncryptConfig must not be nil: %w", errdefs.ErrConfiguration)
 	}
+	release, err := acquireLayerSlot(ctx, ec.GetLimits())
+	if err != nil {
+		return nil, nil, err
+	}
+	// the reader of the layer holds the slot until it is done
+	readerRelease := release
+	defer func() {
+		if err != nil || encLayerReader == nil {
+			release()
+		}
+	}()
 
-	for annotationsID := range keyWrapperAnnotations {
+	for _, r := range getKeyWrapperAnnotations() {
+		annotationsID := r.annotationID
 		annotation := desc.Annotations[annotationsID]
 		if annotation != "" {
-			privOptsData, err = decryptLayerKeyOptsData(&ec.DecryptConfig, desc)
+			privOptsData, err = decryptLayerKeyOptsData(ctx, &ec.DecryptConfig, desc)
 			if err != nil {
 				return nil, nil, err
 			}
-			pubOptsData, err = getLayerPubOpts(desc)
+			privOptsData, pubOptsData, err = getLayerOptsData(&ec.DecryptConfig, desc, privOptsData)
 			if err != nil {
 				return nil, nil, err
 			}
@@ -107,49 +402,58 @@ func EncryptLayer(ec *config.EncryptConfig, encOrPlainLayerReader io.Reader, des
 	}
 
 	if !encrypted {
-		encLayerReader, bcFin, err = commonEncryptLayer(encOrPlainLayerReader, desc.Digest, blockcipher.AES256CTR)
+		encLayerReader, bcFin, err = commonEncryptLayer(ctx, ec, encOrPlainLayerReader, desc.Digest, nil)
 		if err != nil {
 			return nil, nil, err
 		}
+		encLayerReader = newCountingReader(encLayerReader, metrics.M().BytesEncrypted)
+		encLayerReader = newLimitedReader(encLayerReader, ec.GetLimits(), readerRelease)
 	}
 
-	encLayerFinalizer := func() (map[string]string, error) {
+	encLayerFinalizer := func() (map[string]string, *LayerDigests, error) {
+		// a reader that is not read to the end must not keep the slot the
+		// layer needs for wrapping its key
+		readerRelease()
+		release, err := acquireLayerSlot(ctx, ec.GetLimits())
+		if err != nil {
+			return nil, nil, err
+		}
+		defer release()
+
 		// If layer was already encrypted, bcFin should be nil, use existing optsData
+		var digests *LayerDigests
 		if bcFin != nil {
 			opts, err := bcFin()
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			privOptsData, err = json.Marshal(opts.Private)
 			if err != nil {
-				return nil, errors.Wrapf(err, "could not JSON marshal opts")
+				return nil, nil, fmt.Errorf("could not JSON marshal opts: %w", err)
 			}
 			pubOptsData, err = json.Marshal(opts.Public)
 			if err != nil {
-				return nil, errors.Wrapf(err, "could not JSON marshal opts")
+				return nil, nil, fmt.Errorf("could not JSON marshal opts: %w", err)
 			}
+			digests = newLayerDigests(opts)
 		}
 
-		newAnnotations := make(map[string]string)
-		for annotationsID, scheme := range keyWrapperAnnotations {
-			b64Annotations := desc.Annotations[annotationsID]
-			keywrapper := GetKeyWrapper(scheme)
-			b64Annotations, err = preWrapKeys(keywrapper, ec, b64Annotations, privOptsData)
-			if err != nil {
-				return nil, err
-			}
-			if b64Annotations != "" {
-				newAnnotations[annotationsID] = b64Annotations
-			}
+		newAnnotations, err := wrapKeys(ctx, ec, desc.Digest, desc.Annotations, privOptsData)
+		if err != nil {
+			return nil, nil, err
 		}
 
 		newAnnotations["org.opencontainers.image.enc.pubopts"] = base64.StdEncoding.EncodeToString(pubOptsData)
 
+		if err := checkLimits(ec.GetLimits(), newAnnotations); err != nil {
+			return nil, nil, err
+		}
+
 		if len(newAnnotations) == 0 {
-			return nil, errors.New("no encryptor found to handle encryption")
+			return nil, nil, fmt.Errorf("no encryptor found to handle encryption: %w", errdefs.ErrConfiguration)
 		}
 
-		return newAnnotations, err
+		return newAnnotations, digests, nil
 	}
 
 	// if nothing was encrypted, we just return encLayer = nil
@@ -157,10 +461,146 @@ func EncryptLayer(ec *config.EncryptConfig, encOrPlainLayerReader io.Reader, des
 
 }
 
+// wrapKeys wraps the layer key with all keywrappers for the recipients and the
+// escrow recipients of the EncryptConfig and returns the annotations holding
+// the wrapped keys, including those already held by annotations
+func wrapKeys(ctx context.Context, ec *config.EncryptConfig, d digest.Digest, annotations map[string]string, privOptsData []byte) (map[string]string, error) {
+	newAnnotations := make(map[string]string)
+	var wrapErrs []*LayerError
+	wrapped := 0
+	for _, r := range getKeyWrapperAnnotations() {
+		annotationsID, scheme := r.annotationID, r.scheme
+		oldB64Annotations := annotations[annotationsID]
+		b64Annotations, err := wrapLayerKey(ctx, scheme, ec, d, oldB64Annotations, privOptsData)
+		if err != nil {
+			if ec.PartialFailures == config.FailFast {
+				return nil, newLayerError(d, scheme, err)
+			}
+			wrapErrs = append(wrapErrs, &LayerError{Digest: d, Scheme: scheme, Err: err})
+		} else if b64Annotations != oldB64Annotations {
+			wrapped += countWrappedRecipients(GetKeyWrapper(scheme), strings.TrimPrefix(strings.TrimPrefix(b64Annotations, oldB64Annotations), ","))
+		}
+		if b64Annotations != "" {
+			newAnnotations[annotationsID] = b64Annotations
+		}
+	}
+
+	if err := checkPartialFailures(ec, d, wrapErrs, wrapped); err != nil {
+		return nil, err
+	}
+
+	if err := wrapEscrowKeys(ctx, ec, d, newAnnotations, privOptsData); err != nil {
+		return nil, err
+	}
+	return newAnnotations, nil
+}
+
+// countWrappedRecipients returns the number of recipients the layer key is
+// wrapped for in the newly wrapped b64Annotations; keywrappers that cannot
+// tell count as having wrapped it for one recipient
+func countWrappedRecipients(keywrapper keywrap.KeyWrapper, b64Annotations string) int {
+	n := 0
+	if rc, ok := keywrapper.(keywrap.RecipientCounter); ok {
+		n, _ = rc.CountRecipients(b64Annotations)
+	} else {
+		recipients, _ := keywrapper.GetRecipients(b64Annotations)
+		n = len(recipients)
+	}
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// wrapLayerKey wraps the layer key with the given keywrap scheme for the
+// recipients of the EncryptConfig and returns the b64Annotations with the
+// newly wrapped keys appended
+func wrapLayerKey(ctx context.Context, scheme string, ec *config.EncryptConfig, d digest.Digest, b64Annotations string, privOptsData []byte) (string, error) {
+	var err error
+	keywrapper := GetKeyWrapper(scheme)
+	start := time.Now()
+	oldB64Annotations := b64Annotations
+	ctx, span := tracing.T().Start(ctx, tracing.SpanWrapKeys, tracing.String(tracing.KeyLayerDigest, d.String()), tracing.String(tracing.KeyKeyWrapper, scheme))
+	profiling.Do(ctx, d, profiling.OperationWrap, scheme, func(ctx context.Context) {
+		b64Annotations, err = preWrapKeys(ctx, keywrapper, ec, b64Annotations, privOptsData)
+	})
+	span.End(err)
+	if err != nil || b64Annotations != oldB64Annotations {
+		// only count schemes that had recipients to wrap for
+		metrics.M().WrapAttempt(scheme)
+		metrics.M().KeyWrapperLatency(scheme, time.Since(start))
+		auditWrap(keywrapper, scheme, d, strings.TrimPrefix(strings.TrimPrefix(b64Annotations, oldB64Annotations), ","), err)
+	}
+	if err != nil {
+		metrics.M().WrapFailure(scheme)
+		countProviderError(scheme, err)
+		log.L().Error(err, "could not wrap layer key", log.KeyLayerDigest, d, log.KeyKeyWrapper, scheme)
+	}
+	return b64Annotations, err
+}
+
+// wrapEscrowKeys wraps the layer key for the escrow recipients of the policy
+// of the EncryptConfig and adds the wrapped keys to the annotations. Unlike
+// for the recipients of the EncryptConfig, failing to wrap the layer key for
+// an escrow recipient always fails.
+func wrapEscrowKeys(ctx context.Context, ec *config.EncryptConfig, d digest.Digest, annotations map[string]string, privOptsData []byte) error {
+	escrow := ec.GetPolicy().EscrowRecipients
+	if len(escrow) == 0 {
+		return nil
+	}
+	escrowEc := *ec
+	escrowEc.Parameters = escrow
+
+	wrapped := 0
+	for _, r := range getKeyWrapperAnnotations() {
+		annotationsID, scheme := r.annotationID, r.scheme
+		oldB64Annotations := annotations[annotationsID]
+		b64Annotations, err := wrapLayerKey(ctx, scheme, &escrowEc, d, oldB64Annotations, privOptsData)
+		if err != nil {
+			return newLayerError(d, scheme, fmt.Errorf("could not wrap layer key for escrow recipients: %w", err))
+		}
+		if b64Annotations != oldB64Annotations {
+			annotations[annotationsID] = b64Annotations
+			wrapped++
+		}
+	}
+	if wrapped == 0 {
+		return newLayerError(d, "", fmt.Errorf("no keywrapper wrapped the layer key for the escrow recipients: %w", errdefs.ErrConfiguration))
+	}
+	return nil
+}
+
+// checkPartialFailures decides according to the PartialFailures mode of the
+// EncryptConfig whether encrypting the layer fails with the errors of the
+// keywrap schemes that failed to wrap the layer key
+func checkPartialFailures(ec *config.EncryptConfig, d digest.Digest, wrapErrs []*LayerError, wrapped int) error {
+	if len(wrapErrs) == 0 {
+		return nil
+	}
+	sort.Slice(wrapErrs, func(i, j int) bool {
+		return wrapErrs[i].Scheme < wrapErrs[j].Scheme
+	})
+	if ec.PartialFailures == config.BestEffort {
+		minWrappedKeys := ec.MinWrappedKeys
+		if minWrappedKeys < 1 {
+			minWrappedKeys = 1
+		}
+		if wrapped >= minWrappedKeys {
+			log.L().Info("some keywrap schemes failed to wrap the layer key", log.KeyLayerDigest, d, log.KeyError, &WrapError{Digest: d, Errs: wrapErrs, Wrapped: wrapped})
+			return nil
+		}
+	}
+	return &WrapError{
+		Digest:  d,
+		Errs:    wrapErrs,
+		Wrapped: wrapped,
+	}
+}
+
 // preWrapKeys calls WrapKeys and handles the base64 encoding and concatenation of the
 // annotation data
-func preWrapKeys(keywrapper keywrap.KeyWrapper, ec *config.EncryptConfig, b64Annotations string, optsData []byte) (string, error) {
-	newAnnotation, err := keywrapper.WrapKeys(ec, optsData)
+func preWrapKeys(ctx context.Context, keywrapper keywrap.KeyWrapper, ec *config.EncryptConfig, b64Annotations string, optsData []byte) (string, error) {
+	newAnnotation, err := wrapKey(ctx, keywrapper, ec, optsData)
 	if err != nil || len(newAnnotation) == 0 {
 		return b64Annotations, err
 	}
@@ -171,60 +611,517 @@ func preWrapKeys(keywrapper keywrap.KeyWrapper, ec *config.EncryptConfig, b64Ann
 	return b64Annotations + "," + b64newAnnotation, nil
 }
 
+// countProviderError counts the failure of a keywrapper to reach its key
+// provider if the Metrics implement metrics.ProviderErrorMetrics
+func countProviderError(scheme string, err error) {
+	if pm, ok := metrics.M().(metrics.ProviderErrorMetrics); ok && errors.Is(err, errdefs.ErrProviderUnreachable) {
+		pm.ProviderError(scheme)
+	}
+}
+
+// auditWrap sends an audit event for the wrapping of a layer key; the
+// b64Annotations only hold the newly wrapped keys
+func auditWrap(keywrapper keywrap.KeyWrapper, scheme string, d digest.Digest, b64Annotations string, err error) {
+	var recipients []string
+	if err == nil {
+		recipients, _ = keywrapper.GetRecipients(b64Annotations)
+	}
+	audit.S().Audit(audit.Event{
+		Time:        time.Now(),
+		Operation:   audit.OperationWrap,
+		LayerDigest: d,
+		Scheme:      scheme,
+		Recipients:  recipients,
+		Err:         err,
+	})
+}
+
+// auditUnwrap sends an audit event for an attempt to unwrap a layer key
+func auditUnwrap(keywrapper keywrap.KeyWrapper, scheme string, dc *config.DecryptConfig, d digest.Digest, b64Annotations, keyID string, err error) {
+	recipients, _ := keywrapper.GetRecipients(b64Annotations)
+	audit.S().Audit(audit.Event{
+		Time:        time.Now(),
+		Operation:   audit.OperationUnwrap,
+		Tenant:      dc.Tenant,
+		LayerDigest: d,
+		Scheme:      scheme,
+		Recipients:  recipients,
+		KeyID:       keyID,
+		Err:         err,
+	})
+}
+
+// auditUnwrapThrottled sends an audit event for an unwrap operation that was
+// refused by the guard
+func auditUnwrapThrottled(keywrapper keywrap.KeyWrapper, scheme string, dc *config.DecryptConfig, d digest.Digest, b64Annotations string, err error) {
+	recipients, _ := keywrapper.GetRecipients(b64Annotations)
+	audit.S().Audit(audit.Event{
+		Time:        time.Now(),
+		Operation:   audit.OperationUnwrapThrottled,
+		Tenant:      dc.Tenant,
+		LayerDigest: d,
+		Scheme:      scheme,
+		Recipients:  recipients,
+		Err:         err,
+	})
+}
+
+// getGuardKey returns the key identifying the private keys the keywrapper uses
+// for unwrapping towards the guard; the keys of different tenants are kept
+// apart even if they are the same
+func getGuardKey(keywrapper keywrap.KeyWrapper, scheme string, dc *config.DecryptConfig, useDecrypters bool) string {
+	h := sha256.New()
+	for _, privKey := range keywrapper.GetPrivateKeys(dc.Parameters) {
+		h.Write(privKey)
+	}
+	if useDecrypters {
+		for _, decrypter := range dc.Decrypters {
+			if pubKey, err := x509.MarshalPKIXPublicKey(decrypter.Public()); err == nil {
+				h.Write(pubKey)
+			}
+		}
+	}
+	if dc.Tenant != "" {
+		return fmt.Sprintf("%s/%s:%x", dc.Tenant, scheme, h.Sum(nil))
+	}
+	return fmt.Sprintf("%s:%x", scheme, h.Sum(nil))
+}
+
 // DecryptLayer decrypts a layer trying one keywrap.KeyWrapper after the other to see whether it
 // can apply the provided private key
 // If unwrapOnly is set we will only try to decrypt the layer encryption key and return
+//
+// It calls DecryptLayerContext with context.Background().
 func DecryptLayer(dc *config.DecryptConfig, encLayerReader io.Reader, desc ocispec.Descriptor, unwrapOnly bool) (io.Reader, digest.Digest, error) {
+	return DecryptLayerContext(context.Background(), dc, encLayerReader, desc, unwrapOnly)
+}
+
+// DecryptLayerContext decrypts a layer like DecryptLayer; the layer key is
+// unwrapped with ctx, which keywrappers calling remote key management services
+// or HSMs use to cancel their calls, and the tracing spans of the layer are
+// children of the span of ctx. Once ctx is done, no further wrapped key is
+// tried.
+func DecryptLayerContext(ctx context.Context, dc *config.DecryptConfig, encLayerReader io.Reader, desc ocispec.Descriptor, unwrapOnly bool) (io.Reader, digest.Digest, error) {
+	ctx, span := tracing.T().Start(ctx, tracing.SpanDecryptLayer, tracing.String(tracing.KeyLayerDigest, desc.Digest.String()))
+	decLayerReader, d, err := decryptLayer(ctx, dc, encLayerReader, desc, unwrapOnly)
+	err = newLayerError(desc.Digest, "", err)
+	span.End(err)
+	if decLayerReader != nil {
+		decLayerReader = newLayerErrorReader(decLayerReader, desc.Digest)
+	}
+	return decLayerReader, d, err
+}
+
+func decryptLayer(ctx context.Context, dc *config.DecryptConfig, encLayerReader io.Reader, desc ocispec.Descriptor, unwrapOnly bool) (io.Reader, digest.Digest, error) {
 	if dc == nil {
-		return nil, "", errors.New("DecryptConfig must not be nil")
+		return nil, "", fmt.Errorf("DecryptConfig must not be nil: %w", errdefs.ErrConfiguration)
+	}
+	release, err := acquireLayerSlot(ctx, dc.GetLimits())
+	if err != nil {
+		return nil, "", err
 	}
-	privOptsData, err := decryptLayerKeyOptsData(dc, desc)
+
+	privOptsData, err := decryptLayerKeyOptsData(ctx, dc, desc)
+	if err != nil {
+		release()
+		return nil, "", err
+	}
+	privOptsData, pubOptsData, err := getLayerOptsData(dc, desc, privOptsData)
 	if err != nil || unwrapOnly {
+		release()
 		return nil, "", err
 	}
 
-	var pubOptsData []byte
-	pubOptsData, err = getLayerPubOpts(desc)
+	encLayerReader = newProgressReader(encLayerReader, desc.Digest, dc.Progress)
+	decLayerReader, d, err := commonDecryptLayer(ctx, dc, encLayerReader, desc, privOptsData, pubOptsData)
 	if err != nil {
+		release()
 		return nil, "", err
 	}
+	// the reader of the layer holds the slot until it is done
+	return newLimitedReader(decLayerReader, dc.GetLimits(), release), d, nil
+}
+
+// DecryptLayerReaderAt unwraps the key of a layer like DecryptLayer and returns
+// an io.ReaderAt that decrypts the requested ranges of the layer on demand,
+// along with the size of the plaintext. The size bytes of encLayerReaderAt are
+// the encrypted layer. The layer must have been encrypted with a block cipher
+// that supports random access, such as blockcipher.AES256GCMChunked; every
+// range is authenticated before it is returned, but since the layer is never
+// read as a whole its digest is not verified.
+//
+// It calls DecryptLayerReaderAtContext with context.Background().
+func DecryptLayerReaderAt(dc *config.DecryptConfig, encLayerReaderAt io.ReaderAt, size int64, desc ocispec.Descriptor) (io.ReaderAt, int64, error) {
+	return DecryptLayerReaderAtContext(context.Background(), dc, encLayerReaderAt, size, desc)
+}
+
+// DecryptLayerReaderAtContext is like DecryptLayerReaderAt, but unwraps the
+// layer key with ctx like DecryptLayerContext
+func DecryptLayerReaderAtContext(ctx context.Context, dc *config.DecryptConfig, encLayerReaderAt io.ReaderAt, size int64, desc ocispec.Descriptor) (io.ReaderAt, int64, error) {
+	ctx, span := tracing.T().Start(ctx, tracing.SpanDecryptLayer, tracing.String(tracing.KeyLayerDigest, desc.Digest.String()))
+	decLayerReaderAt, plainSize, err := decryptLayerReaderAt(ctx, dc, encLayerReaderAt, size, desc)
+	err = newLayerError(desc.Digest, "", err)
+	span.End(err)
+	if decLayerReaderAt != nil {
+		decLayerReaderAt = newLayerErrorReaderAt(decLayerReaderAt, desc.Digest)
+	}
+	return decLayerReaderAt, plainSize, err
+}
+
+func decryptLayerReaderAt(ctx context.Context, dc *config.DecryptConfig, encLayerReaderAt io.ReaderAt, size int64, desc ocispec.Descriptor) (io.ReaderAt, int64, error) {
+	if dc == nil {
+		return nil, 0, fmt.Errorf("DecryptConfig must not be nil: %w", errdefs.ErrConfiguration)
+	}
+	release, err := acquireLayerSlot(ctx, dc.GetLimits())
+	if err != nil {
+		return nil, 0, err
+	}
+	defer release()
+
+	opts, err := unwrapLayerBlockCipherOptions(ctx, dc, desc)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	lbch, err := blockcipher.NewLayerBlockCipherHandler()
+	if err != nil {
+		return nil, 0, err
+	}
+	return lbch.DecryptReaderAt(encLayerReaderAt, size, opts)
+}
+
+// GetLayerSymmetricKey unwraps the key of an encrypted layer from the
+// annotations of its descriptor like DecryptLayerContext does with
+// unwrapOnly set, and returns the options of its block cipher: the private
+// options hold the symmetric key, the cipher options such as the nonce and
+// the digest of the plaintext layer, the public options the type of the block
+// cipher and its HMAC. No encrypted data is needed, so the layer can be
+// decrypted elsewhere, for example by dm-crypt in a confidential VM. The
+// symmetric key decrypts the layer for anyone holding it, so callers must
+// take care not to leak it and to wipe it once it is no longer needed.
+func GetLayerSymmetricKey(ctx context.Context, dc *config.DecryptConfig, desc ocispec.Descriptor) (blockcipher.LayerBlockCipherOptions, error) {
+	ctx, span := tracing.T().Start(ctx, tracing.SpanDecryptLayer, tracing.String(tracing.KeyLayerDigest, desc.Digest.String()))
+	opts, err := getLayerSymmetricKey(ctx, dc, desc)
+	err = newLayerError(desc.Digest, "", err)
+	span.End(err)
+	return opts, err
+}
+
+func getLayerSymmetricKey(ctx context.Context, dc *config.DecryptConfig, desc ocispec.Descriptor) (blockcipher.LayerBlockCipherOptions, error) {
+	if dc == nil {
+		return blockcipher.LayerBlockCipherOptions{}, fmt.Errorf("DecryptConfig must not be nil: %w", errdefs.ErrConfiguration)
+	}
+	release, err := acquireLayerSlot(ctx, dc.GetLimits())
+	if err != nil {
+		return blockcipher.LayerBlockCipherOptions{}, err
+	}
+	defer release()
 
-	return commonDecryptLayer(encLayerReader, privOptsData, pubOptsData)
+	return unwrapLayerBlockCipherOptions(ctx, dc, desc)
 }
 
-func decryptLayerKeyOptsData(dc *config.DecryptConfig, desc ocispec.Descriptor) ([]byte, error) {
+// unwrapLayerBlockCipherOptions unwraps the key of the layer and returns the
+// options of its block cipher, converting those of the legacy layout
+func unwrapLayerBlockCipherOptions(ctx context.Context, dc *config.DecryptConfig, desc ocispec.Descriptor) (blockcipher.LayerBlockCipherOptions, error) {
+	privOptsData, err := decryptLayerKeyOptsData(ctx, dc, desc)
+	if err != nil {
+		return blockcipher.LayerBlockCipherOptions{}, err
+	}
+	privOptsData, pubOptsData, err := getLayerOptsData(dc, desc, privOptsData)
+	if err != nil {
+		return blockcipher.LayerBlockCipherOptions{}, err
+	}
+	opts, err := getLayerBlockCipherOptions(privOptsData, pubOptsData)
+	if err != nil {
+		return blockcipher.LayerBlockCipherOptions{}, err
+	}
+	if err := bindDigest(dc, desc, &opts); err != nil {
+		return blockcipher.LayerBlockCipherOptions{}, err
+	}
+	return opts, nil
+}
+
+func decryptLayerKeyOptsData(ctx context.Context, dc *config.DecryptConfig, desc ocispec.Descriptor) ([]byte, error) {
+	release := dc.HoldSecrets()
+	defer release()
+
+	if err := dc.CheckTenant(); err != nil {
+		return nil, err
+	}
+	if err := checkMaxMemory(dc, desc); err != nil {
+		return nil, err
+	}
+	if err := checkLimits(dc.GetLimits(), desc.Annotations); err != nil {
+		return nil, err
+	}
+	if dc.Verification != nil {
+		if err := dc.Verification.Verify(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if b64Derivation, ok := desc.Annotations[masterkey.Annotation]; ok {
+		return openDerivedKeyOptsData(dc, desc.Digest, b64Derivation)
+	}
+	_, remote := desc.Annotations[remotekeys.Annotation]
+	if remote && dc.RemoteKeys != nil {
+		annotations, err := dc.RemoteKeys.Resolve(ctx, dc.Tenant, desc.Annotations)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkLimits(dc.GetLimits(), annotations); err != nil {
+			return nil, err
+		}
+		desc.Annotations = annotations
+	}
+	var lookupErr error
+	if dc.KeyLookup != nil {
+		var err error
+		if dc, err = lookupKeys(ctx, dc, desc); err != nil {
+			log.L().Info("key helpers could not provide keys", log.KeyLayerDigest, desc.Digest, log.KeyError, err)
+			lookupErr = err
+		}
+	}
+	registered, err := getDecryptKeyWrappers(dc)
+	if err != nil {
+		return nil, err
+	}
 	privKeyGiven := false
-	errs := ""
-	for annotationsID, scheme := range keyWrapperAnnotations {
+	var errs []*KeyUnwrapError
+	var policyErr, throttleErr error
+	for _, r := range registered {
+		annotationsID, scheme := r.annotationID, r.scheme
 		b64Annotation := desc.Annotations[annotationsID]
 		if b64Annotation != "" {
 			keywrapper := GetKeyWrapper(scheme)
 
-			if keywrapper.NoPossibleKeys(dc.Parameters) {
+			useDecrypters := usesDecrypters(keywrapper, dc)
+			if keywrapper.NoPossibleKeys(dc.Parameters) && !useDecrypters {
 				continue
 			}
 
-			if len(keywrapper.GetPrivateKeys(dc.Parameters)) > 0 {
+			if len(keywrapper.GetPrivateKeys(dc.Parameters)) > 0 || useDecrypters {
 				privKeyGiven = true
 			}
 
-			optsData, err := preUnwrapKey(keywrapper, dc, b64Annotation)
+			if dc.Authorization != nil {
+				recipients, _ := keywrapper.GetRecipients(b64Annotation)
+				if err := dc.Authorization.Authorize(ctx, desc.Digest, scheme, recipients); err != nil {
+					log.L().Info("unwrapping layer key was not authorized", log.KeyLayerDigest, desc.Digest, log.KeyKeyWrapper, scheme, log.KeyError, err)
+					return nil, newLayerError(desc.Digest, scheme, err)
+				}
+			}
+
+			guardKey := getGuardKey(keywrapper, scheme, dc, useDecrypters)
+			if err := guard.G().Allow(guardKey); err != nil {
+				auditUnwrapThrottled(keywrapper, scheme, dc, desc.Digest, b64Annotation, err)
+				log.L().Info("unwrapping layer key was throttled", log.KeyLayerDigest, desc.Digest, log.KeyKeyWrapper, scheme, log.KeyError, err)
+				throttleErr = newLayerError(desc.Digest, scheme, err)
+				errs = appendKeyUnwrapErrors(errs, scheme, err)
+				continue
+			}
+
+			metrics.M().UnwrapAttempt(scheme)
+			start := time.Now()
+			spanCtx, span := tracing.T().Start(ctx, tracing.SpanUnwrapKey, tracing.String(tracing.KeyLayerDigest, desc.Digest.String()), tracing.String(tracing.KeyKeyWrapper, scheme))
+			var (
+				optsData []byte
+				keyID    string
+				err      error
+			)
+			profiling.Do(spanCtx, desc.Digest, profiling.OperationUnwrap, scheme, func(ctx context.Context) {
+				optsData, keyID, err = preUnwrapKey(ctx, keywrapper, dc, b64Annotation)
+			})
+			span.End(err)
+			metrics.M().KeyWrapperLatency(scheme, time.Since(start))
+			auditUnwrap(keywrapper, scheme, dc, desc.Digest, b64Annotation, keyID, err)
+			guard.G().Done(guardKey, err)
 			if err != nil {
+				metrics.M().UnwrapFailure(scheme)
+				countProviderError(scheme, err)
+				log.L().Debug("keywrapper could not unwrap layer key", log.KeyLayerDigest, desc.Digest, log.KeyKeyWrapper, scheme, log.KeyError, err)
+				if errors.Is(err, errdefs.ErrLimitExceeded) {
+					return nil, newLayerError(desc.Digest, scheme, err)
+				}
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return nil, newLayerError(desc.Digest, scheme, ctxErr)
+				}
+				if errors.Is(err, errdefs.ErrDisallowedAlgorithm) {
+					policyErr = newLayerError(desc.Digest, scheme, err)
+				}
 				// try next keywrap.KeyWrapper
-				errs += fmt.Sprintf("%s\n", err)
+				errs = appendKeyUnwrapErrors(errs, scheme, err)
 				continue
 			}
 			if optsData == nil {
 				// try next keywrap.KeyWrapper
 				continue
 			}
+			log.L().Debug("unwrapped layer key", log.KeyLayerDigest, desc.Digest, log.KeyKeyWrapper, scheme, log.KeyKeyID, keyID)
 			return optsData, nil
 		}
 	}
+	if policyErr != nil {
+		return nil, policyErr
+	}
+	if throttleErr != nil {
+		return nil, throttleErr
+	}
 	if !privKeyGiven {
-		return nil, errors.New("missing private key needed for decryption")
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		if remote && dc.RemoteKeys == nil {
+			return nil, fmt.Errorf("the wrapped keys of the layer are stored remotely, but no resolver is set: %w", errdefs.ErrConfiguration)
+		}
+		return nil, fmt.Errorf("missing private key needed for decryption: %w", errdefs.ErrNoDecryptionKey)
+	}
+	return nil, &UnwrapError{
+		Digest: desc.Digest,
+		Errs:   errs,
 	}
-	return nil, errors.Errorf("no suitable key unwrapper found or none of the private keys could be used for decryption:\n%s", errs)
+}
+
+// appendKeyUnwrapErrors appends the errors of the wrapped keys that the
+// keywrap scheme failed to unwrap, or err itself if the scheme failed before
+// trying them, to errs
+func appendKeyUnwrapErrors(errs []*KeyUnwrapError, scheme string, err error) []*KeyUnwrapError {
+	var kerrs keyUnwrapErrors
+	if !errors.As(err, &kerrs) {
+		return append(errs, &KeyUnwrapError{
+			Scheme: scheme,
+			Index:  -1,
+			Err:    err,
+		})
+	}
+	for _, kerr := range kerrs {
+		kerr.Scheme = scheme
+		errs = append(errs, kerr)
+	}
+	return errs
+}
+
+// getDecryptKeyWrappers returns the registrations of the key wrappers that are
+// tried for unwrapping layer keys with the DecryptConfig, in the order of its
+// KeyWrappers if it has any, leaving out its DeniedKeyWrappers
+func getDecryptKeyWrappers(dc *config.DecryptConfig) ([]keyWrapperRegistration, error) {
+	registered := getKeyWrapperAnnotations()
+	if len(dc.KeyWrappers) > 0 {
+		byScheme := make(map[string]keyWrapperRegistration, len(registered))
+		for _, r := range registered {
+			byScheme[r.scheme] = r
+		}
+		registered = make([]keyWrapperRegistration, 0, len(dc.KeyWrappers))
+		for _, scheme := range dc.KeyWrappers {
+			r, ok := byScheme[scheme]
+			if !ok {
+				return nil, fmt.Errorf("no key wrapper is registered for the encryption scheme %s: %w", scheme, errdefs.ErrConfiguration)
+			}
+			registered = append(registered, r)
+		}
+	}
+	if len(dc.DeniedKeyWrappers) == 0 {
+		return registered, nil
+	}
+	denied := make(map[string]bool, len(dc.DeniedKeyWrappers))
+	for _, scheme := range dc.DeniedKeyWrappers {
+		denied[scheme] = true
+	}
+	allowed := make([]keyWrapperRegistration, 0, len(registered))
+	for _, r := range registered {
+		if !denied[r.scheme] {
+			allowed = append(allowed, r)
+		}
+	}
+	return allowed, nil
+}
+
+// lookupKeys returns a copy of the DecryptConfig with the private keys that
+// its key helpers provide for the layer added to them; on error the
+// DecryptConfig is returned unchanged
+func lookupKeys(ctx context.Context, dc *config.DecryptConfig, desc ocispec.Descriptor) (*config.DecryptConfig, error) {
+	var recipients []string
+	for _, r := range getKeyWrapperAnnotations() {
+		annotationsID, scheme := r.annotationID, r.scheme
+		if b64Annotation := desc.Annotations[annotationsID]; b64Annotation != "" {
+			r, _ := GetKeyWrapper(scheme).GetRecipients(b64Annotation)
+			recipients = append(recipients, r...)
+		}
+	}
+	sort.Strings(recipients)
+
+	privKeys, passwords, err := dc.KeyLookup.Keys(ctx, dc.Tenant, desc.Digest, recipients)
+	if err != nil || len(privKeys) == 0 {
+		return dc, err
+	}
+	parameters := make(map[string][][]byte, len(dc.Parameters)+2)
+	for k, v := range dc.Parameters {
+		parameters[k] = v
+	}
+	// copy the slices so that appending does not modify the DecryptConfig
+	parameters["privkeys"] = append(append([][]byte{}, dc.Parameters["privkeys"]...), privKeys...)
+	parameters["privkeys-passwords"] = append(append([][]byte{}, dc.Parameters["privkeys-passwords"]...), passwords...)
+	lookupDc := *dc
+	lookupDc.Parameters = parameters
+	return &lookupDc, nil
+}
+
+// usesDecrypters returns true if the keywrapper can use the crypto.Decrypters
+// or the GPGDecrypter of the DecryptConfig
+func usesDecrypters(keywrapper keywrap.KeyWrapper, dc *config.DecryptConfig) bool {
+	if dc.GPGDecrypter != nil {
+		if gkw, ok := keywrapper.(keywrap.GPGDecrypterKeyWrapper); ok && gkw.SupportsGPGDecrypter() {
+			return true
+		}
+	}
+	if len(dc.Decrypters) == 0 {
+		return false
+	}
+	dkw, ok := keywrapper.(keywrap.DecrypterKeyWrapper)
+	return ok && dkw.SupportsDecrypters()
+}
+
+// checkMaxMemory checks that decoding the encryption metadata of the layer and
+// buffering its decryption stays within the MaxMemory of the DecryptConfig
+func checkMaxMemory(dc *config.DecryptConfig, desc ocispec.Descriptor) error {
+	if dc.MaxMemory == 0 {
+		return nil
+	}
+	opts := blockcipher.LayerBlockCipherOptions{BufferSize: dc.BufferSize}
+	if pubOptsData, err := getLayerPubOpts(desc); err == nil {
+		pubOpts := blockcipher.PublicLayerBlockCipherOptions{}
+		if json.Unmarshal(pubOptsData, &pubOpts) == nil {
+			opts.Public = pubOpts
+		}
+	}
+	needed := blockcipher.GetDecryptionBufferSizeOpts(opts)
+	for _, r := range getKeyWrapperAnnotations() {
+		annotationsID := r.annotationID
+		needed += int64(base64.StdEncoding.DecodedLen(len(desc.Annotations[annotationsID])))
+	}
+	needed += int64(base64.StdEncoding.DecodedLen(len(desc.Annotations["org.opencontainers.image.enc.pubopts"])))
+	if needed > dc.MaxMemory {
+		return fmt.Errorf("decryption needs %d bytes of memory, more than the maximum of %d bytes: %w", needed, dc.MaxMemory, errdefs.ErrLimitExceeded)
+	}
+	return nil
+}
+
+// checkLimits checks the size of the encryption annotations of a layer and the
+// number of its wrapped keys against the Limits
+func checkLimits(l *limits.Limits, annotations map[string]string) error {
+	size := int64(len(annotations["org.opencontainers.image.enc.pubopts"]))
+	recipients := 0
+	for _, r := range getKeyWrapperAnnotations() {
+		annotationsID := r.annotationID
+		b64Annotations := annotations[annotationsID]
+		size += int64(len(b64Annotations))
+		if b64Annotations != "" {
+			recipients += strings.Count(b64Annotations, ",") + 1
+		}
+	}
+	if err := l.CheckAnnotationBytes(size); err != nil {
+		return err
+	}
+	return l.CheckRecipients(recipients)
 }
 
 func getLayerPubOpts(desc ocispec.Descriptor) ([]byte, error) {
@@ -237,46 +1134,142 @@ func getLayerPubOpts(desc ocispec.Descriptor) ([]byte, error) {
 
 // preUnwrapKey decodes the comma separated base64 strings and calls the Unwrap function
 // of the given keywrapper with it and returns the result in case the Unwrap functions
-// does not return an error. If all attempts fail, an error is returned.
-func preUnwrapKey(keywrapper keywrap.KeyWrapper, dc *config.DecryptConfig, b64Annotations string) ([]byte, error) {
+// does not return an error along with the ID of the key that unwrapped it, if the
+// keywrapper can tell it. If all attempts fail, an error is returned.
+func preUnwrapKey(ctx context.Context, keywrapper keywrap.KeyWrapper, dc *config.DecryptConfig, b64Annotations string) ([]byte, string, error) {
 	if b64Annotations == "" {
-		return nil, nil
+		return nil, "", nil
 	}
-	errs := ""
-	for _, b64Annotation := range strings.Split(b64Annotations, ",") {
+	var errs keyUnwrapErrors
+	var policyErr error
+	for i, b64Annotation := range strings.Split(b64Annotations, ",") {
+		if base64.StdEncoding.DecodedLen(len(b64Annotation)) > keywrap.MaxWrappedKeySize {
+			return nil, "", fmt.Errorf("wrapped key is larger than the maximum of %d bytes: %w", keywrap.MaxWrappedKeySize, errdefs.ErrLimitExceeded)
+		}
+		if err := dc.GetLimits().CheckWrappedKeySize(base64.StdEncoding.DecodedLen(len(b64Annotation))); err != nil {
+			return nil, "", err
+		}
 		annotation, err := base64.StdEncoding.DecodeString(b64Annotation)
 		if err != nil {
-			return nil, errors.New("could not base64 decode the annotation")
+			return nil, "", fmt.Errorf("could not base64 decode the annotation: %w", errdefs.ErrProtocol)
 		}
-		optsData, err := keywrapper.UnwrapKey(dc, annotation)
+		optsData, keyID, err := unwrapKey(ctx, keywrapper, dc, annotation)
 		if err != nil {
-			errs += fmt.Sprintf("- %s\n", err)
+			if errors.Is(err, errdefs.ErrLimitExceeded) {
+				return nil, "", err
+			}
+			if errors.Is(err, errdefs.ErrDisallowedAlgorithm) {
+				policyErr = err
+			}
+			recipients, _ := keywrapper.GetRecipients(b64Annotation)
+			errs = append(errs, &KeyUnwrapError{
+				Index:      i,
+				Recipients: recipients,
+				Err:        err,
+			})
 			continue
 		}
-		return optsData, nil
+		return optsData, keyID, nil
+	}
+	if policyErr != nil {
+		return nil, "", policyErr
+	}
+	// the errors of the wrapped keys let callers and the guard tell a wrong
+	// password from a key that does not fit
+	return nil, "", errs
+}
+
+// wrapKey calls the WrapKeys function of the given keywrapper, passing it ctx
+// if it is a keywrap.ContextKeyWrapper
+func wrapKey(ctx context.Context, keywrapper keywrap.KeyWrapper, ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctxWrapper, ok := keywrapper.(keywrap.ContextKeyWrapper); ok {
+		wrapped, err := ctxWrapper.WrapKeysContext(ctx, ec, optsData)
+		if err != nil && ctx.Err() != nil {
+			// the error of the keywrapper need not tell that ctx is done
+			return nil, fmt.Errorf("%v: %w", err, ctx.Err())
+		}
+		return wrapped, err
 	}
-	return nil, errors.Errorf("no suitable key found for decrypting layer key:\n%s", errs)
+	return keywrapper.WrapKeys(ec, optsData)
 }
 
-// commonEncryptLayer is a function to encrypt the plain layer using a new random
-// symmetric key and return the LayerBlockCipherHandler's JSON in string form for
-// later use during decryption
-func commonEncryptLayer(plainLayerReader io.Reader, d digest.Digest, typ blockcipher.LayerCipherType) (io.Reader, blockcipher.Finalizer, error) {
+// unwrapKey calls the Unwrap function of the given keywrapper and also returns the
+// ID of the key that unwrapped the layer key if the keywrapper can tell it; ctx
+// is passed to it if it is a keywrap.ContextKeyWrapper
+func unwrapKey(ctx context.Context, keywrapper keywrap.KeyWrapper, dc *config.DecryptConfig, annotation []byte) ([]byte, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	if ctxWrapper, ok := keywrapper.(keywrap.ContextKeyWrapper); ok {
+		return ctxWrapper.UnwrapKeyIDContext(ctx, dc, annotation)
+	}
+	if kidUnwrapper, ok := keywrapper.(keywrap.KeyIDUnwrapper); ok {
+		return kidUnwrapper.UnwrapKeyID(dc, annotation)
+	}
+	optsData, err := keywrapper.UnwrapKey(dc, annotation)
+	return optsData, "", err
+}
+
+// commonEncryptLayer is a function to encrypt the plain layer with the block
+// cipher of the EncryptConfig using the given symmetric key or, if sk is nil,
+// a new random one and return the LayerBlockCipherHandler's JSON in string
+// form for later use during decryption
+func commonEncryptLayer(ctx context.Context, ec *config.EncryptConfig, plainLayerReader io.Reader, d digest.Digest, sk []byte) (io.Reader, blockcipher.Finalizer, error) {
 	lbch, err := blockcipher.NewLayerBlockCipherHandler()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	encLayerReader, bcFin, err := lbch.Encrypt(plainLayerReader, typ)
+	opts := blockcipher.LayerBlockCipherOptions{
+		Private: blockcipher.PrivateLayerBlockCipherOptions{
+			SymmetricKey: sk,
+		},
+		Rand:        ec.GetRand(),
+		Parallelism: ec.Parallelism,
+	}
+	if ec.BindDigest {
+		if d == "" {
+			return nil, nil, fmt.Errorf("the digest of the layer is needed to bind it to the layer: %w", errdefs.ErrConfiguration)
+		}
+		opts.AdditionalData = []byte(d.String())
+	}
+	typ := ec.GetCipher()
+	// the plaintext of a convergently encrypted layer must match the digest
+	// its layer key and nonces are derived from, or different plaintext would
+	// be encrypted with the same key and nonces
+	var convergentVerifier digest.Verifier
+	if secrets := ec.Parameters["convergent-secret"]; len(secrets) > 0 {
+		if sk != nil {
+			return nil, nil, fmt.Errorf("convergent encryption cannot be used with layer keys derived from a master key: %w", errdefs.ErrConfiguration)
+		}
+		if d == "" {
+			return nil, nil, fmt.Errorf("the digest of the layer is needed for convergent encryption: %w", errdefs.ErrConfiguration)
+		}
+		if err := d.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("invalid digest of the layer for convergent encryption: %v: %w", err, errdefs.ErrConfiguration)
+		}
+		convergentVerifier = d.Verifier()
+		plainLayerReader = io.TeeReader(plainLayerReader, convergentVerifier)
+		opts.Rand = convergentRand(secrets[0], typ, d, opts.AdditionalData)
+	}
+	src := &timingReader{r: newProgressReader(plainLayerReader, d, ec.Progress)}
+	encLayerReader, bcFin, err := lbch.EncryptWithOptions(src, typ, opts)
 	if err != nil {
 		return nil, nil, err
 	}
+	encLayerReader = newProfilingReader(ctx, encLayerReader, src, d, profiling.OperationEncrypt, string(typ))
 
 	newBcFin := func() (blockcipher.LayerBlockCipherOptions, error) {
 		lbco, err := bcFin()
 		if err != nil {
 			return blockcipher.LayerBlockCipherOptions{}, err
 		}
+		if convergentVerifier != nil && !convergentVerifier.Verified() {
+			return blockcipher.LayerBlockCipherOptions{}, fmt.Errorf("the plaintext layer does not match the digest %s it was convergently encrypted for, the encrypted layer must be discarded: %w", d, errdefs.ErrIntegrity)
+		}
 		lbco.Private.Digest = d
 		return lbco, nil
 	}
@@ -284,39 +1277,91 @@ func commonEncryptLayer(plainLayerReader io.Reader, d digest.Digest, typ blockci
 	return encLayerReader, newBcFin, err
 }
 
+// convergentRand returns the source of the layer key and the nonces of a layer
+// encrypted convergently: it is derived from the secret, the block cipher, the
+// digest of the plaintext layer and the additional data, so that identical
+// layers encrypted with the same secret yield identical ciphertext while a key
+// and nonce are never reused with different plaintext or additional data
+func convergentRand(secret []byte, typ blockcipher.LayerCipherType, d digest.Digest, aad []byte) io.Reader {
+	info := []byte("ocicrypt convergent layer key")
+	for _, b := range [][]byte{[]byte(typ), []byte(d.String()), aad} {
+		info = append(info, 0)
+		info = append(info, b...)
+	}
+	return hkdf.New(sha256.New, secret, nil, info)
+}
+
 // commonDecryptLayer decrypts an encrypted layer previously encrypted with commonEncryptLayer
-// by passing along the optsData
-func commonDecryptLayer(encLayerReader io.Reader, privOptsData []byte, pubOptsData []byte) (io.Reader, digest.Digest, error) {
-	privOpts := blockcipher.PrivateLayerBlockCipherOptions{}
-	err := json.Unmarshal(privOptsData, &privOpts)
+// by passing along the optsData, the bound digest and the buffer size of the block cipher
+func commonDecryptLayer(ctx context.Context, dc *config.DecryptConfig, encLayerReader io.Reader, desc ocispec.Descriptor, privOptsData []byte, pubOptsData []byte) (io.Reader, digest.Digest, error) {
+	d := desc.Digest
+	opts, err := getLayerBlockCipherOptions(privOptsData, pubOptsData)
 	if err != nil {
-		return nil, "", errors.Wrapf(err, "could not JSON unmarshal privOptsData")
+		return nil, "", err
 	}
+	if err := bindDigest(dc, desc, &opts); err != nil {
+		return nil, "", err
+	}
+	opts.BufferSize = dc.BufferSize
+	pubOpts := opts.Public
 
 	lbch, err := blockcipher.NewLayerBlockCipherHandler()
 	if err != nil {
 		return nil, "", err
 	}
 
+	src := &timingReader{r: encLayerReader}
+	plainLayerReader, opts, err := lbch.Decrypt(src, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	plainLayerReader = newProfilingReader(ctx, plainLayerReader, src, d, profiling.OperationDecrypt, string(pubOpts.CipherType))
+
+	return newCountingReader(plainLayerReader, metrics.M().BytesDecrypted), opts.Private.Digest, nil
+}
+
+// bindDigest sets the additional data that the block cipher authenticates the
+// layer with to the digest of the plaintext layer that the BoundDigests of the
+// DecryptConfig map the digest of the encrypted layer to. The additional data
+// kept with the layer key is not used since it comes along with the
+// annotations, which may have been moved from another layer.
+func bindDigest(dc *config.DecryptConfig, desc ocispec.Descriptor, opts *blockcipher.LayerBlockCipherOptions) error {
+	aad := opts.Private.CipherOptions["aad"]
+	boundDigest, ok := dc.BoundDigests[desc.Digest]
+	if !ok {
+		if len(aad) > 0 {
+			return fmt.Errorf("the layer is bound to the digest of its plaintext layer, which is not in the bound digests: %w", errdefs.ErrConfiguration)
+		}
+		return nil
+	}
+	if boundDigest == "" || string(aad) != boundDigest.String() {
+		return fmt.Errorf("the layer is not bound to the digest %q of its plaintext layer: %w", boundDigest, errdefs.ErrIntegrity)
+	}
+	opts.AdditionalData = []byte(boundDigest.String())
+	return nil
+}
+
+// getLayerBlockCipherOptions decodes the private and public options of the
+// block cipher of a layer
+func getLayerBlockCipherOptions(privOptsData []byte, pubOptsData []byte) (blockcipher.LayerBlockCipherOptions, error) {
+	privOpts := blockcipher.PrivateLayerBlockCipherOptions{}
+	err := json.Unmarshal(privOptsData, &privOpts)
+	if err != nil {
+		return blockcipher.LayerBlockCipherOptions{}, errdefs.WithCategory(errdefs.ErrProtocol, fmt.Errorf("could not JSON unmarshal privOptsData: %w", err))
+	}
+
 	pubOpts := blockcipher.PublicLayerBlockCipherOptions{}
 	if len(pubOptsData) > 0 {
 		err := json.Unmarshal(pubOptsData, &pubOpts)
 		if err != nil {
-			return nil, "", errors.Wrapf(err, "could not JSON unmarshal pubOptsData")
+			return blockcipher.LayerBlockCipherOptions{}, errdefs.WithCategory(errdefs.ErrProtocol, fmt.Errorf("could not JSON unmarshal pubOptsData: %w", err))
 		}
 	}
 
-	opts := blockcipher.LayerBlockCipherOptions{
+	return blockcipher.LayerBlockCipherOptions{
 		Private: privOpts,
 		Public:  pubOpts,
-	}
-
-	plainLayerReader, opts, err := lbch.Decrypt(encLayerReader, opts)
-	if err != nil {
-		return nil, "", err
-	}
-
-	return plainLayerReader, opts.Private.Digest, nil
+	}, nil
 }
 
 // FilterOutAnnotations filters out the annotations belonging to the image encryption 'namespace'
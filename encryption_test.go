@@ -18,11 +18,43 @@ package ocicrypt
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/containers/ocicrypt/audit"
+	"github.com/containers/ocicrypt/authz"
+	"github.com/containers/ocicrypt/blockcipher"
 	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/fips"
+	"github.com/containers/ocicrypt/guard"
+	"github.com/containers/ocicrypt/keyhelper"
+	"github.com/containers/ocicrypt/keywrap/age"
+	"github.com/containers/ocicrypt/keywrap/jwe"
+	"github.com/containers/ocicrypt/limits"
+	"github.com/containers/ocicrypt/masterkey"
+	"github.com/containers/ocicrypt/metrics"
+	"github.com/containers/ocicrypt/policy"
+	"github.com/containers/ocicrypt/profiling"
+	"github.com/containers/ocicrypt/remotekeys"
+	"github.com/containers/ocicrypt/tracing"
+	"github.com/containers/ocicrypt/utils"
+	"github.com/containers/ocicrypt/verify"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -141,3 +173,2086 @@ func TestEncryptLayer(t *testing.T) {
 		t.Fatalf("Expected %v, got %v", data, decLayer)
 	}
 }
+
+type testMetrics struct {
+	sync.Mutex
+	wrapAttempts   map[string]int
+	unwrapAttempts map[string]int
+	providerErrors map[string]int
+	bytesEncrypted int64
+	bytesDecrypted int64
+}
+
+func (tm *testMetrics) WrapAttempt(scheme string) {
+	tm.Lock()
+	defer tm.Unlock()
+	tm.wrapAttempts[scheme]++
+}
+
+func (tm *testMetrics) WrapFailure(string) {}
+
+func (tm *testMetrics) UnwrapAttempt(scheme string) {
+	tm.Lock()
+	defer tm.Unlock()
+	tm.unwrapAttempts[scheme]++
+}
+
+func (tm *testMetrics) UnwrapFailure(string)                    {}
+func (tm *testMetrics) KeyWrapperLatency(string, time.Duration) {}
+
+func (tm *testMetrics) ProviderError(scheme string) {
+	tm.Lock()
+	defer tm.Unlock()
+	if tm.providerErrors == nil {
+		tm.providerErrors = map[string]int{}
+	}
+	tm.providerErrors[scheme]++
+}
+
+func (tm *testMetrics) BytesEncrypted(n int64) {
+	tm.Lock()
+	defer tm.Unlock()
+	tm.bytesEncrypted += n
+}
+
+func (tm *testMetrics) BytesDecrypted(n int64) {
+	tm.Lock()
+	defer tm.Unlock()
+	tm.bytesDecrypted += n
+}
+
+func TestEncryptDecryptLayerNewConfig(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the pkcs7 scheme")
+
+	if _, err := config.New(); !errors.Is(err, ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration without options, got %v", err)
+	}
+	if _, err := config.New(config.WithJWEPubKeys(nil)); !errors.Is(err, ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration without public keys, got %v", err)
+	}
+
+	caKey, caCert, err := utils.CreateTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certKey, err := utils.CreateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPubKey, err := x509.MarshalPKIXPublicKey(&certKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := utils.CertifyKey(certPubKey, nil, caKey, caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	certPrivKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(certKey)})
+	ageIdentity, ageRecipient, err := age.GenerateIdentity(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := config.New(
+		config.WithJWEPubKeys([][]byte{publicKey}),
+		config.WithX509Certs([][]byte{certPEM}),
+		config.WithAgeRecipients([][]byte{[]byte(ageRecipient)}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(cc.EncryptConfig, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayer, err := ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(GetWrappedKeysMap(ocispec.Descriptor{Annotations: annotations})) != 3 {
+		t.Fatalf("layer key was not wrapped for all recipients: %v", annotations)
+	}
+	newDesc := ocispec.Descriptor{Annotations: annotations}
+
+	for _, opts := range [][]config.Option{
+		{config.WithPrivKeys([][]byte{privateKey}, [][]byte{nil})},
+		{config.WithPrivKeys([][]byte{certPrivKey}, [][]byte{nil}), config.WithDecryptX509Certs([][]byte{certPEM})},
+		{config.WithAgeIdentities([][]byte{[]byte(ageIdentity)})},
+	} {
+		dcc, err := config.New(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decLayerReader, _, err := DecryptLayer(dcc.DecryptConfig, bytes.NewReader(encLayer), newDesc, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decLayer, err := ioutil.ReadAll(decLayerReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decLayer, data) {
+			t.Fatal("decrypted layer does not match the original")
+		}
+	}
+}
+
+func TestEncryptLayerMetrics(t *testing.T) {
+	tm := &testMetrics{
+		wrapAttempts:   map[string]int{},
+		unwrapAttempts: map[string]int{},
+	}
+	metrics.SetMetrics(tm)
+	defer metrics.SetMetrics(nil)
+
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayer, err := ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decLayerReader, _, err := DecryptLayer(dc, bytes.NewReader(encLayer), ocispec.Descriptor{Annotations: annotations}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(decLayerReader); err != nil {
+		t.Fatal(err)
+	}
+
+	if tm.wrapAttempts["jwe"] != 1 || len(tm.wrapAttempts) != 1 {
+		t.Fatalf("Expected exactly one jwe wrap attempt, got %v", tm.wrapAttempts)
+	}
+	if tm.unwrapAttempts["jwe"] != 1 {
+		t.Fatalf("Expected one jwe unwrap attempt, got %v", tm.unwrapAttempts)
+	}
+	if tm.bytesEncrypted != int64(len(data)) || tm.bytesDecrypted != int64(len(data)) {
+		t.Fatalf("Expected %d bytes encrypted and decrypted, got %d and %d", len(data), tm.bytesEncrypted, tm.bytesDecrypted)
+	}
+}
+
+func TestEncryptDecryptLayerContext(t *testing.T) {
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// the layer key is wrapped when the finalizer runs
+	encLayerReader, encLayerFinalizer, err := EncryptLayerContext(canceledCtx, ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(encLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encLayerFinalizer(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	encLayerReader, encLayerFinalizer, err = EncryptLayerContext(context.Background(), ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayer, err := ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDesc := ocispec.Descriptor{
+		Annotations: annotations,
+	}
+
+	if _, _, err := DecryptLayerContext(canceledCtx, dc, bytes.NewReader(encLayer), newDesc, false); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	decLayerReader, _, err := DecryptLayerContext(context.Background(), dc, bytes.NewReader(encLayer), newDesc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decLayer, err := ioutil.ReadAll(decLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decLayer, data) {
+		t.Fatal("Decrypted layer differs")
+	}
+}
+
+func TestEncryptDecryptLayerProgress(t *testing.T) {
+	data := bytes.Repeat([]byte("This is some text!"), 10000)
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	var progress []config.Progress
+	record := func(p config.Progress) {
+		progress = append(progress, p)
+	}
+	checkProgress := func(d digest.Digest, size int64) {
+		if len(progress) < 2 {
+			t.Fatalf("expected several progress updates, got %v", progress)
+		}
+		for i, p := range progress {
+			if p.Digest != d || (i > 0 && p.Bytes < progress[i-1].Bytes) || p.Done != (i == len(progress)-1) {
+				t.Fatalf("unexpected progress %v", progress)
+			}
+		}
+		if last := progress[len(progress)-1]; last.Bytes != size {
+			t.Fatalf("expected %d bytes to be reported, got %d", size, last.Bytes)
+		}
+		progress = nil
+	}
+
+	progressEc := *ec
+	progressEc.Progress = record
+	encLayerReader, encLayerFinalizer, err := EncryptLayerContext(context.Background(), &progressEc, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayer, err := ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProgress(desc.Digest, desc.Size)
+
+	encDesc := ocispec.Descriptor{
+		Digest:      digest.FromBytes(encLayer),
+		Size:        int64(len(encLayer)),
+		Annotations: annotations,
+	}
+	progressDc := *dc
+	progressDc.Progress = record
+	decLayerReader, _, err := DecryptLayerContext(context.Background(), &progressDc, bytes.NewReader(encLayer), encDesc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(decLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	checkProgress(encDesc.Digest, encDesc.Size)
+}
+
+func TestGetLayerSymmetricKey(t *testing.T) {
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayerContext(context.Background(), ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayer, err := ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := GetLayerSymmetricKey(context.Background(), dc, ocispec.Descriptor{Annotations: annotations})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.Private.SymmetricKey) != 32 || opts.Private.Digest != desc.Digest || opts.Public.CipherType != blockcipher.AES256CTR {
+		t.Fatalf("unexpected layer block cipher options %+v", opts)
+	}
+
+	// the options decrypt the layer without ocicrypt unwrapping the key again
+	lbch, err := blockcipher.NewLayerBlockCipherHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decLayerReader, _, err := lbch.Decrypt(bytes.NewReader(encLayer), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decLayer, err := ioutil.ReadAll(decLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decLayer, data) {
+		t.Fatal("Decrypted layer differs")
+	}
+
+	_, otherPrivKey, err := utils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {otherPrivKey},
+			"privkeys-passwords": {{}},
+		},
+	}
+	if _, err := GetLayerSymmetricKey(context.Background(), otherDc, ocispec.Descriptor{Annotations: annotations}); !errors.Is(err, ErrNoDecryptionKey) {
+		t.Fatalf("Expected ErrNoDecryptionKey, got %v", err)
+	}
+}
+
+func TestDecryptLayerNoDecryptionKey(t *testing.T) {
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(encLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDesc := ocispec.Descriptor{
+		Annotations: annotations,
+	}
+
+	// a private key that is not a recipient of the layer
+	_, otherPrivKey, err := utils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {otherPrivKey},
+			"privkeys-passwords": {{}},
+		},
+	}
+	_, _, err = DecryptLayer(otherDc, nil, newDesc, true)
+	if !errors.Is(err, ErrNoDecryptionKey) {
+		t.Fatalf("Expected ErrNoDecryptionKey, got %v", err)
+	}
+	// the error tells why each wrapped key could not be unwrapped
+	var ue *UnwrapError
+	if !errors.As(err, &ue) || len(ue.Errs) != 1 {
+		t.Fatalf("Expected an UnwrapError with one error, got %v", err)
+	}
+	if kerr := ue.Errs[0]; kerr.Scheme != "jwe" || kerr.Index != 0 || len(kerr.Recipients) != 1 || !errors.Is(kerr, ErrNoDecryptionKey) {
+		t.Fatalf("Unexpected error for the wrapped key: %+v", kerr)
+	}
+
+	// no private key at all
+	_, _, err = DecryptLayer(&config.DecryptConfig{}, nil, newDesc, true)
+	if !errors.Is(err, ErrNoDecryptionKey) {
+		t.Fatalf("Expected ErrNoDecryptionKey, got %v", err)
+	}
+}
+
+func TestDecryptLayerKeyWrappers(t *testing.T) {
+	tm := &testMetrics{
+		wrapAttempts:   map[string]int{},
+		unwrapAttempts: map[string]int{},
+	}
+	metrics.SetMetrics(tm)
+	defer metrics.SetMetrics(nil)
+
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+	// the layer key is wrapped by both the jwe and the threshold keywrappers
+	// for the same key
+	twoEc := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"pubkeys":           {publicKey},
+			"threshold-pubkeys": {publicKey},
+			"threshold-k":       {[]byte("1")},
+		},
+	}
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(twoEc, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(encLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		keyWrappers, denied []string
+		tried               string
+		err                 error
+	}{
+		{nil, nil, "jwe", nil},
+		{[]string{"threshold", "jwe"}, nil, "threshold", nil},
+		{nil, []string{"jwe"}, "threshold", nil},
+		{[]string{"jwe"}, []string{"jwe"}, "", ErrNoDecryptionKey},
+		{[]string{"unknown"}, nil, "", ErrConfiguration},
+	} {
+		tm.Lock()
+		tm.unwrapAttempts = map[string]int{}
+		tm.Unlock()
+		orderedDc := *dc
+		orderedDc.KeyWrappers = tc.keyWrappers
+		orderedDc.DeniedKeyWrappers = tc.denied
+		_, _, err := DecryptLayer(&orderedDc, nil, ocispec.Descriptor{Annotations: annotations}, true)
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Expected %v for key wrappers %v and denied %v, got %v", tc.err, tc.keyWrappers, tc.denied, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tm.unwrapAttempts) != 1 || tm.unwrapAttempts[tc.tried] != 1 {
+			t.Fatalf("Expected one %s unwrap attempt for key wrappers %v and denied %v, got %v", tc.tried, tc.keyWrappers, tc.denied, tm.unwrapAttempts)
+		}
+	}
+}
+
+// opaqueKey hides the type of the private key behind crypto.Decrypter
+type opaqueKey struct {
+	crypto.Decrypter
+}
+
+func TestDecryptLayerDecrypter(t *testing.T) {
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayer, err := ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDesc := ocispec.Descriptor{
+		Annotations: annotations,
+	}
+
+	key, err := utils.ParsePrivateKey(privateKey, nil, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypterDc := &config.DecryptConfig{
+		Decrypters: []crypto.Decrypter{opaqueKey{key.(crypto.Decrypter)}},
+	}
+	decLayerReader, _, err := DecryptLayer(decrypterDc, bytes.NewReader(encLayer), newDesc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decLayer, err := ioutil.ReadAll(decLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decLayer, data) {
+		t.Fatalf("Expected %v, got %v", data, decLayer)
+	}
+}
+
+type testAccountant struct {
+	sync.Mutex
+	cpuTime map[profiling.Operation]time.Duration
+	ciphers map[string]bool
+	digests map[digest.Digest]bool
+}
+
+func (ta *testAccountant) CPUTime(d digest.Digest, op profiling.Operation, cipher string, t time.Duration) {
+	ta.Lock()
+	defer ta.Unlock()
+	ta.cpuTime[op] += t
+	ta.ciphers[cipher] = true
+	ta.digests[d] = true
+}
+
+// slowReader sleeps before every read
+type slowReader struct {
+	r io.Reader
+}
+
+func (sr *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(50 * time.Millisecond)
+	return sr.r.Read(p)
+}
+
+func TestEncryptDecryptLayerProfiling(t *testing.T) {
+	ta := &testAccountant{
+		cpuTime: map[profiling.Operation]time.Duration{},
+		ciphers: map[string]bool{},
+		digests: map[digest.Digest]bool{},
+	}
+	profiling.SetAccountant(ta)
+	defer profiling.SetAccountant(nil)
+	profiling.SetLabels(true)
+	defer profiling.SetLabels(false)
+
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(ec, &slowReader{r: bytes.NewReader(data)}, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayer, err := ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decLayerReader, _, err := DecryptLayer(dc, &slowReader{r: bytes.NewReader(encLayer)}, ocispec.Descriptor{Digest: desc.Digest, Annotations: annotations}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decLayer bytes.Buffer
+	if _, err := io.Copy(&decLayer, decLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decLayer.Bytes(), data) {
+		t.Fatal("Decrypted layer does not match the plain layer")
+	}
+
+	for _, op := range []profiling.Operation{profiling.OperationEncrypt, profiling.OperationDecrypt} {
+		// the time spent reading the source must not be accounted
+		if cpuTime, ok := ta.cpuTime[op]; !ok || cpuTime >= 50*time.Millisecond {
+			t.Fatalf("Unexpected CPU time for %s: %v", op, ta.cpuTime)
+		}
+	}
+	if !ta.ciphers[string(blockcipher.AES256CTR)] || len(ta.ciphers) != 1 {
+		t.Fatalf("Unexpected ciphers %v", ta.ciphers)
+	}
+	if !ta.digests[desc.Digest] || len(ta.digests) != 1 {
+		t.Fatalf("Unexpected layer digests %v", ta.digests)
+	}
+}
+
+type testSink struct {
+	sync.Mutex
+	events []audit.Event
+}
+
+func (ts *testSink) Audit(event audit.Event) {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.events = append(ts.events, event)
+}
+
+func TestEncryptLayerAudit(t *testing.T) {
+	ts := &testSink{}
+	audit.SetSink(ts)
+	defer audit.SetSink(nil)
+
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(encLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecryptLayer(dc, nil, ocispec.Descriptor{Digest: desc.Digest, Annotations: annotations}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ts.events) != 2 {
+		t.Fatalf("Expected 2 audit events, got %d", len(ts.events))
+	}
+	for i, op := range []audit.Operation{audit.OperationWrap, audit.OperationUnwrap} {
+		ev := ts.events[i]
+		if ev.Operation != op || ev.Scheme != "jwe" || ev.LayerDigest != desc.Digest || ev.Err != nil || ev.Time.IsZero() {
+			t.Fatalf("Unexpected audit event %+v", ev)
+		}
+	}
+
+	key, err := utils.ParsePrivateKey(privateKey, nil, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID := utils.KeyID(key); keyID == "" || ts.events[1].KeyID != keyID {
+		t.Fatalf("Expected key ID %q in unwrap event, got %q", keyID, ts.events[1].KeyID)
+	}
+	if ts.events[0].KeyID != "" {
+		t.Fatalf("Unexpected key ID %q in wrap event", ts.events[0].KeyID)
+	}
+}
+
+func TestDecryptLayerThrottled(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "an encrypted PEM private key")
+
+	guard.SetGuard(guard.NewBackoff(2, time.Hour, 0))
+	defer guard.SetGuard(nil)
+	ts := &testSink{}
+	audit.SetSink(ts)
+	defer audit.SetSink(nil)
+
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(encLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDesc := ocispec.Descriptor{
+		Digest:      desc.Digest,
+		Annotations: annotations,
+	}
+
+	_, privKey, err := utils.CreateRSATestKey(2048, []byte("password"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongDc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {privKey},
+			"privkeys-passwords": {[]byte("wrong")},
+		},
+	}
+	for i := 0; i < 2; i++ {
+		_, _, err = DecryptLayer(wrongDc, nil, newDesc, true)
+		if !errors.Is(err, ErrWrongPassword) || !errors.Is(err, ErrNoDecryptionKey) {
+			t.Fatalf("Expected ErrWrongPassword, got %v", err)
+		}
+	}
+	_, _, err = DecryptLayer(wrongDc, nil, newDesc, true)
+	if !errors.Is(err, ErrThrottled) {
+		t.Fatalf("Expected ErrThrottled, got %v", err)
+	}
+	ev := ts.events[len(ts.events)-1]
+	if ev.Operation != audit.OperationUnwrapThrottled || ev.LayerDigest != desc.Digest || !errors.Is(ev.Err, ErrThrottled) {
+		t.Fatalf("Unexpected audit event %+v", ev)
+	}
+
+	// other keys are not affected
+	if _, _, err := DecryptLayer(dc, nil, newDesc, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testSpanKey struct{}
+
+type testSpan struct {
+	name   string
+	attrs  []tracing.Attribute
+	parent *testSpan
+	ended  bool
+	err    error
+}
+
+func (s *testSpan) End(err error) {
+	s.ended = true
+	s.err = err
+}
+
+type testTracer struct {
+	lock  sync.Mutex
+	spans []*testSpan
+}
+
+func (tt *testTracer) Start(ctx context.Context, name string, attrs ...tracing.Attribute) (context.Context, tracing.Span) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	parent, _ := ctx.Value(testSpanKey{}).(*testSpan)
+	span := &testSpan{name: name, attrs: attrs, parent: parent}
+	tt.spans = append(tt.spans, span)
+	return context.WithValue(ctx, testSpanKey{}, span), span
+}
+
+func TestEncryptLayerTracing(t *testing.T) {
+	tt := &testTracer{}
+	tracing.SetTracer(tt)
+	defer tracing.SetTracer(nil)
+
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(encLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecryptLayer(dc, nil, ocispec.Descriptor{Digest: desc.Digest, Annotations: annotations}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var unwrapSpans int
+	for _, span := range tt.spans {
+		if !span.ended || span.err != nil {
+			t.Fatalf("Span %s was not ended successfully", span.name)
+		}
+		if span.attrs[0] != tracing.String(tracing.KeyLayerDigest, desc.Digest.String()) {
+			t.Fatalf("Span %s misses the layer digest", span.name)
+		}
+		switch span.name {
+		case tracing.SpanEncryptLayer, tracing.SpanDecryptLayer:
+			if span.parent != nil {
+				t.Fatalf("Span %s must not have a parent", span.name)
+			}
+		case tracing.SpanWrapKeys:
+			if span.parent == nil || span.parent.name != tracing.SpanEncryptLayer {
+				t.Fatalf("Span %s must be a child of %s", span.name, tracing.SpanEncryptLayer)
+			}
+		case tracing.SpanUnwrapKey:
+			unwrapSpans++
+			if span.parent == nil || span.parent.name != tracing.SpanDecryptLayer {
+				t.Fatalf("Span %s must be a child of %s", span.name, tracing.SpanDecryptLayer)
+			}
+		default:
+			t.Fatalf("Unexpected span %s", span.name)
+		}
+	}
+	if tt.spans[0].name != tracing.SpanEncryptLayer || unwrapSpans != 1 {
+		t.Fatalf("Unexpected spans %+v", tt.spans)
+	}
+}
+
+func TestDecryptLayerMaxMemory(t *testing.T) {
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(encLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDesc := ocispec.Descriptor{
+		Annotations: annotations,
+	}
+
+	limitedDc := &config.DecryptConfig{
+		Parameters: dc.Parameters,
+		MaxMemory:  blockcipher.DecryptionBufferSize,
+	}
+	if _, _, err := DecryptLayer(limitedDc, nil, newDesc, true); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("Expected ErrLimitExceeded, got %v", err)
+	}
+
+	limitedDc.MaxMemory = 1024 * 1024
+	if _, _, err := DecryptLayer(limitedDc, nil, newDesc, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// a larger buffer of the block cipher counts against the limit
+	limitedDc.BufferSize = int(limitedDc.MaxMemory / 2)
+	if _, _, err := DecryptLayer(limitedDc, nil, newDesc, true); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("Expected ErrLimitExceeded, got %v", err)
+	}
+}
+
+func TestEncryptLayerWithDigests(t *testing.T) {
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayerWithDigests(ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayer, err := ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, digests, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := LayerDigests{
+		PlaintextDigest: desc.Digest,
+		PlaintextSize:   desc.Size,
+		Digest:          digest.FromBytes(encLayer),
+		Size:            int64(len(encLayer)),
+	}
+	if digests == nil || *digests != expected {
+		t.Fatalf("Expected digests %+v, got %+v", expected, digests)
+	}
+
+	// DecryptLayer returns the digest of the plaintext layer
+	_, d, err := DecryptLayer(dc, bytes.NewReader(encLayer), ocispec.Descriptor{Annotations: annotations}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != desc.Digest {
+		t.Fatalf("Expected digest %s, got %s", desc.Digest, d)
+	}
+
+	// adding recipients to an encrypted layer does not encrypt it again
+	_, encLayerFinalizer, err = EncryptLayerWithDigests(ec, nil, ocispec.Descriptor{Annotations: annotations})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, digests, err = encLayerFinalizer(); err != nil || digests != nil {
+		t.Fatalf("Expected no digests, got %+v and %v", digests, err)
+	}
+}
+
+func TestEncryptLayerBindDigest(t *testing.T) {
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	boundEc := *ec
+	boundEc.BindDigest = true
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(&boundEc, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayer, err := ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encDesc := ocispec.Descriptor{
+		Digest:      digest.FromBytes(encLayer),
+		Size:        int64(len(encLayer)),
+		Annotations: annotations,
+	}
+	boundDc := *dc
+	boundDc.BoundDigests = map[digest.Digest]digest.Digest{encDesc.Digest: desc.Digest}
+	decLayerReader, _, err := DecryptLayer(&boundDc, bytes.NewReader(encLayer), encDesc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decLayer, err := ioutil.ReadAll(decLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decLayer, data) {
+		t.Fatal("Decrypted layer differs")
+	}
+
+	// the digest kept with the layer key is not trusted
+	if _, _, err := DecryptLayer(dc, bytes.NewReader(encLayer), encDesc, false); !errors.Is(err, ErrConfiguration) {
+		t.Fatalf("Expected ErrConfiguration without bound digests, got %v", err)
+	}
+
+	// the annotations cannot be moved to another layer
+	otherData := []byte("This is other text")
+	otherDesc := ocispec.Descriptor{
+		Digest:      digest.FromBytes(otherData),
+		Size:        int64(len(otherData)),
+		Annotations: annotations,
+	}
+	boundDc.BoundDigests = map[digest.Digest]digest.Digest{otherDesc.Digest: digest.FromBytes([]byte("other plaintext"))}
+	if _, _, err := DecryptLayer(&boundDc, bytes.NewReader(encLayer), otherDesc, false); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("Expected ErrIntegrity for annotations of another layer, got %v", err)
+	}
+
+	// layers that are not bound are not decrypted if a digest is expected
+	encLayerReader, encLayerFinalizer, err = EncryptLayer(ec, bytes.NewReader(otherData), ocispec.Descriptor{Digest: otherDesc.Digest, Size: otherDesc.Size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayer, err = ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if annotations, err = encLayerFinalizer(); err != nil {
+		t.Fatal(err)
+	}
+	otherDesc.Annotations = annotations
+	boundDc.BoundDigests = map[digest.Digest]digest.Digest{otherDesc.Digest: otherDesc.Digest}
+	if _, _, err := DecryptLayer(&boundDc, bytes.NewReader(encLayer), otherDesc, false); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("Expected ErrIntegrity for a layer that is not bound, got %v", err)
+	}
+
+	// the digest to bind is needed
+	if _, _, err := EncryptLayer(&boundEc, bytes.NewReader(data), ocispec.Descriptor{Size: desc.Size}); !errors.Is(err, ErrConfiguration) {
+		t.Fatalf("Expected ErrConfiguration, got %v", err)
+	}
+}
+
+func TestEncryptLayerConvergent(t *testing.T) {
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encryptData := func(secret, data []byte) ([]byte, map[string]string, error) {
+		convergentEc := *ec
+		convergentEc.Parameters = map[string][][]byte{"convergent-secret": {secret}}
+		for k, v := range ec.Parameters {
+			convergentEc.Parameters[k] = v
+		}
+		encLayerReader, encLayerFinalizer, err := EncryptLayer(&convergentEc, bytes.NewReader(data), desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encLayer, err := ioutil.ReadAll(encLayerReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		annotations, err := encLayerFinalizer()
+		return encLayer, annotations, err
+	}
+	encrypt := func(secret []byte) ([]byte, map[string]string) {
+		encLayer, annotations, err := encryptData(secret, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encLayer, annotations
+	}
+
+	secret := bytes.Repeat([]byte{1}, 32)
+	encLayer, annotations := encrypt(secret)
+	if encLayer2, _ := encrypt(secret); !bytes.Equal(encLayer, encLayer2) {
+		t.Fatal("Encrypting the layer twice with the same secret gave different ciphertext")
+	}
+	if encLayer2, _ := encrypt(bytes.Repeat([]byte{2}, 32)); bytes.Equal(encLayer, encLayer2) {
+		t.Fatal("Encrypting the layer with different secrets gave the same ciphertext")
+	}
+
+	decLayerReader, _, err := DecryptLayer(dc, bytes.NewReader(encLayer), ocispec.Descriptor{Annotations: annotations}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decLayer, err := ioutil.ReadAll(decLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decLayer, data) {
+		t.Fatal("Decrypted layer differs")
+	}
+
+	// other plaintext under the digest of the layer would reuse its layer key
+	// and nonces
+	if _, _, err := encryptData(secret, []byte("This is other text")); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("Expected ErrIntegrity for plaintext not matching the digest, got %v", err)
+	}
+}
+
+func TestDecryptLayerReaderAt(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the AES_256_GCM_CHUNKED block cipher")
+
+	data := bytes.Repeat([]byte("This is some text!"), 10000)
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	seekableEc := *ec
+	seekableEc.Cipher = blockcipher.AES256GCMChunked
+	seekableEc.Parallelism = 4
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(&seekableEc, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayer, err := ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDesc := ocispec.Descriptor{
+		Digest:      digest.FromBytes(encLayer),
+		Size:        int64(len(encLayer)),
+		Annotations: annotations,
+	}
+
+	decLayerReaderAt, size, err := DecryptLayerReaderAt(dc, bytes.NewReader(encLayer), newDesc.Size, newDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) {
+		t.Fatalf("Expected plaintext size %d, got %d", len(data), size)
+	}
+	p := make([]byte, 1000)
+	if _, err := decLayerReaderAt.ReadAt(p, 100000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, data[100000:101000]) {
+		t.Fatal("Decrypted range differs")
+	}
+
+	decLayerReader, _, err := DecryptLayer(dc, bytes.NewReader(encLayer), newDesc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decLayer, err := ioutil.ReadAll(decLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decLayer, data) {
+		t.Fatal("Decrypted layer differs")
+	}
+
+	// layers encrypted with AES-CTR can only be decrypted as a stream
+	encLayerReader, encLayerFinalizer, err = EncryptLayer(ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encLayer, err = ioutil.ReadAll(encLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	if newDesc.Annotations, err = encLayerFinalizer(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecryptLayerReaderAt(dc, bytes.NewReader(encLayer), int64(len(encLayer)), newDesc); !errors.Is(err, ErrUnsupportedCipher) {
+		t.Fatalf("Expected ErrUnsupportedCipher, got %v", err)
+	}
+}
+
+type testVerifier struct {
+	calls int
+	err   error
+}
+
+func (tv *testVerifier) Verify(context.Context, string, ocispec.Descriptor) error {
+	tv.calls++
+	return tv.err
+}
+
+func TestDecryptLayerVerification(t *testing.T) {
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(encLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDesc := ocispec.Descriptor{
+		Digest:      desc.Digest,
+		Annotations: annotations,
+	}
+
+	tv := &testVerifier{err: errors.New("no trusted signature")}
+	verifiedDc := &config.DecryptConfig{
+		Parameters:   dc.Parameters,
+		Verification: &verify.Verification{Verifier: tv, Reference: "registry.example.com/app"},
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := DecryptLayer(verifiedDc, nil, newDesc, true); !errors.Is(err, ErrVerificationFailed) {
+			t.Fatalf("Expected ErrVerificationFailed, got %v", err)
+		}
+	}
+
+	tv = &testVerifier{}
+	verifiedDc.Verification = &verify.Verification{Verifier: tv, Reference: "registry.example.com/app"}
+	for i := 0; i < 2; i++ {
+		if _, _, err := DecryptLayer(verifiedDc, nil, newDesc, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tv.calls != 1 {
+		t.Fatalf("Verifier was called %d times, expected once per image", tv.calls)
+	}
+}
+
+func TestDecryptLayerAuthorization(t *testing.T) {
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(encLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDesc := ocispec.Descriptor{
+		Digest:      desc.Digest,
+		Annotations: annotations,
+	}
+
+	var requests []authz.Request
+	authorizedDc := &config.DecryptConfig{
+		Parameters: dc.Parameters,
+		Authorization: &authz.Authorization{
+			Authorizer: authz.AuthorizerFunc(func(_ context.Context, req authz.Request) error {
+				requests = append(requests, req)
+				if req.Caller["namespace"] != "prod" {
+					return errors.New("namespace may not decrypt")
+				}
+				return nil
+			}),
+			Reference: "registry.example.com/app:1.0",
+			Caller:    map[string]string{"namespace": "dev"},
+		},
+	}
+	_, _, err = DecryptLayer(authorizedDc, nil, newDesc, true)
+	var le *LayerError
+	if !errors.Is(err, ErrNotAuthorized) || !errors.As(err, &le) || le.Scheme != "jwe" {
+		t.Fatalf("Expected ErrNotAuthorized for jwe, got %v", err)
+	}
+	if len(requests) != 1 || requests[0].Layer != desc.Digest || requests[0].Scheme != "jwe" || requests[0].Reference != "registry.example.com/app:1.0" {
+		t.Fatalf("Unexpected requests %+v", requests)
+	}
+
+	authorizedDc.Authorization.Caller["namespace"] = "prod"
+	if _, _, err := DecryptLayer(authorizedDc, nil, newDesc, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecryptLayerTenants(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "an encrypted PEM private key")
+
+	guard.SetGuard(guard.NewBackoff(2, time.Hour, 0))
+	defer guard.SetGuard(nil)
+	ts := &testSink{}
+	audit.SetSink(ts)
+	defer audit.SetSink(nil)
+
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(encLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDesc := ocispec.Descriptor{
+		Digest:      desc.Digest,
+		Annotations: annotations,
+	}
+
+	_, privKey, err := utils.CreateRSATestKey(2048, []byte("password"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongDc := func(tenant string) *config.DecryptConfig {
+		return &config.DecryptConfig{
+			Parameters: map[string][][]byte{
+				"privkeys":           {privKey},
+				"privkeys-passwords": {[]byte("wrong")},
+			},
+			Tenant: tenant,
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := DecryptLayer(wrongDc("a"), nil, newDesc, true); !errors.Is(err, ErrWrongPassword) {
+			t.Fatalf("Expected ErrWrongPassword, got %v", err)
+		}
+	}
+	if _, _, err := DecryptLayer(wrongDc("a"), nil, newDesc, true); !errors.Is(err, ErrThrottled) {
+		t.Fatalf("Expected ErrThrottled, got %v", err)
+	}
+
+	// the same key of another tenant is not throttled
+	if _, _, err := DecryptLayer(wrongDc("b"), nil, newDesc, true); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("Expected ErrWrongPassword, got %v", err)
+	}
+	if ev := ts.events[len(ts.events)-1]; ev.Operation != audit.OperationUnwrap || ev.Tenant != "b" {
+		t.Fatalf("Unexpected audit event %+v", ev)
+	}
+
+	tenantDc := &config.DecryptConfig{Parameters: dc.Parameters, Tenant: "b"}
+	cc := config.CombineCryptoConfigs([]config.CryptoConfig{
+		{DecryptConfig: tenantDc},
+		{DecryptConfig: &config.DecryptConfig{Tenant: "a"}},
+	})
+	if _, _, err := DecryptLayer(cc.DecryptConfig, nil, newDesc, true); !errors.Is(err, ErrConfiguration) {
+		t.Fatalf("Expected ErrConfiguration for mixed tenants, got %v", err)
+	}
+	cc = config.CombineCryptoConfigs([]config.CryptoConfig{
+		{DecryptConfig: tenantDc},
+		{DecryptConfig: &config.DecryptConfig{}},
+	})
+	if cc.DecryptConfig.Tenant != "b" {
+		t.Fatalf("Expected tenant b, got %q", cc.DecryptConfig.Tenant)
+	}
+	if _, _, err := DecryptLayer(cc.DecryptConfig, nil, newDesc, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecryptLayerKeyLookup(t *testing.T) {
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(encLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDesc := ocispec.Descriptor{
+		Digest:      desc.Digest,
+		Annotations: annotations,
+	}
+
+	// the key helper returns the private key of the DecryptConfig
+	dir := t.TempDir()
+	resp, err := json.Marshal(keyhelper.Response{
+		Keys: []keyhelper.Key{{
+			PrivateKey: dc.Parameters["privkeys"][0],
+			Password:   dc.Parameters["privkeys-passwords"][0],
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "resp.json"), resp, 0600); err != nil {
+		t.Fatal(err)
+	}
+	helper := filepath.Join(dir, keyhelper.Prefix+"test")
+	if err := ioutil.WriteFile(helper, []byte("#!/bin/sh\ncat "+filepath.Join(dir, "resp.json")+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	lookupDc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{},
+		KeyLookup: &keyhelper.Lookup{
+			Helpers:   []*keyhelper.Helper{{Path: helper}},
+			Reference: "registry.example.com/app:1.0",
+		},
+	}
+	if _, _, err := DecryptLayer(lookupDc, nil, newDesc, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(lookupDc.Parameters["privkeys"]) != 0 {
+		t.Fatal("Expected the DecryptConfig to be unchanged")
+	}
+
+	lookupDc.KeyLookup.Helpers[0].Path = filepath.Join(dir, "missing")
+	if _, _, err := DecryptLayer(lookupDc, nil, newDesc, true); !errors.Is(err, ErrProviderUnreachable) {
+		t.Fatalf("Expected ErrProviderUnreachable, got %v", err)
+	}
+}
+
+func TestDecryptLayerRemoteKeys(t *testing.T) {
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(encLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var payload []byte
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(payload)
+	}))
+	defer server.Close()
+	annotations, payload, err = remotekeys.Detach(annotations, server.URL+"/keys", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDesc := ocispec.Descriptor{
+		Digest:      desc.Digest,
+		Annotations: annotations,
+	}
+
+	if _, _, err := DecryptLayer(dc, nil, newDesc, true); !errors.Is(err, ErrConfiguration) {
+		t.Fatalf("Expected ErrConfiguration without resolver, got %v", err)
+	}
+
+	remoteDc := &config.DecryptConfig{
+		Parameters: dc.Parameters,
+		RemoteKeys: &remotekeys.Resolver{Client: server.Client()},
+	}
+	if _, _, err := DecryptLayer(remoteDc, nil, newDesc, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptDecryptLayerMasterKey(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "deriving layer keys from master keys")
+
+	masterKey, err := masterkey.Generate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrappedKeys, err := EncryptMasterKey(ec, masterKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+	encLayerReader, encLayerFinalizer, err := EncryptLayerWithMasterKey(ec, masterKey, 3, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayer, err := ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(annotations) != 2 || annotations[masterkey.Annotation] == "" {
+		t.Fatalf("unexpected annotations %v", annotations)
+	}
+	newDesc := ocispec.Descriptor{
+		Digest:      digest.FromBytes(encLayer),
+		Annotations: annotations,
+	}
+
+	if _, _, err := DecryptLayer(dc, bytes.NewReader(encLayer), newDesc, false); !errors.Is(err, ErrNoDecryptionKey) {
+		t.Fatalf("expected ErrNoDecryptionKey without master key, got %v", err)
+	}
+
+	unwrapped, err := DecryptMasterKey(dc, wrappedKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := config.DecryptWithMasterKeys([][]byte{unwrapped})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decLayerReader, _, err := DecryptLayer(cc.DecryptConfig, bytes.NewReader(encLayer), newDesc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decLayer, err := ioutil.ReadAll(decLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decLayer, data) {
+		t.Fatal("decrypted layer does not match the original")
+	}
+}
+
+func TestDecryptLayerLimits(t *testing.T) {
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	// wrap the layer key for two recipients
+	pubKey2, _, err := utils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	twoEc := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"pubkeys": {publicKey, pubKey2},
+		},
+	}
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(twoEc, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(encLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDesc := ocispec.Descriptor{
+		Digest:      desc.Digest,
+		Annotations: annotations,
+	}
+
+	for _, l := range []*limits.Limits{
+		{MaxRecipients: 1},
+		{MaxAnnotationBytes: 100},
+		{MaxWrappedKeySize: 100},
+	} {
+		limitedDc := &config.DecryptConfig{
+			Parameters: dc.Parameters,
+			Limits:     l,
+		}
+		if _, _, err := DecryptLayer(limitedDc, nil, newDesc, true); !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("Expected ErrLimitExceeded for %+v, got %v", l, err)
+		}
+	}
+
+	limits.SetLimits(&limits.Limits{MaxRecipients: 1})
+	defer limits.SetLimits(nil)
+	if _, _, err := DecryptLayer(dc, nil, newDesc, true); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("Expected ErrLimitExceeded from global limits, got %v", err)
+	}
+	limitedEc := &config.EncryptConfig{
+		Parameters: twoEc.Parameters,
+		Limits:     &limits.Limits{MaxRecipients: 2},
+	}
+	encLayerReader, encLayerFinalizer, err = EncryptLayer(limitedEc, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(encLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encLayerFinalizer(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecryptLayerMaxConcurrentLayers(t *testing.T) {
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+	l := &limits.Limits{MaxConcurrentLayers: 1}
+	limitedEc := &config.EncryptConfig{
+		Parameters: ec.Parameters,
+		Limits:     l,
+	}
+	limitedDc := &config.DecryptConfig{
+		Parameters: dc.Parameters,
+		Limits:     l,
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(limitedEc, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayer, err := ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDesc := ocispec.Descriptor{
+		Digest:      desc.Digest,
+		Annotations: annotations,
+	}
+
+	// readers that are closed before they are read to the end must not block
+	// other layers
+	for i := 0; i < 3; i++ {
+		decLayerReader, _, err := DecryptLayer(limitedDc, bytes.NewReader(encLayer), newDesc, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decLayerReader.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := decLayerReader.(io.Closer).Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the slot is held by the reader of the layer, so another layer waits
+	// until its context is done
+	decLayerReader, _, err := DecryptLayer(limitedDc, bytes.NewReader(encLayer), newDesc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := DecryptLayerContext(ctx, limitedDc, bytes.NewReader(encLayer), newDesc, false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	decLayer, err := ioutil.ReadAll(decLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decLayer, data) {
+		t.Fatal("Decrypted layer does not match the plain layer")
+	}
+}
+
+func TestEncryptDecryptLayerConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%4 == 0 {
+				// registering key wrappers must be safe while layers are processed
+				RegisterKeyWrapper("jwe", jwe.NewKeyWrapper())
+			}
+			data := bytes.Repeat([]byte{byte(i)}, 1000*(i+1))
+			desc := ocispec.Descriptor{
+				Digest: digest.FromBytes(data),
+				Size:   int64(len(data)),
+			}
+			encLayerReader, encLayerFinalizer, err := EncryptLayer(ec, bytes.NewReader(data), desc)
+			if err != nil {
+				errs <- err
+				return
+			}
+			encLayer, err := ioutil.ReadAll(encLayerReader)
+			if err != nil {
+				errs <- err
+				return
+			}
+			annotations, err := encLayerFinalizer()
+			if err != nil {
+				errs <- err
+				return
+			}
+			newDesc := ocispec.Descriptor{
+				Annotations: annotations,
+			}
+			decLayerReader, _, err := DecryptLayer(dc, bytes.NewReader(encLayer), newDesc, false)
+			if err != nil {
+				errs <- err
+				return
+			}
+			decLayer, err := ioutil.ReadAll(decLayerReader)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(decLayer, data) {
+				errs <- errors.New("decrypted layer does not match the original layer")
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestDecryptLayerErrorContext(t *testing.T) {
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayer, err := ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDesc := ocispec.Descriptor{
+		Digest:      digest.FromBytes(encLayer),
+		Annotations: annotations,
+	}
+
+	_, otherPrivKey, err := utils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {otherPrivKey},
+			"privkeys-passwords": {{}},
+		},
+	}
+	_, _, err = DecryptLayer(otherDc, nil, newDesc, true)
+	var layerErr *LayerError
+	if !errors.As(err, &layerErr) || layerErr.Digest != newDesc.Digest {
+		t.Fatalf("Expected LayerError for layer %s, got %v", newDesc.Digest, err)
+	}
+	if !errors.Is(err, ErrNoDecryptionKey) {
+		t.Fatalf("Expected ErrNoDecryptionKey, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "jwe: ") {
+		t.Fatalf("Expected error to name the jwe scheme, got %v", err)
+	}
+
+	// errors while reading the layer name the layer as well
+	encLayer[0] ^= 0xff
+	decLayerReader, _, err := DecryptLayer(dc, bytes.NewReader(encLayer), newDesc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(decLayerReader)
+	if !errors.As(err, &layerErr) || layerErr.Digest != newDesc.Digest || !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("Expected LayerError wrapping ErrIntegrity for layer %s, got %v", newDesc.Digest, err)
+	}
+}
+
+// detRand is a deterministic source of "randomness" for tests
+type detRand struct {
+	b byte
+}
+
+func (r *detRand) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.b
+		r.b++
+	}
+	return len(p), nil
+}
+
+func TestEncryptLayerRand(t *testing.T) {
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	var encLayers [][]byte
+	var allAnnotations []map[string]string
+	var newDesc ocispec.Descriptor
+	for i := 0; i < 2; i++ {
+		detEc := &config.EncryptConfig{
+			Parameters:    ec.Parameters,
+			Rand:          &detRand{},
+			DecryptConfig: ec.DecryptConfig,
+		}
+		encLayerReader, encLayerFinalizer, err := EncryptLayer(detEc, bytes.NewReader(data), desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encLayer, err := ioutil.ReadAll(encLayerReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		annotations, err := encLayerFinalizer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		encLayers = append(encLayers, encLayer)
+		allAnnotations = append(allAnnotations, annotations)
+		newDesc = ocispec.Descriptor{
+			Annotations: annotations,
+		}
+	}
+	if !bytes.Equal(encLayers[0], encLayers[1]) {
+		t.Fatal("Expected the same source of randomness to produce the same encrypted layer")
+	}
+	pubOpts := allAnnotations[0]["org.opencontainers.image.enc.pubopts"]
+	if pubOpts == "" || pubOpts != allAnnotations[1]["org.opencontainers.image.enc.pubopts"] {
+		t.Fatal("Expected the same source of randomness to produce the same public options")
+	}
+	// the JWE is wrapped with RSA-OAEP, which uses the source of randomness
+	// unless only crypto/rand may be used
+	if !fips.Enforced() && !reflect.DeepEqual(allAnnotations[0], allAnnotations[1]) {
+		t.Fatal("Expected the same source of randomness to produce the same annotations")
+	}
+
+	decLayerReader, _, err := DecryptLayer(dc, bytes.NewReader(encLayers[1]), newDesc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decLayer, err := ioutil.ReadAll(decLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decLayer, data) {
+		t.Fatal("Decrypted data is incorrect")
+	}
+}
+
+// failingKeyWrapper fails to wrap the layer key if it has recipients
+type failingKeyWrapper struct{}
+
+func (kw *failingKeyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	if len(ec.Parameters["failing-recipients"]) == 0 {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("key service is down: %w", ErrProviderUnreachable)
+}
+
+func (kw *failingKeyWrapper) UnwrapKey(dc *config.DecryptConfig, annotation []byte) ([]byte, error) {
+	return nil, ErrNoDecryptionKey
+}
+
+func (kw *failingKeyWrapper) GetAnnotationID() string {
+	return "org.opencontainers.image.enc.keys.failing"
+}
+
+func (kw *failingKeyWrapper) NoPossibleKeys(map[string][][]byte) bool      { return true }
+func (kw *failingKeyWrapper) GetPrivateKeys(map[string][][]byte) [][]byte  { return nil }
+func (kw *failingKeyWrapper) GetKeyIdsFromPacket(string) ([]uint64, error) { return nil, nil }
+func (kw *failingKeyWrapper) GetRecipients(string) ([]string, error)       { return nil, nil }
+
+// thirdPartyKeyWrapper is a failingKeyWrapper with another annotation ID
+type thirdPartyKeyWrapper struct {
+	failingKeyWrapper
+	annotationID string
+}
+
+func (kw *thirdPartyKeyWrapper) GetAnnotationID() string {
+	return kw.annotationID
+}
+
+func TestAddKeyWrapper(t *testing.T) {
+	t.Cleanup(func() {
+		keyWrappersLock.Lock()
+		defer keyWrappersLock.Unlock()
+		for _, scheme := range []string{"third-party", "third-party-2", "third-party-3"} {
+			if r, ok := keyWrappers[scheme]; ok {
+				delete(keyWrapperAnnotations, r.annotationID)
+				delete(keyWrappers, scheme)
+			}
+		}
+	})
+	kw := &thirdPartyKeyWrapper{annotationID: "org.opencontainers.image.enc.keys.third-party"}
+	if err := AddKeyWrapper("third-party", kw, WithPriority(10)); err != nil {
+		t.Fatal(err)
+	}
+	if GetKeyWrapper("third-party") != kw {
+		t.Fatal("key wrapper was not registered")
+	}
+	if schemes := GetKeyWrapperSchemes(); schemes[0] != "third-party" || schemes[1] != "pgp" {
+		t.Fatalf("key wrapper with a higher priority is not used first: %v", schemes)
+	}
+
+	// conflicts
+	if err := AddKeyWrapper("third-party", &thirdPartyKeyWrapper{annotationID: "org.opencontainers.image.enc.keys.other"}); !errors.Is(err, ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration for a taken scheme, got %v", err)
+	}
+	if err := AddKeyWrapper("third-party-2", &thirdPartyKeyWrapper{annotationID: "org.opencontainers.image.enc.keys.jwe"}); !errors.Is(err, ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration for a taken annotation ID, got %v", err)
+	}
+	if err := AddKeyWrapper("", kw); !errors.Is(err, ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration for an empty scheme, got %v", err)
+	}
+	if GetKeyWrapper("jwe") == nil || GetKeyWrapper("third-party-2") != nil {
+		t.Fatal("a conflicting key wrapper was registered")
+	}
+
+	// replacing moves the annotation ID to the new scheme
+	kw2 := &thirdPartyKeyWrapper{annotationID: kw.annotationID}
+	if err := AddKeyWrapper("third-party-2", kw2, WithReplace(), WithPriority(-1)); err != nil {
+		t.Fatal(err)
+	}
+	if GetKeyWrapper("third-party") != nil || GetKeyWrapper("third-party-2") != kw2 {
+		t.Fatal("key wrapper was not replaced")
+	}
+	if schemes := GetKeyWrapperSchemes(); schemes[len(schemes)-1] != "third-party-2" {
+		t.Fatalf("key wrapper with a lower priority is not used last: %v", schemes)
+	}
+
+	// RegisterKeyWrapper does not validate and replaces silently
+	if err := AddKeyWrapper("third-party-3", nil); !errors.Is(err, ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration for a nil key wrapper, got %v", err)
+	}
+	RegisterKeyWrapper("third-party-3", nil)
+	if GetKeyWrapper("third-party-3") != nil {
+		t.Fatal("a nil key wrapper was registered")
+	}
+	kw3 := &thirdPartyKeyWrapper{annotationID: kw.annotationID}
+	RegisterKeyWrapper("third-party-3", kw3)
+	RegisterKeyWrapper("third-party-3", kw3)
+	if GetKeyWrapper("third-party-2") != nil || GetKeyWrapper("third-party-3") != kw3 {
+		t.Fatal("key wrapper was not replaced")
+	}
+}
+
+func TestEncryptLayerPartialFailures(t *testing.T) {
+	RegisterKeyWrapper("failing", &failingKeyWrapper{})
+
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+	otherPubKey, _, err := utils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptLayer := func(mode config.PartialFailureMode, minWrappedKeys int, pubKeys ...[]byte) (map[string]string, []byte, error) {
+		partialEc := &config.EncryptConfig{
+			Parameters: map[string][][]byte{
+				"pubkeys":            append([][]byte{publicKey}, pubKeys...),
+				"failing-recipients": {[]byte("anyone")},
+			},
+			PartialFailures: mode,
+			MinWrappedKeys:  minWrappedKeys,
+		}
+		encLayerReader, encLayerFinalizer, err := EncryptLayer(partialEc, bytes.NewReader(data), desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encLayer, err := ioutil.ReadAll(encLayerReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		annotations, err := encLayerFinalizer()
+		return annotations, encLayer, err
+	}
+
+	_, _, err = encryptLayer(config.FailFast, 0)
+	var le *LayerError
+	if !errors.As(err, &le) || le.Scheme != "failing" || !errors.Is(err, ErrProviderUnreachable) {
+		t.Fatalf("Expected the error of the failing scheme, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		mode           config.PartialFailureMode
+		minWrappedKeys int
+	}{
+		{config.CollectErrors, 0},
+		{config.BestEffort, 2},
+	} {
+		_, _, err := encryptLayer(tc.mode, tc.minWrappedKeys)
+		var we *WrapError
+		if !errors.As(err, &we) || len(we.Errs) != 1 || we.Errs[0].Scheme != "failing" || we.Wrapped != 1 {
+			t.Fatalf("Expected a WrapError for mode %d, got %v", tc.mode, err)
+		}
+		if !errors.Is(err, ErrProviderUnreachable) {
+			t.Fatalf("Expected the WrapError to match ErrProviderUnreachable, got %v", err)
+		}
+	}
+
+	// the JWE wrapped for two recipients counts as two wrapped keys
+	if _, _, err := encryptLayer(config.BestEffort, 2, otherPubKey); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = encryptLayer(config.BestEffort, 3, otherPubKey)
+	var we *WrapError
+	if !errors.As(err, &we) || we.Wrapped != 2 {
+		t.Fatalf("Expected a WrapError with 2 wrapped keys, got %v", err)
+	}
+
+	annotations, encLayer, err := encryptLayer(config.BestEffort, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decLayerReader, _, err := DecryptLayer(dc, bytes.NewReader(encLayer), ocispec.Descriptor{Annotations: annotations}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decLayer, err := ioutil.ReadAll(decLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decLayer, data) {
+		t.Fatal("Decrypted layer does not match the plain layer")
+	}
+}
+
+func TestEncryptLayerProviderErrorMetrics(t *testing.T) {
+	RegisterKeyWrapper("failing", &failingKeyWrapper{})
+
+	tm := &testMetrics{
+		wrapAttempts:   map[string]int{},
+		unwrapAttempts: map[string]int{},
+	}
+	metrics.SetMetrics(tm)
+	defer metrics.SetMetrics(nil)
+
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+	failingEc := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"pubkeys":            {publicKey},
+			"failing-recipients": {[]byte("anyone")},
+		},
+	}
+	encLayerReader, encLayerFinalizer, err := EncryptLayer(failingEc, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(encLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encLayerFinalizer(); !errors.Is(err, ErrProviderUnreachable) {
+		t.Fatalf("Expected ErrProviderUnreachable, got %v", err)
+	}
+	if tm.providerErrors["failing"] != 1 {
+		t.Fatalf("Expected 1 provider error for the failing scheme, got %v", tm.providerErrors)
+	}
+	if tm.providerErrors["jwe"] != 0 {
+		t.Fatalf("Expected no provider errors for the jwe scheme, got %v", tm.providerErrors)
+	}
+}
+
+func TestEncryptLayerEscrowRecipients(t *testing.T) {
+	RegisterKeyWrapper("failing", &failingKeyWrapper{})
+
+	escrowPubKey, escrowPrivKey, err := utils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+	encryptLayer := func(escrow map[string][][]byte) (map[string]string, []byte, error) {
+		escrowEc := &config.EncryptConfig{
+			Parameters: ec.Parameters,
+			Policy: &policy.Policy{
+				AllowedLegacyAlgorithms: policy.LegacyAlgorithms,
+				EscrowRecipients:        escrow,
+			},
+			PartialFailures: config.BestEffort,
+		}
+		encLayerReader, encLayerFinalizer, err := EncryptLayer(escrowEc, bytes.NewReader(data), desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encLayer, err := ioutil.ReadAll(encLayerReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		annotations, err := encLayerFinalizer()
+		return annotations, encLayer, err
+	}
+
+	annotations, encLayer, err := encryptLayer(map[string][][]byte{"pubkeys": {escrowPubKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	escrowDc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {escrowPrivKey},
+			"privkeys-passwords": {nil},
+		},
+	}
+	for _, d := range []*config.DecryptConfig{dc, escrowDc} {
+		decLayerReader, _, err := DecryptLayer(d, bytes.NewReader(encLayer), ocispec.Descriptor{Annotations: annotations}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decLayer, err := ioutil.ReadAll(decLayerReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decLayer, data) {
+			t.Fatal("Decrypted layer does not match the plain layer")
+		}
+	}
+
+	// escrow recipients must be added even in BestEffort mode
+	if _, _, err := encryptLayer(map[string][][]byte{"failing-recipients": {[]byte("escrow")}}); !errors.Is(err, ErrProviderUnreachable) {
+		t.Fatalf("Expected ErrProviderUnreachable, got %v", err)
+	}
+	if _, _, err := encryptLayer(map[string][][]byte{"unknown": {[]byte("escrow")}}); !errors.Is(err, ErrConfiguration) {
+		t.Fatalf("Expected ErrConfiguration, got %v", err)
+	}
+}
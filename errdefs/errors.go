@@ -0,0 +1,137 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package errdefs defines the common errors returned by ocicrypt. Errors
+// returned by ocicrypt wrap these errors so that callers can test for them
+// using errors.Is rather than matching error strings.
+//
+// Every error falls into one of the following categories:
+//
+//   - ErrConfiguration: the configuration passed to ocicrypt is incomplete or
+//     inconsistent, or a key provider it refers to cannot be used
+//   - ErrKeyMaterial: a key, certificate or password could not be parsed or
+//     does not fit the encrypted data
+//   - ErrProtocol: the annotations or the wrapped keys of a layer are
+//     malformed or use an unsupported scheme or cipher
+//   - ErrIntegrity: the encrypted data failed its integrity check
+//
+// The more specific errors, such as ErrWrongPassword, are part of one of
+// these categories, so errors.Is(err, ErrKeyMaterial) also holds for an
+// error wrapping ErrWrongPassword.
+package errdefs
+
+import (
+	"errors"
+)
+
+// The error categories
+var (
+	// ErrConfiguration is the category of configuration errors
+	ErrConfiguration = errors.New("configuration error")
+	// ErrKeyMaterial is the category of errors related to keys, certificates
+	// and passwords
+	ErrKeyMaterial = errors.New("key material error")
+	// ErrProtocol is the category of errors related to the format of the
+	// encryption metadata
+	ErrProtocol = errors.New("protocol error")
+	// ErrIntegrity is the category of integrity errors
+	ErrIntegrity = errors.New("integrity error")
+)
+
+var (
+	// ErrNoDecryptionKey is returned when none of the provided keys could be
+	// used to unwrap a layer key or no key was provided at all
+	ErrNoDecryptionKey error = &categorizedError{"no suitable decryption key", ErrKeyMaterial}
+	// ErrWrongPassword is returned when the password for an encrypted private
+	// key is missing or wrong
+	ErrWrongPassword error = &categorizedError{"missing or wrong password", ErrKeyMaterial}
+	// ErrUnsupportedCipher is returned when a layer uses a cipher type that
+	// is not supported
+	ErrUnsupportedCipher error = &categorizedError{"unsupported cipher", ErrProtocol}
+	// ErrProviderUnreachable is returned when the provider of a key, such as
+	// a pkcs11 module or the gpg binary, could not be used
+	ErrProviderUnreachable error = &categorizedError{"key provider unreachable", ErrConfiguration}
+	// ErrDisallowedAlgorithm is returned when a layer uses a legacy algorithm
+	// that the security policy does not allow
+	ErrDisallowedAlgorithm error = &categorizedError{"algorithm not allowed by security policy", ErrProtocol}
+	// ErrWeakKey is returned when a key is weaker than the security policy
+	// requires
+	ErrWeakKey error = &categorizedError{"key too weak for security policy", ErrKeyMaterial}
+	// ErrThrottled is returned when unwrapping with a key is refused after
+	// repeated failed attempts
+	ErrThrottled error = &categorizedError{"too many failed attempts", ErrConfiguration}
+	// ErrLimitExceeded is returned when processing a layer would exceed a
+	// configured limit
+	ErrLimitExceeded error = &categorizedError{"limit exceeded", ErrProtocol}
+	// ErrVerificationFailed is returned when an image fails the verification
+	// of its signature before its layers are decrypted
+	ErrVerificationFailed error = &categorizedError{"image verification failed", ErrIntegrity}
+	// ErrNotAuthorized is returned when the authorization hook denies
+	// unwrapping the key of a layer
+	ErrNotAuthorized error = &categorizedError{"not authorized", ErrConfiguration}
+	// ErrUnsupportedKey is returned when a keywrap scheme cannot use the type
+	// of a key, such as an Ed25519 key for encryption
+	ErrUnsupportedKey error = &categorizedError{"unsupported key type", ErrKeyMaterial}
+	// ErrUntrustedCertificate is returned when the certificate of a recipient
+	// is expired, not issued by a trusted CA or not meant for encryption
+	ErrUntrustedCertificate error = &categorizedError{"untrusted certificate", ErrKeyMaterial}
+)
+
+// categorizedError is an error that belongs to a category
+type categorizedError struct {
+	msg      string
+	category error
+}
+
+func (e *categorizedError) Error() string {
+	return e.msg
+}
+
+func (e *categorizedError) Unwrap() error {
+	return e.category
+}
+
+// withCategory wraps an error and adds a category to it
+type withCategory struct {
+	err      error
+	category error
+}
+
+// WithCategory returns an error that wraps err and additionally belongs to the
+// given category, so that errors.Is(err, category) holds while the chain of err
+// is preserved. A nil err returns nil.
+func WithCategory(category, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &withCategory{
+		err:      err,
+		category: category,
+	}
+}
+
+func (e *withCategory) Error() string {
+	return e.err.Error()
+}
+
+func (e *withCategory) Unwrap() error {
+	return e.err
+}
+
+func (e *withCategory) Is(target error) bool {
+	// a specific error such as ErrProviderUnreachable also matches its category
+	return errors.Is(e.category, target)
+}
@@ -0,0 +1,59 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package errdefs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestCategories(t *testing.T) {
+	err := fmt.Errorf("could not decrypt key: %w", ErrWrongPassword)
+	if !errors.Is(err, ErrWrongPassword) || !errors.Is(err, ErrKeyMaterial) {
+		t.Fatal("Expected error to be ErrWrongPassword and ErrKeyMaterial")
+	}
+	if errors.Is(err, ErrProtocol) {
+		t.Fatal("Error must not be ErrProtocol")
+	}
+	if err.Error() != "could not decrypt key: missing or wrong password" {
+		t.Fatalf("Unexpected error message '%s'", err)
+	}
+}
+
+func TestWithCategory(t *testing.T) {
+	if WithCategory(ErrProtocol, nil) != nil {
+		t.Fatal("Expected nil error")
+	}
+
+	err := WithCategory(ErrProtocol, fmt.Errorf("could not read: %w", io.ErrUnexpectedEOF))
+	if !errors.Is(err, ErrProtocol) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatal("Expected error to be ErrProtocol and io.ErrUnexpectedEOF")
+	}
+	if errors.Is(err, ErrIntegrity) {
+		t.Fatal("Error must not be ErrIntegrity")
+	}
+	if err.Error() != "could not read: unexpected EOF" {
+		t.Fatalf("Unexpected error message '%s'", err)
+	}
+
+	err = WithCategory(ErrProviderUnreachable, io.ErrUnexpectedEOF)
+	if !errors.Is(err, ErrProviderUnreachable) || !errors.Is(err, ErrConfiguration) {
+		t.Fatal("Expected error to be ErrProviderUnreachable and ErrConfiguration")
+	}
+}
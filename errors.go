@@ -0,0 +1,244 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ocicrypt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/opencontainers/go-digest"
+)
+
+// The errors below are the ones defined in the errdefs package; they are
+// available here for convenience so callers can use errors.Is on them.
+// See the errdefs package for a description of the error categories.
+var (
+	ErrConfiguration = errdefs.ErrConfiguration
+	ErrKeyMaterial   = errdefs.ErrKeyMaterial
+	ErrProtocol      = errdefs.ErrProtocol
+	ErrIntegrity     = errdefs.ErrIntegrity
+
+	ErrNoDecryptionKey     = errdefs.ErrNoDecryptionKey
+	ErrWrongPassword       = errdefs.ErrWrongPassword
+	ErrUnsupportedCipher   = errdefs.ErrUnsupportedCipher
+	ErrProviderUnreachable = errdefs.ErrProviderUnreachable
+	ErrDisallowedAlgorithm = errdefs.ErrDisallowedAlgorithm
+	ErrWeakKey             = errdefs.ErrWeakKey
+	ErrThrottled           = errdefs.ErrThrottled
+	ErrLimitExceeded       = errdefs.ErrLimitExceeded
+	ErrVerificationFailed  = errdefs.ErrVerificationFailed
+	ErrNotAuthorized       = errdefs.ErrNotAuthorized
+	ErrUnsupportedKey      = errdefs.ErrUnsupportedKey
+)
+
+// LayerError is returned by EncryptLayer and DecryptLayer and the readers and
+// finalizers they return; it tells which layer and which keywrap scheme an
+// error occurred with
+type LayerError struct {
+	// Digest is the digest of the layer; it is empty if the descriptor of the
+	// layer did not have one
+	Digest digest.Digest
+	// Scheme is the keywrap scheme, such as jwe or pgp; it is empty if the
+	// error does not stem from a specific keywrap scheme
+	Scheme string
+	// Err is the error that occurred
+	Err error
+}
+
+func (e *LayerError) Error() string {
+	msg := ""
+	if e.Digest != "" {
+		msg = "layer " + e.Digest.String() + ": "
+	}
+	if e.Scheme != "" {
+		msg += e.Scheme + ": "
+	}
+	return msg + e.Err.Error()
+}
+
+// Unwrap returns the wrapped error
+func (e *LayerError) Unwrap() error {
+	return e.Err
+}
+
+// newLayerError annotates err with the digest of the layer and the keywrap
+// scheme unless it already is a LayerError
+func newLayerError(d digest.Digest, scheme string, err error) error {
+	var le *LayerError
+	if err == nil || (d == "" && scheme == "") || errors.As(err, &le) {
+		return err
+	}
+	return &LayerError{
+		Digest: d,
+		Scheme: scheme,
+		Err:    err,
+	}
+}
+
+// WrapError is returned by the finalizer of EncryptLayer if keywrappers failed
+// to wrap the layer key in the BestEffort or CollectErrors mode of the
+// EncryptConfig; it holds the errors of all the keywrappers that failed
+type WrapError struct {
+	// Digest is the digest of the layer
+	Digest digest.Digest
+	// Errs holds a LayerError for every keywrap scheme that failed
+	Errs []*LayerError
+	// Wrapped is the number of recipients the layer key was wrapped for
+	Wrapped int
+}
+
+func (e *WrapError) Error() string {
+	msg := ""
+	if e.Digest != "" {
+		msg = "layer " + e.Digest.String() + ": "
+	}
+	msg += fmt.Sprintf("%d keywrap schemes failed to wrap the layer key", len(e.Errs))
+	for _, err := range e.Errs {
+		msg += "\n" + err.Scheme + ": " + err.Err.Error()
+	}
+	return msg
+}
+
+// Is returns true if the error of any of the failed keywrap schemes matches
+// the target
+func (e *WrapError) Is(target error) bool {
+	for _, err := range e.Errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error of the failed keywrap schemes that matches the
+// target
+func (e *WrapError) As(target interface{}) bool {
+	for _, err := range e.Errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyUnwrapError tells why a keywrap scheme could not unwrap the layer key
+// from one of the wrapped keys of a layer
+type KeyUnwrapError struct {
+	// Scheme is the keywrap scheme, such as jwe or pgp
+	Scheme string
+	// Index is the position of the wrapped key among the comma separated
+	// wrapped keys of the scheme; it is -1 if the scheme failed before trying
+	// a wrapped key, for example because it was throttled
+	Index int
+	// Recipients are the recipients of the wrapped key if the keywrapper can
+	// tell them
+	Recipients []string
+	// Err is the error that occurred
+	Err error
+}
+
+func (e *KeyUnwrapError) Error() string {
+	msg := e.Scheme + ": "
+	if e.Index >= 0 {
+		msg += fmt.Sprintf("wrapped key %d", e.Index)
+		if len(e.Recipients) > 0 {
+			msg += " (" + strings.Join(e.Recipients, ", ") + ")"
+		}
+		msg += ": "
+	}
+	return msg + e.Err.Error()
+}
+
+// Unwrap returns the wrapped error
+func (e *KeyUnwrapError) Unwrap() error {
+	return e.Err
+}
+
+// keyUnwrapErrors holds the errors of a keywrapper that could not unwrap the
+// layer key from any of its wrapped keys
+type keyUnwrapErrors []*KeyUnwrapError
+
+func (e keyUnwrapErrors) Error() string {
+	msg := "no suitable key found for decrypting layer key:"
+	for _, err := range e {
+		msg += fmt.Sprintf("\n- wrapped key %d: %s", err.Index, err.Err)
+	}
+	return msg
+}
+
+// Is returns true for ErrNoDecryptionKey and if the error of any of the
+// wrapped keys matches the target
+func (e keyUnwrapErrors) Is(target error) bool {
+	if target == errdefs.ErrNoDecryptionKey {
+		return true
+	}
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnwrapError is returned by DecryptLayer if none of the keywrappers could
+// unwrap the layer key; it holds why every wrapped key that was tried could
+// not be unwrapped
+type UnwrapError struct {
+	// Digest is the digest of the layer
+	Digest digest.Digest
+	// Errs holds a KeyUnwrapError for every wrapped key, or keywrap scheme,
+	// that failed
+	Errs []*KeyUnwrapError
+}
+
+func (e *UnwrapError) Error() string {
+	msg := ""
+	if e.Digest != "" {
+		msg = "layer " + e.Digest.String() + ": "
+	}
+	msg += "no suitable key unwrapper found or none of the private keys could be used for decryption"
+	for _, err := range e.Errs {
+		msg += "\n" + err.Error()
+	}
+	return msg
+}
+
+// Is returns true for ErrNoDecryptionKey and if the error of any of the
+// failed wrapped keys matches the target
+func (e *UnwrapError) Is(target error) bool {
+	if target == errdefs.ErrNoDecryptionKey {
+		return true
+	}
+	for _, err := range e.Errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error of the failed wrapped keys that matches the target
+func (e *UnwrapError) As(target interface{}) bool {
+	for _, err := range e.Errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package fips tells whether ocicrypt runs with a FIPS 140 validated
+// cryptographic module, either the Go Cryptographic Module enabled with
+// GODEBUG=fips140=on or BoringCrypto built with GOEXPERIMENT=boringcrypto.
+// The keywrappers use it to choose approved algorithms and to refuse
+// algorithms that are unavailable in strict mode rather than panicking.
+package fips
+
+// Enabled returns true if the cryptographic module operates in FIPS 140 mode
+func Enabled() bool {
+	return moduleEnabled() || boringEnabled()
+}
+
+// Enforced returns true if only FIPS 140 approved algorithms may be used, as
+// with GODEBUG=fips140=only; using others fails or panics
+func Enforced() bool {
+	return moduleEnforced()
+}
@@ -0,0 +1,40 @@
+//go:build go1.24 && !go1.26
+// +build go1.24,!go1.26
+
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fips
+
+import (
+	"crypto/fips140"
+	"os"
+	"strings"
+)
+
+func moduleEnabled() bool {
+	return fips140.Enabled()
+}
+
+// moduleEnforced checks GODEBUG since crypto/fips140 cannot tell before Go 1.26
+func moduleEnforced() bool {
+	for _, setting := range strings.Split(os.Getenv("GODEBUG"), ",") {
+		if setting == "fips140=only" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fips
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEnforced(t *testing.T) {
+	only := strings.Contains(os.Getenv("GODEBUG"), "fips140=only")
+	if Enforced() != only {
+		t.Fatalf("Expected Enforced() to be %v with GODEBUG=%q", only, os.Getenv("GODEBUG"))
+	}
+	if Enforced() && !Enabled() {
+		t.Fatal("Expected FIPS mode to be enabled when it is enforced")
+	}
+}
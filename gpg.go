@@ -17,6 +17,9 @@
 package ocicrypt
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -24,9 +27,13 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/keywrap"
+	"github.com/containers/ocicrypt/log"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
-	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
@@ -42,7 +49,10 @@ const (
 	GPGVersionUndetermined
 )
 
-// GPGClient defines an interface for wrapping the gpg command line tools
+// GPGClient defines an interface for wrapping the gpg command line tools. The
+// GPGClients returned by NewGPGClient also implement config.GPGDecrypter,
+// which decrypts with keys that gpg cannot export, such as keys on OpenPGP
+// smartcards.
 type GPGClient interface {
 	// ReadGPGPubRingFile gets the byte sequence of the gpg public keyring
 	ReadGPGPubRingFile() ([]byte, error)
@@ -56,14 +66,29 @@ type GPGClient interface {
 	ResolveRecipients([]string) []string
 }
 
+var (
+	_ config.GPGDecrypter = &gpgv1Client{}
+	_ config.GPGDecrypter = &gpgv2Client{}
+)
+
+// DefaultGPGTimeout is the time after which an invocation of gpg, for example
+// one waiting on a hung pinentry or gpg-agent, is killed
+const DefaultGPGTimeout = 2 * time.Minute
+
 // gpgClient contains generic gpg client information
 type gpgClient struct {
 	gpgHomeDir string
+	// ctx cancels running gpg invocations
+	ctx context.Context
+	// timeout limits the time of every gpg invocation unless it is 0
+	timeout time.Duration
 }
 
 // gpgv2Client is a gpg2 client
 type gpgv2Client struct {
 	gpgClient
+	// binary is gpg2 or, where GnuPG 2 is installed as gpg, gpg
+	binary string
 }
 
 // gpgv1Client is a gpg client
@@ -74,18 +99,45 @@ type gpgv1Client struct {
 // GuessGPGVersion guesses the version of gpg. Defaults to gpg2 if exists, if
 // not defaults to regular gpg.
 func GuessGPGVersion() GPGVersion {
-	if err := exec.Command("gpg2", "--version").Run(); err == nil {
+	return guessGPGVersion(context.Background(), DefaultGPGTimeout)
+}
+
+func guessGPGVersion(ctx context.Context, timeout time.Duration) GPGVersion {
+	gc := &gpgClient{ctx: ctx, timeout: timeout}
+	if _, err := gc.runGPGGetOutput(exec.Command("gpg2", "--version")); err == nil {
 		return GPGv2
-	} else if err := exec.Command("gpg", "--version").Run(); err == nil {
+	} else if version, err := gc.runGPGGetOutput(exec.Command("gpg", "--version")); err == nil {
+		// current distributions install GnuPG 2 as gpg
+		if gnupg2Pattern.Match(version) {
+			return GPGv2
+		}
 		return GPGv1
 	} else {
 		return GPGVersionUndetermined
 	}
 }
 
+var gnupg2Pattern = regexp.MustCompile(`^gpg \(GnuPG[^)]*\) 2\.`)
+
+// gpg2Binary returns gpg2 if it is installed and gpg otherwise
+func gpg2Binary() string {
+	if _, err := exec.LookPath("gpg2"); err != nil {
+		return "gpg"
+	}
+	return "gpg2"
+}
+
 // NewGPGClient creates a new GPGClient object representing the given version
-// and using the given home directory
+// and using the given home directory. Invocations of gpg are killed after
+// DefaultGPGTimeout.
 func NewGPGClient(gpgVersion, gpgHomeDir string) (GPGClient, error) {
+	return NewGPGClientWithContext(context.Background(), gpgVersion, gpgHomeDir, DefaultGPGTimeout)
+}
+
+// NewGPGClientWithContext creates a new GPGClient object like NewGPGClient
+// whose invocations of gpg are killed when ctx is done or after the given
+// timeout; a timeout of 0 disables it
+func NewGPGClientWithContext(ctx context.Context, gpgVersion, gpgHomeDir string, timeout time.Duration) (GPGClient, error) {
 	v := new(GPGVersion)
 	switch gpgVersion {
 	case "v1":
@@ -95,28 +147,29 @@ func NewGPGClient(gpgVersion, gpgHomeDir string) (GPGClient, error) {
 	default:
 		v = nil
 	}
-	return newGPGClient(v, gpgHomeDir)
+	return newGPGClient(ctx, v, gpgHomeDir, timeout)
 }
 
-func newGPGClient(version *GPGVersion, homedir string) (GPGClient, error) {
+func newGPGClient(ctx context.Context, version *GPGVersion, homedir string, timeout time.Duration) (GPGClient, error) {
 	var gpgVersion GPGVersion
 	if version != nil {
 		gpgVersion = *version
 	} else {
-		gpgVersion = GuessGPGVersion()
+		gpgVersion = guessGPGVersion(ctx, timeout)
 	}
 
 	switch gpgVersion {
 	case GPGv1:
 		return &gpgv1Client{
-			gpgClient: gpgClient{gpgHomeDir: homedir},
+			gpgClient: gpgClient{gpgHomeDir: homedir, ctx: ctx, timeout: timeout},
 		}, nil
 	case GPGv2:
 		return &gpgv2Client{
-			gpgClient: gpgClient{gpgHomeDir: homedir},
+			gpgClient: gpgClient{gpgHomeDir: homedir, ctx: ctx, timeout: timeout},
+			binary:    gpg2Binary(),
 		}, nil
 	case GPGVersionUndetermined:
-		return nil, fmt.Errorf("unable to determine GPG version")
+		return nil, fmt.Errorf("unable to determine GPG version: %w", errdefs.ErrProviderUnreachable)
 	default:
 		return nil, fmt.Errorf("unhandled case: NewGPGClient")
 	}
@@ -132,7 +185,7 @@ func (gc *gpgv2Client) GetGPGPrivateKey(keyid uint64, passphrase string) ([]byte
 
 	rfile, wfile, err := os.Pipe()
 	if err != nil {
-		return nil, errors.Wrapf(err, "could not create pipe")
+		return nil, fmt.Errorf("could not create pipe: %w", err)
 	}
 	defer func() {
 		rfile.Close()
@@ -146,10 +199,10 @@ func (gc *gpgv2Client) GetGPGPrivateKey(keyid uint64, passphrase string) ([]byte
 
 	args = append(args, []string{"--pinentry-mode", "loopback", "--batch", "--passphrase-fd", fmt.Sprintf("%d", 3), "--export-secret-key", fmt.Sprintf("0x%x", keyid)}...)
 
-	cmd := exec.Command("gpg2", args...)
+	cmd := exec.Command(gc.binary, args...)
 	cmd.ExtraFiles = []*os.File{rfile}
 
-	return runGPGGetOutput(cmd)
+	return gc.runGPGGetOutput(cmd)
 }
 
 // ReadGPGPubRingFile reads the GPG public key ring file
@@ -161,9 +214,9 @@ func (gc *gpgv2Client) ReadGPGPubRingFile() ([]byte, error) {
 	}
 	args = append(args, []string{"--batch", "--export"}...)
 
-	cmd := exec.Command("gpg2", args...)
+	cmd := exec.Command(gc.binary, args...)
 
-	return runGPGGetOutput(cmd)
+	return gc.runGPGGetOutput(cmd)
 }
 
 func (gc *gpgv2Client) getKeyDetails(option string, keyid uint64) ([]byte, bool, error) {
@@ -174,9 +227,9 @@ func (gc *gpgv2Client) getKeyDetails(option string, keyid uint64) ([]byte, bool,
 	}
 	args = append(args, option, fmt.Sprintf("0x%x", keyid))
 
-	cmd := exec.Command("gpg2", args...)
+	cmd := exec.Command(gc.binary, args...)
 
-	keydata, err := runGPGGetOutput(cmd)
+	keydata, err := gc.runGPGGetOutput(cmd)
 	return keydata, err == nil, err
 }
 
@@ -197,6 +250,11 @@ func (gc *gpgv2Client) ResolveRecipients(recipients []string) []string {
 	return resolveRecipients(gc, recipients)
 }
 
+// DecryptGPGMessage decrypts the OpenPGP message with gpg-agent
+func (gc *gpgv2Client) DecryptGPGMessage(message []byte) ([]byte, uint64, error) {
+	return gc.decryptGPGMessage(gc.binary, message)
+}
+
 // GetGPGPrivateKey gets the bytes of a specified keyid, supplying a passphrase
 func (gc *gpgv1Client) GetGPGPrivateKey(keyid uint64, _ string) ([]byte, error) {
 	var args []string
@@ -208,7 +266,7 @@ func (gc *gpgv1Client) GetGPGPrivateKey(keyid uint64, _ string) ([]byte, error)
 
 	cmd := exec.Command("gpg", args...)
 
-	return runGPGGetOutput(cmd)
+	return gc.runGPGGetOutput(cmd)
 }
 
 // ReadGPGPubRingFile reads the GPG public key ring file
@@ -222,7 +280,7 @@ func (gc *gpgv1Client) ReadGPGPubRingFile() ([]byte, error) {
 
 	cmd := exec.Command("gpg", args...)
 
-	return runGPGGetOutput(cmd)
+	return gc.runGPGGetOutput(cmd)
 }
 
 func (gc *gpgv1Client) getKeyDetails(option string, keyid uint64) ([]byte, bool, error) {
@@ -235,7 +293,7 @@ func (gc *gpgv1Client) getKeyDetails(option string, keyid uint64) ([]byte, bool,
 
 	cmd := exec.Command("gpg", args...)
 
-	keydata, err := runGPGGetOutput(cmd)
+	keydata, err := gc.runGPGGetOutput(cmd)
 
 	return keydata, err == nil, err
 }
@@ -257,29 +315,177 @@ func (gc *gpgv1Client) ResolveRecipients(recipients []string) []string {
 	return resolveRecipients(gc, recipients)
 }
 
+// DecryptGPGMessage decrypts the OpenPGP message with gpg-agent
+func (gc *gpgv1Client) DecryptGPGMessage(message []byte) ([]byte, uint64, error) {
+	return gc.decryptGPGMessage("gpg", message)
+}
+
+// decryptGPGMessage runs gpg to decrypt the message and gets the ID of the key
+// that decrypted it from the status output of gpg
+func (gc *gpgClient) decryptGPGMessage(gpgBinary string, message []byte) ([]byte, uint64, error) {
+	var args []string
+
+	if gc.gpgHomeDir != "" {
+		args = append(args, []string{"--homedir", gc.gpgHomeDir}...)
+	}
+
+	rfile, wfile, err := os.Pipe()
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not create pipe: %w", err)
+	}
+	// read the status output in background; pinentry or scdaemon may keep
+	// the pipe open after gpg was killed
+	status := make(chan []byte, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(rfile)
+		rfile.Close()
+		status <- data
+	}()
+	ctx, cancel := gc.context()
+	defer cancel()
+
+	args = append(args, []string{"--batch", "--status-fd", fmt.Sprintf("%d", 3), "--max-output", fmt.Sprintf("%d", keywrap.MaxOptsDataSize+1), "--decrypt"}...)
+
+	cmd := exec.Command(gpgBinary, args...)
+	cmd.Stdin = bytes.NewReader(message)
+	cmd.ExtraFiles = []*os.File{wfile}
+
+	plaintext, err := gc.runGPGGetOutputContext(ctx, cmd)
+	wfile.Close()
+	if err != nil {
+		rfile.Close()
+		if !errors.Is(err, errdefs.ErrProviderUnreachable) {
+			err = errdefs.WithCategory(errdefs.ErrNoDecryptionKey, err)
+		}
+		return nil, 0, err
+	}
+	var statusData []byte
+	select {
+	case statusData = <-status:
+	case <-ctx.Done():
+		rfile.Close()
+		<-status
+		return nil, 0, errdefs.WithCategory(errdefs.ErrProviderUnreachable, fmt.Errorf("the status output of %s did not end: %w", gpgBinary, ctx.Err()))
+	}
+	keyid, err := decryptionKeyID(statusData)
+	if err != nil {
+		return nil, 0, err
+	}
+	return plaintext, keyid, nil
+}
+
+// decryptionKeyID gets the ID of the key that decrypted a message from the
+// status output of gpg; it is the end of the fingerprint in the
+// DECRYPTION_KEY line or, for older versions of gpg, the key ID of the only
+// ENC_TO line
+func decryptionKeyID(status []byte) (uint64, error) {
+	var encTo []string
+	for _, line := range strings.Split(string(status), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "[GNUPG:]" {
+			continue
+		}
+		switch fields[1] {
+		case "DECRYPTION_KEY":
+			if fpr := fields[2]; len(fpr) >= 16 {
+				return strconv.ParseUint(fpr[len(fpr)-16:], 16, 64)
+			}
+		case "ENC_TO":
+			encTo = append(encTo, fields[2])
+		}
+	}
+	if len(encTo) == 1 {
+		return strconv.ParseUint(encTo[0], 16, 64)
+	}
+	return 0, fmt.Errorf("could not determine the key that decrypted the message")
+}
+
 // runGPGGetOutput runs the GPG commandline and returns stdout as byte array
-// and any stderr in the error
-func runGPGGetOutput(cmd *exec.Cmd) ([]byte, error) {
-	stdout, err := cmd.StdoutPipe()
+// and any stderr in the error. The command is killed if it does not finish
+// before the context of the client is done or the timeout expires.
+func (gc *gpgClient) runGPGGetOutput(cmd *exec.Cmd) ([]byte, error) {
+	ctx, cancel := gc.context()
+	defer cancel()
+	return gc.runGPGGetOutputContext(ctx, cmd)
+}
+
+// context returns the context of an invocation of gpg, which is done when the
+// context of the client is done or the timeout expires
+func (gc *gpgClient) context() (context.Context, context.CancelFunc) {
+	ctx := gc.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if gc.timeout > 0 {
+		return context.WithTimeout(ctx, gc.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// runGPGGetOutputContext runs the GPG commandline like runGPGGetOutput and
+// kills it when ctx is done
+func (gc *gpgClient) runGPGGetOutputContext(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+
+	// the output is read from pipes of our own rather than those of
+	// exec.Cmd, whose Wait also waits for the processes, such as pinentry,
+	// that inherited them
+	stdout, stdoutW, err := os.Pipe()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("could not create pipe: %w", err)
 	}
-	stderr, err := cmd.StderrPipe()
+	defer stdout.Close()
+	stderr, stderrW, err := os.Pipe()
 	if err != nil {
-		return nil, err
+		stdoutW.Close()
+		return nil, fmt.Errorf("could not create pipe: %w", err)
 	}
-	if err := cmd.Start(); err != nil {
+	defer stderr.Close()
+	cmd.Stdout, cmd.Stderr = stdoutW, stderrW
+	err = cmd.Start()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
 		return nil, err
 	}
 
-	stdoutstr, err2 := ioutil.ReadAll(stdout)
-	stderrstr, _ := ioutil.ReadAll(stderr)
-
-	if err := cmd.Wait(); err != nil {
-		return nil, fmt.Errorf("error from %s: %s", cmd.Path, string(stderrstr))
+	type result struct {
+		stdout  []byte
+		stderr  []byte
+		err     error
+		waitErr error
 	}
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		stderrRead := make(chan struct{})
+		go func() {
+			res.stderr, _ = ioutil.ReadAll(stderr)
+			close(stderrRead)
+		}()
+		res.stdout, res.err = ioutil.ReadAll(stdout)
+		<-stderrRead
+		res.waitErr = cmd.Wait()
+		done <- res
+	}()
 
-	return stdoutstr, err2
+	select {
+	case res := <-done:
+		if res.waitErr != nil {
+			log.L().Debug("gpg invocation failed", log.KeyProvider, cmd.Path, log.KeyError, res.waitErr)
+			return nil, fmt.Errorf("error from %s: %s", cmd.Path, string(res.stderr))
+		}
+		return res.stdout, res.err
+	case <-ctx.Done():
+		// processes that inherited the pipes, such as pinentry, may keep
+		// them open; closing them ends the reads so that the killed process
+		// is waited for
+		_ = cmd.Process.Kill()
+		stdout.Close()
+		stderr.Close()
+		<-done
+		log.L().Info("killed hung gpg invocation", log.KeyProvider, cmd.Path, log.KeyError, ctx.Err())
+		return nil, errdefs.WithCategory(errdefs.ErrProviderUnreachable, fmt.Errorf("%s did not finish: %w", cmd.Path, ctx.Err()))
+	}
 }
 
 // resolveRecipients walks the list of recipients and attempts to convert
@@ -320,6 +526,14 @@ func extractEmailFromDetails(details []byte) string {
 	return string(emailPattern.Expand(nil, []byte("$email"), details, loc))
 }
 
+// isCardKey returns true if the details of a secret key show that it is held
+// by an OpenPGP smartcard, which gpg marks with '>' after 'sec' or 'ssb'
+func isCardKey(details []byte) bool {
+	return cardKeyPattern.Match(details)
+}
+
+var cardKeyPattern = regexp.MustCompile(`(?m)^(sec|ssb)>`)
+
 // uint64ToStringArray converts an array of uint64's to an array of strings
 // by applying a format string to each uint64
 func uint64ToStringArray(format string, in []uint64) []string {
@@ -336,6 +550,8 @@ func uint64ToStringArray(format string, in []uint64) []string {
 // in the GPGVault or on this system and prompts for the passwords for those
 // that are available. If we do not find a private key on the system for
 // getting to the symmetric key of a layer then an error is generated.
+// Keys on OpenPGP smartcards are found but not returned; they are used by
+// passing the gpgClient to config.DecryptWithGPGDecrypter.
 func GPGGetPrivateKey(descs []ocispec.Descriptor, gpgClient GPGClient, gpgVault GPGVault, mustFindKey bool) (gpgPrivKeys [][]byte, gpgPrivKeysPwds [][]byte, err error) {
 	// PrivateKeyData describes a private key
 	type PrivateKeyData struct {
@@ -352,7 +568,7 @@ func GPGGetPrivateKey(descs []ocispec.Descriptor, gpgClient GPGClient, gpgVault
 			}
 			keywrapper := GetKeyWrapper(scheme)
 			if keywrapper == nil {
-				return nil, nil, errors.Errorf("could not get KeyWrapper for %s\n", scheme)
+				return nil, nil, fmt.Errorf("could not get KeyWrapper for %s\n", scheme)
 			}
 			keyIds, err := keywrapper.GetKeyIdsFromPacket(b64pgpPackets)
 			if err != nil {
@@ -382,6 +598,17 @@ func GPGGetPrivateKey(descs []ocispec.Descriptor, gpgClient GPGClient, gpgVault
 						continue
 					}
 
+					if isCardKey(keyinfo) {
+						// the key cannot be exported; the GPGClient
+						// has to decrypt with it as a
+						// config.GPGDecrypter
+						if _, ok := gpgClient.(config.GPGDecrypter); ok {
+							found = true
+							break
+						}
+						continue
+					}
+
 					_, found = keyIDPasswordMap[keyid]
 					if !found {
 						fmt.Printf("Passphrase required for Key id 0x%x: \n%v", keyid, string(keyinfo))
@@ -411,7 +638,7 @@ func GPGGetPrivateKey(descs []ocispec.Descriptor, gpgClient GPGClient, gpgVault
 			if !found && len(b64pgpPackets) > 0 && mustFindKey {
 				ids := uint64ToStringArray("0x%x", keyIds)
 
-				return nil, nil, errors.Errorf("missing key for decryption of layer %x of %s. Need one of the following keys: %s", desc.Digest, desc.Platform, strings.Join(ids, ", "))
+				return nil, nil, fmt.Errorf("missing key for decryption of layer %x of %s. Need one of the following keys: %s", desc.Digest, desc.Platform, strings.Join(ids, ", "))
 			}
 		}
 	}
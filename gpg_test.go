@@ -0,0 +1,182 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ocicrypt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+func TestRunGPGGetOutputTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	gc := &gpgClient{timeout: 100 * time.Millisecond}
+	start := time.Now()
+	// the child of the shell keeps the pipes open like a pinentry would
+	cmd := exec.Command("sh", "-c", "sleep 60; true")
+	_, err := gc.runGPGGetOutput(cmd)
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, errdefs.ErrProviderUnreachable) {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+	if time.Since(start) > 30*time.Second {
+		t.Fatal("Hung command was not killed")
+	}
+	if cmd.ProcessState == nil {
+		t.Fatal("Killed command was not waited for")
+	}
+}
+
+func TestRunGPGGetOutputCancel(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep is not available")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	gc := &gpgClient{ctx: ctx}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := gc.runGPGGetOutput(exec.Command("sleep", "60")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the command to be canceled, got %v", err)
+	}
+}
+
+func TestRunGPGGetOutput(t *testing.T) {
+	if _, err := exec.LookPath("echo"); err != nil {
+		t.Skip("echo is not available")
+	}
+
+	gc := &gpgClient{timeout: DefaultGPGTimeout}
+	out, err := gc.runGPGGetOutput(exec.Command("echo", "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "hello\n" {
+		t.Fatalf("Unexpected output %q", out)
+	}
+}
+
+func TestDecryptGPGMessage(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not available")
+	}
+
+	homedir := t.TempDir()
+	gpg := func(stdin []byte, args ...string) []byte {
+		cmd := exec.Command("gpg", append([]string{"--homedir", homedir, "--batch"}, args...)...)
+		cmd.Stdin = bytes.NewReader(stdin)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Skipf("gpg %v failed: %v", args, err)
+		}
+		return out
+	}
+	defer func() {
+		_ = exec.Command("gpgconf", "--homedir", homedir, "--kill", "gpg-agent").Run()
+	}()
+	gpg(nil, "--passphrase", "", "--quick-gen-key", "test@example.com", "default", "default")
+	message := gpg([]byte("secret"), "--trust-model", "always", "-r", "test@example.com", "--encrypt")
+
+	gc := &gpgClient{gpgHomeDir: homedir, timeout: DefaultGPGTimeout}
+	plaintext, keyid, err := gc.decryptGPGMessage("gpg", message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "secret" {
+		t.Fatalf("Unexpected plaintext %q", plaintext)
+	}
+	if details, _, _ := (&gpgv1Client{gpgClient: *gc}).GetSecretKeyDetails(keyid); len(details) == 0 {
+		t.Fatalf("Key 0x%x that decrypted the message is unknown", keyid)
+	}
+
+	if _, _, err := gc.decryptGPGMessage("gpg", []byte("not a message")); !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+		t.Fatalf("Expected ErrNoDecryptionKey, got %v", err)
+	}
+}
+
+func TestDecryptGPGMessageStatusTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	// the child of the fake gpg keeps the status output open like a
+	// pinentry would
+	fakeGPG := filepath.Join(t.TempDir(), "gpg")
+	if err := ioutil.WriteFile(fakeGPG, []byte("#!/bin/sh\nsleep 60 >/dev/null 2>&1 </dev/null &\necho secret\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	gc := &gpgClient{timeout: 100 * time.Millisecond}
+	start := time.Now()
+	if _, _, err := gc.decryptGPGMessage(fakeGPG, []byte("message")); !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, errdefs.ErrProviderUnreachable) {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+	if time.Since(start) > 30*time.Second {
+		t.Fatal("Reading the status output did not time out")
+	}
+}
+
+func TestDecryptionKeyID(t *testing.T) {
+	for _, tc := range []struct {
+		status string
+		keyid  uint64
+		ok     bool
+	}{
+		{"[GNUPG:] ENC_TO 5107E634899018F6 1 0\n[GNUPG:] DECRYPTION_KEY 22415FC7C0C9D451CBE619925107E634899018F6 7FC494CC3F99FBECAC34D8EEACC53E5378AC98E5 u\n", 0x5107e634899018f6, true},
+		{"[GNUPG:] ENC_TO 5107E634899018F6 1 0\n[GNUPG:] DECRYPTION_OKAY\n", 0x5107e634899018f6, true},
+		{"[GNUPG:] ENC_TO 5107E634899018F6 1 0\n[GNUPG:] ENC_TO 1111111111111111 1 0\n", 0, false},
+		{"", 0, false},
+	} {
+		keyid, err := decryptionKeyID([]byte(tc.status))
+		if (err == nil) != tc.ok || keyid != tc.keyid {
+			t.Fatalf("Unexpected key ID 0x%x and error %v for %q", keyid, err, tc.status)
+		}
+	}
+}
+
+func TestIsCardKey(t *testing.T) {
+	card := []byte("sec>  rsa2048 2020-01-01 [SC]\n      Card serial no. = 0006 12345678\nuid           [ultimate] test@example.com\nssb>  rsa2048 2020-01-01 [E]\n")
+	if !isCardKey(card) {
+		t.Fatal("Card key was not recognized")
+	}
+	local := []byte("sec   rsa3072 2026-10-15 [SC]\nuid           [ultimate] test@example.com\nssb   rsa3072 2026-10-15 [E]\n")
+	if isCardKey(local) {
+		t.Fatal("Local key was taken for a card key")
+	}
+}
+
+func TestGnuPG2Pattern(t *testing.T) {
+	for version, isV2 := range map[string]bool{
+		"gpg (GnuPG) 2.2.40\nlibgcrypt 1.8.8\n": true,
+		"gpg (GnuPG/MacGPG2) 2.2.24\n":          true,
+		"gpg (GnuPG) 1.4.23\nCopyright (C) ...": false,
+	} {
+		if gnupg2Pattern.MatchString(version) != isV2 {
+			t.Fatalf("Unexpected match of %q", version)
+		}
+	}
+}
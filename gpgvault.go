@@ -17,12 +17,14 @@
 package ocicrypt
 
 import (
-	"bytes"
+	"fmt"
 	"io/ioutil"
+	"sync"
 
-	"github.com/pkg/errors"
-	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/packet"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/containers/ocicrypt/utils"
+	"github.com/containers/ocicrypt/utils/securemem"
 )
 
 // GPGVault defines an interface for wrapping multiple secret key rings
@@ -37,10 +39,21 @@ type GPGVault interface {
 	GetGPGPrivateKey(keyid uint64) ([]openpgp.Key, []byte)
 }
 
-// gpgVault wraps an array of gpgSecretKeyRing
+// SecureGPGVault is a GPGVault that holds the raw secret keyring data in
+// locked memory
+type SecureGPGVault interface {
+	GPGVault
+	// Destroy wipes and releases the locked memory holding the secret keyrings
+	Destroy()
+}
+
+// gpgVault wraps an array of gpgSecretKeyRing; it is safe for concurrent use
 type gpgVault struct {
+	lock        sync.RWMutex
 	entityLists []openpgp.EntityList
 	keyDataList [][]byte // the raw data original passed in
+	secure      bool
+	secrets     []*securemem.Buffer
 }
 
 // NewGPGVault creates an empty GPGVault
@@ -48,14 +61,34 @@ func NewGPGVault() GPGVault {
 	return &gpgVault{}
 }
 
+// NewSecureGPGVault creates an empty SecureGPGVault; the raw secret keyring
+// data passed to it is copied into locked memory and the original byte arrays
+// are wiped. Only the raw data is protected, the parsed keys are held on the
+// Go heap.
+func NewSecureGPGVault() SecureGPGVault {
+	return &gpgVault{
+		secure: true,
+	}
+}
+
 // AddSecretKeyRingData adds a secret keyring's to the gpgVault; the raw byte
 // array read from the file must be passed and will be parsed by this function
 func (g *gpgVault) AddSecretKeyRingData(gpgSecretKeyRingData []byte) error {
 	// read the private keys
-	r := bytes.NewReader(gpgSecretKeyRingData)
-	entityList, err := openpgp.ReadKeyRing(r)
+	entityList, err := utils.ReadGPGKeyRing(gpgSecretKeyRingData)
 	if err != nil {
-		return errors.Wrapf(err, "could not read keyring")
+		return fmt.Errorf("could not read keyring: %w", err)
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.secure {
+		b, err := securemem.NewFromBytes(gpgSecretKeyRingData)
+		if err != nil {
+			return err
+		}
+		g.secrets = append(g.secrets, b)
+		gpgSecretKeyRingData = b.Bytes()
 	}
 	g.entityLists = append(g.entityLists, entityList)
 	g.keyDataList = append(g.keyDataList, gpgSecretKeyRingData)
@@ -90,6 +123,8 @@ func (g *gpgVault) AddSecretKeyRingFiles(filenames []string) error {
 
 // GetGPGPrivateKey gets the bytes of a specified keyid, supplying a passphrase
 func (g *gpgVault) GetGPGPrivateKey(keyid uint64) ([]openpgp.Key, []byte) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
 	for i, el := range g.entityLists {
 		decKeys := el.KeysByIdUsage(keyid, packet.KeyFlagEncryptCommunications)
 		if len(decKeys) > 0 {
@@ -98,3 +133,16 @@ func (g *gpgVault) GetGPGPrivateKey(keyid uint64) ([]openpgp.Key, []byte) {
 	}
 	return nil, nil
 }
+
+// Destroy wipes and releases the locked memory holding the secret keyrings and
+// removes all keyrings from the gpgVault
+func (g *gpgVault) Destroy() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, b := range g.secrets {
+		_ = b.Destroy()
+	}
+	g.secrets = nil
+	g.entityLists = nil
+	g.keyDataList = nil
+}
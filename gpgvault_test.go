@@ -0,0 +1,75 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ocicrypt
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/containers/ocicrypt/utils"
+)
+
+func createSecretKeyRing(t *testing.T, email string) (*openpgp.Entity, []byte) {
+	entity, err := openpgp.NewEntity("testkey", "", email, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var privKeyRing bytes.Buffer
+	if err := entity.SerializePrivate(&privKeyRing, nil); err != nil {
+		t.Fatal(err)
+	}
+	return entity, privKeyRing.Bytes()
+}
+
+func TestGPGVaultConcurrent(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "OpenPGP")
+
+	var entities []*openpgp.Entity
+	var keyRings [][]byte
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com"} {
+		entity, keyRing := createSecretKeyRing(t, email)
+		entities = append(entities, entity)
+		keyRings = append(keyRings, keyRing)
+	}
+
+	gpgVault := NewGPGVault()
+	var wg sync.WaitGroup
+	for i := range entities {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			if err := gpgVault.AddSecretKeyRingData(keyRings[i]); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			// the key may or may not have been added yet
+			_, _ = gpgVault.GetGPGPrivateKey(entities[i].Subkeys[0].PublicKey.KeyId)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, entity := range entities {
+		keys, keyData := gpgVault.GetGPGPrivateKey(entity.Subkeys[0].PublicKey.KeyId)
+		if len(keys) == 0 || !bytes.Equal(keyData, keyRings[i]) {
+			t.Fatalf("key %d not found in GPGVault", i)
+		}
+	}
+}
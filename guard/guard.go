@@ -0,0 +1,187 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package guard defines the hook that is consulted before private keys are
+// used for unwrapping a layer key. It allows throttling repeated failed
+// attempts, which protects PIN-guarded tokens and passworded keys from being
+// locked out by runtimes retrying with a wrong PIN or password in a loop.
+package guard
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+// Guard is consulted before and informed after every attempt to unwrap a layer
+// key with the private keys of a keywrap scheme. The key passed to it
+// identifies the scheme and the private keys. Implementations must be safe for
+// concurrent use.
+type Guard interface {
+	// Allow returns an error wrapping errdefs.ErrThrottled if no attempt may
+	// be made with the key at this time
+	Allow(key string) error
+	// Done reports the outcome of an attempt with the key
+	Done(key string, err error)
+}
+
+type noopGuard struct{}
+
+func (noopGuard) Allow(string) error { return nil }
+func (noopGuard) Done(string, error) {}
+
+var (
+	guardLock sync.RWMutex
+	guard     Guard = noopGuard{}
+)
+
+// SetGuard sets the Guard consulted before unwrapping; passing nil restores the
+// default that allows all attempts
+func SetGuard(g Guard) {
+	guardLock.Lock()
+	defer guardLock.Unlock()
+
+	if g == nil {
+		g = noopGuard{}
+	}
+	guard = g
+}
+
+// G returns the Guard currently consulted before unwrapping
+func G() Guard {
+	guardLock.RLock()
+	defer guardLock.RUnlock()
+
+	return guard
+}
+
+// Backoff is a Guard that locks out a key after a number of consecutive failed
+// attempts; the lockout starts with Delay and doubles with every further
+// failure up to MaxDelay. A successful attempt resets the key.
+type Backoff struct {
+	// MaxFailures is the number of consecutive failures before a key is
+	// locked out
+	MaxFailures int
+	// Delay is the duration of the first lockout
+	Delay time.Duration
+	// MaxDelay caps the duration of a lockout; 0 means no cap
+	MaxDelay time.Duration
+	// IsFailure decides which errors count as failures; if nil, only errors
+	// wrapping errdefs.ErrWrongPassword count, since failing to unwrap with a
+	// key the layer was not encrypted for is expected
+	IsFailure func(err error) bool
+
+	lock sync.Mutex
+	keys map[string]*keyState
+	now  func() time.Time
+}
+
+type keyState struct {
+	failures int
+	until    time.Time
+}
+
+// NewBackoff creates a Backoff guard
+func NewBackoff(maxFailures int, delay, maxDelay time.Duration) *Backoff {
+	return &Backoff{
+		MaxFailures: maxFailures,
+		Delay:       delay,
+		MaxDelay:    maxDelay,
+	}
+}
+
+func (b *Backoff) getNow() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+	return time.Now()
+}
+
+// Allow returns an error wrapping errdefs.ErrThrottled while the key is locked
+// out
+func (b *Backoff) Allow(key string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ks, ok := b.keys[key]
+	if !ok {
+		return nil
+	}
+	if wait := ks.until.Sub(b.getNow()); wait > 0 {
+		return fmt.Errorf("%d consecutive failures, retry in %s: %w", ks.failures, wait.Round(time.Millisecond), errdefs.ErrThrottled)
+	}
+	return nil
+}
+
+// Done records the outcome of an attempt with the key
+func (b *Backoff) Done(key string, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err == nil {
+		delete(b.keys, key)
+		return
+	}
+	isFailure := b.IsFailure
+	if isFailure == nil {
+		isFailure = func(err error) bool {
+			return errors.Is(err, errdefs.ErrWrongPassword)
+		}
+	}
+	if !isFailure(err) {
+		return
+	}
+
+	if b.keys == nil {
+		b.keys = make(map[string]*keyState)
+	}
+	ks, ok := b.keys[key]
+	if !ok {
+		ks = &keyState{}
+		b.keys[key] = ks
+	}
+	ks.failures++
+	if ks.failures < b.MaxFailures {
+		return
+	}
+	ks.until = b.getNow().Add(b.delay(ks.failures - b.MaxFailures))
+}
+
+// delay returns the duration of the lockout after the given number of further
+// failures. It doubles at most until it reaches MaxDelay or, without a cap,
+// the longest time.Duration, so it neither overflows nor takes longer with
+// more failures.
+func (b *Backoff) delay(doublings int) time.Duration {
+	maxDelay := b.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = math.MaxInt64
+	}
+	delay := b.Delay
+	for i := 0; i < doublings && delay > 0 && delay < maxDelay; i++ {
+		if delay > maxDelay/2 {
+			return maxDelay
+		}
+		delay *= 2
+	}
+	if delay > maxDelay {
+		return maxDelay
+	}
+	return delay
+}
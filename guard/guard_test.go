@@ -0,0 +1,115 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package guard
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+func TestBackoff(t *testing.T) {
+	now := time.Now()
+	b := NewBackoff(2, time.Second, 3*time.Second)
+	b.now = func() time.Time { return now }
+
+	wrongPassword := fmt.Errorf("test: %w", errdefs.ErrWrongPassword)
+
+	// errors other than wrong passwords do not count
+	for i := 0; i < 5; i++ {
+		b.Done("key", errdefs.ErrNoDecryptionKey)
+	}
+	if err := b.Allow("key"); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Done("key", wrongPassword)
+	if err := b.Allow("key"); err != nil {
+		t.Fatal(err)
+	}
+	b.Done("key", wrongPassword)
+	if err := b.Allow("key"); !errors.Is(err, errdefs.ErrThrottled) {
+		t.Fatalf("Expected key to be throttled, got %v", err)
+	}
+	if err := b.Allow("other"); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Second)
+	if err := b.Allow("key"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lockout doubles up to the maximum
+	for _, delay := range []time.Duration{2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		b.Done("key", wrongPassword)
+		now = now.Add(delay - time.Millisecond)
+		if err := b.Allow("key"); !errors.Is(err, errdefs.ErrThrottled) {
+			t.Fatalf("Expected key to be throttled, got %v", err)
+		}
+		now = now.Add(time.Millisecond)
+		if err := b.Allow("key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// success resets the key
+	b.Done("key", nil)
+	b.Done("key", wrongPassword)
+	if err := b.Allow("key"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackoffManyFailures(t *testing.T) {
+	now := time.Now()
+	// without a cap the lockout saturates at the longest duration
+	b := NewBackoff(1, time.Second, 0)
+	b.now = func() time.Time { return now }
+
+	wrongPassword := fmt.Errorf("test: %w", errdefs.ErrWrongPassword)
+	for i := 0; i < 100000; i++ {
+		b.Done("key", wrongPassword)
+	}
+	if d := b.delay(100000); d != math.MaxInt64 {
+		t.Fatalf("Expected the longest lockout, got %s", d)
+	}
+	now = now.Add(100 * 365 * 24 * time.Hour)
+	if err := b.Allow("key"); !errors.Is(err, errdefs.ErrThrottled) {
+		t.Fatalf("Expected key to be throttled, got %v", err)
+	}
+
+	b = NewBackoff(1, time.Second, time.Hour)
+	for _, tc := range []struct {
+		doublings int
+		delay     time.Duration
+	}{
+		{0, time.Second},
+		{3, 8 * time.Second},
+		{12, time.Hour},
+		{63, time.Hour},
+		{math.MaxInt, time.Hour},
+	} {
+		if d := b.delay(tc.doublings); d != tc.delay {
+			t.Fatalf("Expected lockout of %s after %d doublings, got %s", tc.delay, tc.doublings, d)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package crio provides what CRI-O needs for pulling encrypted images: the
+// DecryptConfig assembled from the decryption settings of crio.conf, the
+// per-pull settings and the mapping of errors to CRI status codes.
+package crio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/helpers"
+	"github.com/containers/ocicrypt/limits"
+	"github.com/containers/ocicrypt/policy"
+	"github.com/containers/ocicrypt/verify"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"google.golang.org/grpc/codes"
+)
+
+// Config holds the decryption settings of crio.conf
+type Config struct {
+	// DecryptionKeysPath is the directory holding the private keys for
+	// decrypting images, as decryption_keys_path in crio.conf. Keys may be
+	// in subdirectories; files that are no keys are ignored. A missing
+	// directory means that no keys are available.
+	DecryptionKeysPath string
+}
+
+// Decrypter holds the private keys loaded according to the Config and hands
+// out the DecryptConfig for every pull
+type Decrypter struct {
+	dc config.DecryptConfig
+}
+
+// NewDecrypter loads the private keys according to the Config
+func NewDecrypter(cfg Config) (*Decrypter, error) {
+	var keys []string
+	if cfg.DecryptionKeysPath != "" {
+		err := filepath.Walk(cfg.DecryptionKeysPath, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				keys = append(keys, path)
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("could not read the decryption keys in %s: %w", cfg.DecryptionKeysPath, err))
+		}
+	}
+
+	d := &Decrypter{}
+	if len(keys) > 0 {
+		cc, err := helpers.CreateDecryptCryptoConfig(keys, nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the decryption keys in %s: %w", cfg.DecryptionKeysPath, err)
+		}
+		d.dc = *cc.DecryptConfig
+	}
+	if d.dc.Parameters == nil {
+		d.dc.Parameters = map[string][][]byte{}
+	}
+	return d, nil
+}
+
+// PullOptions holds the settings for pulling one image
+type PullOptions struct {
+	// Reference is the repository of the image, such as
+	// registry.example.com/app
+	Reference string
+	// Manifest is the descriptor of the manifest of the image
+	Manifest ocispec.Descriptor
+	// Verifier, if set, verifies the image before the keys of its layers
+	// are unwrapped
+	Verifier verify.Verifier
+	// Policy, if set, overrides the global security policy for the image
+	Policy *policy.Policy
+	// Limits, if set, override the global limits for the image
+	Limits *limits.Limits
+}
+
+// DecryptConfig returns the DecryptConfig for pulling an image. It is never
+// nil, so that pulling an encrypted image without a suitable key fails with
+// an error wrapping ErrNoDecryptionKey.
+func (d *Decrypter) DecryptConfig(opts PullOptions) *config.DecryptConfig {
+	dc := config.DecryptConfig{
+		Parameters: d.dc.Parameters,
+		Decrypters: d.dc.Decrypters,
+		Policy:     d.dc.Policy,
+		MaxMemory:  d.dc.MaxMemory,
+		Limits:     d.dc.Limits,
+	}
+	if opts.Policy != nil {
+		dc.Policy = opts.Policy
+	}
+	if opts.Limits != nil {
+		dc.Limits = opts.Limits
+	}
+	if opts.Verifier != nil {
+		dc.Verification = &verify.Verification{
+			Verifier:  opts.Verifier,
+			Reference: opts.Reference,
+			Manifest:  opts.Manifest,
+		}
+	}
+	return &dc
+}
+
+// StatusCode returns the gRPC status code for an error returned by ocicrypt,
+// so that CRI-O can return a status the kubelet understands:
+//
+//   - PermissionDenied if no key could decrypt the image, a password is wrong,
+//     the image failed verification, decrypting it was not authorized or it
+//     uses an algorithm the policy rejects
+//   - Unavailable if a key provider could not be reached
+//   - ResourceExhausted if a limit was exceeded or attempts were throttled
+//   - FailedPrecondition for other configuration errors
+//   - InvalidArgument if the encryption metadata of the image is malformed
+//   - DataLoss if the encrypted data failed its integrity check
+func StatusCode(err error) codes.Code {
+	switch {
+	case err == nil:
+		return codes.OK
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	case errors.Is(err, errdefs.ErrNoDecryptionKey),
+		errors.Is(err, errdefs.ErrWrongPassword),
+		errors.Is(err, errdefs.ErrVerificationFailed),
+		errors.Is(err, errdefs.ErrNotAuthorized),
+		errors.Is(err, errdefs.ErrDisallowedAlgorithm),
+		errors.Is(err, errdefs.ErrWeakKey):
+		return codes.PermissionDenied
+	case errors.Is(err, errdefs.ErrProviderUnreachable):
+		return codes.Unavailable
+	case errors.Is(err, errdefs.ErrLimitExceeded),
+		errors.Is(err, errdefs.ErrThrottled):
+		return codes.ResourceExhausted
+	case errors.Is(err, errdefs.ErrConfiguration),
+		errors.Is(err, errdefs.ErrKeyMaterial):
+		return codes.FailedPrecondition
+	case errors.Is(err, errdefs.ErrProtocol):
+		return codes.InvalidArgument
+	case errors.Is(err, errdefs.ErrIntegrity):
+		return codes.DataLoss
+	}
+	return codes.Unknown
+}
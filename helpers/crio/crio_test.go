@@ -0,0 +1,147 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/ocicrypt"
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/limits"
+	"github.com/containers/ocicrypt/utils"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"google.golang.org/grpc/codes"
+)
+
+type failingVerifier struct{}
+
+func (failingVerifier) Verify(context.Context, string, ocispec.Descriptor) error {
+	return errors.New("no trusted signature")
+}
+
+// encryptLayer encrypts data for the public key and returns the descriptor
+// of the encrypted layer
+func encryptLayer(t *testing.T, pubKey, data []byte) ocispec.Descriptor {
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{"pubkeys": {pubKey}},
+	}
+	encLayerReader, encLayerFinalizer, err := ocicrypt.EncryptLayer(ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(encLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ocispec.Descriptor{Digest: desc.Digest, Annotations: annotations}
+}
+
+func TestDecrypter(t *testing.T) {
+	pubKey, privKey, err := utils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keysPath := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(keysPath, "app"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(keysPath, "app", "key.pem"), privKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(keysPath, "README"), []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	desc := encryptLayer(t, pubKey, []byte("This is some text!"))
+
+	d, err := NewDecrypter(Config{DecryptionKeysPath: keysPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ocicrypt.DecryptLayer(d.DecryptConfig(PullOptions{}), nil, desc, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// the per-pull settings apply to that pull only
+	opts := PullOptions{
+		Reference: "registry.example.com/app",
+		Manifest:  ocispec.Descriptor{Digest: digest.FromString("manifest")},
+		Verifier:  failingVerifier{},
+	}
+	_, _, err = ocicrypt.DecryptLayer(d.DecryptConfig(opts), nil, desc, true)
+	if StatusCode(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for unverified image, got %v", err)
+	}
+	_, _, err = ocicrypt.DecryptLayer(d.DecryptConfig(PullOptions{Limits: &limits.Limits{MaxAnnotationBytes: 10}}), nil, desc, true)
+	if StatusCode(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted for exceeded limit, got %v", err)
+	}
+	if _, _, err := ocicrypt.DecryptLayer(d.DecryptConfig(PullOptions{}), nil, desc, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// without keys, pulling encrypted images fails with PermissionDenied
+	d, err = NewDecrypter(Config{DecryptionKeysPath: filepath.Join(keysPath, "missing")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ocicrypt.DecryptLayer(d.DecryptConfig(PullOptions{}), nil, desc, true)
+	if StatusCode(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied without keys, got %v", err)
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code codes.Code
+	}{
+		{nil, codes.OK},
+		{errors.New("other"), codes.Unknown},
+		{fmt.Errorf("pull: %w", context.Canceled), codes.Canceled},
+		{errdefs.ErrNoDecryptionKey, codes.PermissionDenied},
+		{errdefs.ErrWrongPassword, codes.PermissionDenied},
+		{errdefs.ErrVerificationFailed, codes.PermissionDenied},
+		{errdefs.ErrNotAuthorized, codes.PermissionDenied},
+		{errdefs.ErrDisallowedAlgorithm, codes.PermissionDenied},
+		{errdefs.WithCategory(errdefs.ErrProviderUnreachable, errors.New("gpg")), codes.Unavailable},
+		{errdefs.ErrLimitExceeded, codes.ResourceExhausted},
+		{errdefs.ErrThrottled, codes.ResourceExhausted},
+		{errdefs.ErrConfiguration, codes.FailedPrecondition},
+		{errdefs.ErrUnsupportedCipher, codes.InvalidArgument},
+		{&ocicrypt.LayerError{Err: errdefs.ErrIntegrity}, codes.DataLoss},
+	} {
+		if code := StatusCode(tc.err); code != tc.code {
+			t.Errorf("StatusCode(%v) = %v, expected %v", tc.err, code, tc.code)
+		}
+	}
+}
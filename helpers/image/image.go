@@ -0,0 +1,384 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package image encrypts and decrypts whole images, the level of abstraction
+// tools like Podman and Buildah need: it takes the manifest of an image and
+// access to its blobs, selects the layers, reports progress, prompts for
+// passwords and returns the manifest of the encrypted or decrypted image.
+package image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/containers/ocicrypt"
+	"github.com/containers/ocicrypt/blockcipher"
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/masterkey"
+	"github.com/containers/ocicrypt/spec"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	encryptedSuffix = "+encrypted"
+	// maxPrompts is the number of times the password is prompted for
+	maxPrompts = 3
+
+	mediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar"
+	mediaTypeDockerLayerGzip    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeDockerForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// Store gives access to the blobs of an image
+type Store interface {
+	// GetBlob returns the content of the blob with the descriptor
+	GetBlob(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error)
+	// PutBlob stores the content read from r as blob and returns its digest
+	// and size
+	PutBlob(ctx context.Context, r io.Reader) (digest.Digest, int64, error)
+}
+
+// Progress reports how far processing a layer has come
+type Progress struct {
+	// Index is the index of the layer in the manifest
+	Index int
+	// Layer is the descriptor of the layer before processing
+	Layer ocispec.Descriptor
+	// Bytes is the number of bytes of the layer read so far
+	Bytes int64
+	// Done is true once the layer has been stored
+	Done bool
+}
+
+// Options selects the layers to process and holds the callbacks
+type Options struct {
+	// Layers selects the layers by their index in the manifest and their
+	// descriptor; if nil, all layers are selected
+	Layers func(index int, desc ocispec.Descriptor) bool
+	// Cipher is the block cipher for encrypting layers; if empty, the
+	// cipher of the EncryptConfig is used
+	Cipher blockcipher.LayerCipherType
+	// Progress, if set, is called while layers are read and once they are
+	// stored; it must return quickly
+	Progress func(Progress)
+	// Prompt, if set, is called for the password of the private keys when
+	// unwrapping a layer key fails because a password is missing or wrong;
+	// the password returned is used for all private keys
+	Prompt func(ctx context.Context, message string) ([]byte, error)
+	// MasterKey, if set, encrypts the layers with keys derived from a master
+	// key of the image instead of wrapping the key of every layer for the
+	// recipients; the master key is wrapped once and stored in the
+	// annotations of the manifest. An image that already has a master key
+	// keeps it.
+	MasterKey bool
+}
+
+// EncryptImage encrypts the selected layers of the image for the recipients
+// of the EncryptConfig and returns the manifest of the encrypted image. Layers
+// that are already encrypted get the recipients added. The caller stores the
+// manifest.
+func EncryptImage(ctx context.Context, store Store, manifest ocispec.Manifest, ec *config.EncryptConfig, opts Options) (ocispec.Manifest, error) {
+	if ec == nil {
+		return ocispec.Manifest{}, fmt.Errorf("EncryptConfig must not be nil: %w", ocicrypt.ErrConfiguration)
+	}
+	if opts.Cipher != "" {
+		copied := *ec
+		copied.Cipher = opts.Cipher
+		ec = &copied
+	}
+	var masterKey []byte
+	if opts.MasterKey {
+		var err error
+		if masterKey, err = getMasterKey(ec, manifest); err != nil {
+			return ocispec.Manifest{}, err
+		}
+	}
+
+	newManifest, err := processLayers(ctx, manifest, opts, func(index int, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+		mediaType, err := encryptedMediaType(desc.MediaType)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		blob, err := store.GetBlob(ctx, desc)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("could not get layer %s: %w", desc.Digest, err)
+		}
+		defer blob.Close()
+
+		var (
+			encLayerReader io.Reader
+			finalizer      ocicrypt.EncryptLayerFinalizer
+		)
+		if masterKey != nil {
+			encLayerReader, finalizer, err = ocicrypt.EncryptLayerWithMasterKeyContext(ctx, ec, masterKey, index, newProgressReader(blob, index, desc, opts.Progress), desc)
+		} else {
+			encLayerReader, finalizer, err = ocicrypt.EncryptLayerContext(ctx, ec, newProgressReader(blob, index, desc, opts.Progress), desc)
+		}
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		newDesc := desc
+		// layers that are already encrypted are not rewritten
+		if encLayerReader != nil {
+			newDesc.Digest, newDesc.Size, err = store.PutBlob(ctx, encLayerReader)
+			if err != nil {
+				return ocispec.Descriptor{}, fmt.Errorf("could not store encrypted layer %s: %w", desc.Digest, err)
+			}
+		}
+		annotations, err := finalizer()
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+
+		newDesc.MediaType = mediaType
+		newDesc.Annotations = make(map[string]string)
+		for k, v := range desc.Annotations {
+			newDesc.Annotations[k] = v
+		}
+		for k, v := range annotations {
+			newDesc.Annotations[k] = v
+		}
+		return newDesc, nil
+	})
+	if err != nil || masterKey == nil {
+		return newManifest, err
+	}
+
+	annotations, err := ocicrypt.EncryptMasterKey(ec, masterKey, manifest.Annotations)
+	if err != nil {
+		return ocispec.Manifest{}, err
+	}
+	newManifest.Annotations = make(map[string]string)
+	for k, v := range manifest.Annotations {
+		newManifest.Annotations[k] = v
+	}
+	for k, v := range annotations {
+		newManifest.Annotations[k] = v
+	}
+	return newManifest, nil
+}
+
+// getMasterKey returns the master key of the image, which is unwrapped from
+// the annotations of the manifest with the keys of the EncryptConfig if the
+// image has one, or a new master key otherwise
+func getMasterKey(ec *config.EncryptConfig, manifest ocispec.Manifest) ([]byte, error) {
+	if !hasMasterKey(manifest) {
+		return masterkey.Generate(ec.GetRand())
+	}
+	return ocicrypt.DecryptMasterKey(&ec.DecryptConfig, manifest.Annotations)
+}
+
+// hasMasterKey returns true if the annotations of the manifest hold wrapped
+// keys of a master key
+func hasMasterKey(manifest ocispec.Manifest) bool {
+	return len(ocicrypt.GetWrappedKeysMap(ocispec.Descriptor{Annotations: manifest.Annotations})) > 0
+}
+
+// DecryptImage decrypts the selected encrypted layers of the image with the
+// keys of the DecryptConfig and returns the manifest of the decrypted image;
+// layers that are not encrypted are left as they are. The caller stores the
+// manifest.
+func DecryptImage(ctx context.Context, store Store, manifest ocispec.Manifest, dc *config.DecryptConfig, opts Options) (ocispec.Manifest, error) {
+	if dc == nil {
+		return ocispec.Manifest{}, fmt.Errorf("DecryptConfig must not be nil: %w", ocicrypt.ErrConfiguration)
+	}
+
+	masterKeyAdded := false
+	newManifest, err := processLayers(ctx, manifest, opts, func(index int, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+		if !strings.HasSuffix(desc.MediaType, encryptedSuffix) {
+			return desc, nil
+		}
+		var err error
+		if _, ok := desc.Annotations[masterkey.Annotation]; ok && !masterKeyAdded && hasMasterKey(manifest) {
+			// the master key is unwrapped once for all layers
+			var masterKey []byte
+			dc, err = withPrompts(ctx, dc, opts, "Password for the private key to decrypt the master key of the image", func(dc *config.DecryptConfig) error {
+				var err error
+				masterKey, err = ocicrypt.DecryptMasterKey(dc, manifest.Annotations)
+				return err
+			})
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			dc = withMasterKey(dc, masterKey)
+			masterKeyAdded = true
+		}
+		blob, err := store.GetBlob(ctx, desc)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("could not get layer %s: %w", desc.Digest, err)
+		}
+		defer blob.Close()
+
+		// the layer key is unwrapped before the layer is read, so
+		// decrypting can be retried with another password
+		var decLayerReader io.Reader
+		dc, err = withPrompts(ctx, dc, opts, fmt.Sprintf("Password for the private key to decrypt layer %s", desc.Digest), func(dc *config.DecryptConfig) error {
+			var err error
+			decLayerReader, _, err = ocicrypt.DecryptLayerContext(ctx, dc, newProgressReader(blob, index, desc, opts.Progress), desc, false)
+			return err
+		})
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		d, size, err := store.PutBlob(ctx, decLayerReader)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("could not store decrypted layer %s: %w", desc.Digest, err)
+		}
+
+		newDesc := desc
+		newDesc.MediaType = strings.TrimSuffix(desc.MediaType, encryptedSuffix)
+		newDesc.Digest = d
+		newDesc.Size = size
+		newDesc.Annotations = ocicrypt.FilterOutAnnotations(desc.Annotations)
+		return newDesc, nil
+	})
+	if err != nil {
+		return ocispec.Manifest{}, err
+	}
+
+	// the wrapped master key is removed once no layer needs it
+	if hasMasterKey(manifest) {
+		for _, desc := range newManifest.Layers {
+			if _, ok := desc.Annotations[masterkey.Annotation]; ok {
+				return newManifest, nil
+			}
+		}
+		newManifest.Annotations = ocicrypt.FilterOutAnnotations(manifest.Annotations)
+	}
+	return newManifest, nil
+}
+
+// withPrompts calls try with the DecryptConfig and, as long as it fails
+// because a password is missing or wrong, prompts for the password and calls
+// try again; it returns the DecryptConfig try succeeded with
+func withPrompts(ctx context.Context, dc *config.DecryptConfig, opts Options, message string, try func(*config.DecryptConfig) error) (*config.DecryptConfig, error) {
+	for prompts := 0; ; prompts++ {
+		err := try(dc)
+		if err == nil {
+			return dc, nil
+		}
+		if !errors.Is(err, ocicrypt.ErrWrongPassword) || opts.Prompt == nil || prompts == maxPrompts {
+			return nil, err
+		}
+		password, err := opts.Prompt(ctx, message)
+		if err != nil {
+			return nil, err
+		}
+		dc = withPassword(dc, password)
+	}
+}
+
+// processLayers calls process for every selected layer and returns the
+// manifest with the new layer descriptors
+func processLayers(ctx context.Context, manifest ocispec.Manifest, opts Options, process func(int, ocispec.Descriptor) (ocispec.Descriptor, error)) (ocispec.Manifest, error) {
+	newManifest := manifest
+	newManifest.Layers = make([]ocispec.Descriptor, len(manifest.Layers))
+	for i, desc := range manifest.Layers {
+		if err := ctx.Err(); err != nil {
+			return ocispec.Manifest{}, err
+		}
+		if opts.Layers != nil && !opts.Layers(i, desc) {
+			newManifest.Layers[i] = desc
+			continue
+		}
+		newDesc, err := process(i, desc)
+		if err != nil {
+			return ocispec.Manifest{}, err
+		}
+		newManifest.Layers[i] = newDesc
+		if opts.Progress != nil {
+			opts.Progress(Progress{Index: i, Layer: desc, Bytes: desc.Size, Done: true})
+		}
+	}
+	return newManifest, nil
+}
+
+// encryptedMediaType returns the media type of a layer once it is encrypted;
+// Docker layers become OCI layers
+func encryptedMediaType(mediaType string) (string, error) {
+	switch mediaType {
+	case mediaTypeDockerLayer:
+		return spec.MediaTypeLayerEnc, nil
+	case mediaTypeDockerLayerGzip:
+		return spec.MediaTypeLayerGzipEnc, nil
+	case mediaTypeDockerForeignLayer:
+		return spec.MediaTypeLayerNonDistributableGzipEnc, nil
+	}
+	if strings.HasSuffix(mediaType, encryptedSuffix) {
+		return mediaType, nil
+	}
+	if strings.HasPrefix(mediaType, ocispec.MediaTypeImageLayer) || strings.HasPrefix(mediaType, ocispec.MediaTypeImageLayerNonDistributable) {
+		return mediaType + encryptedSuffix, nil
+	}
+	return "", fmt.Errorf("unsupported layer media type %s: %w", mediaType, ocicrypt.ErrConfiguration)
+}
+
+// withPassword returns a copy of the DecryptConfig that uses the password for
+// all its private keys
+func withPassword(dc *config.DecryptConfig, password []byte) *config.DecryptConfig {
+	copied := *dc
+	copied.Parameters = make(map[string][][]byte)
+	for k, v := range dc.Parameters {
+		copied.Parameters[k] = v
+	}
+	for _, name := range []string{"privkeys-passwords", "gpg-privatekeys-passwords"} {
+		passwords := make([][]byte, len(dc.Parameters[name]))
+		for i := range passwords {
+			passwords[i] = password
+		}
+		copied.Parameters[name] = passwords
+	}
+	return &copied
+}
+
+// withMasterKey returns a copy of the DecryptConfig that has the master key
+// added to its master keys
+func withMasterKey(dc *config.DecryptConfig, masterKey []byte) *config.DecryptConfig {
+	copied := *dc
+	copied.Parameters = make(map[string][][]byte)
+	for k, v := range dc.Parameters {
+		copied.Parameters[k] = v
+	}
+	copied.Parameters["masterkeys"] = append(append([][]byte{}, dc.Parameters["masterkeys"]...), masterKey)
+	return &copied
+}
+
+// progressReader reports the number of bytes read from a layer
+type progressReader struct {
+	r        io.Reader
+	progress func(Progress)
+	p        Progress
+}
+
+func newProgressReader(r io.Reader, index int, desc ocispec.Descriptor, progress func(Progress)) io.Reader {
+	if progress == nil {
+		return r
+	}
+	return &progressReader{r: r, progress: progress, p: Progress{Index: index, Layer: desc}}
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if n > 0 {
+		pr.p.Bytes += int64(n)
+		pr.progress(pr.p)
+	}
+	return n, err
+}
@@ -0,0 +1,244 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/containers/ocicrypt"
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/masterkey"
+	"github.com/containers/ocicrypt/spec"
+	"github.com/containers/ocicrypt/utils"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type memoryStore map[digest.Digest][]byte
+
+func (ms memoryStore) GetBlob(_ context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	data, ok := ms[desc.Digest]
+	if !ok {
+		return nil, errors.New("blob not found")
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (ms memoryStore) PutBlob(_ context.Context, r io.Reader) (digest.Digest, int64, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", 0, err
+	}
+	d := digest.FromBytes(data)
+	ms[d] = data
+	return d, int64(len(data)), nil
+}
+
+func (ms memoryStore) add(mediaType string, data []byte) ocispec.Descriptor {
+	d := digest.FromBytes(data)
+	ms[d] = data
+	return ocispec.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(data))}
+}
+
+func TestEncryptDecryptImage(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "an encrypted PEM private key")
+
+	ctx := context.Background()
+	password := []byte("secret")
+	pubKey, privKey, err := utils.CreateRSATestKey(2048, password, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := memoryStore{}
+	manifest := ocispec.Manifest{
+		Layers: []ocispec.Descriptor{
+			store.add(ocispec.MediaTypeImageLayerGzip, []byte("layer 0")),
+			store.add(mediaTypeDockerLayerGzip, []byte("layer 1")),
+			store.add(ocispec.MediaTypeImageLayer, []byte("layer 2")),
+		},
+	}
+
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{"pubkeys": {pubKey}},
+	}
+	var done []int
+	var bytesRead int64
+	opts := Options{
+		// leave the last layer unencrypted
+		Layers: func(index int, _ ocispec.Descriptor) bool { return index < 2 },
+		Progress: func(p Progress) {
+			if p.Done {
+				done = append(done, p.Index)
+			} else {
+				bytesRead = p.Bytes
+			}
+		},
+	}
+	encManifest, err := EncryptImage(ctx, store, manifest, ec, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 2 || bytesRead != int64(len("layer 1")) {
+		t.Fatalf("unexpected progress: done %v, %d bytes", done, bytesRead)
+	}
+	for i, mediaType := range []string{spec.MediaTypeLayerGzipEnc, spec.MediaTypeLayerGzipEnc, ocispec.MediaTypeImageLayer} {
+		if encManifest.Layers[i].MediaType != mediaType {
+			t.Fatalf("layer %d has media type %s, expected %s", i, encManifest.Layers[i].MediaType, mediaType)
+		}
+	}
+	if encManifest.Layers[2].Digest != manifest.Layers[2].Digest {
+		t.Fatal("unselected layer was changed")
+	}
+
+	dc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {privKey},
+			"privkeys-passwords": {nil},
+		},
+	}
+	if _, err := DecryptImage(ctx, store, encManifest, dc, Options{}); !errors.Is(err, ocicrypt.ErrWrongPassword) {
+		t.Fatalf("expected ErrWrongPassword without prompt, got %v", err)
+	}
+
+	prompts := 0
+	decManifest, err := DecryptImage(ctx, store, encManifest, dc, Options{
+		Prompt: func(context.Context, string) ([]byte, error) {
+			prompts++
+			return password, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prompts != 1 {
+		t.Fatalf("prompted %d times, expected once", prompts)
+	}
+	for i, desc := range decManifest.Layers {
+		if desc.Digest != manifest.Layers[i].Digest {
+			t.Fatalf("layer %d was not decrypted to the original content", i)
+		}
+		if len(desc.Annotations) != 0 {
+			t.Fatalf("layer %d still has annotations %v", i, desc.Annotations)
+		}
+	}
+	if decManifest.Layers[1].MediaType != ocispec.MediaTypeImageLayerGzip {
+		t.Fatalf("unexpected media type %s of decrypted Docker layer", decManifest.Layers[1].MediaType)
+	}
+}
+
+func TestEncryptDecryptImageMasterKey(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "deriving layer keys from master keys")
+
+	ctx := context.Background()
+	pubKey, privKey, err := utils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey2, privKey2, err := utils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := memoryStore{}
+	manifest := ocispec.Manifest{
+		Layers: []ocispec.Descriptor{
+			store.add(ocispec.MediaTypeImageLayerGzip, []byte("layer 0")),
+			store.add(ocispec.MediaTypeImageLayerGzip, []byte("layer 1")),
+		},
+	}
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{"pubkeys": {pubKey}},
+	}
+	encManifest, err := EncryptImage(ctx, store, manifest, ec, Options{MasterKey: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encManifest.Annotations["org.opencontainers.image.enc.keys.jwe"] == "" {
+		t.Fatal("master key was not wrapped in the annotations of the manifest")
+	}
+	for i, desc := range encManifest.Layers {
+		if len(ocicrypt.GetWrappedKeysMap(desc)) != 0 || desc.Annotations[masterkey.Annotation] == "" {
+			t.Fatalf("layer %d has unexpected annotations %v", i, desc.Annotations)
+		}
+	}
+
+	// adding a recipient rewraps the master key only
+	ec2 := &config.EncryptConfig{
+		Parameters: map[string][][]byte{"pubkeys": {pubKey2}},
+		DecryptConfig: config.DecryptConfig{
+			Parameters: map[string][][]byte{"privkeys": {privKey}, "privkeys-passwords": {nil}},
+		},
+	}
+	encManifest2, err := EncryptImage(ctx, store, encManifest, ec2, Options{MasterKey: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, desc := range encManifest2.Layers {
+		if desc.Digest != encManifest.Layers[i].Digest {
+			t.Fatalf("layer %d was encrypted again", i)
+		}
+	}
+
+	for _, privKey := range [][]byte{privKey, privKey2} {
+		dc := &config.DecryptConfig{
+			Parameters: map[string][][]byte{"privkeys": {privKey}, "privkeys-passwords": {nil}},
+		}
+		decManifest, err := DecryptImage(ctx, store, encManifest2, dc, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, desc := range decManifest.Layers {
+			if desc.Digest != manifest.Layers[i].Digest {
+				t.Fatalf("layer %d was not decrypted to the original content", i)
+			}
+		}
+		if len(decManifest.Annotations) != 0 {
+			t.Fatalf("manifest still has annotations %v", decManifest.Annotations)
+		}
+	}
+
+	// without the master key the layers cannot be decrypted
+	dc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{"privkeys": {privKey}, "privkeys-passwords": {nil}},
+	}
+	if _, _, err := ocicrypt.DecryptLayer(dc, bytes.NewReader(store[encManifest.Layers[0].Digest]), encManifest.Layers[0], false); !errors.Is(err, ocicrypt.ErrNoDecryptionKey) {
+		t.Fatalf("expected ErrNoDecryptionKey, got %v", err)
+	}
+}
+
+func TestEncryptImageUnsupportedMediaType(t *testing.T) {
+	store := memoryStore{}
+	manifest := ocispec.Manifest{
+		Layers: []ocispec.Descriptor{store.add("application/octet-stream", []byte("data"))},
+	}
+	pubKey, _, err := utils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{"pubkeys": {pubKey}},
+	}
+	if _, err := EncryptImage(context.Background(), store, manifest, ec, Options{}); !errors.Is(err, ocicrypt.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package helpers
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -12,25 +13,34 @@ import (
 	"github.com/containers/ocicrypt/config/pkcs11config"
 	"github.com/containers/ocicrypt/crypto/pkcs11"
 	encutils "github.com/containers/ocicrypt/utils"
-
-	"github.com/pkg/errors"
 )
 
+// recipientKeys are the recipients sorted by type
+type recipientKeys struct {
+	gpgRecipients [][]byte
+	pubkeys       [][]byte
+	x509s         [][]byte
+	pkcs11Pubkeys [][]byte
+	pkcs11Yamls   [][]byte
+	awsKMSKeys    [][]byte
+	gcpKMSKeys    [][]byte
+	azureKVKeys   [][]byte
+	vaultKeys     [][]byte
+}
+
 // processRecipientKeys sorts the array of recipients by type. Recipients may be either
-// x509 certificates, public keys, or PGP public keys identified by email address or name
-func processRecipientKeys(recipients []string) ([][]byte, [][]byte, [][]byte, [][]byte, [][]byte, error) {
-	var (
-		gpgRecipients [][]byte
-		pubkeys       [][]byte
-		x509s         [][]byte
-		pkcs11Pubkeys [][]byte
-		pkcs11Yamls   [][]byte
-	)
+// x509 certificates, public keys, PGP public keys identified by email address or name,
+// the ARNs of AWS KMS keys given as aws-kms://arn:..., the names of Google
+// Cloud KMS keys given as gcpkms://projects/..., the IDs of Azure Key Vault
+// keys given as azurekv://<vault host>/keys/... or the references of Vault
+// transit keys given as vault-transit://<Vault host>/<mount path>/keys/...
+func processRecipientKeys(recipients []string) (*recipientKeys, error) {
+	rk := &recipientKeys{}
 	for _, recipient := range recipients {
 
 		idx := strings.Index(recipient, ":")
 		if idx < 0 {
-			return nil, nil, nil, nil, nil, errors.New("Invalid recipient format")
+			return nil, errors.New("Invalid recipient format")
 		}
 
 		protocol := recipient[:idx]
@@ -38,46 +48,70 @@ func processRecipientKeys(recipients []string) ([][]byte, [][]byte, [][]byte, []
 
 		switch protocol {
 		case "pgp":
-			gpgRecipients = append(gpgRecipients, []byte(value))
+			rk.gpgRecipients = append(rk.gpgRecipients, []byte(value))
 
 		case "jwe":
 			tmp, err := ioutil.ReadFile(value)
 			if err != nil {
-				return nil, nil, nil, nil, nil, errors.Wrap(err, "Unable to read file")
+				return nil, fmt.Errorf("Unable to read file: %w", err)
 			}
 			if !encutils.IsPublicKey(tmp) {
-				return nil, nil, nil, nil, nil, errors.New("File provided is not a public key")
+				return nil, errors.New("File provided is not a public key")
 			}
-			pubkeys = append(pubkeys, tmp)
+			rk.pubkeys = append(rk.pubkeys, tmp)
 
 		case "pkcs7":
 			tmp, err := ioutil.ReadFile(value)
 			if err != nil {
-				return nil, nil, nil, nil, nil, errors.Wrap(err, "Unable to read file")
+				return nil, fmt.Errorf("Unable to read file: %w", err)
 			}
 			if !encutils.IsCertificate(tmp) {
-				return nil, nil, nil, nil, nil, errors.New("File provided is not an x509 cert")
+				return nil, errors.New("File provided is not an x509 cert")
 			}
-			x509s = append(x509s, tmp)
+			rk.x509s = append(rk.x509s, tmp)
 
 		case "pkcs11":
 			tmp, err := ioutil.ReadFile(value)
 			if err != nil {
-				return nil, nil, nil, nil, nil, errors.Wrap(err, "Unable to read file")
+				return nil, fmt.Errorf("Unable to read file: %w", err)
 			}
 			if encutils.IsPkcs11PublicKey(tmp) {
-				pkcs11Yamls = append(pkcs11Yamls, tmp)
+				rk.pkcs11Yamls = append(rk.pkcs11Yamls, tmp)
 			} else if encutils.IsPublicKey(tmp) {
-				pkcs11Pubkeys = append(pkcs11Pubkeys, tmp)
+				rk.pkcs11Pubkeys = append(rk.pkcs11Pubkeys, tmp)
 			} else {
-				return nil, nil, nil, nil, nil, errors.New("Provided file is not a public key")
+				return nil, errors.New("Provided file is not a public key")
+			}
+
+		case "aws-kms":
+			if !strings.HasPrefix(value, "//arn:") {
+				return nil, errors.New("AWS KMS recipients must be given as aws-kms://arn:...")
+			}
+			rk.awsKMSKeys = append(rk.awsKMSKeys, []byte(recipient))
+
+		case "gcpkms":
+			if !strings.HasPrefix(value, "//projects/") {
+				return nil, errors.New("GCP KMS recipients must be given as gcpkms://projects/...")
+			}
+			rk.gcpKMSKeys = append(rk.gcpKMSKeys, []byte(recipient))
+
+		case "azurekv":
+			if !strings.HasPrefix(value, "//") || !strings.Contains(value, "/keys/") {
+				return nil, errors.New("Azure Key Vault recipients must be given as azurekv://<vault host>/keys/...")
+			}
+			rk.azureKVKeys = append(rk.azureKVKeys, []byte(recipient))
+
+		case "vault-transit":
+			if !strings.HasPrefix(value, "//") || !strings.Contains(value, "/keys/") {
+				return nil, errors.New("Vault transit recipients must be given as vault-transit://<Vault host>/<mount path>/keys/...")
 			}
+			rk.vaultKeys = append(rk.vaultKeys, []byte(recipient))
 
 		default:
-			return nil, nil, nil, nil, nil, errors.New("Provided protocol not recognized")
+			return nil, errors.New("Provided protocol not recognized")
 		}
 	}
-	return gpgRecipients, pubkeys, x509s, pkcs11Pubkeys, pkcs11Yamls, nil
+	return rk, nil
 }
 
 // processx509Certs processes x509 certificate files
@@ -86,7 +120,7 @@ func processx509Certs(keys []string) ([][]byte, error) {
 	for _, key := range keys {
 		tmp, err := ioutil.ReadFile(strings.Split(key, ":")[0])
 		if err != nil {
-			return nil, errors.Wrap(err, "Unable to read file")
+			return nil, fmt.Errorf("Unable to read file: %w", err)
 		}
 		if !encutils.IsCertificate(tmp) {
 			continue
@@ -111,7 +145,7 @@ func processPwdString(pwdString string) ([]byte, error) {
 		fdStr := pwdString[3:]
 		fd, err := strconv.Atoi(fdStr)
 		if err != nil {
-			return nil, errors.Wrapf(err, "could not parse file descriptor %s", fdStr)
+			return nil, fmt.Errorf("could not parse file descriptor %s: %w", fdStr, err)
 		}
 		f := os.NewFile(uintptr(fd), "pwdfile")
 		if f == nil {
@@ -121,7 +155,7 @@ func processPwdString(pwdString string) ([]byte, error) {
 		pwd := make([]byte, 64)
 		n, err := f.Read(pwd)
 		if err != nil {
-			return nil, errors.Wrapf(err, "could not read from file descriptor")
+			return nil, fmt.Errorf("could not read from file descriptor: %w", err)
 		}
 		return pwd[:n], nil
 	}
@@ -190,10 +224,11 @@ func CreateDecryptCryptoConfig(keys []string, decRecipients []string) (encconfig
 	ccs := []encconfig.CryptoConfig{}
 
 	// x509 cert is needed for PKCS7 decryption
-	_, _, x509s, _, _, err := processRecipientKeys(decRecipients)
+	rk, err := processRecipientKeys(decRecipients)
 	if err != nil {
 		return encconfig.CryptoConfig{}, err
 	}
+	x509s := rk.x509s
 
 	// x509 certs can also be passed in via keys
 	x509FromKeys, err := processx509Certs(keys)
@@ -267,6 +302,36 @@ func CreateDecryptCryptoConfig(keys []string, decRecipients []string) (encconfig
 		ccs = append(ccs, pkcs11PrivKeysCc)
 	}
 
+	// AWS KMS keys are passed like recipients since they cannot leave AWS
+	if len(rk.awsKMSKeys) > 0 {
+		awsKMSCc, err := encconfig.DecryptWithAWSKMS(rk.awsKMSKeys)
+		if err != nil {
+			return encconfig.CryptoConfig{}, err
+		}
+		ccs = append(ccs, awsKMSCc)
+	}
+	if len(rk.gcpKMSKeys) > 0 {
+		gcpKMSCc, err := encconfig.DecryptWithGCPKMS(rk.gcpKMSKeys)
+		if err != nil {
+			return encconfig.CryptoConfig{}, err
+		}
+		ccs = append(ccs, gcpKMSCc)
+	}
+	if len(rk.azureKVKeys) > 0 {
+		azureKVCc, err := encconfig.DecryptWithAzureKeyVault(rk.azureKVKeys)
+		if err != nil {
+			return encconfig.CryptoConfig{}, err
+		}
+		ccs = append(ccs, azureKVCc)
+	}
+	if len(rk.vaultKeys) > 0 {
+		vaultCc, err := encconfig.DecryptWithVaultTransit(rk.vaultKeys)
+		if err != nil {
+			return encconfig.CryptoConfig{}, err
+		}
+		ccs = append(ccs, vaultCc)
+	}
+
 	return encconfig.CombineCryptoConfigs(ccs), nil
 }
 
@@ -284,10 +349,11 @@ func CreateCryptoConfig(recipients []string, keys []string) (encconfig.CryptoCon
 	}
 
 	if len(recipients) > 0 {
-		gpgRecipients, pubKeys, x509s, pkcs11Pubkeys, pkcs11Yamls, err := processRecipientKeys(recipients)
+		rk, err := processRecipientKeys(recipients)
 		if err != nil {
 			return encconfig.CryptoConfig{}, err
 		}
+		gpgRecipients, pubKeys, x509s, pkcs11Pubkeys, pkcs11Yamls := rk.gpgRecipients, rk.pubkeys, rk.x509s, rk.pkcs11Pubkeys, rk.pkcs11Yamls
 		encryptCcs := []encconfig.CryptoConfig{}
 
 		// Create GPG client with guessed GPG version and default homedir
@@ -332,6 +398,38 @@ func CreateCryptoConfig(recipients []string, keys []string) (encconfig.CryptoCon
 		}
 		encryptCcs = append(encryptCcs, pkcs11Cc)
 
+		if len(rk.awsKMSKeys) > 0 {
+			awsKMSCc, err := encconfig.EncryptWithAWSKMS(rk.awsKMSKeys)
+			if err != nil {
+				return encconfig.CryptoConfig{}, err
+			}
+			encryptCcs = append(encryptCcs, awsKMSCc)
+		}
+
+		if len(rk.gcpKMSKeys) > 0 {
+			gcpKMSCc, err := encconfig.EncryptWithGCPKMS(rk.gcpKMSKeys)
+			if err != nil {
+				return encconfig.CryptoConfig{}, err
+			}
+			encryptCcs = append(encryptCcs, gcpKMSCc)
+		}
+
+		if len(rk.azureKVKeys) > 0 {
+			azureKVCc, err := encconfig.EncryptWithAzureKeyVault(rk.azureKVKeys)
+			if err != nil {
+				return encconfig.CryptoConfig{}, err
+			}
+			encryptCcs = append(encryptCcs, azureKVCc)
+		}
+
+		if len(rk.vaultKeys) > 0 {
+			vaultCc, err := encconfig.EncryptWithVaultTransit(rk.vaultKeys)
+			if err != nil {
+				return encconfig.CryptoConfig{}, err
+			}
+			encryptCcs = append(encryptCcs, vaultCc)
+		}
+
 		ecc := encconfig.CombineCryptoConfigs(encryptCcs)
 		if decryptCc != nil {
 			ecc.EncryptConfig.AttachDecryptConfig(decryptCc.DecryptConfig)
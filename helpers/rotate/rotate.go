@@ -0,0 +1,383 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package rotate rotates the keys of many encrypted images at once, as
+// registries do when the keys of an organization change: it rewraps the layer
+// keys for the new recipients, or re-encrypts the layers if the block cipher
+// changes, runs several images concurrently and can resume an interrupted
+// rotation from a checkpoint file.
+package rotate
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/containers/ocicrypt"
+	"github.com/containers/ocicrypt/blockcipher"
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/helpers/image"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Item is an image whose keys are rotated
+type Item struct {
+	// Name identifies the image in the checkpoint and the results, such as
+	// its reference
+	Name string
+	// Manifest is the manifest of the encrypted image
+	Manifest ocispec.Manifest
+}
+
+// Result is the outcome of rotating the keys of an image
+type Result struct {
+	// Name is the Name of the Item
+	Name string
+	// Manifest is the manifest of the image with the rotated keys; it is
+	// empty if rotating failed or was skipped
+	Manifest ocispec.Manifest
+	// Skipped is true if the checkpoint shows that the image was rotated
+	// before
+	Skipped bool
+	// Err is the error rotating the image failed with
+	Err error
+}
+
+// Progress reports how far the rotation has come; it is passed after every image
+type Progress struct {
+	// Total is the number of images to rotate
+	Total int
+	// Done is the number of images that were rotated, skipped or failed
+	Done int
+	// Failed is the number of images that failed
+	Failed int
+	// Result is the result of the image that was just finished
+	Result Result
+}
+
+// Options configures a rotation
+type Options struct {
+	// Concurrency is the number of images rotated at the same time; if it is
+	// not positive, one image is rotated at a time
+	Concurrency int
+	// Checkpoint, if set, is the path of the file recording the images that
+	// were rotated; images recorded in it are skipped, so that an interrupted
+	// rotation can be resumed by passing the same file
+	Checkpoint string
+	// Commit, if set, stores the manifest of a rotated image, for example by
+	// pushing it under the reference of the image; an image is only recorded
+	// in the checkpoint once Commit succeeded
+	Commit func(ctx context.Context, item Item, manifest ocispec.Manifest) error
+	// Progress, if set, is called after every image
+	Progress func(Progress)
+}
+
+// checkpointEntry is a line of the checkpoint file
+type checkpointEntry struct {
+	Name     string        `json:"name"`
+	Manifest digest.Digest `json:"manifest"`
+}
+
+// Rotate rotates the keys of the encrypted layers of the images. The old
+// CryptoConfig needs a DecryptConfig that unwraps the layer keys and the new
+// CryptoConfig an EncryptConfig with the new recipients, which replace the
+// old ones. If the Cipher of the new EncryptConfig differs from the block
+// cipher of a layer, the layer is decrypted and encrypted anew and the new
+// blob is put into the store; otherwise only the keys are rewrapped.
+//
+// Rotate returns a Result for every Item in the same order. The error is
+// only set if the checkpoint cannot be read or written or the context is
+// done; errors of single images are in their Result.
+func Rotate(ctx context.Context, store image.Store, items []Item, oldCc, newCc *config.CryptoConfig, opts Options) ([]Result, error) {
+	if oldCc == nil || oldCc.DecryptConfig == nil {
+		return nil, fmt.Errorf("old CryptoConfig needs a DecryptConfig: %w", ocicrypt.ErrConfiguration)
+	}
+	if newCc == nil || newCc.EncryptConfig == nil {
+		return nil, fmt.Errorf("new CryptoConfig needs an EncryptConfig: %w", ocicrypt.ErrConfiguration)
+	}
+
+	done, err := readCheckpoint(opts.Checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	var checkpoint *os.File
+	if opts.Checkpoint != "" {
+		checkpoint, err = os.OpenFile(opts.Checkpoint, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("could not open checkpoint: %w", err)
+		}
+		defer checkpoint.Close()
+	}
+
+	r := &rotator{
+		store:      store,
+		dc:         oldCc.DecryptConfig,
+		ec:         newCc.EncryptConfig,
+		opts:       opts,
+		checkpoint: checkpoint,
+		results:    make([]Result, len(items)),
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indices {
+				r.rotateItem(ctx, idx, items[idx], done)
+			}
+		}()
+	}
+feed:
+	for idx := range items {
+		select {
+		case indices <- idx:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indices)
+	wg.Wait()
+
+	if r.fatal != nil {
+		return r.results, r.fatal
+	}
+	return r.results, ctx.Err()
+}
+
+// rotator holds the state shared by the workers of a rotation
+type rotator struct {
+	store      image.Store
+	dc         *config.DecryptConfig
+	ec         *config.EncryptConfig
+	opts       Options
+	checkpoint *os.File
+
+	mu       sync.Mutex
+	results  []Result
+	finished int
+	failed   int
+	fatal    error
+}
+
+func (r *rotator) rotateItem(ctx context.Context, idx int, item Item, done map[checkpointEntry]bool) {
+	result := Result{Name: item.Name}
+	entry, err := newCheckpointEntry(item)
+	if err != nil {
+		result.Err = err
+	} else if done[entry] {
+		result.Skipped = true
+	} else {
+		result.Manifest, result.Err = r.rotateManifest(ctx, item.Manifest)
+		if result.Err == nil && r.opts.Commit != nil {
+			result.Err = r.opts.Commit(ctx, item, result.Manifest)
+		}
+		if result.Err != nil {
+			result.Manifest = ocispec.Manifest{}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if result.Err == nil && !result.Skipped && r.checkpoint != nil && r.fatal == nil {
+		if err := writeCheckpoint(r.checkpoint, entry); err != nil {
+			r.fatal = err
+		}
+	}
+	r.results[idx] = result
+	r.finished++
+	if result.Err != nil {
+		r.failed++
+	}
+	if r.opts.Progress != nil {
+		r.opts.Progress(Progress{Total: len(r.results), Done: r.finished, Failed: r.failed, Result: result})
+	}
+}
+
+// rotateManifest rotates the keys of the encrypted layers of a manifest
+func (r *rotator) rotateManifest(ctx context.Context, manifest ocispec.Manifest) (ocispec.Manifest, error) {
+	newManifest := manifest
+	newManifest.Layers = make([]ocispec.Descriptor, len(manifest.Layers))
+	for i, desc := range manifest.Layers {
+		if err := ctx.Err(); err != nil {
+			return ocispec.Manifest{}, err
+		}
+		if len(ocicrypt.GetWrappedKeysMap(desc)) == 0 {
+			newManifest.Layers[i] = desc
+			continue
+		}
+		var (
+			newDesc ocispec.Descriptor
+			err     error
+		)
+		if r.ec.Cipher != "" && r.ec.Cipher != layerCipher(desc) {
+			newDesc, err = r.reencrypt(ctx, desc)
+		} else {
+			newDesc, err = r.rewrap(ctx, desc)
+		}
+		if err != nil {
+			return ocispec.Manifest{}, err
+		}
+		newManifest.Layers[i] = newDesc
+	}
+	return newManifest, nil
+}
+
+// rewrap unwraps the key of the layer with the old keys and wraps it for the
+// new recipients; the blob of the layer stays the same
+func (r *rotator) rewrap(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	ec := *r.ec
+	ec.DecryptConfig = *r.dc
+	annotations, err := ocicrypt.RewrapLayerKey(ctx, &ec, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return withAnnotations(desc, annotations), nil
+}
+
+// reencrypt decrypts the layer and encrypts it with the new cipher for the
+// new recipients
+func (r *rotator) reencrypt(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	blob, err := r.store.GetBlob(ctx, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("could not get layer %s: %w", desc.Digest, err)
+	}
+	defer blob.Close()
+
+	ec := *r.ec
+	ec.DecryptConfig = *r.dc
+	encLayerReader, finalizer, err := ocicrypt.RotateLayerKey(ctx, &ec, blob, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	// a layer that is not stored to the end releases its slot of the
+	// concurrently processed layers
+	if c, ok := encLayerReader.(io.Closer); ok {
+		defer c.Close()
+	}
+	d, size, err := r.store.PutBlob(ctx, encLayerReader)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("could not store re-encrypted layer %s: %w", desc.Digest, err)
+	}
+	annotations, _, err := finalizer()
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	newDesc := withAnnotations(desc, annotations)
+	newDesc.Digest = d
+	newDesc.Size = size
+	return newDesc, nil
+}
+
+// withAnnotations returns the descriptor with its encryption annotations
+// replaced by the given ones
+func withAnnotations(desc ocispec.Descriptor, annotations map[string]string) ocispec.Descriptor {
+	newDesc := desc
+	newDesc.Annotations = ocicrypt.FilterOutAnnotations(desc.Annotations)
+	if newDesc.Annotations == nil {
+		newDesc.Annotations = make(map[string]string)
+	}
+	for k, v := range annotations {
+		newDesc.Annotations[k] = v
+	}
+	return newDesc
+}
+
+// layerCipher returns the block cipher an encrypted layer was encrypted with
+func layerCipher(desc ocispec.Descriptor) blockcipher.LayerCipherType {
+	pubOptsData, err := base64.StdEncoding.DecodeString(desc.Annotations["org.opencontainers.image.enc.pubopts"])
+	if err != nil {
+		return ""
+	}
+	pubOpts := blockcipher.PublicLayerBlockCipherOptions{}
+	if err := json.Unmarshal(pubOptsData, &pubOpts); err != nil {
+		return ""
+	}
+	return pubOpts.CipherType
+}
+
+func newCheckpointEntry(item Item) (checkpointEntry, error) {
+	manifestData, err := json.Marshal(item.Manifest)
+	if err != nil {
+		return checkpointEntry{}, fmt.Errorf("could not JSON marshal manifest: %w", err)
+	}
+	return checkpointEntry{
+		Name:     item.Name,
+		Manifest: digest.FromBytes(manifestData),
+	}, nil
+}
+
+// readCheckpoint returns the entries of the checkpoint file at path; a
+// missing file has no entries
+func readCheckpoint(path string) (map[checkpointEntry]bool, error) {
+	done := make(map[checkpointEntry]bool)
+	if path == "" {
+		return done, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return done, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not open checkpoint: %w", err)
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			// an incomplete last line was written when the rotation was
+			// interrupted; the image is rotated again
+			return done, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read checkpoint: %w", err)
+		}
+		var entry checkpointEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("could not parse checkpoint %s: %w", path, err)
+		}
+		done[entry] = true
+	}
+}
+
+// writeCheckpoint appends the entry to the checkpoint file and syncs it
+func writeCheckpoint(f *os.File, entry checkpointEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("could not JSON marshal checkpoint entry: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("could not write checkpoint: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("could not sync checkpoint: %w", err)
+	}
+	return nil
+}
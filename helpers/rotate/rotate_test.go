@@ -0,0 +1,200 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rotate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/containers/ocicrypt"
+	"github.com/containers/ocicrypt/blockcipher"
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/helpers/image"
+	"github.com/containers/ocicrypt/utils"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type memoryStore struct {
+	sync.Mutex
+	blobs map[digest.Digest][]byte
+}
+
+func (ms *memoryStore) GetBlob(_ context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	data, ok := ms.blobs[desc.Digest]
+	if !ok {
+		return nil, errors.New("blob not found")
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (ms *memoryStore) PutBlob(_ context.Context, r io.Reader) (digest.Digest, int64, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", 0, err
+	}
+	ms.Lock()
+	defer ms.Unlock()
+	d := digest.FromBytes(data)
+	ms.blobs[d] = data
+	return d, int64(len(data)), nil
+}
+
+func newKeys(t *testing.T) (*config.EncryptConfig, *config.DecryptConfig) {
+	pubKey, privKey, err := utils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &config.EncryptConfig{
+		Parameters: map[string][][]byte{"pubkeys": {pubKey}},
+	}, &config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {privKey},
+			"privkeys-passwords": {nil},
+		},
+	}
+}
+
+func TestRotate(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryStore{blobs: map[digest.Digest][]byte{}}
+	oldEc, oldDc := newKeys(t)
+	newEc, newDc := newKeys(t)
+
+	var items []Item
+	for i := 0; i < 4; i++ {
+		d, size, err := store.PutBlob(ctx, bytes.NewReader([]byte(fmt.Sprintf("layer of image %d", i))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest := ocispec.Manifest{
+			Layers: []ocispec.Descriptor{{MediaType: ocispec.MediaTypeImageLayer, Digest: d, Size: size}},
+		}
+		encManifest, err := image.EncryptImage(ctx, store, manifest, oldEc, image.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, Item{Name: fmt.Sprintf("image%d", i), Manifest: encManifest})
+	}
+
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	var progress []Progress
+	var commitLock sync.Mutex
+	committed := 0
+	opts := Options{
+		Concurrency: 2,
+		Checkpoint:  checkpoint,
+		Commit: func(_ context.Context, item Item, _ ocispec.Manifest) error {
+			if item.Name == "image3" {
+				return errors.New("registry unavailable")
+			}
+			commitLock.Lock()
+			defer commitLock.Unlock()
+			committed++
+			return nil
+		},
+		Progress: func(p Progress) { progress = append(progress, p) },
+	}
+	results, err := Rotate(ctx, store, items, &config.CryptoConfig{DecryptConfig: oldDc}, &config.CryptoConfig{EncryptConfig: newEc}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if committed != 3 || len(progress) != 4 || progress[3].Done != 4 || progress[3].Failed != 1 {
+		t.Fatalf("unexpected progress %v after %d commits", progress, committed)
+	}
+	for i, result := range results[:3] {
+		if result.Err != nil || result.Name != items[i].Name {
+			t.Fatalf("unexpected result %v", result)
+		}
+		layer := result.Manifest.Layers[0]
+		if layer.Digest != items[i].Manifest.Layers[0].Digest {
+			t.Fatal("rewrapping changed the layer")
+		}
+		if _, _, err := ocicrypt.DecryptLayer(oldDc, nil, layer, true); !errors.Is(err, ocicrypt.ErrNoDecryptionKey) {
+			t.Fatalf("expected old key to be removed, got %v", err)
+		}
+		if _, _, err := ocicrypt.DecryptLayer(newDc, nil, layer, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if results[3].Err == nil {
+		t.Fatal("expected commit error")
+	}
+
+	// resuming only rotates the image that failed
+	opts.Commit = nil
+	results, err = Rotate(ctx, store, items, &config.CryptoConfig{DecryptConfig: oldDc}, &config.CryptoConfig{EncryptConfig: newEc}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result.Skipped != (i < 3) || result.Err != nil {
+			t.Fatalf("unexpected result %v", result)
+		}
+	}
+}
+
+func TestRotateCipherChange(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the AES_256_GCM_CHUNKED block cipher")
+
+	ctx := context.Background()
+	store := &memoryStore{blobs: map[digest.Digest][]byte{}}
+	oldEc, oldDc := newKeys(t)
+	newEc, newDc := newKeys(t)
+	newEc.Cipher = blockcipher.AES256GCMChunked
+
+	data := []byte("layer data")
+	d, size, err := store.PutBlob(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ocispec.Manifest{
+		Layers: []ocispec.Descriptor{{MediaType: ocispec.MediaTypeImageLayer, Digest: d, Size: size}},
+	}
+	encManifest, err := image.EncryptImage(ctx, store, manifest, oldEc, image.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := Rotate(ctx, store, []Item{{Name: "image", Manifest: encManifest}}, &config.CryptoConfig{DecryptConfig: oldDc}, &config.CryptoConfig{EncryptConfig: newEc}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err != nil {
+		t.Fatal(results[0].Err)
+	}
+	layer := results[0].Manifest.Layers[0]
+	if layer.Digest == encManifest.Layers[0].Digest || layerCipher(layer) != blockcipher.AES256GCMChunked {
+		t.Fatal("layer was not re-encrypted")
+	}
+	decManifest, err := image.DecryptImage(ctx, store, results[0].Manifest, newDc, image.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decManifest.Layers[0].Digest != d {
+		t.Fatal("re-encrypted layer does not decrypt to the original data")
+	}
+}
@@ -0,0 +1,167 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package keyhelper obtains the private keys for decrypting an image on
+// demand from key helpers, programs in the style of the docker credential
+// helpers, so that keys can live in OS keychains or secret stores rather than
+// in files. The key helper named <name> is the executable
+// ocicrypt-key-helper-<name>; ocicrypt runs it as
+// 'ocicrypt-key-helper-<name> get' with a Request in JSON on its standard
+// input and reads a Response in JSON from its standard output.
+package keyhelper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/containers/ocicrypt/errdefs"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// DefaultTimeout is the time a Helper waits for the key helper to finish
+const DefaultTimeout = 30 * time.Second
+
+// Prefix is the prefix of the names of key helper executables
+const Prefix = "ocicrypt-key-helper-"
+
+// Request is the input of a key helper
+type Request struct {
+	// Tenant is the tenant whose keys are asked for, if the DecryptConfig
+	// has one; key helpers serving many tenants must only return the keys
+	// of this tenant
+	Tenant string `json:"tenant,omitempty"`
+	// Reference is the reference of the image, such as
+	// registry.example.com/app:1.0
+	Reference string `json:"reference,omitempty"`
+	// Layer is the digest of the layer
+	Layer digest.Digest `json:"layer,omitempty"`
+	// Recipients are the recipients the layer key is wrapped for, as far
+	// as the keywrap schemes tell them; they are hints for which keys are
+	// needed
+	Recipients []string `json:"recipients,omitempty"`
+}
+
+// Key is a private key returned by a key helper
+type Key struct {
+	// PrivateKey is the private key in any of the formats accepted in the
+	// privkeys of a DecryptConfig, base64 encoded in JSON
+	PrivateKey []byte `json:"privateKey"`
+	// Password is the password of an encrypted private key, base64 encoded
+	// in JSON
+	Password []byte `json:"password,omitempty"`
+}
+
+// Response is the output of a key helper; a key helper that has no keys for
+// a request returns no keys rather than failing
+type Response struct {
+	Keys []Key `json:"keys"`
+}
+
+// Helper runs a key helper
+type Helper struct {
+	// Name is the name of the key helper; ocicrypt-key-helper-<Name> is
+	// looked up in the PATH
+	Name string
+	// Path is the path of the key helper executable; if set, it is used
+	// instead of looking up the Name
+	Path string
+	// Env is the environment of the key helper; if nil, the environment of
+	// the process is used
+	Env []string
+	// Timeout is the time the key helper has to return the keys; if 0,
+	// DefaultTimeout is used
+	Timeout time.Duration
+}
+
+// Get runs the key helper with the request and returns the keys it returned
+func (h *Helper) Get(ctx context.Context, req Request) ([]Key, error) {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not JSON marshal request: %w", err)
+	}
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	path := h.Path
+	if path == "" {
+		path = Prefix + h.Name
+	}
+	cmd := exec.CommandContext(ctx, path, "get")
+	cmd.Env = h.Env
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, errdefs.WithCategory(errdefs.ErrProviderUnreachable, fmt.Errorf("key helper %s did not finish: %w", path, ctx.Err()))
+		}
+		if _, ok := err.(*exec.ExitError); !ok {
+			return nil, errdefs.WithCategory(errdefs.ErrProviderUnreachable, fmt.Errorf("could not run key helper %s: %w", path, err))
+		}
+		return nil, fmt.Errorf("key helper %s failed: %s: %w", path, strings.TrimSpace(stderr.String()), errdefs.ErrProviderUnreachable)
+	}
+
+	var resp Response
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrProtocol, fmt.Errorf("could not parse output of key helper %s: %w", path, err))
+	}
+	return resp.Keys, nil
+}
+
+// Lookup obtains the private keys for decrypting the layers of an image from
+// key helpers; it is set per image in the DecryptConfig along with the
+// reference of the image
+type Lookup struct {
+	// Helpers are the key helpers, which are asked in turn
+	Helpers []*Helper
+	// Reference is the reference of the image
+	Reference string
+}
+
+// Keys asks all key helpers for the keys of the tenant to decrypt the given
+// layer, whose key is wrapped for the recipients, and returns the private
+// keys and their passwords. It fails if any of the key helpers fails.
+func (l *Lookup) Keys(ctx context.Context, tenant string, layer digest.Digest, recipients []string) ([][]byte, [][]byte, error) {
+	req := Request{
+		Tenant:     tenant,
+		Reference:  l.Reference,
+		Layer:      layer,
+		Recipients: recipients,
+	}
+	var privKeys, passwords [][]byte
+	for _, h := range l.Helpers {
+		keys, err := h.Get(ctx, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, key := range keys {
+			privKeys = append(privKeys, key.PrivateKey)
+			passwords = append(passwords, key.Password)
+		}
+	}
+	return privKeys, passwords, nil
+}
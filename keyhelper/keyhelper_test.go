@@ -0,0 +1,89 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keyhelper
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/opencontainers/go-digest"
+)
+
+// writeHelper writes a fake key helper named test into dir that returns a
+// key for images of registry.example.com
+func writeHelper(t *testing.T, dir string) string {
+	path := filepath.Join(dir, Prefix+"test")
+	script := `#!/bin/sh
+[ "$1" = get ] || exit 2
+if grep -q '"reference":"registry.example.com/'; then
+	echo '{"keys":[{"privateKey":"a2V5","password":"cGFzc3dvcmQ="}]}'
+else
+	echo '{"keys":[]}'
+fi
+`
+	if err := os.WriteFile(path, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLookup(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	writeHelper(t, dir)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	l := &Lookup{
+		Helpers:   []*Helper{{Name: "test"}},
+		Reference: "registry.example.com/app:1.0",
+	}
+	layer := digest.FromString("layer")
+
+	privKeys, passwords, err := l.Keys(ctx, "", layer, []string{"[jwe]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(privKeys) != 1 || string(privKeys[0]) != "key" || string(passwords[0]) != "password" {
+		t.Fatalf("unexpected keys %q and passwords %q", privKeys, passwords)
+	}
+
+	l.Reference = "docker.io/library/app:1.0"
+	if privKeys, _, err := l.Keys(ctx, "", layer, nil); err != nil || len(privKeys) != 0 {
+		t.Fatalf("expected no keys, got %d: %v", len(privKeys), err)
+	}
+
+	l.Helpers = []*Helper{{Name: "missing"}}
+	if _, _, err := l.Keys(ctx, "", layer, nil); !errors.Is(err, errdefs.ErrProviderUnreachable) {
+		t.Fatalf("expected ErrProviderUnreachable, got %v", err)
+	}
+}
+
+func TestHelperFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), Prefix+"failing")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\necho 'keychain is locked' >&2\nexit 1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	h := &Helper{Path: path}
+	if _, err := h.Get(context.Background(), Request{}); !errors.Is(err, errdefs.ErrProviderUnreachable) || !strings.Contains(err.Error(), "keychain is locked") {
+		t.Fatalf("expected the output of the key helper in the error, got %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package age
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/limits"
+	"golang.org/x/crypto/curve25519"
+)
+
+// The age files are written and read by filippo.io/age, the reference
+// implementation of the age v1 file format (https://age-encryption.org/v1).
+
+const identityHRP = "age-secret-key-"
+
+// recipient is an age recipient along with its string form, by which the
+// recipients are sorted and deduplicated
+type recipient struct {
+	age.Recipient
+	name string
+}
+
+// String returns the recipient as age1... string or, for SSH recipients, in
+// authorized_keys format
+func (r recipient) String() string {
+	return r.name
+}
+
+// identity is an age identity along with the key ID reported for the layer
+// keys it unwraps
+type identity struct {
+	age.Identity
+	keyID string
+}
+
+// parseRecipient parses a bech32 encoded recipient, age1...
+func parseRecipient(s string) (recipient, error) {
+	r, err := age.ParseX25519Recipient(s)
+	if err != nil {
+		return recipient{}, fmt.Errorf("age: malformed recipient %q: %v: %w", s, err, errdefs.ErrKeyMaterial)
+	}
+	return recipient{Recipient: r, name: r.String()}, nil
+}
+
+// parseIdentity parses a bech32 encoded identity, AGE-SECRET-KEY-1...
+func parseIdentity(s string) (*age.X25519Identity, error) {
+	i, err := age.ParseX25519Identity(s)
+	if err != nil {
+		return nil, fmt.Errorf("age: %v: %w", err, errdefs.ErrKeyMaterial)
+	}
+	return i, nil
+}
+
+// newX25519Identity returns the X25519 identity with the given secret key
+func newX25519Identity(secretKey []byte) (*age.X25519Identity, error) {
+	if len(secretKey) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("age: secret key has %d bytes instead of %d: %w", len(secretKey), curve25519.ScalarSize, errdefs.ErrKeyMaterial)
+	}
+	return parseIdentity(strings.ToUpper(bech32Encode(identityHRP, secretKey)))
+}
+
+// GenerateIdentity generates a new X25519 identity and returns it along with
+// its recipient, as AGE-SECRET-KEY-1... and age1... strings
+func GenerateIdentity(rand io.Reader) (identity string, recipient string, err error) {
+	secretKey := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand, secretKey); err != nil {
+		return "", "", fmt.Errorf("age: could not generate identity: %w", err)
+	}
+	i, err := newX25519Identity(secretKey)
+	if err != nil {
+		return "", "", err
+	}
+	return i.String(), i.Recipient().String(), nil
+}
+
+// encrypt encrypts the plaintext for the recipients into an age file
+func encrypt(recipients []recipient, plaintext []byte) ([]byte, error) {
+	ageRecipients := make([]age.Recipient, 0, len(recipients))
+	for _, r := range recipients {
+		ageRecipients = append(ageRecipients, r)
+	}
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, ageRecipients...)
+	if err != nil {
+		return nil, fmt.Errorf("age: could not wrap the file key: %w", err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, fmt.Errorf("age: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("age: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// matchingIdentity records which identity unwrapped the file key and checks
+// the number of recipient stanzas against the limits before any identity
+// tries them
+type matchingIdentity struct {
+	identity
+	limits  *limits.Limits
+	matched **identity
+}
+
+func (mi *matchingIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	if err := mi.limits.CheckRecipients(len(stanzas)); err != nil {
+		return nil, err
+	}
+	fileKey, err := mi.Identity.Unwrap(stanzas)
+	if err == nil {
+		*mi.matched = &mi.identity
+	}
+	return fileKey, err
+}
+
+// decrypt decrypts an age file with the first of the identities that can
+// unwrap the file key and returns the plaintext along with that identity;
+// the plaintext may not be larger than maxSize unless maxSize is 0
+func decrypt(identities []identity, data []byte, l *limits.Limits, maxSize int) ([]byte, identity, error) {
+	var matched *identity
+	ageIdentities := make([]age.Identity, 0, len(identities))
+	for _, i := range identities {
+		ageIdentities = append(ageIdentities, &matchingIdentity{identity: i, limits: l, matched: &matched})
+	}
+	r, err := age.Decrypt(bytes.NewReader(data), ageIdentities...)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		switch {
+		case errors.Is(err, errdefs.ErrLimitExceeded):
+			return nil, identity{}, err
+		case errors.As(err, &noMatch):
+			return nil, identity{}, fmt.Errorf("age: %v: %w", err, errdefs.ErrNoDecryptionKey)
+		case matched != nil:
+			// the header MAC or the nonce of the payload are wrong
+			return nil, identity{}, fmt.Errorf("age: %v: %w", err, errdefs.ErrIntegrity)
+		}
+		return nil, identity{}, fmt.Errorf("age: %v: %w", err, errdefs.ErrProtocol)
+	}
+	if maxSize > 0 {
+		r = io.LimitReader(r, int64(maxSize)+1)
+	}
+	plaintext, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, identity{}, fmt.Errorf("age: payload authentication failed: %v: %w", err, errdefs.ErrIntegrity)
+	}
+	if maxSize > 0 && len(plaintext) > maxSize {
+		return nil, identity{}, fmt.Errorf("age: payload is larger than %d bytes: %w", maxSize, errdefs.ErrLimitExceeded)
+	}
+	return plaintext, *matched, nil
+}
@@ -0,0 +1,147 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package age
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"filippo.io/age"
+	"github.com/containers/ocicrypt/errdefs"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SSH agents only sign, so they cannot unwrap the ssh-ed25519 and ssh-rsa
+// stanzas. Instead, the signature of an agent key over a fixed challenge
+// serves as the secret from which an X25519 identity is derived. Since
+// ed25519 and RSA PKCS #1 v1.5 signatures are deterministic, the agent
+// derives the same identity every time, and its recipient is handed out
+// like any other X25519 recipient.
+
+const (
+	sshAgentChallenge = "ocicrypt age ssh-agent identity v1"
+	sshAgentLabel     = "ocicrypt/age/ssh-agent"
+)
+
+// dialSSHAgent connects to the SSH agent at SSH_AUTH_SOCK
+var dialSSHAgent = func() (agent.ExtendedAgent, io.Closer, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, nil, fmt.Errorf("age: SSH_AUTH_SOCK is not set: %w", errdefs.ErrProviderUnreachable)
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("age: could not connect to the SSH agent: %v: %w", err, errdefs.ErrProviderUnreachable)
+	}
+	return agent.NewClient(conn), conn, nil
+}
+
+// SSHAgentRecipient returns the recipient, age1..., of the X25519 identity
+// derived from the key of the SSH agent with the given public key in
+// authorized_keys format. Layer keys wrapped for the recipient can be
+// unwrapped with the agent by passing the public key in the age-ssh-agent
+// parameter.
+func SSHAgentRecipient(pubKey []byte) (string, error) {
+	a, closer, err := dialSSHAgent()
+	if err != nil {
+		return "", err
+	}
+	defer closer.Close()
+
+	sshKey, err := parseSSHAgentKey(pubKey)
+	if err != nil {
+		return "", err
+	}
+	i, err := sshAgentIdentity(a, sshKey)
+	if err != nil {
+		return "", err
+	}
+	return i.Recipient().String(), nil
+}
+
+// parseSSHAgentKey parses the public key of an agent key in authorized_keys
+// format
+func parseSSHAgentKey(pubKey []byte) (ssh.PublicKey, error) {
+	sshKey, _, _, _, err := ssh.ParseAuthorizedKey(pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("age: malformed SSH agent key %q: %v: %w", pubKey, err, errdefs.ErrKeyMaterial)
+	}
+	return sshKey, nil
+}
+
+// sshAgentIdentity derives the X25519 identity of the agent key; only ed25519
+// and RSA keys, whose signatures are deterministic, can be used
+func sshAgentIdentity(a agent.ExtendedAgent, sshKey ssh.PublicKey) (*age.X25519Identity, error) {
+	var flags agent.SignatureFlags
+	switch sshKey.Type() {
+	case ssh.KeyAlgoED25519:
+	case ssh.KeyAlgoRSA:
+		flags = agent.SignatureFlagRsaSha256
+	default:
+		return nil, fmt.Errorf("age: SSH agent keys of type %s cannot be used since their signatures are not deterministic: %w", sshKey.Type(), errdefs.ErrUnsupportedKey)
+	}
+	sig, err := a.SignWithFlags(sshKey, []byte(sshAgentChallenge), flags)
+	if err != nil {
+		return nil, fmt.Errorf("age: the SSH agent could not sign with %s: %v: %w", ssh.FingerprintSHA256(sshKey), err, errdefs.ErrNoDecryptionKey)
+	}
+	if err := sshKey.Verify([]byte(sshAgentChallenge), sig); err != nil {
+		return nil, fmt.Errorf("age: the SSH agent returned an invalid signature for %s: %w", ssh.FingerprintSHA256(sshKey), errdefs.ErrKeyMaterial)
+	}
+	secretKey := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, sig.Blob, sshKey.Marshal(), []byte(sshAgentLabel)), secretKey); err != nil {
+		return nil, err
+	}
+	return newX25519Identity(secretKey)
+}
+
+// sshAgentIdentities derives the identities of the agent keys with the given
+// public keys
+func sshAgentIdentities(pubKeys [][]byte) ([]identity, error) {
+	var sshKeys []ssh.PublicKey
+	for _, line := range splitLines(pubKeys) {
+		sshKey, err := parseSSHAgentKey([]byte(line))
+		if err != nil {
+			return nil, err
+		}
+		sshKeys = append(sshKeys, sshKey)
+	}
+	if len(sshKeys) == 0 {
+		return nil, nil
+	}
+
+	a, closer, err := dialSSHAgent()
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	var identities []identity
+	for _, sshKey := range sshKeys {
+		i, err := sshAgentIdentity(a, sshKey)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity{Identity: i, keyID: i.Recipient().String()})
+	}
+	return identities, nil
+}
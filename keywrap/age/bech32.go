@@ -0,0 +1,94 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package age
+
+import (
+	"strings"
+)
+
+// bech32 encoding as specified in BIP 173, which filippo.io/age does not
+// export; it is needed to hand the X25519 secret keys derived from SSH agent
+// keys to age.ParseX25519Identity
+
+const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+var generator = []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+func polymod(values []byte) uint32 {
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+func hrpExpand(hrp string) []byte {
+	var ret []byte
+	for _, c := range []byte(hrp) {
+		ret = append(ret, c>>5)
+	}
+	ret = append(ret, 0)
+	for _, c := range []byte(hrp) {
+		ret = append(ret, c&31)
+	}
+	return ret
+}
+
+// convertBits regroups the bits of data from bytes to groups of 5 bits, the
+// last one padded with zeros
+func convertBits(data []byte) []byte {
+	var (
+		ret  []byte
+		acc  uint32
+		bits uint
+	)
+	for _, value := range data {
+		acc = acc<<8 | uint32(value)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			ret = append(ret, byte(acc>>bits)&31)
+		}
+	}
+	if bits > 0 {
+		ret = append(ret, byte(acc<<(5-bits))&31)
+	}
+	return ret
+}
+
+// bech32Encode encodes the data with the lower case human readable part hrp
+func bech32Encode(hrp string, data []byte) string {
+	values := convertBits(data)
+	mod := polymod(append(append(hrpExpand(hrp), values...), 0, 0, 0, 0, 0, 0)) ^ 1
+
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, v := range values {
+		sb.WriteByte(charset[v])
+	}
+	for i := 0; i < 6; i++ {
+		sb.WriteByte(charset[(mod>>uint(5*(5-i)))&31])
+	}
+	return sb.String()
+}
@@ -0,0 +1,214 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package age
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
+	"github.com/containers/ocicrypt/keywrap"
+	"github.com/containers/ocicrypt/log"
+)
+
+// errUnavailable is returned in FIPS 140-only mode since age relies on X25519
+// and ChaCha20-Poly1305
+var errUnavailable = fmt.Errorf("age is not available in FIPS 140-only mode: %w", errdefs.ErrDisallowedAlgorithm)
+
+type ageKeyWrapper struct {
+}
+
+func (kw *ageKeyWrapper) GetAnnotationID() string {
+	return "org.opencontainers.image.enc.keys.age"
+}
+
+// NewKeyWrapper returns a new key wrapping interface using age X25519 and SSH
+// recipients; the wrapped keys are age files that the age tool can decrypt
+func NewKeyWrapper() keywrap.KeyWrapper {
+	return &ageKeyWrapper{}
+}
+
+// WrapKeys encrypts the optsData, which describe the symmetric key used for
+// encrypting the layer, for the age recipients of the age-recipients parameter
+func (kw *ageKeyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	recipients, err := parseRecipients(ec.Parameters["age-recipients"])
+	if err != nil {
+		return nil, err
+	}
+	// no recipients is not an error...
+	if len(recipients) == 0 {
+		return nil, nil
+	}
+	if fips.Enforced() {
+		return nil, errUnavailable
+	}
+	return encrypt(recipients, optsData)
+}
+
+func (kw *ageKeyWrapper) UnwrapKey(dc *config.DecryptConfig, annotation []byte) ([]byte, error) {
+	optsData, _, err := kw.UnwrapKeyID(dc, annotation)
+	return optsData, err
+}
+
+// UnwrapKeyID decrypts the symmetric key with which the layer is encrypted
+// and returns the recipient of the age identity that decrypted it; the
+// identities are those of the age-identities parameter and those derived from
+// the SSH agent keys of the age-ssh-agent parameter
+func (kw *ageKeyWrapper) UnwrapKeyID(dc *config.DecryptConfig, annotation []byte) ([]byte, string, error) {
+	if fips.Enforced() {
+		return nil, "", errUnavailable
+	}
+	identities, err := parseIdentities(dc.Parameters["age-identities"])
+	if err != nil {
+		return nil, "", err
+	}
+	agentIdentities, err := sshAgentIdentities(dc.Parameters["age-ssh-agent"])
+	if err != nil {
+		if len(identities) == 0 {
+			return nil, "", err
+		}
+		log.L().Debug("SSH agent keys could not be used", log.KeyError, err)
+	}
+	identities = append(identities, agentIdentities...)
+	if len(identities) == 0 {
+		return nil, "", fmt.Errorf("No age identities found for age decryption: %w", errdefs.ErrNoDecryptionKey)
+	}
+	optsData, i, err := decrypt(identities, annotation, dc.GetLimits(), keywrap.MaxOptsDataSize)
+	if err != nil {
+		return nil, "", err
+	}
+	return optsData, "age:" + i.keyID, nil
+}
+
+func (kw *ageKeyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
+	return len(kw.GetPrivateKeys(dcparameters)) == 0
+}
+
+// GetPrivateKeys returns the identities and the public keys of the SSH agent
+// keys
+func (kw *ageKeyWrapper) GetPrivateKeys(dcparameters map[string][][]byte) [][]byte {
+	return append(append([][]byte{}, dcparameters["age-identities"]...), dcparameters["age-ssh-agent"]...)
+}
+
+func (kw *ageKeyWrapper) GetKeyIdsFromPacket(_ string) ([]uint64, error) {
+	return nil, nil
+}
+
+// GetRecipients returns a placeholder since the recipient stanzas of age
+// files do not reveal the recipients
+func (kw *ageKeyWrapper) GetRecipients(_ string) ([]string, error) {
+	return []string{"[age]"}, nil
+}
+
+// CountRecipients returns the number of recipient stanzas in the headers of
+// the age files
+func (kw *ageKeyWrapper) CountRecipients(b64files string) (int, error) {
+	n := 0
+	for _, b64file := range strings.Split(b64files, ",") {
+		file, err := base64.StdEncoding.DecodeString(b64file)
+		if err != nil {
+			return 0, fmt.Errorf("age: could not base64 decode the wrapped key: %w", errdefs.ErrProtocol)
+		}
+		// the header ends with the line holding its MAC
+		header, _, _ := bytes.Cut(file, []byte("\n---"))
+		for _, line := range bytes.Split(header, []byte("\n")) {
+			if bytes.HasPrefix(line, []byte("-> ")) {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// parseRecipients parses the recipients, each given as age1... string, as
+// OpenSSH public key in authorized_keys format or as recipients file with one
+// per line; duplicates are dropped and the others are sorted so that the
+// stanzas do not depend on the order of the recipients
+func parseRecipients(values [][]byte) ([]recipient, error) {
+	var recipients []recipient
+	seen := make(map[string]bool)
+	for _, line := range splitLines(values) {
+		var (
+			r   recipient
+			err error
+		)
+		if strings.HasPrefix(line, "ssh-") {
+			r, err = parseSSHRecipient(line)
+		} else {
+			r, err = parseRecipient(line)
+		}
+		if err != nil {
+			return nil, err
+		}
+		s := r.String()
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		recipients = append(recipients, r)
+	}
+	sort.Slice(recipients, func(i, j int) bool {
+		return recipients[i].String() < recipients[j].String()
+	})
+	return recipients, nil
+}
+
+// parseIdentities parses the identities, each given as AGE-SECRET-KEY-1...
+// string, as identity file with one per line as written by age-keygen or as
+// unencrypted SSH private key
+func parseIdentities(values [][]byte) ([]identity, error) {
+	var identities []identity
+	for _, value := range values {
+		if bytes.Contains(value, []byte("-----BEGIN ")) {
+			i, err := parseSSHIdentity(value)
+			if err != nil {
+				return nil, err
+			}
+			identities = append(identities, i)
+			continue
+		}
+		for _, line := range splitLines([][]byte{value}) {
+			i, err := parseIdentity(line)
+			if err != nil {
+				return nil, err
+			}
+			identities = append(identities, identity{Identity: i, keyID: i.Recipient().String()})
+		}
+	}
+	return identities, nil
+}
+
+// splitLines returns the lines of the values that are neither empty nor
+// comments starting with #
+func splitLines(values [][]byte) []string {
+	var lines []string
+	for _, value := range values {
+		for _, line := range strings.Split(string(value), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
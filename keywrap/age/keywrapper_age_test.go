@@ -0,0 +1,430 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package age
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/limits"
+	"github.com/containers/ocicrypt/utils"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestParseIdentity(t *testing.T) {
+	i, err := parseIdentity("AGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := i.Recipient().String(); r != "age1zvkyg2lqzraa2lnjvqej32nkuu0ues2s82hzrye869xeexvn73equnujwj" {
+		t.Fatalf("unexpected recipient %s", r)
+	}
+
+	for _, s := range []string{
+		"age1zvkyg2lqzraa2lnjvqej32nkuu0ues2s82hzrye869xeexvn73equnujwj",
+		"AGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEY",
+		"age-secret-key-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX",
+	} {
+		if _, err := parseIdentity(s); !errors.Is(err, errdefs.ErrKeyMaterial) {
+			t.Fatalf("expected ErrKeyMaterial for %s, got %v", s, err)
+		}
+	}
+}
+
+func createValidAgeCcs() ([]config.CryptoConfig, [][]byte, error) {
+	var identities, recipients [][]byte
+	for i := 0; i < 2; i++ {
+		identity, recipient, err := GenerateIdentity(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		identities = append(identities, []byte("# created by a test\n"+identity+"\n"))
+		recipients = append(recipients, []byte(recipient))
+	}
+
+	validAgeCcs := []config.CryptoConfig{
+		// Key 1
+		{
+			EncryptConfig: &config.EncryptConfig{
+				Parameters: map[string][][]byte{
+					"age-recipients": {recipients[0]},
+				},
+				DecryptConfig: config.DecryptConfig{
+					Parameters: map[string][][]byte{
+						"age-identities": {identities[0]},
+					},
+				},
+			},
+			DecryptConfig: &config.DecryptConfig{
+				Parameters: map[string][][]byte{
+					"age-identities": {identities[0]},
+				},
+			},
+		},
+		// Key 2, with both recipients in a recipients file
+		{
+			EncryptConfig: &config.EncryptConfig{
+				Parameters: map[string][][]byte{
+					"age-recipients": {bytes.Join(recipients, []byte("\n"))},
+				},
+				DecryptConfig: config.DecryptConfig{
+					Parameters: map[string][][]byte{
+						"age-identities": {identities[1]},
+					},
+				},
+			},
+			DecryptConfig: &config.DecryptConfig{
+				Parameters: map[string][][]byte{
+					"age-identities": {identities[1]},
+				},
+			},
+		},
+	}
+	return validAgeCcs, recipients, nil
+}
+
+func TestKeyWrapAgeSuccess(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the age scheme")
+
+	validAgeCcs, recipients, err := createValidAgeCcs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, cc := range validAgeCcs {
+		kw := NewKeyWrapper()
+
+		data := []byte("This is some secret text")
+
+		wk, err := kw.WrapKeys(cc.EncryptConfig, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ud, keyID, err := kw.(*ageKeyWrapper).UnwrapKeyID(cc.DecryptConfig, wk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, ud) {
+			t.Fatal("Strings don't match")
+		}
+		if keyID != "age:"+string(recipients[i]) {
+			t.Fatalf("unexpected key ID %s", keyID)
+		}
+		n, err := kw.(*ageKeyWrapper).CountRecipients(base64.StdEncoding.EncodeToString(wk))
+		if err != nil || n != i+1 {
+			t.Fatalf("expected %d recipients, got %d: %v", i+1, n, err)
+		}
+	}
+}
+
+// ageVectors are age files written by the age tool, taken from the testdata of
+// filippo.io/age, and by the keywrapper before it used filippo.io/age
+var ageVectors = []struct {
+	name, identity, file, plaintext string
+}{
+	{
+		name:      "age",
+		identity:  "AGE-SECRET-KEY-184JMZMVQH3E6U0PSL869004Y3U2NYV7R30EU99CSEDNPH02YUVFSZW44VU",
+		file:      "YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSA4aHJsTStaQkczRGQ0ZkYyK2E1ODN6ZFRJV0RrOC9SNDFrQ1lac3Z3VFc0CnlPNFBZZGxNV0RKK0N4Z1VOUnFZNVowVC9tK2czRkNoNWpJeEdMYkNWWGMKLS0tIEkvaW1ldlp6eTgxMjBKU3ptSm5tbi9LTWszcDVBMTFWODNOazQxbTlOUEUKcMXlNiShUgdT+Sxa0Q7KsnO6TWEXgHcT6DggQXod8soIGCJyyPhchXc0oTEaO3XpjQ6v",
+		plaintext: "Black lives matter.",
+	},
+	{
+		name:      "ocicrypt",
+		identity:  "AGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX",
+		file:      "YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSArQ3BsOGJERXc5MUloNnJ0c2lFclU1OTRRYUZUMFFKK0Z0bTRucGMrZ2k0CmlBWTFBWGVrOEYvU1Y1SmhERE9OR0VJYkhoQ29GdHNjTE9qdHhVZWlkOFkKLS0tIFI0N25GamlYaTEvZFhDQWM4ZzNRbVQwQ3F1bzkwOWZSVTQzbC9Na090QzAKB8FIfVgUK1CKrU41MxCah8WzU7D+hXiKNcG9BUnr2bqLVD35n/TF7cUsQ6yeu50s7jKPDTxLBGcZ60QMkhVKzXySsy36",
+		plaintext: "written by the keywrapper of ocicrypt",
+	},
+}
+
+func TestKeyWrapAgeVectors(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the age scheme")
+
+	kw := NewKeyWrapper()
+	for _, v := range ageVectors {
+		file, err := base64.StdEncoding.DecodeString(v.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc, err := config.DecryptWithAgeIdentities([][]byte{[]byte(v.identity)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := kw.UnwrapKey(cc.DecryptConfig, file)
+		if err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+		if string(plaintext) != v.plaintext {
+			t.Fatalf("%s: unexpected plaintext %q", v.name, plaintext)
+		}
+	}
+}
+
+func TestKeyWrapAgeLargeOptsData(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the age scheme")
+
+	validAgeCcs, _, err := createValidAgeCcs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := validAgeCcs[0]
+	kw := NewKeyWrapper()
+
+	// spans several chunks of 64 KiB, the last one being full
+	data := make([]byte, 2*64*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	wk, err := encrypt(mustParseRecipients(t, cc.EncryptConfig.Parameters["age-recipients"]), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities, err := parseIdentities(cc.DecryptConfig.Parameters["age-identities"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ud, _, err := decrypt(identities, wk, limits.L(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, ud) {
+		t.Fatal("Data doesn't match")
+	}
+
+	// the key options may not be that large
+	if _, err := kw.UnwrapKey(cc.DecryptConfig, wk); !errors.Is(err, errdefs.ErrLimitExceeded) {
+		t.Fatalf("expected ErrLimitExceeded, got %v", err)
+	}
+}
+
+func TestKeyWrapAgeInvalid(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the age scheme")
+
+	validAgeCcs, _, err := createValidAgeCcs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+
+	// the first config encrypts for the first identity only
+	wk, err := kw.WrapKeys(validAgeCcs[0].EncryptConfig, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kw.UnwrapKey(validAgeCcs[1].DecryptConfig, wk); !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+		t.Fatalf("expected ErrNoDecryptionKey, got %v", err)
+	}
+
+	// flipping a bit of the header MAC or the payload is detected
+	for _, idx := range []int{len(wk) - 60, len(wk) - 1} {
+		tampered := append([]byte{}, wk...)
+		tampered[idx] ^= 1
+		if _, err := kw.UnwrapKey(validAgeCcs[0].DecryptConfig, tampered); err == nil {
+			t.Fatalf("tampered wrapped key at offset %d was accepted", idx)
+		}
+	}
+
+	if _, err := kw.UnwrapKey(validAgeCcs[0].DecryptConfig, []byte("not an age file")); !errors.Is(err, errdefs.ErrProtocol) {
+		t.Fatalf("expected ErrProtocol, got %v", err)
+	}
+
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"age-recipients": {[]byte("age1notarecipient")},
+		},
+	}
+	if _, err := kw.WrapKeys(ec, data); !errors.Is(err, errdefs.ErrKeyMaterial) {
+		t.Fatalf("expected ErrKeyMaterial, got %v", err)
+	}
+}
+
+func TestKeyWrapAgeNoRecipients(t *testing.T) {
+	kw := NewKeyWrapper()
+	wk, err := kw.WrapKeys(&config.EncryptConfig{Parameters: map[string][][]byte{}}, []byte("data"))
+	if err != nil || wk != nil {
+		t.Fatalf("expected no wrapped key and no error, got %v, %v", wk, err)
+	}
+	if !kw.NoPossibleKeys(map[string][][]byte{}) {
+		t.Fatal("expected no possible keys")
+	}
+}
+
+func TestKeyWrapAgeSSH(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the age scheme")
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+	for _, privKey := range []crypto.Signer{edKey, rsaKey} {
+		sshKey, err := ssh.NewPublicKey(privKey.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		identity := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: mustMarshalPKCS8(t, privKey)})
+
+		cc, err := config.EncryptWithAge([][]byte{ssh.MarshalAuthorizedKey(sshKey)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wk, err := kw.WrapKeys(cc.EncryptConfig, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc, err = config.DecryptWithAgeIdentities([][]byte{identity})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ud, keyID, err := kw.(*ageKeyWrapper).UnwrapKeyID(cc.DecryptConfig, wk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, ud) {
+			t.Fatal("Strings don't match")
+		}
+		if keyID != "age:"+authorizedKey(sshKey) {
+			t.Fatalf("unexpected key ID %s", keyID)
+		}
+	}
+
+	smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshKey, err := ssh.NewPublicKey(&smallKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseRecipients([][]byte{ssh.MarshalAuthorizedKey(sshKey)}); !errors.Is(err, errdefs.ErrUnsupportedKey) {
+		t.Fatalf("expected ErrUnsupportedKey for a 1024 bit RSA key, got %v", err)
+	}
+}
+
+func TestKeyWrapAgeSSHAgent(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the age scheme")
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	for _, key := range []interface{}{edKey, ecKey} {
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldDialSSHAgent := dialSSHAgent
+	defer func() { dialSSHAgent = oldDialSSHAgent }()
+	dialSSHAgent = func() (agent.ExtendedAgent, io.Closer, error) {
+		return keyring.(agent.ExtendedAgent), ioutil.NopCloser(nil), nil
+	}
+
+	sshKey, err := ssh.NewPublicKey(edKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := ssh.MarshalAuthorizedKey(sshKey)
+	recipient, err := SSHAgentRecipient(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the identity derived from the agent key does not change
+	if r, err := SSHAgentRecipient(pubKey); err != nil || r != recipient {
+		t.Fatalf("the derived recipient changed from %s to %s: %v", recipient, r, err)
+	}
+
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+	cc, err := config.EncryptWithAge([][]byte{[]byte(recipient)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wk, err := kw.WrapKeys(cc.EncryptConfig, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err = config.DecryptWithSSHAgent([][]byte{pubKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kw.NoPossibleKeys(cc.DecryptConfig.Parameters) {
+		t.Fatal("the SSH agent keys were not found")
+	}
+	ud, err := kw.UnwrapKey(cc.DecryptConfig, wk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, ud) {
+		t.Fatal("Strings don't match")
+	}
+
+	ecSSHKey, err := ssh.NewPublicKey(ecKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SSHAgentRecipient(ssh.MarshalAuthorizedKey(ecSSHKey)); !errors.Is(err, errdefs.ErrUnsupportedKey) {
+		t.Fatalf("expected ErrUnsupportedKey for an ECDSA agent key, got %v", err)
+	}
+
+	dialSSHAgent = oldDialSSHAgent
+	t.Setenv("SSH_AUTH_SOCK", "")
+	if _, err := kw.UnwrapKey(cc.DecryptConfig, wk); !errors.Is(err, errdefs.ErrProviderUnreachable) {
+		t.Fatalf("expected ErrProviderUnreachable without an SSH agent, got %v", err)
+	}
+}
+
+func mustMarshalPKCS8(t *testing.T, key interface{}) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func mustParseRecipients(t *testing.T, values [][]byte) []recipient {
+	recipients, err := parseRecipients(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recipients
+}
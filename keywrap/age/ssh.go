@@ -0,0 +1,94 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package age
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+
+	"filippo.io/age/agessh"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// The ssh-ed25519 and ssh-rsa recipient stanzas of age, which wrap file keys
+// for OpenSSH public keys, are implemented by filippo.io/age/agessh.
+
+// authorizedKey returns the SSH key in authorized_keys format without comment
+func authorizedKey(pubKey ssh.PublicKey) string {
+	return strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(pubKey)), "\n")
+}
+
+// parseSSHRecipient parses an OpenSSH public key in authorized_keys format,
+// ssh-ed25519 AAAA... or ssh-rsa AAAA...
+func parseSSHRecipient(s string) (recipient, error) {
+	sshKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return recipient{}, fmt.Errorf("age: malformed SSH recipient %q: %v: %w", s, err, errdefs.ErrKeyMaterial)
+	}
+	switch sshKey.Type() {
+	case ssh.KeyAlgoRSA:
+		r, err := agessh.NewRSARecipient(sshKey)
+		if err != nil {
+			// age only accepts RSA keys of at least 2048 bits
+			return recipient{}, fmt.Errorf("age: %v: %w", err, errdefs.ErrUnsupportedKey)
+		}
+		return recipient{Recipient: r, name: authorizedKey(sshKey)}, nil
+	case ssh.KeyAlgoED25519:
+		r, err := agessh.NewEd25519Recipient(sshKey)
+		if err != nil {
+			return recipient{}, fmt.Errorf("age: %v: %w", err, errdefs.ErrKeyMaterial)
+		}
+		return recipient{Recipient: r, name: authorizedKey(sshKey)}, nil
+	}
+	return recipient{}, fmt.Errorf("age: unsupported SSH recipient type %s: %w", sshKey.Type(), errdefs.ErrUnsupportedKey)
+}
+
+// parseSSHIdentity parses an unencrypted RSA or ed25519 private key as written
+// by ssh-keygen
+func parseSSHIdentity(data []byte) (identity, error) {
+	key, err := utils.ParsePrivateKey(data, nil, "age")
+	if err != nil {
+		return identity{}, err
+	}
+	switch privKey := key.(type) {
+	case *rsa.PrivateKey:
+		sshKey, err := ssh.NewPublicKey(&privKey.PublicKey)
+		if err != nil {
+			return identity{}, fmt.Errorf("age: %v: %w", err, errdefs.ErrKeyMaterial)
+		}
+		i, err := agessh.NewRSAIdentity(privKey)
+		if err != nil {
+			return identity{}, fmt.Errorf("age: %v: %w", err, errdefs.ErrKeyMaterial)
+		}
+		return identity{Identity: i, keyID: authorizedKey(sshKey)}, nil
+	case ed25519.PrivateKey:
+		sshKey, err := ssh.NewPublicKey(privKey.Public())
+		if err != nil {
+			return identity{}, fmt.Errorf("age: %v: %w", err, errdefs.ErrKeyMaterial)
+		}
+		i, err := agessh.NewEd25519Identity(privKey)
+		if err != nil {
+			return identity{}, fmt.Errorf("age: %v: %w", err, errdefs.ErrKeyMaterial)
+		}
+		return identity{Identity: i, keyID: authorizedKey(sshKey)}, nil
+	}
+	return identity{}, fmt.Errorf("age: %T SSH keys cannot be used, only RSA and ed25519 keys: %w", key, errdefs.ErrUnsupportedKey)
+}
@@ -0,0 +1,67 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package awskms
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+var (
+	configLock   sync.Mutex
+	cachedConfig *aws.Config
+)
+
+// loadConfig returns the configuration of the AWS SDK, whose default
+// credential chain finds, in this order, the AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY environment variables, the shared configuration and
+// credentials files, a web identity token such as the service account token
+// of an EKS pod, the ECS container credentials and the EC2 instance metadata
+// service. The configuration is kept so that the SDK caches temporary
+// credentials until shortly before they expire.
+func loadConfig(ctx context.Context) (aws.Config, error) {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	if cachedConfig != nil {
+		return *cachedConfig, nil
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithHTTPClient(httpClient))
+	if err != nil {
+		return aws.Config{}, errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("AWS KMS: could not load the AWS configuration: %w", err))
+	}
+	cachedConfig = &cfg
+	return cfg, nil
+}
+
+// newClient returns a client of AWS KMS in the region of the key; the endpoint
+// may be overridden with AWS_ENDPOINT_URL_KMS or AWS_ENDPOINT_URL
+func newClient(ctx context.Context, key keyARN) (*kms.Client, error) {
+	cfg, err := loadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return kms.NewFromConfig(cfg, func(o *kms.Options) {
+		o.Region = key.region
+	}), nil
+}
@@ -0,0 +1,305 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package awskms
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/smithy-go"
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/keywrap"
+	"github.com/containers/ocicrypt/log"
+)
+
+const (
+	// CallTimeout is the time AWS KMS has for encrypting or decrypting a
+	// layer key, including getting the credentials
+	CallTimeout = 10 * time.Second
+	// URIScheme is the prefix of the key ARNs in recipient strings, as in
+	// aws-kms://arn:aws:kms:us-east-1:111122223333:key/1234abcd-...
+	URIScheme = "aws-kms://"
+)
+
+// encryptionContext is passed to every Encrypt and Decrypt call; AWS KMS
+// binds the ciphertexts to it and records it in CloudTrail
+var encryptionContext = map[string]string{"org.opencontainers.image.enc": "layer-key"}
+
+// httpClient is used for calling AWS; the SDK adds the CA bundle of
+// AWS_CA_BUNDLE to it
+var httpClient = awshttp.NewBuildableClient().WithTimeout(CallTimeout)
+
+// awsKMSBlob is the wrapped key; it holds the layer key encrypted by every
+// KMS key
+type awsKMSBlob struct {
+	Version    int               `json:"version"`
+	Recipients []awsKMSRecipient `json:"recipients"`
+}
+
+type awsKMSRecipient struct {
+	KeyARN     string `json:"key_arn"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// keyARN is the parsed ARN of a KMS key or alias
+type keyARN struct {
+	arn       string
+	partition string
+	region    string
+	// resource is key/<key id> or alias/<alias name>
+	resource string
+}
+
+type awsKMSKeyWrapper struct {
+}
+
+func (kw *awsKMSKeyWrapper) GetAnnotationID() string {
+	return "org.opencontainers.image.enc.keys.aws-kms"
+}
+
+// NewKeyWrapper returns a new key wrapping interface that encrypts layer keys
+// with AWS KMS keys
+func NewKeyWrapper() keywrap.KeyWrapper {
+	return &awsKMSKeyWrapper{}
+}
+
+// WrapKeys has the KMS keys of the aws-kms-keys parameter encrypt the optsData,
+// which describe the symmetric key used for encrypting the layer
+func (kw *awsKMSKeyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	return kw.WrapKeysContext(context.Background(), ec, optsData)
+}
+
+// WrapKeysContext wraps the layer key like WrapKeys, giving up once ctx is done
+func (kw *awsKMSKeyWrapper) WrapKeysContext(ctx context.Context, ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	keys, err := parseKeyARNs(ec.Parameters["aws-kms-keys"])
+	if err != nil {
+		return nil, err
+	}
+	// no recipients is not an error...
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	blob := awsKMSBlob{}
+	for _, key := range keys {
+		client, err := newClient(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		callCtx, cancel := context.WithTimeout(ctx, CallTimeout)
+		resp, err := client.Encrypt(callCtx, &kms.EncryptInput{
+			KeyId:             aws.String(key.arn),
+			Plaintext:         optsData,
+			EncryptionContext: encryptionContext,
+		})
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("AWS KMS Encrypt failed: %w", callError("Encrypt", err))
+		}
+		if aws.ToString(resp.KeyId) == "" || len(resp.CiphertextBlob) == 0 {
+			return nil, fmt.Errorf("AWS KMS returned no key ARN or ciphertext for %s: %w", key.arn, errdefs.ErrProtocol)
+		}
+		blob.Recipients = append(blob.Recipients, awsKMSRecipient{
+			KeyARN:     aws.ToString(resp.KeyId),
+			Ciphertext: resp.CiphertextBlob,
+		})
+	}
+	sort.SliceStable(blob.Recipients, func(i, j int) bool {
+		return blob.Recipients[i].KeyARN < blob.Recipients[j].KeyARN
+	})
+	return json.Marshal(&blob)
+}
+
+func (kw *awsKMSKeyWrapper) UnwrapKey(dc *config.DecryptConfig, annotation []byte) ([]byte, error) {
+	optsData, _, err := kw.UnwrapKeyID(dc, annotation)
+	return optsData, err
+}
+
+// UnwrapKeyID has the KMS keys of the aws-kms-keys parameter decrypt the
+// symmetric key with which the layer is encrypted and returns the ARN of the
+// KMS key that decrypted it. Key ARNs are only used for the ciphertexts of
+// the same key, alias ARNs for all ciphertexts of their region.
+func (kw *awsKMSKeyWrapper) UnwrapKeyID(dc *config.DecryptConfig, annotation []byte) ([]byte, string, error) {
+	return kw.UnwrapKeyIDContext(context.Background(), dc, annotation)
+}
+
+// UnwrapKeyIDContext unwraps the layer key like UnwrapKeyID, giving up once
+// ctx is done
+func (kw *awsKMSKeyWrapper) UnwrapKeyIDContext(ctx context.Context, dc *config.DecryptConfig, annotation []byte) ([]byte, string, error) {
+	keys, err := parseKeyARNs(kw.GetPrivateKeys(dc.Parameters))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(keys) == 0 {
+		return nil, "", fmt.Errorf("No KMS keys found for AWS KMS decryption: %w", errdefs.ErrNoDecryptionKey)
+	}
+
+	var blob awsKMSBlob
+	if err := json.Unmarshal(annotation, &blob); err != nil {
+		return nil, "", fmt.Errorf("could not parse the AWS KMS wrapped key: %w", errdefs.ErrProtocol)
+	}
+	if blob.Version != 0 {
+		return nil, "", fmt.Errorf("unsupported AWS KMS wrapped key version %d: %w", blob.Version, errdefs.ErrProtocol)
+	}
+	if err := dc.GetLimits().CheckRecipients(len(blob.Recipients)); err != nil {
+		return nil, "", err
+	}
+
+	var unreachableErr error
+	for _, key := range keys {
+		client, err := newClient(ctx, key)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, recipient := range blob.Recipients {
+			if !key.mayDecrypt(recipient.KeyARN) {
+				continue
+			}
+			callCtx, cancel := context.WithTimeout(ctx, CallTimeout)
+			resp, err := client.Decrypt(callCtx, &kms.DecryptInput{
+				KeyId:             aws.String(key.arn),
+				CiphertextBlob:    recipient.Ciphertext,
+				EncryptionContext: encryptionContext,
+			})
+			cancel()
+			if err == nil {
+				if len(resp.Plaintext) > keywrap.MaxOptsDataSize {
+					return nil, "", fmt.Errorf("AWS KMS: layer key options are larger than %d bytes: %w", keywrap.MaxOptsDataSize, errdefs.ErrLimitExceeded)
+				}
+				return resp.Plaintext, "aws-kms:" + recipient.KeyARN, nil
+			}
+			err = callError("Decrypt", err)
+			log.L().Debug("AWS KMS could not decrypt the layer key", log.KeyKeyID, recipient.KeyARN, log.KeyError, err)
+			if errors.Is(err, errdefs.ErrProviderUnreachable) {
+				unreachableErr = err
+			}
+		}
+	}
+	if unreachableErr != nil {
+		return nil, "", fmt.Errorf("AWS KMS: No KMS key could decrypt the layer key: %w", unreachableErr)
+	}
+	return nil, "", fmt.Errorf("AWS KMS: No KMS key could decrypt the layer key: %w", errdefs.ErrNoDecryptionKey)
+}
+
+func (kw *awsKMSKeyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
+	return len(kw.GetPrivateKeys(dcparameters)) == 0
+}
+
+// GetPrivateKeys returns the ARNs of the KMS keys since the keys cannot leave
+// AWS KMS
+func (kw *awsKMSKeyWrapper) GetPrivateKeys(dcparameters map[string][][]byte) [][]byte {
+	return dcparameters["aws-kms-keys"]
+}
+
+func (kw *awsKMSKeyWrapper) GetKeyIdsFromPacket(_ string) ([]uint64, error) {
+	return nil, nil
+}
+
+// GetRecipients returns the ARNs of the KMS keys the layer key is encrypted
+// with
+func (kw *awsKMSKeyWrapper) GetRecipients(b64blobs string) ([]string, error) {
+	var recipients []string
+	for _, b64blob := range strings.Split(b64blobs, ",") {
+		data, err := base64.StdEncoding.DecodeString(b64blob)
+		if err != nil {
+			return nil, fmt.Errorf("could not base64 decode the AWS KMS wrapped key: %w", errdefs.ErrProtocol)
+		}
+		var blob awsKMSBlob
+		if err := json.Unmarshal(data, &blob); err != nil {
+			return nil, fmt.Errorf("could not parse the AWS KMS wrapped key: %w", errdefs.ErrProtocol)
+		}
+		for _, recipient := range blob.Recipients {
+			recipients = append(recipients, "aws-kms:"+recipient.KeyARN)
+		}
+	}
+	return recipients, nil
+}
+
+// parseKeyARNs parses the ARNs of KMS keys or aliases, which may be prefixed
+// by aws-kms://; duplicates are dropped
+func parseKeyARNs(values [][]byte) ([]keyARN, error) {
+	var keys []keyARN
+	seen := make(map[string]bool)
+	for _, value := range values {
+		arn := strings.TrimPrefix(string(value), URIScheme)
+		// arn:partition:kms:region:account:key/id
+		parts := strings.SplitN(arn, ":", 6)
+		if len(parts) != 6 || parts[0] != "arn" || parts[2] != "kms" || parts[3] == "" ||
+			!(strings.HasPrefix(parts[5], "key/") || strings.HasPrefix(parts[5], "alias/")) {
+			return nil, fmt.Errorf("AWS KMS: %q is not the ARN of a KMS key or alias: %w", value, errdefs.ErrConfiguration)
+		}
+		if seen[arn] {
+			continue
+		}
+		seen[arn] = true
+		keys = append(keys, keyARN{arn: arn, partition: parts[1], region: parts[3], resource: parts[5]})
+	}
+	return keys, nil
+}
+
+// mayDecrypt returns true if the KMS key may have encrypted a ciphertext of the
+// KMS key with the given ARN
+func (k keyARN) mayDecrypt(arn string) bool {
+	if strings.HasPrefix(k.resource, "key/") {
+		return k.arn == arn
+	}
+	return strings.HasPrefix(arn, "arn:"+k.partition+":kms:"+k.region+":")
+}
+
+// callError returns the error of an AWS KMS action with the category of the
+// failure; throttling and failures of AWS wrap ErrProviderUnreachable
+func callError(action string, err error) error {
+	var (
+		netErr  net.Error
+		respErr *awshttp.ResponseError
+		signErr *v4.SigningError
+		apiErr  smithy.APIError
+	)
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() >= http.StatusInternalServerError {
+		return errdefs.WithCategory(errdefs.ErrProviderUnreachable, err)
+	}
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr):
+		return fmt.Errorf("could not call AWS KMS: %v: %w", err, errdefs.ErrProviderUnreachable)
+	case errors.As(err, &signErr):
+		// no credentials were found or they were refused
+		return errdefs.WithCategory(errdefs.ErrConfiguration, err)
+	case errors.As(err, &apiErr):
+		switch {
+		case apiErr.ErrorCode() == "ThrottlingException" || apiErr.ErrorCode() == "KMSInternalException":
+			return errdefs.WithCategory(errdefs.ErrProviderUnreachable, err)
+		case action == "Decrypt":
+			return errdefs.WithCategory(errdefs.ErrNoDecryptionKey, err)
+		default:
+			return errdefs.WithCategory(errdefs.ErrConfiguration, err)
+		}
+	}
+	return errdefs.WithCategory(errdefs.ErrProviderUnreachable, err)
+}
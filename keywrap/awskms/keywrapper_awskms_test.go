@@ -0,0 +1,241 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package awskms
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/keywrap"
+)
+
+const (
+	testKey1 = "arn:aws:kms:us-east-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+	testKey2 = "arn:aws:kms:us-east-1:111122223333:key/0987dcba-09fe-87dc-65ba-ab0987654321"
+)
+
+// fakeKMS is an AWS KMS that 'encrypts' by prefixing the plaintext with the
+// key ARN
+type fakeKMS struct {
+	// keys are the key ARNs by alias ARN
+	aliases map[string]string
+}
+
+func (f *fakeKMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"__type":"UnrecognizedClientException","message":"bad credentials"}`))
+		return
+	}
+	var req struct {
+		KeyID             string            `json:"KeyId"`
+		Plaintext         []byte            `json:"Plaintext"`
+		CiphertextBlob    []byte            `json:"CiphertextBlob"`
+		EncryptionContext map[string]string `json:"EncryptionContext"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.EncryptionContext["org.opencontainers.image.enc"] != "layer-key" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"__type":"ValidationException"}`))
+		return
+	}
+	keyID := req.KeyID
+	if key, ok := f.aliases[keyID]; ok {
+		keyID = key
+	}
+	var resp interface{}
+	switch r.Header.Get("X-Amz-Target") {
+	case "TrentService.Encrypt":
+		resp = map[string]interface{}{
+			"KeyId":          keyID,
+			"CiphertextBlob": append([]byte(keyID+"|"), req.Plaintext...),
+		}
+	case "TrentService.Decrypt":
+		if !bytes.HasPrefix(req.CiphertextBlob, []byte(keyID+"|")) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"IncorrectKeyException","message":"wrong key"}`))
+			return
+		}
+		resp = map[string]interface{}{
+			"KeyId":     keyID,
+			"Plaintext": req.CiphertextBlob[len(keyID)+1:],
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func setupFakeKMS(t *testing.T) {
+	srv := httptest.NewServer(&fakeKMS{aliases: map[string]string{
+		"arn:aws:kms:us-east-1:111122223333:alias/layers": testKey1,
+	}})
+	t.Cleanup(srv.Close)
+	t.Setenv("AWS_ENDPOINT_URL_KMS", srv.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	cachedConfig = nil
+	t.Cleanup(func() { cachedConfig = nil })
+}
+
+func TestKeyWrapAWSKMSSuccess(t *testing.T) {
+	setupFakeKMS(t)
+
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"aws-kms-keys": {[]byte(URIScheme + testKey2), []byte("arn:aws:kms:us-east-1:111122223333:alias/layers")},
+		},
+	}
+	wk, err := kw.WrapKeys(ec, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{testKey1, testKey2, "arn:aws:kms:us-east-1:111122223333:alias/layers"} {
+		dc := &config.DecryptConfig{
+			Parameters: map[string][][]byte{
+				"aws-kms-keys": {[]byte(key)},
+			},
+		}
+		ud, keyID, err := kw.(*awsKMSKeyWrapper).UnwrapKeyID(dc, wk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, ud) {
+			t.Fatal("Strings don't match")
+		}
+		if !strings.HasPrefix(keyID, "aws-kms:arn:aws:kms:") {
+			t.Fatalf("unexpected key ID %s", keyID)
+		}
+	}
+
+	recipients, err := kw.GetRecipients(base64.StdEncoding.EncodeToString(wk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 2 || recipients[0] != "aws-kms:"+testKey2 || recipients[1] != "aws-kms:"+testKey1 {
+		t.Fatalf("unexpected recipients %v", recipients)
+	}
+}
+
+func TestKeyWrapAWSKMSContext(t *testing.T) {
+	setupFakeKMS(t)
+
+	kw := NewKeyWrapper().(keywrap.ContextKeyWrapper)
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"aws-kms-keys": {[]byte(URIScheme + testKey1)},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := kw.WrapKeysContext(ctx, ec, []byte("This is some secret text"))
+	if !errors.Is(err, errdefs.ErrProviderUnreachable) || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Fatalf("Expected the canceled call to fail, got %v", err)
+	}
+}
+
+func TestKeyWrapAWSKMSInvalid(t *testing.T) {
+	setupFakeKMS(t)
+
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"aws-kms-keys": {[]byte(testKey1)},
+		},
+	}
+	wk, err := kw.WrapKeys(ec, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an alias of another region is not tried
+	for _, key := range []string{testKey2, "arn:aws:kms:eu-west-1:111122223333:alias/layers"} {
+		dc := &config.DecryptConfig{
+			Parameters: map[string][][]byte{
+				"aws-kms-keys": {[]byte(key)},
+			},
+		}
+		if _, err := kw.UnwrapKey(dc, wk); !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+			t.Fatalf("expected ErrNoDecryptionKey for %s, got %v", key, err)
+		}
+	}
+
+	ec.Parameters["aws-kms-keys"] = [][]byte{[]byte("arn:aws:s3:::bucket")}
+	if _, err := kw.WrapKeys(ec, data); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDOTHER")
+	cachedConfig = nil
+	ec.Parameters["aws-kms-keys"] = [][]byte{[]byte(testKey1)}
+	if _, err := kw.WrapKeys(ec, data); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+}
+
+func TestKeyWrapAWSKMSSharedCredentials(t *testing.T) {
+	setupFakeKMS(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_ROLE_ARN", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "")
+
+	dir := t.TempDir()
+	credsFile := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(credsFile, []byte("[default]\naws_access_key_id = AKIDDEFAULT\naws_secret_access_key = secret\n\n[ci]\naws_access_key_id=AKIDEXAMPLE\naws_secret_access_key=wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credsFile)
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_PROFILE", "ci")
+
+	kw := NewKeyWrapper()
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"aws-kms-keys": {[]byte(testKey1)},
+		},
+	}
+	if _, err := kw.WrapKeys(ec, []byte("This is some secret text")); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("AWS_PROFILE", "missing")
+	cachedConfig = nil
+	if _, err := kw.WrapKeys(ec, []byte("This is some secret text")); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package azurekv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+var (
+	credentialLock sync.Mutex
+	credential     azcore.TokenCredential
+	// disableInstanceDiscovery skips the discovery of the authority host;
+	// tests serve Microsoft Entra ID themselves
+	disableInstanceDiscovery bool
+)
+
+// getAccessToken returns an access token for the resource, such as
+// https://vault.azure.net, of the DefaultAzureCredential of azidentity, which
+// tries in this order the client secret or certificate of AZURE_CLIENT_SECRET
+// or AZURE_CLIENT_CERTIFICATE_PATH, the federated token of AKS workload
+// identity in AZURE_FEDERATED_TOKEN_FILE, the managed identity of the VM and
+// the Azure CLI. The credential is kept; it caches tokens until shortly
+// before they expire.
+func getAccessToken(ctx context.Context, resource string) (string, error) {
+	credentialLock.Lock()
+	if credential == nil {
+		c, err := azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{
+			ClientOptions:            azcore.ClientOptions{Transport: httpClient},
+			DisableInstanceDiscovery: disableInstanceDiscovery,
+		})
+		if err != nil {
+			credentialLock.Unlock()
+			return "", errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("Azure Key Vault: no Azure credentials found: %w", err))
+		}
+		credential = c
+	}
+	c := credential
+	credentialLock.Unlock()
+
+	token, err := c.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{resource + "/.default"}})
+	if err != nil {
+		return "", tokenError(err)
+	}
+	return token.Token, nil
+}
+
+// tokenError returns the error of getting an access token with the category
+// of the failure; missing or refused credentials are a configuration error
+func tokenError(err error) error {
+	var (
+		netErr  net.Error
+		authErr *azidentity.AuthenticationFailedError
+	)
+	err = fmt.Errorf("Azure Key Vault: could not get an access token: %w", err)
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr):
+		return errdefs.WithCategory(errdefs.ErrProviderUnreachable, err)
+	case errors.As(err, &authErr) && authErr.RawResponse != nil &&
+		(authErr.RawResponse.StatusCode >= http.StatusInternalServerError || authErr.RawResponse.StatusCode == http.StatusTooManyRequests):
+		return errdefs.WithCategory(errdefs.ErrProviderUnreachable, err)
+	}
+	return errdefs.WithCategory(errdefs.ErrConfiguration, err)
+}
@@ -0,0 +1,445 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package azurekv
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
+	"github.com/containers/ocicrypt/keywrap"
+	"github.com/containers/ocicrypt/log"
+	"github.com/containers/ocicrypt/spiffe"
+)
+
+const (
+	// CallTimeout is the time Azure Key Vault has for wrapping or unwrapping a
+	// layer key, including getting an access token
+	CallTimeout = 10 * time.Second
+	// URIScheme is the prefix of the key IDs in recipient strings, as in
+	// azurekv://myvault.vault.azure.net/keys/mykey
+	URIScheme = "azurekv://"
+	// apiVersion is the version of the Key Vault REST API
+	apiVersion = "7.4"
+	// maxResponseSize is the maximum size of a response of Key Vault
+	maxResponseSize = 64 * 1024
+)
+
+// additionalData authenticates the sealed layer key options
+var additionalData = []byte("org.opencontainers.image.enc/layer-key")
+
+// httpClient is used for calling Azure; tests replace it
+var httpClient = &http.Client{Timeout: CallTimeout}
+
+// azureKVBlob is the wrapped key; it holds the layer key options sealed with a
+// random AES key, which is wrapped by every Key Vault key
+type azureKVBlob struct {
+	Version    int                `json:"version"`
+	Recipients []azureKVRecipient `json:"recipients"`
+}
+
+type azureKVRecipient struct {
+	// KeyID is the ID of the version of the key that wrapped the AES key
+	KeyID string `json:"key_id"`
+	// Alg is the wrapping algorithm
+	Alg        string `json:"alg"`
+	Ciphertext []byte `json:"ciphertext"`
+	// Sealed holds the layer key options encrypted with AES-256-GCM
+	Sealed []byte `json:"sealed"`
+}
+
+// keyID is the parsed ID of a Key Vault key, as in
+// https://myvault.vault.azure.net/keys/mykey[/version]
+type keyID struct {
+	id string
+	// resource is the resource of the access tokens for the vault, as in
+	// https://vault.azure.net
+	resource string
+	// version is set for IDs of key versions
+	version bool
+}
+
+type azureKVKeyWrapper struct {
+}
+
+func (kw *azureKVKeyWrapper) GetAnnotationID() string {
+	return "org.opencontainers.image.enc.keys.azure-kv"
+}
+
+// NewKeyWrapper returns a new key wrapping interface that wraps layer keys
+// with Azure Key Vault keys
+func NewKeyWrapper() keywrap.KeyWrapper {
+	return &azureKVKeyWrapper{}
+}
+
+// WrapKeys seals the optsData, which describe the symmetric key used for
+// encrypting the layer, with a random AES key and has the Key Vault keys of
+// the azure-kv-keys parameter wrap it. RSA keys wrap with RSA-OAEP-256,
+// symmetric keys of a Managed HSM with A256KW.
+func (kw *azureKVKeyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	return kw.WrapKeysContext(context.Background(), ec, optsData)
+}
+
+// WrapKeysContext wraps the layer key like WrapKeys, giving up once ctx is done
+func (kw *azureKVKeyWrapper) WrapKeysContext(ctx context.Context, ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	keys, err := parseKeyIDs(ec.Parameters["azure-kv-keys"])
+	if err != nil {
+		return nil, err
+	}
+	// no recipients is not an error...
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	aesKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, aesKey); err != nil {
+		return nil, fmt.Errorf("could not generate the AES key: %w", err)
+	}
+	sealed, err := seal(aesKey, optsData)
+	if err != nil {
+		return nil, err
+	}
+
+	client := spiffe.HTTPClient(httpClient, ec.DecryptConfig.SVIDSource)
+	blob := azureKVBlob{}
+	for _, key := range keys {
+		callCtx, cancel := context.WithTimeout(ctx, CallTimeout)
+		recipient, err := wrapKey(callCtx, client, key, aesKey)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("Azure Key Vault wrapping with %s failed: %w", key.id, err)
+		}
+		recipient.Sealed = sealed
+		blob.Recipients = append(blob.Recipients, *recipient)
+	}
+	sort.SliceStable(blob.Recipients, func(i, j int) bool {
+		return blob.Recipients[i].KeyID < blob.Recipients[j].KeyID
+	})
+	return json.Marshal(&blob)
+}
+
+// wrapKey looks up the current version and type of the key and has it wrap
+// the AES key
+func wrapKey(ctx context.Context, client *http.Client, key keyID, aesKey []byte) (*azureKVRecipient, error) {
+	var keyResp struct {
+		Key struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+		} `json:"key"`
+	}
+	if err := call(ctx, client, http.MethodGet, key, key.id, nil, &keyResp); err != nil {
+		return nil, err
+	}
+	var alg string
+	switch keyResp.Key.Kty {
+	case "RSA", "RSA-HSM":
+		alg = "RSA-OAEP-256"
+	case "oct", "oct-HSM":
+		alg = "A256KW"
+	default:
+		return nil, fmt.Errorf("Azure Key Vault key %s has the type %q, which cannot wrap keys: %w", key.id, keyResp.Key.Kty, errdefs.ErrConfiguration)
+	}
+	// only versions of the configured key are used
+	if !key.mayUnwrap(keyResp.Key.Kid) {
+		return nil, fmt.Errorf("Azure Key Vault returned the unexpected key ID %s: %w", keyResp.Key.Kid, errdefs.ErrProtocol)
+	}
+
+	var resp struct {
+		Kid   string `json:"kid"`
+		Value string `json:"value"`
+	}
+	err := call(ctx, client, http.MethodPost, key, keyResp.Key.Kid+"/wrapkey", map[string]string{
+		"alg":   alg,
+		"value": base64.RawURLEncoding.EncodeToString(aesKey),
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(resp.Value)
+	if err != nil || len(ciphertext) == 0 {
+		return nil, fmt.Errorf("Azure Key Vault returned no wrapped key for %s: %w", key.id, errdefs.ErrProtocol)
+	}
+	return &azureKVRecipient{KeyID: keyResp.Key.Kid, Alg: alg, Ciphertext: ciphertext}, nil
+}
+
+func (kw *azureKVKeyWrapper) UnwrapKey(dc *config.DecryptConfig, annotation []byte) ([]byte, error) {
+	optsData, _, err := kw.UnwrapKeyID(dc, annotation)
+	return optsData, err
+}
+
+// UnwrapKeyID has the Key Vault keys of the azure-kv-keys parameter unwrap the
+// symmetric key with which the layer is encrypted and returns the ID of the
+// key version that unwrapped it. The ID of a key without a version stands for
+// all of its versions.
+func (kw *azureKVKeyWrapper) UnwrapKeyID(dc *config.DecryptConfig, annotation []byte) ([]byte, string, error) {
+	return kw.UnwrapKeyIDContext(context.Background(), dc, annotation)
+}
+
+// UnwrapKeyIDContext unwraps the layer key like UnwrapKeyID, giving up once
+// ctx is done
+func (kw *azureKVKeyWrapper) UnwrapKeyIDContext(ctx context.Context, dc *config.DecryptConfig, annotation []byte) ([]byte, string, error) {
+	keys, err := parseKeyIDs(kw.GetPrivateKeys(dc.Parameters))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(keys) == 0 {
+		return nil, "", fmt.Errorf("No keys found for Azure Key Vault decryption: %w", errdefs.ErrNoDecryptionKey)
+	}
+
+	var blob azureKVBlob
+	if err := json.Unmarshal(annotation, &blob); err != nil {
+		return nil, "", fmt.Errorf("could not parse the Azure Key Vault wrapped key: %w", errdefs.ErrProtocol)
+	}
+	if blob.Version != 0 {
+		return nil, "", fmt.Errorf("unsupported Azure Key Vault wrapped key version %d: %w", blob.Version, errdefs.ErrProtocol)
+	}
+	if err := dc.GetLimits().CheckRecipients(len(blob.Recipients)); err != nil {
+		return nil, "", err
+	}
+
+	client := spiffe.HTTPClient(httpClient, dc.SVIDSource)
+	var unreachableErr error
+	for _, key := range keys {
+		for _, recipient := range blob.Recipients {
+			if !key.mayUnwrap(recipient.KeyID) {
+				continue
+			}
+			callCtx, cancel := context.WithTimeout(ctx, CallTimeout)
+			var resp struct {
+				Value string `json:"value"`
+			}
+			err := call(callCtx, client, http.MethodPost, key, recipient.KeyID+"/unwrapkey", map[string]string{
+				"alg":   recipient.Alg,
+				"value": base64.RawURLEncoding.EncodeToString(recipient.Ciphertext),
+			}, &resp)
+			cancel()
+			var optsData []byte
+			if err == nil {
+				var aesKey []byte
+				if aesKey, err = base64.RawURLEncoding.DecodeString(resp.Value); err != nil {
+					err = fmt.Errorf("Azure Key Vault returned an invalid key: %w", errdefs.ErrProtocol)
+				} else {
+					optsData, err = open(aesKey, recipient.Sealed)
+				}
+			}
+			if err == nil {
+				if len(optsData) > keywrap.MaxOptsDataSize {
+					return nil, "", fmt.Errorf("Azure Key Vault: layer key options are larger than %d bytes: %w", keywrap.MaxOptsDataSize, errdefs.ErrLimitExceeded)
+				}
+				return optsData, "azurekv:" + recipient.KeyID, nil
+			}
+			log.L().Debug("Azure Key Vault could not unwrap the layer key", log.KeyKeyID, recipient.KeyID, log.KeyError, err)
+			if errors.Is(err, errdefs.ErrProviderUnreachable) {
+				unreachableErr = err
+			}
+		}
+	}
+	if unreachableErr != nil {
+		return nil, "", fmt.Errorf("Azure Key Vault: No key could unwrap the layer key: %w", unreachableErr)
+	}
+	return nil, "", fmt.Errorf("Azure Key Vault: No key could unwrap the layer key: %w", errdefs.ErrNoDecryptionKey)
+}
+
+func (kw *azureKVKeyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
+	return len(kw.GetPrivateKeys(dcparameters)) == 0
+}
+
+// GetPrivateKeys returns the IDs of the Key Vault keys since the keys cannot
+// leave the vault
+func (kw *azureKVKeyWrapper) GetPrivateKeys(dcparameters map[string][][]byte) [][]byte {
+	return dcparameters["azure-kv-keys"]
+}
+
+func (kw *azureKVKeyWrapper) GetKeyIdsFromPacket(_ string) ([]uint64, error) {
+	return nil, nil
+}
+
+// GetRecipients returns the IDs of the key versions the layer key is wrapped
+// with
+func (kw *azureKVKeyWrapper) GetRecipients(b64blobs string) ([]string, error) {
+	var recipients []string
+	for _, b64blob := range strings.Split(b64blobs, ",") {
+		data, err := base64.StdEncoding.DecodeString(b64blob)
+		if err != nil {
+			return nil, fmt.Errorf("could not base64 decode the Azure Key Vault wrapped key: %w", errdefs.ErrProtocol)
+		}
+		var blob azureKVBlob
+		if err := json.Unmarshal(data, &blob); err != nil {
+			return nil, fmt.Errorf("could not parse the Azure Key Vault wrapped key: %w", errdefs.ErrProtocol)
+		}
+		for _, recipient := range blob.Recipients {
+			recipients = append(recipients, "azurekv:"+recipient.KeyID)
+		}
+	}
+	return recipients, nil
+}
+
+// parseKeyIDs parses the IDs of Key Vault keys, which are URLs whose https://
+// may be replaced by azurekv://; duplicates are dropped
+func parseKeyIDs(values [][]byte) ([]keyID, error) {
+	var keys []keyID
+	seen := make(map[string]bool)
+	for _, value := range values {
+		id := string(value)
+		if strings.HasPrefix(id, URIScheme) {
+			id = "https://" + id[len(URIScheme):]
+		}
+		u, err := url.Parse(id)
+		parts := []string{}
+		if err == nil {
+			parts = strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+		}
+		if err != nil || u.Scheme != "https" || !strings.Contains(u.Hostname(), ".") || u.RawQuery != "" ||
+			(len(parts) != 2 && len(parts) != 3) || parts[0] != "keys" || parts[1] == "" || (len(parts) == 3 && parts[2] == "") {
+			return nil, fmt.Errorf("Azure Key Vault: %q is not the ID of a key: %w", value, errdefs.ErrConfiguration)
+		}
+		id = "https://" + u.Host + "/" + strings.Join(parts, "/")
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		host := u.Hostname()
+		keys = append(keys, keyID{
+			id:       id,
+			resource: "https://" + host[strings.Index(host, ".")+1:],
+			version:  len(parts) == 3,
+		})
+	}
+	return keys, nil
+}
+
+// mayUnwrap returns true if the key may unwrap a ciphertext of the key version
+// with the given ID
+func (k keyID) mayUnwrap(id string) bool {
+	if k.version {
+		return k.id == id
+	}
+	rest := strings.TrimPrefix(id, k.id+"/")
+	return rest != id && rest != "" && !strings.Contains(rest, "/")
+}
+
+// seal encrypts the optsData with AES-256-GCM and prefixes them with the nonce
+func seal(key, optsData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("could not generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, optsData, additionalData), nil
+}
+
+// open decrypts optsData sealed by seal
+func open(key, sealed []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("Azure Key Vault: sealed layer key options are too short: %w", errdefs.ErrProtocol)
+	}
+	optsData, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("Azure Key Vault: could not open the layer key options: %w", errdefs.ErrIntegrity)
+	}
+	return optsData, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if fips.Enforced() {
+		// the nonces are not generated by the FIPS module
+		return nil, fmt.Errorf("Azure Key Vault: sealing the layer key options is not available in FIPS 140-only mode: %w", errdefs.ErrDisallowedAlgorithm)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrProtocol, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// call calls an operation of the Key Vault REST API on the URL of a key with
+// the client
+func call(ctx context.Context, client *http.Client, method string, key keyID, u string, req, resp interface{}) error {
+	token, err := getAccessToken(ctx, key.resource)
+	if err != nil {
+		return err
+	}
+	var body []byte
+	if req != nil {
+		if body, err = json.Marshal(req); err != nil {
+			return err
+		}
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, u+"?api-version="+apiVersion, bytes.NewReader(body))
+	if err != nil {
+		return errdefs.WithCategory(errdefs.ErrConfiguration, err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("could not call Azure Key Vault: %v: %w", err, errdefs.ErrProviderUnreachable)
+	}
+	defer httpResp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(httpResp.Body, maxResponseSize+1))
+	if err != nil {
+		return fmt.Errorf("could not read the response of Azure Key Vault: %v: %w", err, errdefs.ErrProviderUnreachable)
+	}
+	if len(data) > maxResponseSize {
+		return fmt.Errorf("the response of Azure Key Vault is too large: %w", errdefs.ErrProtocol)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		var kvErr struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		_ = json.Unmarshal(data, &kvErr)
+		code, message := kvErr.Error.Code, kvErr.Error.Message
+		switch {
+		case httpResp.StatusCode >= 500 || httpResp.StatusCode == http.StatusTooManyRequests:
+			return fmt.Errorf("Azure Key Vault failed with %d %s %s: %w", httpResp.StatusCode, code, message, errdefs.ErrProviderUnreachable)
+		case strings.HasSuffix(u, "/unwrapkey"):
+			return fmt.Errorf("Azure Key Vault failed with %d %s %s: %w", httpResp.StatusCode, code, message, errdefs.ErrNoDecryptionKey)
+		default:
+			return fmt.Errorf("Azure Key Vault failed with %d %s %s: %w", httpResp.StatusCode, code, message, errdefs.ErrConfiguration)
+		}
+	}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return fmt.Errorf("could not parse the response of Azure Key Vault: %w", errdefs.ErrProtocol)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package azurekv
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/utils"
+)
+
+const testAccToken = "eyJ0eXAiOi.test"
+
+// fakeKeyVault is a Key Vault and Microsoft Entra ID token endpoint; keys
+// 'wrap' by prefixing the key with the ID of the key version
+type fakeKeyVault struct {
+	// kty are the key types by key name
+	kty map[string]string
+}
+
+func (f *fakeKeyVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if r.URL.Path == "/tenant/v2.0/.well-known/openid-configuration" {
+		authority := "https://" + r.Host + "/tenant"
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 authority + "/v2.0",
+			"authorization_endpoint": authority + "/oauth2/v2.0/authorize",
+			"token_endpoint":         authority + "/oauth2/v2.0/token",
+		})
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/oauth2/v2.0/token") {
+		form, _ := url.ParseQuery(string(body))
+		if r.URL.Path != "/tenant/oauth2/v2.0/token" || form.Get("grant_type") != "client_credentials" ||
+			(form.Get("client_secret") != "secret" && form.Get("client_assertion") != "aks-token") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"` + testAccToken + `","expires_in":3600}`))
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+testAccToken || r.URL.Query().Get("api-version") != apiVersion {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":{"code":"Unauthorized"}}`))
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":{"code":"KeyNotFound"}}`))
+	}
+	if len(parts) < 2 || f.kty[parts[1]] == "" {
+		notFound()
+		return
+	}
+	kid := "https://" + r.Host + "/keys/" + parts[1] + "/v1"
+	var req struct {
+		Alg   string `json:"alg"`
+		Value string `json:"value"`
+	}
+	_ = json.Unmarshal(body, &req)
+	value, _ := base64.RawURLEncoding.DecodeString(req.Value)
+	var resp interface{}
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		resp = map[string]interface{}{"key": map[string]string{"kid": kid, "kty": f.kty[parts[1]]}}
+	case len(parts) == 4 && parts[3] == "wrapkey":
+		resp = map[string]string{"kid": kid, "value": base64.RawURLEncoding.EncodeToString(append([]byte(kid+"|"), value...))}
+	case len(parts) == 4 && parts[3] == "unwrapkey":
+		if !bytes.HasPrefix(value, []byte(kid+"|")) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":{"code":"BadParameter"}}`))
+			return
+		}
+		resp = map[string]string{"kid": kid, "value": base64.RawURLEncoding.EncodeToString(value[len(kid)+1:])}
+	default:
+		notFound()
+		return
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// setupFakeKeyVault returns the URL of the vault
+func setupFakeKeyVault(t *testing.T) string {
+	srv := httptest.NewTLSServer(&fakeKeyVault{kty: map[string]string{"rsa": "RSA-HSM", "oct": "oct-HSM", "ec": "EC"}})
+	t.Cleanup(srv.Close)
+
+	oldClient := httpClient
+	httpClient = srv.Client()
+	disableInstanceDiscovery = true
+	t.Cleanup(func() {
+		httpClient = oldClient
+		disableInstanceDiscovery = false
+		credential = nil
+	})
+	t.Setenv("AZURE_AUTHORITY_HOST", srv.URL)
+	t.Setenv("AZURE_TENANT_ID", "tenant")
+	t.Setenv("AZURE_CLIENT_ID", "client")
+	t.Setenv("AZURE_CLIENT_SECRET", "secret")
+	credential = nil
+	return srv.URL
+}
+
+func TestKeyWrapAzureKVSuccess(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the azurekv scheme")
+
+	vault := setupFakeKeyVault(t)
+
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"azure-kv-keys": {[]byte(vault + "/keys/rsa"), []byte(URIScheme + strings.TrimPrefix(vault, "https://") + "/keys/oct")},
+		},
+	}
+	wk, err := kw.WrapKeys(ec, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{vault + "/keys/rsa", vault + "/keys/oct/v1"} {
+		dc := &config.DecryptConfig{
+			Parameters: map[string][][]byte{
+				"azure-kv-keys": {[]byte(key)},
+			},
+		}
+		ud, keyID, err := kw.(*azureKVKeyWrapper).UnwrapKeyID(dc, wk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, ud) {
+			t.Fatal("Strings don't match")
+		}
+		if !strings.HasPrefix(keyID, "azurekv:"+key) {
+			t.Fatalf("unexpected key ID %s", keyID)
+		}
+	}
+
+	recipients, err := kw.GetRecipients(base64.StdEncoding.EncodeToString(wk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 2 || recipients[0] != "azurekv:"+vault+"/keys/oct/v1" || recipients[1] != "azurekv:"+vault+"/keys/rsa/v1" {
+		t.Fatalf("unexpected recipients %v", recipients)
+	}
+}
+
+func TestKeyWrapAzureKVWorkloadIdentity(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the azurekv scheme")
+
+	vault := setupFakeKeyVault(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("aks-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AZURE_CLIENT_SECRET", "")
+	t.Setenv("AZURE_FEDERATED_TOKEN_FILE", tokenFile)
+	credential = nil
+
+	kw := NewKeyWrapper()
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"azure-kv-keys": {[]byte(vault + "/keys/rsa")},
+		},
+	}
+	if _, err := kw.WrapKeys(ec, []byte("This is some secret text")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyWrapAzureKVInvalid(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the azurekv scheme")
+
+	vault := setupFakeKeyVault(t)
+
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"azure-kv-keys": {[]byte(vault + "/keys/rsa")},
+		},
+	}
+	wk, err := kw.WrapKeys(ec, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// other keys and versions are not tried
+	for _, key := range []string{vault + "/keys/oct", vault + "/keys/rsa/v2", "https://other.vault.azure.net/keys/rsa"} {
+		dc := &config.DecryptConfig{
+			Parameters: map[string][][]byte{
+				"azure-kv-keys": {[]byte(key)},
+			},
+		}
+		if _, err := kw.UnwrapKey(dc, wk); !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+			t.Fatalf("expected ErrNoDecryptionKey for %s, got %v", key, err)
+		}
+	}
+
+	for _, key := range []string{vault + "/keys/ec", vault + "/secrets/rsa", "http://myvault.vault.azure.net/keys/rsa"} {
+		ec.Parameters["azure-kv-keys"] = [][]byte{[]byte(key)}
+		if _, err := kw.WrapKeys(ec, data); !errors.Is(err, errdefs.ErrConfiguration) {
+			t.Fatalf("expected ErrConfiguration for %s, got %v", key, err)
+		}
+	}
+
+	t.Setenv("AZURE_CLIENT_SECRET", "other")
+	credential = nil
+	ec.Parameters["azure-kv-keys"] = [][]byte{[]byte(vault + "/keys/rsa")}
+	if _, err := kw.WrapKeys(ec, data); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gcpkms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// credentialsEnv names the file with the application default credentials
+	credentialsEnv = "GOOGLE_APPLICATION_CREDENTIALS"
+	// cloudPlatformScope is the OAuth2 scope of the access tokens
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+var (
+	tokenLock   sync.Mutex
+	tokenSource oauth2.TokenSource
+)
+
+// getAccessToken returns an access token for the application default
+// credentials found by golang.org/x/oauth2/google: the file of
+// GOOGLE_APPLICATION_CREDENTIALS or the one written by 'gcloud auth
+// application-default login', and the service account of the GCE metadata
+// server otherwise, which is also where GKE workload identity provides its
+// tokens. The token source is kept; it caches tokens until shortly before
+// they expire.
+func getAccessToken(ctx context.Context) (string, error) {
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return "", fmt.Errorf("GCP KMS: could not get an access token: %v: %w", err, errdefs.ErrProviderUnreachable)
+	}
+	if tokenSource == nil {
+		// the token source outlives ctx
+		credsCtx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+		creds, err := google.FindDefaultCredentials(credsCtx, cloudPlatformScope)
+		if err != nil {
+			return "", errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("GCP KMS: no Google credentials found: %w", err))
+		}
+		tokenSource = creds.TokenSource
+	}
+	token, err := tokenSource.Token()
+	if err != nil {
+		return "", tokenError(err)
+	}
+	return token.AccessToken, nil
+}
+
+// tokenError returns the error of getting an access token with the category
+// of the failure; refused credentials are a configuration error
+func tokenError(err error) error {
+	var (
+		netErr      net.Error
+		retrieveErr *oauth2.RetrieveError
+	)
+	err = fmt.Errorf("GCP KMS: could not get an access token: %w", err)
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr):
+		return errdefs.WithCategory(errdefs.ErrProviderUnreachable, err)
+	case errors.As(err, &retrieveErr) && retrieveErr.Response != nil &&
+		(retrieveErr.Response.StatusCode >= http.StatusInternalServerError || retrieveErr.Response.StatusCode == http.StatusTooManyRequests):
+		return errdefs.WithCategory(errdefs.ErrProviderUnreachable, err)
+	}
+	return errdefs.WithCategory(errdefs.ErrConfiguration, err)
+}
@@ -0,0 +1,472 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gcpkms
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha1" // OAEP hashes of Cloud KMS keys
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
+	"github.com/containers/ocicrypt/keywrap"
+	"github.com/containers/ocicrypt/log"
+	"github.com/containers/ocicrypt/spiffe"
+	"github.com/containers/ocicrypt/utils"
+)
+
+const (
+	// CallTimeout is the time Cloud KMS has for encrypting or decrypting a
+	// layer key, including getting an access token
+	CallTimeout = 10 * time.Second
+	// URIScheme is the prefix of the key names in recipient strings, as in
+	// gcpkms://projects/p/locations/global/keyRings/r/cryptoKeys/k
+	URIScheme = "gcpkms://"
+	// maxResponseSize is the maximum size of a response of Cloud KMS
+	maxResponseSize = 64 * 1024
+)
+
+// additionalAuthenticatedData is passed to every symmetric Encrypt and
+// Decrypt call; Cloud KMS binds the ciphertexts to it
+var additionalAuthenticatedData = []byte("org.opencontainers.image.enc/layer-key")
+
+var (
+	// kmsEndpoint is the URL of Cloud KMS; tests replace it
+	kmsEndpoint = "https://cloudkms.googleapis.com"
+	// httpClient is used for calling Google; tests replace it
+	httpClient = &http.Client{Timeout: CallTimeout}
+)
+
+// gcpKMSBlob is the wrapped key; it holds the layer key encrypted by every
+// KMS key
+type gcpKMSBlob struct {
+	Version    int               `json:"version"`
+	Recipients []gcpKMSRecipient `json:"recipients"`
+}
+
+type gcpKMSRecipient struct {
+	// KeyName is the resource name of a symmetric key or of the version of an
+	// asymmetric key
+	KeyName    string `json:"key_name"`
+	Ciphertext []byte `json:"ciphertext"`
+	// Sealed holds the layer key options encrypted with AES-256-GCM for
+	// asymmetric keys, whose Ciphertext is the AES key; RSA-OAEP cannot
+	// encrypt the options directly with all key sizes
+	Sealed []byte `json:"sealed,omitempty"`
+}
+
+// keyName is the resource name of a KMS key, which is a key version for
+// asymmetric keys
+type keyName struct {
+	name string
+	// version is set for key versions
+	version bool
+}
+
+type gcpKMSKeyWrapper struct {
+}
+
+func (kw *gcpKMSKeyWrapper) GetAnnotationID() string {
+	return "org.opencontainers.image.enc.keys.gcp-kms"
+}
+
+// NewKeyWrapper returns a new key wrapping interface that encrypts layer keys
+// with Google Cloud KMS keys
+func NewKeyWrapper() keywrap.KeyWrapper {
+	return &gcpKMSKeyWrapper{}
+}
+
+// WrapKeys has the KMS keys of the gcp-kms-keys parameter encrypt the optsData,
+// which describe the symmetric key used for encrypting the layer. Symmetric
+// keys encrypt in Cloud KMS, the public keys of asymmetric key versions
+// locally with RSA-OAEP.
+func (kw *gcpKMSKeyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	return kw.WrapKeysContext(context.Background(), ec, optsData)
+}
+
+// WrapKeysContext wraps the layer key like WrapKeys, giving up once ctx is done
+func (kw *gcpKMSKeyWrapper) WrapKeysContext(ctx context.Context, ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	keys, err := parseKeyNames(ec.Parameters["gcp-kms-keys"])
+	if err != nil {
+		return nil, err
+	}
+	// no recipients is not an error...
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	client := spiffe.HTTPClient(httpClient, ec.DecryptConfig.SVIDSource)
+	blob := gcpKMSBlob{}
+	for _, key := range keys {
+		callCtx, cancel := context.WithTimeout(ctx, CallTimeout)
+		var ciphertext, sealed []byte
+		if key.version {
+			ciphertext, sealed, err = encryptAsymmetric(callCtx, client, key, optsData)
+		} else {
+			var resp struct {
+				Ciphertext []byte `json:"ciphertext"`
+			}
+			err = call(callCtx, client, http.MethodPost, key.name+":encrypt", map[string]interface{}{
+				"plaintext":                   optsData,
+				"additionalAuthenticatedData": additionalAuthenticatedData,
+			}, &resp)
+			ciphertext = resp.Ciphertext
+		}
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("GCP KMS encryption with %s failed: %w", key.name, err)
+		}
+		if len(ciphertext) == 0 {
+			return nil, fmt.Errorf("GCP KMS returned no ciphertext for %s: %w", key.name, errdefs.ErrProtocol)
+		}
+		blob.Recipients = append(blob.Recipients, gcpKMSRecipient{
+			KeyName:    key.name,
+			Ciphertext: ciphertext,
+			Sealed:     sealed,
+		})
+	}
+	sort.SliceStable(blob.Recipients, func(i, j int) bool {
+		return blob.Recipients[i].KeyName < blob.Recipients[j].KeyName
+	})
+	return json.Marshal(&blob)
+}
+
+// encryptAsymmetric seals the optsData with a random AES key and encrypts the
+// AES key with the public key of an asymmetric key version, which Cloud KMS
+// cannot do
+func encryptAsymmetric(ctx context.Context, client *http.Client, key keyName, optsData []byte) ([]byte, []byte, error) {
+	var resp struct {
+		Pem       string `json:"pem"`
+		Algorithm string `json:"algorithm"`
+	}
+	if err := call(ctx, client, http.MethodGet, key.name+"/publicKey", nil, &resp); err != nil {
+		return nil, nil, err
+	}
+	var hash crypto.Hash
+	switch {
+	case !strings.HasPrefix(resp.Algorithm, "RSA_DECRYPT_OAEP_"):
+		return nil, nil, fmt.Errorf("GCP KMS key %s has the algorithm %s, which does not support decryption: %w", key.name, resp.Algorithm, errdefs.ErrConfiguration)
+	case strings.HasSuffix(resp.Algorithm, "_SHA256"):
+		hash = crypto.SHA256
+	case strings.HasSuffix(resp.Algorithm, "_SHA512"):
+		hash = crypto.SHA512
+	case strings.HasSuffix(resp.Algorithm, "_SHA1"):
+		hash = crypto.SHA1
+	default:
+		return nil, nil, fmt.Errorf("GCP KMS key %s has the unsupported algorithm %s: %w", key.name, resp.Algorithm, errdefs.ErrConfiguration)
+	}
+	pubKey, err := utils.ParsePublicKey([]byte(resp.Pem), "GCP KMS")
+	if err != nil {
+		return nil, nil, errdefs.WithCategory(errdefs.ErrProtocol, err)
+	}
+	rsaKey, ok := pubKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("GCP KMS returned a public key that is not an RSA key for %s: %w", key.name, errdefs.ErrProtocol)
+	}
+	aesKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, aesKey); err != nil {
+		return nil, nil, fmt.Errorf("could not generate the AES key: %w", err)
+	}
+	sealed, err := seal(aesKey, optsData)
+	if err != nil {
+		return nil, nil, err
+	}
+	ciphertext, err := rsa.EncryptOAEP(hash.New(), rand.Reader, rsaKey, aesKey, nil)
+	if err != nil {
+		return nil, nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("GCP KMS: RSA-OAEP encryption failed: %w", err))
+	}
+	return ciphertext, sealed, nil
+}
+
+// seal encrypts the optsData with AES-256-GCM and prefixes them with the nonce
+func seal(key, optsData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("could not generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, optsData, additionalAuthenticatedData), nil
+}
+
+// open decrypts optsData sealed by seal
+func open(key, sealed []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("GCP KMS: sealed layer key options are too short: %w", errdefs.ErrProtocol)
+	}
+	optsData, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalAuthenticatedData)
+	if err != nil {
+		return nil, fmt.Errorf("GCP KMS: could not open the layer key options: %w", errdefs.ErrIntegrity)
+	}
+	return optsData, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if fips.Enforced() {
+		// the nonces are not generated by the FIPS module
+		return nil, fmt.Errorf("GCP KMS: sealing the layer key options for asymmetric keys is not available in FIPS 140-only mode: %w", errdefs.ErrDisallowedAlgorithm)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrProtocol, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func (kw *gcpKMSKeyWrapper) UnwrapKey(dc *config.DecryptConfig, annotation []byte) ([]byte, error) {
+	optsData, _, err := kw.UnwrapKeyID(dc, annotation)
+	return optsData, err
+}
+
+// UnwrapKeyID has the KMS keys of the gcp-kms-keys parameter decrypt the
+// symmetric key with which the layer is encrypted and returns the name of the
+// KMS key that decrypted it. The name of an asymmetric key stands for all of
+// its versions.
+func (kw *gcpKMSKeyWrapper) UnwrapKeyID(dc *config.DecryptConfig, annotation []byte) ([]byte, string, error) {
+	return kw.UnwrapKeyIDContext(context.Background(), dc, annotation)
+}
+
+// UnwrapKeyIDContext unwraps the layer key like UnwrapKeyID, giving up once
+// ctx is done
+func (kw *gcpKMSKeyWrapper) UnwrapKeyIDContext(ctx context.Context, dc *config.DecryptConfig, annotation []byte) ([]byte, string, error) {
+	keys, err := parseKeyNames(kw.GetPrivateKeys(dc.Parameters))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(keys) == 0 {
+		return nil, "", fmt.Errorf("No KMS keys found for GCP KMS decryption: %w", errdefs.ErrNoDecryptionKey)
+	}
+
+	var blob gcpKMSBlob
+	if err := json.Unmarshal(annotation, &blob); err != nil {
+		return nil, "", fmt.Errorf("could not parse the GCP KMS wrapped key: %w", errdefs.ErrProtocol)
+	}
+	if blob.Version != 0 {
+		return nil, "", fmt.Errorf("unsupported GCP KMS wrapped key version %d: %w", blob.Version, errdefs.ErrProtocol)
+	}
+	if err := dc.GetLimits().CheckRecipients(len(blob.Recipients)); err != nil {
+		return nil, "", err
+	}
+
+	client := spiffe.HTTPClient(httpClient, dc.SVIDSource)
+	var unreachableErr error
+	for _, key := range keys {
+		for _, recipient := range blob.Recipients {
+			if !key.mayDecrypt(recipient.KeyName) {
+				continue
+			}
+			recipientKey, err := parseKeyName(recipient.KeyName)
+			if err != nil {
+				return nil, "", errdefs.WithCategory(errdefs.ErrProtocol, err)
+			}
+			callCtx, cancel := context.WithTimeout(ctx, CallTimeout)
+			var resp struct {
+				Plaintext []byte `json:"plaintext"`
+			}
+			if recipientKey.version {
+				err = call(callCtx, client, http.MethodPost, recipientKey.name+":asymmetricDecrypt", map[string]interface{}{
+					"ciphertext": recipient.Ciphertext,
+				}, &resp)
+			} else {
+				err = call(callCtx, client, http.MethodPost, recipientKey.name+":decrypt", map[string]interface{}{
+					"ciphertext":                  recipient.Ciphertext,
+					"additionalAuthenticatedData": additionalAuthenticatedData,
+				}, &resp)
+			}
+			cancel()
+			if err == nil && recipientKey.version {
+				resp.Plaintext, err = open(resp.Plaintext, recipient.Sealed)
+			}
+			if err == nil {
+				if len(resp.Plaintext) > keywrap.MaxOptsDataSize {
+					return nil, "", fmt.Errorf("GCP KMS: layer key options are larger than %d bytes: %w", keywrap.MaxOptsDataSize, errdefs.ErrLimitExceeded)
+				}
+				return resp.Plaintext, "gcpkms:" + recipient.KeyName, nil
+			}
+			log.L().Debug("GCP KMS could not decrypt the layer key", log.KeyKeyID, recipient.KeyName, log.KeyError, err)
+			if errors.Is(err, errdefs.ErrProviderUnreachable) {
+				unreachableErr = err
+			}
+		}
+	}
+	if unreachableErr != nil {
+		return nil, "", fmt.Errorf("GCP KMS: No KMS key could decrypt the layer key: %w", unreachableErr)
+	}
+	return nil, "", fmt.Errorf("GCP KMS: No KMS key could decrypt the layer key: %w", errdefs.ErrNoDecryptionKey)
+}
+
+func (kw *gcpKMSKeyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
+	return len(kw.GetPrivateKeys(dcparameters)) == 0
+}
+
+// GetPrivateKeys returns the names of the KMS keys since the keys cannot leave
+// Cloud KMS
+func (kw *gcpKMSKeyWrapper) GetPrivateKeys(dcparameters map[string][][]byte) [][]byte {
+	return dcparameters["gcp-kms-keys"]
+}
+
+func (kw *gcpKMSKeyWrapper) GetKeyIdsFromPacket(_ string) ([]uint64, error) {
+	return nil, nil
+}
+
+// GetRecipients returns the names of the KMS keys the layer key is encrypted
+// with
+func (kw *gcpKMSKeyWrapper) GetRecipients(b64blobs string) ([]string, error) {
+	var recipients []string
+	for _, b64blob := range strings.Split(b64blobs, ",") {
+		data, err := base64.StdEncoding.DecodeString(b64blob)
+		if err != nil {
+			return nil, fmt.Errorf("could not base64 decode the GCP KMS wrapped key: %w", errdefs.ErrProtocol)
+		}
+		var blob gcpKMSBlob
+		if err := json.Unmarshal(data, &blob); err != nil {
+			return nil, fmt.Errorf("could not parse the GCP KMS wrapped key: %w", errdefs.ErrProtocol)
+		}
+		for _, recipient := range blob.Recipients {
+			recipients = append(recipients, "gcpkms:"+recipient.KeyName)
+		}
+	}
+	return recipients, nil
+}
+
+// parseKeyNames parses the names of KMS keys, which may be prefixed by
+// gcpkms://; duplicates are dropped
+func parseKeyNames(values [][]byte) ([]keyName, error) {
+	var keys []keyName
+	seen := make(map[string]bool)
+	for _, value := range values {
+		key, err := parseKeyName(strings.TrimPrefix(string(value), URIScheme))
+		if err != nil {
+			return nil, err
+		}
+		if seen[key.name] {
+			continue
+		}
+		seen[key.name] = true
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// parseKeyName parses projects/p/locations/l/keyRings/r/cryptoKeys/k and
+// projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/v
+func parseKeyName(name string) (keyName, error) {
+	parts := strings.Split(name, "/")
+	valid := len(parts) == 8 || len(parts) == 10
+	for i, collection := range []string{"projects", "locations", "keyRings", "cryptoKeys", "cryptoKeyVersions"} {
+		if !valid || 2*i >= len(parts) {
+			break
+		}
+		valid = parts[2*i] == collection && parts[2*i+1] != ""
+	}
+	if !valid {
+		return keyName{}, fmt.Errorf("GCP KMS: %q is not the name of a KMS key or key version: %w", name, errdefs.ErrConfiguration)
+	}
+	return keyName{name: name, version: len(parts) == 10}, nil
+}
+
+// mayDecrypt returns true if the KMS key may decrypt a ciphertext of the KMS
+// key or key version with the given name
+func (k keyName) mayDecrypt(name string) bool {
+	return k.name == name || (!k.version && strings.HasPrefix(name, k.name+"/cryptoKeyVersions/"))
+}
+
+// call calls a method of the Cloud KMS REST API on a resource with the client
+func call(ctx context.Context, client *http.Client, method, resource string, req, resp interface{}) error {
+	token, err := getAccessToken(ctx)
+	if err != nil {
+		return err
+	}
+	var body []byte
+	if req != nil {
+		if body, err = json.Marshal(req); err != nil {
+			return err
+		}
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, kmsEndpoint+"/v1/"+resource, bytes.NewReader(body))
+	if err != nil {
+		return errdefs.WithCategory(errdefs.ErrConfiguration, err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("could not call GCP KMS: %v: %w", err, errdefs.ErrProviderUnreachable)
+	}
+	defer httpResp.Body.Close()
+	data, err := readAll(httpResp)
+	if err != nil {
+		return err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		var kmsErr struct {
+			Error struct {
+				Status  string `json:"status"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		_ = json.Unmarshal(data, &kmsErr)
+		status, message := kmsErr.Error.Status, kmsErr.Error.Message
+		switch {
+		case httpResp.StatusCode >= 500 || httpResp.StatusCode == http.StatusTooManyRequests:
+			return fmt.Errorf("GCP KMS failed with %d %s %s: %w", httpResp.StatusCode, status, message, errdefs.ErrProviderUnreachable)
+		case strings.HasSuffix(resource, "ecrypt"):
+			return fmt.Errorf("GCP KMS failed with %d %s %s: %w", httpResp.StatusCode, status, message, errdefs.ErrNoDecryptionKey)
+		default:
+			return fmt.Errorf("GCP KMS failed with %d %s %s: %w", httpResp.StatusCode, status, message, errdefs.ErrConfiguration)
+		}
+	}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return fmt.Errorf("could not parse the response of GCP KMS: %w", errdefs.ErrProtocol)
+	}
+	return nil
+}
+
+func readAll(resp *http.Response) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not read the response of GCP KMS: %v: %w", err, errdefs.ErrProviderUnreachable)
+	}
+	if len(data) > maxResponseSize {
+		return nil, fmt.Errorf("the response of GCP KMS is too large: %w", errdefs.ErrProtocol)
+	}
+	return data, nil
+}
@@ -0,0 +1,314 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gcpkms
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/utils"
+)
+
+const (
+	testSymKey   = "projects/p/locations/global/keyRings/r/cryptoKeys/sym"
+	testAsymKey  = "projects/p/locations/global/keyRings/r/cryptoKeys/asym"
+	testAccToken = "ya29.test"
+)
+
+// fakeKMS is a Cloud KMS and token endpoint; symmetric keys 'encrypt' by
+// prefixing the plaintext with the key name, the asymmetric key is a real
+// RSA key
+type fakeKMS struct {
+	asymKey *rsa.PrivateKey
+}
+
+func (f *fakeKMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if r.URL.Path == "/token" {
+		// user credentials, service account keys and workload identity
+		// federation
+		form, _ := url.ParseQuery(string(body))
+		switch {
+		case form.Get("grant_type") == "refresh_token" && form.Get("refresh_token") == "refresh":
+		case form.Get("grant_type") == "urn:ietf:params:oauth:grant-type:jwt-bearer" && form.Get("assertion") != "":
+		case form.Get("grant_type") == "urn:ietf:params:oauth:grant-type:token-exchange" && form.Get("subject_token") == "k8s-token":
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"` + testAccToken + `","token_type":"Bearer","issued_token_type":"urn:ietf:params:oauth:token-type:access_token","expires_in":3600}`))
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+testAccToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":{"code":401,"status":"UNAUTHENTICATED"}}`))
+		return
+	}
+	resource := strings.TrimPrefix(r.URL.Path, "/v1/")
+	var req struct {
+		Plaintext                   []byte `json:"plaintext"`
+		Ciphertext                  []byte `json:"ciphertext"`
+		AdditionalAuthenticatedData []byte `json:"additionalAuthenticatedData"`
+	}
+	_ = json.Unmarshal(body, &req)
+	var resp interface{}
+	switch {
+	case strings.HasSuffix(resource, ":encrypt") || strings.HasSuffix(resource, ":decrypt"):
+		name := resource[:strings.LastIndex(resource, ":")]
+		if !strings.HasPrefix(name, testSymKey) || !bytes.Equal(req.AdditionalAuthenticatedData, additionalAuthenticatedData) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":{"code":404,"status":"NOT_FOUND"}}`))
+			return
+		}
+		if strings.HasSuffix(resource, ":encrypt") {
+			resp = map[string]interface{}{
+				"name":       name + "/cryptoKeyVersions/1",
+				"ciphertext": append([]byte(name+"|"), req.Plaintext...),
+			}
+		} else {
+			if !bytes.HasPrefix(req.Ciphertext, []byte(name+"|")) {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error":{"code":400,"status":"INVALID_ARGUMENT","message":"Decryption failed"}}`))
+				return
+			}
+			resp = map[string]interface{}{"plaintext": req.Ciphertext[len(name)+1:]}
+		}
+	case resource == testAsymKey+"/cryptoKeyVersions/1/publicKey":
+		der, _ := x509.MarshalPKIXPublicKey(&f.asymKey.PublicKey)
+		resp = map[string]interface{}{
+			"pem":       string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+			"algorithm": "RSA_DECRYPT_OAEP_2048_SHA256",
+		}
+	case resource == testAsymKey+"/cryptoKeyVersions/1:asymmetricDecrypt":
+		plaintext, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, f.asymKey, req.Ciphertext, nil)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp = map[string]interface{}{"plaintext": plaintext}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":{"code":404,"status":"NOT_FOUND"}}`))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// setupFakeKMS returns the URL of the token endpoint
+func setupFakeKMS(t *testing.T) string {
+	asymKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(&fakeKMS{asymKey: asymKey})
+	t.Cleanup(srv.Close)
+
+	oldEndpoint := kmsEndpoint
+	kmsEndpoint = srv.URL
+	t.Cleanup(func() {
+		kmsEndpoint = oldEndpoint
+		tokenSource = nil
+	})
+
+	tokenURL := srv.URL + "/token"
+	writeCredentials(t, map[string]interface{}{
+		"type":          "authorized_user",
+		"client_id":     "id",
+		"client_secret": "secret",
+		"refresh_token": "refresh",
+		"token_uri":     tokenURL,
+	})
+	return tokenURL
+}
+
+// writeCredentials writes the application default credentials
+func writeCredentials(t *testing.T, creds map[string]interface{}) {
+	data, err := json.Marshal(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credsFile := filepath.Join(t.TempDir(), "credentials.json")
+	if err := ioutil.WriteFile(credsFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(credentialsEnv, credsFile)
+	tokenSource = nil
+}
+
+func TestKeyWrapGCPKMSSuccess(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "wrapping with asymmetric GCP KMS keys")
+
+	setupFakeKMS(t)
+
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"gcp-kms-keys": {[]byte(URIScheme + testSymKey), []byte(testAsymKey + "/cryptoKeyVersions/1")},
+		},
+	}
+	wk, err := kw.WrapKeys(ec, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{testSymKey, testAsymKey, URIScheme + testAsymKey + "/cryptoKeyVersions/1"} {
+		dc := &config.DecryptConfig{
+			Parameters: map[string][][]byte{
+				"gcp-kms-keys": {[]byte(key)},
+			},
+		}
+		ud, keyID, err := kw.(*gcpKMSKeyWrapper).UnwrapKeyID(dc, wk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, ud) {
+			t.Fatal("Strings don't match")
+		}
+		if !strings.HasPrefix(keyID, "gcpkms:projects/p/") {
+			t.Fatalf("unexpected key ID %s", keyID)
+		}
+	}
+
+	recipients, err := kw.GetRecipients(base64.StdEncoding.EncodeToString(wk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 2 || recipients[0] != "gcpkms:"+testAsymKey+"/cryptoKeyVersions/1" || recipients[1] != "gcpkms:"+testSymKey {
+		t.Fatalf("unexpected recipients %v", recipients)
+	}
+}
+
+func TestKeyWrapGCPKMSInvalid(t *testing.T) {
+	setupFakeKMS(t)
+
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"gcp-kms-keys": {[]byte(testSymKey)},
+		},
+	}
+	wk, err := kw.WrapKeys(ec, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another key and a version of the asymmetric key are not tried
+	for _, key := range []string{testSymKey + "2", testAsymKey + "/cryptoKeyVersions/1"} {
+		dc := &config.DecryptConfig{
+			Parameters: map[string][][]byte{
+				"gcp-kms-keys": {[]byte(key)},
+			},
+		}
+		if _, err := kw.UnwrapKey(dc, wk); !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+			t.Fatalf("expected ErrNoDecryptionKey for %s, got %v", key, err)
+		}
+	}
+
+	for _, key := range []string{"projects/p/locations/global/keyRings/r", "projects/p/locations/global/keyRings/r/cryptoKeys/"} {
+		ec.Parameters["gcp-kms-keys"] = [][]byte{[]byte(key)}
+		if _, err := kw.WrapKeys(ec, data); !errors.Is(err, errdefs.ErrConfiguration) {
+			t.Fatalf("expected ErrConfiguration for %s, got %v", key, err)
+		}
+	}
+
+	kmsEndpoint = "http://127.0.0.1:1"
+	dc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"gcp-kms-keys": {[]byte(testSymKey)},
+		},
+	}
+	if _, err := kw.UnwrapKey(dc, wk); !errors.Is(err, errdefs.ErrProviderUnreachable) {
+		t.Fatalf("expected ErrProviderUnreachable, got %v", err)
+	}
+}
+
+func TestKeyWrapGCPKMSCredentials(t *testing.T) {
+	tokenURL := setupFakeKMS(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("k8s-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	kw := NewKeyWrapper()
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"gcp-kms-keys": {[]byte(testSymKey)},
+		},
+	}
+	for _, creds := range []map[string]interface{}{
+		{
+			"type":           "service_account",
+			"client_email":   "layers@p.iam.gserviceaccount.com",
+			"private_key_id": "kid1",
+			"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+			"token_uri":      tokenURL,
+		},
+		{
+			"type":               "external_account",
+			"audience":           "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/k8s/providers/k8s",
+			"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+			"token_url":          tokenURL,
+			"credential_source":  map[string]string{"file": tokenFile},
+		},
+	} {
+		writeCredentials(t, creds)
+		if _, err := kw.WrapKeys(ec, []byte("This is some secret text")); err != nil {
+			t.Fatalf("%s: %v", creds["type"], err)
+		}
+	}
+
+	writeCredentials(t, map[string]interface{}{
+		"type":          "authorized_user",
+		"client_id":     "id",
+		"client_secret": "secret",
+		"refresh_token": "revoked",
+		"token_uri":     tokenURL,
+	})
+	if _, err := kw.WrapKeys(ec, []byte("This is some secret text")); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+}
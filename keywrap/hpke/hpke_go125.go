@@ -0,0 +1,41 @@
+//go:build !go1.26
+// +build !go1.26
+
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hpke
+
+import (
+	"fmt"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/utils"
+)
+
+// seal needs crypto/hpke, which is available since Go 1.26
+func seal(key interface{}, info, plaintext []byte) ([]byte, error) {
+	return nil, fmt.Errorf("HPKE requires Go 1.26 or later: %w", errdefs.ErrConfiguration)
+}
+
+// open needs crypto/hpke, which is available since Go 1.26
+func open(key interface{}, info, sealed []byte) ([]byte, error) {
+	return nil, fmt.Errorf("HPKE requires Go 1.26 or later: %w", errdefs.ErrConfiguration)
+}
+
+func keyID(key interface{}) string {
+	return utils.KeyID(key)
+}
@@ -0,0 +1,77 @@
+//go:build go1.26
+// +build go1.26
+
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hpke
+
+import (
+	"crypto/ecdh"
+	"crypto/hpke"
+	"fmt"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/utils"
+	"github.com/opencontainers/go-digest"
+)
+
+// seal seals the plaintext to an X25519 public key or an hpke.PublicKey
+func seal(key interface{}, info, plaintext []byte) ([]byte, error) {
+	var pk hpke.PublicKey
+	switch k := key.(type) {
+	case *ecdh.PublicKey:
+		var err error
+		if pk, err = hpke.NewDHKEMPublicKey(k); err != nil {
+			return nil, errdefs.WithCategory(errdefs.ErrUnsupportedKey, err)
+		}
+	case hpke.PublicKey:
+		pk = k
+	default:
+		return nil, fmt.Errorf("HPKE: %T keys cannot be used for encryption: %w", key, errdefs.ErrUnsupportedKey)
+	}
+	return hpke.Seal(pk, hpke.HKDFSHA256(), hpke.ChaCha20Poly1305(), info, plaintext)
+}
+
+// open opens what seal sealed to the public key of an X25519 private key or
+// an hpke.PrivateKey
+func open(key interface{}, info, sealed []byte) ([]byte, error) {
+	var sk hpke.PrivateKey
+	switch k := key.(type) {
+	case *ecdh.PrivateKey:
+		var err error
+		if sk, err = hpke.NewDHKEMPrivateKey(k); err != nil {
+			return nil, errdefs.WithCategory(errdefs.ErrUnsupportedKey, err)
+		}
+	case hpke.PrivateKey:
+		sk = k
+	default:
+		return nil, fmt.Errorf("HPKE: %T keys cannot be used for decryption: %w", key, errdefs.ErrUnsupportedKey)
+	}
+	return hpke.Open(sk, hpke.HKDFSHA256(), hpke.ChaCha20Poly1305(), info, sealed)
+}
+
+// keyID returns the digest of the serialized public key of an hpke.PublicKey
+// or hpke.PrivateKey, which have no PKIX encoding, and utils.KeyID otherwise
+func keyID(key interface{}) string {
+	switch k := key.(type) {
+	case hpke.PublicKey:
+		return digest.FromBytes(k.Bytes()).String()
+	case hpke.PrivateKey:
+		return digest.FromBytes(k.PublicKey().Bytes()).String()
+	}
+	return utils.KeyID(key)
+}
@@ -0,0 +1,241 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hpke
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
+	"github.com/containers/ocicrypt/keywrap"
+	"github.com/containers/ocicrypt/utils"
+)
+
+// errUnavailable is returned in FIPS 140-only mode since the cipher suites
+// rely on X25519 and ChaCha20-Poly1305
+var errUnavailable = fmt.Errorf("HPKE is not available in FIPS 140-only mode: %w", errdefs.ErrDisallowedAlgorithm)
+
+// hpkeBlob is the wrapped key; it holds the layer key sealed to every
+// recipient with the KEM of the keys, HKDF-SHA256 and ChaCha20-Poly1305 in
+// base mode, each as the encapsulated key followed by the ciphertext
+type hpkeBlob struct {
+	Version    int      `json:"version"`
+	Recipients [][]byte `json:"recipients"`
+}
+
+// hpkeKeyWrapper wraps keys with HPKE for the keys of one KEM; the annotation
+// ID is also the info of the HPKE contexts, which binds them to their use for
+// wrapping layer keys
+type hpkeKeyWrapper struct {
+	annotationID string
+	// pubKeysParam, privKeysParam and passwordsParam are the parameters
+	// holding the public keys, the private keys and their passwords; the
+	// passwords are optional
+	pubKeysParam, privKeysParam, passwordsParam string
+	// parsePubKey parses a public key and fails unless it is for the KEM
+	parsePubKey func(pubKey []byte) (interface{}, error)
+	// parsePrivKey parses a private key protected by a password
+	parsePrivKey func(privKey, password []byte) (interface{}, error)
+}
+
+func (kw *hpkeKeyWrapper) GetAnnotationID() string {
+	return kw.annotationID
+}
+
+// NewKeyWrapper returns a new key wrapping interface using HPKE (RFC 9180)
+// with X25519 keys
+func NewKeyWrapper() keywrap.KeyWrapper {
+	return &hpkeKeyWrapper{
+		annotationID:   "org.opencontainers.image.enc.keys.hpke",
+		pubKeysParam:   "hpke-pubkeys",
+		privKeysParam:  "hpke-privkeys",
+		passwordsParam: "hpke-privkeys-passwords",
+		parsePubKey: func(pubKey []byte) (interface{}, error) {
+			key, err := utils.ParsePublicKey(pubKey, "HPKE")
+			if err != nil {
+				return nil, err
+			}
+			if utils.KeyType(key) != "X25519" {
+				return nil, fmt.Errorf("HPKE: %s keys cannot be used for encryption: %w", utils.KeyType(key), errdefs.ErrUnsupportedKey)
+			}
+			return key, nil
+		},
+		parsePrivKey: func(privKey, password []byte) (interface{}, error) {
+			return utils.ParsePrivateKey(privKey, password, "HPKE")
+		},
+	}
+}
+
+// NewMLKEM768X25519KeyWrapper returns a new, experimental key wrapping
+// interface using HPKE with the hybrid post-quantum KEM MLKEM768-X25519
+// (X-Wing), which keeps layer keys confidential as long as either ML-KEM-768
+// or X25519 is not broken
+func NewMLKEM768X25519KeyWrapper() keywrap.KeyWrapper {
+	return &hpkeKeyWrapper{
+		annotationID:  "org.opencontainers.image.enc.keys.experimental.mlkem768x25519",
+		pubKeysParam:  "mlkem768x25519-pubkeys",
+		privKeysParam: "mlkem768x25519-privkeys",
+		parsePubKey: func(pubKey []byte) (interface{}, error) {
+			return utils.ParseMLKEM768X25519PublicKey(pubKey, "MLKEM768-X25519")
+		},
+		parsePrivKey: func(privKey, _ []byte) (interface{}, error) {
+			return utils.ParseMLKEM768X25519PrivateKey(privKey, "MLKEM768-X25519")
+		},
+	}
+}
+
+// WrapKeys seals the optsData, which describe the symmetric key used for
+// encrypting the layer, to the public keys of the pubKeysParam parameter
+func (kw *hpkeKeyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	pubKeys, err := kw.parsePubKeys(ec.Parameters[kw.pubKeysParam])
+	if err != nil {
+		return nil, err
+	}
+	// no recipients is not an error...
+	if len(pubKeys) == 0 {
+		return nil, nil
+	}
+	if fips.Enforced() {
+		return nil, errUnavailable
+	}
+
+	blob := hpkeBlob{}
+	for _, pubKey := range pubKeys {
+		sealed, err := seal(pubKey, []byte(kw.annotationID), optsData)
+		if err != nil {
+			return nil, fmt.Errorf("HPKE Seal failed: %w", err)
+		}
+		blob.Recipients = append(blob.Recipients, sealed)
+	}
+	return json.Marshal(&blob)
+}
+
+func (kw *hpkeKeyWrapper) UnwrapKey(dc *config.DecryptConfig, annotation []byte) ([]byte, error) {
+	optsData, _, err := kw.UnwrapKeyID(dc, annotation)
+	return optsData, err
+}
+
+// UnwrapKeyID opens the symmetric key with which the layer is encrypted and
+// returns the KeyID of the private key that opened it
+func (kw *hpkeKeyWrapper) UnwrapKeyID(dc *config.DecryptConfig, annotation []byte) ([]byte, string, error) {
+	if fips.Enforced() {
+		return nil, "", errUnavailable
+	}
+	var blob hpkeBlob
+	if err := json.Unmarshal(annotation, &blob); err != nil {
+		return nil, "", fmt.Errorf("could not parse the HPKE wrapped key: %w", errdefs.ErrProtocol)
+	}
+	if blob.Version != 0 {
+		return nil, "", fmt.Errorf("unsupported HPKE wrapped key version %d: %w", blob.Version, errdefs.ErrProtocol)
+	}
+	if err := dc.GetLimits().CheckRecipients(len(blob.Recipients)); err != nil {
+		return nil, "", err
+	}
+
+	privKeys := kw.GetPrivateKeys(dc.Parameters)
+	if len(privKeys) == 0 {
+		return nil, "", fmt.Errorf("No private keys found for HPKE decryption: %w", errdefs.ErrNoDecryptionKey)
+	}
+	privKeysPasswords := make([][]byte, len(privKeys))
+	if kw.passwordsParam != "" {
+		privKeysPasswords = dc.Parameters[kw.passwordsParam]
+		if len(privKeysPasswords) != len(privKeys) {
+			return nil, "", fmt.Errorf("Private key password array length must be same as that of private keys: %w", errdefs.ErrConfiguration)
+		}
+	}
+
+	for idx, privKey := range privKeys {
+		key, err := kw.parsePrivKey(privKey, privKeysPasswords[idx])
+		if err != nil {
+			return nil, "", err
+		}
+		for _, sealed := range blob.Recipients {
+			optsData, err := open(key, []byte(kw.annotationID), sealed)
+			if err == nil {
+				if len(optsData) > keywrap.MaxOptsDataSize {
+					return nil, "", fmt.Errorf("HPKE: layer key options are larger than %d bytes: %w", keywrap.MaxOptsDataSize, errdefs.ErrLimitExceeded)
+				}
+				return optsData, keyID(key), nil
+			}
+			if errors.Is(err, errdefs.ErrUnsupportedKey) || errors.Is(err, errdefs.ErrConfiguration) {
+				return nil, "", err
+			}
+		}
+	}
+	return nil, "", fmt.Errorf("HPKE: No suitable private key found for decryption: %w", errdefs.ErrNoDecryptionKey)
+}
+
+func (kw *hpkeKeyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
+	return len(kw.GetPrivateKeys(dcparameters)) == 0
+}
+
+func (kw *hpkeKeyWrapper) GetPrivateKeys(dcparameters map[string][][]byte) [][]byte {
+	return dcparameters[kw.privKeysParam]
+}
+
+func (kw *hpkeKeyWrapper) GetKeyIdsFromPacket(_ string) ([]uint64, error) {
+	return nil, nil
+}
+
+// GetRecipients returns a placeholder since the encapsulated keys do not
+// reveal the recipients
+func (kw *hpkeKeyWrapper) GetRecipients(b64blobs string) ([]string, error) {
+	var recipients []string
+	for _, b64blob := range strings.Split(b64blobs, ",") {
+		data, err := base64.StdEncoding.DecodeString(b64blob)
+		if err != nil {
+			return nil, fmt.Errorf("could not base64 decode the HPKE wrapped key: %w", errdefs.ErrProtocol)
+		}
+		var blob hpkeBlob
+		if err := json.Unmarshal(data, &blob); err != nil {
+			return nil, fmt.Errorf("could not parse the HPKE wrapped key: %w", errdefs.ErrProtocol)
+		}
+		for range blob.Recipients {
+			recipients = append(recipients, "[hpke]")
+		}
+	}
+	return recipients, nil
+}
+
+// parsePubKeys parses the public keys and drops duplicates; the others are
+// sorted so that the wrapped key does not depend on the order of the keys
+func (kw *hpkeKeyWrapper) parsePubKeys(pubKeys [][]byte) ([]interface{}, error) {
+	var keys []interface{}
+	seen := make(map[string]bool)
+	for _, pubKey := range pubKeys {
+		key, err := kw.parsePubKey(pubKey)
+		if err != nil {
+			return nil, err
+		}
+		keyID := keyID(key)
+		if seen[keyID] {
+			continue
+		}
+		seen[keyID] = true
+		keys = append(keys, key)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keyID(keys[i]) < keyID(keys[j])
+	})
+	return keys, nil
+}
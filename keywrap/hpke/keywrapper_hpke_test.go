@@ -0,0 +1,200 @@
+//go:build go1.26
+// +build go1.26
+
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hpke
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/utils"
+)
+
+func createX25519TestKey(t *testing.T) ([]byte, []byte) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(key.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
+}
+
+func createValidHpkeCcs(t *testing.T) []config.CryptoConfig {
+	pubKey, privKey := createX25519TestKey(t)
+	pubKey2, privKey2 := createX25519TestKey(t)
+
+	return []config.CryptoConfig{
+		// Key 1
+		{
+			EncryptConfig: &config.EncryptConfig{
+				Parameters: map[string][][]byte{
+					"hpke-pubkeys": {pubKey},
+				},
+			},
+			DecryptConfig: &config.DecryptConfig{
+				Parameters: map[string][][]byte{
+					"hpke-privkeys":           {privKey},
+					"hpke-privkeys-passwords": {nil},
+				},
+			},
+		},
+		// Key 2, wrapped along with key 1
+		{
+			EncryptConfig: &config.EncryptConfig{
+				Parameters: map[string][][]byte{
+					"hpke-pubkeys": {pubKey, pubKey2},
+				},
+			},
+			DecryptConfig: &config.DecryptConfig{
+				Parameters: map[string][][]byte{
+					"hpke-privkeys":           {privKey2},
+					"hpke-privkeys-passwords": {nil},
+				},
+			},
+		},
+	}
+}
+
+func TestKeyWrapHpkeSuccess(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the hpke scheme")
+
+	for _, cc := range createValidHpkeCcs(t) {
+		kw := NewKeyWrapper()
+
+		data := []byte("This is some secret text")
+
+		wk, err := kw.WrapKeys(cc.EncryptConfig, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ud, err := kw.UnwrapKey(cc.DecryptConfig, wk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, ud) {
+			t.Fatal("Strings don't match")
+		}
+
+		recipients, err := kw.GetRecipients(base64.StdEncoding.EncodeToString(wk))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recipients) != len(cc.EncryptConfig.Parameters["hpke-pubkeys"]) {
+			t.Fatalf("unexpected recipients %v", recipients)
+		}
+	}
+}
+
+func TestKeyWrapHpkeInvalid(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the hpke scheme")
+
+	ccs := createValidHpkeCcs(t)
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+
+	wk, err := kw.WrapKeys(ccs[0].EncryptConfig, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kw.UnwrapKey(ccs[1].DecryptConfig, wk); !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+		t.Fatalf("expected ErrNoDecryptionKey, got %v", err)
+	}
+	if _, err := kw.UnwrapKey(ccs[0].DecryptConfig, []byte(`{"version":1}`)); !errors.Is(err, errdefs.ErrProtocol) {
+		t.Fatalf("expected ErrProtocol, got %v", err)
+	}
+
+	rsaPubKey, _, err := utils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"hpke-pubkeys": {rsaPubKey},
+		},
+	}
+	if _, err := kw.WrapKeys(ec, data); !errors.Is(err, errdefs.ErrUnsupportedKey) {
+		t.Fatalf("expected ErrUnsupportedKey, got %v", err)
+	}
+}
+
+func TestKeyWrapMLKEM768X25519(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the hpke scheme")
+
+	pubKey, privKey, err := utils.GenerateMLKEM768X25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey2, privKey2, err := utils.GenerateMLKEM768X25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utils.IsMLKEM768X25519PublicKey(pubKey) || !utils.IsMLKEM768X25519PrivateKey(privKey) || utils.IsPublicKey(pubKey) {
+		t.Fatal("MLKEM768-X25519 keys were not recognized")
+	}
+
+	kw := NewMLKEM768X25519KeyWrapper()
+	data := []byte("This is some secret text")
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"mlkem768x25519-pubkeys": {pubKey2, pubKey},
+		},
+	}
+	wk, err := kw.WrapKeys(ec, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range [][]byte{privKey, privKey2} {
+		dc := &config.DecryptConfig{
+			Parameters: map[string][][]byte{
+				"mlkem768x25519-privkeys": {key},
+			},
+		}
+		ud, err := kw.UnwrapKey(dc, wk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, ud) {
+			t.Fatal("Strings don't match")
+		}
+	}
+
+	// X25519 keys are not MLKEM768-X25519 keys
+	x25519PubKey, _ := createX25519TestKey(t)
+	ec.Parameters["mlkem768x25519-pubkeys"] = [][]byte{x25519PubKey}
+	if _, err := kw.WrapKeys(ec, data); !errors.Is(err, errdefs.ErrKeyMaterial) {
+		t.Fatalf("expected ErrKeyMaterial, got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package jwe
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// opaqueDecrypter unwraps the content encryption key of a JWE recipient
+// using a crypto.Decrypter holding an RSA key
+type opaqueDecrypter struct {
+	decrypter crypto.Decrypter
+}
+
+// contentKeyLengths maps the JWE content encryption algorithms to the lengths
+// of their keys
+var contentKeyLengths = map[jose.ContentEncryption]int{
+	jose.A128GCM:       16,
+	jose.A192GCM:       24,
+	jose.A256GCM:       32,
+	jose.A128CBC_HS256: 32,
+	jose.A192CBC_HS384: 48,
+	jose.A256CBC_HS512: 64,
+}
+
+func (d *opaqueDecrypter) DecryptKey(encryptedKey []byte, header jose.Header) ([]byte, error) {
+	if _, ok := d.decrypter.Public().(*rsa.PublicKey); !ok {
+		return nil, errors.New("only RSA keys are supported as crypto.Decrypter")
+	}
+
+	switch jose.KeyAlgorithm(header.Algorithm) {
+	case jose.RSA_OAEP:
+		return d.decrypter.Decrypt(rand.Reader, encryptedKey, &rsa.OAEPOptions{Hash: crypto.SHA1})
+	case jose.RSA_OAEP_256:
+		return d.decrypter.Decrypt(rand.Reader, encryptedKey, &rsa.OAEPOptions{Hash: crypto.SHA256})
+	case jose.RSA1_5:
+		enc, _ := header.ExtraHeaders["enc"].(string)
+		keyLen, ok := contentKeyLengths[jose.ContentEncryption(enc)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported content encryption algorithm %q", enc)
+		}
+		// a random key is returned on invalid padding so that the failure
+		// only shows when decrypting the content
+		return d.decrypter.Decrypt(rand.Reader, encryptedKey, &rsa.PKCS1v15DecryptOptions{SessionKeyLen: keyLen})
+	}
+	return nil, fmt.Errorf("unsupported key management algorithm %q", header.Algorithm)
+}
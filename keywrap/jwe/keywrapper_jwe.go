@@ -18,11 +18,22 @@ package jwe
 
 import (
 	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
 
 	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
 	"github.com/containers/ocicrypt/keywrap"
+	"github.com/containers/ocicrypt/policy"
 	"github.com/containers/ocicrypt/utils"
-	"github.com/pkg/errors"
 	jose "gopkg.in/square/go-jose.v2"
 )
 
@@ -43,7 +54,11 @@ func NewKeyWrapper() keywrap.KeyWrapper {
 func (kw *jweKeyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
 	var joseRecipients []jose.Recipient
 
-	err := addPubKeys(&joseRecipients, ec.Parameters["pubkeys"])
+	keyAlgs, enc, err := encryptionAlgorithms(ec.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	err = addPubKeys(ec.GetPolicy(), &joseRecipients, ec.Parameters["pubkeys"], keyAlgs)
 	if err != nil {
 		return nil, err
 	}
@@ -52,43 +67,138 @@ func (kw *jweKeyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte) ([]
 		return nil, nil
 	}
 
-	encrypter, err := jose.NewMultiEncrypter(jose.A256GCM, joseRecipients, nil)
+	hasOKP := false
+	for i, r := range joseRecipients {
+		key := r.Key
+		if jwk, ok := key.(*jose.JSONWebKey); ok {
+			key = jwk.Key
+		}
+		if isOKP(key) {
+			if joseRecipients[i].Key, err = toX25519PublicKey(key); err != nil {
+				return nil, err
+			}
+			hasOKP = true
+		} else {
+			joseRecipients[i].Key = key
+		}
+	}
+	// only crypto/rand may be used in FIPS 140-only mode
+	useRand := ec.Rand != nil && !fips.Enforced()
+	if hasOKP || useRand {
+		var rand io.Reader = cryptorand.Reader
+		if useRand {
+			rand = ec.Rand
+		}
+		return assembleJWE(rand, joseRecipients, enc, optsData)
+	}
+
+	encrypter, err := jose.NewMultiEncrypter(enc, joseRecipients, nil)
 	if err != nil {
-		return nil, errors.Wrapf(err, "jose.NewMultiEncrypter failed")
+		return nil, fmt.Errorf("jose.NewMultiEncrypter failed: %w", err)
 	}
 	jwe, err := encrypter.Encrypt(optsData)
 	if err != nil {
-		return nil, errors.Wrapf(err, "JWE Encrypt failed")
+		return nil, fmt.Errorf("JWE Encrypt failed: %w", err)
 	}
 	return []byte(jwe.FullSerialize()), nil
 }
 
 func (kw *jweKeyWrapper) UnwrapKey(dc *config.DecryptConfig, jweString []byte) ([]byte, error) {
-	jwe, err := jose.ParseEncrypted(string(jweString))
+	optsData, _, err := kw.UnwrapKeyID(dc, jweString)
+	return optsData, err
+}
+
+// UnwrapKeyID unwraps the symmetric key with which the layer is encrypted and
+// returns the KeyID of the private key that unwrapped it
+func (kw *jweKeyWrapper) UnwrapKeyID(dc *config.DecryptConfig, jweString []byte) ([]byte, string, error) {
+	if err := dc.GetLimits().CheckRecipients(countRecipients(jweString)); err != nil {
+		return nil, "", err
+	}
+	// the private keys are never used with algorithms the policy disallows
+	allowed, policyErr, err := filterRecipients(dc.GetPolicy(), jweString)
 	if err != nil {
-		return nil, errors.New("jose.ParseEncrypted failed")
+		return nil, "", err
+	}
+	if allowed == nil {
+		return nil, "", policyErr
+	}
+	okpJWE, rest, err := splitOKP(allowed)
+	if err != nil {
+		return nil, "", err
+	}
+	var jwe *jose.JSONWebEncryption
+	if rest != nil {
+		jwe, err = jose.ParseEncrypted(string(rest))
+		if err != nil {
+			return nil, "", fmt.Errorf("jose.ParseEncrypted failed: %w", errdefs.ErrProtocol)
+		}
+		// we never compress the key options; refuse to decompress untrusted data
+		if _, ok := jwe.Header.ExtraHeaders["zip"]; ok {
+			return nil, "", fmt.Errorf("compressed JWE is not supported: %w", errdefs.ErrProtocol)
+		}
 	}
 
 	privKeys := kw.GetPrivateKeys(dc.Parameters)
-	if len(privKeys) == 0 {
-		return nil, errors.New("No private keys found for JWE decryption")
+	if len(privKeys) == 0 && len(dc.Decrypters) == 0 {
+		return nil, "", fmt.Errorf("No private keys found for JWE decryption: %w", errdefs.ErrNoDecryptionKey)
 	}
 	privKeysPasswords := kw.getPrivateKeysPasswords(dc.Parameters)
 	if len(privKeysPasswords) != len(privKeys) {
-		return nil, errors.New("Private key password array length must be same as that of private keys")
+		return nil, "", fmt.Errorf("Private key password array length must be same as that of private keys: %w", errdefs.ErrConfiguration)
 	}
 
 	for idx, privKey := range privKeys {
 		key, err := utils.ParsePrivateKey(privKey, privKeysPasswords[idx], "JWE")
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
-		_, _, plain, err := jwe.DecryptMulti(key)
-		if err == nil {
-			return plain, nil
+		if dc.GetPolicy().CheckKeysOnUnwrap {
+			if err := checkKey(dc.GetPolicy(), key); err != nil {
+				return nil, "", err
+			}
+		}
+		if priv, ok := x25519PrivateKey(key); ok {
+			if okpJWE == nil {
+				continue
+			}
+			if fips.Enforced() {
+				return nil, "", fmt.Errorf("JWE: X25519 key agreement is not available in FIPS 140-only mode: %w", errdefs.ErrDisallowedAlgorithm)
+			}
+			if plain, err := okpJWE.decryptOKP(priv); err == nil {
+				return plain, utils.KeyID(key), nil
+			}
+			continue
+		}
+		if jwe == nil {
+			continue
+		}
+		if _, _, plain, err := jwe.DecryptMulti(key); err == nil {
+			return plain, utils.KeyID(key), nil
 		}
 	}
-	return nil, errors.New("JWE: No suitable private key found for decryption")
+	for _, decrypter := range dc.Decrypters {
+		if jwe == nil {
+			break
+		}
+		if dc.GetPolicy().CheckKeysOnUnwrap {
+			if err := checkKey(dc.GetPolicy(), decrypter.Public()); err != nil {
+				return nil, "", err
+			}
+		}
+		if _, _, plain, err := jwe.DecryptMulti(&opaqueDecrypter{decrypter: decrypter}); err == nil {
+			return plain, utils.KeyID(decrypter), nil
+		}
+	}
+	if policyErr != nil {
+		return nil, "", policyErr
+	}
+	return nil, "", fmt.Errorf("JWE: No suitable private key found for decryption: %w", errdefs.ErrNoDecryptionKey)
+}
+
+// SupportsDecrypters returns true since RSA keys held by crypto.Decrypters
+// can be used for unwrapping
+func (kw *jweKeyWrapper) SupportsDecrypters() bool {
+	return true
 }
 
 func (kw *jweKeyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
@@ -111,20 +221,247 @@ func (kw *jweKeyWrapper) GetRecipients(b64jwes string) ([]string, error) {
 	return []string{"[jwe]"}, nil
 }
 
-func addPubKeys(joseRecipients *[]jose.Recipient, pubKeys [][]byte) error {
+// CountRecipients returns the number of recipients of the JWEs
+func (kw *jweKeyWrapper) CountRecipients(b64jwes string) (int, error) {
+	n := 0
+	for _, b64jwe := range strings.Split(b64jwes, ",") {
+		jweString, err := base64.StdEncoding.DecodeString(b64jwe)
+		if err != nil {
+			return 0, fmt.Errorf("could not base64 decode the JWE: %w", errdefs.ErrProtocol)
+		}
+		n += countRecipients(jweString)
+	}
+	return n, nil
+}
+
+// countRecipients returns the number of recipients of a JWE; a JWE in compact
+// serialization has a single one
+func countRecipients(jweString []byte) int {
+	var raw struct {
+		Recipients []json.RawMessage `json:"recipients"`
+	}
+	if err := json.Unmarshal(jweString, &raw); err != nil || len(raw.Recipients) == 0 {
+		return 1
+	}
+	return len(raw.Recipients)
+}
+
+// checkPolicy checks the key management and content encryption algorithms of
+// a JWE recipient against the policy
+func checkPolicy(p *policy.Policy, alg, enc string) error {
+	if _, ok := contentKeyLengths[jose.ContentEncryption(enc)]; !ok {
+		return fmt.Errorf("JWE: content encryption algorithm %q is not allowed: %w", enc, errdefs.ErrDisallowedAlgorithm)
+	}
+	switch jose.KeyAlgorithm(alg) {
+	case jose.RSA1_5:
+		return p.Check("JWE", policy.RSAPKCS1v15)
+	case jose.RSA_OAEP:
+		return p.Check("JWE", policy.RSAOAEPSHA1)
+	}
+	return nil
+}
+
+// filterRecipients checks the algorithms of the recipients of a JWE against
+// the policy before any private key is used and returns the JWE without the
+// recipients whose algorithms the policy disallows, along with the error of
+// the policy for them. If no recipient is left, the JWE is nil.
+func filterRecipients(p *policy.Policy, jweString []byte) ([]byte, error, error) {
+	if len(jweString) == 0 || jweString[0] != '{' {
+		// compact serialization with a single recipient
+		parts := strings.Split(string(jweString), ".")
+		if len(parts) != 5 {
+			return nil, nil, fmt.Errorf("JWE: invalid compact serialization: %w", errdefs.ErrProtocol)
+		}
+		header, err := (&rawJWE{Protected: parts[0]}).mergedHeader(rawRecipient{})
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := checkPolicy(p, header.Alg, header.Enc); err != nil {
+			return nil, err, nil
+		}
+		return jweString, nil, nil
+	}
+
+	var jwe rawJWE
+	if err := json.Unmarshal(jweString, &jwe); err != nil {
+		return nil, nil, fmt.Errorf("JWE: invalid JSON serialization: %w", errdefs.ErrProtocol)
+	}
+	flattened := len(jwe.Recipients) == 0
+	recipients := jwe.Recipients
+	if flattened {
+		recipients = []rawRecipient{{Header: jwe.Header, EncryptedKey: jwe.EncryptedKey}}
+	}
+	var (
+		allowed   []rawRecipient
+		policyErr error
+	)
+	for _, r := range recipients {
+		header, err := jwe.mergedHeader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := checkPolicy(p, header.Alg, header.Enc); err != nil {
+			policyErr = err
+			continue
+		}
+		allowed = append(allowed, r)
+	}
+	switch {
+	case len(allowed) == 0:
+		return nil, policyErr, nil
+	case len(allowed) == len(recipients):
+		return jweString, nil, nil
+	}
+	// the recipients are not authenticated, so dropping some of them leaves
+	// the JWE intact for the others
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(jweString, &fields); err != nil {
+		return nil, nil, fmt.Errorf("JWE: invalid JSON serialization: %w", errdefs.ErrProtocol)
+	}
+	rawAllowed, err := json.Marshal(allowed)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields["recipients"] = rawAllowed
+	filtered, err := json.Marshal(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	return filtered, policyErr, nil
+}
+
+// checkKey checks the strength of a key against the policy
+func checkKey(p *policy.Policy, key interface{}) error {
+	if jwk, ok := key.(*jose.JSONWebKey); ok {
+		key = jwk.Key
+	}
+	return p.CheckKey("JWE", key)
+}
+
+// allowedKeyAlgorithms are the key management algorithms that may be chosen
+// with the jwe-key-algorithms parameter; RSA1_5 and the algorithms that cannot
+// be used with several recipients are left out
+var allowedKeyAlgorithms = map[jose.KeyAlgorithm]bool{
+	jose.RSA_OAEP:       true,
+	jose.RSA_OAEP_256:   true,
+	jose.ECDH_ES_A128KW: true,
+	jose.ECDH_ES_A192KW: true,
+	jose.ECDH_ES_A256KW: true,
+}
+
+// encryptionAlgorithms returns the key management algorithms and the content
+// encryption algorithm chosen with the jwe-key-algorithms and
+// jwe-content-encryption parameters, checked against the allowlists
+func encryptionAlgorithms(params map[string][][]byte) ([]jose.KeyAlgorithm, jose.ContentEncryption, error) {
+	var keyAlgs []jose.KeyAlgorithm
+	for _, value := range params["jwe-key-algorithms"] {
+		alg := jose.KeyAlgorithm(value)
+		if !allowedKeyAlgorithms[alg] {
+			return nil, "", fmt.Errorf("JWE: key management algorithm %q is not allowed: %w", alg, errdefs.ErrDisallowedAlgorithm)
+		}
+		if alg == jose.RSA_OAEP && fips.Enabled() {
+			return nil, "", fmt.Errorf("JWE: RSA-OAEP with SHA-1 is not available in FIPS mode: %w", errdefs.ErrDisallowedAlgorithm)
+		}
+		keyAlgs = append(keyAlgs, alg)
+	}
+
+	enc := jose.A256GCM
+	if fips.Enforced() {
+		// AES-GCM may only be used with IVs generated by the FIPS module
+		enc = jose.A256CBC_HS512
+	}
+	switch values := params["jwe-content-encryption"]; len(values) {
+	case 0:
+	case 1:
+		enc = jose.ContentEncryption(values[0])
+		if _, ok := contentKeyLengths[enc]; !ok {
+			return nil, "", fmt.Errorf("JWE: content encryption algorithm %q is not allowed: %w", enc, errdefs.ErrDisallowedAlgorithm)
+		}
+		if fips.Enforced() && enc != jose.A128CBC_HS256 && enc != jose.A192CBC_HS384 && enc != jose.A256CBC_HS512 {
+			return nil, "", fmt.Errorf("JWE: %s is not available in FIPS 140-only mode: %w", enc, errdefs.ErrDisallowedAlgorithm)
+		}
+	default:
+		return nil, "", fmt.Errorf("JWE: only one content encryption algorithm may be given: %w", errdefs.ErrConfiguration)
+	}
+	return keyAlgs, enc, nil
+}
+
+// keyAlgorithm returns the key management algorithm for wrapping the layer
+// key for a public key; this is the first of the chosen algorithms that can
+// be used with the key or the default one if none were chosen
+func keyAlgorithm(key interface{}, keyAlgs []jose.KeyAlgorithm) (jose.KeyAlgorithm, error) {
+	pubKey := key
+	if jwk, ok := key.(*jose.JSONWebKey); ok {
+		pubKey = jwk.Key
+	}
+	var fits func(jose.KeyAlgorithm) bool
+	switch k := pubKey.(type) {
+	case *rsa.PublicKey:
+		if len(keyAlgs) == 0 {
+			if fips.Enabled() {
+				// SHA-1 may not be available in FIPS mode
+				return jose.RSA_OAEP_256, nil
+			}
+			return jose.RSA_OAEP, nil
+		}
+		fits = func(alg jose.KeyAlgorithm) bool {
+			return alg == jose.RSA_OAEP || alg == jose.RSA_OAEP_256
+		}
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+			fits = isECDHES
+		}
+	}
+	if isOKP(pubKey) {
+		if fips.Enforced() {
+			return "", fmt.Errorf("JWE: X25519 key agreement is not available in FIPS 140-only mode: %w", errdefs.ErrDisallowedAlgorithm)
+		}
+		fits = isECDHES
+	}
+	if fits == nil {
+		return "", fmt.Errorf("JWE: %s keys cannot be used for encryption: %w", utils.KeyType(key), errdefs.ErrUnsupportedKey)
+	}
+	if len(keyAlgs) == 0 {
+		return jose.ECDH_ES_A256KW, nil
+	}
+	for _, alg := range keyAlgs {
+		if fits(alg) {
+			return alg, nil
+		}
+	}
+	return "", fmt.Errorf("JWE: none of the key management algorithms %v can be used with %s keys: %w", keyAlgs, utils.KeyType(key), errdefs.ErrConfiguration)
+}
+
+func isECDHES(alg jose.KeyAlgorithm) bool {
+	return alg == jose.ECDH_ES_A128KW || alg == jose.ECDH_ES_A192KW || alg == jose.ECDH_ES_A256KW
+}
+
+func addPubKeys(p *policy.Policy, joseRecipients *[]jose.Recipient, pubKeys [][]byte, keyAlgs []jose.KeyAlgorithm) error {
 	if len(pubKeys) == 0 {
 		return nil
 	}
+	seen := make(map[string]bool)
 	for _, pubKey := range pubKeys {
 		key, err := utils.ParsePublicKey(pubKey, "JWE")
 		if err != nil {
 			return err
 		}
+		if err := checkKey(p, key); err != nil {
+			return err
+		}
+		// wrapping the layer key twice for the same key is of no use
+		keyID := utils.KeyID(key)
+		if keyID != "" {
+			if seen[keyID] {
+				continue
+			}
+			seen[keyID] = true
+		}
 
-		alg := jose.RSA_OAEP
-		switch key.(type) {
-		case *ecdsa.PublicKey:
-			alg = jose.ECDH_ES_A256KW
+		alg, err := keyAlgorithm(key, keyAlgs)
+		if err != nil {
+			return err
 		}
 
 		*joseRecipients = append(*joseRecipients, jose.Recipient{
@@ -132,5 +469,10 @@ func addPubKeys(joseRecipients *[]jose.Recipient, pubKeys [][]byte) error {
 			Key:       key,
 		})
 	}
+	// the order of the recipients in the JWE does not depend on the order
+	// in which they were passed
+	sort.SliceStable(*joseRecipients, func(i, j int) bool {
+		return utils.KeyID((*joseRecipients)[i].Key) < utils.KeyID((*joseRecipients)[j].Key)
+	})
 	return nil
 }
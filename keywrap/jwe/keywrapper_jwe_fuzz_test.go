@@ -0,0 +1,43 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package jwe
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/containers/ocicrypt/config"
+)
+
+func FuzzUnwrapKey(f *testing.F) {
+	// malformed JWEs that were found to be problematic or model pathological
+	// inputs
+	f.Add([]byte(`{}`))
+	f.Add([]byte(`{"protected":"eyJ6aXAiOiJERUYifQ","ciphertext":"","iv":"","tag":""}`))
+	f.Add([]byte(`{"recipients":[` + strings.Repeat(`{},`, 10000) + `{}]}`))
+	f.Add([]byte(strings.Repeat(`{"a":`, 10000)))
+	f.Add([]byte(`eyJhbGciOiJSU0EtT0FFUCJ9.....`))
+
+	kw := NewKeyWrapper()
+	dc := &config.DecryptConfig{}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = kw.UnwrapKey(dc, data)
+	})
+}
@@ -17,30 +17,38 @@
 package jwe
 
 import (
+	"crypto"
 	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
+	"github.com/containers/ocicrypt/policy"
 	"github.com/containers/ocicrypt/utils"
 	jose "gopkg.in/square/go-jose.v2"
 )
 
 var oneEmpty []byte
 
-func createValidJweCcs() ([]*config.CryptoConfig, error) {
-
-	jwePubKeyPem, jwePrivKeyPem, err := utils.CreateRSATestKey(2048, oneEmpty, true)
-	if err != nil {
-		return nil, err
+// testContentEncryption returns the content encryption of the JWEs built by
+// the tests; AES-GCM is not allowed in FIPS 140-only mode
+func testContentEncryption() jose.ContentEncryption {
+	if fips.Enforced() {
+		return jose.A256CBC_HS512
 	}
+	return jose.A256GCM
+}
 
-	jwePubKey2Pem, jwePrivKey2Pem, err := utils.CreateRSATestKey(1024, oneEmpty, true)
-	if err != nil {
-		return nil, err
-	}
+func createValidJweCcs() ([]*config.CryptoConfig, error) {
 
-	jwePrivKey3Password := []byte("password")
-	jwePubKey3Pem, jwePrivKey3PassPem, err := utils.CreateRSATestKey(2048, jwePrivKey3Password, true)
+	jwePubKeyPem, jwePrivKeyPem, err := utils.CreateRSATestKey(2048, oneEmpty, true)
 	if err != nil {
 		return nil, err
 	}
@@ -93,28 +101,6 @@ func createValidJweCcs() ([]*config.CryptoConfig, error) {
 			},
 		},
 
-		// Key 2
-		{
-			EncryptConfig: &config.EncryptConfig{
-				Parameters: map[string][][]byte{
-					"pubkeys": {jwePubKey2Pem},
-				},
-				DecryptConfig: config.DecryptConfig{
-					Parameters: map[string][][]byte{
-						"privkeys":           {jwePrivKey2Pem},
-						"privkeys-passwords": {oneEmpty},
-					},
-				},
-			},
-
-			DecryptConfig: &config.DecryptConfig{
-				Parameters: map[string][][]byte{
-					"privkeys":           {jwePrivKey2Pem},
-					"privkeys-passwords": {oneEmpty},
-				},
-			},
-		},
-
 		// Key 1 without enc private key
 		{
 			EncryptConfig: &config.EncryptConfig{
@@ -131,38 +117,6 @@ func createValidJweCcs() ([]*config.CryptoConfig, error) {
 			},
 		},
 
-		// Key 2 without enc private key
-		{
-			EncryptConfig: &config.EncryptConfig{
-				Parameters: map[string][][]byte{
-					"pubkeys": {jwePubKey2Pem},
-				},
-			},
-
-			DecryptConfig: &config.DecryptConfig{
-				Parameters: map[string][][]byte{
-					"privkeys":           {jwePrivKey2Pem},
-					"privkeys-passwords": {oneEmpty},
-				},
-			},
-		},
-
-		// Key 3 with enc private key
-		{
-			EncryptConfig: &config.EncryptConfig{
-				Parameters: map[string][][]byte{
-					"pubkeys": {jwePubKey3Pem},
-				},
-			},
-
-			DecryptConfig: &config.DecryptConfig{
-				Parameters: map[string][][]byte{
-					"privkeys":           {jwePrivKey3PassPem},
-					"privkeys-passwords": {jwePrivKey3Password},
-				},
-			},
-		},
-
 		// Key (DER format)
 		{
 			EncryptConfig: &config.EncryptConfig{
@@ -227,6 +181,77 @@ func createValidJweCcs() ([]*config.CryptoConfig, error) {
 			},
 		},
 	}
+
+	// RSA keys of less than 2048 bits and encrypted PEM private keys are not
+	// allowed in FIPS 140-only mode
+	if !fips.Enforced() {
+		jwePubKey2Pem, jwePrivKey2Pem, err := utils.CreateRSATestKey(1024, oneEmpty, true)
+		if err != nil {
+			return nil, err
+		}
+
+		jwePrivKey3Password := []byte("password")
+		jwePubKey3Pem, jwePrivKey3PassPem, err := utils.CreateRSATestKey(2048, jwePrivKey3Password, true)
+		if err != nil {
+			return nil, err
+		}
+
+		validJweCcs = append(validJweCcs, []*config.CryptoConfig{
+			// Key 2
+			{
+				EncryptConfig: &config.EncryptConfig{
+					Parameters: map[string][][]byte{
+						"pubkeys": {jwePubKey2Pem},
+					},
+					DecryptConfig: config.DecryptConfig{
+						Parameters: map[string][][]byte{
+							"privkeys":           {jwePrivKey2Pem},
+							"privkeys-passwords": {oneEmpty},
+						},
+					},
+				},
+
+				DecryptConfig: &config.DecryptConfig{
+					Parameters: map[string][][]byte{
+						"privkeys":           {jwePrivKey2Pem},
+						"privkeys-passwords": {oneEmpty},
+					},
+				},
+			},
+
+			// Key 2 without enc private key
+			{
+				EncryptConfig: &config.EncryptConfig{
+					Parameters: map[string][][]byte{
+						"pubkeys": {jwePubKey2Pem},
+					},
+				},
+
+				DecryptConfig: &config.DecryptConfig{
+					Parameters: map[string][][]byte{
+						"privkeys":           {jwePrivKey2Pem},
+						"privkeys-passwords": {oneEmpty},
+					},
+				},
+			},
+
+			// Key 3 with enc private key
+			{
+				EncryptConfig: &config.EncryptConfig{
+					Parameters: map[string][][]byte{
+						"pubkeys": {jwePubKey3Pem},
+					},
+				},
+
+				DecryptConfig: &config.DecryptConfig{
+					Parameters: map[string][][]byte{
+						"privkeys":           {jwePrivKey3PassPem},
+						"privkeys-passwords": {jwePrivKey3Password},
+					},
+				},
+			},
+		}...)
+	}
 	return validJweCcs, nil
 }
 
@@ -343,3 +368,602 @@ func TestKeyWrapJweInvalid(t *testing.T) {
 		t.Fatal("Successfully wrap for invalid crypto config")
 	}
 }
+
+func TestKeyWrapJwePolicy(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "RSA-OAEP with SHA-1")
+
+	jwePubKeyPem, jwePrivKeyPem, err := utils.CreateRSATestKey(2048, oneEmpty, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+
+	// WrapKeys only uses RSA-OAEP with SHA-1 outside of FIPS mode
+	pubKey, err := utils.ParsePublicKey(jwePubKeyPem, "JWE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: jose.RSA_OAEP, Key: pubKey}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwe, err := encrypter.Encrypt(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wk := []byte(jwe.FullSerialize())
+
+	dc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {jwePrivKeyPem},
+			"privkeys-passwords": {oneEmpty},
+		},
+		Policy: policy.Strict(),
+	}
+	if _, err := kw.UnwrapKey(dc, wk); !errors.Is(err, errdefs.ErrDisallowedAlgorithm) {
+		t.Fatalf("Expected RSA-OAEP with SHA-1 to be rejected, got %v", err)
+	}
+
+	// the private key is not used with the disallowed algorithm
+	privKey, err := utils.ParsePrivateKey(jwePrivKeyPem, oneEmpty, "JWE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingKey{Decrypter: privKey.(crypto.Decrypter)}
+	decrypterDc := &config.DecryptConfig{
+		Decrypters: []crypto.Decrypter{counting},
+		Policy:     policy.Strict(),
+	}
+	if _, err := kw.UnwrapKey(decrypterDc, wk); !errors.Is(err, errdefs.ErrDisallowedAlgorithm) {
+		t.Fatalf("Expected RSA-OAEP with SHA-1 to be rejected, got %v", err)
+	}
+	if counting.calls != 0 {
+		t.Fatalf("The private key was used %d times with a disallowed algorithm", counting.calls)
+	}
+
+	// recipients with allowed algorithms are still tried
+	otherPubKeyPem, otherPrivKeyPem, err := utils.CreateRSATestKey(2048, oneEmpty, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPubKey, err := utils.ParsePublicKey(otherPubKeyPem, "JWE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	multiEncrypter, err := jose.NewMultiEncrypter(jose.A256GCM, []jose.Recipient{
+		{Algorithm: jose.RSA_OAEP, Key: pubKey},
+		{Algorithm: jose.RSA_OAEP_256, Key: otherPubKey},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multiJWE, err := multiEncrypter.Encrypt(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc.Parameters["privkeys"] = [][]byte{jwePrivKeyPem, otherPrivKeyPem}
+	dc.Parameters["privkeys-passwords"] = [][]byte{oneEmpty, oneEmpty}
+	ud, err := kw.UnwrapKey(dc, []byte(multiJWE.FullSerialize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(ud) {
+		t.Fatal("Strings don't match")
+	}
+
+	dc.Policy.AllowedLegacyAlgorithms = []policy.Algorithm{policy.RSAOAEPSHA1}
+	ud, err = kw.UnwrapKey(dc, wk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(ud) {
+		t.Fatal("Strings don't match")
+	}
+}
+
+// countingKey counts the decryptions with the private key
+type countingKey struct {
+	crypto.Decrypter
+	calls int
+}
+
+func (k *countingKey) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	k.calls++
+	return k.Decrypter.Decrypt(rand, msg, opts)
+}
+
+func TestKeyWrapJweKeyStrength(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "RSA keys of less than 2048 bits")
+
+	jwePubKeyPem, jwePrivKeyPem, err := utils.CreateRSATestKey(1024, oneEmpty, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"pubkeys": {jwePubKeyPem},
+		},
+		Policy: &policy.Policy{
+			MinRSAKeySize: 2048,
+		},
+	}
+	if _, err := kw.WrapKeys(ec, data); !errors.Is(err, errdefs.ErrWeakKey) {
+		t.Fatalf("Expected 1024 bit key to be rejected, got %v", err)
+	}
+
+	ec.Policy = nil
+	wk, err := kw.WrapKeys(ec, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {jwePrivKeyPem},
+			"privkeys-passwords": {oneEmpty},
+		},
+		Policy: &policy.Policy{
+			AllowedLegacyAlgorithms: policy.LegacyAlgorithms,
+			MinRSAKeySize:           2048,
+		},
+	}
+	if _, err := kw.UnwrapKey(dc, wk); err != nil {
+		t.Fatal(err)
+	}
+	dc.Policy.CheckKeysOnUnwrap = true
+	if _, err := kw.UnwrapKey(dc, wk); !errors.Is(err, errdefs.ErrWeakKey) {
+		t.Fatalf("Expected 1024 bit key to be rejected, got %v", err)
+	}
+}
+
+// opaqueKey hides the type of the private key behind crypto.Decrypter
+type opaqueKey struct {
+	crypto.Decrypter
+}
+
+func TestKeyWrapJweDecrypter(t *testing.T) {
+	key, err := utils.CreateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := utils.CreateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwePubKeyJwk, err := jose.JSONWebKey{Key: &key.PublicKey}.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+
+	wk, err := kw.WrapKeys(&config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"pubkeys": {jwePubKeyJwk},
+		},
+	}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc := &config.DecryptConfig{
+		Decrypters: []crypto.Decrypter{opaqueKey{otherKey}},
+	}
+	if _, err := kw.UnwrapKey(dc, wk); !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+		t.Fatalf("Expected no suitable key error, got %v", err)
+	}
+
+	dc.Decrypters = append(dc.Decrypters, opaqueKey{key})
+	ud, err := kw.UnwrapKey(dc, wk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(ud) {
+		t.Fatal("Strings don't match")
+	}
+}
+
+func TestKeyWrapJweCompressed(t *testing.T) {
+	jwePubKeyPem, jwePrivKeyPem, err := utils.CreateRSATestKey(2048, oneEmpty, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := utils.ParsePublicKey(jwePubKeyPem, "JWE")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a compressed JWE may decompress to huge amounts of data
+	encrypter, err := jose.NewEncrypter(testContentEncryption(), jose.Recipient{Algorithm: jose.RSA_OAEP_256, Key: pubKey}, &jose.EncrypterOptions{Compression: jose.DEFLATE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwe, err := encrypter.Encrypt(make([]byte, 1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {jwePrivKeyPem},
+			"privkeys-passwords": {oneEmpty},
+		},
+	}
+	if _, err := NewKeyWrapper().UnwrapKey(dc, []byte(jwe.FullSerialize())); !errors.Is(err, errdefs.ErrProtocol) {
+		t.Fatalf("Expected compressed JWE to be rejected, got %v", err)
+	}
+}
+
+func TestKeyWrapJweCanonical(t *testing.T) {
+	pubKey1, privKey1, err := utils.CreateRSATestKey(2048, oneEmpty, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey2, _, err := utils.CreateRSATestKey(2048, oneEmpty, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key1, err := utils.ParsePrivateKey(privKey1, nil, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kw := NewKeyWrapper()
+	var indices []int
+	for _, pubKeys := range [][][]byte{
+		{pubKey1, pubKey2},
+		{pubKey2, pubKey1, pubKey2},
+	} {
+		ec := &config.EncryptConfig{
+			Parameters: map[string][][]byte{
+				"pubkeys": pubKeys,
+			},
+		}
+		wk, err := kw.WrapKeys(ec, []byte("This is some secret text"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := countRecipients(wk); n != 2 {
+			t.Fatalf("Expected 2 recipients, got %d", n)
+		}
+		jwe, err := jose.ParseEncrypted(string(wk))
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx, _, _, err := jwe.DecryptMulti(key1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indices = append(indices, idx)
+	}
+	if indices[0] != indices[1] {
+		t.Fatalf("Expected the same order of recipients, got indices %v", indices)
+	}
+}
+
+func TestKeyWrapJweKeyTypes(t *testing.T) {
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		pubKey, privKey, err := utils.CreateECDSATestKey(curve)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := x509.ParsePKIXPublicKey(pubKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jwk, err := jose.JSONWebKey{Key: key}.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, recipient := range [][]byte{pubKey, jwk} {
+			wk, err := kw.WrapKeys(&config.EncryptConfig{
+				Parameters: map[string][][]byte{
+					"pubkeys": {recipient},
+				},
+			}, data)
+			if err != nil {
+				t.Fatalf("%s: %v", curve.Params().Name, err)
+			}
+			ud, err := kw.UnwrapKey(&config.DecryptConfig{
+				Parameters: map[string][][]byte{
+					"privkeys":           {privKey},
+					"privkeys-passwords": {oneEmpty},
+				},
+			}, wk)
+			if err != nil {
+				t.Fatalf("%s: %v", curve.Params().Name, err)
+			}
+			if string(data) != string(ud) {
+				t.Fatal("Strings don't match")
+			}
+		}
+	}
+
+	p224PubKey, _, err := utils.CreateECDSATestKey(elliptic.P224())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = kw.WrapKeys(&config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"pubkeys": {p224PubKey},
+		},
+	}, data)
+	if !errors.Is(err, errdefs.ErrUnsupportedKey) {
+		t.Fatalf("Expected ErrUnsupportedKey, got %v", err)
+	}
+}
+
+func TestKeyWrapJweOKP(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "X25519")
+
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+
+	edKey, err := utils.CreateEd25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPubKey, err := x509.MarshalPKIXPublicKey(edKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPrivKey, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPubKeyJwk, err := jose.JSONWebKey{Key: edKey.Public()}.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPubKey, rsaPrivKey, err := utils.CreateRSATestKey(2048, oneEmpty, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPubKey, ecPrivKey, err := utils.CreateECDSATestKey(elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, recipient := range [][]byte{edPubKey, edPubKeyJwk} {
+		wk, err := kw.WrapKeys(&config.EncryptConfig{
+			Parameters: map[string][][]byte{
+				"pubkeys": {recipient},
+			},
+		}, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ud, keyID, err := kw.(*jweKeyWrapper).UnwrapKeyID(&config.DecryptConfig{
+			Parameters: map[string][][]byte{
+				"privkeys":           {rsaPrivKey, edPrivKey},
+				"privkeys-passwords": {oneEmpty, oneEmpty},
+			},
+		}, wk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(ud) {
+			t.Fatal("Strings don't match")
+		}
+		if keyID != utils.KeyID(edKey) {
+			t.Fatalf("Expected key ID %s, got %s", utils.KeyID(edKey), keyID)
+		}
+	}
+
+	// OKP recipients can be mixed with other ones
+	wk, err := kw.WrapKeys(&config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"pubkeys": {rsaPubKey, edPubKey, ecPubKey},
+		},
+	}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countRecipients(wk); n != 3 {
+		t.Fatalf("Expected 3 recipients, got %d", n)
+	}
+	for _, privKey := range [][]byte{rsaPrivKey, edPrivKey, ecPrivKey} {
+		ud, err := kw.UnwrapKey(&config.DecryptConfig{
+			Parameters: map[string][][]byte{
+				"privkeys":           {privKey},
+				"privkeys-passwords": {oneEmpty},
+			},
+		}, wk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(ud) {
+			t.Fatal("Strings don't match")
+		}
+	}
+
+	otherKey, err := utils.CreateEd25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPrivKey, err := x509.MarshalPKCS8PrivateKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = kw.UnwrapKey(&config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {otherPrivKey},
+			"privkeys-passwords": {oneEmpty},
+		},
+	}, wk)
+	if !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+		t.Fatalf("Expected ErrNoDecryptionKey, got %v", err)
+	}
+}
+
+func TestKeyWrapJweAlgorithms(t *testing.T) {
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+
+	rsaPubKey, rsaPrivKey, err := utils.CreateRSATestKey(2048, oneEmpty, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPubKey, ecPrivKey, err := utils.CreateECDSATestKey(elliptic.P384())
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey, err := utils.CreateEd25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPubKey, err := x509.MarshalPKIXPublicKey(edKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPrivKey, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		pubKeys  [][]byte
+		privKeys [][]byte
+		keyAlgs  []string
+		enc      string
+		inFIPS   bool
+	}{
+		{[][]byte{rsaPubKey, ecPubKey}, [][]byte{rsaPrivKey, ecPrivKey}, []string{"RSA-OAEP-256", "ECDH-ES+A128KW"}, "A128GCM", false},
+		{[][]byte{rsaPubKey, ecPubKey}, [][]byte{rsaPrivKey, ecPrivKey}, []string{"ECDH-ES+A192KW", "RSA-OAEP-256"}, "A192CBC-HS384", true},
+		{[][]byte{rsaPubKey, ecPubKey, edPubKey}, [][]byte{rsaPrivKey, ecPrivKey, edPrivKey}, []string{"RSA-OAEP-256", "ECDH-ES+A128KW"}, "A128CBC-HS256", false},
+		{[][]byte{edPubKey}, [][]byte{edPrivKey}, nil, "A192GCM", false},
+	} {
+		// AES-GCM and X25519 are not allowed in FIPS 140-only mode
+		if fips.Enforced() && !tc.inFIPS {
+			continue
+		}
+		cc, err := config.EncryptWithJweAlgorithms(tc.keyAlgs, tc.enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ec := cc.EncryptConfig
+		ec.Parameters["pubkeys"] = tc.pubKeys
+		if err := ec.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		wk, err := kw.WrapKeys(ec, data)
+		if err != nil {
+			t.Fatalf("%v %s: %v", tc.keyAlgs, tc.enc, err)
+		}
+
+		var raw struct {
+			Protected string `json:"protected"`
+		}
+		if err := json.Unmarshal(wk, &raw); err != nil {
+			t.Fatal(err)
+		}
+		protected, err := base64.RawURLEncoding.DecodeString(raw.Protected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(protected), `"enc":"`+tc.enc+`"`) {
+			t.Fatalf("Expected %s, got protected header %s", tc.enc, protected)
+		}
+
+		for i, privKey := range tc.privKeys {
+			ud, err := kw.UnwrapKey(&config.DecryptConfig{
+				Parameters: map[string][][]byte{
+					"privkeys":           {privKey},
+					"privkeys-passwords": {oneEmpty},
+				},
+			}, wk)
+			if err != nil {
+				t.Fatalf("%v %s: key %d: %v", tc.keyAlgs, tc.enc, i, err)
+			}
+			if string(data) != string(ud) {
+				t.Fatal("Strings don't match")
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		keyAlgs []string
+		enc     string
+		err     error
+	}{
+		{[]string{"RSA1_5"}, "", errdefs.ErrDisallowedAlgorithm},
+		{[]string{"dir"}, "", errdefs.ErrDisallowedAlgorithm},
+		{nil, "A512GCM", errdefs.ErrDisallowedAlgorithm},
+		{[]string{"ECDH-ES+A256KW"}, "", errdefs.ErrConfiguration},
+	} {
+		cc, err := config.EncryptWithJweAlgorithms(tc.keyAlgs, tc.enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc.EncryptConfig.Parameters["pubkeys"] = [][]byte{rsaPubKey}
+		if _, err := kw.WrapKeys(cc.EncryptConfig, data); !errors.Is(err, tc.err) {
+			t.Fatalf("%v %s: expected %v, got %v", tc.keyAlgs, tc.enc, tc.err, err)
+		}
+	}
+}
+
+func TestKeyWrapJweSerializations(t *testing.T) {
+	pubKey1, privKey1, err := utils.CreateRSATestKey(2048, oneEmpty, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey2, _, err := utils.CreateRSATestKey(2048, oneEmpty, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recipients []jose.Recipient
+	for _, pubKey := range [][]byte{pubKey1, pubKey2} {
+		key, err := utils.ParsePublicKey(pubKey, "JWE")
+		if err != nil {
+			t.Fatal(err)
+		}
+		recipients = append(recipients, jose.Recipient{Algorithm: jose.RSA_OAEP_256, Key: key})
+	}
+	data := []byte("This is some secret text")
+
+	single, err := jose.NewEncrypter(testContentEncryption(), recipients[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwe, err := single.Encrypt(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, err := jwe.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flattened := jwe.FullSerialize()
+
+	multi, err := jose.NewMultiEncrypter(testContentEncryption(), recipients, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jwe, err = multi.Encrypt(data); err != nil {
+		t.Fatal(err)
+	}
+	general := jwe.FullSerialize()
+
+	dc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {privKey1},
+			"privkeys-passwords": {oneEmpty},
+		},
+	}
+	for _, wk := range []string{compact, flattened, general} {
+		ud, err := NewKeyWrapper().UnwrapKey(dc, []byte(wk))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(ud) {
+			t.Fatal("Strings don't match")
+		}
+	}
+}
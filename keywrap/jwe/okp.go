@@ -0,0 +1,413 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package jwe
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"filippo.io/edwards25519"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/utils"
+	"golang.org/x/crypto/curve25519"
+	jose "gopkg.in/square/go-jose.v2"
+	josecipher "gopkg.in/square/go-jose.v2/cipher"
+)
+
+// go-jose implements neither ECDH-ES with X25519 (RFC 8037) nor parsing JWEs
+// whose recipients have X25519 ephemeral keys. JWEs with such OKP recipients
+// are therefore assembled here, as are JWEs wrapped with the source of
+// randomness of an EncryptConfig since go-jose always uses crypto/rand; when
+// unwrapping, the OKP recipients are decrypted here and all others are handed
+// to go-jose without them.
+
+// x25519PublicKey is the public key of an OKP recipient; Ed25519 keys are
+// converted to X25519 keys
+type x25519PublicKey []byte
+
+// rawJWE is a JWE in JSON serialization
+type rawJWE struct {
+	Protected    string          `json:"protected,omitempty"`
+	Unprotected  json.RawMessage `json:"unprotected,omitempty"`
+	Header       json.RawMessage `json:"header,omitempty"`
+	EncryptedKey string          `json:"encrypted_key,omitempty"`
+	Recipients   []rawRecipient  `json:"recipients,omitempty"`
+	Aad          string          `json:"aad,omitempty"`
+	Iv           string          `json:"iv"`
+	Ciphertext   string          `json:"ciphertext"`
+	Tag          string          `json:"tag"`
+}
+
+type rawRecipient struct {
+	Header       json.RawMessage `json:"header,omitempty"`
+	EncryptedKey string          `json:"encrypted_key,omitempty"`
+}
+
+// jweHeader holds the header parameters used for unwrapping OKP recipients
+type jweHeader struct {
+	Alg string `json:"alg,omitempty"`
+	Enc string `json:"enc,omitempty"`
+	Zip string `json:"zip,omitempty"`
+	Epk *struct {
+		Kty string `json:"kty"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+	} `json:"epk,omitempty"`
+	Apu string `json:"apu,omitempty"`
+	Apv string `json:"apv,omitempty"`
+}
+
+// isOKP returns true if the key is an X25519 or Ed25519 key
+func isOKP(key interface{}) bool {
+	switch key.(type) {
+	case ed25519.PublicKey, ed25519.PrivateKey, x25519PublicKey:
+		return true
+	}
+	return utils.KeyType(key) == "X25519"
+}
+
+// toX25519PublicKey returns the X25519 public key of an X25519 or Ed25519
+// public key
+func toX25519PublicKey(key interface{}) (x25519PublicKey, error) {
+	if pub, ok := key.(ed25519.PublicKey); ok {
+		return ed25519ToX25519(pub)
+	}
+	if k, ok := key.(interface{ Bytes() []byte }); ok && utils.KeyType(key) == "X25519" {
+		return k.Bytes(), nil
+	}
+	return nil, fmt.Errorf("JWE: %s keys are no OKP keys: %w", utils.KeyType(key), errdefs.ErrUnsupportedKey)
+}
+
+// x25519PrivateKey returns the X25519 scalar of an X25519 or Ed25519 private
+// key; the scalar of an Ed25519 key is the first half of the SHA-512 of its
+// seed like for signing
+func x25519PrivateKey(key interface{}) ([]byte, bool) {
+	if priv, ok := key.(ed25519.PrivateKey); ok {
+		h := sha512.Sum512(priv.Seed())
+		return h[:curve25519.ScalarSize], true
+	}
+	if k, ok := key.(interface{ Bytes() []byte }); ok && utils.KeyType(key) == "X25519" {
+		return k.Bytes(), true
+	}
+	return nil, false
+}
+
+// ed25519ToX25519 maps an Ed25519 public key to the X25519 public key of the
+// same private key
+func ed25519ToX25519(pub ed25519.PublicKey) (x25519PublicKey, error) {
+	p, err := new(edwards25519.Point).SetBytes(pub)
+	if err != nil {
+		return nil, fmt.Errorf("JWE: invalid Ed25519 public key: %w", errdefs.ErrKeyMaterial)
+	}
+	return p.BytesMontgomery(), nil
+}
+
+// deriveKEK derives the key encryption key of ECDH-ES key agreement with the
+// Concat KDF of RFC 7518
+func deriveKEK(alg string, z, apu, apv []byte, size int) []byte {
+	lengthPrefixed := func(data []byte) []byte {
+		out := make([]byte, 4+len(data))
+		binary.BigEndian.PutUint32(out, uint32(len(data)))
+		copy(out[4:], data)
+		return out
+	}
+	supPubInfo := make([]byte, 4)
+	binary.BigEndian.PutUint32(supPubInfo, uint32(size)*8)
+	kek := make([]byte, size)
+	_, _ = io.ReadFull(josecipher.NewConcatKDF(crypto.SHA256, z, lengthPrefixed([]byte(alg)), lengthPrefixed(apu), lengthPrefixed(apv), supPubInfo, nil), kek)
+	return kek
+}
+
+// assembleJWE encrypts the optsData to the recipients as a JWE in general JSON
+// serialization; all randomness is read from rand, though Go ignores it for
+// the ephemeral keys of ECDH-ES with NIST curves
+func assembleJWE(rand io.Reader, joseRecipients []jose.Recipient, enc jose.ContentEncryption, optsData []byte) ([]byte, error) {
+	cek := make([]byte, contentKeyLengths[enc])
+	if _, err := io.ReadFull(rand, cek); err != nil {
+		return nil, fmt.Errorf("could not generate the content encryption key: %w", err)
+	}
+	jwe := rawJWE{
+		Protected: base64.RawURLEncoding.EncodeToString([]byte(`{"enc":"` + string(enc) + `"}`)),
+	}
+	for _, r := range joseRecipients {
+		header := map[string]interface{}{"alg": r.Algorithm}
+		var (
+			encryptedKey []byte
+			err          error
+		)
+		switch key := r.Key.(type) {
+		case *rsa.PublicKey:
+			var h hash.Hash
+			switch r.Algorithm {
+			case jose.RSA_OAEP:
+				h = sha1.New()
+			case jose.RSA_OAEP_256:
+				h = sha256.New()
+			default:
+				return nil, fmt.Errorf("JWE: unsupported key management algorithm %s: %w", r.Algorithm, errdefs.ErrUnsupportedKey)
+			}
+			encryptedKey, err = rsa.EncryptOAEP(h, rand, key, cek, nil)
+		case *ecdsa.PublicKey:
+			var eph *ecdsa.PrivateKey
+			if eph, err = ecdsa.GenerateKey(key.Curve, rand); err != nil {
+				break
+			}
+			header["epk"] = &jose.JSONWebKey{Key: &eph.PublicKey}
+			encryptedKey, err = wrapCEK(josecipher.DeriveECDHES(string(r.Algorithm), nil, nil, eph, key, kekSizes[r.Algorithm]), cek)
+		case x25519PublicKey:
+			eph := make([]byte, curve25519.ScalarSize)
+			if _, err = io.ReadFull(rand, eph); err != nil {
+				break
+			}
+			var ephPub, z []byte
+			if ephPub, err = curve25519.X25519(eph, curve25519.Basepoint); err != nil {
+				break
+			}
+			if z, err = curve25519.X25519(eph, key); err != nil {
+				return nil, fmt.Errorf("JWE: invalid X25519 public key: %w", errdefs.ErrKeyMaterial)
+			}
+			header["epk"] = map[string]string{"kty": "OKP", "crv": "X25519", "x": base64.RawURLEncoding.EncodeToString(ephPub)}
+			encryptedKey, err = wrapCEK(deriveKEK(string(r.Algorithm), z, nil, nil, kekSizes[r.Algorithm]), cek)
+		default:
+			return nil, fmt.Errorf("JWE: %s keys cannot be used for encryption: %w", utils.KeyType(r.Key), errdefs.ErrUnsupportedKey)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("JWE: could not wrap the content encryption key: %w", err)
+		}
+		rawHeader, err := json.Marshal(header)
+		if err != nil {
+			return nil, err
+		}
+		jwe.Recipients = append(jwe.Recipients, rawRecipient{
+			Header:       rawHeader,
+			EncryptedKey: base64.RawURLEncoding.EncodeToString(encryptedKey),
+		})
+	}
+
+	aead, tagSize, err := newContentAEAD(enc, cek)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand, iv); err != nil {
+		return nil, fmt.Errorf("could not generate the IV: %w", err)
+	}
+	sealed := aead.Seal(nil, iv, optsData, []byte(jwe.Protected))
+	jwe.Iv = base64.RawURLEncoding.EncodeToString(iv)
+	jwe.Ciphertext = base64.RawURLEncoding.EncodeToString(sealed[:len(sealed)-tagSize])
+	jwe.Tag = base64.RawURLEncoding.EncodeToString(sealed[len(sealed)-tagSize:])
+	return json.Marshal(&jwe)
+}
+
+// kekSizes maps the ECDH-ES key management algorithms to the sizes of their
+// key encryption keys
+var kekSizes = map[jose.KeyAlgorithm]int{
+	jose.ECDH_ES_A128KW: 16,
+	jose.ECDH_ES_A192KW: 24,
+	jose.ECDH_ES_A256KW: 32,
+}
+
+// newContentAEAD returns the AEAD of a content encryption algorithm and the
+// size of its authentication tag
+func newContentAEAD(enc jose.ContentEncryption, cek []byte) (cipher.AEAD, int, error) {
+	keyLen, ok := contentKeyLengths[enc]
+	if !ok || len(cek) != keyLen {
+		return nil, 0, fmt.Errorf("JWE: unsupported content encryption algorithm %q: %w", enc, errdefs.ErrProtocol)
+	}
+	switch enc {
+	case jose.A128GCM, jose.A192GCM, jose.A256GCM:
+		block, err := aes.NewCipher(cek)
+		if err != nil {
+			return nil, 0, err
+		}
+		aead, err := cipher.NewGCM(block)
+		return aead, 16, err
+	}
+	aead, err := josecipher.NewCBCHMAC(cek, aes.NewCipher)
+	return aead, keyLen / 2, err
+}
+
+func wrapCEK(kek, cek []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return josecipher.KeyWrap(block, cek)
+}
+
+// splitOKP parses a JWE in JSON serialization and separates its OKP recipients
+// from the others; it returns the JWE without the OKP recipients for go-jose,
+// which is nil if there are no others. A JWE without OKP recipients is returned
+// unchanged.
+func splitOKP(jweString []byte) (*rawJWE, []byte, error) {
+	var jwe rawJWE
+	if len(jweString) == 0 || jweString[0] != '{' || json.Unmarshal(jweString, &jwe) != nil {
+		return nil, jweString, nil
+	}
+	recipients := jwe.Recipients
+	if len(recipients) == 0 {
+		// flattened JSON serialization
+		recipients = []rawRecipient{{Header: jwe.Header, EncryptedKey: jwe.EncryptedKey}}
+	}
+	var okp, others []rawRecipient
+	for _, r := range recipients {
+		header, err := jwe.mergedHeader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		// we never compress the key options; refuse to decompress untrusted data
+		if header.Zip != "" {
+			return nil, nil, fmt.Errorf("compressed JWE is not supported: %w", errdefs.ErrProtocol)
+		}
+		if header.Epk != nil && header.Epk.Kty == "OKP" {
+			okp = append(okp, r)
+		} else {
+			others = append(others, r)
+		}
+	}
+	if len(okp) == 0 {
+		return nil, jweString, nil
+	}
+
+	var rest []byte
+	if len(others) > 0 {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(jweString, &fields); err != nil {
+			return nil, nil, fmt.Errorf("JWE: invalid JSON serialization: %w", errdefs.ErrProtocol)
+		}
+		delete(fields, "header")
+		delete(fields, "encrypted_key")
+		rawOthers, err := json.Marshal(others)
+		if err != nil {
+			return nil, nil, err
+		}
+		fields["recipients"] = rawOthers
+		if rest, err = json.Marshal(fields); err != nil {
+			return nil, nil, err
+		}
+	}
+	jwe.Recipients, jwe.Header, jwe.EncryptedKey = okp, nil, ""
+	return &jwe, rest, nil
+}
+
+// mergedHeader merges the protected, shared unprotected and recipient headers
+func (jwe *rawJWE) mergedHeader(r rawRecipient) (*jweHeader, error) {
+	var header jweHeader
+	protected, err := base64.RawURLEncoding.DecodeString(jwe.Protected)
+	if err != nil {
+		return nil, fmt.Errorf("JWE: invalid protected header: %w", errdefs.ErrProtocol)
+	}
+	for _, h := range [][]byte{protected, jwe.Unprotected, r.Header} {
+		if len(h) > 0 && json.Unmarshal(h, &header) != nil {
+			return nil, fmt.Errorf("JWE: invalid header: %w", errdefs.ErrProtocol)
+		}
+	}
+	return &header, nil
+}
+
+// decryptOKP decrypts the content of the JWE with an X25519 scalar using the
+// first of the OKP recipients that it unwraps the content encryption key of
+func (jwe *rawJWE) decryptOKP(priv []byte) ([]byte, error) {
+	for _, r := range jwe.Recipients {
+		cek, enc, err := jwe.unwrapOKP(priv, r)
+		if err != nil {
+			continue
+		}
+		return jwe.decryptContent(cek, enc)
+	}
+	return nil, errors.New("no OKP recipient could be decrypted")
+}
+
+func (jwe *rawJWE) unwrapOKP(priv []byte, r rawRecipient) ([]byte, string, error) {
+	header, err := jwe.mergedHeader(r)
+	if err != nil {
+		return nil, "", err
+	}
+	kekSize, ok := kekSizes[jose.KeyAlgorithm(header.Alg)]
+	if !ok {
+		return nil, "", fmt.Errorf("JWE: unsupported key management algorithm %q for OKP keys: %w", header.Alg, errdefs.ErrProtocol)
+	}
+	if header.Epk.Crv != "X25519" {
+		return nil, "", fmt.Errorf("JWE: unsupported OKP curve %q: %w", header.Epk.Crv, errdefs.ErrProtocol)
+	}
+	var ephPub, apu, apv, encryptedKey []byte
+	for _, f := range []struct {
+		in  string
+		out *[]byte
+	}{{header.Epk.X, &ephPub}, {header.Apu, &apu}, {header.Apv, &apv}, {r.EncryptedKey, &encryptedKey}} {
+		if *f.out, err = base64.RawURLEncoding.DecodeString(f.in); err != nil {
+			return nil, "", fmt.Errorf("JWE: invalid base64url encoding: %w", errdefs.ErrProtocol)
+		}
+	}
+	z, err := curve25519.X25519(priv, ephPub)
+	if err != nil {
+		return nil, "", fmt.Errorf("JWE: invalid ephemeral X25519 key: %w", errdefs.ErrProtocol)
+	}
+	block, err := aes.NewCipher(deriveKEK(header.Alg, z, apu, apv, kekSize))
+	if err != nil {
+		return nil, "", err
+	}
+	cek, err := josecipher.KeyUnwrap(block, encryptedKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return cek, header.Enc, nil
+}
+
+// decryptContent decrypts the ciphertext of the JWE with the content
+// encryption key
+func (jwe *rawJWE) decryptContent(cek []byte, enc string) ([]byte, error) {
+	aead, _, err := newContentAEAD(jose.ContentEncryption(enc), cek)
+	if err != nil {
+		return nil, err
+	}
+	var iv, ciphertext, tag []byte
+	for _, f := range []struct {
+		in  string
+		out *[]byte
+	}{{jwe.Iv, &iv}, {jwe.Ciphertext, &ciphertext}, {jwe.Tag, &tag}} {
+		if *f.out, err = base64.RawURLEncoding.DecodeString(f.in); err != nil {
+			return nil, fmt.Errorf("JWE: invalid base64url encoding: %w", errdefs.ErrProtocol)
+		}
+	}
+	if len(iv) != aead.NonceSize() {
+		return nil, fmt.Errorf("JWE: invalid IV: %w", errdefs.ErrProtocol)
+	}
+	aad := jwe.Protected
+	if jwe.Aad != "" {
+		aad += "." + jwe.Aad
+	}
+	plain, err := aead.Open(nil, iv, append(ciphertext, tag...), []byte(aad))
+	if err != nil {
+		return nil, fmt.Errorf("JWE: could not decrypt the content: %w", errdefs.ErrIntegrity)
+	}
+	return plain, nil
+}
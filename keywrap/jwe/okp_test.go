@@ -0,0 +1,117 @@
+//go:build go1.20
+// +build go1.20
+
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package jwe
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/x509"
+	"testing"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/utils"
+)
+
+func TestKeyWrapJweX25519(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "X25519")
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := x509.MarshalPKIXPublicKey(key.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	privKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+	wk, err := kw.WrapKeys(&config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"pubkeys": {pubKey},
+		},
+	}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ud, err := kw.UnwrapKey(&config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {privKey},
+			"privkeys-passwords": {oneEmpty},
+		},
+	}, wk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(ud) {
+		t.Fatal("Strings don't match")
+	}
+}
+
+// detRand is a deterministic source of "randomness" for tests
+type detRand struct {
+	b byte
+}
+
+func (r *detRand) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.b
+		r.b++
+	}
+	return len(p), nil
+}
+
+func TestKeyWrapJweX25519Rand(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "X25519")
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := x509.MarshalPKIXPublicKey(key.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the ephemeral key, the content encryption key and the IV are all read
+	// from the randomness source of the EncryptConfig
+	kw := NewKeyWrapper()
+	var wrapped [][]byte
+	for i := 0; i < 2; i++ {
+		wk, err := kw.WrapKeys(&config.EncryptConfig{
+			Parameters: map[string][][]byte{
+				"pubkeys": {pubKey},
+			},
+			Rand: &detRand{},
+		}, []byte("This is some secret text"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrapped = append(wrapped, wk)
+	}
+	if !bytes.Equal(wrapped[0], wrapped[1]) {
+		t.Fatal("JWEs wrapped with the same randomness differ")
+	}
+}
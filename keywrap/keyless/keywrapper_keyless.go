@@ -0,0 +1,427 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keyless
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
+	"github.com/containers/ocicrypt/keywrap"
+	"github.com/containers/ocicrypt/log"
+	"github.com/containers/ocicrypt/spiffe"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// CallTimeout is the time a rewrap service has for answering a request
+	CallTimeout = 30 * time.Second
+	// maxResponseSize is the maximum size of a response of a rewrap service
+	maxResponseSize = 256 * 1024
+)
+
+// httpClient is used for calling the rewrap services; tests replace it
+var httpClient = &http.Client{Timeout: CallTimeout}
+
+// Identity is an OIDC identity or a SPIFFE ID that may have the layer key
+// rewrapped for it; the rewrap service authenticates a SPIFFE ID by the
+// X.509-SVID the client presents as client certificate
+type Identity struct {
+	Issuer   string `json:"issuer,omitempty"`
+	Subject  string `json:"subject,omitempty"`
+	SPIFFEID string `json:"spiffe_id,omitempty"`
+}
+
+// payload is encrypted for the rewrap service; it binds the identities to the
+// layer key so that they cannot be changed without the rewrap service noticing
+type payload struct {
+	Identities []Identity `json:"identities"`
+	OptsData   []byte     `json:"optsdata"`
+}
+
+// keylessBlob is the wrapped key
+type keylessBlob struct {
+	Version int    `json:"version"`
+	Service string `json:"service"`
+	JWE     string `json:"jwe"`
+}
+
+type rewrapRequest struct {
+	JWE       string          `json:"jwe"`
+	Recipient json.RawMessage `json:"recipient"`
+}
+
+type rewrapResponse struct {
+	JWE string `json:"jwe"`
+}
+
+type keylessKeyWrapper struct {
+}
+
+func (kw *keylessKeyWrapper) GetAnnotationID() string {
+	return "org.opencontainers.image.enc.keys.experimental.keyless"
+}
+
+// NewKeyWrapper returns a new key wrapping interface that has a rewrap service
+// re-target the layer key at pull time to the ephemeral key of a client that
+// authenticates with an OIDC identity
+func NewKeyWrapper() keywrap.KeyWrapper {
+	return &keylessKeyWrapper{}
+}
+
+// WrapKeys encrypts the optsData, which describe the symmetric key used for
+// encrypting the layer, along with the identities of the keyless-identities
+// parameter for the short-lived certificate of the rewrap service of the
+// keyless-services parameter. The certificate must be issued by one of the CAs
+// of the keyless-roots parameter to the identity of the
+// keyless-service-identity parameter.
+func (kw *keylessKeyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	return kw.WrapKeysContext(context.Background(), ec, optsData)
+}
+
+// WrapKeysContext wraps the layer key like WrapKeys, giving up once ctx is done
+func (kw *keylessKeyWrapper) WrapKeysContext(ctx context.Context, ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	services := ec.Parameters["keyless-services"]
+	// no recipients is not an error...
+	if len(services) == 0 {
+		return nil, nil
+	}
+	if len(services) != 1 {
+		return nil, fmt.Errorf("keyless: exactly one rewrap service must be given: %w", errdefs.ErrConfiguration)
+	}
+	service := strings.TrimSuffix(string(services[0]), "/")
+	if err := checkService(service); err != nil {
+		return nil, err
+	}
+	serviceIdentities := ec.Parameters["keyless-service-identity"]
+	if len(serviceIdentities) != 1 || len(serviceIdentities[0]) == 0 {
+		return nil, fmt.Errorf("keyless: exactly one identity of the rewrap service must be given: %w", errdefs.ErrConfiguration)
+	}
+
+	identities, err := parseIdentities(ec.Parameters["keyless-identities"])
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	for _, root := range ec.Parameters["keyless-roots"] {
+		if !roots.AppendCertsFromPEM(root) {
+			return nil, fmt.Errorf("keyless: could not parse the roots: %w", errdefs.ErrKeyMaterial)
+		}
+	}
+	if len(ec.Parameters["keyless-roots"]) == 0 {
+		return nil, fmt.Errorf("keyless: no roots given for the certificate of the rewrap service: %w", errdefs.ErrConfiguration)
+	}
+
+	cert, err := fetchCertificate(ctx, service, string(serviceIdentities[0]), roots)
+	if err != nil {
+		return nil, err
+	}
+	if err := ec.GetPolicy().CheckKey("keyless", cert.PublicKey); err != nil {
+		return nil, err
+	}
+
+	plaintext, err := json.Marshal(&payload{Identities: identities, OptsData: optsData})
+	if err != nil {
+		return nil, err
+	}
+	alg := jose.RSA_OAEP_256
+	if _, ok := cert.PublicKey.(*ecdsa.PublicKey); ok {
+		alg = jose.ECDH_ES_A256KW
+	}
+	jwe, err := encrypt(alg, cert.PublicKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&keylessBlob{Service: service, JWE: jwe})
+}
+
+func (kw *keylessKeyWrapper) UnwrapKey(dc *config.DecryptConfig, annotation []byte) ([]byte, error) {
+	optsData, _, err := kw.UnwrapKeyID(dc, annotation)
+	return optsData, err
+}
+
+// UnwrapKeyID has the rewrap service re-target the layer key to an ephemeral
+// key, authenticating with the ID token of the DecryptConfig and with its
+// X.509-SVID as client certificate. Only the rewrap services of the
+// keyless-services parameter are called since they receive the token. It
+// returns the URL of the rewrap service as key ID.
+func (kw *keylessKeyWrapper) UnwrapKeyID(dc *config.DecryptConfig, annotation []byte) ([]byte, string, error) {
+	return kw.UnwrapKeyIDContext(context.Background(), dc, annotation)
+}
+
+// UnwrapKeyIDContext unwraps the layer key like UnwrapKeyID, giving up once
+// ctx is done
+func (kw *keylessKeyWrapper) UnwrapKeyIDContext(ctx context.Context, dc *config.DecryptConfig, annotation []byte) ([]byte, string, error) {
+	if kw.NoPossibleKeys(dc.Parameters) {
+		return nil, "", fmt.Errorf("No rewrap services found for keyless decryption: %w", errdefs.ErrNoDecryptionKey)
+	}
+	if dc.IDTokenSource == nil && dc.SVIDSource == nil {
+		return nil, "", fmt.Errorf("keyless decryption needs an ID token or an X.509-SVID: %w", errdefs.ErrNoDecryptionKey)
+	}
+
+	var blob keylessBlob
+	if err := json.Unmarshal(annotation, &blob); err != nil {
+		return nil, "", fmt.Errorf("could not parse the keyless wrapped key: %w", errdefs.ErrProtocol)
+	}
+	if blob.Version != 0 {
+		return nil, "", fmt.Errorf("unsupported keyless wrapped key version %d: %w", blob.Version, errdefs.ErrProtocol)
+	}
+	trusted := false
+	for _, service := range kw.GetPrivateKeys(dc.Parameters) {
+		if strings.TrimSuffix(string(service), "/") == blob.Service {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		log.L().Debug("Layer key was wrapped for an untrusted rewrap service", log.KeyProvider, blob.Service)
+		return nil, "", fmt.Errorf("keyless: layer key was wrapped for rewrap service %s, which is not trusted: %w", blob.Service, errdefs.ErrNoDecryptionKey)
+	}
+	if err := checkService(blob.Service); err != nil {
+		return nil, "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, CallTimeout)
+	defer cancel()
+	var token string
+	if dc.IDTokenSource != nil {
+		var err error
+		if token, err = dc.IDTokenSource.Token(ctx); err != nil {
+			return nil, "", fmt.Errorf("could not get the ID token for the rewrap service: %w", err)
+		}
+	}
+	client := spiffe.HTTPClient(httpClient, dc.SVIDSource)
+
+	ephemeralKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	recipient, err := (&jose.JSONWebKey{Key: &ephemeralKey.PublicKey}).MarshalJSON()
+	if err != nil {
+		return nil, "", err
+	}
+	reqBody, err := json.Marshal(&rewrapRequest{JWE: blob.JWE, Recipient: recipient})
+	if err != nil {
+		return nil, "", err
+	}
+	var resp rewrapResponse
+	if err := call(ctx, client, http.MethodPost, blob.Service+"/v1/rewrap", token, reqBody, &resp); err != nil {
+		return nil, "", err
+	}
+
+	jwe, err := jose.ParseEncrypted(resp.JWE)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not parse the rewrapped key: %w", errdefs.ErrProtocol)
+	}
+	if _, ok := jwe.Header.ExtraHeaders["zip"]; ok {
+		return nil, "", fmt.Errorf("compressed JWE is not supported: %w", errdefs.ErrProtocol)
+	}
+	optsData, err := jwe.Decrypt(ephemeralKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not decrypt the rewrapped key: %w", errdefs.ErrIntegrity)
+	}
+	return optsData, "keyless:" + blob.Service, nil
+}
+
+func (kw *keylessKeyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
+	return len(kw.GetPrivateKeys(dcparameters)) == 0
+}
+
+// GetPrivateKeys returns the trusted rewrap services since the keys never
+// leave them
+func (kw *keylessKeyWrapper) GetPrivateKeys(dcparameters map[string][][]byte) [][]byte {
+	return dcparameters["keyless-services"]
+}
+
+func (kw *keylessKeyWrapper) GetKeyIdsFromPacket(_ string) ([]uint64, error) {
+	return nil, nil
+}
+
+func (kw *keylessKeyWrapper) GetRecipients(_ string) ([]string, error) {
+	return []string{"[keyless]"}, nil
+}
+
+// parseIdentities parses identities given as "<issuer> <subject>" or as SPIFFE
+// IDs
+func parseIdentities(params [][]byte) ([]Identity, error) {
+	if len(params) == 0 {
+		return nil, fmt.Errorf("keyless: no identities given that may decrypt: %w", errdefs.ErrConfiguration)
+	}
+	var identities []Identity
+	for _, param := range params {
+		fields := strings.Fields(string(param))
+		if len(fields) == 1 && strings.HasPrefix(fields[0], "spiffe://") {
+			id, err := spiffeid.FromString(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("keyless: invalid SPIFFE ID %q: %w", param, errdefs.ErrConfiguration)
+			}
+			identities = append(identities, Identity{SPIFFEID: id.String()})
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("keyless: identity %q is not of the form '<issuer> <subject>' or a SPIFFE ID: %w", param, errdefs.ErrConfiguration)
+		}
+		identities = append(identities, Identity{Issuer: fields[0], Subject: fields[1]})
+	}
+	return identities, nil
+}
+
+// checkService checks that the rewrap service is called with https since it
+// receives the ID tokens
+func checkService(service string) error {
+	u, err := url.Parse(service)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("keyless: rewrap service %q is not an https URL: %w", service, errdefs.ErrConfiguration)
+	}
+	return nil
+}
+
+// fetchCertificate fetches the current certificate of the rewrap service and
+// verifies that it is currently valid, issued by the roots and issued to the
+// identity
+func fetchCertificate(ctx context.Context, service, identity string, roots *x509.CertPool) (*x509.Certificate, error) {
+	ctx, cancel := context.WithTimeout(ctx, CallTimeout)
+	defer cancel()
+	var resp struct {
+		Chain string `json:"chain"`
+	}
+	if err := call(ctx, httpClient, http.MethodGet, service+"/v1/certificate", "", nil, &resp); err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	rest := []byte(resp.Chain)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse the certificate of rewrap service %s: %w", service, errdefs.ErrKeyMaterial)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("rewrap service %s returned no certificate: %w", service, errdefs.ErrProtocol)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("could not verify the certificate of rewrap service %s: %w", service, err))
+	}
+	if !hasIdentity(certs[0], identity) {
+		return nil, fmt.Errorf("the certificate of rewrap service %s is not issued to %s: %w", service, identity, errdefs.ErrKeyMaterial)
+	}
+	return certs[0], nil
+}
+
+// hasIdentity returns whether the identity is one of the URIs, email
+// addresses or DNS names of the subject alternative names of the certificate
+func hasIdentity(cert *x509.Certificate, identity string) bool {
+	for _, u := range cert.URIs {
+		if u.String() == identity {
+			return true
+		}
+	}
+	for _, name := range append(cert.EmailAddresses, cert.DNSNames...) {
+		if name == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// encrypt encrypts the plaintext for the public key as a JWE in compact
+// serialization
+func encrypt(alg jose.KeyAlgorithm, pubKey interface{}, plaintext []byte) (string, error) {
+	enc := jose.A256GCM
+	if fips.Enforced() {
+		// AES-GCM may only be used with IVs generated by the FIPS module
+		enc = jose.A256CBC_HS512
+	}
+	encrypter, err := jose.NewEncrypter(enc, jose.Recipient{Algorithm: alg, Key: pubKey}, nil)
+	if err != nil {
+		return "", fmt.Errorf("jose.NewEncrypter failed: %w", err)
+	}
+	jwe, err := encrypter.Encrypt(plaintext)
+	if err != nil {
+		return "", fmt.Errorf("JWE Encrypt failed: %w", err)
+	}
+	return jwe.CompactSerialize()
+}
+
+// call calls the rewrap service with the client and decodes its JSON response
+// into resp
+func call(ctx context.Context, client *http.Client, method, url, token string, body []byte, resp interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid rewrap service URL %s: %w", url, errdefs.ErrConfiguration)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	httpResp, err := client.Do(req)
+	if err != nil {
+		return errdefs.WithCategory(errdefs.ErrProviderUnreachable, fmt.Errorf("could not call the rewrap service: %w", err))
+	}
+	defer httpResp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(httpResp.Body, maxResponseSize+1))
+	if err != nil {
+		return errdefs.WithCategory(errdefs.ErrProviderUnreachable, fmt.Errorf("could not read the response of the rewrap service: %w", err))
+	}
+	switch {
+	case httpResp.StatusCode == http.StatusUnauthorized || httpResp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("rewrap service %s refused the request with HTTP status %d: %w", url, httpResp.StatusCode, errdefs.ErrNoDecryptionKey)
+	case httpResp.StatusCode >= 500:
+		return fmt.Errorf("rewrap service %s failed with HTTP status %d: %w", url, httpResp.StatusCode, errdefs.ErrProviderUnreachable)
+	case httpResp.StatusCode != http.StatusOK:
+		return fmt.Errorf("rewrap service %s returned HTTP status %d: %w", url, httpResp.StatusCode, errdefs.ErrProtocol)
+	}
+	if len(data) > maxResponseSize {
+		return fmt.Errorf("response of rewrap service %s is too large: %w", url, errdefs.ErrLimitExceeded)
+	}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return fmt.Errorf("could not parse the response of rewrap service %s: %w", url, errdefs.ErrProtocol)
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package keyless
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/oidc"
+	"github.com/containers/ocicrypt/spiffe"
+	"github.com/containers/ocicrypt/utils"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// fakeRewrapService holds its key in memory and treats the ID tokens as
+// '<issuer>.<subject>.' for simplicity; SPIFFE IDs are taken from the verified
+// client certificates
+type fakeRewrapService struct {
+	key   *ecdsa.PrivateKey
+	chain []byte
+}
+
+// testServiceIdentity is the identity the certificates of the fake rewrap
+// services are issued to
+const testServiceIdentity = "https://github.com/example/rewrap/.github/workflows/deploy.yml@refs/heads/main"
+
+// newFakeRewrapService returns a rewrap service whose certificate expires at
+// notAfter and the root of its certificate
+func newFakeRewrapService(t *testing.T, notAfter time.Time) (*fakeRewrapService, []byte) {
+	caKey, caCert, err := utils.CreateTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubData, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := url.Parse(testServiceIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := utils.CertifyKey(pubData, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    notAfter.Add(-10 * time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageKeyAgreement,
+		URIs:         []*url.URL{identity},
+	}, caKey, caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	root := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+	return &fakeRewrapService{key: key, chain: chain}, root
+}
+
+func (s *fakeRewrapService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v1/certificate":
+		_ = json.NewEncoder(w).Encode(map[string]string{"chain": string(s.chain)})
+	case "/v1/rewrap":
+		var req rewrapRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		jwe, err := jose.ParseEncrypted(req.JWE)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		plaintext, err := jwe.Decrypt(s.key)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var p payload
+		if err := json.Unmarshal(plaintext, &p); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		allowed := false
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		for _, identity := range p.Identities {
+			if identity.SPIFFEID == "" && len(parts) == 3 && identity.Issuer == parts[0] && identity.Subject == parts[1] {
+				allowed = true
+			}
+			if identity.SPIFFEID != "" && len(r.TLS.PeerCertificates) > 0 {
+				for _, u := range r.TLS.PeerCertificates[0].URIs {
+					if u.String() == identity.SPIFFEID {
+						allowed = true
+					}
+				}
+			}
+		}
+		if !allowed {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var recipient jose.JSONWebKey
+		if err := recipient.UnmarshalJSON(req.Recipient); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rewrapped, err := encrypt(jose.ECDH_ES_A256KW, recipient.Key, p.OptsData)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(&rewrapResponse{JWE: rewrapped})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestKeyWrapKeyless(t *testing.T) {
+	service, root := newFakeRewrapService(t, time.Now().Add(5*time.Minute))
+	server := httptest.NewTLSServer(service)
+	defer server.Close()
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = server.Client()
+
+	optsData := []byte(`{"cipher":"AES_256_CTR_HMAC_SHA256"}`)
+	kw := NewKeyWrapper()
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"keyless-services":         {[]byte(server.URL)},
+			"keyless-service-identity": {[]byte(testServiceIdentity)},
+			"keyless-roots":            {root},
+			"keyless-identities":       {[]byte("issuer ci-job")},
+		},
+	}
+	wrapped, err := kw.WrapKeys(ec, optsData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("OCICRYPT_TEST_ID_TOKEN", "issuer.ci-job.")
+	dc := &config.DecryptConfig{
+		Parameters:    map[string][][]byte{"keyless-services": {[]byte(server.URL + "/")}},
+		IDTokenSource: oidc.EnvTokenSource("OCICRYPT_TEST_ID_TOKEN"),
+	}
+	plain, keyID, err := kw.(*keylessKeyWrapper).UnwrapKeyID(dc, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != string(optsData) || keyID != "keyless:"+server.URL {
+		t.Fatalf("unexpected key %q with key ID %q", plain, keyID)
+	}
+
+	// other identities are refused by the rewrap service
+	t.Setenv("OCICRYPT_TEST_ID_TOKEN", "issuer.other-job.")
+	if _, err := kw.UnwrapKey(dc, wrapped); !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+		t.Fatalf("expected ErrNoDecryptionKey, got %v", err)
+	}
+
+	// the token is only sent to trusted rewrap services
+	dc.Parameters["keyless-services"] = [][]byte{[]byte("https://rewrap.example.com")}
+	if _, err := kw.UnwrapKey(dc, wrapped); !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+		t.Fatalf("expected ErrNoDecryptionKey, got %v", err)
+	}
+
+	// the token is not sent over http
+	httpBlob := strings.Replace(string(wrapped), `"https://`, `"http://`, 1)
+	dc.Parameters["keyless-services"] = [][]byte{[]byte(strings.Replace(server.URL, "https://", "http://", 1))}
+	if _, err := kw.UnwrapKey(dc, []byte(httpBlob)); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+
+	// the certificate of the rewrap service must be issued to its identity
+	ec.Parameters["keyless-service-identity"] = [][]byte{[]byte("https://github.com/attacker/rewrap")}
+	if _, err := kw.WrapKeys(ec, optsData); !errors.Is(err, errdefs.ErrKeyMaterial) {
+		t.Fatalf("expected ErrKeyMaterial, got %v", err)
+	}
+	delete(ec.Parameters, "keyless-service-identity")
+	if _, err := kw.WrapKeys(ec, optsData); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+	ec.Parameters["keyless-service-identity"] = [][]byte{[]byte(testServiceIdentity)}
+
+	// the certificate of the rewrap service must be issued by the roots
+	_, otherRoot := newFakeRewrapService(t, time.Now().Add(5*time.Minute))
+	ec.Parameters["keyless-roots"] = [][]byte{otherRoot}
+	if _, err := kw.WrapKeys(ec, optsData); !errors.Is(err, errdefs.ErrKeyMaterial) {
+		t.Fatalf("expected ErrKeyMaterial, got %v", err)
+	}
+
+	// the rewrap service must be called with https
+	ec.Parameters["keyless-roots"] = [][]byte{root}
+	ec.Parameters["keyless-services"] = [][]byte{[]byte(strings.Replace(server.URL, "https://", "http://", 1))}
+	if _, err := kw.WrapKeys(ec, optsData); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+}
+
+func TestKeyWrapKeylessExpiredCertificate(t *testing.T) {
+	service, root := newFakeRewrapService(t, time.Now().Add(-time.Minute))
+	server := httptest.NewTLSServer(service)
+	defer server.Close()
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = server.Client()
+
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"keyless-services":         {[]byte(server.URL)},
+			"keyless-service-identity": {[]byte(testServiceIdentity)},
+			"keyless-roots":            {root},
+			"keyless-identities":       {[]byte("issuer ci-job")},
+		},
+	}
+	if _, err := NewKeyWrapper().WrapKeys(ec, []byte("{}")); !errors.Is(err, errdefs.ErrKeyMaterial) {
+		t.Fatalf("expected ErrKeyMaterial, got %v", err)
+	}
+}
+
+// createSVID creates an X.509-SVID for id signed by the CA
+func createSVID(t *testing.T, id string, caKey *rsa.PrivateKey, caCert *x509.Certificate) *spiffe.X509SVID {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubData, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, err := url.Parse(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := utils.CertifyKey(pubData, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caKey, caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &spiffe.X509SVID{
+		ID:           id,
+		Certificates: []*x509.Certificate{cert},
+		PrivateKey:   key,
+		Bundle:       []*x509.Certificate{caCert},
+	}
+}
+
+func TestKeyWrapKeylessSVID(t *testing.T) {
+	caKey, caCert, err := utils.CreateTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+
+	service, root := newFakeRewrapService(t, time.Now().Add(5*time.Minute))
+	server := httptest.NewUnstartedServer(service)
+	server.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = server.Client()
+
+	optsData := []byte(`{"cipher":"AES_256_CTR_HMAC_SHA256"}`)
+	kw := NewKeyWrapper()
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"keyless-services":         {[]byte(server.URL)},
+			"keyless-service-identity": {[]byte(testServiceIdentity)},
+			"keyless-roots":            {root},
+			"keyless-identities":       {[]byte("spiffe://example.org/node")},
+		},
+	}
+	wrapped, err := kw.WrapKeys(ec, optsData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := config.DecryptWithKeylessSVID([][]byte{[]byte(server.URL)}, createSVID(t, "spiffe://example.org/node", caKey, caCert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := kw.UnwrapKey(cc.DecryptConfig, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != string(optsData) {
+		t.Fatalf("unexpected key %q", plain)
+	}
+
+	// other SPIFFE IDs are refused by the rewrap service
+	cc.DecryptConfig.SVIDSource = createSVID(t, "spiffe://example.org/other", caKey, caCert)
+	if _, err := kw.UnwrapKey(cc.DecryptConfig, wrapped); !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+		t.Fatalf("expected ErrNoDecryptionKey, got %v", err)
+	}
+
+	// without an SVID or an ID token there is nothing to authenticate with
+	cc.DecryptConfig.SVIDSource = nil
+	if _, err := kw.UnwrapKey(cc.DecryptConfig, wrapped); !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+		t.Fatalf("expected ErrNoDecryptionKey, got %v", err)
+	}
+
+	ec.Parameters["keyless-identities"] = [][]byte{[]byte("spiffe:///node")}
+	if _, err := kw.WrapKeys(ec, optsData); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+}
@@ -17,9 +17,20 @@
 package keywrap
 
 import (
+	"context"
+
 	"github.com/containers/ocicrypt/config"
 )
 
+const (
+	// MaxWrappedKeySize is the maximum size in bytes of a single wrapped key
+	// that is passed to UnwrapKey; larger ones are rejected before parsing
+	MaxWrappedKeySize = 1024 * 1024
+	// MaxOptsDataSize is the maximum size in bytes of the layer key options
+	// that UnwrapKey may return; it bounds the decompression of wrapped keys
+	MaxOptsDataSize = 64 * 1024
+)
+
 // KeyWrapper is the interface used for wrapping keys using
 // a specific encryption technology (pgp, jwe)
 type KeyWrapper interface {
@@ -46,3 +57,49 @@ type KeyWrapper interface {
 	// If not implemented, return the nil slice
 	GetRecipients(packet string) ([]string, error)
 }
+
+// KeyIDUnwrapper is an optional interface of a KeyWrapper that tells which
+// private key unwrapped a layer key
+type KeyIDUnwrapper interface {
+	// UnwrapKeyID unwraps the layer key like UnwrapKey and also returns an
+	// identifier of the private key that unwrapped it
+	UnwrapKeyID(dc *config.DecryptConfig, annotation []byte) ([]byte, string, error)
+}
+
+// RecipientCounter is an optional interface of a KeyWrapper whose
+// GetRecipients returns a placeholder instead of the recipients
+type RecipientCounter interface {
+	// CountRecipients returns the number of recipients the layer key is
+	// wrapped for in the packet
+	CountRecipients(packet string) (int, error)
+}
+
+// ContextKeyWrapper is an optional interface of a KeyWrapper whose wrapping and
+// unwrapping of keys can be cancelled with a context.Context, for example
+// because it calls a remote key management service. KeyWrappers making such
+// calls should implement it; ocicrypt then uses it instead of WrapKeys,
+// UnwrapKey and UnwrapKeyID.
+type ContextKeyWrapper interface {
+	// WrapKeysContext wraps the layer key like WrapKeys, giving up once ctx
+	// is done
+	WrapKeysContext(ctx context.Context, ec *config.EncryptConfig, optsData []byte) ([]byte, error)
+	// UnwrapKeyIDContext unwraps the layer key like UnwrapKeyID, giving up
+	// once ctx is done; the identifier of the private key may be empty
+	UnwrapKeyIDContext(ctx context.Context, dc *config.DecryptConfig, annotation []byte) ([]byte, string, error)
+}
+
+// DecrypterKeyWrapper is an optional interface of a KeyWrapper that can unwrap
+// keys using the crypto.Decrypters of a DecryptConfig
+type DecrypterKeyWrapper interface {
+	// SupportsDecrypters returns true if the KeyWrapper uses the
+	// crypto.Decrypters of a DecryptConfig
+	SupportsDecrypters() bool
+}
+
+// GPGDecrypterKeyWrapper is an optional interface of a KeyWrapper that can
+// unwrap keys using the GPGDecrypter of a DecryptConfig
+type GPGDecrypterKeyWrapper interface {
+	// SupportsGPGDecrypter returns true if the KeyWrapper uses the
+	// GPGDecrypter of a DecryptConfig
+	SupportsGPGDecrypter() bool
+}
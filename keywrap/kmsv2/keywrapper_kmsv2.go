@@ -0,0 +1,272 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kmsv2
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/keywrap"
+	"github.com/containers/ocicrypt/log"
+	"github.com/containers/ocicrypt/utils/unixgrpc"
+	"google.golang.org/grpc/metadata"
+	kmsapi "k8s.io/kms/apis/v2"
+)
+
+const (
+	// CallTimeout is the time a KMS plugin has for encrypting or decrypting
+	// a layer key
+	CallTimeout = 10 * time.Second
+)
+
+// kmsv2Blob is the wrapped key; it holds the layer key encrypted by every KMS
+// plugin along with what the plugin needs for decrypting it
+type kmsv2Blob struct {
+	Version    int              `json:"version"`
+	Recipients []kmsv2Recipient `json:"recipients"`
+}
+
+type kmsv2Recipient struct {
+	KeyID       string            `json:"key_id"`
+	Ciphertext  []byte            `json:"ciphertext"`
+	Annotations map[string][]byte `json:"annotations,omitempty"`
+}
+
+type kmsv2KeyWrapper struct {
+}
+
+func (kw *kmsv2KeyWrapper) GetAnnotationID() string {
+	return "org.opencontainers.image.enc.keys.experimental.kmsv2"
+}
+
+// NewKeyWrapper returns a new key wrapping interface that uses the KMS plugins
+// of Kubernetes clusters, which implement the KMS v2 API
+func NewKeyWrapper() keywrap.KeyWrapper {
+	return &kmsv2KeyWrapper{}
+}
+
+// WrapKeys has the KMS plugins at the endpoints of the kmsv2-endpoints parameter
+// encrypt the optsData, which describe the symmetric key used for encrypting
+// the layer
+func (kw *kmsv2KeyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	return kw.WrapKeysContext(context.Background(), ec, optsData)
+}
+
+// WrapKeysContext wraps the layer key like WrapKeys, giving up once ctx is done
+func (kw *kmsv2KeyWrapper) WrapKeysContext(ctx context.Context, ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	endpoints, err := parseEndpoints(ec.Parameters["kmsv2-endpoints"])
+	if err != nil {
+		return nil, err
+	}
+	// no recipients is not an error...
+	if len(endpoints) == 0 {
+		return nil, nil
+	}
+
+	blob := kmsv2Blob{}
+	for _, endpoint := range endpoints {
+		callCtx, cancel := context.WithTimeout(ctx, CallTimeout)
+		resp, err := encrypt(callCtx, endpoint, &kmsapi.EncryptRequest{Plaintext: optsData, Uid: newUID()})
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("KMSv2 Encrypt failed: %w", err)
+		}
+		if resp.KeyId == "" || len(resp.Ciphertext) == 0 {
+			return nil, fmt.Errorf("KMS plugin at %s returned no key ID or ciphertext: %w", endpoint, errdefs.ErrProtocol)
+		}
+		blob.Recipients = append(blob.Recipients, kmsv2Recipient{
+			KeyID:       resp.KeyId,
+			Ciphertext:  resp.Ciphertext,
+			Annotations: resp.Annotations,
+		})
+	}
+	sort.SliceStable(blob.Recipients, func(i, j int) bool {
+		return blob.Recipients[i].KeyID < blob.Recipients[j].KeyID
+	})
+	return json.Marshal(&blob)
+}
+
+func (kw *kmsv2KeyWrapper) UnwrapKey(dc *config.DecryptConfig, annotation []byte) ([]byte, error) {
+	optsData, _, err := kw.UnwrapKeyID(dc, annotation)
+	return optsData, err
+}
+
+// UnwrapKeyID has the KMS plugins at the endpoints of the kmsv2-endpoints
+// parameter decrypt the symmetric key with which the layer is encrypted and
+// returns the key ID of the KMS key that decrypted it
+func (kw *kmsv2KeyWrapper) UnwrapKeyID(dc *config.DecryptConfig, annotation []byte) ([]byte, string, error) {
+	return kw.UnwrapKeyIDContext(context.Background(), dc, annotation)
+}
+
+// UnwrapKeyIDContext unwraps the layer key like UnwrapKeyID, giving up once
+// ctx is done
+func (kw *kmsv2KeyWrapper) UnwrapKeyIDContext(ctx context.Context, dc *config.DecryptConfig, annotation []byte) ([]byte, string, error) {
+	endpoints, err := parseEndpoints(kw.GetPrivateKeys(dc.Parameters))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(endpoints) == 0 {
+		return nil, "", fmt.Errorf("No KMS plugins found for KMSv2 decryption: %w", errdefs.ErrNoDecryptionKey)
+	}
+
+	var blob kmsv2Blob
+	if err := json.Unmarshal(annotation, &blob); err != nil {
+		return nil, "", fmt.Errorf("could not parse the KMSv2 wrapped key: %w", errdefs.ErrProtocol)
+	}
+	if blob.Version != 0 {
+		return nil, "", fmt.Errorf("unsupported KMSv2 wrapped key version %d: %w", blob.Version, errdefs.ErrProtocol)
+	}
+	if err := dc.GetLimits().CheckRecipients(len(blob.Recipients)); err != nil {
+		return nil, "", err
+	}
+
+	if dc.IDTokenSource != nil {
+		callCtx, cancel := context.WithTimeout(ctx, CallTimeout)
+		token, err := dc.IDTokenSource.Token(callCtx)
+		cancel()
+		if err != nil {
+			return nil, "", fmt.Errorf("could not get the ID token for the KMS plugins: %w", err)
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	}
+
+	var unreachableErr error
+	for _, endpoint := range endpoints {
+		for _, recipient := range blob.Recipients {
+			callCtx, cancel := context.WithTimeout(ctx, CallTimeout)
+			resp, err := decrypt(callCtx, endpoint, &kmsapi.DecryptRequest{
+				Ciphertext:  recipient.Ciphertext,
+				Uid:         newUID(),
+				KeyId:       recipient.KeyID,
+				Annotations: recipient.Annotations,
+			})
+			cancel()
+			if err == nil {
+				return resp.Plaintext, "kmsv2:" + recipient.KeyID, nil
+			}
+			log.L().Debug("KMS plugin could not decrypt the layer key", log.KeyProvider, endpoint, log.KeyKeyID, recipient.KeyID, log.KeyError, err)
+			if errors.Is(err, errdefs.ErrProviderUnreachable) {
+				unreachableErr = err
+				// the other key IDs will not fare better
+				break
+			}
+		}
+	}
+	if unreachableErr != nil {
+		return nil, "", fmt.Errorf("KMSv2: No KMS plugin could decrypt the layer key: %w", unreachableErr)
+	}
+	return nil, "", fmt.Errorf("KMSv2: No KMS plugin could decrypt the layer key: %w", errdefs.ErrNoDecryptionKey)
+}
+
+func (kw *kmsv2KeyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
+	return len(kw.GetPrivateKeys(dcparameters)) == 0
+}
+
+// GetPrivateKeys returns the endpoints of the KMS plugins since the keys
+// cannot leave the KMS
+func (kw *kmsv2KeyWrapper) GetPrivateKeys(dcparameters map[string][][]byte) [][]byte {
+	return dcparameters["kmsv2-endpoints"]
+}
+
+func (kw *kmsv2KeyWrapper) GetKeyIdsFromPacket(_ string) ([]uint64, error) {
+	return nil, nil
+}
+
+// GetRecipients returns the key IDs of the KMS keys the layer key is
+// encrypted with
+func (kw *kmsv2KeyWrapper) GetRecipients(b64blobs string) ([]string, error) {
+	var recipients []string
+	for _, b64blob := range strings.Split(b64blobs, ",") {
+		data, err := base64.StdEncoding.DecodeString(b64blob)
+		if err != nil {
+			return nil, fmt.Errorf("could not base64 decode the KMSv2 wrapped key: %w", errdefs.ErrProtocol)
+		}
+		var blob kmsv2Blob
+		if err := json.Unmarshal(data, &blob); err != nil {
+			return nil, fmt.Errorf("could not parse the KMSv2 wrapped key: %w", errdefs.ErrProtocol)
+		}
+		for _, recipient := range blob.Recipients {
+			recipients = append(recipients, "kmsv2:"+recipient.KeyID)
+		}
+	}
+	return recipients, nil
+}
+
+// parseEndpoints returns the paths of the unix sockets of KMS plugins given
+// like in the EncryptionConfiguration of Kubernetes, as unix:///path/to/socket;
+// duplicates are dropped
+func parseEndpoints(endpoints [][]byte) ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, endpoint := range endpoints {
+		path := strings.TrimPrefix(string(endpoint), "unix://")
+		if path == string(endpoint) || path == "" {
+			return nil, fmt.Errorf("KMS plugin endpoint %q is not of the form unix:///path/to/socket: %w", endpoint, errdefs.ErrConfiguration)
+		}
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// newUID returns an identifier for a request, which plugins use for their logs
+func newUID() string {
+	var uid [16]byte
+	if _, err := rand.Read(uid[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(uid[:])
+}
+
+func encrypt(ctx context.Context, path string, req *kmsapi.EncryptRequest) (*kmsapi.EncryptResponse, error) {
+	conn, err := unixgrpc.Dial(path)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	resp, err := kmsapi.NewKeyManagementServiceClient(conn).Encrypt(ctx, req)
+	if err != nil {
+		return nil, unixgrpc.Error(err, path, "Encrypt")
+	}
+	return resp, nil
+}
+
+func decrypt(ctx context.Context, path string, req *kmsapi.DecryptRequest) (*kmsapi.DecryptResponse, error) {
+	conn, err := unixgrpc.Dial(path)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	resp, err := kmsapi.NewKeyManagementServiceClient(conn).Decrypt(ctx, req)
+	if err != nil {
+		return nil, unixgrpc.Error(err, path, "Decrypt")
+	}
+	return resp, nil
+}
@@ -0,0 +1,194 @@
+//go:build go1.24
+// +build go1.24
+
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kmsv2
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/oidc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	kmsapi "k8s.io/kms/apis/v2"
+)
+
+// fakePlugin is a KMS v2 plugin that 'encrypts' by XORing with its key
+type fakePlugin struct {
+	kmsapi.UnimplementedKeyManagementServiceServer
+	keyID string
+	key   byte
+	// token is the ID token the plugin requires for decrypting
+	token string
+}
+
+func (p *fakePlugin) Encrypt(_ context.Context, req *kmsapi.EncryptRequest) (*kmsapi.EncryptResponse, error) {
+	return &kmsapi.EncryptResponse{
+		Ciphertext:  p.xor(req.Plaintext),
+		KeyId:       p.keyID,
+		Annotations: map[string][]byte{"version.example.com": []byte("1")},
+	}, nil
+}
+
+func (p *fakePlugin) Decrypt(ctx context.Context, req *kmsapi.DecryptRequest) (*kmsapi.DecryptResponse, error) {
+	if p.token != "" {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if auth := md.Get("authorization"); len(auth) != 1 || auth[0] != "Bearer "+p.token {
+			return nil, status.Error(codes.Unauthenticated, "missing ID token")
+		}
+	}
+	if req.KeyId != p.keyID || string(req.Annotations["version.example.com"]) != "1" {
+		return nil, status.Error(codes.FailedPrecondition, "unknown key")
+	}
+	return &kmsapi.DecryptResponse{Plaintext: p.xor(req.Ciphertext)}, nil
+}
+
+func (p *fakePlugin) xor(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i := range data {
+		out[i] = data[i] ^ p.key
+	}
+	return out
+}
+
+// startPlugin serves the plugin on a unix socket and returns its endpoint
+func startPlugin(t *testing.T, p *fakePlugin) []byte {
+	path := filepath.Join(t.TempDir(), "kms.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	kmsapi.RegisterKeyManagementServiceServer(server, p)
+	go func() { _ = server.Serve(l) }()
+	t.Cleanup(server.Stop)
+	return []byte("unix://" + path)
+}
+
+func TestKeyWrapKMSv2Success(t *testing.T) {
+	endpoint1 := startPlugin(t, &fakePlugin{keyID: "key-b", key: 0x5a})
+	endpoint2 := startPlugin(t, &fakePlugin{keyID: "key-a", key: 0xa5})
+	optsData := []byte(`{"cipher":"AES_256_CTR_HMAC_SHA256"}`)
+
+	kw := NewKeyWrapper()
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{"kmsv2-endpoints": {endpoint1, endpoint2, endpoint1}},
+	}
+	wrapped, err := kw.WrapKeys(ec, optsData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipients, err := kw.GetRecipients(base64.StdEncoding.EncodeToString(wrapped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 2 || recipients[0] != "kmsv2:key-a" || recipients[1] != "kmsv2:key-b" {
+		t.Fatalf("unexpected recipients %v", recipients)
+	}
+
+	for _, endpoint := range [][]byte{endpoint1, endpoint2} {
+		dc := &config.DecryptConfig{
+			Parameters: map[string][][]byte{"kmsv2-endpoints": {endpoint}},
+		}
+		plain, _, err := kw.(*kmsv2KeyWrapper).UnwrapKeyID(dc, wrapped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plain, optsData) {
+			t.Fatalf("unwrapped key %q does not match %q", plain, optsData)
+		}
+	}
+}
+
+func TestKeyWrapKMSv2Invalid(t *testing.T) {
+	endpoint := startPlugin(t, &fakePlugin{keyID: "key-a", key: 0x5a})
+	other := startPlugin(t, &fakePlugin{keyID: "key-b", key: 0xa5})
+
+	kw := NewKeyWrapper()
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{"kmsv2-endpoints": {endpoint}},
+	}
+	wrapped, err := kw.WrapKeys(ec, []byte("layer key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{"kmsv2-endpoints": {other}},
+	}
+	if _, err := kw.UnwrapKey(dc, wrapped); !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+		t.Fatalf("expected ErrNoDecryptionKey, got %v", err)
+	}
+
+	missing := []byte("unix://" + filepath.Join(t.TempDir(), "missing.sock"))
+	dc.Parameters["kmsv2-endpoints"] = [][]byte{missing}
+	if _, err := kw.UnwrapKey(dc, wrapped); !errors.Is(err, errdefs.ErrProviderUnreachable) {
+		t.Fatalf("expected ErrProviderUnreachable, got %v", err)
+	}
+	ec.Parameters["kmsv2-endpoints"] = [][]byte{missing}
+	if _, err := kw.WrapKeys(ec, []byte("layer key")); !errors.Is(err, errdefs.ErrProviderUnreachable) {
+		t.Fatalf("expected ErrProviderUnreachable, got %v", err)
+	}
+
+	ec.Parameters["kmsv2-endpoints"] = [][]byte{[]byte("/run/kms.sock")}
+	if _, err := kw.WrapKeys(ec, []byte("layer key")); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+}
+
+func TestKeyWrapKMSv2IDToken(t *testing.T) {
+	token := "eyJhbGciOiJub25lIn0.eyJzdWIiOiJjaS1qb2IifQ."
+	endpoint := startPlugin(t, &fakePlugin{keyID: "key-a", key: 0x5a, token: token})
+
+	kw := NewKeyWrapper()
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{"kmsv2-endpoints": {endpoint}},
+	}
+	wrapped, err := kw.WrapKeys(ec, []byte("layer key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{"kmsv2-endpoints": {endpoint}},
+	}
+	if _, err := kw.UnwrapKey(dc, wrapped); err == nil {
+		t.Fatal("unwrapping without ID token succeeded")
+	}
+
+	t.Setenv("OCICRYPT_TEST_ID_TOKEN", token)
+	dc.IDTokenSource = oidc.EnvTokenSource("OCICRYPT_TEST_ID_TOKEN")
+	plain, err := kw.UnwrapKey(dc, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != "layer key" {
+		t.Fatalf("unexpected unwrapped key %q", plain)
+	}
+}
@@ -25,14 +25,19 @@ import (
 	"io"
 	"io/ioutil"
 	"net/mail"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
 	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
 	"github.com/containers/ocicrypt/keywrap"
-	"github.com/pkg/errors"
-	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/packet"
+	"github.com/containers/ocicrypt/policy"
+	"github.com/containers/ocicrypt/utils"
 )
 
 type gpgKeyWrapper struct {
@@ -43,6 +48,10 @@ func NewKeyWrapper() keywrap.KeyWrapper {
 	return &gpgKeyWrapper{}
 }
 
+// errUnavailable is returned in FIPS 140-only mode since OpenPGP relies on
+// SHA-1 for key fingerprints
+var errUnavailable = fmt.Errorf("PGP is not available in FIPS 140-only mode: %w", errdefs.ErrDisallowedAlgorithm)
+
 var (
 	// GPGDefaultEncryptConfig is the default configuration for layer encryption/decryption
 	GPGDefaultEncryptConfig = &packet.Config{
@@ -61,21 +70,30 @@ func (kw *gpgKeyWrapper) GetAnnotationID() string {
 // WrapKeys wraps the session key for recpients and encrypts the optsData, which
 // describe the symmetric key used for encrypting the layer
 func (kw *gpgKeyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	if len(ec.Parameters["gpg-recipients"]) > 0 && fips.Enforced() {
+		return nil, errUnavailable
+	}
 	ciphertext := new(bytes.Buffer)
 	el, err := kw.createEntityList(ec)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to create entity list")
+		return nil, fmt.Errorf("unable to create entity list: %w", err)
 	}
 	if len(el) == 0 {
 		// nothing to do -- not an error
 		return nil, nil
 	}
 
+	encryptConfig := GPGDefaultEncryptConfig
+	if ec.Rand != nil {
+		cfg := *GPGDefaultEncryptConfig
+		cfg.Rand = ec.Rand
+		encryptConfig = &cfg
+	}
 	plaintextWriter, err := openpgp.Encrypt(ciphertext,
 		el,  /*EntityList*/
 		nil, /* Sign*/
 		nil, /* FileHint */
-		GPGDefaultEncryptConfig)
+		encryptConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -91,16 +109,31 @@ func (kw *gpgKeyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte) ([]
 // UnwrapKey unwraps the symmetric key with which the layer is encrypted
 // This symmetric key is encrypted in the PGP payload.
 func (kw *gpgKeyWrapper) UnwrapKey(dc *config.DecryptConfig, pgpPacket []byte) ([]byte, error) {
+	optsData, _, err := kw.UnwrapKeyID(dc, pgpPacket)
+	return optsData, err
+}
+
+// UnwrapKeyID unwraps the symmetric key with which the layer is encrypted and
+// returns the key ID of the PGP key that unwrapped it
+func (kw *gpgKeyWrapper) UnwrapKeyID(dc *config.DecryptConfig, pgpPacket []byte) ([]byte, string, error) {
 	pgpPrivateKeys, pgpPrivateKeysPwd, err := kw.getKeyParameters(dc.Parameters)
-	if err != nil {
-		return nil, err
+	if err != nil && dc.GPGDecrypter == nil {
+		return nil, "", err
+	}
+	if fips.Enforced() {
+		return nil, "", errUnavailable
+	}
+	// malformed packets are rejected when reading the message
+	if keyIDs, err := kw.getKeyIDs(pgpPacket); err == nil {
+		if err := dc.GetLimits().CheckRecipients(len(keyIDs)); err != nil {
+			return nil, "", err
+		}
 	}
 
 	for idx, pgpPrivateKey := range pgpPrivateKeys {
-		r := bytes.NewBuffer(pgpPrivateKey)
-		entityList, err := openpgp.ReadKeyRing(r)
+		entityList, err := utils.ReadGPGKeyRing(pgpPrivateKey)
 		if err != nil {
-			return nil, errors.Wrap(err, "unable to parse private keys")
+			return nil, "", fmt.Errorf("unable to parse private keys: %w", err)
 		}
 
 		var prompt openpgp.PromptFunction
@@ -120,19 +153,45 @@ func (kw *gpgKeyWrapper) UnwrapKey(dc *config.DecryptConfig, pgpPacket []byte) (
 			}
 		}
 
-		r = bytes.NewBuffer(pgpPacket)
+		r := bytes.NewBuffer(pgpPacket)
 		md, err := openpgp.ReadMessage(r, entityList, prompt, GPGDefaultEncryptConfig)
 		if err != nil {
 			continue
 		}
-		// we get the plain key options back
-		optsData, err := ioutil.ReadAll(md.UnverifiedBody)
+		// we get the plain key options back; the message may be compressed
+		// so we must not read more than we expect
+		optsData, err := ioutil.ReadAll(io.LimitReader(md.UnverifiedBody, keywrap.MaxOptsDataSize+1))
 		if err != nil {
 			continue
 		}
-		return optsData, nil
+		if len(optsData) > keywrap.MaxOptsDataSize {
+			return nil, "", fmt.Errorf("PGP: unwrapped key options are larger than the maximum of %d bytes: %w", keywrap.MaxOptsDataSize, errdefs.ErrLimitExceeded)
+		}
+		keyID := ""
+		if md.DecryptedWith.PublicKey != nil {
+			keyID = "0x" + strconv.FormatUint(md.DecryptedWith.PublicKey.KeyId, 16)
+		}
+		return optsData, keyID, nil
 	}
-	return nil, errors.New("PGP: No suitable key found to unwrap key")
+	if dc.GPGDecrypter != nil {
+		// the secret key may not be exportable, such as a key on an OpenPGP
+		// smartcard, so gpg-agent has to decrypt the message
+		optsData, keyid, err := dc.GPGDecrypter.DecryptGPGMessage(pgpPacket)
+		if err != nil {
+			return nil, "", fmt.Errorf("PGP: unable to unwrap key with gpg-agent: %w", err)
+		}
+		if len(optsData) > keywrap.MaxOptsDataSize {
+			return nil, "", fmt.Errorf("PGP: unwrapped key options are larger than the maximum of %d bytes: %w", keywrap.MaxOptsDataSize, errdefs.ErrLimitExceeded)
+		}
+		return optsData, "0x" + strconv.FormatUint(keyid, 16), nil
+	}
+	return nil, "", fmt.Errorf("PGP: No suitable key found to unwrap key: %w", errdefs.ErrNoDecryptionKey)
+}
+
+// SupportsGPGDecrypter returns true since the pgp keywrapper falls back to the
+// GPGDecrypter for keys that cannot be exported
+func (kw *gpgKeyWrapper) SupportsGPGDecrypter() bool {
+	return true
 }
 
 // GetKeyIdsFromWrappedKeys converts the base64 encoded PGPPacket to uint64 keyIds
@@ -142,7 +201,7 @@ func (kw *gpgKeyWrapper) GetKeyIdsFromPacket(b64pgpPackets string) ([]uint64, er
 	for _, b64pgpPacket := range strings.Split(b64pgpPackets, ",") {
 		pgpPacket, err := base64.StdEncoding.DecodeString(b64pgpPacket)
 		if err != nil {
-			return nil, errors.Wrapf(err, "could not decode base64 encoded PGP packet")
+			return nil, errdefs.WithCategory(errdefs.ErrProtocol, fmt.Errorf("could not decode base64 encoded PGP packet: %w", err))
 		}
 		newids, err := kw.getKeyIDs(pgpPacket)
 		if err != nil {
@@ -166,12 +225,12 @@ ParsePackets:
 			break ParsePackets
 		}
 		if err != nil {
-			return []uint64{}, errors.Wrapf(err, "packets.Next() failed")
+			return []uint64{}, errdefs.WithCategory(errdefs.ErrProtocol, fmt.Errorf("packets.Next() failed: %w", err))
 		}
 		switch p := p.(type) {
 		case *packet.EncryptedKey:
 			keyids = append(keyids, p.KeyId)
-		case *packet.SymmetricallyEncrypted:
+		case *packet.SymmetricallyEncrypted, *packet.AEADEncrypted:
 			break ParsePackets
 		}
 	}
@@ -203,7 +262,7 @@ func (kw *gpgKeyWrapper) getKeyParameters(dcparameters map[string][][]byte) ([][
 
 	privKeys := kw.GetPrivateKeys(dcparameters)
 	if len(privKeys) == 0 {
-		return nil, nil, errors.New("GPG: Missing private key parameter")
+		return nil, nil, fmt.Errorf("GPG: Missing private key parameter: %w", errdefs.ErrNoDecryptionKey)
 	}
 
 	return privKeys, dcparameters["gpg-privatekeys-passwords"], nil
@@ -216,9 +275,7 @@ func (kw *gpgKeyWrapper) createEntityList(ec *config.EncryptConfig) (openpgp.Ent
 	if len(pgpPubringFile) == 0 {
 		return nil, nil
 	}
-	r := bytes.NewReader(pgpPubringFile[0])
-
-	entityList, err := openpgp.ReadKeyRing(r)
+	entityList, err := utils.ReadGPGKeyRing(pgpPubringFile[0])
 	if err != nil {
 		return nil, err
 	}
@@ -235,6 +292,7 @@ func (kw *gpgKeyWrapper) createEntityList(ec *config.EncryptConfig) (openpgp.Ent
 
 	var filteredList openpgp.EntityList
 	for _, entity := range entityList {
+		added := false
 		for k := range entity.Identities {
 			addr, err := mail.ParseAddress(k)
 			if err != nil {
@@ -243,12 +301,22 @@ func (kw *gpgKeyWrapper) createEntityList(ec *config.EncryptConfig) (openpgp.Ent
 			for _, r := range gpgRecipients {
 				recp := string(r)
 				if strings.Compare(addr.Name, recp) == 0 || strings.Compare(addr.Address, recp) == 0 {
-					filteredList = append(filteredList, entity)
+					// wrap the layer key only once for a key with several
+					// matching identities
+					if !added {
+						filteredList = append(filteredList, entity)
+						added = true
+					}
 					rSet[recp] = rSet[recp] + 1
 				}
 			}
 		}
 	}
+	// the order of the recipients in the message does not depend on the
+	// order of the keys in the keyring
+	sort.SliceStable(filteredList, func(i, j int) bool {
+		return filteredList[i].PrimaryKey.KeyId < filteredList[j].PrimaryKey.KeyId
+	})
 
 	// make sure we found keys for all the Recipients...
 	var buffer bytes.Buffer
@@ -266,8 +334,101 @@ func (kw *gpgKeyWrapper) createEntityList(ec *config.EncryptConfig) (openpgp.Ent
 	}
 
 	if notFound {
-		return nil, errors.New(buffer.String())
+		return nil, fmt.Errorf("%s: %w", buffer.String(), errdefs.ErrKeyMaterial)
+	}
+
+	filteredList, err = selectSubkeys(filteredList, ec.Parameters["gpg-subkeys"], time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entity := range filteredList {
+		if err := checkKeys(ec.GetPolicy(), entity); err != nil {
+			return nil, err
+		}
 	}
 
 	return filteredList, nil
 }
+
+// selectSubkeys restricts the entities to the encryption subkeys with the
+// given fingerprints, so that openpgp.Encrypt wraps the layer key for them
+// rather than for the newest valid encryption subkey, and checks that every
+// entity has a valid encryption key
+func selectSubkeys(entities openpgp.EntityList, fingerprints [][]byte, now time.Time) (openpgp.EntityList, error) {
+	selected := make(map[string]bool)
+	for _, fingerprint := range fingerprints {
+		fpr := strings.ToUpper(strings.Replace(strings.TrimPrefix(string(fingerprint), "0x"), " ", "", -1))
+		selected[fpr] = false
+	}
+
+	var result openpgp.EntityList
+	for _, entity := range entities {
+		keyName := fmt.Sprintf("0x%X", entity.PrimaryKey.KeyId)
+		var restricted openpgp.EntityList
+		if fpr := fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint); hasKey(selected, fpr) {
+			selected[fpr] = true
+			e := *entity
+			e.Subkeys = nil
+			restricted = append(restricted, &e)
+		}
+		for _, subkey := range entity.Subkeys {
+			fpr := fmt.Sprintf("%X", subkey.PublicKey.Fingerprint)
+			if !hasKey(selected, fpr) {
+				continue
+			}
+			selected[fpr] = true
+			switch {
+			case !subkey.Sig.FlagsValid || !subkey.Sig.FlagEncryptCommunications || !subkey.PublicKey.PubKeyAlgo.CanEncrypt():
+				return nil, fmt.Errorf("PGP: subkey %s of key %s is not an encryption key: %w", fpr, keyName, errdefs.ErrKeyMaterial)
+			case subkey.Revoked(now):
+				return nil, fmt.Errorf("PGP: subkey %s of key %s is revoked: %w", fpr, keyName, errdefs.ErrKeyMaterial)
+			case subkey.PublicKey.KeyExpired(subkey.Sig, now) || subkey.Sig.SigExpired(now):
+				return nil, fmt.Errorf("PGP: subkey %s of key %s has expired: %w", fpr, keyName, errdefs.ErrKeyMaterial)
+			}
+			e := *entity
+			e.Subkeys = []openpgp.Subkey{subkey}
+			restricted = append(restricted, &e)
+		}
+
+		if restricted == nil {
+			restricted = openpgp.EntityList{entity}
+		}
+		for _, e := range restricted {
+			if _, ok := e.EncryptionKey(now); !ok {
+				return nil, fmt.Errorf("PGP: key %s has no valid encryption key, it may have expired or be revoked: %w", keyName, errdefs.ErrKeyMaterial)
+			}
+		}
+		result = append(result, restricted...)
+	}
+
+	for fpr, found := range selected {
+		if !found {
+			return nil, fmt.Errorf("PGP: no key of the recipients has the fingerprint %s: %w", fpr, errdefs.ErrKeyMaterial)
+		}
+	}
+	return result, nil
+}
+
+func hasKey(m map[string]bool, key string) bool {
+	_, ok := m[key]
+	return ok
+}
+
+// checkKeys checks the strength of the keys of an entity that can be used for
+// encryption against the policy
+func checkKeys(p *policy.Policy, entity *openpgp.Entity) error {
+	if entity.PrimaryKey.PubKeyAlgo.CanEncrypt() {
+		if err := p.CheckKey("PGP", entity.PrimaryKey.PublicKey); err != nil {
+			return err
+		}
+	}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PublicKey.PubKeyAlgo.CanEncrypt() {
+			if err := p.CheckKey("PGP", subkey.PublicKey.PublicKey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
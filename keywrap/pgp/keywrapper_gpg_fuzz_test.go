@@ -0,0 +1,39 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pgp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzGetKeyIDs(f *testing.F) {
+	// packets with lengths far beyond the data and many empty packets
+	f.Add([]byte{0xc1, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0x84, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0xc1, 0xe0, 0x00})
+	f.Add(bytes.Repeat([]byte{0xc1, 0x00}, 10000))
+	f.Add(bytes.Repeat([]byte{0xc8, 0x01, 0x01}, 10000))
+
+	kw := &gpgKeyWrapper{}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = kw.getKeyIDs(data)
+	})
+}
@@ -17,9 +17,22 @@
 package pgp
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
 	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/keywrap"
+	"github.com/containers/ocicrypt/utils"
 )
 
 var validGpgCcs = []*config.CryptoConfig{
@@ -144,6 +157,8 @@ var invalidGpgCcs = []*config.CryptoConfig{
 }
 
 func TestKeyWrapGpgSuccess(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the pgp scheme")
+
 	for _, cc := range validGpgCcs {
 		kw := NewKeyWrapper()
 
@@ -188,3 +203,248 @@ func TestKeyWrapGpgInvalid(t *testing.T) {
 		t.Fatal("Successfully wrap for invalid crypto config")
 	}
 }
+
+func TestKeyWrapGpgCanonical(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the pgp scheme")
+
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+
+	var keyIDs [][]uint64
+	for _, recipients := range [][][]byte{
+		{gpgRecipient1, gpgRecipient2},
+		{gpgRecipient2, gpgRecipient1, gpgRecipient2},
+	} {
+		ec := &config.EncryptConfig{
+			Parameters: map[string][][]byte{
+				"gpg-pubkeyringfile": {gpgPubKeyRing},
+				"gpg-recipients":     recipients,
+			},
+		}
+		wk, err := kw.WrapKeys(ec, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := kw.(*gpgKeyWrapper).getKeyIDs(wk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 2 {
+			t.Fatalf("Expected two key IDs, got %x", ids)
+		}
+		keyIDs = append(keyIDs, ids)
+	}
+	if !reflect.DeepEqual(keyIDs[0], keyIDs[1]) {
+		t.Fatalf("Expected the same order of recipients, got %x and %x", keyIDs[0], keyIDs[1])
+	}
+}
+
+func armorKey(t *testing.T, blockType string, serialize func(w *bytes.Buffer) error) []byte {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, blockType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key bytes.Buffer
+	if err := serialize(&key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(key.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestKeyWrapGpgArmoredCurve25519(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the pgp scheme")
+
+	entity, err := openpgp.NewEntity("testkey", "", "testkey@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKeyRing := armorKey(t, openpgp.PublicKeyType, func(w *bytes.Buffer) error {
+		return entity.Serialize(w)
+	})
+	// a second armored block in the same key ring
+	pubKeyRing = append(pubKeyRing, armorKey(t, openpgp.PublicKeyType, func(w *bytes.Buffer) error {
+		_, err := w.Write(gpgPubKeyRing)
+		return err
+	})...)
+	privKey := armorKey(t, openpgp.PrivateKeyType, func(w *bytes.Buffer) error {
+		return entity.SerializePrivate(w, nil)
+	})
+
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"gpg-pubkeyringfile": {pubKeyRing},
+			"gpg-recipients":     {[]byte("testkey@example.com"), gpgRecipient1},
+		},
+	}
+	wk, err := kw.WrapKeys(ec, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"gpg-privatekeys": {privKey},
+		},
+	}
+	ud, keyID, err := kw.(*gpgKeyWrapper).UnwrapKeyID(dc, wk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(ud) {
+		t.Fatal("Strings don't match")
+	}
+	if keyID != "0x"+strconv.FormatUint(entity.Subkeys[0].PublicKey.KeyId, 16) {
+		t.Fatalf("Unexpected key ID %s", keyID)
+	}
+}
+
+// testGPGDecrypter decrypts like gpg-agent would with a key it does not export
+type testGPGDecrypter struct {
+	keyRing []byte
+}
+
+func (d *testGPGDecrypter) DecryptGPGMessage(message []byte) ([]byte, uint64, error) {
+	entityList, err := openpgp.ReadKeyRing(bytes.NewReader(d.keyRing))
+	if err != nil {
+		return nil, 0, err
+	}
+	md, err := openpgp.ReadMessage(bytes.NewReader(message), entityList, nil, nil)
+	if err != nil {
+		return nil, 0, errdefs.WithCategory(errdefs.ErrNoDecryptionKey, err)
+	}
+	plaintext, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, 0, err
+	}
+	return plaintext, md.DecryptedWith.PublicKey.KeyId, nil
+}
+
+func TestKeyWrapGpgDecrypter(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the pgp scheme")
+
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"gpg-pubkeyringfile": {gpgPubKeyRing},
+			"gpg-recipients":     {gpgRecipient1},
+		},
+	}
+	wk, err := kw.WrapKeys(ec, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyIDs, err := kw.(*gpgKeyWrapper).getKeyIDs(wk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the private key of another recipient does not stop the GPGDecrypter
+	// from being asked
+	for _, parameters := range []map[string][][]byte{
+		{},
+		{"gpg-privatekeys": {gpgPrivKey2}},
+	} {
+		dc := &config.DecryptConfig{
+			Parameters:   parameters,
+			GPGDecrypter: &testGPGDecrypter{keyRing: gpgPrivKey1},
+		}
+		ud, keyID, err := kw.(keywrap.KeyIDUnwrapper).UnwrapKeyID(dc, wk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(ud) != string(data) {
+			t.Fatal("Strings don't match")
+		}
+		if keyID != "0x"+strconv.FormatUint(keyIDs[0], 16) {
+			t.Fatalf("Unexpected key ID %s", keyID)
+		}
+	}
+
+	dc := &config.DecryptConfig{
+		GPGDecrypter: &testGPGDecrypter{keyRing: gpgPrivKey2},
+	}
+	if _, err := kw.UnwrapKey(dc, wk); !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+		t.Fatalf("Expected ErrNoDecryptionKey, got %v", err)
+	}
+}
+
+func TestKeyWrapGpgSubkeys(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the pgp scheme")
+
+	created := time.Now().Add(-3 * time.Hour)
+	cfg := &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA, Time: func() time.Time { return created }}
+	entity, err := openpgp.NewEntity("testkey", "", "testkey@example.com", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a newer encryption subkey, which is chosen unless another one is
+	// selected, a signing subkey and an expired encryption subkey
+	cfg.Time = func() time.Time { return created.Add(time.Hour) }
+	if err := entity.AddEncryptionSubkey(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.AddSigningSubkey(cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.KeyLifetimeSecs = 60
+	if err := entity.AddEncryptionSubkey(cfg); err != nil {
+		t.Fatal(err)
+	}
+	var pubKeyRing bytes.Buffer
+	if err := entity.Serialize(&pubKeyRing); err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := func(i int) []byte {
+		return []byte(fmt.Sprintf("%x", entity.Subkeys[i].PublicKey.Fingerprint))
+	}
+
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+	for _, tc := range []struct {
+		subkeys [][]byte
+		keyIDs  []uint64
+		err     bool
+	}{
+		{nil, []uint64{entity.Subkeys[1].PublicKey.KeyId}, false},
+		{[][]byte{fingerprint(0)}, []uint64{entity.Subkeys[0].PublicKey.KeyId}, false},
+		{[][]byte{append([]byte("0x"), bytes.ToUpper(fingerprint(0))...)}, []uint64{entity.Subkeys[0].PublicKey.KeyId}, false},
+		{[][]byte{fingerprint(2)}, nil, true},
+		{[][]byte{fingerprint(3)}, nil, true},
+		{[][]byte{[]byte("0123456789abcdef0123456789abcdef01234567")}, nil, true},
+	} {
+		ec := &config.EncryptConfig{
+			Parameters: map[string][][]byte{
+				"gpg-pubkeyringfile": {pubKeyRing.Bytes()},
+				"gpg-recipients":     {[]byte("testkey@example.com")},
+				"gpg-subkeys":        tc.subkeys,
+			},
+		}
+		wk, err := kw.WrapKeys(ec, data)
+		if tc.err {
+			if !errors.Is(err, errdefs.ErrKeyMaterial) {
+				t.Fatalf("Expected ErrKeyMaterial for subkeys %s, got %v", tc.subkeys, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyIDs, err := kw.(*gpgKeyWrapper).getKeyIDs(wk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keyIDs, tc.keyIDs) {
+			t.Fatalf("Expected key IDs %x for subkeys %s, got %x", tc.keyIDs, tc.subkeys, keyIDs)
+		}
+	}
+}
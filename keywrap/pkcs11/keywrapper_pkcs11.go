@@ -17,12 +17,21 @@
 package pkcs11
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
 	"github.com/containers/ocicrypt/config"
 	"github.com/containers/ocicrypt/crypto/pkcs11"
+	"github.com/containers/ocicrypt/errdefs"
 	"github.com/containers/ocicrypt/keywrap"
+	"github.com/containers/ocicrypt/policy"
 	"github.com/containers/ocicrypt/utils"
-
-	"github.com/pkg/errors"
+	pkcs11uri "github.com/stefanberger/go-pkcs11uri"
 )
 
 type pkcs11KeyWrapper struct {
@@ -40,7 +49,7 @@ func NewKeyWrapper() keywrap.KeyWrapper {
 // WrapKeys wraps the session key for recpients and encrypts the optsData, which
 // describe the symmetric key used for encrypting the layer
 func (kw *pkcs11KeyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
-	pkcs11Recipients, err := addPubKeys(&ec.DecryptConfig, append(ec.Parameters["pkcs11-pubkeys"], ec.Parameters["pkcs11-yamls"]...))
+	pkcs11Recipients, err := addPubKeys(ec.GetPolicy(), &ec.DecryptConfig, append(ec.Parameters["pkcs11-pubkeys"], ec.Parameters["pkcs11-yamls"]...))
 	if err != nil {
 		return nil, err
 	}
@@ -51,28 +60,36 @@ func (kw *pkcs11KeyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte)
 
 	jsonString, err := pkcs11.EncryptMultiple(pkcs11Recipients, optsData)
 	if err != nil {
-		return nil, errors.Wrapf(err, "PKCS11 EncryptMulitple failed")
+		return nil, fmt.Errorf("PKCS11 EncryptMulitple failed: %w", err)
 	}
 	return jsonString, nil
 }
 
 func (kw *pkcs11KeyWrapper) UnwrapKey(dc *config.DecryptConfig, jsonString []byte) ([]byte, error) {
+	optsData, _, err := kw.UnwrapKeyID(dc, jsonString)
+	return optsData, err
+}
+
+// UnwrapKeyID unwraps the symmetric key with which the layer is encrypted and
+// returns the pkcs11 URI of the private key that unwrapped it
+func (kw *pkcs11KeyWrapper) UnwrapKeyID(dc *config.DecryptConfig, jsonString []byte) ([]byte, string, error) {
 	var pkcs11PrivKeys []*pkcs11.Pkcs11KeyFileObject
 
 	privKeys := kw.GetPrivateKeys(dc.Parameters)
 	if len(privKeys) == 0 {
-		return nil, errors.New("No private keys found for PKCS11 decryption")
+		return nil, "", fmt.Errorf("No private keys found for PKCS11 decryption: %w", errdefs.ErrNoDecryptionKey)
 	}
 
 	p11conf, err := p11confFromParameters(dc.Parameters)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
+	setMaxSessions(p11conf)
 
 	for _, privKey := range privKeys {
 		key, err := utils.ParsePrivateKey(privKey, nil, "PKCS11")
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		switch pkcs11PrivKey := key.(type) {
 		case *pkcs11.Pkcs11KeyFileObject:
@@ -86,12 +103,12 @@ func (kw *pkcs11KeyWrapper) UnwrapKey(dc *config.DecryptConfig, jsonString []byt
 		}
 	}
 
-	plaintext, err := pkcs11.Decrypt(pkcs11PrivKeys, jsonString)
+	plaintext, privKeyObj, err := pkcs11.DecryptWithKey(pkcs11PrivKeys, jsonString)
 	if err == nil {
-		return plaintext, nil
+		return plaintext, keyIDFromURI(privKeyObj.Uri), nil
 	}
 
-	return nil, errors.Wrapf(err, "PKCS11: No suitable private key found for decryption")
+	return nil, "", fmt.Errorf("PKCS11: No suitable private key found for decryption: %w", err)
 }
 
 func (kw *pkcs11KeyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
@@ -110,7 +127,26 @@ func (kw *pkcs11KeyWrapper) GetRecipients(_ string) ([]string, error) {
 	return []string{"[pkcs11]"}, nil
 }
 
-func addPubKeys(dc *config.DecryptConfig, pubKeys [][]byte) ([]interface{}, error) {
+// CountRecipients returns the number of recipients of the PKCS11 blobs
+func (kw *pkcs11KeyWrapper) CountRecipients(b64blobs string) (int, error) {
+	n := 0
+	for _, b64blob := range strings.Split(b64blobs, ",") {
+		data, err := base64.StdEncoding.DecodeString(b64blob)
+		if err != nil {
+			return 0, fmt.Errorf("could not base64 decode the PKCS11 wrapped key: %w", errdefs.ErrProtocol)
+		}
+		var blob struct {
+			Recipients []json.RawMessage `json:"recipients"`
+		}
+		if err := json.Unmarshal(data, &blob); err != nil {
+			return 0, fmt.Errorf("could not parse the PKCS11 wrapped key: %w", errdefs.ErrProtocol)
+		}
+		n += len(blob.Recipients)
+	}
+	return n, nil
+}
+
+func addPubKeys(p *policy.Policy, dc *config.DecryptConfig, pubKeys [][]byte) ([]interface{}, error) {
 	var pkcs11Keys []interface{}
 
 	if len(pubKeys) == 0 {
@@ -121,18 +157,31 @@ func addPubKeys(dc *config.DecryptConfig, pubKeys [][]byte) ([]interface{}, erro
 	if err != nil {
 		return nil, err
 	}
+	setMaxSessions(p11conf)
 
 	for _, pubKey := range pubKeys {
 		key, err := utils.ParsePublicKey(pubKey, "PKCS11")
 		if err != nil {
 			return nil, err
 		}
+		if err := p.CheckKey("PKCS11", key); err != nil {
+			return nil, err
+		}
 		switch pkcs11PubKey := key.(type) {
 		case *pkcs11.Pkcs11KeyFileObject:
 			if p11conf != nil {
 				pkcs11PubKey.Uri.SetModuleDirectories(p11conf.ModuleDirectories)
 				pkcs11PubKey.Uri.SetAllowedModulePaths(p11conf.AllowedModulePaths)
 			}
+		case *rsa.PublicKey:
+		case *ecdsa.PublicKey:
+			switch pkcs11PubKey.Curve {
+			case elliptic.P256(), elliptic.P384(), elliptic.P521():
+			default:
+				return nil, fmt.Errorf("PKCS11: EC keys on curve %s cannot be used for encryption: %w", pkcs11PubKey.Curve.Params().Name, errdefs.ErrUnsupportedKey)
+			}
+		default:
+			return nil, fmt.Errorf("PKCS11: %s keys cannot be used for encryption, only RSA and EC keys are supported: %w", utils.KeyType(key), errdefs.ErrUnsupportedKey)
 		}
 		pkcs11Keys = append(pkcs11Keys, key)
 	}
@@ -145,3 +194,32 @@ func p11confFromParameters(dcparameters map[string][][]byte) (*pkcs11.Pkcs11Conf
 	}
 	return nil, nil
 }
+
+// setMaxSessions applies the maximum number of pkcs11 sessions if the pkcs11
+// configuration sets it
+func setMaxSessions(p11conf *pkcs11.Pkcs11Config) {
+	if p11conf != nil && p11conf.MaxSessions > 0 {
+		pkcs11.SetMaxSessions(p11conf.MaxSessions)
+	}
+}
+
+// keyIDAttributes are the path attributes of a pkcs11 URI (RFC 7512) that
+// identify a key
+var keyIDAttributes = []string{
+	"library-manufacturer", "library-description", "library-version",
+	"slot-manufacturer", "slot-description", "slot-id",
+	"manufacturer", "model", "serial", "token",
+	"type", "object", "id",
+}
+
+// keyIDFromURI returns the path attributes of the pkcs11 URI of a key as its
+// key ID; the query attributes, which may hold the PIN, are left out
+func keyIDFromURI(uri *pkcs11uri.Pkcs11URI) string {
+	var attrs []string
+	for _, name := range keyIDAttributes {
+		if value, ok := uri.GetPathAttribute(name, true); ok {
+			attrs = append(attrs, name+"="+value)
+		}
+	}
+	return "pkcs11:" + strings.Join(attrs, ";")
+}
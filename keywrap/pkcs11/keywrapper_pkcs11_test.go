@@ -25,6 +25,7 @@ import (
 	"github.com/containers/ocicrypt/utils"
 	"github.com/containers/ocicrypt/crypto/pkcs11"
 	"github.com/containers/ocicrypt/utils/softhsm"
+	pkcs11uri "github.com/stefanberger/go-pkcs11uri"
 )
 
 var (
@@ -215,3 +216,13 @@ func TestKeyWrapPkcs11Invalid(t *testing.T) {
 		t.Fatal("Successfully wrapped and unwrapped with invalid crypto config")
 	}
 }
+
+func TestKeyIDFromURI(t *testing.T) {
+	uri := pkcs11uri.New()
+	if err := uri.Parse("pkcs11:object=my%20key;token=test;id=%01?pin-value=1234&module-name=softhsm2"); err != nil {
+		t.Fatal(err)
+	}
+	if keyID := keyIDFromURI(uri); keyID != "pkcs11:token=test;object=my%20key;id=%01" {
+		t.Fatalf("Unexpected key ID %q", keyID)
+	}
+}
@@ -0,0 +1,540 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs7
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+
+	josecipher "gopkg.in/square/go-jose.v2/cipher"
+)
+
+// CMS authenticated enveloped data (RFC 5083) with AES-GCM content encryption
+// (RFC 5084), RSA-OAEP key transport (RFC 8017, RFC 4055) and ECDH key
+// agreement with the X9.63 KDF and AES key wrap (RFC 5753), none of which are
+// implemented by go.mozilla.org/pkcs7
+
+var (
+	oidAuthEnvelopedData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 23}
+	oidData                       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidAES128GCM                  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 6}
+	oidAES192GCM                  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 26}
+	oidAES256GCM                  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 46}
+	oidAES128Wrap                 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 5}
+	oidAES192Wrap                 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 25}
+	oidAES256Wrap                 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 45}
+	oidRSAESOAEP                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 7}
+	oidMGF1                       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+	oidSHA1                       = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256                     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384                     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512                     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidECPublicKey                = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidDHSinglePassStdDHSHA1KDF   = asn1.ObjectIdentifier{1, 3, 133, 16, 840, 63, 0, 2}
+	oidDHSinglePassStdDHSHA224KDF = asn1.ObjectIdentifier{1, 3, 132, 1, 11, 0}
+	oidDHSinglePassStdDHSHA256KDF = asn1.ObjectIdentifier{1, 3, 132, 1, 11, 1}
+	oidDHSinglePassStdDHSHA384KDF = asn1.ObjectIdentifier{1, 3, 132, 1, 11, 2}
+	oidDHSinglePassStdDHSHA512KDF = asn1.ObjectIdentifier{1, 3, 132, 1, 11, 3}
+)
+
+// kdfHashes maps the ECDH key agreement schemes to the hashes of their KDFs;
+// OpenSSL uses the one with SHA-1 by default
+var kdfHashes = map[string]crypto.Hash{
+	oidDHSinglePassStdDHSHA1KDF.String():   crypto.SHA1,
+	oidDHSinglePassStdDHSHA224KDF.String(): crypto.SHA224,
+	oidDHSinglePassStdDHSHA256KDF.String(): crypto.SHA256,
+	oidDHSinglePassStdDHSHA384KDF.String(): crypto.SHA384,
+	oidDHSinglePassStdDHSHA512KDF.String(): crypto.SHA512,
+}
+
+// cmsContentKeyLengths maps the AES-GCM content encryption algorithms to the
+// lengths of their keys
+var cmsContentKeyLengths = map[string]int{
+	oidAES128GCM.String(): 16,
+	oidAES192GCM.String(): 24,
+	oidAES256GCM.String(): 32,
+}
+
+// cmsHashes maps the hash algorithms usable with RSA-OAEP to their hashes
+var cmsHashes = map[string]crypto.Hash{
+	oidSHA1.String():   crypto.SHA1,
+	oidSHA256.String(): crypto.SHA256,
+	oidSHA384.String(): crypto.SHA384,
+	oidSHA512.String(): crypto.SHA512,
+}
+
+type authEnvelopedData struct {
+	Version                  int
+	RecipientInfos           []asn1.RawValue `asn1:"set"`
+	AuthEncryptedContentInfo encryptedContentInfo
+	MAC                      []byte
+}
+
+type gcmParameters struct {
+	Nonce  []byte
+	ICVLen int `asn1:"optional,default:12"`
+}
+
+type rsaesOAEPParams struct {
+	HashAlgorithm    pkix.AlgorithmIdentifier `asn1:"optional,explicit,tag:0"`
+	MaskGenAlgorithm pkix.AlgorithmIdentifier `asn1:"optional,explicit,tag:1"`
+}
+
+type keyAgreeRecipientInfo struct {
+	Version                int
+	Originator             asn1.RawValue
+	UKM                    []byte `asn1:"optional,explicit,tag:1"`
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	RecipientEncryptedKeys []recipientEncryptedKey
+}
+
+type originatorPublicKey struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+type recipientEncryptedKey struct {
+	Rid          issuerAndSerial
+	EncryptedKey []byte
+}
+
+type eccCMSSharedInfo struct {
+	KeyInfo     pkix.AlgorithmIdentifier
+	EntityUInfo []byte `asn1:"optional,explicit,tag:0"`
+	SuppPubInfo []byte `asn1:"explicit,tag:2"`
+}
+
+// isCMS returns true if the DER encoded packet holds CMS authenticated
+// enveloped data
+func isCMS(packet []byte) bool {
+	var info contentInfo
+	_, err := asn1.Unmarshal(packet, &info)
+	return err == nil && info.ContentType.Equal(oidAuthEnvelopedData)
+}
+
+// encryptCMS encrypts the data with AES-256-GCM for the recipients with the
+// given certificates, using RSA-OAEP with SHA-256 for RSA keys and ECDH for
+// EC keys; all randomness is read from rand, though Go ignores it for the
+// ephemeral ECDH keys
+func encryptCMS(rand io.Reader, data []byte, certs []*x509.Certificate) ([]byte, error) {
+	cek := make([]byte, 32)
+	if _, err := io.ReadFull(rand, cek); err != nil {
+		return nil, fmt.Errorf("could not generate the content encryption key: %w", err)
+	}
+
+	var recipientInfos []asn1.RawValue
+	for _, cert := range certs {
+		var (
+			ri  []byte
+			err error
+		)
+		switch pub := cert.PublicKey.(type) {
+		case *rsa.PublicKey:
+			ri, err = newKeyTransRecipientInfo(rand, cert, pub, cek)
+		case *ecdsa.PublicKey:
+			ri, err = newKeyAgreeRecipientInfo(rand, cert, pub, cek)
+		default:
+			err = fmt.Errorf("unsupported key type %T", pub)
+		}
+		if err != nil {
+			return nil, err
+		}
+		recipientInfos = append(recipientInfos, asn1.RawValue{FullBytes: ri})
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand, nonce); err != nil {
+		return nil, fmt.Errorf("could not generate the nonce: %w", err)
+	}
+	params, err := asn1.Marshal(gcmParameters{Nonce: nonce, ICVLen: aead.Overhead()})
+	if err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nil, nonce, data, nil)
+	ciphertext, tag := sealed[:len(data)], sealed[len(data):]
+
+	content, err := asn1.Marshal(authEnvelopedData{
+		Version:        0,
+		RecipientInfos: recipientInfos,
+		AuthEncryptedContentInfo: encryptedContentInfo{
+			ContentType: oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{
+				Algorithm:  oidAES256GCM,
+				Parameters: asn1.RawValue{FullBytes: params},
+			},
+			EncryptedContent: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: ciphertext},
+		},
+		MAC: tag,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: oidAuthEnvelopedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content},
+	})
+}
+
+func newIssuerAndSerial(cert *x509.Certificate) issuerAndSerial {
+	return issuerAndSerial{
+		IssuerName:   asn1.RawValue{FullBytes: cert.RawIssuer},
+		SerialNumber: cert.SerialNumber,
+	}
+}
+
+// newKeyTransRecipientInfo encrypts the content encryption key with RSA-OAEP
+// using SHA-256
+func newKeyTransRecipientInfo(rand io.Reader, cert *x509.Certificate, pub *rsa.PublicKey, cek []byte) ([]byte, error) {
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand, pub, cek, nil)
+	if err != nil {
+		return nil, err
+	}
+	sha256ID := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	mgfParams, err := asn1.Marshal(sha256ID)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(rsaesOAEPParams{
+		HashAlgorithm:    sha256ID,
+		MaskGenAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidMGF1, Parameters: asn1.RawValue{FullBytes: mgfParams}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(recipientInfo{
+		Version:                0,
+		IssuerAndSerialNumber:  newIssuerAndSerial(cert),
+		KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAESOAEP, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedKey:           encryptedKey,
+	})
+}
+
+// newKeyAgreeRecipientInfo wraps the content encryption key with AES-256 key
+// wrap using a key agreed with an ephemeral ECDH key
+func newKeyAgreeRecipientInfo(rand io.Reader, cert *x509.Certificate, pub *ecdsa.PublicKey, cek []byte) ([]byte, error) {
+	eph, err := ecdsa.GenerateKey(pub.Curve, rand)
+	if err != nil {
+		return nil, err
+	}
+	wrapAlg := pkix.AlgorithmIdentifier{Algorithm: oidAES256Wrap}
+	kek, err := deriveKEK(crypto.SHA256, pub.Curve, eph.D, pub.X, pub.Y, wrapAlg, nil)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	encryptedKey, err := josecipher.KeyWrap(block, cek)
+	if err != nil {
+		return nil, err
+	}
+
+	originator, err := asn1.MarshalWithParams(originatorPublicKey{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidECPublicKey},
+		PublicKey: asn1.BitString{Bytes: elliptic.Marshal(pub.Curve, eph.X, eph.Y), BitLength: 8 * len(elliptic.Marshal(pub.Curve, eph.X, eph.Y))},
+	}, "tag:1")
+	if err != nil {
+		return nil, err
+	}
+	wrapAlgDER, err := asn1.Marshal(wrapAlg)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.MarshalWithParams(keyAgreeRecipientInfo{
+		Version:    3,
+		Originator: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: originator},
+		KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidDHSinglePassStdDHSHA256KDF,
+			Parameters: asn1.RawValue{FullBytes: wrapAlgDER},
+		},
+		RecipientEncryptedKeys: []recipientEncryptedKey{{
+			Rid:          newIssuerAndSerial(cert),
+			EncryptedKey: encryptedKey,
+		}},
+	}, "tag:1")
+}
+
+// deriveKEK derives the key encryption key from the ECDH shared secret with
+// the X9.63 KDF as specified by RFC 5753
+func deriveKEK(kdfHash crypto.Hash, curve elliptic.Curve, priv, x, y *big.Int, wrapAlg pkix.AlgorithmIdentifier, ukm []byte) ([]byte, error) {
+	var kekSize int
+	switch {
+	case wrapAlg.Algorithm.Equal(oidAES128Wrap):
+		kekSize = 16
+	case wrapAlg.Algorithm.Equal(oidAES192Wrap):
+		kekSize = 24
+	case wrapAlg.Algorithm.Equal(oidAES256Wrap):
+		kekSize = 32
+	default:
+		return nil, fmt.Errorf("unsupported key wrap algorithm %s", wrapAlg.Algorithm)
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("invalid EC public key")
+	}
+	zx, _ := curve.ScalarMult(x, y, priv.Bytes())
+	z := zx.FillBytes(make([]byte, (curve.Params().BitSize+7)/8))
+
+	suppPubInfo := make([]byte, 4)
+	binary.BigEndian.PutUint32(suppPubInfo, uint32(kekSize*8))
+	sharedInfo, err := asn1.Marshal(eccCMSSharedInfo{
+		KeyInfo:     pkix.AlgorithmIdentifier{Algorithm: wrapAlg.Algorithm},
+		EntityUInfo: ukm,
+		SuppPubInfo: suppPubInfo,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var kek []byte
+	for counter := uint32(1); len(kek) < kekSize; counter++ {
+		h := newHash(kdfHash)
+		h.Write(z)
+		_ = binary.Write(h, binary.BigEndian, counter)
+		h.Write(sharedInfo)
+		kek = h.Sum(kek)
+	}
+	return kek[:kekSize], nil
+}
+
+// newHash returns a new hash without relying on the registration of the
+// hash functions by their packages
+func newHash(h crypto.Hash) hash.Hash {
+	switch h {
+	case crypto.SHA1:
+		return sha1.New()
+	case crypto.SHA224:
+		return sha256.New224()
+	case crypto.SHA256:
+		return sha256.New()
+	case crypto.SHA384:
+		return sha512.New384()
+	}
+	return sha512.New()
+}
+
+// cmsRecipientKey is the encrypted content encryption key of a recipient of
+// CMS authenticated enveloped data
+type cmsRecipientKey struct {
+	rid          issuerAndSerial
+	encryptedKey []byte
+	// oaepHash is the hash of RSA-OAEP key transport
+	oaepHash crypto.Hash
+	// originator and wrapAlg are set for ECDH key agreement
+	originator *originatorPublicKey
+	kdfHash    crypto.Hash
+	wrapAlg    pkix.AlgorithmIdentifier
+	ukm        []byte
+}
+
+// parseCMS parses DER encoded CMS authenticated enveloped data and returns the
+// keys of its recipients
+func parseCMS(packet []byte) (*authEnvelopedData, []cmsRecipientKey, error) {
+	var info contentInfo
+	if _, err := asn1.Unmarshal(packet, &info); err != nil {
+		return nil, nil, err
+	}
+	if !info.ContentType.Equal(oidAuthEnvelopedData) {
+		return nil, nil, fmt.Errorf("not an authenticated enveloped data packet: %s", info.ContentType)
+	}
+	var aed authEnvelopedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &aed); err != nil {
+		return nil, nil, err
+	}
+
+	var keys []cmsRecipientKey
+	for _, raw := range aed.RecipientInfos {
+		switch {
+		case raw.Class == asn1.ClassUniversal && raw.Tag == asn1.TagSequence:
+			var ri recipientInfo
+			if _, err := asn1.Unmarshal(raw.FullBytes, &ri); err != nil {
+				// recipients identified by a subject key identifier
+				continue
+			}
+			if !ri.KeyEncryptionAlgorithm.Algorithm.Equal(oidRSAESOAEP) {
+				continue
+			}
+			var params rsaesOAEPParams
+			if len(ri.KeyEncryptionAlgorithm.Parameters.FullBytes) > 0 {
+				if _, err := asn1.Unmarshal(ri.KeyEncryptionAlgorithm.Parameters.FullBytes, &params); err != nil {
+					return nil, nil, err
+				}
+			}
+			oaepHash := crypto.SHA1
+			if len(params.HashAlgorithm.Algorithm) > 0 {
+				var ok bool
+				if oaepHash, ok = cmsHashes[params.HashAlgorithm.Algorithm.String()]; !ok {
+					continue
+				}
+			}
+			keys = append(keys, cmsRecipientKey{rid: ri.IssuerAndSerialNumber, encryptedKey: ri.EncryptedKey, oaepHash: oaepHash})
+		case raw.Class == asn1.ClassContextSpecific && raw.Tag == 1:
+			var kari keyAgreeRecipientInfo
+			if _, err := asn1.UnmarshalWithParams(raw.FullBytes, &kari, "tag:1"); err != nil {
+				continue
+			}
+			kdfHash, ok := kdfHashes[kari.KeyEncryptionAlgorithm.Algorithm.String()]
+			if !ok {
+				continue
+			}
+			var originator originatorPublicKey
+			if _, err := asn1.UnmarshalWithParams(kari.Originator.Bytes, &originator, "tag:1"); err != nil {
+				continue
+			}
+			var wrapAlg pkix.AlgorithmIdentifier
+			if _, err := asn1.Unmarshal(kari.KeyEncryptionAlgorithm.Parameters.FullBytes, &wrapAlg); err != nil {
+				return nil, nil, err
+			}
+			for _, rek := range kari.RecipientEncryptedKeys {
+				keys = append(keys, cmsRecipientKey{rid: rek.Rid, encryptedKey: rek.EncryptedKey, originator: &originator, kdfHash: kdfHash, wrapAlg: wrapAlg, ukm: kari.UKM})
+			}
+		}
+	}
+	return &aed, keys, nil
+}
+
+// matches returns true if the recipient key is meant for the certificate
+func (k *cmsRecipientKey) matches(cert *x509.Certificate) bool {
+	return bytes.Equal(k.rid.IssuerName.FullBytes, cert.RawIssuer) && k.rid.SerialNumber.Cmp(cert.SerialNumber) == 0
+}
+
+// decryptCMS decrypts DER encoded CMS authenticated enveloped data for the
+// recipient with the given certificate using an RSA or EC private key or a
+// crypto.Decrypter holding an RSA key; it also returns the recipient key that
+// was used
+func decryptCMS(packet []byte, cert *x509.Certificate, key interface{}) ([]byte, *cmsRecipientKey, error) {
+	aed, keys, err := parseCMS(packet)
+	if err != nil {
+		return nil, nil, err
+	}
+	eci := aed.AuthEncryptedContentInfo
+	cekLen, ok := cmsContentKeyLengths[eci.ContentEncryptionAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported content encryption algorithm %s", eci.ContentEncryptionAlgorithm.Algorithm)
+	}
+
+	for i := range keys {
+		k := &keys[i]
+		if !k.matches(cert) {
+			continue
+		}
+		cek, err := k.decryptKey(key)
+		if err != nil || len(cek) != cekLen {
+			continue
+		}
+		plain, err := openCMSContent(aed, cek)
+		if err != nil {
+			return nil, nil, err
+		}
+		return plain, k, nil
+	}
+	return nil, nil, errors.New("no enveloped recipient for provided certificate and key")
+}
+
+// decryptKey decrypts the content encryption key
+func (k *cmsRecipientKey) decryptKey(key interface{}) ([]byte, error) {
+	if k.originator == nil {
+		switch priv := key.(type) {
+		case *rsa.PrivateKey:
+			return rsa.DecryptOAEP(newHash(k.oaepHash), rand.Reader, priv, k.encryptedKey, nil)
+		case crypto.Decrypter:
+			if _, ok := priv.Public().(*rsa.PublicKey); ok {
+				return priv.Decrypt(rand.Reader, k.encryptedKey, &rsa.OAEPOptions{Hash: k.oaepHash})
+			}
+		}
+		return nil, errors.New("RSA-OAEP requires an RSA private key")
+	}
+
+	priv, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("ECDH requires an EC private key")
+	}
+	x, y := elliptic.Unmarshal(priv.Curve, k.originator.PublicKey.Bytes)
+	if x == nil {
+		return nil, errors.New("invalid originator public key")
+	}
+	kek, err := deriveKEK(k.kdfHash, priv.Curve, priv.D, x, y, k.wrapAlg, k.ukm)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return josecipher.KeyUnwrap(block, k.encryptedKey)
+}
+
+// openCMSContent decrypts and authenticates the content with AES-GCM
+func openCMSContent(aed *authEnvelopedData, cek []byte) ([]byte, error) {
+	eci := aed.AuthEncryptedContentInfo
+	var params gcmParameters
+	if _, err := asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if len(params.Nonce) != 12 || params.ICVLen != len(aed.MAC) {
+		return nil, errors.New("invalid AES-GCM parameters")
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCMWithTagSize(block, params.ICVLen)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := append(append([]byte{}, eci.EncryptedContent.Bytes...), aed.MAC...)
+	return aead.Open(nil, params.Nonce, ciphertext, nil)
+}
+
+// getCMSRecipients returns the issuer and serial number of the certificates
+// of the recipients of DER encoded CMS authenticated enveloped data
+func getCMSRecipients(packet []byte) ([]issuerAndSerial, error) {
+	_, keys, err := parseCMS(packet)
+	if err != nil {
+		return nil, err
+	}
+	var rids []issuerAndSerial
+	for _, k := range keys {
+		rids = append(rids, k.rid)
+	}
+	return rids, nil
+}
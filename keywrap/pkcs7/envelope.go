@@ -0,0 +1,191 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package pkcs7
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// The ASN.1 structures below mirror those of go.mozilla.org/pkcs7, which does
+// not export them
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []recipientInfo `asn1:"set"`
+	EncryptedContentInfo asn1.RawValue
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo asn1.RawValue
+}
+
+type recipientInfo struct {
+	Version                int
+	IssuerAndSerialNumber  issuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type issuerAndSerial struct {
+	IssuerName   asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"tag:0,optional"`
+}
+
+// parseEnvelopedData parses a DER encoded PKCS7 enveloped data packet
+func parseEnvelopedData(pkcs7Packet []byte) (*envelopedData, error) {
+	var info contentInfo
+	if _, err := asn1.Unmarshal(pkcs7Packet, &info); err != nil {
+		return nil, err
+	}
+	if !info.ContentType.Equal(pkcs7.OIDEnvelopedData) {
+		return nil, fmt.Errorf("not an enveloped data packet: %s", info.ContentType)
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &ed); err != nil {
+		return nil, err
+	}
+	return &ed, nil
+}
+
+// getContentEncryptionAlgorithm returns the content encryption algorithm of a
+// DER encoded PKCS7 enveloped data packet
+func getContentEncryptionAlgorithm(pkcs7Packet []byte) (asn1.ObjectIdentifier, error) {
+	ed, err := parseEnvelopedData(pkcs7Packet)
+	if err != nil {
+		return nil, err
+	}
+	var eci encryptedContentInfo
+	if _, err := asn1.Unmarshal(ed.EncryptedContentInfo.FullBytes, &eci); err != nil {
+		return nil, err
+	}
+	return eci.ContentEncryptionAlgorithm.Algorithm, nil
+}
+
+// decryptWithDecrypter decrypts a DER encoded PKCS7 enveloped data packet for
+// the recipient with the given certificate, whose RSA private key is held by
+// the given crypto.Decrypter
+func decryptWithDecrypter(pkcs7Packet []byte, cert *x509.Certificate, decrypter crypto.Decrypter) ([]byte, error) {
+	ed, err := parseEnvelopedData(pkcs7Packet)
+	if err != nil {
+		return nil, err
+	}
+
+	var encryptedKey []byte
+	for _, ri := range ed.RecipientInfos {
+		if bytes.Equal(ri.IssuerAndSerialNumber.IssuerName.FullBytes, cert.RawIssuer) &&
+			ri.IssuerAndSerialNumber.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			encryptedKey = ri.EncryptedKey
+			break
+		}
+	}
+	if encryptedKey == nil {
+		return nil, errors.New("no enveloped recipient for provided certificate")
+	}
+
+	contentKey, err := decrypter.Decrypt(rand.Reader, encryptedKey, &rsa.PKCS1v15DecryptOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// go.mozilla.org/pkcs7 decrypts the content of an encrypted data packet
+	// given its key, so we wrap the encrypted content into one
+	content, err := asn1.Marshal(encryptedData{
+		Version:              0,
+		EncryptedContentInfo: ed.EncryptedContentInfo,
+	})
+	if err != nil {
+		return nil, err
+	}
+	packet, err := asn1.Marshal(contentInfo{
+		ContentType: pkcs7.OIDEncryptedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content},
+	})
+	if err != nil {
+		return nil, err
+	}
+	p7, err := pkcs7.Parse(packet)
+	if err != nil {
+		return nil, err
+	}
+	return p7.DecryptUsingPSK(contentKey)
+}
+
+// publicKeyMatches returns true if the certificate holds the RSA public key
+// of the crypto.Decrypter
+func publicKeyMatches(cert *x509.Certificate, decrypter crypto.Decrypter) bool {
+	certKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return false
+	}
+	key, ok := decrypter.Public().(*rsa.PublicKey)
+	return ok && key.N.Cmp(certKey.N) == 0 && key.E == certKey.E
+}
+
+// getRecipients returns the issuer and serial number of the certificates of
+// the recipients of a DER encoded PKCS7 enveloped data packet or CMS
+// authenticated enveloped data
+func getRecipients(pkcs7Packet []byte) ([]string, error) {
+	var rids []issuerAndSerial
+	if isCMS(pkcs7Packet) {
+		var err error
+		if rids, err = getCMSRecipients(pkcs7Packet); err != nil {
+			return nil, err
+		}
+	} else {
+		ed, err := parseEnvelopedData(pkcs7Packet)
+		if err != nil {
+			return nil, err
+		}
+		for _, ri := range ed.RecipientInfos {
+			rids = append(rids, ri.IssuerAndSerialNumber)
+		}
+	}
+	var recipients []string
+	for _, rid := range rids {
+		var issuer pkix.RDNSequence
+		if _, err := asn1.Unmarshal(rid.IssuerName.FullBytes, &issuer); err != nil {
+			return nil, err
+		}
+		var name pkix.Name
+		name.FillFromRDNSequence(&issuer)
+		recipients = append(recipients, fmt.Sprintf("pkcs7:serial=%x,issuer=%s", rid.SerialNumber, name.String()))
+	}
+	return recipients, nil
+}
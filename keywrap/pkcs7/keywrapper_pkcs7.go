@@ -17,19 +17,39 @@
 package pkcs7
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
 	"github.com/containers/ocicrypt/keywrap"
+	"github.com/containers/ocicrypt/policy"
 	"github.com/containers/ocicrypt/utils"
-	"github.com/pkg/errors"
 	"go.mozilla.org/pkcs7"
 )
 
 type pkcs7KeyWrapper struct {
 }
 
+// errUnavailable is returned in FIPS 140-only mode since go.mozilla.org/pkcs7
+// only supports RSA PKCS#1 v1.5 key transport and CMS uses AES-GCM with
+// nonces that are not generated by the FIPS module
+var errUnavailable = fmt.Errorf("PKCS7 is not available in FIPS 140-only mode: %w", errdefs.ErrDisallowedAlgorithm)
+
+// encryptLock serializes the use of pkcs7.ContentEncryptionAlgorithm, which
+// go.mozilla.org/pkcs7 only offers as a global variable
+var encryptLock sync.Mutex
+
 // NewKeyWrapper returns a new key wrapping interface using jwe
 func NewKeyWrapper() keywrap.KeyWrapper {
 	return &pkcs7KeyWrapper{}
@@ -50,11 +70,119 @@ func (kw *pkcs7KeyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte) (
 	if len(x509Certs) == 0 {
 		return nil, nil
 	}
+	if fips.Enforced() {
+		return nil, errUnavailable
+	}
+	cms, err := useCMS(ec.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyX509s(ec.Parameters); err != nil {
+		return nil, err
+	}
+	for _, x509Cert := range x509Certs {
+		if err := checkRecipientKey(x509Cert, cms); err != nil {
+			return nil, err
+		}
+		if err := ec.GetPolicy().CheckKey("PKCS7", x509Cert.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+	x509Certs = canonicalX509s(x509Certs)
 
+	if cms {
+		return encryptCMS(ec.GetRand(), optsData, x509Certs)
+	}
+
+	encryptLock.Lock()
+	defer encryptLock.Unlock()
 	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES128GCM
 	return pkcs7.Encrypt(optsData, x509Certs)
 }
 
+// useCMS returns true if the pkcs7-mode parameter selects CMS authenticated
+// enveloped data instead of the legacy PKCS7 enveloped data
+func useCMS(params map[string][][]byte) (bool, error) {
+	switch values := params["pkcs7-mode"]; len(values) {
+	case 0:
+		return false, nil
+	case 1:
+		switch string(values[0]) {
+		case "legacy":
+			return false, nil
+		case "cms":
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("PKCS7: pkcs7-mode must be either \"legacy\" or \"cms\": %w", errdefs.ErrConfiguration)
+}
+
+// verifyX509s verifies the certificates of the recipients against the CAs of
+// the x509-roots parameter, if given, unless the x509-skip-verify parameter
+// is set. The intermediate certificates are taken from the bundles of the
+// x509s parameter.
+func verifyX509s(params map[string][][]byte) error {
+	if len(params["x509-roots"]) == 0 || len(params["x509-skip-verify"]) > 0 {
+		return nil
+	}
+	roots := x509.NewCertPool()
+	for _, root := range params["x509-roots"] {
+		certs, err := utils.ParseCertificates(root, "PKCS7")
+		if err != nil {
+			return err
+		}
+		for _, cert := range certs {
+			roots.AddCert(cert)
+		}
+	}
+	for _, x509s := range params["x509s"] {
+		certs, err := utils.ParseCertificates(x509s, "PKCS7")
+		if err != nil {
+			return err
+		}
+		leaf, rest := utils.SelectLeaf(certs)
+		intermediates := x509.NewCertPool()
+		for _, cert := range rest {
+			intermediates.AddCert(cert)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			return fmt.Errorf("PKCS7: certificate %q: %v: %w", leaf.Subject, err, errdefs.ErrUntrustedCertificate)
+		}
+		// certificates without the key usage extension may be used for
+		// anything
+		usage := x509.KeyUsageKeyEncipherment
+		if _, ok := leaf.PublicKey.(*ecdsa.PublicKey); ok {
+			usage = x509.KeyUsageKeyAgreement
+		}
+		if leaf.KeyUsage != 0 && leaf.KeyUsage&usage == 0 {
+			return fmt.Errorf("PKCS7: certificate %q may not be used for key encipherment or key agreement: %w", leaf.Subject, errdefs.ErrUntrustedCertificate)
+		}
+	}
+	return nil
+}
+
+// checkRecipientKey checks that the key of the certificate can be used for
+// encryption; go.mozilla.org/pkcs7 only implements RSA key transport, while
+// CMS also supports ECDH with the NIST curves
+func checkRecipientKey(x509Cert *x509.Certificate, cms bool) error {
+	switch k := x509Cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return nil
+	case *ecdsa.PublicKey:
+		if cms {
+			switch k.Curve {
+			case elliptic.P256(), elliptic.P384(), elliptic.P521():
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("PKCS7: certificates with %s keys cannot be used for encryption: %w", utils.KeyType(x509Cert.PublicKey), errdefs.ErrUnsupportedKey)
+}
+
 func collectX509s(x509s [][]byte) ([]*x509.Certificate, error) {
 	if len(x509s) == 0 {
 		return nil, nil
@@ -70,6 +198,30 @@ func collectX509s(x509s [][]byte) ([]*x509.Certificate, error) {
 	return x509Certs, nil
 }
 
+// canonicalX509s sorts the certificates of the recipients and drops duplicates
+// so that the order of the recipients in the envelope does not depend on the
+// order in which they were passed
+func canonicalX509s(x509Certs []*x509.Certificate) []*x509.Certificate {
+	sorted := make([]*x509.Certificate, len(x509Certs))
+	copy(sorted, x509Certs)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Raw, sorted[j].Raw) < 0
+	})
+	var res []*x509.Certificate
+	for i, x509Cert := range sorted {
+		if i == 0 || !bytes.Equal(x509Cert.Raw, sorted[i-1].Raw) {
+			res = append(res, x509Cert)
+		}
+	}
+	return res
+}
+
+// SupportsDecrypters returns true since RSA keys held by crypto.Decrypters
+// can be used for unwrapping
+func (kw *pkcs7KeyWrapper) SupportsDecrypters() bool {
+	return true
+}
+
 func (kw *pkcs7KeyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
 	return len(kw.GetPrivateKeys(dcparameters)) == 0
 }
@@ -85,42 +237,167 @@ func (kw *pkcs7KeyWrapper) getPrivateKeysPasswords(dcparameters map[string][][]b
 // UnwrapKey unwraps the symmetric key with which the layer is encrypted
 // This symmetric key is encrypted in the PKCS7 payload.
 func (kw *pkcs7KeyWrapper) UnwrapKey(dc *config.DecryptConfig, pkcs7Packet []byte) ([]byte, error) {
+	optsData, _, err := kw.UnwrapKeyID(dc, pkcs7Packet)
+	return optsData, err
+}
+
+// UnwrapKeyID unwraps the symmetric key with which the layer is encrypted and
+// returns the KeyID of the private key that unwrapped it
+func (kw *pkcs7KeyWrapper) UnwrapKeyID(dc *config.DecryptConfig, pkcs7Packet []byte) ([]byte, string, error) {
 	privKeys := kw.GetPrivateKeys(dc.Parameters)
-	if len(privKeys) == 0 {
-		return nil, errors.New("no private keys found for PKCS7 decryption")
+	if len(privKeys) == 0 && len(dc.Decrypters) == 0 {
+		return nil, "", fmt.Errorf("no private keys found for PKCS7 decryption: %w", errdefs.ErrNoDecryptionKey)
 	}
 	privKeysPasswords := kw.getPrivateKeysPasswords(dc.Parameters)
 	if len(privKeysPasswords) != len(privKeys) {
-		return nil, errors.New("private key password array length must be same as that of private keys")
+		return nil, "", fmt.Errorf("private key password array length must be same as that of private keys: %w", errdefs.ErrConfiguration)
 	}
 
 	x509Certs, err := collectX509s(dc.Parameters["x509s"])
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	// PKCS#12 bundles hold the certificate along with the private key
+	for idx, privKey := range privKeys {
+		if utils.IsPKCS12(privKey) {
+			_, certs, err := utils.ParsePKCS12(privKey, privKeysPasswords[idx], "PKCS7")
+			if err != nil {
+				return nil, "", err
+			}
+			x509Certs = append(x509Certs, certs...)
+		}
 	}
 	if len(x509Certs) == 0 {
-		return nil, errors.New("no x509 certificates found needed for PKCS7 decryption")
+		return nil, "", fmt.Errorf("no x509 certificates found needed for PKCS7 decryption: %w", errdefs.ErrConfiguration)
+	}
+
+	if fips.Enforced() {
+		return nil, "", errUnavailable
+	}
+
+	if isCMS(pkcs7Packet) {
+		return unwrapCMS(dc, pkcs7Packet, privKeys, privKeysPasswords, x509Certs)
 	}
 
 	p7, err := pkcs7.Parse(pkcs7Packet)
 	if err != nil {
-		return nil, errors.Wrapf(err, "could not parse PKCS7 packet")
+		return nil, "", errdefs.WithCategory(errdefs.ErrProtocol, fmt.Errorf("could not parse PKCS7 packet: %w", err))
+	}
+	if err := checkPolicy(dc.GetPolicy(), pkcs7Packet); err != nil {
+		return nil, "", err
 	}
 
 	for idx, privKey := range privKeys {
 		key, err := utils.ParsePrivateKey(privKey, privKeysPasswords[idx], "PKCS7")
 		if err != nil {
-			return nil, err
+			return nil, "", err
+		}
+		if dc.GetPolicy().CheckKeysOnUnwrap {
+			if err := dc.GetPolicy().CheckKey("PKCS7", key); err != nil {
+				return nil, "", err
+			}
 		}
 		for _, x509Cert := range x509Certs {
 			optsData, err := p7.Decrypt(x509Cert, crypto.PrivateKey(key))
 			if err != nil {
 				continue
 			}
-			return optsData, nil
+			return optsData, utils.KeyID(key), nil
+		}
+	}
+	for _, decrypter := range dc.Decrypters {
+		if dc.GetPolicy().CheckKeysOnUnwrap {
+			if err := dc.GetPolicy().CheckKey("PKCS7", decrypter.Public()); err != nil {
+				return nil, "", err
+			}
+		}
+		for _, x509Cert := range x509Certs {
+			if !publicKeyMatches(x509Cert, decrypter) {
+				continue
+			}
+			optsData, err := decryptWithDecrypter(pkcs7Packet, x509Cert, decrypter)
+			if err != nil {
+				continue
+			}
+			return optsData, utils.KeyID(decrypter), nil
+		}
+	}
+	return nil, "", fmt.Errorf("PKCS7: No suitable private key found for decryption: %w", errdefs.ErrNoDecryptionKey)
+}
+
+// unwrapCMS unwraps the symmetric key from CMS authenticated enveloped data
+func unwrapCMS(dc *config.DecryptConfig, packet []byte, privKeys, privKeysPasswords [][]byte, x509Certs []*x509.Certificate) ([]byte, string, error) {
+	if _, _, err := parseCMS(packet); err != nil {
+		return nil, "", errdefs.WithCategory(errdefs.ErrProtocol, fmt.Errorf("could not parse CMS packet: %w", err))
+	}
+
+	keys := make([]interface{}, 0, len(privKeys)+len(dc.Decrypters))
+	for idx, privKey := range privKeys {
+		key, err := utils.ParsePrivateKey(privKey, privKeysPasswords[idx], "PKCS7")
+		if err != nil {
+			return nil, "", err
+		}
+		keys = append(keys, key)
+	}
+	for _, decrypter := range dc.Decrypters {
+		keys = append(keys, decrypter)
+	}
+
+	var policyErr error
+	for _, key := range keys {
+		if dc.GetPolicy().CheckKeysOnUnwrap {
+			pubKey := key
+			if decrypter, ok := key.(crypto.Decrypter); ok {
+				pubKey = decrypter.Public()
+			}
+			if err := dc.GetPolicy().CheckKey("PKCS7", pubKey); err != nil {
+				return nil, "", err
+			}
+		}
+		for _, x509Cert := range x509Certs {
+			if utils.KeyID(x509Cert.PublicKey) != utils.KeyID(key) {
+				continue
+			}
+			optsData, rk, err := decryptCMS(packet, x509Cert, key)
+			if err != nil {
+				continue
+			}
+			if rk.originator == nil && rk.oaepHash == crypto.SHA1 {
+				if err := dc.GetPolicy().Check("PKCS7", policy.RSAOAEPSHA1); err != nil {
+					policyErr = err
+					continue
+				}
+			}
+			return optsData, utils.KeyID(key), nil
 		}
 	}
-	return nil, errors.New("PKCS7: No suitable private key found for decryption")
+	if policyErr != nil {
+		return nil, "", policyErr
+	}
+	return nil, "", fmt.Errorf("PKCS7: No suitable private key found for decryption: %w", errdefs.ErrNoDecryptionKey)
+}
+
+// checkPolicy checks the algorithms used by a PKCS7 packet against the policy;
+// go.mozilla.org/pkcs7 only supports RSA PKCS#1 v1.5 key transport
+func checkPolicy(p *policy.Policy, pkcs7Packet []byte) error {
+	if err := p.Check("PKCS7", policy.RSAPKCS1v15); err != nil {
+		return err
+	}
+	if p.Allows(policy.DES) && p.Allows(policy.TripleDES) {
+		return nil
+	}
+
+	alg, err := getContentEncryptionAlgorithm(pkcs7Packet)
+	if err != nil {
+		return errdefs.WithCategory(errdefs.ErrProtocol, fmt.Errorf("could not determine PKCS7 content encryption algorithm: %w", err))
+	}
+	switch {
+	case alg.Equal(pkcs7.OIDEncryptionAlgorithmDESCBC):
+		return p.Check("PKCS7", policy.DES)
+	case alg.Equal(pkcs7.OIDEncryptionAlgorithmDESEDE3CBC):
+		return p.Check("PKCS7", policy.TripleDES)
+	}
+	return nil
 }
 
 // GetKeyIdsFromWrappedKeys converts the base64 encoded Packet to uint64 keyIds;
@@ -129,8 +406,21 @@ func (kw *pkcs7KeyWrapper) GetKeyIdsFromPacket(b64pkcs7Packets string) ([]uint64
 	return nil, nil
 }
 
-// GetRecipients converts the wrappedKeys to an array of recipients
-// We cannot do this with pkcs7
+// GetRecipients returns the serial number and issuer of the certificates the
+// layer key is wrapped for; the envelopes do not carry the certificates, so
+// their subjects are unknown
 func (kw *pkcs7KeyWrapper) GetRecipients(b64pkcs7Packets string) ([]string, error) {
-	return []string{"[pkcs7]"}, nil
+	var recipients []string
+	for _, b64pkcs7Packet := range strings.Split(b64pkcs7Packets, ",") {
+		pkcs7Packet, err := base64.StdEncoding.DecodeString(b64pkcs7Packet)
+		if err != nil {
+			return nil, fmt.Errorf("could not base64 decode the PKCS7 packet: %w", errdefs.ErrProtocol)
+		}
+		r, err := getRecipients(pkcs7Packet)
+		if err != nil {
+			return nil, errdefs.WithCategory(errdefs.ErrProtocol, fmt.Errorf("could not parse PKCS7 packet: %w", err))
+		}
+		recipients = append(recipients, r...)
+	}
+	return recipients, nil
 }
@@ -17,11 +17,25 @@
 package pkcs7
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/elliptic"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
 	"testing"
+	"time"
 
 	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/policy"
 	"github.com/containers/ocicrypt/utils"
+	"go.mozilla.org/pkcs7"
+	gopkcs12 "software.sslmate.com/src/go-pkcs12"
 )
 
 var oneEmpty []byte
@@ -198,6 +212,8 @@ func createInvalidPkcs7Ccs() ([]*config.CryptoConfig, error) {
 }
 
 func TestKeyWrapPkcs7Success(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the pkcs7 scheme")
+
 	validPkcs7Ccs, err := createValidPkcs7Ccs()
 	if err != nil {
 		t.Fatal(err)
@@ -252,3 +268,574 @@ func TestKeyWrapPkcs7Invalid(t *testing.T) {
 		t.Fatal("Successfully wrap for invalid crypto config")
 	}
 }
+
+func TestKeyWrapPkcs7Policy(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the pkcs7 scheme")
+
+	pkcs7ClientCert, pkcs7ClientPrivKey, _, _, err := createKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("This is some secret text")
+
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmDESCBC
+	wkDES, err := pkcs7.Encrypt(data, []*x509.Certificate{pkcs7ClientCert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kw := NewKeyWrapper()
+	wkAES, err := kw.WrapKeys(&config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"x509s": {pkcs7ClientCert.Raw},
+		},
+	}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {pkcs7ClientPrivKey},
+			"privkeys-passwords": {oneEmpty},
+			"x509s":              {pkcs7ClientCert.Raw},
+		},
+		Policy: policy.Strict(),
+	}
+	if _, err := kw.UnwrapKey(dc, wkAES); !errors.Is(err, errdefs.ErrDisallowedAlgorithm) {
+		t.Fatalf("Expected PKCS#1 v1.5 to be rejected, got %v", err)
+	}
+
+	dc.Policy.AllowedLegacyAlgorithms = []policy.Algorithm{policy.RSAPKCS1v15}
+	if _, err := kw.UnwrapKey(dc, wkDES); !errors.Is(err, errdefs.ErrDisallowedAlgorithm) {
+		t.Fatalf("Expected DES to be rejected, got %v", err)
+	}
+	ud, err := kw.UnwrapKey(dc, wkAES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(ud) {
+		t.Fatal("Strings don't match")
+	}
+
+	dc.Policy = nil
+	ud, err = kw.UnwrapKey(dc, wkDES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(ud) {
+		t.Fatal("Strings don't match")
+	}
+}
+
+// opaqueKey hides the type of the private key behind crypto.Decrypter
+type opaqueKey struct {
+	crypto.Decrypter
+}
+
+func TestKeyWrapPkcs7Decrypter(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the pkcs7 scheme")
+
+	caKey, caCert, err := utils.CreateTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := utils.CreateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := utils.CertifyKey(pubKey, nil, caKey, caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := utils.CreateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPubKey, err := x509.MarshalPKIXPublicKey(&otherKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert, err := utils.CertifyKey(otherPubKey, nil, caKey, caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+
+	for _, alg := range []int{pkcs7.EncryptionAlgorithmAES128GCM, pkcs7.EncryptionAlgorithmAES256CBC} {
+		pkcs7.ContentEncryptionAlgorithm = alg
+		wk, err := pkcs7.Encrypt(data, []*x509.Certificate{cert})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dc := &config.DecryptConfig{
+			Parameters: map[string][][]byte{
+				"x509s": {cert.Raw, otherCert.Raw},
+			},
+			Decrypters: []crypto.Decrypter{opaqueKey{otherKey}},
+		}
+		if _, err := kw.UnwrapKey(dc, wk); !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+			t.Fatalf("Expected no suitable key error, got %v", err)
+		}
+
+		dc.Decrypters = append(dc.Decrypters, opaqueKey{key})
+		ud, err := kw.UnwrapKey(dc, wk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(ud) {
+			t.Fatal("Strings don't match")
+		}
+	}
+}
+
+func TestCanonicalX509s(t *testing.T) {
+	cert1, _, cert2, _, err := createKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := canonicalX509s([]*x509.Certificate{cert1, cert2})
+	second := canonicalX509s([]*x509.Certificate{cert2, cert1, cert2})
+	if len(first) != 2 || len(second) != 2 {
+		t.Fatalf("Expected 2 certificates, got %d and %d", len(first), len(second))
+	}
+	for i := range first {
+		if !first[i].Equal(second[i]) {
+			t.Fatal("Expected the same order of certificates")
+		}
+	}
+}
+
+func TestKeyWrapPkcs7GetRecipients(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the pkcs7 scheme")
+
+	cert1, _, cert2, _, err := createKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kw := NewKeyWrapper()
+	wk, err := kw.WrapKeys(&config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"x509s": {cert1.Raw, cert2.Raw},
+		},
+	}, []byte("This is some secret text"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipients, err := kw.GetRecipients(base64.StdEncoding.EncodeToString(wk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 2 {
+		t.Fatalf("Expected 2 recipients, got %v", recipients)
+	}
+	// both certificates have serial number 1 and are issued by the same CA
+	for _, recipient := range recipients {
+		if recipient != fmt.Sprintf("pkcs7:serial=%x,issuer=%s", cert1.SerialNumber, cert1.Issuer) {
+			t.Fatalf("Unexpected recipient %s", recipient)
+		}
+	}
+}
+
+func TestKeyWrapPkcs7ECDSA(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the pkcs7 scheme")
+
+	caKey, caCert, err := utils.CreateTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, _, err := utils.CreateECDSATestKey(elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := utils.CertifyKey(pubKey, nil, caKey, caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewKeyWrapper().WrapKeys(&config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"x509s": {cert.Raw},
+		},
+	}, []byte("This is some secret text"))
+	if !errors.Is(err, errdefs.ErrUnsupportedKey) {
+		t.Fatalf("Expected ErrUnsupportedKey, got %v", err)
+	}
+}
+
+// pkcs12Bundle is an RSA key with its certificate, issued by a test CA, as
+// exported by 'openssl pkcs12 -export -legacy' with password "password"
+const pkcs12Bundle = "" +
+	"MIIJ+QIBAzCCCb8GCSqGSIb3DQEHAaCCCbAEggmsMIIJqDCCBF8GCSqGSIb3DQEHBqCCBFAwggRM" +
+	"AgEAMIIERQYJKoZIhvcNAQcBMBwGCiqGSIb3DQEMAQYwDgQIp/qet2kiUdgCAggAgIIEGJAo078I" +
+	"9FbMKW8ieARzw2A9uRafS5rk++1knH2HXHAaq73/k5WKdQO0O/4HMUYk0xPX/eTQY7kcltln/KJ8" +
+	"tjdgoTXnQiJ+ttUMEfwuBPOPa052OnnrCEwDwVbyQUbvc9nfOaKdZz6R6E0qHJi++OAWEqqpDjow" +
+	"llvfwr4XIpD4Ay+vwv8+lOTrBP6aY1bvYvGQIoXuv4yhbwyhGdACDFqNOPp30LHFYamw866Yr2N9" +
+	"uC3LN2p6EFnwW2lYvWuxqU6/gV6f9HA9334j18L0y/BHtAeBmxsM28/MbkqjFPrzSpcyNOnOG9pk" +
+	"8FebxLd2NZSaA+xGKWWD1D4Fe95XaDytZ46T42sHLgiQgLitbG2j7zQvSRa8s/VfLZjNp2bwcZc2" +
+	"m8fE0RqkvjNPlyI0T71joSA8oBlctEaA4OTE60XNK3HkvpecUwnLQI2m3Dr2Ps1SkxJnz3V2LxpW" +
+	"k+T7Co2sgO/tdr7jNKFLi5wi3LzK8dGODPidy2UAId2VYWdhCWZOse/rqMJ4VJIAbf5WbbTXwcTo" +
+	"yC200L2BkWS9zA5CWdtpiRdu/EjOEbKcR8gbpbPw9yXrQF6knqBMMuulkJGWLL+HSK038Izo6wR5" +
+	"M+Qzb/fdOYh0i1StFE2btB6zU3YShzdYbBuVl42qZ3KwDs3P8rnCH0NjM1PRW2xrwKGbN3XkhpBn" +
+	"VBBKZLJdU979x24ODt3CoPbQlJrYgN3o58do7hLYCXwPfD2Ie989Cm/Ny5pznEm42OSY9ZQuQe12" +
+	"D7GBzONFI0Jzw/zF5t4EZoqzN5Wbe+GUJBu4jrZszrbSdfpmA4JJCaGukfxnZklh7TdWqK06+MkW" +
+	"tjO+aa9jC6zXF8PXmW+bbpAKot8cijhpJE+X1rr7qhVN3xNf0ylIv0Z1E8fJgpWDMPR4hdeClXh0" +
+	"EBaQU+dFLH9KRoBJU8kCEiRL03kuMozSE8qGawNwLZ/P/OlZIz/DBqGXVeq3Jlktr48k75LaV3fe" +
+	"b289LkW3CdPmtJwzBFUYXko9pWk7kJfsPHPC2BxYBPEh4rSRSUZsSVcwK/4hn9bT6jAqyY8iykG8" +
+	"DKeaJ5gQjb85zW6WnBzFjZC2Qq1xg0rlKqCbuKTFJXuI2LnWjVM9w1FMaLieciLYbvQtIjbkqMwX" +
+	"G7SWsh04D8DNDjsOGzxl5kkt4FwSL4JOD49u2np3xWH/ZGRnE0m/X0JoL7pmktGjBP584cLoJLz+" +
+	"0JFkZCMNIlaAWXhB1Sg+Cne4O6jESMHvoyTrt3xdaWIDtsA/Dj+jr8SwsHkVBDjO6rbAoHLSlOBj" +
+	"aTohwaZaAIfqwbJxDQYocG1cfq4f10jM8U82QnZZr4XSUCYyCdcilCEWRvsRGfRZ7dS6RT6vAiui" +
+	"Yg9ccm7AZjq95RMW8FrojiswggVBBgkqhkiG9w0BBwGgggUyBIIFLjCCBSowggUmBgsqhkiG9w0B" +
+	"DAoBAqCCBO4wggTqMBwGCiqGSIb3DQEMAQMwDgQIB9Qa4ze/BZ0CAggABIIEyBNlHwMzW0jS41D7" +
+	"Zx3IBHrdH5O5HDoY/l3fj32c8/uGENSFnXxCt5lH23pCyJqyP7MViQCJdADOrsTMTma4RTQA88gs" +
+	"gUDtQMwWKNmO9XSAEgVgaJWV7OCp7p7iqWioTHhBpF5PeHiuXehR05oB2fWHfKdAtud2t916IDoP" +
+	"8DsbahWE/7RTLTURCUf5VOkg5zLSDHVte7+MyLyv0uekHY5P6fUWxGAzMAC02b3kzOg3l9iBOSrN" +
+	"/Q1CBAgRP7n8WrTJSjEF2ziHt8RgGIZaIJtxOom4QM1l738nALEO+bIHDMyKeZZjFNSeiluI/CIK" +
+	"221oZlihtWPRnUrTQ+zHBtpwmxR5zg64SupYZi6Npf7ontt0dhHmEQkCvG1u/aIZq3rk06/jS2yw" +
+	"rhbLFzxM/ILnUHJhI7nkcvFGopdr+lfrl8ittWjGB68iKP7fyXiZQdoXWG1V0ZGw3ySB8W/PHvaa" +
+	"vkkhHLBRRAdpfunThVf9pPd1xLRqct3vEYPHD5lR27MNZiqBXbQHkv2Ixx1L4QsGwDQVe+RIprKA" +
+	"5vRsItxZPB1O6EPU2k9y8JBfXWBxJU016Bu0G64us/eOmgduVCVW0TzhI/FTkvfJcgdg5cXPMf97" +
+	"zstbBbjE156G//nyhYcOQB0EfI6NujS3pFrqHCxBEWwZGF7j9MfilGdwU/R3XivFLOvZ7G6KERbt" +
+	"jgJE2qlUHRaNYpKzPcrC8v9AxZge/N8iIb1+76A+l0TvpSx1w0cFhytr5DtpWQlM8AxWZhbPpf2P" +
+	"BFCjaDn8EXKG6IFQV5n6VwxKzQ2T5qYWuzMXwbdxYDYhE3H0WrRxAg+n3Yr+G/HMo4rNhuRAipRc" +
+	"0V0UYIhitR1bBSekh3AQH3k0LT/yPKhU8HaeQLoQP6fRzIyih+Se15vS4ymWlZOmWFmynnXA3jIY" +
+	"+hb9Ao5rYbzqF320dfIM/80uh/1VII7w+5ZjY2PeY3YxI1MasEkK3Zr5IZuXj3R7et4gVFrfTrWn" +
+	"Un0XSHTNq6YbG2jI0jp/E1SLK11i28f2anJ7FD//8ZaZLx6lGfDN2Dn/9hiPorldgkFCKO+aXSWp" +
+	"/P9aapI1kZVIh+cY7TYxCu7mkheZ5BI+lh9bPnE7EyKHcNPLVMSQf+K3qaUqa6TizjewEzVEo3jK" +
+	"KED3FrpBIqnSt8wXaIPDe6ByHbrMPz8tZ12zR4iyzIleKr2F9ACTkohJc4ZI8qbQtW/zGAdkkxiW" +
+	"kBx+KekFr9yZz1qMG7XpamEviwgvVp4ZUxedfGo45c9W1nSsZKYTqWH4H59kGOYFN4ilM6hUk5ae" +
+	"4dXcI3E6w0mlWpjb+QVFSZleCA1Gn8oA11pHq+pBgtD8/rlZvYZ5LgilexU+EofjZPkKCMJF/rVe" +
+	"cZE6O+dRn/WWPU95R266weThaw3iBuf70RgLNxxwVczvwAGk55xVfw9kgel/yutOiMBnOd3Iii4p" +
+	"zAzdCGmZbzOQ/Pl33TXN56DtTUM9J2Usw8bqzYM0E1K7YcOVtHkfd5bVN5BonkKpgo2TFjR3ua/K" +
+	"fqCzwULGVQy/jKJ4N2E8/0wBZC3QyA0Dnl8n2GwzMIssezKo/aDv0bo12LW3yLLJcLkfUy2B0Gkj" +
+	"I2ynihmQ75t2wtSxB5ctODElMCMGCSqGSIb3DQEJFTEWBBSqm7nRnMZz57QzWjFTAXlr/e41ojAx" +
+	"MCEwCQYFKw4DAhoFAAQUMnEH2tMjJnL0iiuCCJo1J2lYtbEECB9WZ1RP5z5aAgIIAA=="
+
+func TestKeyWrapPkcs7PKCS12(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the pkcs7 scheme")
+
+	p12, err := base64.StdEncoding.DecodeString(pkcs12Bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	password := []byte("password")
+
+	_, certs, err := utils.ParsePKCS12(p12, password, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || certs[0].Subject.CommonName != "ocicrypt-test" {
+		t.Fatalf("Expected the key's certificate first out of 2, got %d", len(certs))
+	}
+
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+	wk, err := kw.WrapKeys(&config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"x509s": {certs[0].Raw},
+		},
+	}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the certificate is taken from the bundle
+	ud, err := kw.UnwrapKey(&config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {p12},
+			"privkeys-passwords": {password},
+		},
+	}, wk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(ud) {
+		t.Fatal("Strings don't match")
+	}
+
+	for _, pw := range [][]byte{nil, []byte("wrong")} {
+		_, err = kw.UnwrapKey(&config.DecryptConfig{
+			Parameters: map[string][][]byte{
+				"privkeys":           {p12},
+				"privkeys-passwords": {pw},
+			},
+		}, wk)
+		if !errors.Is(err, errdefs.ErrWrongPassword) {
+			t.Fatalf("Expected ErrWrongPassword, got %v", err)
+		}
+	}
+
+	if utils.IsPKCS12(certs[0].Raw) {
+		t.Fatal("Certificate must not be detected as PKCS#12 bundle")
+	}
+}
+
+func TestKeyWrapPkcs7PKCS12PBES2(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the pkcs7 scheme")
+
+	caKey, caCert, err := utils.CreateTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := utils.CreateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := utils.CertifyKey(pubKey, nil, caKey, caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// PBES2 with AES-256-CBC, the default of OpenSSL 3
+	password := []byte("password")
+	p12, err := gopkcs12.Modern2023.Encode(key, cert, []*x509.Certificate{caCert}, string(password))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, certs, err := utils.ParsePKCS12(p12, password, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || !certs[0].Equal(cert) || !certs[1].Equal(caCert) {
+		t.Fatalf("Expected the key's certificate first out of 2, got %d", len(certs))
+	}
+
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+	wk, err := kw.WrapKeys(&config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"x509s": {cert.Raw},
+		},
+	}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ud, err := kw.UnwrapKey(&config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {p12},
+			"privkeys-passwords": {password},
+		},
+	}, wk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(ud) {
+		t.Fatal("Strings don't match")
+	}
+
+	if _, _, err := utils.ParsePKCS12(p12, []byte("wrong"), "test"); !errors.Is(err, errdefs.ErrWrongPassword) {
+		t.Fatalf("Expected ErrWrongPassword, got %v", err)
+	}
+}
+
+func TestKeyWrapPkcs7CMS(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the pkcs7 scheme")
+
+	caKey, caCert, err := utils.CreateTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := utils.CreateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPubKey, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaCert, err := utils.CertifyKey(rsaPubKey, nil, caKey, caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := [][]byte{rsaCert.Raw}
+	privKeys := [][]byte{}
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		pubKey, privKey, err := utils.CreateECDSATestKey(curve)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := utils.CertifyKey(pubKey, nil, caKey, caCert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert.Raw)
+		privKeys = append(privKeys, privKey)
+	}
+
+	cc, err := config.EncryptWithCMS(certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+	wk, err := kw.WrapKeys(cc.EncryptConfig, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isCMS(wk) {
+		t.Fatal("Expected CMS authenticated enveloped data")
+	}
+	recipients, err := kw.GetRecipients(base64.StdEncoding.EncodeToString(wk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != len(certs) {
+		t.Fatalf("Expected %d recipients, got %v", len(certs), recipients)
+	}
+
+	for _, privKey := range privKeys {
+		ud, err := kw.UnwrapKey(&config.DecryptConfig{
+			Parameters: map[string][][]byte{
+				"privkeys":           {privKey},
+				"privkeys-passwords": {oneEmpty},
+				"x509s":              certs,
+			},
+		}, wk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(ud) {
+			t.Fatal("Strings don't match")
+		}
+	}
+
+	// RSA recipients are wrapped with the source of randomness of the
+	// EncryptConfig
+	rsaCc, err := config.EncryptWithCMS(certs[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var detWks [][]byte
+	for i := 0; i < 2; i++ {
+		rsaCc.EncryptConfig.Rand = bytes.NewReader(bytes.Repeat([]byte{1}, 1024))
+		detWk, err := kw.WrapKeys(rsaCc.EncryptConfig, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		detWks = append(detWks, detWk)
+	}
+	if !bytes.Equal(detWks[0], detWks[1]) {
+		t.Fatal("Expected the same source of randomness to produce the same CMS packet")
+	}
+
+	// RSA keys held by a crypto.Decrypter unwrap using RSA-OAEP as well
+	ud, err := kw.UnwrapKey(&config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"x509s": certs,
+		},
+		Decrypters: []crypto.Decrypter{opaqueKey{rsaKey}},
+	}, wk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(ud) {
+		t.Fatal("Strings don't match")
+	}
+
+	// tampering with the content fails authentication
+	wk[len(wk)-1] ^= 1
+	_, err = kw.UnwrapKey(&config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"x509s": certs,
+		},
+		Decrypters: []crypto.Decrypter{opaqueKey{rsaKey}},
+	}, wk)
+	if err == nil {
+		t.Fatal("Expected tampered CMS packet to be rejected")
+	}
+
+	cc.EncryptConfig.Parameters["pkcs7-mode"] = [][]byte{[]byte("pkcs1")}
+	if _, err := kw.WrapKeys(cc.EncryptConfig, data); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("Expected ErrConfiguration, got %v", err)
+	}
+}
+
+func TestKeyWrapPkcs7VerifyX509s(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the pkcs7 scheme")
+
+	caKey, caCert, err := utils.CreateTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherCACert, err := utils.CreateTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, _, err := utils.CreateRSATestKey(2048, oneEmpty, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := utils.CertifyKey(pubKey, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "recipient"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment,
+	}, caKey, caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredCert, err := utils.CreateExpiredCert(pubKey, caKey, caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the leaf certificate of the chain only allows digital signatures
+	_, chain, err := utils.CreateCertificateChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bundle []byte
+	for _, c := range chain[:2] {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+	chainCAPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chain[2].Raw})
+
+	kw := NewKeyWrapper()
+	for _, tc := range []struct {
+		x509s [][]byte
+		roots [][]byte
+		ok    bool
+	}{
+		{[][]byte{cert.Raw}, [][]byte{caPem}, true},
+		{[][]byte{cert.Raw}, [][]byte{otherCACert.Raw}, false},
+		{[][]byte{cert.Raw}, [][]byte{otherCACert.Raw, caCert.Raw}, true},
+		{[][]byte{cert.Raw, expiredCert.Raw}, [][]byte{caPem}, false},
+		{[][]byte{bundle}, [][]byte{chainCAPem}, false},
+		{[][]byte{expiredCert.Raw}, nil, true},
+	} {
+		params := map[string][][]byte{
+			"x509s": tc.x509s,
+		}
+		if tc.roots != nil {
+			params["x509-roots"] = tc.roots
+		}
+		ec := &config.EncryptConfig{Parameters: params}
+		_, err := kw.WrapKeys(ec, []byte("This is some secret text"))
+		if tc.ok && err != nil {
+			t.Fatal(err)
+		}
+		if !tc.ok {
+			if !errors.Is(err, errdefs.ErrUntrustedCertificate) || !errors.Is(err, errdefs.ErrKeyMaterial) {
+				t.Fatalf("Expected ErrUntrustedCertificate, got %v", err)
+			}
+			// the verification can be overridden
+			params["x509-skip-verify"] = [][]byte{[]byte("true")}
+			if _, err := kw.WrapKeys(ec, []byte("This is some secret text")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,234 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package threshold
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/keywrap"
+	"github.com/containers/ocicrypt/keywrap/jwe"
+	"github.com/containers/ocicrypt/utils"
+)
+
+// thresholdBlob is the wrapped key; the layer key options are split into
+// one share per recipient with Shamir's secret sharing, any Threshold of
+// which recover them, and every share is wrapped for its recipient as a JWE
+type thresholdBlob struct {
+	Version   int      `json:"version"`
+	Threshold int      `json:"threshold"`
+	Shares    [][]byte `json:"shares"`
+}
+
+type thresholdKeyWrapper struct {
+	jwe keywrap.KeyWrapper
+}
+
+// NewKeyWrapper returns a new key wrapping interface that requires the
+// private keys of k out of n recipients for unwrapping the layer key
+func NewKeyWrapper() keywrap.KeyWrapper {
+	return &thresholdKeyWrapper{jwe: jwe.NewKeyWrapper()}
+}
+
+func (kw *thresholdKeyWrapper) GetAnnotationID() string {
+	return "org.opencontainers.image.enc.keys.threshold"
+}
+
+// WrapKeys splits the optsData, which describe the symmetric key used for
+// encrypting the layer, into shares for the public keys of the
+// threshold-pubkeys parameter, threshold-k of which are needed to unwrap it
+func (kw *thresholdKeyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	pubKeys, err := parsePubKeys(ec.Parameters["threshold-pubkeys"])
+	if err != nil {
+		return nil, err
+	}
+	// no recipients is not an error...
+	if len(pubKeys) == 0 {
+		return nil, nil
+	}
+	k, err := getThreshold(ec.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if k > len(pubKeys) {
+		return nil, fmt.Errorf("threshold: %d of %d different public keys cannot be required: %w", k, len(pubKeys), errdefs.ErrConfiguration)
+	}
+
+	shares, err := split(optsData, k, len(pubKeys), ec.GetRand())
+	if err != nil {
+		return nil, fmt.Errorf("threshold: %v: %w", err, errdefs.ErrConfiguration)
+	}
+	blob := thresholdBlob{Threshold: k}
+	for i, pubKey := range pubKeys {
+		shareEc := *ec
+		shareEc.Parameters = map[string][][]byte{
+			"pubkeys":                {pubKey},
+			"jwe-key-algorithms":     ec.Parameters["jwe-key-algorithms"],
+			"jwe-content-encryption": ec.Parameters["jwe-content-encryption"],
+		}
+		wrapped, err := kw.jwe.WrapKeys(&shareEc, shares[i])
+		if err != nil {
+			return nil, fmt.Errorf("threshold: %w", err)
+		}
+		blob.Shares = append(blob.Shares, wrapped)
+	}
+	return json.Marshal(&blob)
+}
+
+func (kw *thresholdKeyWrapper) UnwrapKey(dc *config.DecryptConfig, annotation []byte) ([]byte, error) {
+	optsData, _, err := kw.UnwrapKeyID(dc, annotation)
+	return optsData, err
+}
+
+// UnwrapKeyID unwraps the shares of the layer key with the private keys of
+// the privkeys parameter and the Decrypters and recovers the layer key from
+// them; it returns the KeyIDs of the private keys that unwrapped the shares
+func (kw *thresholdKeyWrapper) UnwrapKeyID(dc *config.DecryptConfig, annotation []byte) ([]byte, string, error) {
+	var blob thresholdBlob
+	if err := json.Unmarshal(annotation, &blob); err != nil {
+		return nil, "", fmt.Errorf("could not parse the threshold wrapped key: %w", errdefs.ErrProtocol)
+	}
+	if blob.Version != 0 {
+		return nil, "", fmt.Errorf("unsupported threshold wrapped key version %d: %w", blob.Version, errdefs.ErrProtocol)
+	}
+	if blob.Threshold < 1 || blob.Threshold > len(blob.Shares) {
+		return nil, "", fmt.Errorf("threshold wrapped key requires %d of %d shares: %w", blob.Threshold, len(blob.Shares), errdefs.ErrProtocol)
+	}
+	if err := dc.GetLimits().CheckRecipients(len(blob.Shares)); err != nil {
+		return nil, "", err
+	}
+
+	var (
+		shares [][]byte
+		keyIDs []string
+	)
+	for _, wrapped := range blob.Shares {
+		share, keyID, err := kw.jwe.(keywrap.KeyIDUnwrapper).UnwrapKeyID(dc, wrapped)
+		if err != nil {
+			if errors.Is(err, errdefs.ErrNoDecryptionKey) {
+				continue
+			}
+			return nil, "", fmt.Errorf("threshold: %w", err)
+		}
+		shares = append(shares, share)
+		keyIDs = append(keyIDs, keyID)
+		if len(shares) == blob.Threshold {
+			optsData, err := combine(shares)
+			if err != nil {
+				return nil, "", fmt.Errorf("threshold: %v: %w", err, errdefs.ErrProtocol)
+			}
+			if len(optsData) > keywrap.MaxOptsDataSize {
+				return nil, "", fmt.Errorf("threshold: layer key options are larger than %d bytes: %w", keywrap.MaxOptsDataSize, errdefs.ErrLimitExceeded)
+			}
+			return optsData, strings.Join(keyIDs, ","), nil
+		}
+	}
+	return nil, "", fmt.Errorf("threshold: the private keys unwrap %d shares but %d are required: %w", len(shares), blob.Threshold, errdefs.ErrNoDecryptionKey)
+}
+
+// SupportsDecrypters returns true since the shares are unwrapped by the jwe
+// keywrapper, which uses RSA keys held by crypto.Decrypters
+func (kw *thresholdKeyWrapper) SupportsDecrypters() bool {
+	return true
+}
+
+func (kw *thresholdKeyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
+	return len(kw.GetPrivateKeys(dcparameters)) == 0
+}
+
+func (kw *thresholdKeyWrapper) GetPrivateKeys(dcparameters map[string][][]byte) [][]byte {
+	return kw.jwe.GetPrivateKeys(dcparameters)
+}
+
+func (kw *thresholdKeyWrapper) GetKeyIdsFromPacket(_ string) ([]uint64, error) {
+	return nil, nil
+}
+
+// GetRecipients returns a placeholder for every share since the JWEs do not
+// reveal the recipients
+func (kw *thresholdKeyWrapper) GetRecipients(b64blobs string) ([]string, error) {
+	var recipients []string
+	for _, b64blob := range strings.Split(b64blobs, ",") {
+		data, err := base64.StdEncoding.DecodeString(b64blob)
+		if err != nil {
+			return nil, fmt.Errorf("could not base64 decode the threshold wrapped key: %w", errdefs.ErrProtocol)
+		}
+		var blob thresholdBlob
+		if err := json.Unmarshal(data, &blob); err != nil {
+			return nil, fmt.Errorf("could not parse the threshold wrapped key: %w", errdefs.ErrProtocol)
+		}
+		for range blob.Shares {
+			recipients = append(recipients, fmt.Sprintf("[threshold %d of %d]", blob.Threshold, len(blob.Shares)))
+		}
+	}
+	return recipients, nil
+}
+
+// getThreshold returns the number of recipients whose private keys are
+// needed for unwrapping the layer key as given by the threshold-k parameter
+func getThreshold(parameters map[string][][]byte) (int, error) {
+	values := parameters["threshold-k"]
+	if len(values) != 1 {
+		return 0, fmt.Errorf("threshold: exactly one threshold-k is required: %w", errdefs.ErrConfiguration)
+	}
+	k, err := strconv.Atoi(string(values[0]))
+	if err != nil || k < 1 {
+		return 0, fmt.Errorf("threshold: threshold-k %q is not a positive number: %w", values[0], errdefs.ErrConfiguration)
+	}
+	return k, nil
+}
+
+// parsePubKeys checks the public keys and drops duplicates, which must not
+// count twice towards the threshold; the others are sorted so that the
+// wrapped key does not depend on the order of the keys
+func parsePubKeys(pubKeys [][]byte) ([][]byte, error) {
+	type keyWithID struct {
+		data  []byte
+		keyID string
+	}
+	var keys []keyWithID
+	seen := make(map[string]bool)
+	for _, pubKey := range pubKeys {
+		key, err := utils.ParsePublicKey(pubKey, "threshold")
+		if err != nil {
+			return nil, err
+		}
+		keyID := utils.KeyID(key)
+		if keyID != "" {
+			if seen[keyID] {
+				continue
+			}
+			seen[keyID] = true
+		}
+		keys = append(keys, keyWithID{data: pubKey, keyID: keyID})
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].keyID < keys[j].keyID
+	})
+	result := make([][]byte, len(keys))
+	for i, key := range keys {
+		result[i] = key.data
+	}
+	return result, nil
+}
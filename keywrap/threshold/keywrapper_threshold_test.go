@@ -0,0 +1,168 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package threshold
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/utils"
+)
+
+func TestShamir(t *testing.T) {
+	secret := []byte("This is some secret text")
+	shares, err := split(secret, 3, 5, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, share := range shares {
+		if bytes.Contains(share, secret) {
+			t.Fatal("Share reveals the secret")
+		}
+	}
+	// every 3 of the 5 shares recover the secret, 2 do not
+	for a := 0; a < 5; a++ {
+		for b := a + 1; b < 5; b++ {
+			combined, err := combine([][]byte{shares[a], shares[b]})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(combined, secret) {
+				t.Fatalf("Shares %d and %d recovered the secret", a, b)
+			}
+			for c := b + 1; c < 5; c++ {
+				combined, err := combine([][]byte{shares[c], shares[a], shares[b]})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(combined, secret) {
+					t.Fatalf("Shares %d, %d and %d did not recover the secret", a, b, c)
+				}
+			}
+		}
+	}
+
+	if _, err := combine([][]byte{shares[0], shares[0]}); err == nil {
+		t.Fatal("Combined a share with itself")
+	}
+	if _, err := split(secret, 3, 2, rand.Reader); err == nil {
+		t.Fatal("Split a secret with a threshold above the number of shares")
+	}
+}
+
+func TestGFInv(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if p := gfMul(byte(a), gfInv(byte(a))); p != 1 {
+			t.Fatalf("%d times its inverse is %d", a, p)
+		}
+	}
+}
+
+func TestKeyWrapThreshold(t *testing.T) {
+	var pubKeys, privKeys [][]byte
+	for i := 0; i < 3; i++ {
+		pubKey, privKey, err := utils.CreateECDSATestKey(elliptic.P256())
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKeys = append(pubKeys, pubKey)
+		privKeys = append(privKeys, privKey)
+	}
+	// an RSA key for a recipient next to the ECDSA keys
+	pubKey, privKey, err := utils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKeys = append(pubKeys, pubKey)
+	privKeys = append(privKeys, privKey)
+
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			// a duplicate key does not count towards the threshold
+			"threshold-pubkeys": append(pubKeys, pubKeys[0]),
+			"threshold-k":       {[]byte("2")},
+		},
+	}
+	wk, err := kw.WrapKeys(ec, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipients, err := kw.GetRecipients(base64.StdEncoding.EncodeToString(wk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 4 || recipients[0] != "[threshold 2 of 4]" {
+		t.Fatalf("Unexpected recipients %v", recipients)
+	}
+
+	for _, tc := range []struct {
+		privKeys [][]byte
+		ok       bool
+	}{
+		{privKeys[:1], false},
+		{privKeys[3:], false},
+		{privKeys[:2], true},
+		{[][]byte{privKeys[3], privKeys[1]}, true},
+		{privKeys, true},
+	} {
+		dc := &config.DecryptConfig{
+			Parameters: map[string][][]byte{
+				"privkeys":           tc.privKeys,
+				"privkeys-passwords": make([][]byte, len(tc.privKeys)),
+			},
+		}
+		ud, keyIDs, err := kw.(*thresholdKeyWrapper).UnwrapKeyID(dc, wk)
+		if !tc.ok {
+			if !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+				t.Fatalf("Expected ErrNoDecryptionKey with %d keys, got %v", len(tc.privKeys), err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ud, data) {
+			t.Fatal("Strings don't match")
+		}
+		if n := len(strings.Split(keyIDs, ",")); n != 2 {
+			t.Fatalf("Expected the key IDs of 2 keys, got %q", keyIDs)
+		}
+	}
+
+	for _, k := range []string{"0", "5", "two"} {
+		ec.Parameters["threshold-k"] = [][]byte{[]byte(k)}
+		if _, err := kw.WrapKeys(ec, data); !errors.Is(err, errdefs.ErrConfiguration) {
+			t.Fatalf("Expected ErrConfiguration for threshold %s, got %v", k, err)
+		}
+	}
+	cc, err := config.EncryptWithThreshold(len(pubKeys)+1, pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Validate(); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("Expected ErrConfiguration for a threshold above the number of keys, got %v", err)
+	}
+}
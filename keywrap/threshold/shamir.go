@@ -0,0 +1,108 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package threshold
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// gfMul multiplies in GF(2^8) with the polynomial of AES without branching
+// on the operands
+func gfMul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		a = a<<1 ^ 0x1b&-(a>>7)
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns the multiplicative inverse in GF(2^8) as a^254
+func gfInv(a byte) byte {
+	r := a
+	for i := 0; i < 6; i++ {
+		r = gfMul(gfMul(r, r), a)
+	}
+	return gfMul(r, r)
+}
+
+// split splits the secret into n shares with Shamir's secret sharing so that
+// any k of them reveal it; every share is its x coordinate followed by the
+// values of the polynomials of the bytes of the secret at x
+func split(secret []byte, k, n int, rand io.Reader) ([][]byte, error) {
+	if k < 1 || k > n || n > 255 {
+		return nil, fmt.Errorf("cannot split a secret into %d shares with a threshold of %d", n, k)
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, 1, 1+len(secret))
+		shares[i][0] = byte(i + 1)
+	}
+	coefficients := make([]byte, k)
+	for _, s := range secret {
+		coefficients[0] = s
+		if _, err := io.ReadFull(rand, coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			// Horner's scheme
+			x, y := shares[i][0], byte(0)
+			for j := k - 1; j >= 0; j-- {
+				y = gfMul(y, x) ^ coefficients[j]
+			}
+			shares[i] = append(shares[i], y)
+		}
+	}
+	for i := range coefficients {
+		coefficients[i] = 0
+	}
+	return shares, nil
+}
+
+// combine recovers the secret from shares created by split by interpolating
+// the polynomials at 0; given fewer shares than the threshold it returns
+// garbage
+func combine(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares to combine")
+	}
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if len(share) < 1 || len(share) != len(shares[0]) || share[0] == 0 || seen[share[0]] {
+			return nil, errors.New("invalid shares")
+		}
+		seen[share[0]] = true
+	}
+
+	secret := make([]byte, len(shares[0])-1)
+	for j, share := range shares {
+		// the Lagrange basis polynomial of share j at 0
+		basis := byte(1)
+		for m, other := range shares {
+			if m != j {
+				basis = gfMul(basis, gfMul(other[0], gfInv(other[0]^share[0])))
+			}
+		}
+		for i := range secret {
+			secret[i] ^= gfMul(basis, share[1+i])
+		}
+	}
+	return secret, nil
+}
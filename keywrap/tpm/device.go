@@ -0,0 +1,226 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tpm
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// DefaultDevices are the TPM devices that are tried if none is configured; the
+// resource manager is preferred so that other users of the TPM are not
+// disturbed
+var DefaultDevices = []string{"/dev/tpmrm0", "/dev/tpm0"}
+
+const (
+	// KeySRK refers to the RSA storage root key, which is created from the
+	// template of the TCG TPM v2.0 Provisioning Guidance
+	KeySRK = "srk"
+	// KeySRKECC refers to the ECC P-256 storage root key
+	KeySRKECC = "srk-ecc"
+)
+
+// contextFileMagic starts the context files written by tpm2-tools
+const contextFileMagic = 0xBADCC0DE
+
+// openTPM opens the TPM device or, if none is given, the first of the default
+// devices that exists
+var openTPM = func(device string) (io.ReadWriteCloser, error) {
+	if device == "" {
+		for _, d := range DefaultDevices {
+			if _, err := os.Stat(d); err == nil {
+				device = d
+				break
+			}
+		}
+		if device == "" {
+			return nil, fmt.Errorf("TPM: no TPM device found: %w", errdefs.ErrProviderUnreachable)
+		}
+	}
+	rw, err := tpm2.OpenTPM(device)
+	if err != nil {
+		return nil, fmt.Errorf("TPM: could not open %s: %v: %w", device, err, errdefs.ErrProviderUnreachable)
+	}
+	return rw, nil
+}
+
+// parentKey is a storage key loaded into the TPM
+type parentKey struct {
+	handle tpmutil.Handle
+	// flush tells whether the key is a transient object to flush after use
+	flush bool
+	// fingerprint is the hex SHA-256 digest of the public key in PKIX format
+	fingerprint string
+}
+
+// loadParent loads the storage key that the key reference refers to: the SRK,
+// a persistent handle given as hex number or a saved context in the format of
+// tpm2-tools or as written by TPM2_ContextSave
+func loadParent(rw io.ReadWriter, key []byte) (*parentKey, error) {
+	parent := &parentKey{}
+	ref := strings.TrimSpace(string(key))
+	switch {
+	case ref == KeySRK || ref == KeySRKECC:
+		template := srkTemplateRSA()
+		if ref == KeySRKECC {
+			template = srkTemplateECC()
+		}
+		handle, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", template)
+		if err != nil {
+			return nil, fmt.Errorf("TPM: could not create the storage root key: %w", err)
+		}
+		parent.handle, parent.flush = handle, true
+	case strings.HasPrefix(ref, "0x"):
+		handle, err := strconv.ParseUint(ref[2:], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("TPM: invalid handle '%s': %w", ref, errdefs.ErrConfiguration)
+		}
+		parent.handle = tpmutil.Handle(handle)
+	default:
+		saveArea := key
+		if len(key) >= 8 && binary.BigEndian.Uint32(key) == contextFileMagic {
+			var err error
+			if saveArea, err = convertContextFile(key); err != nil {
+				return nil, err
+			}
+		}
+		handle, err := tpm2.ContextLoad(rw, saveArea)
+		if err != nil {
+			return nil, fmt.Errorf("TPM: could not load the key context: %w", err)
+		}
+		parent.handle, parent.flush = handle, true
+	}
+
+	public, _, _, err := tpm2.ReadPublic(rw, parent.handle)
+	if err == nil {
+		var pubKey crypto.PublicKey
+		if pubKey, err = public.Key(); err == nil {
+			parent.fingerprint, err = fingerprint(pubKey)
+		}
+	}
+	if err != nil {
+		parent.close(rw)
+		return nil, fmt.Errorf("TPM: could not read the public key of the storage key: %w", err)
+	}
+	return parent, nil
+}
+
+func (p *parentKey) close(rw io.ReadWriter) {
+	if p.flush {
+		_ = tpm2.FlushContext(rw, p.handle)
+	}
+}
+
+// convertContextFile converts a context file of tpm2-tools, which starts with
+// the magic number and version followed by the hierarchy, the saved handle
+// and the sequence number, into a TPMS_CONTEXT. tpm2-tools 4.0 and later save
+// contexts with the ESAPI, which wraps the context blob of the TPM into a
+// structure with a reserved zero field and metadata of its own.
+func convertContextFile(data []byte) ([]byte, error) {
+	var (
+		magic, version, hierarchy, savedHandle uint32
+		sequence                               uint64
+		blob                                   tpmutil.U16Bytes
+	)
+	if _, err := tpmutil.Unpack(data, &magic, &version, &hierarchy, &savedHandle, &sequence, &blob); err != nil {
+		return nil, fmt.Errorf("TPM: invalid context file: %w", errdefs.ErrKeyMaterial)
+	}
+	if version != 1 {
+		return nil, fmt.Errorf("TPM: unsupported context file version %d: %w", version, errdefs.ErrKeyMaterial)
+	}
+	// the context blob of the TPM starts with the size of its integrity
+	// digest, which is never zero
+	if len(blob) >= 4 && binary.BigEndian.Uint32(blob) == 0 {
+		var (
+			reserved uint32
+			tpmBlob  tpmutil.U16Bytes
+		)
+		if _, err := tpmutil.Unpack(blob, &reserved, &tpmBlob); err != nil {
+			return nil, fmt.Errorf("TPM: invalid context file: %w", errdefs.ErrKeyMaterial)
+		}
+		blob = tpmBlob
+	}
+	return tpmutil.Pack(sequence, savedHandle, hierarchy, blob)
+}
+
+// fingerprint returns the hex SHA-256 digest of the public key in PKIX format
+func fingerprint(pubKey crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(der)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// unseal imports the sealed object of the recipient under the parent key and
+// unseals it, satisfying its PCR policy if it has one
+func unseal(rw io.ReadWriter, parent *parentKey, recipient *tpmRecipient) ([]byte, error) {
+	auth := tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}
+	private, err := tpm2.Import(rw, parent.handle, auth, recipient.Public, recipient.Duplicate, recipient.Seed, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("TPM: could not import the sealed key: %w", err)
+	}
+	handle, _, err := tpm2.Load(rw, parent.handle, "", recipient.Public, private)
+	if err != nil {
+		return nil, fmt.Errorf("TPM: could not load the sealed key: %w", err)
+	}
+	defer func() {
+		_ = tpm2.FlushContext(rw, handle)
+	}()
+
+	if len(recipient.PCRs) == 0 {
+		data, err := tpm2.Unseal(rw, handle, "")
+		if err != nil {
+			return nil, fmt.Errorf("TPM: could not unseal the key: %w", err)
+		}
+		return data, nil
+	}
+
+	bank, ok := pcrBanks[recipient.PCRBank]
+	if !ok {
+		return nil, fmt.Errorf("TPM: unsupported PCR bank '%s': %w", recipient.PCRBank, errdefs.ErrProtocol)
+	}
+	session, _, err := tpm2.StartAuthSession(rw, tpm2.HandleNull, tpm2.HandleNull, make([]byte, sha256.Size), nil, tpm2.SessionPolicy, tpm2.AlgNull, nameAlg)
+	if err != nil {
+		return nil, fmt.Errorf("TPM: could not start a policy session: %w", err)
+	}
+	defer func() {
+		_ = tpm2.FlushContext(rw, session)
+	}()
+	if err := tpm2.PolicyPCR(rw, session, nil, tpm2.PCRSelection{Hash: bank, PCRs: recipient.PCRs}); err != nil {
+		return nil, fmt.Errorf("TPM: could not apply the PCR policy: %w", err)
+	}
+	data, err := tpm2.UnsealWithSession(rw, session, handle, "")
+	if err != nil {
+		// the PCRs do not have the values the key is bound to
+		return nil, fmt.Errorf("TPM: could not unseal the key, the PCR policy may not be satisfied: %w", err)
+	}
+	return data, nil
+}
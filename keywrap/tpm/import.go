@@ -0,0 +1,358 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tpm
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// nameAlg is the name algorithm of the sealed objects and of the parent keys
+// created from the SRK templates; it is also the hash of the policy sessions
+const nameAlg = tpm2.AlgSHA256
+
+// pcrBanks are the PCR banks that policies can refer to
+var pcrBanks = map[string]tpm2.Algorithm{
+	"sha1":   tpm2.AlgSHA1,
+	"sha256": tpm2.AlgSHA256,
+	"sha384": tpm2.AlgSHA384,
+}
+
+// pcrPolicy holds the PCR values that the sealed key is bound to
+type pcrPolicy struct {
+	bank   string
+	values map[int][]byte
+}
+
+// srkAttributes are the attributes of the storage root key as recommended by
+// the TCG TPM v2.0 Provisioning Guidance
+const srkAttributes = tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin |
+	tpm2.FlagUserWithAuth | tpm2.FlagNoDA | tpm2.FlagRestricted | tpm2.FlagDecrypt
+
+func srkSymmetric() *tpm2.SymScheme {
+	return &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB}
+}
+
+// srkTemplateRSA returns the template of the RSA storage root key
+func srkTemplateRSA() tpm2.Public {
+	return tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    nameAlg,
+		Attributes: srkAttributes,
+		RSAParameters: &tpm2.RSAParams{
+			Symmetric:  srkSymmetric(),
+			KeyBits:    2048,
+			ModulusRaw: make([]byte, 256),
+		},
+	}
+}
+
+// srkTemplateECC returns the template of the ECC P-256 storage root key
+func srkTemplateECC() tpm2.Public {
+	return tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    nameAlg,
+		Attributes: srkAttributes,
+		ECCParameters: &tpm2.ECCParams{
+			Symmetric: srkSymmetric(),
+			CurveID:   tpm2.CurveNISTP256,
+			Point: tpm2.ECPoint{
+				XRaw: make([]byte, 32),
+				YRaw: make([]byte, 32),
+			},
+		},
+	}
+}
+
+// parentPublic returns the public area of a storage key with the given public
+// key; the parameters that matter for importing objects are those of the SRK
+// templates
+func parentPublic(pubKey crypto.PublicKey) (tpm2.Public, error) {
+	switch key := pubKey.(type) {
+	case *rsa.PublicKey:
+		public := srkTemplateRSA()
+		public.RSAParameters.KeyBits = uint16(key.N.BitLen())
+		public.RSAParameters.ModulusRaw = key.N.Bytes()
+		if key.E != 65537 {
+			public.RSAParameters.ExponentRaw = uint32(key.E)
+		}
+		return public, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return tpm2.Public{}, fmt.Errorf("TPM: EC keys on curve %s cannot be used: %w", key.Curve.Params().Name, errdefs.ErrUnsupportedKey)
+		}
+		public := srkTemplateECC()
+		public.ECCParameters.Point = tpm2.ECPoint{
+			XRaw: key.X.FillBytes(make([]byte, 32)),
+			YRaw: key.Y.FillBytes(make([]byte, 32)),
+		}
+		return public, nil
+	}
+	return tpm2.Public{}, fmt.Errorf("TPM: %T keys cannot be used, only RSA and EC P-256 storage keys are supported: %w", pubKey, errdefs.ErrUnsupportedKey)
+}
+
+// parsePCRPolicy parses the PCR values of the form <bank>:<index>=<hex digest>
+// with several values separated by commas; all values must be of one bank
+func parsePCRPolicy(values [][]byte) (*pcrPolicy, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	policy := &pcrPolicy{values: make(map[int][]byte)}
+	for _, value := range values {
+		idx := strings.Index(string(value), ":")
+		if idx < 0 {
+			return nil, fmt.Errorf("TPM: PCR values %q lack the PCR bank: %w", value, errdefs.ErrConfiguration)
+		}
+		bank := strings.ToLower(string(value[:idx]))
+		alg, ok := pcrBanks[bank]
+		if !ok {
+			return nil, fmt.Errorf("TPM: unsupported PCR bank '%s': %w", bank, errdefs.ErrConfiguration)
+		}
+		if policy.bank != "" && policy.bank != bank {
+			return nil, fmt.Errorf("TPM: PCR values of the banks %s and %s cannot be combined: %w", policy.bank, bank, errdefs.ErrConfiguration)
+		}
+		policy.bank = bank
+		hashFn, err := alg.Hash()
+		if err != nil {
+			return nil, err
+		}
+		for _, pcr := range strings.Split(string(value[idx+1:]), ",") {
+			p := strings.SplitN(strings.TrimSpace(pcr), "=", 2)
+			if len(p) != 2 {
+				return nil, fmt.Errorf("TPM: PCR value %q is not of the form <index>=<hex digest>: %w", pcr, errdefs.ErrConfiguration)
+			}
+			index, err := strconv.Atoi(p[0])
+			if err != nil || index < 0 || index > 23 {
+				return nil, fmt.Errorf("TPM: invalid PCR index '%s': %w", p[0], errdefs.ErrConfiguration)
+			}
+			digest, err := hex.DecodeString(strings.TrimPrefix(p[1], "0x"))
+			if err != nil || len(digest) != hashFn.Size() {
+				return nil, fmt.Errorf("TPM: PCR %d needs a hex %s digest: %w", index, bank, errdefs.ErrConfiguration)
+			}
+			policy.values[index] = digest
+		}
+	}
+	return policy, nil
+}
+
+// selection returns the PCRs of the policy
+func (p *pcrPolicy) selection() tpm2.PCRSelection {
+	sel := tpm2.PCRSelection{Hash: pcrBanks[p.bank]}
+	for index := range p.values {
+		sel.PCRs = append(sel.PCRs, index)
+	}
+	sort.Ints(sel.PCRs)
+	return sel
+}
+
+// digest returns the policy digest of a TPM2_PolicyPCR with the PCR values
+func (p *pcrPolicy) digest() []byte {
+	sel := p.selection()
+
+	pcrDigest := sha256.New()
+	for _, index := range sel.PCRs {
+		pcrDigest.Write(p.values[index])
+	}
+
+	// TPML_PCR_SELECTION with one TPMS_PCR_SELECTION of 3 bytes
+	pcrSelect := make([]byte, 3)
+	for _, index := range sel.PCRs {
+		pcrSelect[index/8] |= 1 << uint(index%8)
+	}
+	encodedSel, _ := tpmutil.Pack(uint32(1), sel.Hash, byte(len(pcrSelect)))
+
+	h := sha256.New()
+	h.Write(make([]byte, sha256.Size))
+	cc, _ := tpmutil.Pack(tpm2.CmdPolicyPCR)
+	h.Write(cc)
+	h.Write(encodedSel)
+	h.Write(pcrSelect)
+	h.Write(pcrDigest.Sum(nil))
+	return h.Sum(nil)
+}
+
+// importBlob holds what TPM2_Import needs to import a sealed object
+type importBlob struct {
+	public        []byte
+	duplicate     []byte
+	encryptedSeed []byte
+}
+
+// createImportBlob creates a sealed object holding the data that only the TPM
+// holding the private key of the parent can import, following the duplication
+// of TPM 2.0 Part 1, 23.3 with an outer wrapper and no inner wrapper. If a PCR
+// policy is given, the object can only be unsealed in a policy session that
+// satisfies it.
+func createImportBlob(parent tpm2.Public, data []byte, policy *pcrPolicy) (*importBlob, error) {
+	private := tpm2.Private{
+		Type:      tpm2.AlgKeyedHash,
+		SeedValue: make([]byte, sha256.Size),
+		Sensitive: data,
+	}
+	if _, err := io.ReadFull(rand.Reader, private.SeedValue); err != nil {
+		return nil, err
+	}
+	unique := sha256.New()
+	unique.Write(private.SeedValue)
+	unique.Write(private.Sensitive)
+	public := tpm2.Public{
+		Type:    tpm2.AlgKeyedHash,
+		NameAlg: nameAlg,
+		KeyedHashParameters: &tpm2.KeyedHashParams{
+			Alg:    tpm2.AlgNull,
+			Unique: unique.Sum(nil),
+		},
+	}
+	if policy != nil {
+		public.Attributes |= tpm2.FlagAdminWithPolicy
+		public.AuthPolicy = policy.digest()
+	} else {
+		public.Attributes |= tpm2.FlagUserWithAuth
+	}
+
+	seed, encryptedSeed, err := createSeed(parent)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := public.Name()
+	if err != nil {
+		return nil, err
+	}
+	encodedName, err := name.Digest.Encode()
+	if err != nil {
+		return nil, err
+	}
+	encodedPrivate, err := private.Encode()
+	if err != nil {
+		return nil, err
+	}
+	sensitive, err := tpmutil.Pack(tpmutil.U16Bytes(encodedPrivate))
+	if err != nil {
+		return nil, err
+	}
+
+	symKey, err := tpm2.KDFa(nameAlg, seed, "STORAGE", encodedName, nil, int(srkSymmetric().KeyBits))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(symKey)
+	if err != nil {
+		return nil, err
+	}
+	encSensitive := make([]byte, len(sensitive))
+	// the IV is all zeros
+	cipher.NewCFBEncrypter(block, make([]byte, block.BlockSize())).XORKeyStream(encSensitive, sensitive)
+
+	hmacKey, err := tpm2.KDFa(nameAlg, seed, "INTEGRITY", nil, nil, sha256.Size*8)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(encSensitive)
+	mac.Write(encodedName)
+
+	duplicate, err := tpmutil.Pack(tpm2.IDObject{
+		IntegrityHMAC: mac.Sum(nil),
+		EncIdentity:   encSensitive,
+	})
+	if err != nil {
+		return nil, err
+	}
+	encodedPublic, err := public.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return &importBlob{
+		public:        encodedPublic,
+		duplicate:     duplicate,
+		encryptedSeed: encryptedSeed,
+	}, nil
+}
+
+// createSeed creates the seed from which the keys protecting the duplicate are
+// derived and encrypts it for the parent
+func createSeed(parent tpm2.Public) ([]byte, []byte, error) {
+	switch parent.Type {
+	case tpm2.AlgRSA:
+		seed := make([]byte, int(parent.RSAParameters.Symmetric.KeyBits)/8)
+		if _, err := io.ReadFull(rand.Reader, seed); err != nil {
+			return nil, nil, err
+		}
+		pubKey, err := parent.Key()
+		if err != nil {
+			return nil, nil, err
+		}
+		encryptedSeed, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pubKey.(*rsa.PublicKey), seed, []byte("DUPLICATE\x00"))
+		return seed, encryptedSeed, err
+	case tpm2.AlgECC:
+		if parent.ECCParameters.CurveID != tpm2.CurveNISTP256 {
+			return nil, nil, fmt.Errorf("TPM: parent keys on curve %v cannot be used: %w", parent.ECCParameters.CurveID, errdefs.ErrUnsupportedKey)
+		}
+		curve := ecdh.P256()
+		point := parent.ECCParameters.Point
+		pubKey, err := curve.NewPublicKey(append(append([]byte{4}, padLeft(point.XRaw, 32)...), padLeft(point.YRaw, 32)...))
+		if err != nil {
+			return nil, nil, fmt.Errorf("TPM: invalid parent key: %w", errdefs.ErrKeyMaterial)
+		}
+		ephemeral, err := curve.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		z, err := ephemeral.ECDH(pubKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		// the uncompressed point is 0x04 || x || y
+		ephemeralPoint := ephemeral.PublicKey().Bytes()
+		x, y := ephemeralPoint[1:33], ephemeralPoint[33:]
+		seed, err := tpm2.KDFe(nameAlg, z, "DUPLICATE", x, padLeft(point.XRaw, 32), sha256.Size*8)
+		if err != nil {
+			return nil, nil, err
+		}
+		encryptedSeed, err := tpmutil.Pack(tpmutil.U16Bytes(x), tpmutil.U16Bytes(y))
+		return seed, encryptedSeed, err
+	}
+	return nil, nil, fmt.Errorf("TPM: unsupported parent key type %v: %w", parent.Type, errdefs.ErrUnsupportedKey)
+}
+
+// padLeft pads b with leading zeros to size bytes; the TPM may strip them
+// from the coordinates of EC points
+func padLeft(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
@@ -0,0 +1,301 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tpm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
+	"github.com/containers/ocicrypt/keywrap"
+	"github.com/containers/ocicrypt/log"
+	"github.com/containers/ocicrypt/utils"
+	"github.com/google/go-tpm/tpm2"
+)
+
+// errUnavailable is returned in FIPS 140-only mode since importing keys into
+// a TPM relies on AES-CFB and the layer key options are sealed with AES-GCM
+// using nonces that are not generated by the FIPS module
+var errUnavailable = fmt.Errorf("TPM wrapped keys are not available in FIPS 140-only mode: %w", errdefs.ErrDisallowedAlgorithm)
+
+// sealedKeySize is the size of the AES-256-GCM key sealed to the TPM; the
+// layer key options are too large to be sealed themselves
+const sealedKeySize = 32
+
+// tpmBlob is the wrapped key; it holds the layer key encrypted for every
+// storage key
+type tpmBlob struct {
+	Version    int            `json:"version"`
+	Recipients []tpmRecipient `json:"recipients"`
+}
+
+type tpmRecipient struct {
+	// Parent is the hex SHA-256 digest of the public key of the storage key in
+	// PKIX format
+	Parent string `json:"parent"`
+	// Public, Duplicate and Seed are the TPMT_PUBLIC, TPM2B_PRIVATE and
+	// encrypted seed of the sealed object to import under the storage key
+	Public    []byte `json:"public"`
+	Duplicate []byte `json:"duplicate"`
+	Seed      []byte `json:"seed"`
+	// PCRBank and PCRs are the PCRs of the policy of the sealed object
+	PCRBank string `json:"pcrBank,omitempty"`
+	PCRs    []int  `json:"pcrs,omitempty"`
+	// Ciphertext is the nonce and the layer key options encrypted with
+	// AES-256-GCM using the sealed key
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type tpmKeyWrapper struct {
+}
+
+func (kw *tpmKeyWrapper) GetAnnotationID() string {
+	return "org.opencontainers.image.enc.keys.tpm"
+}
+
+// NewKeyWrapper returns a new key wrapping interface that seals layer keys to
+// storage keys of TPM 2.0 devices, optionally bound to PCR values
+func NewKeyWrapper() keywrap.KeyWrapper {
+	return &tpmKeyWrapper{}
+}
+
+// WrapKeys seals a key, with which the optsData are encrypted, to the storage
+// keys of the tpm-pubkeys parameter; the sealed keys are bound to the PCR
+// values of the tpm-pcrs parameter if it is set. The TPMs are not needed for
+// this.
+func (kw *tpmKeyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	pubKeys := ec.Parameters["tpm-pubkeys"]
+	// no recipients is not an error...
+	if len(pubKeys) == 0 {
+		return nil, nil
+	}
+	if fips.Enforced() {
+		return nil, errUnavailable
+	}
+	policy, err := parsePCRPolicy(ec.Parameters["tpm-pcrs"])
+	if err != nil {
+		return nil, err
+	}
+
+	blob := tpmBlob{}
+	seen := make(map[string]bool)
+	for _, pubKey := range pubKeys {
+		key, err := utils.ParsePublicKey(pubKey, "TPM")
+		if err != nil {
+			return nil, err
+		}
+		if err := ec.GetPolicy().CheckKey("TPM", key); err != nil {
+			return nil, err
+		}
+		parent, err := parentPublic(key)
+		if err != nil {
+			return nil, err
+		}
+		fp, err := fingerprint(key)
+		if err != nil {
+			return nil, err
+		}
+		if seen[fp] {
+			continue
+		}
+		seen[fp] = true
+
+		recipient, err := seal(parent, optsData, policy)
+		if err != nil {
+			return nil, err
+		}
+		recipient.Parent = fp
+		blob.Recipients = append(blob.Recipients, *recipient)
+	}
+	sort.SliceStable(blob.Recipients, func(i, j int) bool {
+		return blob.Recipients[i].Parent < blob.Recipients[j].Parent
+	})
+	return json.Marshal(&blob)
+}
+
+// seal seals a random key to the parent and encrypts the optsData with it
+func seal(parent tpm2.Public, optsData []byte, policy *pcrPolicy) (*tpmRecipient, error) {
+	sealedKey := make([]byte, sealedKeySize)
+	if _, err := io.ReadFull(rand.Reader, sealedKey); err != nil {
+		return nil, err
+	}
+	ib, err := createImportBlob(parent, sealedKey, policy)
+	if err != nil {
+		return nil, fmt.Errorf("TPM: could not seal the key: %w", err)
+	}
+	aead, err := newGCM(sealedKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	recipient := &tpmRecipient{
+		Public:     ib.public,
+		Duplicate:  ib.duplicate,
+		Seed:       ib.encryptedSeed,
+		Ciphertext: aead.Seal(nonce, nonce, optsData, ib.public),
+	}
+	if policy != nil {
+		sel := policy.selection()
+		recipient.PCRBank = policy.bank
+		recipient.PCRs = sel.PCRs
+	}
+	return recipient, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (kw *tpmKeyWrapper) UnwrapKey(dc *config.DecryptConfig, annotation []byte) ([]byte, error) {
+	optsData, _, err := kw.UnwrapKeyID(dc, annotation)
+	return optsData, err
+}
+
+// UnwrapKeyID unseals the key of the layer key options with one of the storage
+// keys of the tpm-keys parameter and returns the fingerprint of the storage key
+func (kw *tpmKeyWrapper) UnwrapKeyID(dc *config.DecryptConfig, annotation []byte) ([]byte, string, error) {
+	keys := kw.GetPrivateKeys(dc.Parameters)
+	if len(keys) == 0 {
+		return nil, "", fmt.Errorf("No storage keys found for TPM decryption: %w", errdefs.ErrNoDecryptionKey)
+	}
+	if fips.Enforced() {
+		return nil, "", errUnavailable
+	}
+
+	var blob tpmBlob
+	if err := json.Unmarshal(annotation, &blob); err != nil {
+		return nil, "", fmt.Errorf("could not parse the TPM wrapped key: %w", errdefs.ErrProtocol)
+	}
+	if blob.Version != 0 {
+		return nil, "", fmt.Errorf("unsupported TPM wrapped key version %d: %w", blob.Version, errdefs.ErrProtocol)
+	}
+	if err := dc.GetLimits().CheckRecipients(len(blob.Recipients)); err != nil {
+		return nil, "", err
+	}
+
+	var device string
+	if devices := dc.Parameters["tpm-device"]; len(devices) > 0 {
+		device = string(devices[0])
+	}
+	rw, err := openTPM(device)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rw.Close()
+
+	var loadErr error
+	for _, key := range keys {
+		parent, err := loadParent(rw, key)
+		if err != nil {
+			log.L().Debug("TPM storage key could not be loaded", log.KeyError, err)
+			loadErr = err
+			continue
+		}
+		for i := range blob.Recipients {
+			recipient := &blob.Recipients[i]
+			if recipient.Parent != parent.fingerprint {
+				continue
+			}
+			optsData, err := unsealOptsData(rw, parent, recipient)
+			if err == nil {
+				parent.close(rw)
+				return optsData, "tpm:" + parent.fingerprint, nil
+			}
+			log.L().Debug("TPM storage key could not unseal the layer key", log.KeyKeyID, parent.fingerprint, log.KeyError, err)
+		}
+		parent.close(rw)
+	}
+	if loadErr != nil {
+		return nil, "", fmt.Errorf("TPM: No storage key could unseal the layer key: %v: %w", loadErr, errdefs.ErrNoDecryptionKey)
+	}
+	return nil, "", fmt.Errorf("TPM: No storage key could unseal the layer key: %w", errdefs.ErrNoDecryptionKey)
+}
+
+// unsealOptsData unseals the key of the recipient and decrypts the layer key
+// options with it
+func unsealOptsData(rw io.ReadWriter, parent *parentKey, recipient *tpmRecipient) ([]byte, error) {
+	sealedKey, err := unseal(rw, parent, recipient)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(sealedKey)
+	if err != nil {
+		return nil, fmt.Errorf("TPM: the unsealed key is invalid: %w", errdefs.ErrIntegrity)
+	}
+	if len(recipient.Ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("TPM: the encrypted layer key is too short: %w", errdefs.ErrProtocol)
+	}
+	nonce, ciphertext := recipient.Ciphertext[:aead.NonceSize()], recipient.Ciphertext[aead.NonceSize():]
+	if len(ciphertext) > keywrap.MaxOptsDataSize+aead.Overhead() {
+		return nil, fmt.Errorf("TPM: layer key options are larger than %d bytes: %w", keywrap.MaxOptsDataSize, errdefs.ErrLimitExceeded)
+	}
+	optsData, err := aead.Open(nil, nonce, ciphertext, recipient.Public)
+	if err != nil {
+		return nil, fmt.Errorf("TPM: could not decrypt the layer key: %w", errdefs.ErrIntegrity)
+	}
+	return optsData, nil
+}
+
+func (kw *tpmKeyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
+	return len(kw.GetPrivateKeys(dcparameters)) == 0
+}
+
+// GetPrivateKeys returns the references of the storage keys since the keys
+// cannot leave the TPM
+func (kw *tpmKeyWrapper) GetPrivateKeys(dcparameters map[string][][]byte) [][]byte {
+	return dcparameters["tpm-keys"]
+}
+
+func (kw *tpmKeyWrapper) GetKeyIdsFromPacket(_ string) ([]uint64, error) {
+	return nil, nil
+}
+
+// GetRecipients returns the fingerprints of the storage keys the layer key is
+// sealed to
+func (kw *tpmKeyWrapper) GetRecipients(b64blobs string) ([]string, error) {
+	var recipients []string
+	for _, b64blob := range strings.Split(b64blobs, ",") {
+		data, err := base64.StdEncoding.DecodeString(b64blob)
+		if err != nil {
+			return nil, fmt.Errorf("could not base64 decode the TPM wrapped key: %w", errdefs.ErrProtocol)
+		}
+		var blob tpmBlob
+		if err := json.Unmarshal(data, &blob); err != nil {
+			return nil, fmt.Errorf("could not parse the TPM wrapped key: %w", errdefs.ErrProtocol)
+		}
+		for _, recipient := range blob.Recipients {
+			recipients = append(recipients, "tpm:"+recipient.Parent)
+		}
+	}
+	return recipients, nil
+}
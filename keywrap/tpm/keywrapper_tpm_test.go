@@ -0,0 +1,276 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tpm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/utils"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+var (
+	sha1Zero   = strings.Repeat("00", 20)
+	sha256Zero = strings.Repeat("00", 32)
+)
+
+func TestParsePCRPolicy(t *testing.T) {
+	policy, err := parsePCRPolicy([][]byte{[]byte("sha256:7=" + sha256Zero + ",0=0x" + sha256Zero), []byte("SHA256:4=" + sha256Zero)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sel := policy.selection()
+	if policy.bank != "sha256" || sel.Hash != tpm2.AlgSHA256 || fmt.Sprint(sel.PCRs) != "[0 4 7]" {
+		t.Fatalf("unexpected policy for bank %s and PCRs %v", policy.bank, sel.PCRs)
+	}
+	if len(policy.digest()) != sha256.Size {
+		t.Fatal("policy digest has the wrong size")
+	}
+
+	policy, err = parsePCRPolicy(nil)
+	if err != nil || policy != nil {
+		t.Fatal("no PCR values must not yield a policy")
+	}
+
+	for _, value := range []string{
+		"7=" + sha256Zero,
+		"md5:7=" + sha256Zero,
+		"sha256:7",
+		"sha256:24=" + sha256Zero,
+		"sha256:x=" + sha256Zero,
+		"sha256:7=" + sha1Zero,
+		"sha256:7=zz",
+	} {
+		if _, err := parsePCRPolicy([][]byte{[]byte(value)}); !errors.Is(err, errdefs.ErrConfiguration) {
+			t.Fatalf("PCR values %q should have been rejected: %v", value, err)
+		}
+	}
+	if _, err := parsePCRPolicy([][]byte{[]byte("sha1:7=" + sha1Zero), []byte("sha256:7=" + sha256Zero)}); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("PCR values of different banks should have been rejected: %v", err)
+	}
+}
+
+// importDuplicate does in software what TPM2_Import does with the import blob
+// and returns the sensitive area of the sealed object
+func importDuplicate(t *testing.T, priv crypto.PrivateKey, ib *importBlob) []byte {
+	var seed []byte
+	switch key := priv.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		seed, err = rsa.DecryptOAEP(sha256.New(), nil, key, ib.encryptedSeed, []byte("DUPLICATE\x00"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		var x, y tpmutil.U16Bytes
+		if _, err := tpmutil.Unpack(ib.encryptedSeed, &x, &y); err != nil {
+			t.Fatal(err)
+		}
+		ecdhKey, err := key.ECDH()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ephemeral, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		z, err := ecdhKey.ECDH(ephemeral)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seed, err = tpm2.KDFe(nameAlg, z, "DUPLICATE", x, ecdhKey.PublicKey().Bytes()[1:33], sha256.Size*8)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	public, err := tpm2.DecodePublic(ib.public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := public.Name()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedName, err := name.Digest.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the encrypted sensitive area follows the HMAC without a size
+	var integrityHMAC tpmutil.U16Bytes
+	n, err := tpmutil.Unpack(ib.duplicate, &integrityHMAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encIdentity := ib.duplicate[n:]
+
+	hmacKey, err := tpm2.KDFa(nameAlg, seed, "INTEGRITY", nil, nil, sha256.Size*8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(encIdentity)
+	mac.Write(encodedName)
+	if !hmac.Equal(mac.Sum(nil), integrityHMAC) {
+		t.Fatal("integrity HMAC of the duplicate does not match")
+	}
+
+	symKey, err := tpm2.KDFa(nameAlg, seed, "STORAGE", encodedName, nil, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(symKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sensitive := make([]byte, len(encIdentity))
+	cipher.NewCFBDecrypter(block, make([]byte, block.BlockSize())).XORKeyStream(sensitive, encIdentity)
+	var private tpmutil.U16Bytes
+	if _, err := tpmutil.Unpack(sensitive, &private); err != nil {
+		t.Fatal(err)
+	}
+	return private
+}
+
+func TestCreateImportBlob(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "importing keys into a TPM")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := parsePCRPolicy([][]byte{[]byte("sha256:7=" + sha256Zero)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, sealedKeySize)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		t.Fatal(err)
+	}
+	for _, priv := range []crypto.Signer{rsaKey, ecKey} {
+		parent, err := parentPublic(priv.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []*pcrPolicy{nil, policy} {
+			ib, err := createImportBlob(parent, data, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			private := importDuplicate(t, priv, ib)
+			// the sensitive data is the last field of TPMT_SENSITIVE
+			if !bytes.HasSuffix(private, data) {
+				t.Fatal("the sealed object does not hold the data")
+			}
+			public, err := tpm2.DecodePublic(ib.public)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p != nil && (!bytes.Equal(public.AuthPolicy, p.digest()) || public.Attributes&tpm2.FlagUserWithAuth != 0) {
+				t.Fatal("the sealed object is not bound to the PCR policy")
+			}
+		}
+	}
+
+	ecKey384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parentPublic(&ecKey384.PublicKey); !errors.Is(err, errdefs.ErrUnsupportedKey) {
+		t.Fatalf("P-384 storage keys should have been rejected: %v", err)
+	}
+	parent := srkTemplateECC()
+	parent.ECCParameters.CurveID = tpm2.CurveNISTP384
+	if _, _, err := createSeed(parent); !errors.Is(err, errdefs.ErrUnsupportedKey) {
+		t.Fatalf("P-384 parent keys should have been rejected: %v", err)
+	}
+}
+
+func TestKeyWrapTPM(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the tpm scheme")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, err := fingerprint(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := config.EncryptWithTPM([][]byte{pubKey, pubKey}, [][]byte{[]byte("sha256:7=" + sha256Zero)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kw := NewKeyWrapper()
+	optsData := []byte("layer key options")
+	annotation, err := kw.WrapKeys(cc.EncryptConfig, optsData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipients, err := kw.GetRecipients(base64.StdEncoding.EncodeToString(annotation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 1 || recipients[0] != "tpm:"+fp {
+		t.Fatalf("unexpected recipients %v", recipients)
+	}
+
+	cc, err = config.DecryptWithTPM("/dev/nonexistent-tpm", [][]byte{[]byte(KeySRK)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if kw.NoPossibleKeys(cc.DecryptConfig.Parameters) {
+		t.Fatal("the TPM keys were not found")
+	}
+	if _, _, err := kw.(*tpmKeyWrapper).UnwrapKeyID(cc.DecryptConfig, annotation); !errors.Is(err, errdefs.ErrProviderUnreachable) {
+		t.Fatalf("unwrapping without a TPM should have failed as unreachable: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package vaulttransit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/api/auth/approle"
+	"github.com/hashicorp/vault/api/auth/kubernetes"
+)
+
+const (
+	// RoleIDEnv and SecretIDEnv are the environment variables with the
+	// credentials for the AppRole auth method
+	RoleIDEnv   = "VAULT_ROLE_ID"
+	SecretIDEnv = "VAULT_SECRET_ID"
+	// AppRoleMountEnv overrides the path of the AppRole auth method
+	AppRoleMountEnv = "VAULT_APPROLE_MOUNT"
+	// KubernetesRoleEnv is the environment variable with the role for the
+	// Kubernetes auth method
+	KubernetesRoleEnv = "VAULT_K8S_ROLE"
+	// KubernetesMountEnv overrides the path of the Kubernetes auth method
+	KubernetesMountEnv = "VAULT_K8S_MOUNT"
+	// KubernetesTokenFileEnv overrides the file of the service account token
+	// used with the Kubernetes auth method
+	KubernetesTokenFileEnv = "VAULT_K8S_TOKEN_FILE"
+
+	defaultKubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	// expiryMargin is the time before their expiry at which tokens obtained
+	// by logging in are renewed by logging in again
+	expiryMargin = time.Minute
+)
+
+// vaultClient is a client of the Vault API with a token; tokens obtained by
+// logging in expire
+type vaultClient struct {
+	client  *api.Client
+	expires time.Time
+}
+
+var (
+	clientLock sync.Mutex
+	// clients are the clients by Vault address
+	clients = make(map[string]*vaultClient)
+)
+
+// getClient returns a client of the Vault API for the Vault at the address,
+// which reads VAULT_NAMESPACE, VAULT_CACERT and its other environment
+// variables. Its token is found in this order: VAULT_TOKEN, a login with the
+// AppRole of VAULT_ROLE_ID and VAULT_SECRET_ID, a login with the Kubernetes
+// auth method for the role of VAULT_K8S_ROLE and the service account token of
+// the pod and the token helper file ~/.vault-token written by 'vault login'.
+// Clients are kept until shortly before the lease of a token obtained by
+// logging in ends.
+func getClient(ctx context.Context, addr string) (*api.Client, error) {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+
+	if c := clients[addr]; c != nil && (c.expires.IsZero() || time.Now().Add(expiryMargin).Before(c.expires)) {
+		return c.client, nil
+	}
+	cfg := api.DefaultConfig()
+	if cfg.Error != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("Vault transit: %w", cfg.Error))
+	}
+	cfg.Address = addr
+	cfg.Timeout = CallTimeout
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("Vault transit: %w", err))
+	}
+
+	c := &vaultClient{client: client}
+	var method api.AuthMethod
+	switch {
+	case client.Token() != "":
+		// VAULT_TOKEN
+	case os.Getenv(RoleIDEnv) != "":
+		method, err = approle.NewAppRoleAuth(os.Getenv(RoleIDEnv), &approle.SecretID{FromEnv: SecretIDEnv},
+			approle.WithMountPath(mountPath(AppRoleMountEnv, "approle")))
+	case os.Getenv(KubernetesRoleEnv) != "":
+		tokenFile := os.Getenv(KubernetesTokenFileEnv)
+		if tokenFile == "" {
+			tokenFile = defaultKubernetesTokenFile
+		}
+		jwt, ferr := ioutil.ReadFile(tokenFile)
+		if ferr != nil {
+			return nil, errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("Vault transit: could not read the service account token: %w", ferr))
+		}
+		method, err = kubernetes.NewKubernetesAuth(os.Getenv(KubernetesRoleEnv),
+			kubernetes.WithServiceAccountToken(strings.TrimSpace(string(jwt))), kubernetes.WithMountPath(mountPath(KubernetesMountEnv, "kubernetes")))
+	default:
+		home, herr := os.UserHomeDir()
+		if herr != nil {
+			return nil, fmt.Errorf("Vault transit: no Vault token found: %w", errdefs.ErrConfiguration)
+		}
+		data, ferr := ioutil.ReadFile(filepath.Join(home, ".vault-token"))
+		if ferr != nil || len(bytes.TrimSpace(data)) == 0 {
+			return nil, fmt.Errorf("Vault transit: no Vault token found: %w", errdefs.ErrConfiguration)
+		}
+		client.SetToken(string(bytes.TrimSpace(data)))
+	}
+	if err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("Vault transit: %w", err))
+	}
+	if method != nil {
+		secret, err := client.Auth().Login(ctx, method)
+		if err != nil {
+			return nil, fmt.Errorf("Vault transit: login failed: %w", requestError(err))
+		}
+		if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+			return nil, fmt.Errorf("Vault transit: login returned no token: %w", errdefs.ErrProtocol)
+		}
+		if secret.Auth.LeaseDuration > 0 {
+			c.expires = time.Now().Add(time.Duration(secret.Auth.LeaseDuration) * time.Second)
+		}
+	}
+	clients[addr] = c
+	return client, nil
+}
+
+// forgetClient drops the client of the Vault at the address after Vault
+// refused its token, for example because it was revoked
+func forgetClient(addr string) {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	delete(clients, addr)
+}
+
+// mountPath returns the path of an auth method, which the environment
+// variable may override
+func mountPath(env, def string) string {
+	if path := strings.Trim(os.Getenv(env), "/"); path != "" {
+		return path
+	}
+	return def
+}
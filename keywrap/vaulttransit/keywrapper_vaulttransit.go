@@ -0,0 +1,309 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package vaulttransit
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/keywrap"
+	"github.com/containers/ocicrypt/log"
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	// CallTimeout is the time Vault has for encrypting or decrypting a layer
+	// key, including logging in
+	CallTimeout = 10 * time.Second
+	// URIScheme is the prefix of the key references in recipient strings, as
+	// in vault-transit://vault.example.com:8200/transit/keys/layers
+	URIScheme = "vault-transit://"
+)
+
+// vaultTransitBlob is the wrapped key; it holds the layer key encrypted by
+// every transit key
+type vaultTransitBlob struct {
+	Version    int                     `json:"version"`
+	Recipients []vaultTransitRecipient `json:"recipients"`
+}
+
+type vaultTransitRecipient struct {
+	// Key is the reference of the transit key without the URI scheme, as in
+	// vault.example.com:8200/transit/keys/layers
+	Key string `json:"key"`
+	// Ciphertext is the vault:v<version>:... ciphertext of the transit engine
+	Ciphertext string `json:"ciphertext"`
+}
+
+// keyRef is the parsed reference of a transit key
+type keyRef struct {
+	ref string
+	// addr is the address of Vault, as in https://vault.example.com:8200
+	addr  string
+	mount string
+	name  string
+}
+
+type vaultTransitKeyWrapper struct {
+}
+
+func (kw *vaultTransitKeyWrapper) GetAnnotationID() string {
+	return "org.opencontainers.image.enc.keys.vault-transit"
+}
+
+// NewKeyWrapper returns a new key wrapping interface that encrypts layer keys
+// with keys of the transit secrets engine of HashiCorp Vault
+func NewKeyWrapper() keywrap.KeyWrapper {
+	return &vaultTransitKeyWrapper{}
+}
+
+// WrapKeys has the transit keys of the vault-transit-keys parameter encrypt the
+// optsData, which describe the symmetric key used for encrypting the layer
+func (kw *vaultTransitKeyWrapper) WrapKeys(ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	return kw.WrapKeysContext(context.Background(), ec, optsData)
+}
+
+// WrapKeysContext wraps the layer key like WrapKeys, giving up once ctx is done
+func (kw *vaultTransitKeyWrapper) WrapKeysContext(ctx context.Context, ec *config.EncryptConfig, optsData []byte) ([]byte, error) {
+	keys, err := parseKeyRefs(ec.Parameters["vault-transit-keys"])
+	if err != nil {
+		return nil, err
+	}
+	// no recipients is not an error...
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	blob := vaultTransitBlob{}
+	for _, key := range keys {
+		callCtx, cancel := context.WithTimeout(ctx, CallTimeout)
+		data, err := call(callCtx, key, "encrypt", map[string]interface{}{
+			"plaintext": base64.StdEncoding.EncodeToString(optsData),
+		})
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("Vault transit encryption with %s failed: %w", key.ref, err)
+		}
+		ciphertext, _ := data["ciphertext"].(string)
+		if !strings.HasPrefix(ciphertext, "vault:") {
+			return nil, fmt.Errorf("Vault returned no ciphertext for %s: %w", key.ref, errdefs.ErrProtocol)
+		}
+		blob.Recipients = append(blob.Recipients, vaultTransitRecipient{
+			Key:        key.ref,
+			Ciphertext: ciphertext,
+		})
+	}
+	sort.SliceStable(blob.Recipients, func(i, j int) bool {
+		return blob.Recipients[i].Key < blob.Recipients[j].Key
+	})
+	return json.Marshal(&blob)
+}
+
+func (kw *vaultTransitKeyWrapper) UnwrapKey(dc *config.DecryptConfig, annotation []byte) ([]byte, error) {
+	optsData, _, err := kw.UnwrapKeyID(dc, annotation)
+	return optsData, err
+}
+
+// UnwrapKeyID has the transit keys of the vault-transit-keys parameter decrypt
+// the symmetric key with which the layer is encrypted and returns the
+// reference of the transit key that decrypted it
+func (kw *vaultTransitKeyWrapper) UnwrapKeyID(dc *config.DecryptConfig, annotation []byte) ([]byte, string, error) {
+	return kw.UnwrapKeyIDContext(context.Background(), dc, annotation)
+}
+
+// UnwrapKeyIDContext unwraps the layer key like UnwrapKeyID, giving up once
+// ctx is done
+func (kw *vaultTransitKeyWrapper) UnwrapKeyIDContext(ctx context.Context, dc *config.DecryptConfig, annotation []byte) ([]byte, string, error) {
+	keys, err := parseKeyRefs(kw.GetPrivateKeys(dc.Parameters))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(keys) == 0 {
+		return nil, "", fmt.Errorf("No transit keys found for Vault transit decryption: %w", errdefs.ErrNoDecryptionKey)
+	}
+
+	var blob vaultTransitBlob
+	if err := json.Unmarshal(annotation, &blob); err != nil {
+		return nil, "", fmt.Errorf("could not parse the Vault transit wrapped key: %w", errdefs.ErrProtocol)
+	}
+	if blob.Version != 0 {
+		return nil, "", fmt.Errorf("unsupported Vault transit wrapped key version %d: %w", blob.Version, errdefs.ErrProtocol)
+	}
+	if err := dc.GetLimits().CheckRecipients(len(blob.Recipients)); err != nil {
+		return nil, "", err
+	}
+
+	var unreachableErr error
+	for _, key := range keys {
+		for _, recipient := range blob.Recipients {
+			if recipient.Key != key.ref {
+				continue
+			}
+			callCtx, cancel := context.WithTimeout(ctx, CallTimeout)
+			data, err := call(callCtx, key, "decrypt", map[string]interface{}{
+				"ciphertext": recipient.Ciphertext,
+			})
+			cancel()
+			var optsData []byte
+			if err == nil {
+				plaintext, _ := data["plaintext"].(string)
+				if optsData, err = base64.StdEncoding.DecodeString(plaintext); err != nil {
+					err = fmt.Errorf("Vault returned an invalid plaintext: %w", errdefs.ErrProtocol)
+				}
+			}
+			if err == nil {
+				if len(optsData) > keywrap.MaxOptsDataSize {
+					return nil, "", fmt.Errorf("Vault transit: layer key options are larger than %d bytes: %w", keywrap.MaxOptsDataSize, errdefs.ErrLimitExceeded)
+				}
+				return optsData, "vault-transit:" + recipient.Key, nil
+			}
+			log.L().Debug("Vault transit could not decrypt the layer key", log.KeyKeyID, recipient.Key, log.KeyError, err)
+			if errors.Is(err, errdefs.ErrProviderUnreachable) {
+				unreachableErr = err
+			}
+		}
+	}
+	if unreachableErr != nil {
+		return nil, "", fmt.Errorf("Vault transit: No transit key could decrypt the layer key: %w", unreachableErr)
+	}
+	return nil, "", fmt.Errorf("Vault transit: No transit key could decrypt the layer key: %w", errdefs.ErrNoDecryptionKey)
+}
+
+func (kw *vaultTransitKeyWrapper) NoPossibleKeys(dcparameters map[string][][]byte) bool {
+	return len(kw.GetPrivateKeys(dcparameters)) == 0
+}
+
+// GetPrivateKeys returns the references of the transit keys since the keys
+// cannot leave Vault
+func (kw *vaultTransitKeyWrapper) GetPrivateKeys(dcparameters map[string][][]byte) [][]byte {
+	return dcparameters["vault-transit-keys"]
+}
+
+func (kw *vaultTransitKeyWrapper) GetKeyIdsFromPacket(_ string) ([]uint64, error) {
+	return nil, nil
+}
+
+// GetRecipients returns the references of the transit keys the layer key is
+// encrypted with
+func (kw *vaultTransitKeyWrapper) GetRecipients(b64blobs string) ([]string, error) {
+	var recipients []string
+	for _, b64blob := range strings.Split(b64blobs, ",") {
+		data, err := base64.StdEncoding.DecodeString(b64blob)
+		if err != nil {
+			return nil, fmt.Errorf("could not base64 decode the Vault transit wrapped key: %w", errdefs.ErrProtocol)
+		}
+		var blob vaultTransitBlob
+		if err := json.Unmarshal(data, &blob); err != nil {
+			return nil, fmt.Errorf("could not parse the Vault transit wrapped key: %w", errdefs.ErrProtocol)
+		}
+		for _, recipient := range blob.Recipients {
+			recipients = append(recipients, "vault-transit:"+recipient.Key)
+		}
+	}
+	return recipients, nil
+}
+
+// parseKeyRefs parses references of transit keys of the form
+// [vault-transit://]<host>[:<port>]/<mount path>/keys/<key name>; Vault is
+// called with https unless VAULT_ADDR has the same host with another scheme.
+// Duplicates are dropped.
+func parseKeyRefs(values [][]byte) ([]keyRef, error) {
+	var keys []keyRef
+	seen := make(map[string]bool)
+	for _, value := range values {
+		ref := strings.TrimPrefix(string(value), URIScheme)
+		idx := strings.LastIndex(ref, "/keys/")
+		slash := strings.Index(ref, "/")
+		if idx <= slash || slash <= 0 || strings.HasSuffix(ref, "/keys/") || strings.Contains(ref[idx+len("/keys/"):], "/") {
+			return nil, fmt.Errorf("Vault transit: %q is not the reference of a transit key: %w", value, errdefs.ErrConfiguration)
+		}
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		host := ref[:slash]
+		addr := "https://" + host
+		if u, err := url.Parse(os.Getenv("VAULT_ADDR")); err == nil && u.Host == host && u.Scheme != "" {
+			addr = u.Scheme + "://" + host
+		}
+		keys = append(keys, keyRef{
+			ref:   ref,
+			addr:  addr,
+			mount: ref[slash+1 : idx],
+			name:  ref[idx+len("/keys/"):],
+		})
+	}
+	return keys, nil
+}
+
+// call calls the encrypt or decrypt endpoint of the transit key and returns
+// the data of the response; a client whose token Vault refuses is dropped
+func call(ctx context.Context, key keyRef, operation string, req map[string]interface{}) (map[string]interface{}, error) {
+	client, err := getClient(ctx, key.addr)
+	if err != nil {
+		return nil, err
+	}
+	path := key.mount + "/" + operation + "/" + url.PathEscape(key.name)
+	secret, err := client.Logical().WriteWithContext(ctx, path, req)
+	var respErr *api.ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusForbidden {
+		forgetClient(key.addr)
+	}
+	if err != nil {
+		err = requestError(err)
+		if operation == "decrypt" && !errors.Is(err, errdefs.ErrProviderUnreachable) {
+			return nil, errdefs.WithCategory(errdefs.ErrNoDecryptionKey, err)
+		}
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("Vault returned no data: %w", errdefs.ErrProtocol)
+	}
+	return secret.Data, nil
+}
+
+// requestError categorizes an error of the Vault API client
+func requestError(err error) error {
+	var respErr *api.ResponseError
+	switch {
+	case errors.As(err, &respErr):
+		// Vault is sealed, in standby without forwarding or rate limiting
+		if respErr.StatusCode >= 500 || respErr.StatusCode == http.StatusTooManyRequests {
+			return errdefs.WithCategory(errdefs.ErrProviderUnreachable, err)
+		}
+		return errdefs.WithCategory(errdefs.ErrConfiguration, err)
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("could not call Vault: %v: %w", err, errdefs.ErrProviderUnreachable)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return fmt.Errorf("could not call Vault: %v: %w", err, errdefs.ErrProviderUnreachable)
+	}
+	return errdefs.WithCategory(errdefs.ErrConfiguration, err)
+}
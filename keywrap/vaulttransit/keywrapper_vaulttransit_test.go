@@ -0,0 +1,242 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package vaulttransit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+const testToken = "hvs.test"
+
+// fakeVault is a Vault whose transit keys 'encrypt' by prefixing the plaintext
+// with the key name
+type fakeVault struct {
+	sealed bool
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.sealed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"errors":["Vault is sealed"]}`))
+		return
+	}
+	var req map[string]string
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	switch r.URL.Path {
+	case "/v1/auth/approle/login":
+		if req["role_id"] != "role" || req["secret_id"] != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errors":["invalid role or secret ID"]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"auth":{"client_token":"` + testToken + `","lease_duration":3600}}`))
+		return
+	case "/v1/auth/kubernetes/login":
+		if req["role"] != "puller" || req["jwt"] != "k8s-token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"auth":{"client_token":"` + testToken + `","lease_duration":3600}}`))
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != testToken {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/transit/"), "/")
+	if len(parts) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	name := parts[1]
+	var resp interface{}
+	switch parts[0] {
+	case "encrypt":
+		plaintext, _ := base64.StdEncoding.DecodeString(req["plaintext"])
+		resp = map[string]interface{}{"data": map[string]string{
+			"ciphertext": "vault:v1:" + base64.StdEncoding.EncodeToString(append([]byte(name+"|"), plaintext...)),
+		}}
+	case "decrypt":
+		ciphertext, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(req["ciphertext"], "vault:v1:"))
+		if !bytes.HasPrefix(ciphertext, []byte(name+"|")) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errors":["cipher: message authentication failed"]}`))
+			return
+		}
+		resp = map[string]interface{}{"data": map[string]string{
+			"plaintext": base64.StdEncoding.EncodeToString(ciphertext[len(name)+1:]),
+		}}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// setupFakeVault returns the host of Vault
+func setupFakeVault(t *testing.T) (*fakeVault, string) {
+	fv := &fakeVault{}
+	srv := httptest.NewServer(fv)
+	t.Cleanup(srv.Close)
+	t.Setenv("VAULT_ADDR", srv.URL)
+	t.Setenv("VAULT_TOKEN", testToken)
+	t.Setenv(RoleIDEnv, "")
+	t.Setenv(KubernetesRoleEnv, "")
+	clients = make(map[string]*vaultClient)
+	return fv, strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestKeyWrapVaultTransitSuccess(t *testing.T) {
+	_, host := setupFakeVault(t)
+
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"vault-transit-keys": {[]byte(URIScheme + host + "/transit/keys/layers"), []byte(host + "/transit/keys/backup")},
+		},
+	}
+	wk, err := kw.WrapKeys(ec, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{host + "/transit/keys/layers", URIScheme + host + "/transit/keys/backup"} {
+		dc := &config.DecryptConfig{
+			Parameters: map[string][][]byte{
+				"vault-transit-keys": {[]byte(key)},
+			},
+		}
+		ud, keyID, err := kw.(*vaultTransitKeyWrapper).UnwrapKeyID(dc, wk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, ud) {
+			t.Fatal("Strings don't match")
+		}
+		if keyID != "vault-transit:"+strings.TrimPrefix(key, URIScheme) {
+			t.Fatalf("unexpected key ID %s", keyID)
+		}
+	}
+
+	recipients, err := kw.GetRecipients(base64.StdEncoding.EncodeToString(wk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 2 || recipients[0] != "vault-transit:"+host+"/transit/keys/backup" {
+		t.Fatalf("unexpected recipients %v", recipients)
+	}
+}
+
+func TestKeyWrapVaultTransitLogin(t *testing.T) {
+	_, host := setupFakeVault(t)
+	t.Setenv("VAULT_TOKEN", "")
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("k8s-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	kw := NewKeyWrapper()
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"vault-transit-keys": {[]byte(host + "/transit/keys/layers")},
+		},
+	}
+	for _, env := range [][2]string{{RoleIDEnv, "role"}, {KubernetesRoleEnv, "puller"}} {
+		t.Setenv(RoleIDEnv, "")
+		t.Setenv(SecretIDEnv, "secret")
+		t.Setenv(KubernetesTokenFileEnv, tokenFile)
+		t.Setenv(env[0], env[1])
+		clients = make(map[string]*vaultClient)
+		if _, err := kw.WrapKeys(ec, []byte("This is some secret text")); err != nil {
+			t.Fatalf("%s: %v", env[0], err)
+		}
+	}
+
+	t.Setenv(KubernetesRoleEnv, "other")
+	clients = make(map[string]*vaultClient)
+	if _, err := kw.WrapKeys(ec, []byte("This is some secret text")); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+}
+
+func TestKeyWrapVaultTransitInvalid(t *testing.T) {
+	fv, host := setupFakeVault(t)
+
+	kw := NewKeyWrapper()
+	data := []byte("This is some secret text")
+	ec := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"vault-transit-keys": {[]byte(host + "/transit/keys/layers")},
+		},
+	}
+	wk, err := kw.WrapKeys(ec, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"vault-transit-keys": {[]byte(host + "/transit/keys/other")},
+		},
+	}
+	if _, err := kw.UnwrapKey(dc, wk); !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+		t.Fatalf("expected ErrNoDecryptionKey, got %v", err)
+	}
+
+	// a ciphertext that the key does not decrypt
+	var blob vaultTransitBlob
+	if err := json.Unmarshal(wk, &blob); err != nil {
+		t.Fatal(err)
+	}
+	blob.Recipients[0].Ciphertext = "vault:v1:" + base64.StdEncoding.EncodeToString([]byte("other|"))
+	badWk, err := json.Marshal(&blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc.Parameters["vault-transit-keys"] = [][]byte{[]byte(host + "/transit/keys/layers")}
+	if _, err := kw.UnwrapKey(dc, badWk); !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+		t.Fatalf("expected ErrNoDecryptionKey, got %v", err)
+	}
+
+	fv.sealed = true
+	if _, err := kw.UnwrapKey(dc, wk); !errors.Is(err, errdefs.ErrProviderUnreachable) {
+		t.Fatalf("expected ErrProviderUnreachable, got %v", err)
+	}
+
+	for _, key := range []string{host, host + "/transit/keys/", "/transit/keys/layers", host + "/keys/layers/1"} {
+		ec.Parameters["vault-transit-keys"] = [][]byte{[]byte(key)}
+		if _, err := kw.WrapKeys(ec, data); !errors.Is(err, errdefs.ErrConfiguration) {
+			t.Fatalf("expected ErrConfiguration for %s, got %v", key, err)
+		}
+	}
+}
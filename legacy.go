@@ -0,0 +1,156 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ocicrypt
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/containers/ocicrypt/blockcipher"
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/log"
+	"github.com/containers/ocicrypt/policy"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// legacySymmetricKey holds the symmetric key of the private options wrapped
+// by early versions of imgcrypt, whose JSON used the names of the fields; the
+// other fields match the current ones since encoding/json ignores the case
+type legacySymmetricKey struct {
+	SymmetricKey []byte `json:"SymmetricKey"`
+}
+
+// getLayerOptsData returns the private and public options of the block cipher
+// of the layer whose unwrapped private options are privOptsData; the options
+// of layers in the legacy layout are converted to the current one if the
+// policy of the DecryptConfig allows it
+func getLayerOptsData(dc *config.DecryptConfig, desc ocispec.Descriptor, privOptsData []byte) ([]byte, []byte, error) {
+	privOptsData, pubOptsData, legacy, err := convertLegacyOptsData(desc, privOptsData)
+	if err != nil || !legacy {
+		return privOptsData, pubOptsData, err
+	}
+	if err := dc.GetPolicy().Check("annotations", policy.LegacyLayout); err != nil {
+		return nil, nil, err
+	}
+	log.L().Debug("converted layer options from the legacy layout", log.KeyLayerDigest, desc.Digest)
+	return privOptsData, pubOptsData, nil
+}
+
+// convertLegacyOptsData converts the private options and the public options of
+// the layer to the current layout and returns true if they were in the legacy
+// layout. In the legacy layout the layer has no public options, the layer was
+// encrypted with AES_256_CTR_HMAC_SHA256 and the HMAC is one of the private
+// cipher options.
+func convertLegacyOptsData(desc ocispec.Descriptor, privOptsData []byte) ([]byte, []byte, bool, error) {
+	pubOptsData, err := getLayerPubOpts(desc)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	opts, err := getLayerBlockCipherOptions(privOptsData, pubOptsData)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	legacy := false
+	if len(opts.Private.SymmetricKey) == 0 {
+		var lsk legacySymmetricKey
+		if err := json.Unmarshal(privOptsData, &lsk); err == nil && len(lsk.SymmetricKey) > 0 {
+			opts.Private.SymmetricKey = lsk.SymmetricKey
+			legacy = true
+		}
+	}
+	if _, ok := desc.Annotations["org.opencontainers.image.enc.pubopts"]; !ok {
+		opts.Public = blockcipher.PublicLayerBlockCipherOptions{
+			CipherType: blockcipher.AES256CTR,
+			Hmac:       opts.Private.CipherOptions["hmac"],
+		}
+		delete(opts.Private.CipherOptions, "hmac")
+		legacy = true
+	}
+	if !legacy {
+		return privOptsData, pubOptsData, false, nil
+	}
+
+	if privOptsData, err = json.Marshal(opts.Private); err != nil {
+		return nil, nil, false, fmt.Errorf("could not JSON marshal opts: %w", err)
+	}
+	if pubOptsData, err = json.Marshal(opts.Public); err != nil {
+		return nil, nil, false, fmt.Errorf("could not JSON marshal opts: %w", err)
+	}
+	return privOptsData, pubOptsData, true, nil
+}
+
+// MigrateAnnotations rewrites the annotations of a layer encrypted by an early
+// version of imgcrypt to the current layout and returns the new encryption
+// annotations of the layer. Since all wrapped keys of such a layer hold the
+// private options in the legacy layout, the layer key is unwrapped with the
+// DecryptConfig of the EncryptConfig and wrapped for the recipients of the
+// EncryptConfig, which replace the old recipients; the blob of the layer does
+// not change. The encryption annotations of layers in the current layout are
+// returned as they are. Migrating is not subject to the LegacyLayout policy.
+func MigrateAnnotations(ec *config.EncryptConfig, desc ocispec.Descriptor) (map[string]string, error) {
+	annotations, err := migrateAnnotations(ec, desc)
+	return annotations, newLayerError(desc.Digest, "", err)
+}
+
+func migrateAnnotations(ec *config.EncryptConfig, desc ocispec.Descriptor) (map[string]string, error) {
+	if ec == nil {
+		return nil, fmt.Errorf("EncryptConfig must not be nil: %w", errdefs.ErrConfiguration)
+	}
+	release, err := acquireLayerSlot(context.Background(), ec.GetLimits())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	ctx := context.Background()
+	privOptsData, err := decryptLayerKeyOptsData(ctx, &ec.DecryptConfig, desc)
+	if err != nil {
+		return nil, err
+	}
+	privOptsData, pubOptsData, legacy, err := convertLegacyOptsData(desc, privOptsData)
+	if err != nil {
+		return nil, err
+	}
+	if !legacy {
+		annotations := make(map[string]string)
+		for k, v := range desc.Annotations {
+			if strings.HasPrefix(k, "org.opencontainers.image.enc.") {
+				annotations[k] = v
+			}
+		}
+		return annotations, nil
+	}
+
+	newAnnotations, err := wrapKeys(ctx, ec, desc.Digest, nil, privOptsData)
+	if err != nil {
+		return nil, err
+	}
+	if len(newAnnotations) == 0 {
+		return nil, fmt.Errorf("no encryptor found to handle encryption: %w", errdefs.ErrConfiguration)
+	}
+	newAnnotations["org.opencontainers.image.enc.pubopts"] = base64.StdEncoding.EncodeToString(pubOptsData)
+	if err := checkLimits(ec.GetLimits(), newAnnotations); err != nil {
+		return nil, err
+	}
+	log.L().Info("migrated layer annotations from the legacy layout", log.KeyLayerDigest, desc.Digest)
+	return newAnnotations, nil
+}
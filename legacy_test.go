@@ -0,0 +1,128 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ocicrypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/containers/ocicrypt/blockcipher"
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/policy"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// createLegacyLayer encrypts the data like early versions of imgcrypt did
+func createLegacyLayer(t *testing.T, data []byte) ([]byte, ocispec.Descriptor) {
+	lbch, err := blockcipher.NewLayerBlockCipherHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayerReader, fin, err := lbch.Encrypt(bytes.NewReader(data), blockcipher.AES256CTR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayer, err := ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := fin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyOptsData, err := json.Marshal(struct {
+		SymmetricKey  []byte
+		Digest        digest.Digest
+		CipherOptions map[string][]byte
+	}{
+		SymmetricKey: opts.Private.SymmetricKey,
+		Digest:       digest.FromBytes(data),
+		CipherOptions: map[string][]byte{
+			"nonce": opts.Private.CipherOptions["nonce"],
+			"hmac":  opts.Public.Hmac,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := GetKeyWrapper("jwe").WrapKeys(ec, legacyOptsData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encLayer, ocispec.Descriptor{
+		Digest: digest.FromBytes(encLayer),
+		Annotations: map[string]string{
+			"org.opencontainers.image.enc.keys.jwe": base64.StdEncoding.EncodeToString(wrapped),
+		},
+	}
+}
+
+func TestDecryptLegacyLayer(t *testing.T) {
+	data := []byte("This is some text!")
+	encLayer, desc := createLegacyLayer(t, data)
+
+	decrypt := func(dc *config.DecryptConfig, desc ocispec.Descriptor) error {
+		decLayerReader, _, err := DecryptLayer(dc, bytes.NewReader(encLayer), desc, false)
+		if err != nil {
+			return err
+		}
+		decLayer, err := ioutil.ReadAll(decLayerReader)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(decLayer, data) {
+			t.Fatal("decrypted layer does not match the original")
+		}
+		return nil
+	}
+	if err := decrypt(dc, desc); err != nil {
+		t.Fatal(err)
+	}
+
+	strictDc := *dc
+	// the test key wraps with RSA-OAEP using SHA-1
+	strictDc.Policy = &policy.Policy{AllowedLegacyAlgorithms: []policy.Algorithm{policy.RSAOAEPSHA1}}
+	if err := decrypt(&strictDc, desc); !errors.Is(err, ErrDisallowedAlgorithm) {
+		t.Fatalf("expected ErrDisallowedAlgorithm, got %v", err)
+	}
+
+	annotations, err := MigrateAnnotations(ec, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if annotations["org.opencontainers.image.enc.pubopts"] == "" {
+		t.Fatalf("migrated annotations %v lack the public options", annotations)
+	}
+	migratedDesc := ocispec.Descriptor{Digest: desc.Digest, Annotations: annotations}
+	if err := decrypt(&strictDc, migratedDesc); err != nil {
+		t.Fatal(err)
+	}
+
+	// layers in the current layout keep their annotations
+	again, err := MigrateAnnotations(ec, migratedDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != len(annotations) || again["org.opencontainers.image.enc.keys.jwe"] != annotations["org.opencontainers.image.enc.keys.jwe"] {
+		t.Fatal("annotations in the current layout were changed")
+	}
+}
@@ -0,0 +1,127 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package limits defines the limits that bound the resources used for
+// processing the encryption metadata of untrusted images.
+package limits
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+// Limits bounds the resources used for encrypting and decrypting layers; a
+// value of 0 means that there is no limit. The built-in limits of the parsers,
+// such as keywrap.MaxWrappedKeySize, apply in any case. A Limits must not be
+// copied after first use.
+type Limits struct {
+	// MaxAnnotationBytes is the maximum total size in bytes of the
+	// encryption annotations of a layer
+	MaxAnnotationBytes int64
+	// MaxRecipients is the maximum number of wrapped keys of a layer and
+	// the maximum number of recipients of a single jwe or pgp wrapped key
+	MaxRecipients int
+	// MaxWrappedKeySize is the maximum size in bytes of a single wrapped key
+	MaxWrappedKeySize int
+	// MaxConcurrentLayers is the maximum number of layers whose keys are
+	// wrapped or unwrapped or whose data is encrypted or decrypted at the
+	// same time; further layers wait until one of them is done. A layer
+	// holds its slot from the creation of its reader until the reader is
+	// read to the end, fails or is closed.
+	MaxConcurrentLayers int
+
+	once sync.Once
+	sem  chan struct{}
+}
+
+// CheckAnnotationBytes returns an error wrapping errdefs.ErrLimitExceeded if
+// the encryption annotations of a layer are larger than MaxAnnotationBytes
+func (l *Limits) CheckAnnotationBytes(n int64) error {
+	if l.MaxAnnotationBytes > 0 && n > l.MaxAnnotationBytes {
+		return fmt.Errorf("encryption annotations of %d bytes are larger than the maximum of %d bytes: %w", n, l.MaxAnnotationBytes, errdefs.ErrLimitExceeded)
+	}
+	return nil
+}
+
+// CheckRecipients returns an error wrapping errdefs.ErrLimitExceeded if there
+// are more than MaxRecipients wrapped keys or recipients
+func (l *Limits) CheckRecipients(n int) error {
+	if l.MaxRecipients > 0 && n > l.MaxRecipients {
+		return fmt.Errorf("%d recipients are more than the maximum of %d: %w", n, l.MaxRecipients, errdefs.ErrLimitExceeded)
+	}
+	return nil
+}
+
+// CheckWrappedKeySize returns an error wrapping errdefs.ErrLimitExceeded if a
+// wrapped key is larger than MaxWrappedKeySize
+func (l *Limits) CheckWrappedKeySize(n int) error {
+	if l.MaxWrappedKeySize > 0 && n > l.MaxWrappedKeySize {
+		return fmt.Errorf("wrapped key is larger than the maximum of %d bytes: %w", l.MaxWrappedKeySize, errdefs.ErrLimitExceeded)
+	}
+	return nil
+}
+
+// Acquire waits until fewer than MaxConcurrentLayers layers are processed and
+// returns the function that must be called once the layer is done; calling it
+// more than once has no effect. If ctx is done first, the error of ctx is
+// returned.
+func (l *Limits) Acquire(ctx context.Context) (func(), error) {
+	if l.MaxConcurrentLayers <= 0 {
+		return func() {}, nil
+	}
+	l.once.Do(func() {
+		l.sem = make(chan struct{}, l.MaxConcurrentLayers)
+	})
+	select {
+	case l.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for a slot of the %d concurrently processed layers: %w", l.MaxConcurrentLayers, ctx.Err())
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.sem
+		})
+	}, nil
+}
+
+var (
+	limitsLock sync.RWMutex
+	limits     = &Limits{}
+)
+
+// SetLimits sets the global Limits that are used when a configuration does not
+// carry its own; passing nil restores the default, which has no limits
+func SetLimits(l *Limits) {
+	limitsLock.Lock()
+	defer limitsLock.Unlock()
+
+	if l == nil {
+		l = &Limits{}
+	}
+	limits = l
+}
+
+// L returns the global Limits
+func L() *Limits {
+	limitsLock.RLock()
+	defer limitsLock.RUnlock()
+
+	return limits
+}
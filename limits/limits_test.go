@@ -0,0 +1,138 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package limits
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+func TestLimitsCheck(t *testing.T) {
+	l := &Limits{}
+	if err := l.CheckAnnotationBytes(1 << 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CheckRecipients(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CheckWrappedKeySize(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+
+	l = &Limits{
+		MaxAnnotationBytes: 100,
+		MaxRecipients:      2,
+		MaxWrappedKeySize:  10,
+	}
+	if err := l.CheckAnnotationBytes(100); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CheckAnnotationBytes(101); !errors.Is(err, errdefs.ErrLimitExceeded) {
+		t.Fatalf("Expected ErrLimitExceeded, got %v", err)
+	}
+	if err := l.CheckRecipients(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CheckRecipients(3); !errors.Is(err, errdefs.ErrLimitExceeded) {
+		t.Fatalf("Expected ErrLimitExceeded, got %v", err)
+	}
+	if err := l.CheckWrappedKeySize(10); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CheckWrappedKeySize(11); !errors.Is(err, errdefs.ErrLimitExceeded) {
+		t.Fatalf("Expected ErrLimitExceeded, got %v", err)
+	}
+}
+
+func TestLimitsAcquire(t *testing.T) {
+	l := &Limits{MaxConcurrentLayers: 2}
+
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := l.Acquire(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer release()
+
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning > 2 {
+		t.Fatalf("%d layers were processed concurrently", maxRunning)
+	}
+}
+
+func TestLimitsAcquireContext(t *testing.T) {
+	l := &Limits{MaxConcurrentLayers: 1}
+
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Acquire(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	// releasing twice must not free a slot held by another layer
+	release()
+	release()
+	release, err = l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	SetLimits(&Limits{MaxRecipients: 1})
+	if L().MaxRecipients != 1 {
+		t.Fatal("Global limits were not set")
+	}
+	SetLimits(nil)
+	if L().MaxRecipients != 0 {
+		t.Fatal("Global limits were not reset")
+	}
+}
@@ -0,0 +1,78 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package log
+
+import (
+	"sync"
+)
+
+// Well-known keys for the structured fields passed to a Logger
+const (
+	// KeyLayerDigest is the key for the digest of the layer being processed
+	KeyLayerDigest = "layer-digest"
+	// KeyKeyWrapper is the key for the keywrap scheme (jwe, pgp, pkcs7, ...)
+	KeyKeyWrapper = "keywrapper"
+	// KeyProvider is the key for the provider of a key, such as a pkcs11 module
+	KeyProvider = "provider"
+	// KeyKeyID is the key for the identifier of the private key that was used
+	KeyKeyID = "key-id"
+	// KeyError is the key for an error that is logged at debug level
+	KeyError = "error"
+)
+
+// Logger is the interface ocicrypt uses for logging. The keysAndValues are
+// alternating keys and values in the style of logr and log/slog, so that
+// embedders can route the messages into their own logging pipeline.
+type Logger interface {
+	// Debug logs a message that is only of interest when troubleshooting
+	Debug(msg string, keysAndValues ...interface{})
+	// Info logs a general informational message
+	Info(msg string, keysAndValues ...interface{})
+	// Error logs an error along with a message
+	Error(err error, msg string, keysAndValues ...interface{})
+}
+
+type noopLogger struct{}
+
+func (noopLogger) Debug(string, ...interface{})        {}
+func (noopLogger) Info(string, ...interface{})         {}
+func (noopLogger) Error(error, string, ...interface{}) {}
+
+var (
+	loggerLock sync.RWMutex
+	logger     Logger = noopLogger{}
+)
+
+// SetLogger sets the Logger used by ocicrypt; passing nil restores the
+// default logger that discards all messages
+func SetLogger(l Logger) {
+	loggerLock.Lock()
+	defer loggerLock.Unlock()
+
+	if l == nil {
+		l = noopLogger{}
+	}
+	logger = l
+}
+
+// L returns the Logger currently used by ocicrypt
+func L() Logger {
+	loggerLock.RLock()
+	defer loggerLock.RUnlock()
+
+	return logger
+}
@@ -0,0 +1,46 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package log
+
+import (
+	"testing"
+)
+
+type testLogger struct {
+	noopLogger
+	msgs []string
+}
+
+func (tl *testLogger) Debug(msg string, keysAndValues ...interface{}) {
+	tl.msgs = append(tl.msgs, msg)
+}
+
+func TestSetLogger(t *testing.T) {
+	tl := &testLogger{}
+	SetLogger(tl)
+	defer SetLogger(nil)
+
+	L().Debug("hello", KeyKeyWrapper, "jwe")
+	if len(tl.msgs) != 1 || tl.msgs[0] != "hello" {
+		t.Fatalf("Expected logger to receive message, got %v", tl.msgs)
+	}
+
+	SetLogger(nil)
+	if _, ok := L().(noopLogger); !ok {
+		t.Fatal("Expected SetLogger(nil) to restore the no-op logger")
+	}
+}
@@ -0,0 +1,242 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ocicrypt
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/containers/ocicrypt/blockcipher"
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/log"
+	"github.com/containers/ocicrypt/masterkey"
+	"github.com/containers/ocicrypt/metrics"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// derivedKey is the master key of the image and the index of the layer from
+// which the layer key is derived
+type derivedKey struct {
+	masterKey []byte
+	index     int
+}
+
+// EncryptLayerWithMasterKey encrypts the layer like EncryptLayer, but with a
+// key derived from the master key of the image and the index of the layer in
+// the manifest instead of a random key wrapped for every recipient. The
+// finalizer returns the annotations of the layer, which do not hold wrapped
+// keys; EncryptMasterKey wraps the master key for the recipients once for the
+// whole image. A layer whose key is already derived from the master key keeps
+// its key and annotations.
+//
+// It calls EncryptLayerWithMasterKeyContext with context.Background().
+func EncryptLayerWithMasterKey(ec *config.EncryptConfig, masterKey []byte, index int, encOrPlainLayerReader io.Reader, desc ocispec.Descriptor) (io.Reader, EncryptLayerFinalizer, error) {
+	return EncryptLayerWithMasterKeyContext(context.Background(), ec, masterKey, index, encOrPlainLayerReader, desc)
+}
+
+// EncryptLayerWithMasterKeyContext is like EncryptLayerWithMasterKey; the
+// tracing spans of the layer are children of the span of ctx
+func EncryptLayerWithMasterKeyContext(ctx context.Context, ec *config.EncryptConfig, masterKey []byte, index int, encOrPlainLayerReader io.Reader, desc ocispec.Descriptor) (io.Reader, EncryptLayerFinalizer, error) {
+	encLayerReader, encLayerFinalizer, err := traceEncryptLayer(ctx, ec, &derivedKey{masterKey: masterKey, index: index}, encOrPlainLayerReader, desc)
+	return encLayerReader, withoutDigests(encLayerFinalizer), err
+}
+
+func encryptLayerWithMasterKey(ctx context.Context, ec *config.EncryptConfig, dk *derivedKey, encOrPlainLayerReader io.Reader, desc ocispec.Descriptor) (io.Reader, EncryptLayerDigestsFinalizer, error) {
+	if ec == nil {
+		return nil, nil, fmt.Errorf("EncryptConfig must not be nil: %w", errdefs.ErrConfiguration)
+	}
+	release, err := acquireLayerSlot(ctx, ec.GetLimits())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if b64Derivation, ok := desc.Annotations[masterkey.Annotation]; ok {
+		release()
+		// the recipients of the layer are those of the master key
+		pubOpts := desc.Annotations["org.opencontainers.image.enc.pubopts"]
+		return nil, func() (map[string]string, *LayerDigests, error) {
+			return map[string]string{
+				masterkey.Annotation:                   b64Derivation,
+				"org.opencontainers.image.enc.pubopts": pubOpts,
+			}, nil, nil
+		}, nil
+	}
+	if len(GetWrappedKeysMap(desc)) > 0 {
+		release()
+		return nil, nil, fmt.Errorf("the layer is already encrypted with a key of its own: %w", errdefs.ErrConfiguration)
+	}
+
+	derivation, err := masterkey.NewDerivation(dk.index, ec.GetRand())
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	sk, err := derivation.LayerKey(dk.masterKey)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	encLayerReader, bcFin, err := commonEncryptLayer(ctx, ec, encOrPlainLayerReader, desc.Digest, sk)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	encLayerReader = newCountingReader(encLayerReader, metrics.M().BytesEncrypted)
+	// the reader of the layer holds the slot until it is done
+	encLayerReader = newLimitedReader(encLayerReader, ec.GetLimits(), release)
+
+	encLayerFinalizer := func() (map[string]string, *LayerDigests, error) {
+		// a reader that is not read to the end must not keep the slot the
+		// layer needs for sealing its options
+		release()
+		release, err := acquireLayerSlot(ctx, ec.GetLimits())
+		if err != nil {
+			return nil, nil, err
+		}
+		defer release()
+
+		opts, err := bcFin()
+		if err != nil {
+			return nil, nil, err
+		}
+		// the symmetric key is derived again when decrypting
+		opts.Private.SymmetricKey = nil
+		privOptsData, err := json.Marshal(opts.Private)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not JSON marshal opts: %w", err)
+		}
+		pubOptsData, err := json.Marshal(opts.Public)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not JSON marshal opts: %w", err)
+		}
+		if err := derivation.Seal(dk.masterKey, privOptsData, ec.GetRand()); err != nil {
+			return nil, nil, err
+		}
+		b64Derivation, err := derivation.Encode()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		newAnnotations := map[string]string{
+			masterkey.Annotation:                   b64Derivation,
+			"org.opencontainers.image.enc.pubopts": base64.StdEncoding.EncodeToString(pubOptsData),
+		}
+		if err := checkLimits(ec.GetLimits(), newAnnotations); err != nil {
+			return nil, nil, err
+		}
+		return newAnnotations, newLayerDigests(opts), nil
+	}
+	return encLayerReader, encLayerFinalizer, nil
+}
+
+// EncryptMasterKey wraps the master key of an image for the recipients of the
+// EncryptConfig and returns the annotations holding the wrapped keys, which
+// are to be set on the manifest of the image. The wrapped keys held by
+// annotations, those of the manifest, are kept, so that recipients can be
+// added to an image.
+func EncryptMasterKey(ec *config.EncryptConfig, masterKey []byte, annotations map[string]string) (map[string]string, error) {
+	if ec == nil {
+		return nil, fmt.Errorf("EncryptConfig must not be nil: %w", errdefs.ErrConfiguration)
+	}
+	if len(masterKey) != masterkey.KeySize {
+		return nil, fmt.Errorf("invalid master key length of %d bytes; need %d bytes: %w", len(masterKey), masterkey.KeySize, errdefs.ErrKeyMaterial)
+	}
+	release, err := ec.GetLimits().Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	privOptsData, err := json.Marshal(blockcipher.PrivateLayerBlockCipherOptions{SymmetricKey: masterKey})
+	if err != nil {
+		return nil, fmt.Errorf("could not JSON marshal opts: %w", err)
+	}
+	newAnnotations, err := wrapKeys(context.Background(), ec, "", annotations, privOptsData)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLimits(ec.GetLimits(), newAnnotations); err != nil {
+		return nil, err
+	}
+	if len(newAnnotations) == 0 {
+		return nil, fmt.Errorf("no encryptor found to handle encryption: %w", errdefs.ErrConfiguration)
+	}
+	return newAnnotations, nil
+}
+
+// DecryptMasterKey unwraps the master key of an image from the annotations of
+// its manifest with the keys of the DecryptConfig. The master key is then
+// added to the DecryptConfig of the layers with config.DecryptWithMasterKeys.
+func DecryptMasterKey(dc *config.DecryptConfig, annotations map[string]string) ([]byte, error) {
+	if dc == nil {
+		return nil, fmt.Errorf("DecryptConfig must not be nil: %w", errdefs.ErrConfiguration)
+	}
+	release, err := dc.GetLimits().Acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	privOptsData, err := decryptLayerKeyOptsData(context.Background(), dc, ocispec.Descriptor{Annotations: annotations})
+	if err != nil {
+		return nil, err
+	}
+	opts, err := getLayerBlockCipherOptions(privOptsData, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Private.SymmetricKey) != masterkey.KeySize {
+		return nil, fmt.Errorf("unwrapped master key has a length of %d bytes; need %d bytes: %w", len(opts.Private.SymmetricKey), masterkey.KeySize, errdefs.ErrProtocol)
+	}
+	return opts.Private.SymmetricKey, nil
+}
+
+// openDerivedKeyOptsData opens the private options of the layer with the
+// master keys of the DecryptConfig and adds the layer key derived from the
+// master key that opened them
+func openDerivedKeyOptsData(dc *config.DecryptConfig, d digest.Digest, b64Derivation string) ([]byte, error) {
+	derivation, err := masterkey.Decode(b64Derivation)
+	if err != nil {
+		return nil, err
+	}
+	masterKeys := dc.Parameters["masterkeys"]
+	if len(masterKeys) == 0 {
+		return nil, fmt.Errorf("the layer key is derived from a master key, but no master key is given: %w", errdefs.ErrNoDecryptionKey)
+	}
+	for _, masterKey := range masterKeys {
+		privOptsData, err := derivation.Open(masterKey)
+		if err != nil {
+			log.L().Debug("master key could not open layer options", log.KeyLayerDigest, d, log.KeyError, err)
+			continue
+		}
+		opts, err := getLayerBlockCipherOptions(privOptsData, nil)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Private.SymmetricKey, err = derivation.LayerKey(masterKey); err != nil {
+			return nil, err
+		}
+		log.L().Debug("derived layer key from master key", log.KeyLayerDigest, d)
+		return json.Marshal(opts.Private)
+	}
+	return nil, fmt.Errorf("none of the master keys could be used for decryption: %w", errdefs.ErrNoDecryptionKey)
+}
@@ -0,0 +1,197 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// Package masterkey derives the keys of the layers of an image from a single
+// master key of the image. The master key is wrapped once for the recipients
+// of the image, so the number of wrapped keys and of calls to key providers
+// does not grow with the number of layers. Every layer carries the Annotation
+// with the Derivation of its key: the index of the layer and a random salt are
+// the input to HKDF-SHA256, which keeps the keys of the layers distinct, and
+// the private options of the layer's block cipher are sealed with another key
+// derived the same way.
+package masterkey
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Annotation is the annotation of a layer holding its Derivation in JSON
+const Annotation = "org.opencontainers.image.enc.masterkey"
+
+// KeySize is the size in bytes of master keys and of the derived keys
+const KeySize = 32
+
+// saltSize is the size in bytes of the salt of a Derivation
+const saltSize = 32
+
+// the purposes of the derived keys
+const (
+	purposeLayerKey = "ocicrypt layer key"
+	purposeSealKey  = "ocicrypt layer options"
+)
+
+// Derivation describes how the key of a layer is derived from the master key
+type Derivation struct {
+	// Index is the index of the layer in the manifest
+	Index int `json:"index"`
+	// Salt is random and tells apart the layers with the same index in
+	// different images
+	Salt []byte `json:"salt"`
+	// Sealed holds the private options of the layer's block cipher without
+	// the symmetric key, encrypted with AES-256-GCM
+	Sealed []byte `json:"sealed"`
+}
+
+// Generate returns a new master key read from rand; if rand is nil,
+// crypto/rand is used
+func Generate(r io.Reader) ([]byte, error) {
+	if r == nil {
+		r = rand.Reader
+	}
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, fmt.Errorf("could not generate master key: %w", err)
+	}
+	return key, nil
+}
+
+// NewDerivation returns the Derivation of the key of the layer with the index
+// with a new salt read from rand; if rand is nil, crypto/rand is used
+func NewDerivation(index int, r io.Reader) (*Derivation, error) {
+	if r == nil {
+		r = rand.Reader
+	}
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return nil, fmt.Errorf("could not generate salt: %w", err)
+	}
+	return &Derivation{Index: index, Salt: salt}, nil
+}
+
+// Decode decodes the Derivation from the base64 encoded JSON of the Annotation
+func Decode(b64 string) (*Derivation, error) {
+	data, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("could not base64 decode the key derivation: %w", errdefs.ErrProtocol)
+	}
+	var d Derivation
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrProtocol, fmt.Errorf("could not JSON unmarshal the key derivation: %w", err))
+	}
+	if d.Index < 0 || len(d.Salt) != saltSize {
+		return nil, fmt.Errorf("invalid key derivation: %w", errdefs.ErrProtocol)
+	}
+	return &d, nil
+}
+
+// Encode returns the base64 encoded JSON of the Derivation for the Annotation
+func (d *Derivation) Encode() (string, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return "", fmt.Errorf("could not JSON marshal the key derivation: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// LayerKey returns the symmetric key of the layer derived from the master key
+func (d *Derivation) LayerKey(masterKey []byte) ([]byte, error) {
+	return d.deriveKey(masterKey, purposeLayerKey)
+}
+
+// Seal encrypts the private options of the layer's block cipher with a key
+// derived from the master key and stores them in the Derivation
+func (d *Derivation) Seal(masterKey, privOptsData []byte, r io.Reader) error {
+	aead, err := d.newAEAD(masterKey)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		r = rand.Reader
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return fmt.Errorf("could not generate nonce: %w", err)
+	}
+	d.Sealed = aead.Seal(nonce, nonce, privOptsData, d.additionalData())
+	return nil
+}
+
+// Open decrypts the private options of the layer's block cipher sealed in the
+// Derivation; it fails with errdefs.ErrNoDecryptionKey if the master key is
+// not the one they were sealed with
+func (d *Derivation) Open(masterKey []byte) ([]byte, error) {
+	aead, err := d.newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.Sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed layer options are too short: %w", errdefs.ErrProtocol)
+	}
+	nonce, sealed := d.Sealed[:aead.NonceSize()], d.Sealed[aead.NonceSize():]
+	privOptsData, err := aead.Open(nil, nonce, sealed, d.additionalData())
+	if err != nil {
+		return nil, fmt.Errorf("master key does not open the layer options: %w", errdefs.ErrNoDecryptionKey)
+	}
+	return privOptsData, nil
+}
+
+func (d *Derivation) newAEAD(masterKey []byte) (cipher.AEAD, error) {
+	if fips.Enforced() {
+		// the nonces are not generated by the FIPS module
+		return nil, fmt.Errorf("master keys are not available in FIPS 140-only mode: %w", errdefs.ErrDisallowedAlgorithm)
+	}
+	key, err := d.deriveKey(masterKey, purposeSealKey)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveKey derives a key for the purpose with HKDF-SHA256 from the master
+// key; the info is the purpose, the index of the layer and the salt
+func (d *Derivation) deriveKey(masterKey []byte, purpose string) ([]byte, error) {
+	if len(masterKey) != KeySize {
+		return nil, fmt.Errorf("invalid master key length of %d bytes; need %d bytes: %w", len(masterKey), KeySize, errdefs.ErrKeyMaterial)
+	}
+	info := append([]byte(purpose+"\x00"), d.additionalData()...)
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, masterKey, nil, info), key); err != nil {
+		return nil, fmt.Errorf("could not derive key: %w", err)
+	}
+	return key, nil
+}
+
+// additionalData returns the index of the layer followed by the salt
+func (d *Derivation) additionalData() []byte {
+	data := make([]byte, 8, 8+len(d.Salt))
+	binary.BigEndian.PutUint64(data, uint64(d.Index))
+	return append(data, d.Salt...)
+}
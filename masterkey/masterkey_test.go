@@ -0,0 +1,108 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package masterkey
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/utils"
+)
+
+func TestDerivation(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "deriving layer keys from master keys")
+
+	masterKey, err := Generate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var layerKeys [][]byte
+	for index := 0; index < 2; index++ {
+		for i := 0; i < 2; i++ {
+			d, err := NewDerivation(index, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			layerKey, err := d.LayerKey(masterKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, k := range layerKeys {
+				if bytes.Equal(k, layerKey) {
+					t.Fatal("layer keys are not distinct")
+				}
+			}
+			layerKeys = append(layerKeys, layerKey)
+
+			if err := d.Seal(masterKey, []byte("options"), nil); err != nil {
+				t.Fatal(err)
+			}
+			b64, err := d.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := Decode(b64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			privOptsData, err := decoded.Open(masterKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(privOptsData) != "options" {
+				t.Fatalf("unexpected options %q", privOptsData)
+			}
+			decodedKey, err := decoded.LayerKey(masterKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decodedKey, layerKey) {
+				t.Fatal("layer key was not derived again")
+			}
+
+			// the index is bound to the sealed options
+			decoded.Index++
+			if _, err := decoded.Open(masterKey); !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+				t.Fatalf("expected ErrNoDecryptionKey, got %v", err)
+			}
+		}
+	}
+
+	otherKey, err := Generate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDerivation(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Seal(masterKey, []byte("options"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Open(otherKey); !errors.Is(err, errdefs.ErrNoDecryptionKey) {
+		t.Fatalf("expected ErrNoDecryptionKey, got %v", err)
+	}
+	if _, err := d.LayerKey(masterKey[:16]); !errors.Is(err, errdefs.ErrKeyMaterial) {
+		t.Fatalf("expected ErrKeyMaterial, got %v", err)
+	}
+	if _, err := Decode("e30="); !errors.Is(err, errdefs.ErrProtocol) {
+		t.Fatalf("expected ErrProtocol, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// Metrics is the interface ocicrypt reports its metrics to. Integrators can
+// bind the counters and histograms to a metrics library such as Prometheus.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// WrapAttempt counts an attempt to wrap a layer key with the given scheme
+	WrapAttempt(scheme string)
+	// WrapFailure counts a failure to wrap a layer key with the given scheme
+	WrapFailure(scheme string)
+	// UnwrapAttempt counts an attempt to unwrap a layer key with the given scheme
+	UnwrapAttempt(scheme string)
+	// UnwrapFailure counts a failure to unwrap a layer key with the given scheme
+	UnwrapFailure(scheme string)
+	// KeyWrapperLatency observes the time a keywrapper (and the provider
+	// behind it) took to wrap or unwrap a layer key
+	KeyWrapperLatency(scheme string, d time.Duration)
+	// BytesEncrypted observes the size of an encrypted layer
+	BytesEncrypted(n int64)
+	// BytesDecrypted observes the size of a decrypted layer
+	BytesDecrypted(n int64)
+}
+
+// ProviderErrorMetrics is an optional interface of Metrics that counts the
+// failures of keywrappers to reach the key provider behind them, such as a
+// cloud KMS, an HSM or a key service, apart from keys that do not fit
+type ProviderErrorMetrics interface {
+	// ProviderError counts a failure to reach the key provider of the given
+	// scheme while wrapping or unwrapping a layer key
+	ProviderError(scheme string)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) WrapAttempt(string)                      {}
+func (noopMetrics) WrapFailure(string)                      {}
+func (noopMetrics) UnwrapAttempt(string)                    {}
+func (noopMetrics) UnwrapFailure(string)                    {}
+func (noopMetrics) KeyWrapperLatency(string, time.Duration) {}
+func (noopMetrics) BytesEncrypted(int64)                    {}
+func (noopMetrics) BytesDecrypted(int64)                    {}
+
+var (
+	metricsLock sync.RWMutex
+	metrics     Metrics = noopMetrics{}
+)
+
+// SetMetrics sets the Metrics ocicrypt reports to; passing nil restores the
+// default that discards all metrics
+func SetMetrics(m Metrics) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	if m == nil {
+		m = noopMetrics{}
+	}
+	metrics = m
+}
+
+// M returns the Metrics ocicrypt currently reports to
+func M() Metrics {
+	metricsLock.RLock()
+	defer metricsLock.RUnlock()
+
+	return metrics
+}
@@ -0,0 +1,211 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package oidc provides the OIDC ID tokens that are attached to the calls to
+// key services for unwrapping layer keys, so that key services can decide by
+// the identity of a CI job or a node pool whether it may decrypt a layer
+// without long-lived credentials being distributed.
+package oidc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+const (
+	// AWSWebIdentityTokenFileEnv is the environment variable that EKS sets to
+	// the path of the projected service account token of a pod
+	AWSWebIdentityTokenFileEnv = "AWS_WEB_IDENTITY_TOKEN_FILE"
+	// GCEMetadataHostEnv is the environment variable that overrides the host
+	// of the GCE metadata server
+	GCEMetadataHostEnv = "GCE_METADATA_HOST"
+
+	// maxTokenSize is the maximum size of an ID token
+	maxTokenSize = 64 * 1024
+	// expiryMargin is the time before their expiry at which cached tokens are
+	// refreshed
+	expiryMargin = time.Minute
+)
+
+// TokenSource provides OIDC ID tokens
+type TokenSource interface {
+	// Token returns a currently valid ID token
+	Token(ctx context.Context) (string, error)
+}
+
+type fileTokenSource struct {
+	path string
+}
+
+// FileTokenSource returns a TokenSource that reads the token from a file, such
+// as a projected service account token. The file is read for every token since
+// it is rotated.
+func FileTokenSource(path string) TokenSource {
+	return &fileTokenSource{path: path}
+}
+
+func (ts *fileTokenSource) Token(_ context.Context) (string, error) {
+	f, err := os.Open(ts.path)
+	if err != nil {
+		return "", errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("could not read the ID token: %w", err))
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxTokenSize+1))
+	if err != nil {
+		return "", errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("could not read the ID token: %w", err))
+	}
+	return checkToken(data, ts.path)
+}
+
+type envTokenSource struct {
+	name string
+}
+
+// EnvTokenSource returns a TokenSource that takes the token from an environment
+// variable
+func EnvTokenSource(name string) TokenSource {
+	return &envTokenSource{name: name}
+}
+
+func (ts *envTokenSource) Token(_ context.Context) (string, error) {
+	return checkToken([]byte(os.Getenv(ts.name)), "$"+ts.name)
+}
+
+// onGCE tells whether the process runs on GCE; tests replace it
+var onGCE = metadata.OnGCE
+
+type gceTokenSource struct {
+	audience string
+	client   *metadata.Client
+
+	lock   sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// GCETokenSource returns a TokenSource that fetches ID tokens for the given
+// audience and the default service account of the VM from the GCE metadata
+// server. Tokens are cached until shortly before they expire.
+func GCETokenSource(audience string) TokenSource {
+	return &gceTokenSource{
+		audience: audience,
+		client:   metadata.NewClient(&http.Client{Timeout: 10 * time.Second}),
+	}
+}
+
+func (ts *gceTokenSource) Token(ctx context.Context) (string, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	if ts.token != "" && time.Now().Add(expiryMargin).Before(ts.expiry) {
+		return ts.token, nil
+	}
+
+	data, err := ts.client.GetWithContext(ctx, "instance/service-accounts/default/identity?format=full&audience="+url.QueryEscape(ts.audience))
+	if err != nil {
+		var notDefinedErr metadata.NotDefinedError
+		var metadataErr *metadata.Error
+		if errors.As(err, &notDefinedErr) || errors.As(err, &metadataErr) {
+			return "", errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("GCE metadata server refused the ID token: %w", err))
+		}
+		return "", errdefs.WithCategory(errdefs.ErrProviderUnreachable, fmt.Errorf("could not fetch the ID token from the GCE metadata server: %w", err))
+	}
+	token, err := checkToken([]byte(data), "the GCE metadata server")
+	if err != nil {
+		return "", err
+	}
+	ts.token, ts.expiry = token, expiry(token)
+	return token, nil
+}
+
+type ambientTokenSource struct {
+	audience string
+
+	once sync.Once
+	ts   TokenSource
+	err  error
+}
+
+// AmbientTokenSource returns a TokenSource for the environment the process runs
+// in: the projected service account token on EKS and the GCE metadata server on
+// GCE. Whether the process runs on GCE is only found out once, when the first
+// token is asked for; elsewhere every token fails with an error wrapping
+// errdefs.ErrConfiguration. The audience is only used on GCE; on EKS it is
+// configured with the pod.
+func AmbientTokenSource(audience string) TokenSource {
+	if path := os.Getenv(AWSWebIdentityTokenFileEnv); path != "" {
+		return FileTokenSource(path)
+	}
+	return &ambientTokenSource{audience: audience}
+}
+
+func (ts *ambientTokenSource) Token(ctx context.Context) (string, error) {
+	ts.once.Do(func() {
+		if onGCE() {
+			ts.ts = GCETokenSource(ts.audience)
+			return
+		}
+		ts.err = fmt.Errorf("no ambient ID token: neither %s is set nor is the process running on GCE: %w", AWSWebIdentityTokenFileEnv, errdefs.ErrConfiguration)
+	})
+	if ts.err != nil {
+		return "", ts.err
+	}
+	return ts.ts.Token(ctx)
+}
+
+// checkToken returns the token without surrounding whitespace and makes sure it
+// is a JWT
+func checkToken(data []byte, from string) (string, error) {
+	if len(data) > maxTokenSize {
+		return "", fmt.Errorf("ID token from %s is larger than %d bytes: %w", from, maxTokenSize, errdefs.ErrLimitExceeded)
+	}
+	token := strings.TrimSpace(string(data))
+	if strings.Count(token, ".") != 2 {
+		return "", fmt.Errorf("no ID token found in %s: %w", from, errdefs.ErrConfiguration)
+	}
+	return token, nil
+}
+
+// expiry returns the time at which a token expires according to its exp claim;
+// tokens without one are treated as expired. The token is not verified, which
+// is up to the key service.
+func expiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
@@ -0,0 +1,178 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package oidc
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+// createToken creates an unsigned JWT expiring at exp
+func createToken(exp time.Time) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		enc.EncodeToString([]byte(fmt.Sprintf(`{"sub":"ci-job","exp":%d}`, exp.Unix()))) + "."
+}
+
+func TestFileTokenSource(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "token")
+	token := createToken(time.Now().Add(time.Hour))
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := FileTokenSource(path).Token(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != token {
+		t.Fatalf("got token %q, expected %q", got, token)
+	}
+
+	// rotated tokens are picked up
+	rotated := createToken(time.Now().Add(2 * time.Hour))
+	if err := os.WriteFile(path, []byte(rotated), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := FileTokenSource(path).Token(ctx); got != rotated {
+		t.Fatalf("got token %q, expected %q", got, rotated)
+	}
+
+	if err := os.WriteFile(path, []byte("not a token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FileTokenSource(path).Token(ctx); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+	if _, err := FileTokenSource(path + ".missing").Token(ctx); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+}
+
+func TestEnvTokenSource(t *testing.T) {
+	token := createToken(time.Now().Add(time.Hour))
+	t.Setenv("OCICRYPT_TEST_ID_TOKEN", token)
+
+	got, err := EnvTokenSource("OCICRYPT_TEST_ID_TOKEN").Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != token {
+		t.Fatalf("got token %q, expected %q", got, token)
+	}
+	if _, err := EnvTokenSource("OCICRYPT_TEST_UNSET").Token(context.Background()); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+}
+
+func TestGCETokenSource(t *testing.T) {
+	var requests int
+	exp := time.Now().Add(time.Hour)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.URL.Query().Get("audience") != "https://kms.example.com" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, createToken(exp))
+	}))
+	defer server.Close()
+	t.Setenv(GCEMetadataHostEnv, strings.TrimPrefix(server.URL, "http://"))
+	t.Setenv(AWSWebIdentityTokenFileEnv, "")
+	defer func(f func() bool) { onGCE = f }(onGCE)
+	onGCE = func() bool { return true }
+
+	ts := AmbientTokenSource("https://kms.example.com")
+	for i := 0; i < 2; i++ {
+		token, err := ts.Token(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != createToken(exp) {
+			t.Fatalf("unexpected token %q", token)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("token was fetched %d times but should have been cached", requests)
+	}
+
+	// tokens about to expire are fetched again
+	exp = time.Now().Add(time.Second)
+	ts = GCETokenSource("https://kms.example.com")
+	for i := 0; i < 2; i++ {
+		if _, err := ts.Token(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests != 3 {
+		t.Fatalf("token was fetched %d times, expected 3", requests)
+	}
+
+	if _, err := GCETokenSource("https://other.example.com").Token(context.Background()); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+}
+
+func TestAmbientTokenSourceNotOnGCE(t *testing.T) {
+	t.Setenv(AWSWebIdentityTokenFileEnv, "")
+	var probes int
+	defer func(f func() bool) { onGCE = f }(onGCE)
+	onGCE = func() bool {
+		probes++
+		return false
+	}
+
+	// the failure is kept rather than probing for GCE on every token
+	ts := AmbientTokenSource("https://kms.example.com")
+	for i := 0; i < 2; i++ {
+		if _, err := ts.Token(context.Background()); !errors.Is(err, errdefs.ErrConfiguration) {
+			t.Fatalf("expected ErrConfiguration, got %v", err)
+		}
+	}
+	if probes != 1 {
+		t.Fatalf("probed for GCE %d times, expected once", probes)
+	}
+}
+
+func TestAmbientTokenSourceEKS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	token := createToken(time.Now().Add(time.Hour))
+	if err := os.WriteFile(path, []byte(token), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(AWSWebIdentityTokenFileEnv, path)
+
+	got, err := AmbientTokenSource("ignored").Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != token {
+		t.Fatalf("got token %q, expected %q", got, token)
+	}
+}
@@ -0,0 +1,223 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package policy defines the security policy that decides which legacy
+// algorithms are accepted when unwrapping layer keys, how strong the keys
+// of recipients must be and which escrow recipients layers are always
+// encrypted for.
+package policy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"sync"
+
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+// Algorithm identifies a legacy algorithm
+type Algorithm string
+
+const (
+	// RSAOAEPSHA1 is RSA-OAEP key transport using SHA-1, as used by JWE
+	// 'RSA-OAEP'
+	RSAOAEPSHA1 Algorithm = "RSA-OAEP-SHA1"
+	// RSAPKCS1v15 is RSA PKCS#1 v1.5 key transport, as used by JWE 'RSA1_5'
+	// and PKCS7
+	RSAPKCS1v15 Algorithm = "RSA-PKCS1v1.5"
+	// TripleDES is 3DES content encryption in PKCS7
+	TripleDES Algorithm = "3DES"
+	// DES is DES content encryption in PKCS7
+	DES Algorithm = "DES"
+	// LegacyLayout is the layout of the annotations of layers encrypted by
+	// early versions of imgcrypt, which lack the public options of the
+	// block cipher
+	LegacyLayout Algorithm = "legacy-layout"
+)
+
+// LegacyAlgorithms holds all the legacy algorithms a Policy decides about
+var LegacyAlgorithms = []Algorithm{RSAOAEPSHA1, RSAPKCS1v15, TripleDES, DES, LegacyLayout}
+
+// Policy decides which legacy algorithms are accepted at decrypt time and
+// which keys may be used
+type Policy struct {
+	// AllowedLegacyAlgorithms holds the legacy algorithms that are accepted
+	AllowedLegacyAlgorithms []Algorithm
+	// MinRSAKeySize is the minimum size of RSA keys in bits; 0 means that
+	// there is no minimum
+	MinRSAKeySize int
+	// AllowedCurves holds the names of the allowed elliptic curves, such as
+	// "P-256"; all curves are allowed if it is empty
+	AllowedCurves []string
+	// CheckKeysOnUnwrap also checks the private keys used for unwrapping
+	// against MinRSAKeySize and AllowedCurves; public keys of recipients are
+	// always checked when wrapping
+	CheckKeysOnUnwrap bool
+	// EscrowRecipients holds the encryption parameters of recipients, such
+	// as an organization's recovery key, that layers are always encrypted
+	// for in addition to the recipients of the EncryptConfig, for example
+	// {"pubkeys": {pemKey}}; encrypting fails if the layer key cannot be
+	// wrapped for them
+	EscrowRecipients map[string][][]byte
+
+	// noCurves is set by Intersect if AllowedCurves have nothing in common
+	noCurves bool
+}
+
+// Strict returns a Policy that rejects all legacy algorithms
+func Strict() *Policy {
+	return &Policy{}
+}
+
+// Permissive returns a Policy that accepts all legacy algorithms
+func Permissive() *Policy {
+	return &Policy{
+		AllowedLegacyAlgorithms: LegacyAlgorithms,
+	}
+}
+
+// Allows returns true if the Policy accepts the given algorithm
+func (p *Policy) Allows(alg Algorithm) bool {
+	for _, a := range p.AllowedLegacyAlgorithms {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns an error wrapping errdefs.ErrDisallowedAlgorithm if the Policy
+// does not accept the algorithm used by the given keywrap scheme
+func (p *Policy) Check(scheme string, alg Algorithm) error {
+	if p.Allows(alg) {
+		return nil
+	}
+	return fmt.Errorf("%s: %s: %w", scheme, alg, errdefs.ErrDisallowedAlgorithm)
+}
+
+// CheckKey returns an error wrapping errdefs.ErrWeakKey if the given RSA or
+// ECDSA key used by the given keywrap scheme does not meet the requirements of
+// the Policy; other types of keys are not checked
+func (p *Policy) CheckKey(scheme string, key interface{}) error {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return p.CheckKey(scheme, &k.PublicKey)
+	case *ecdsa.PrivateKey:
+		return p.CheckKey(scheme, &k.PublicKey)
+	case *rsa.PublicKey:
+		if k.N.BitLen() < p.MinRSAKeySize {
+			return fmt.Errorf("%s: RSA key with %d bits is smaller than %d bits: %w", scheme, k.N.BitLen(), p.MinRSAKeySize, errdefs.ErrWeakKey)
+		}
+	case *ecdsa.PublicKey:
+		if len(p.AllowedCurves) == 0 && !p.noCurves {
+			return nil
+		}
+		name := k.Curve.Params().Name
+		for _, curve := range p.AllowedCurves {
+			if curve == name {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: curve %s is not allowed: %w", scheme, name, errdefs.ErrWeakKey)
+	}
+	return nil
+}
+
+// Intersect returns a Policy that only accepts what both Policies accept: the
+// legacy algorithms allowed by both, the larger minimum RSA key size and the
+// curves allowed by both. Keys are checked on unwrap if either Policy checks
+// them and layers are encrypted for the escrow recipients of both.
+func (p *Policy) Intersect(other *Policy) *Policy {
+	res := &Policy{
+		MinRSAKeySize:     p.MinRSAKeySize,
+		CheckKeysOnUnwrap: p.CheckKeysOnUnwrap || other.CheckKeysOnUnwrap,
+		noCurves:          p.noCurves || other.noCurves,
+	}
+	if other.MinRSAKeySize > res.MinRSAKeySize {
+		res.MinRSAKeySize = other.MinRSAKeySize
+	}
+	for _, alg := range p.AllowedLegacyAlgorithms {
+		if other.Allows(alg) {
+			res.AllowedLegacyAlgorithms = append(res.AllowedLegacyAlgorithms, alg)
+		}
+	}
+
+	switch {
+	case res.noCurves:
+	case len(p.AllowedCurves) == 0:
+		res.AllowedCurves = append([]string{}, other.AllowedCurves...)
+	case len(other.AllowedCurves) == 0:
+		res.AllowedCurves = append([]string{}, p.AllowedCurves...)
+	default:
+		for _, curve := range p.AllowedCurves {
+			for _, c := range other.AllowedCurves {
+				if c == curve {
+					res.AllowedCurves = append(res.AllowedCurves, curve)
+					break
+				}
+			}
+		}
+		// an empty list would allow all curves
+		res.noCurves = len(res.AllowedCurves) == 0
+	}
+
+	if len(p.EscrowRecipients) > 0 || len(other.EscrowRecipients) > 0 {
+		res.EscrowRecipients = make(map[string][][]byte)
+		for _, escrow := range []map[string][][]byte{p.EscrowRecipients, other.EscrowRecipients} {
+			for name, values := range escrow {
+			next:
+				for _, value := range values {
+					for _, v := range res.EscrowRecipients[name] {
+						if bytes.Equal(v, value) {
+							continue next
+						}
+					}
+					res.EscrowRecipients[name] = append(res.EscrowRecipients[name], value)
+				}
+			}
+		}
+	}
+	return res
+}
+
+var (
+	policyLock sync.RWMutex
+	policy     = Permissive()
+)
+
+// SetPolicy sets the global Policy that is used when a DecryptConfig does not
+// carry its own; passing nil restores the default. The default is Permissive
+// since images encrypted by earlier versions of ocicrypt use RSA-OAEP with
+// SHA-1 (JWE) and RSA PKCS#1 v1.5 (PKCS7).
+func SetPolicy(p *Policy) {
+	policyLock.Lock()
+	defer policyLock.Unlock()
+
+	if p == nil {
+		p = Permissive()
+	}
+	policy = p
+}
+
+// P returns the global Policy
+func P() *Policy {
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+
+	return policy
+}
@@ -0,0 +1,148 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package policy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/utils"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	p := Strict()
+	for _, alg := range LegacyAlgorithms {
+		if err := p.Check("jwe", alg); !errors.Is(err, errdefs.ErrDisallowedAlgorithm) {
+			t.Fatalf("Strict policy must reject %s, got %v", alg, err)
+		}
+	}
+
+	p.AllowedLegacyAlgorithms = []Algorithm{RSAOAEPSHA1}
+	if err := p.Check("jwe", RSAOAEPSHA1); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Check("pkcs7", TripleDES); !errors.Is(err, errdefs.ErrProtocol) {
+		t.Fatalf("Expected a protocol error, got %v", err)
+	}
+
+	for _, alg := range LegacyAlgorithms {
+		if err := Permissive().Check("jwe", alg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSetPolicy(t *testing.T) {
+	SetPolicy(Strict())
+	if P().Allows(RSAPKCS1v15) {
+		t.Fatal("Global policy was not set")
+	}
+	SetPolicy(nil)
+	if !P().Allows(RSAPKCS1v15) {
+		t.Fatal("Global policy was not reset")
+	}
+}
+
+func TestPolicyCheckKey(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "RSA keys of less than 2048 bits")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := Permissive()
+	for _, key := range []interface{}{rsaKey, &rsaKey.PublicKey, ecKey, &ecKey.PublicKey} {
+		if err := p.CheckKey("jwe", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p.MinRSAKeySize = 2048
+	p.AllowedCurves = []string{"P-256", "P-384"}
+	for _, key := range []interface{}{rsaKey, &rsaKey.PublicKey, ecKey, &ecKey.PublicKey} {
+		if err := p.CheckKey("jwe", key); !errors.Is(err, errdefs.ErrWeakKey) {
+			t.Fatalf("Expected a weak key error for %T, got %v", key, err)
+		}
+	}
+
+	p.MinRSAKeySize = 1024
+	p.AllowedCurves = []string{"P-224"}
+	for _, key := range []interface{}{rsaKey, &rsaKey.PublicKey, ecKey, &ecKey.PublicKey} {
+		if err := p.CheckKey("jwe", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPolicyIntersect(t *testing.T) {
+	p := &Policy{
+		AllowedLegacyAlgorithms: []Algorithm{RSAOAEPSHA1, LegacyLayout},
+		MinRSAKeySize:           2048,
+		AllowedCurves:           []string{"P-256", "P-384"},
+		EscrowRecipients:        map[string][][]byte{"pubkeys": {[]byte("escrow1")}},
+	}
+	other := &Policy{
+		AllowedLegacyAlgorithms: []Algorithm{RSAPKCS1v15, LegacyLayout},
+		MinRSAKeySize:           3072,
+		AllowedCurves:           []string{"P-384"},
+		CheckKeysOnUnwrap:       true,
+		EscrowRecipients:        map[string][][]byte{"pubkeys": {[]byte("escrow1"), []byte("escrow2")}},
+	}
+	res := p.Intersect(other)
+	if len(res.AllowedLegacyAlgorithms) != 1 || !res.Allows(LegacyLayout) {
+		t.Fatalf("Unexpected legacy algorithms %v", res.AllowedLegacyAlgorithms)
+	}
+	if res.MinRSAKeySize != 3072 || !res.CheckKeysOnUnwrap {
+		t.Fatalf("Unexpected key requirements %+v", res)
+	}
+	if len(res.AllowedCurves) != 1 || res.AllowedCurves[0] != "P-384" {
+		t.Fatalf("Unexpected curves %v", res.AllowedCurves)
+	}
+	if len(res.EscrowRecipients["pubkeys"]) != 2 {
+		t.Fatalf("Unexpected escrow recipients %v", res.EscrowRecipients)
+	}
+
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := res.CheckKey("jwe", p256); !errors.Is(err, errdefs.ErrWeakKey) {
+		t.Fatalf("Expected ErrWeakKey for a P-256 key, got %v", err)
+	}
+	if err := Permissive().Intersect(p).CheckKey("jwe", p256); err != nil {
+		t.Fatal(err)
+	}
+
+	// curve lists without common curve allow none rather than all
+	none := res.Intersect(&Policy{AllowedCurves: []string{"P-256"}})
+	if err := none.CheckKey("jwe", p256); !errors.Is(err, errdefs.ErrWeakKey) {
+		t.Fatalf("Expected ErrWeakKey for disjoint curves, got %v", err)
+	}
+	if err := none.Intersect(Permissive()).CheckKey("jwe", p256); !errors.Is(err, errdefs.ErrWeakKey) {
+		t.Fatalf("Expected ErrWeakKey for disjoint curves, got %v", err)
+	}
+}
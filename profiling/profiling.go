@@ -0,0 +1,121 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package profiling allows attributing the CPU time ocicrypt spends on
+// encrypting and decrypting layers to the layers in production profiles.
+package profiling
+
+import (
+	"context"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Operation identifies what ocicrypt spends CPU time on
+type Operation string
+
+const (
+	// OperationEncrypt is the encryption of layer data
+	OperationEncrypt Operation = "encrypt"
+	// OperationDecrypt is the decryption of layer data
+	OperationDecrypt Operation = "decrypt"
+	// OperationWrap is the wrapping of a layer key
+	OperationWrap Operation = "wrap"
+	// OperationUnwrap is the unwrapping of a layer key
+	OperationUnwrap Operation = "unwrap"
+)
+
+// Keys of the pprof labels attached to the goroutines while they process layers
+const (
+	// LabelLayerDigest is the label for the digest of the layer
+	LabelLayerDigest = "ocicrypt.layer-digest"
+	// LabelCipher is the label for the layer block cipher or the keywrap scheme
+	LabelCipher = "ocicrypt.cipher"
+	// LabelOperation is the label for the Operation
+	LabelOperation = "ocicrypt.operation"
+)
+
+// Accountant is the interface for accounting the CPU time spent on
+// encrypting and decrypting layer data
+type Accountant interface {
+	// CPUTime reports the time spent on encrypting or decrypting a part of
+	// the data of a layer with the given block cipher, not including the
+	// time spent reading the data. It is called for every read from a
+	// layer and must be cheap.
+	CPUTime(layerDigest digest.Digest, op Operation, cipher string, d time.Duration)
+}
+
+type noopAccountant struct{}
+
+func (noopAccountant) CPUTime(digest.Digest, Operation, string, time.Duration) {}
+
+var (
+	profilingLock sync.RWMutex
+	accountant    Accountant = noopAccountant{}
+	labels        bool
+)
+
+// SetAccountant sets the Accountant used by ocicrypt; passing nil restores
+// the default accountant that discards all reports
+func SetAccountant(a Accountant) {
+	profilingLock.Lock()
+	defer profilingLock.Unlock()
+
+	if a == nil {
+		a = noopAccountant{}
+	}
+	accountant = a
+}
+
+// A returns the Accountant currently used by ocicrypt
+func A() Accountant {
+	profilingLock.RLock()
+	defer profilingLock.RUnlock()
+
+	return accountant
+}
+
+// SetLabels enables or disables pprof labels. They are disabled by default
+// since the labels of the calling goroutine are only restored to those of
+// the context passed to ocicrypt, which is context.Background() for
+// EncryptLayer and DecryptLayer.
+func SetLabels(enabled bool) {
+	profilingLock.Lock()
+	defer profilingLock.Unlock()
+
+	labels = enabled
+}
+
+// LabelsEnabled returns true if pprof labels are enabled
+func LabelsEnabled() bool {
+	profilingLock.RLock()
+	defer profilingLock.RUnlock()
+
+	return labels
+}
+
+// Do calls f with the pprof labels for the given layer, operation and cipher
+// attached to the goroutine if labels are enabled
+func Do(ctx context.Context, layerDigest digest.Digest, op Operation, cipher string, f func(context.Context)) {
+	if !LabelsEnabled() {
+		f(ctx)
+		return
+	}
+	pprof.Do(ctx, pprof.Labels(LabelLayerDigest, layerDigest.String(), LabelOperation, string(op), LabelCipher, cipher), f)
+}
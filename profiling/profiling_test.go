@@ -0,0 +1,54 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package profiling
+
+import (
+	"context"
+	"runtime/pprof"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestDo(t *testing.T) {
+	d := digest.FromString("layer")
+
+	called := false
+	Do(context.Background(), d, OperationDecrypt, "AES_256_CTR_HMAC_SHA256", func(ctx context.Context) {
+		called = true
+		if _, ok := pprof.Label(ctx, LabelLayerDigest); ok {
+			t.Fatal("Labels must be disabled by default")
+		}
+	})
+	if !called {
+		t.Fatal("Function was not called")
+	}
+
+	SetLabels(true)
+	defer SetLabels(false)
+	Do(context.Background(), d, OperationDecrypt, "AES_256_CTR_HMAC_SHA256", func(ctx context.Context) {
+		for key, exp := range map[string]string{
+			LabelLayerDigest: d.String(),
+			LabelOperation:   "decrypt",
+			LabelCipher:      "AES_256_CTR_HMAC_SHA256",
+		} {
+			if value, _ := pprof.Label(ctx, key); value != exp {
+				t.Fatalf("Expected label %s to be %q, got %q", key, exp, value)
+			}
+		}
+	})
+}
@@ -17,7 +17,14 @@
 package ocicrypt
 
 import (
+	"context"
 	"io"
+	"time"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/limits"
+	"github.com/containers/ocicrypt/profiling"
+	"github.com/opencontainers/go-digest"
 )
 
 type readerAtReader struct {
@@ -38,3 +45,269 @@ func (rar *readerAtReader) Read(p []byte) (n int, err error) {
 	rar.off += int64(n)
 	return n, err
 }
+
+// countingReader counts the bytes read from the wrapped reader and calls
+// done with the total once the wrapped reader returned io.EOF
+type countingReader struct {
+	r    io.Reader
+	n    int64
+	done func(int64)
+}
+
+func newCountingReader(r io.Reader, done func(int64)) io.Reader {
+	return &countingReader{
+		r:    r,
+		done: done,
+	}
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	if err == io.EOF && cr.done != nil {
+		cr.done(cr.n)
+		cr.done = nil
+	}
+	return n, err
+}
+
+// WriteTo implements io.WriterTo so that io.Copy can hand the data of the
+// wrapped reader to w without an intermediate buffer
+func (cr *countingReader) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.Copy(w, cr.r)
+	cr.n += n
+	if err == nil && cr.done != nil {
+		cr.done(cr.n)
+		cr.done = nil
+	}
+	return n, err
+}
+
+// progressReader reports the number of bytes read from the wrapped reader
+// to a config.ProgressFunc
+type progressReader struct {
+	r        io.Reader
+	progress config.ProgressFunc
+	p        config.Progress
+}
+
+func newProgressReader(r io.Reader, d digest.Digest, progress config.ProgressFunc) io.Reader {
+	if progress == nil {
+		return r
+	}
+	return &progressReader{
+		r:        r,
+		progress: progress,
+		p:        config.Progress{Digest: d},
+	}
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if pr.p.Done {
+		return n, err
+	}
+	pr.p.Bytes += int64(n)
+	pr.p.Done = err == io.EOF
+	if n > 0 || pr.p.Done {
+		pr.progress(pr.p)
+	}
+	return n, err
+}
+
+// layerErrorReader annotates the errors of the wrapped reader with the digest
+// of the layer
+type layerErrorReader struct {
+	r io.Reader
+	d digest.Digest
+}
+
+func newLayerErrorReader(r io.Reader, d digest.Digest) io.Reader {
+	if d == "" {
+		return r
+	}
+	return &layerErrorReader{
+		r: r,
+		d: d,
+	}
+}
+
+func (ler *layerErrorReader) Read(p []byte) (int, error) {
+	n, err := ler.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = newLayerError(ler.d, "", err)
+	}
+	return n, err
+}
+
+// WriteTo implements io.WriterTo so that io.Copy can hand the data of the
+// wrapped reader to w without an intermediate buffer
+func (ler *layerErrorReader) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.Copy(w, ler.r)
+	return n, newLayerError(ler.d, "", err)
+}
+
+func (ler *layerErrorReader) Close() error {
+	return closeReader(ler.r)
+}
+
+// layerErrorReaderAt annotates the errors of the wrapped io.ReaderAt with the
+// digest of the layer
+type layerErrorReaderAt struct {
+	r io.ReaderAt
+	d digest.Digest
+}
+
+func newLayerErrorReaderAt(r io.ReaderAt, d digest.Digest) io.ReaderAt {
+	if d == "" {
+		return r
+	}
+	return &layerErrorReaderAt{
+		r: r,
+		d: d,
+	}
+}
+
+func (ler *layerErrorReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := ler.r.ReadAt(p, off)
+	if err != nil && err != io.EOF {
+		err = newLayerError(ler.d, "", err)
+	}
+	return n, err
+}
+
+// layerSlotKey is the key of the context value that marks operations holding
+// the slot of their layer among the concurrently processed layers for the
+// operations they call, such as RotateLayerKey for the decryption and the
+// encryption of the layer
+type layerSlotKey struct{}
+
+// acquireLayerSlot waits for a slot of the concurrently processed layers of
+// the Limits unless the operation of ctx holds one already
+func acquireLayerSlot(ctx context.Context, l *limits.Limits) (func(), error) {
+	if ctx.Value(layerSlotKey{}) != nil {
+		return func() {}, nil
+	}
+	return l.Acquire(ctx)
+}
+
+// limitedReader holds the slot of its layer among the concurrently processed
+// layers of the Limits until the wrapped reader is read to the end, fails or
+// is closed
+type limitedReader struct {
+	r       io.Reader
+	release func()
+}
+
+// newLimitedReader returns a reader that calls release once r is done
+func newLimitedReader(r io.Reader, l *limits.Limits, release func()) io.Reader {
+	if l.MaxConcurrentLayers <= 0 {
+		return r
+	}
+	return &limitedReader{
+		r:       r,
+		release: release,
+	}
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	if err != nil {
+		lr.release()
+	}
+	return n, err
+}
+
+// WriteTo implements io.WriterTo so that io.Copy can hand the data of the
+// wrapped reader to w without an intermediate buffer
+func (lr *limitedReader) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.Copy(w, lr.r)
+	lr.release()
+	return n, err
+}
+
+// Close releases the slot of a layer that is not read to the end
+func (lr *limitedReader) Close() error {
+	lr.release()
+	return closeReader(lr.r)
+}
+
+// closeReader closes r if it is an io.Closer
+func closeReader(r io.Reader) error {
+	if c, ok := r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// timingReader measures the time spent reading from the wrapped reader
+type timingReader struct {
+	r       io.Reader
+	elapsed time.Duration
+}
+
+func (tr *timingReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := tr.r.Read(p)
+	tr.elapsed += time.Since(start)
+	return n, err
+}
+
+// timingWriter measures the time spent writing to the wrapped writer
+type timingWriter struct {
+	w       io.Writer
+	elapsed time.Duration
+}
+
+func (tw *timingWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := tw.w.Write(p)
+	tw.elapsed += time.Since(start)
+	return n, err
+}
+
+// profilingReader attaches the pprof labels of the layer while reading from a
+// block cipher and reports the time spent in the block cipher, apart from
+// the time spent reading its source, to the profiling.Accountant
+type profilingReader struct {
+	ctx    context.Context
+	r      io.Reader
+	src    *timingReader
+	d      digest.Digest
+	op     profiling.Operation
+	cipher string
+}
+
+// newProfilingReader returns the reader for the block cipher reader r, which
+// must read its data from src
+func newProfilingReader(ctx context.Context, r io.Reader, src *timingReader, d digest.Digest, op profiling.Operation, cipher string) io.Reader {
+	return &profilingReader{
+		ctx:    ctx,
+		r:      r,
+		src:    src,
+		d:      d,
+		op:     op,
+		cipher: cipher,
+	}
+}
+
+func (pr *profilingReader) Read(p []byte) (n int, err error) {
+	start, srcElapsed := time.Now(), pr.src.elapsed
+	profiling.Do(pr.ctx, pr.d, pr.op, pr.cipher, func(context.Context) {
+		n, err = pr.r.Read(p)
+	})
+	profiling.A().CPUTime(pr.d, pr.op, pr.cipher, time.Since(start)-(pr.src.elapsed-srcElapsed))
+	return n, err
+}
+
+// WriteTo implements io.WriterTo so that io.Copy can hand the data of the
+// wrapped reader to w without an intermediate buffer
+func (pr *profilingReader) WriteTo(w io.Writer) (n int64, err error) {
+	tw := &timingWriter{w: w}
+	start, srcElapsed := time.Now(), pr.src.elapsed
+	profiling.Do(pr.ctx, pr.d, pr.op, pr.cipher, func(context.Context) {
+		n, err = io.Copy(tw, pr.r)
+	})
+	profiling.A().CPUTime(pr.d, pr.op, pr.cipher, time.Since(start)-(pr.src.elapsed-srcElapsed)-tw.elapsed)
+	return n, err
+}
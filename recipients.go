@@ -0,0 +1,91 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ocicrypt
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/containers/ocicrypt/blockcipher"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/masterkey"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LayerRecipients describes who can decrypt a layer as far as the annotations
+// of the layer tell
+type LayerRecipients struct {
+	// Cipher is the block cipher the layer is encrypted with; it is empty for
+	// layers in the legacy layout
+	Cipher blockcipher.LayerCipherType
+	// MasterKey is true if the layer key is derived from the master key of
+	// the image, whose recipients are found with the annotations holding the
+	// wrapped master key
+	MasterKey bool
+	// Schemes lists the schemes the layer key is wrapped with, in the order
+	// in which their keywrappers are tried
+	Schemes []SchemeRecipients
+}
+
+// SchemeRecipients describes the keys of a layer wrapped with one scheme
+type SchemeRecipients struct {
+	// Scheme is the encryption scheme of the keywrapper, such as jwe or
+	// aws-kms
+	Scheme string
+	// Recipients holds what the wrapped keys tell about their recipients,
+	// such as the serial numbers and issuers of certificates, key IDs or the
+	// names of the keys of key management services. Schemes that do not
+	// reveal their recipients give a placeholder such as [jwe].
+	Recipients []string
+	// Err is set if the wrapped keys could not be parsed
+	Err error
+}
+
+// GetRecipients returns which schemes the key of a layer is wrapped with and
+// hints on their recipients from the annotations of the layer, so tools can
+// show who can decrypt an image without holding any key. The hints are not
+// verified; only decrypting the layer tells whether a key fits.
+func GetRecipients(annotations map[string]string) (*LayerRecipients, error) {
+	desc := ocispec.Descriptor{Annotations: annotations}
+	pubOptsData, err := getLayerPubOpts(desc)
+	if err != nil {
+		return nil, fmt.Errorf("could not base64 decode the public options: %w", errdefs.ErrProtocol)
+	}
+	pubOpts := blockcipher.PublicLayerBlockCipherOptions{}
+	if err := json.Unmarshal(pubOptsData, &pubOpts); err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrProtocol, fmt.Errorf("could not JSON unmarshal the public options: %w", err))
+	}
+
+	_, masterKey := annotations[masterkey.Annotation]
+	lr := &LayerRecipients{
+		Cipher:    pubOpts.CipherType,
+		MasterKey: masterKey,
+	}
+	for _, r := range getKeyWrapperAnnotations() {
+		b64Annotation := annotations[r.annotationID]
+		if b64Annotation == "" {
+			continue
+		}
+		recipients, err := r.keyWrapper.GetRecipients(b64Annotation)
+		lr.Schemes = append(lr.Schemes, SchemeRecipients{
+			Scheme:     r.scheme,
+			Recipients: recipients,
+			Err:        err,
+		})
+	}
+	return lr, nil
+}
@@ -0,0 +1,121 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ocicrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/containers/ocicrypt/blockcipher"
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/masterkey"
+	"github.com/containers/ocicrypt/utils"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestGetRecipients(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "the pkcs7 scheme")
+
+	caKey, caCert, err := utils.CreateTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certKey, err := utils.CreateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPubKey, err := x509.MarshalPKIXPublicKey(&certKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := utils.CertifyKey(certPubKey, nil, caKey, caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+
+	cc, err := config.New(
+		config.WithJWEPubKeys([][]byte{publicKey}),
+		config.WithX509Certs([][]byte{certPEM}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.EncryptConfig.Cipher = blockcipher.AES256GCMChunked
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+	encLayerReader, encLayerFinalizer, err := EncryptLayerContext(context.Background(), cc.EncryptConfig, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(encLayerReader); err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lr, err := GetRecipients(annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lr.Cipher != blockcipher.AES256GCMChunked || lr.MasterKey {
+		t.Fatalf("unexpected recipients %+v", lr)
+	}
+	// the order of the schemes depends on the priorities of the keywrappers
+	recipients := make(map[string][]string)
+	for _, sr := range lr.Schemes {
+		if sr.Err != nil {
+			t.Fatal(sr.Err)
+		}
+		recipients[sr.Scheme] = sr.Recipients
+	}
+	expected := map[string][]string{
+		"jwe":   {"[jwe]"},
+		"pkcs7": {fmt.Sprintf("pkcs7:serial=%x,issuer=%s", cert.SerialNumber, caCert.Subject.String())},
+	}
+	if !reflect.DeepEqual(recipients, expected) {
+		t.Fatalf("unexpected recipients %v", recipients)
+	}
+
+	lr, err = GetRecipients(map[string]string{
+		masterkey.Annotation:                    "e30=",
+		"org.opencontainers.image.enc.keys.jwe": "not base64",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lr.MasterKey || lr.Cipher != "" || len(lr.Schemes) != 1 || lr.Schemes[0].Scheme != "jwe" {
+		t.Fatalf("unexpected recipients %+v", lr)
+	}
+
+	if _, err := GetRecipients(map[string]string{"org.opencontainers.image.enc.pubopts": "not base64"}); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("Expected ErrProtocol, got %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package remotekeys stores the wrapped keys of a layer outside of the image.
+// The layer then carries the Annotation with a Reference to an HTTPS URL
+// serving the annotations holding the wrapped keys, so that a rotation service
+// can update the recipients of a layer without pushing to the registry. The
+// Reference can pin the digest of the wrapped keys.
+package remotekeys
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/ocicrypt/errdefs"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Annotation is the annotation of a layer holding the Reference in JSON
+const Annotation = "org.opencontainers.image.enc.keys.remote"
+
+// keysAnnotationPrefix is the prefix of the annotations holding wrapped keys
+const keysAnnotationPrefix = "org.opencontainers.image.enc.keys."
+
+// DefaultCacheTTL is the time a Resolver caches the wrapped keys it fetched
+const DefaultCacheTTL = 5 * time.Minute
+
+// DefaultMaxSize is the maximum size in bytes of the wrapped keys a Resolver
+// fetches
+const DefaultMaxSize = 1024 * 1024
+
+// Reference points at the wrapped keys of a layer
+type Reference struct {
+	// URL is the HTTPS URL serving the annotations holding the wrapped keys
+	// as a JSON object
+	URL string `json:"url"`
+	// Digest is the digest of the served JSON object; if empty, the wrapped
+	// keys may change
+	Digest digest.Digest `json:"digest,omitempty"`
+}
+
+// Detach moves the annotations holding the wrapped keys of a layer into a
+// JSON object, which is to be served at the given URL, and returns the
+// annotations of the layer with the Annotation referring to it instead. If
+// pin is set, the Reference pins the digest of the JSON object.
+func Detach(annotations map[string]string, keysURL string, pin bool) (map[string]string, []byte, error) {
+	if err := checkURL(keysURL); err != nil {
+		return nil, nil, err
+	}
+	keys := make(map[string]string)
+	newAnnotations := make(map[string]string)
+	for k, v := range annotations {
+		if strings.HasPrefix(k, keysAnnotationPrefix) && k != Annotation {
+			keys[k] = v
+		} else {
+			newAnnotations[k] = v
+		}
+	}
+	payload, err := json.Marshal(keys)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not JSON marshal wrapped keys: %w", err)
+	}
+	ref := Reference{URL: keysURL}
+	if pin {
+		ref.Digest = digest.FromBytes(payload)
+	}
+	refJSON, err := json.Marshal(ref)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not JSON marshal reference: %w", err)
+	}
+	newAnnotations[Annotation] = string(refJSON)
+	return newAnnotations, payload, nil
+}
+
+// checkURL makes sure the wrapped keys are fetched using HTTPS
+func checkURL(keysURL string) error {
+	u, err := url.Parse(keysURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q of wrapped keys: %v: %w", keysURL, err, errdefs.ErrConfiguration)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("URL %q of wrapped keys is not an HTTPS URL: %w", keysURL, errdefs.ErrConfiguration)
+	}
+	return nil
+}
+
+// cacheKey identifies cached wrapped keys; tenants do not share them
+type cacheKey struct {
+	tenant string
+	ref    Reference
+}
+
+type cacheEntry struct {
+	keys    map[string]string
+	expires time.Time
+}
+
+// Resolver fetches the wrapped keys of layers that refer to them with the
+// Annotation; a Resolver may be shared by DecryptConfigs
+type Resolver struct {
+	// Client is the HTTP client; if nil, http.DefaultClient is used
+	Client *http.Client
+	// AllowedHosts are the hosts the wrapped keys may be fetched from; if
+	// empty, any host is allowed
+	AllowedHosts []string
+	// CacheTTL is the time the wrapped keys are cached; if 0,
+	// DefaultCacheTTL is used
+	CacheTTL time.Duration
+	// MaxSize is the maximum size of the wrapped keys; if 0,
+	// DefaultMaxSize is used
+	MaxSize int64
+
+	mu    sync.Mutex
+	cache map[cacheKey]cacheEntry
+}
+
+// Resolve returns the annotations of a layer with the wrapped keys that the
+// Annotation refers to added to them; the wrapped keys are appended to those
+// the layer already has. Annotations without the Annotation are returned
+// unchanged. The wrapped keys are cached per tenant.
+func (r *Resolver) Resolve(ctx context.Context, tenant string, annotations map[string]string) (map[string]string, error) {
+	refJSON, ok := annotations[Annotation]
+	if !ok {
+		return annotations, nil
+	}
+	var ref Reference
+	if err := json.Unmarshal([]byte(refJSON), &ref); err != nil {
+		return nil, fmt.Errorf("could not parse reference to wrapped keys: %v: %w", err, errdefs.ErrProtocol)
+	}
+	keys, err := r.fetch(ctx, cacheKey{tenant: tenant, ref: ref})
+	if err != nil {
+		return nil, err
+	}
+	newAnnotations := make(map[string]string, len(annotations)+len(keys))
+	for k, v := range annotations {
+		newAnnotations[k] = v
+	}
+	for k, v := range keys {
+		if !strings.HasPrefix(k, keysAnnotationPrefix) || k == Annotation || v == "" {
+			continue
+		}
+		if newAnnotations[k] != "" {
+			v = newAnnotations[k] + "," + v
+		}
+		newAnnotations[k] = v
+	}
+	return newAnnotations, nil
+}
+
+// fetch returns the wrapped keys from the cache or fetches them
+func (r *Resolver) fetch(ctx context.Context, key cacheKey) (map[string]string, error) {
+	ref := key.ref
+	r.mu.Lock()
+	entry, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.keys, nil
+	}
+
+	if err := checkURL(ref.URL); err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrProtocol, err)
+	}
+	if len(r.AllowedHosts) > 0 {
+		u, _ := url.Parse(ref.URL)
+		allowed := false
+		for _, host := range r.AllowedHosts {
+			if u.Host == host {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, fmt.Errorf("host %s of the wrapped keys is not allowed: %w", u.Host, errdefs.ErrConfiguration)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ref.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrProviderUnreachable, fmt.Errorf("could not fetch wrapped keys from %s: %w", ref.URL, err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch wrapped keys from %s: %s: %w", ref.URL, resp.Status, errdefs.ErrProviderUnreachable)
+	}
+	maxSize := r.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxSize
+	}
+	payload, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrProviderUnreachable, fmt.Errorf("could not read wrapped keys from %s: %w", ref.URL, err))
+	}
+	if int64(len(payload)) > maxSize {
+		return nil, fmt.Errorf("wrapped keys from %s are larger than %d bytes: %w", ref.URL, maxSize, errdefs.ErrLimitExceeded)
+	}
+	if ref.Digest != "" {
+		if err := ref.Digest.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid digest of wrapped keys: %v: %w", err, errdefs.ErrProtocol)
+		}
+		if ref.Digest.Algorithm().FromBytes(payload) != ref.Digest {
+			return nil, fmt.Errorf("wrapped keys from %s do not match digest %s: %w", ref.URL, ref.Digest, errdefs.ErrIntegrity)
+		}
+	}
+	var keys map[string]string
+	if err := json.Unmarshal(payload, &keys); err != nil {
+		return nil, fmt.Errorf("could not parse wrapped keys from %s: %v: %w", ref.URL, err, errdefs.ErrProtocol)
+	}
+
+	ttl := r.CacheTTL
+	if ttl == 0 {
+		ttl = DefaultCacheTTL
+	}
+	now := time.Now()
+	r.mu.Lock()
+	if r.cache == nil {
+		r.cache = make(map[cacheKey]cacheEntry)
+	}
+	for cached, entry := range r.cache {
+		if !now.Before(entry.expires) {
+			delete(r.cache, cached)
+		}
+	}
+	r.cache[key] = cacheEntry{keys: keys, expires: now.Add(ttl)}
+	r.mu.Unlock()
+	return keys, nil
+}
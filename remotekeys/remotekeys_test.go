@@ -0,0 +1,87 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remotekeys
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+func TestResolve(t *testing.T) {
+	ctx := context.Background()
+	annotations := map[string]string{
+		"org.opencontainers.image.enc.keys.jwe": "a2V5MQ==",
+		"org.opencontainers.image.enc.pubopts":  "e30=",
+	}
+
+	var payload []byte
+	requests := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write(payload)
+	}))
+	defer server.Close()
+
+	detached, payload, err := Detach(annotations, server.URL+"/keys", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := detached["org.opencontainers.image.enc.keys.jwe"]; ok || detached["org.opencontainers.image.enc.pubopts"] != "e30=" {
+		t.Fatalf("unexpected annotations %v", detached)
+	}
+
+	// a wrapped key that is still in the image is kept
+	detached["org.opencontainers.image.enc.keys.jwe"] = "a2V5Mg=="
+	r := &Resolver{Client: server.Client()}
+	for i := 0; i < 2; i++ {
+		resolved, err := r.Resolve(ctx, "", detached)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resolved["org.opencontainers.image.enc.keys.jwe"] != "a2V5Mg==,a2V5MQ==" {
+			t.Fatalf("unexpected wrapped keys %q", resolved["org.opencontainers.image.enc.keys.jwe"])
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("expected the wrapped keys to be cached, got %d requests", requests)
+	}
+
+	// the pinned digest does not match once the wrapped keys change
+	payload = []byte(`{"org.opencontainers.image.enc.keys.jwe":"a2V5Mw=="}`)
+	r = &Resolver{Client: server.Client()}
+	if _, err := r.Resolve(ctx, "", detached); !errors.Is(err, errdefs.ErrIntegrity) {
+		t.Fatalf("expected ErrIntegrity, got %v", err)
+	}
+
+	r = &Resolver{Client: server.Client(), AllowedHosts: []string{"keys.example.com"}}
+	if _, err := r.Resolve(ctx, "", detached); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+
+	if _, _, err := Detach(annotations, "http://keys.example.com/keys", false); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+	detached[Annotation] = `{"url":"http://keys.example.com/keys"}`
+	if _, err := r.Resolve(ctx, "", detached); !errors.Is(err, errdefs.ErrProtocol) {
+		t.Fatalf("expected ErrProtocol, got %v", err)
+	}
+}
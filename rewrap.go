@@ -0,0 +1,128 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ocicrypt
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/masterkey"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// RewrapLayerKey unwraps the key of an encrypted layer with the DecryptConfig
+// of the EncryptConfig and wraps it for the recipients of the EncryptConfig,
+// which replace the old recipients. It returns the new encryption annotations
+// of the layer; the blob of the layer does not change and need not be read, so
+// recipients can be added to or removed from large layers cheaply. Anyone who
+// could decrypt the layer before and kept its key still can, so removing a
+// recipient whose keys were compromised needs the layer to be re-encrypted.
+// The keys of layers derived from a master key are rewrapped with
+// EncryptMasterKey instead.
+func RewrapLayerKey(ctx context.Context, ec *config.EncryptConfig, desc ocispec.Descriptor) (map[string]string, error) {
+	annotations, err := rewrapLayerKey(ctx, ec, desc)
+	return annotations, newLayerError(desc.Digest, "", err)
+}
+
+func rewrapLayerKey(ctx context.Context, ec *config.EncryptConfig, desc ocispec.Descriptor) (map[string]string, error) {
+	if ec == nil {
+		return nil, fmt.Errorf("EncryptConfig must not be nil: %w", errdefs.ErrConfiguration)
+	}
+	if _, ok := desc.Annotations[masterkey.Annotation]; ok {
+		return nil, fmt.Errorf("the key of the layer is derived from a master key, which is rewrapped with EncryptMasterKey: %w", errdefs.ErrConfiguration)
+	}
+	release, err := acquireLayerSlot(ctx, ec.GetLimits())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	privOptsData, err := decryptLayerKeyOptsData(ctx, &ec.DecryptConfig, desc)
+	if err != nil {
+		return nil, err
+	}
+	privOptsData, pubOptsData, err := getLayerOptsData(&ec.DecryptConfig, desc, privOptsData)
+	if err != nil {
+		return nil, err
+	}
+
+	newAnnotations, err := wrapKeys(ctx, ec, desc.Digest, nil, privOptsData)
+	if err != nil {
+		return nil, err
+	}
+	if len(newAnnotations) == 0 {
+		return nil, fmt.Errorf("no encryptor found to handle encryption: %w", errdefs.ErrConfiguration)
+	}
+	newAnnotations["org.opencontainers.image.enc.pubopts"] = base64.StdEncoding.EncodeToString(pubOptsData)
+	if err := checkLimits(ec.GetLimits(), newAnnotations); err != nil {
+		return nil, err
+	}
+	return newAnnotations, nil
+}
+
+// RotateLayerKey decrypts the encrypted layer with the DecryptConfig of the
+// EncryptConfig and, in the same pass, encrypts it with a new layer key and
+// the block cipher of the EncryptConfig for its recipients. Unlike
+// RewrapLayerKey it also locks out recipients that kept the old layer key. The
+// finalizer, which is run once the returned reader has been read to the end,
+// returns the new encryption annotations of the layer along with the digests
+// and sizes of the plaintext and of the new encrypted layer. The integrity of
+// the old encrypted layer is verified as it is read, so reading the returned
+// reader fails if it was tampered with. The layer key is not new if the
+// EncryptConfig makes the encryption convergent with the same secret.
+func RotateLayerKey(ctx context.Context, ec *config.EncryptConfig, encLayerReader io.Reader, desc ocispec.Descriptor) (io.Reader, EncryptLayerDigestsFinalizer, error) {
+	if ec == nil {
+		return nil, nil, newLayerError(desc.Digest, "", fmt.Errorf("EncryptConfig must not be nil: %w", errdefs.ErrConfiguration))
+	}
+	release, err := acquireLayerSlot(ctx, ec.GetLimits())
+	if err != nil {
+		return nil, nil, newLayerError(desc.Digest, "", err)
+	}
+	// the decryption and the encryption of the layer share its slot
+	slotCtx := context.WithValue(ctx, layerSlotKey{}, true)
+	decLayerReader, plainDigest, err := DecryptLayerContext(slotCtx, &ec.DecryptConfig, encLayerReader, desc, false)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	// without the encryption annotations the layer is encrypted anew
+	plainDesc := ocispec.Descriptor{
+		MediaType: desc.MediaType,
+		Digest:    plainDigest,
+	}
+	newLayerReader, newLayerFinalizer, err := EncryptLayerWithDigestsContext(slotCtx, ec, decLayerReader, plainDesc)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return newLimitedReader(newLayerReader, ec.GetLimits(), release), func() (map[string]string, *LayerDigests, error) {
+		// a reader that is not read to the end must not keep the slot the
+		// layer needs for wrapping its key
+		release()
+		release, err := acquireLayerSlot(ctx, ec.GetLimits())
+		if err != nil {
+			return nil, nil, newLayerError(desc.Digest, "", err)
+		}
+		defer release()
+
+		return newLayerFinalizer()
+	}, nil
+}
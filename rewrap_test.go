@@ -0,0 +1,281 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ocicrypt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/limits"
+	"github.com/containers/ocicrypt/masterkey"
+	"github.com/containers/ocicrypt/utils"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestRewrapLayerKey(t *testing.T) {
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayerContext(context.Background(), ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayer, err := ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encDesc := ocispec.Descriptor{
+		Digest:      digest.FromBytes(encLayer),
+		Size:        int64(len(encLayer)),
+		Annotations: annotations,
+	}
+
+	newPubKey, newPrivKey, err := utils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEc := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"pubkeys": {newPubKey},
+		},
+		DecryptConfig: *dc,
+	}
+	newDc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {newPrivKey},
+			"privkeys-passwords": {{}},
+		},
+	}
+
+	newAnnotations, err := RewrapLayerKey(context.Background(), newEc, encDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newAnnotations["org.opencontainers.image.enc.pubopts"] != annotations["org.opencontainers.image.enc.pubopts"] {
+		t.Fatal("The public options of the layer changed")
+	}
+	newDesc := encDesc
+	newDesc.Annotations = newAnnotations
+
+	decLayerReader, _, err := DecryptLayerContext(context.Background(), newDc, bytes.NewReader(encLayer), newDesc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decLayer, err := ioutil.ReadAll(decLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decLayer, data) {
+		t.Fatal("Decrypted layer differs")
+	}
+
+	// the new recipients replace the old ones
+	if _, _, err := DecryptLayerContext(context.Background(), dc, bytes.NewReader(encLayer), newDesc, true); !errors.Is(err, ErrNoDecryptionKey) {
+		t.Fatalf("Expected ErrNoDecryptionKey, got %v", err)
+	}
+
+	// the keys of the new recipients do not unwrap the old annotations
+	if _, err := RewrapLayerKey(context.Background(), &config.EncryptConfig{Parameters: newEc.Parameters, DecryptConfig: *newDc}, encDesc); !errors.Is(err, ErrNoDecryptionKey) {
+		t.Fatalf("Expected ErrNoDecryptionKey, got %v", err)
+	}
+
+	masterKeyDesc := ocispec.Descriptor{Annotations: map[string]string{masterkey.Annotation: "e30="}}
+	if _, err := RewrapLayerKey(context.Background(), newEc, masterKeyDesc); !errors.Is(err, ErrConfiguration) {
+		t.Fatalf("Expected ErrConfiguration, got %v", err)
+	}
+}
+
+func TestRotateLayerKey(t *testing.T) {
+	data := []byte("This is some text!")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+
+	encLayerReader, encLayerFinalizer, err := EncryptLayerContext(context.Background(), ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayer, err := ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encDesc := ocispec.Descriptor{
+		Digest:      digest.FromBytes(encLayer),
+		Size:        int64(len(encLayer)),
+		Annotations: annotations,
+	}
+
+	newPubKey, newPrivKey, err := utils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEc := &config.EncryptConfig{
+		Parameters: map[string][][]byte{
+			"pubkeys": {newPubKey},
+		},
+		DecryptConfig: *dc,
+	}
+	newDc := &config.DecryptConfig{
+		Parameters: map[string][][]byte{
+			"privkeys":           {newPrivKey},
+			"privkeys-passwords": {{}},
+		},
+	}
+
+	rotLayerReader, rotLayerFinalizer, err := RotateLayerKey(context.Background(), newEc, bytes.NewReader(encLayer), encDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotLayer, err := ioutil.ReadAll(rotLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotAnnotations, digests, err := rotLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(rotLayer, encLayer) {
+		t.Fatal("The rotated layer was not encrypted anew")
+	}
+	if digests == nil || digests.PlaintextDigest != desc.Digest || digests.Digest != digest.FromBytes(rotLayer) || digests.Size != int64(len(rotLayer)) {
+		t.Fatalf("unexpected digests %+v", digests)
+	}
+	rotDesc := ocispec.Descriptor{
+		Digest:      digests.Digest,
+		Size:        digests.Size,
+		Annotations: rotAnnotations,
+	}
+
+	decLayerReader, _, err := DecryptLayerContext(context.Background(), newDc, bytes.NewReader(rotLayer), rotDesc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decLayer, err := ioutil.ReadAll(decLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decLayer, data) {
+		t.Fatal("Decrypted layer differs")
+	}
+
+	// the old layer key does not decrypt the rotated layer
+	oldKeyDesc := rotDesc
+	oldKeyDesc.Annotations = annotations
+	decLayerReader, _, err = DecryptLayerContext(context.Background(), dc, bytes.NewReader(rotLayer), oldKeyDesc, false)
+	if err == nil {
+		_, err = ioutil.ReadAll(decLayerReader)
+	}
+	if err == nil {
+		t.Fatal("Decrypting the rotated layer with the old layer key succeeded")
+	}
+
+	// a tampered layer fails while it is rotated
+	encLayer[0] ^= 1
+	rotLayerReader, _, err = RotateLayerKey(context.Background(), newEc, bytes.NewReader(encLayer), encDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(rotLayerReader); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("Expected ErrIntegrity, got %v", err)
+	}
+}
+
+func TestRotateLayerKeyMaxConcurrentLayers(t *testing.T) {
+	data := bytes.Repeat([]byte("This is some text!"), 10000)
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(data),
+		Size:   int64(len(data)),
+	}
+	encLayerReader, encLayerFinalizer, err := EncryptLayerContext(context.Background(), ec, bytes.NewReader(data), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encLayer, err := ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encDesc := ocispec.Descriptor{
+		Digest:      digest.FromBytes(encLayer),
+		Size:        int64(len(encLayer)),
+		Annotations: annotations,
+	}
+	l := &limits.Limits{MaxConcurrentLayers: 1}
+	limitedEc := &config.EncryptConfig{
+		Parameters: ec.Parameters,
+		DecryptConfig: config.DecryptConfig{
+			Parameters: dc.Parameters,
+			Limits:     l,
+		},
+		Limits: l,
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		// the second rotation waits for the slot of the first
+		for i := 0; i < 2; i++ {
+			rotLayerReader, rotLayerFinalizer, err := RotateLayerKey(context.Background(), limitedEc, bytes.NewReader(encLayer), encDesc)
+			if err != nil {
+				done <- err
+				return
+			}
+			rotLayer, err := ioutil.ReadAll(rotLayerReader)
+			if err != nil {
+				done <- err
+				return
+			}
+			if _, digests, err := rotLayerFinalizer(); err != nil {
+				done <- err
+				return
+			} else if digests.Size != int64(len(rotLayer)) {
+				done <- fmt.Errorf("unexpected digests %+v", digests)
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("Rotating the layer with MaxConcurrentLayers of 1 did not finish")
+	}
+}
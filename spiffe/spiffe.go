@@ -0,0 +1,225 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package spiffe fetches the identity of a workload from the SPIFFE Workload
+// API, so that calls to key services can be authenticated with the SVID of the
+// node using mutual TLS and key services can grant access by SPIFFE ID.
+package spiffe
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/utils/unixgrpc"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"google.golang.org/grpc/metadata"
+)
+
+// EndpointSocketEnv is the environment variable that holds the address of the
+// SPIFFE Workload API, such as unix:///run/spire/sockets/agent.sock
+const EndpointSocketEnv = "SPIFFE_ENDPOINT_SOCKET"
+
+// X509SVID is the X.509 SPIFFE Verifiable Identity Document of a workload along
+// with the trust bundle for verifying the SVIDs of its peers
+type X509SVID struct {
+	// ID is the SPIFFE ID of the workload, such as spiffe://example.org/node
+	ID string
+	// Certificates is the certificate chain of the SVID, leaf first
+	Certificates []*x509.Certificate
+	// PrivateKey is the private key of the leaf certificate
+	PrivateKey crypto.Signer
+	// Bundle holds the CA certificates of the trust domain
+	Bundle []*x509.Certificate
+}
+
+// FetchX509SVID fetches the default X.509-SVID of the workload from the SPIFFE
+// Workload API, for example a SPIRE agent, listening at the given address; an
+// empty address is taken from the SPIFFE_ENDPOINT_SOCKET environment variable
+func FetchX509SVID(ctx context.Context, address string) (*X509SVID, error) {
+	if address == "" {
+		address = os.Getenv(EndpointSocketEnv)
+	}
+	path := strings.TrimPrefix(address, "unix://")
+	if path == address || path == "" {
+		return nil, fmt.Errorf("SPIFFE Workload API address %q is not of the form unix:///path/to/socket: %w", address, errdefs.ErrConfiguration)
+	}
+
+	conn, err := unixgrpc.Dial(path)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// the Workload API refuses requests without this header; the stream,
+	// which would go on with updates of the SVID, ends with the cancel
+	ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(ctx, "workload.spiffe.io", "true"))
+	defer cancel()
+	stream, err := workload.NewSpiffeWorkloadAPIClient(conn).FetchX509SVID(ctx, &workload.X509SVIDRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch the X.509-SVID: %w", unixgrpc.Error(err, path, "FetchX509SVID"))
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch the X.509-SVID: %w", unixgrpc.Error(err, path, "FetchX509SVID"))
+	}
+	return parseX509SVIDResponse(resp)
+}
+
+// parseX509SVIDResponse parses the first SVID of an X509SVIDResponse, which is
+// the default one
+func parseX509SVIDResponse(resp *workload.X509SVIDResponse) (*X509SVID, error) {
+	if len(resp.Svids) == 0 {
+		return nil, fmt.Errorf("the SPIFFE Workload API returned no X.509-SVID: %w", errdefs.ErrNoDecryptionKey)
+	}
+	svid := resp.Svids[0]
+
+	var err error
+	s := &X509SVID{ID: svid.SpiffeId}
+	if s.Certificates, err = x509.ParseCertificates(svid.X509Svid); err != nil || len(s.Certificates) == 0 {
+		return nil, fmt.Errorf("could not parse the certificates of the X.509-SVID: %w", errdefs.ErrProtocol)
+	}
+	if s.Bundle, err = x509.ParseCertificates(svid.Bundle); err != nil {
+		return nil, fmt.Errorf("could not parse the trust bundle of the X.509-SVID: %w", errdefs.ErrProtocol)
+	}
+	privKey, err := x509.ParsePKCS8PrivateKey(svid.X509SvidKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the private key of the X.509-SVID: %w", errdefs.ErrProtocol)
+	}
+	signer, ok := privKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T of the X.509-SVID: %w", privKey, errdefs.ErrProtocol)
+	}
+	s.PrivateKey = signer
+
+	certID, err := IDFromCertificate(s.Certificates[0])
+	if err != nil {
+		return nil, err
+	}
+	if certID != s.ID {
+		return nil, fmt.Errorf("X.509-SVID for %s holds the SPIFFE ID %s: %w", s.ID, certID, errdefs.ErrProtocol)
+	}
+	return s, nil
+}
+
+// IDFromCertificate returns the SPIFFE ID of an X.509-SVID, which is its only
+// URI SAN
+func IDFromCertificate(cert *x509.Certificate) (string, error) {
+	if len(cert.URIs) != 1 || cert.URIs[0].Scheme != "spiffe" {
+		return "", fmt.Errorf("certificate is not an X.509-SVID: %w", errdefs.ErrKeyMaterial)
+	}
+	return cert.URIs[0].String(), nil
+}
+
+// TLSCertificate returns the SVID for presenting it in TLS handshakes
+func (s *X509SVID) TLSCertificate() tls.Certificate {
+	cert := tls.Certificate{
+		PrivateKey: s.PrivateKey,
+		Leaf:       s.Certificates[0],
+	}
+	for _, c := range s.Certificates {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert
+}
+
+// GetX509SVID returns the SVID in the form of go-spiffe, which makes X509SVID
+// an x509svid.Source
+func (s *X509SVID) GetX509SVID() (*x509svid.SVID, error) {
+	id, err := spiffeid.FromString(s.ID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SPIFFE ID %q of the X.509-SVID: %w", s.ID, errdefs.ErrKeyMaterial)
+	}
+	return &x509svid.SVID{ID: id, Certificates: s.Certificates, PrivateKey: s.PrivateKey}, nil
+}
+
+// GetX509BundleForTrustDomain returns the trust bundle of the SVID, which makes
+// X509SVID an x509bundle.Source; it only holds the bundle of the trust domain
+// of the workload itself
+func (s *X509SVID) GetX509BundleForTrustDomain(td spiffeid.TrustDomain) (*x509bundle.Bundle, error) {
+	id, err := spiffeid.FromString(s.ID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SPIFFE ID %q of the X.509-SVID: %w", s.ID, errdefs.ErrKeyMaterial)
+	}
+	if td != id.TrustDomain() {
+		return nil, fmt.Errorf("no trust bundle for trust domain %s: %w", td, errdefs.ErrKeyMaterial)
+	}
+	return x509bundle.FromX509Authorities(td, s.Bundle), nil
+}
+
+// Source provides the X.509-SVID of the workload and the trust bundles for
+// verifying the SVIDs of its peers. An X509SVID is a Source that never
+// changes; a workloadapi.X509Source of go-spiffe follows the rotations of the
+// SVID.
+type Source interface {
+	x509svid.Source
+	x509bundle.Source
+}
+
+// ClientTLSConfig returns the configuration for authenticating to a key service
+// with the SVID of the source using mutual TLS. The key service must present an
+// SVID of the trust bundle of the source with one of the given SPIFFE IDs.
+func ClientTLSConfig(source Source, serverIDs ...string) (*tls.Config, error) {
+	var ids []spiffeid.ID
+	for _, serverID := range serverIDs {
+		id, err := spiffeid.FromString(serverID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SPIFFE ID %q of the key service: %w", serverID, errdefs.ErrConfiguration)
+		}
+		ids = append(ids, id)
+	}
+	return tlsconfig.MTLSClientConfig(source, source, tlsconfig.AuthorizeOneOf(ids...)), nil
+}
+
+// HTTPClient returns a client like base that presents the SVID of the source to
+// the HTTPS services that ask for a client certificate, so that they can
+// authenticate the workload by its SPIFFE ID. The services are still verified
+// the way base verifies them. Since the SVID rotates, the connections of the
+// client are not kept alive. If the source is nil or base does not use an
+// http.Transport, which is only the case in tests, base is returned.
+func HTTPClient(base *http.Client, source Source) *http.Client {
+	if source == nil {
+		return base
+	}
+	var transport *http.Transport
+	switch t := base.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return base
+	}
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	transport.TLSClientConfig.GetClientCertificate = tlsconfig.GetClientCertificate(source)
+	transport.DisableKeepAlives = true
+
+	client := *base
+	client.Transport = transport
+	return &client
+}
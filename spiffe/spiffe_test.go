@@ -0,0 +1,264 @@
+//go:build go1.24
+// +build go1.24
+
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spiffe
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/utils"
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// createSVID creates an X.509-SVID for id signed by the CA
+func createSVID(t *testing.T, id string, caKey *rsa.PrivateKey, caCert *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubData, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, err := url.Parse(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := utils.CertifyKey(pubData, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}, caKey, caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// fakeWorkloadAPI is a Workload API that streams a single X.509-SVID
+type fakeWorkloadAPI struct {
+	workload.UnimplementedSpiffeWorkloadAPIServer
+	resp *workload.X509SVIDResponse
+}
+
+func (f *fakeWorkloadAPI) FetchX509SVID(_ *workload.X509SVIDRequest, stream workload.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if v := md.Get("workload.spiffe.io"); len(v) != 1 || v[0] != "true" {
+		return status.Error(codes.InvalidArgument, "security header missing from request")
+	}
+	if err := stream.Send(f.resp); err != nil {
+		return err
+	}
+	// the stream stays open for updates of the SVID
+	<-stream.Context().Done()
+	return nil
+}
+
+// startWorkloadAPI serves a Workload API that streams the SVID and returns its
+// address
+func startWorkloadAPI(t *testing.T, id string, cert *x509.Certificate, key *ecdsa.PrivateKey, caCert *x509.Certificate) string {
+	keyData, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &fakeWorkloadAPI{resp: &workload.X509SVIDResponse{
+		Svids: []*workload.X509SVID{{
+			SpiffeId:    id,
+			X509Svid:    cert.Raw,
+			X509SvidKey: keyData,
+			Bundle:      caCert.Raw,
+		}},
+	}}
+
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	workload.RegisterSpiffeWorkloadAPIServer(server, api)
+	go func() { _ = server.Serve(l) }()
+	t.Cleanup(server.Stop)
+	return "unix://" + path
+}
+
+func TestFetchX509SVID(t *testing.T) {
+	caKey, caCert, err := utils.CreateTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := "spiffe://example.org/node"
+	cert, key := createSVID(t, id, caKey, caCert)
+	address := startWorkloadAPI(t, id, cert, key, caCert)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	t.Setenv(EndpointSocketEnv, address)
+	svid, err := FetchX509SVID(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svid.ID != id || len(svid.Certificates) != 1 || len(svid.Bundle) != 1 {
+		t.Fatalf("unexpected SVID %+v", svid)
+	}
+	if !svid.Certificates[0].Equal(cert) || !svid.Bundle[0].Equal(caCert) {
+		t.Fatal("SVID does not hold the served certificates")
+	}
+
+	if _, err := FetchX509SVID(ctx, "/run/spire/agent.sock"); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+	missing := "unix://" + filepath.Join(t.TempDir(), "missing.sock")
+	if _, err := FetchX509SVID(ctx, missing); !errors.Is(err, errdefs.ErrProviderUnreachable) {
+		t.Fatalf("expected ErrProviderUnreachable, got %v", err)
+	}
+}
+
+func TestClientTLSConfig(t *testing.T) {
+	caKey, caCert, err := utils.CreateTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, clientKey := createSVID(t, "spiffe://example.org/node", caKey, caCert)
+	serverCert, serverKey := createSVID(t, "spiffe://example.org/kms", caKey, caCert)
+
+	client := &X509SVID{
+		ID:           "spiffe://example.org/node",
+		Certificates: []*x509.Certificate{clientCert},
+		PrivateKey:   clientKey,
+		Bundle:       []*x509.Certificate{caCert},
+	}
+	server := &X509SVID{
+		ID:           "spiffe://example.org/kms",
+		Certificates: []*x509.Certificate{serverCert},
+		PrivateKey:   serverKey,
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+
+	handshake := func(config *tls.Config) error {
+		c, s := net.Pipe()
+		defer c.Close()
+		defer s.Close()
+		serverConfig := &tls.Config{
+			Certificates: []tls.Certificate{server.TLSCertificate()},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientCAs,
+		}
+		go func() { _ = tls.Server(s, serverConfig).Handshake() }()
+		return tls.Client(c, config).Handshake()
+	}
+
+	config, err := ClientTLSConfig(client, "spiffe://example.org/kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(config); err != nil {
+		t.Fatal(err)
+	}
+	config, err = ClientTLSConfig(client, "spiffe://example.org/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(config); err == nil {
+		t.Fatal("handshake with unauthorized SPIFFE ID succeeded")
+	}
+	if _, err := ClientTLSConfig(client, "https://example.org/kms"); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	caKey, caCert, err := utils.CreateTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := "spiffe://example.org/node"
+	cert, key := createSVID(t, id, caKey, caCert)
+	svid := &X509SVID{
+		ID:           id,
+		Certificates: []*x509.Certificate{cert},
+		PrivateKey:   key,
+		Bundle:       []*x509.Certificate{caCert},
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		peerID, err := IDFromCertificate(r.TLS.PeerCertificates[0])
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(peerID))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	for _, tc := range []struct {
+		client *http.Client
+		status int
+	}{
+		{server.Client(), http.StatusUnauthorized},
+		{HTTPClient(server.Client(), svid), http.StatusOK},
+	} {
+		resp, err := tc.client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.status {
+			t.Fatalf("expected HTTP status %d, got %d", tc.status, resp.StatusCode)
+		}
+		if tc.status == http.StatusOK && string(body) != id {
+			t.Fatalf("server saw SPIFFE ID %q", body)
+		}
+	}
+}
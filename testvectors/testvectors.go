@@ -0,0 +1,168 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package testvectors provides test vectors for the decryption of layers and
+// the API to generate and verify them. The vectors in vectors.json cover every
+// keywrap scheme that needs neither external hardware nor a key service and
+// every block cipher; implementations in other languages can use them to
+// validate that they interoperate with this package.
+package testvectors
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/containers/ocicrypt"
+	"github.com/containers/ocicrypt/blockcipher"
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/errdefs"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Vector is a test vector holding an encrypted layer along with the keys
+// needed to decrypt it
+type Vector struct {
+	// Name describes the vector
+	Name string `json:"name"`
+	// Scheme is the keywrap scheme the layer key is wrapped with
+	Scheme string `json:"scheme"`
+	// Cipher is the block cipher the layer is encrypted with
+	Cipher blockcipher.LayerCipherType `json:"cipher"`
+	// EncryptParameters are the parameters of the EncryptConfig the layer
+	// was encrypted with
+	EncryptParameters map[string][][]byte `json:"encryptParameters"`
+	// DecryptParameters are the parameters of a DecryptConfig that decrypts
+	// the layer
+	DecryptParameters map[string][][]byte `json:"decryptParameters"`
+	// Plaintext is the plain layer
+	Plaintext []byte `json:"plaintext"`
+	// PlaintextDigest is the digest of the plain layer
+	PlaintextDigest digest.Digest `json:"plaintextDigest"`
+	// Ciphertext is the encrypted layer
+	Ciphertext []byte `json:"ciphertext"`
+	// Annotations are the annotations of the encrypted layer holding the
+	// wrapped layer key and the public options of the cipher
+	Annotations map[string]string `json:"annotations"`
+}
+
+// Generate encrypts the plaintext with the block cipher using the given
+// parameters and returns the Vector holding the result; scheme names the
+// keywrap scheme the parameters select. rand is the source of randomness of
+// the EncryptConfig for the layer key and the nonces; if nil, crypto/rand is
+// used.
+func Generate(name, scheme string, cipher blockcipher.LayerCipherType, encryptParameters, decryptParameters map[string][][]byte, plaintext []byte, rand io.Reader) (*Vector, error) {
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(plaintext),
+		Size:   int64(len(plaintext)),
+	}
+	ec := &config.EncryptConfig{
+		Parameters: encryptParameters,
+		Rand:       rand,
+		Cipher:     cipher,
+		DecryptConfig: config.DecryptConfig{
+			Parameters: map[string][][]byte{},
+		},
+	}
+	encLayerReader, encLayerFinalizer, err := ocicrypt.EncryptLayerContext(context.Background(), ec, bytes.NewReader(plaintext), desc)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := ioutil.ReadAll(encLayerReader)
+	if err != nil {
+		return nil, err
+	}
+	annotations, err := encLayerFinalizer()
+	if err != nil {
+		return nil, err
+	}
+
+	pubOpts, err := getPublicOptions(annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Vector{
+		Name:              name,
+		Scheme:            scheme,
+		Cipher:            pubOpts.CipherType,
+		EncryptParameters: encryptParameters,
+		DecryptParameters: decryptParameters,
+		Plaintext:         plaintext,
+		PlaintextDigest:   desc.Digest,
+		Ciphertext:        ciphertext,
+		Annotations:       annotations,
+	}, nil
+}
+
+// Verify decrypts the ciphertext of the Vector and checks that it yields the
+// plaintext
+func (v *Vector) Verify() error {
+	dc := &config.DecryptConfig{
+		Parameters: v.DecryptParameters,
+	}
+	desc := ocispec.Descriptor{
+		Annotations: v.Annotations,
+	}
+	decLayerReader, _, err := ocicrypt.DecryptLayerContext(context.Background(), dc, bytes.NewReader(v.Ciphertext), desc, false)
+	if err != nil {
+		return fmt.Errorf("%s: %w", v.Name, err)
+	}
+	plaintext, err := ioutil.ReadAll(decLayerReader)
+	if err != nil {
+		return fmt.Errorf("%s: %w", v.Name, err)
+	}
+	if !bytes.Equal(plaintext, v.Plaintext) {
+		return fmt.Errorf("%s: decrypted layer does not match the plaintext: %w", v.Name, errdefs.ErrIntegrity)
+	}
+	if digest.FromBytes(plaintext) != v.PlaintextDigest {
+		return fmt.Errorf("%s: digest of the decrypted layer does not match: %w", v.Name, errdefs.ErrIntegrity)
+	}
+	return nil
+}
+
+// Load reads the JSON encoded array of Vectors from r
+func Load(r io.Reader) ([]Vector, error) {
+	var vectors []Vector
+	if err := json.NewDecoder(r).Decode(&vectors); err != nil {
+		return nil, fmt.Errorf("could not decode test vectors: %w", err)
+	}
+	return vectors, nil
+}
+
+// Store writes the Vectors as JSON encoded array to w
+func Store(w io.Writer, vectors []Vector) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(vectors)
+}
+
+func getPublicOptions(annotations map[string]string) (*blockcipher.PublicLayerBlockCipherOptions, error) {
+	pubOptsData, err := base64.StdEncoding.DecodeString(annotations["org.opencontainers.image.enc.pubopts"])
+	if err != nil {
+		return nil, fmt.Errorf("could not base64 decode the public options: %w", err)
+	}
+	pubOpts := &blockcipher.PublicLayerBlockCipherOptions{}
+	if err := json.Unmarshal(pubOptsData, pubOpts); err != nil {
+		return nil, fmt.Errorf("could not JSON unmarshal the public options: %w", err)
+	}
+	return pubOpts, nil
+}
@@ -0,0 +1,346 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testvectors
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	mathrand "math/rand/v2"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/containers/ocicrypt/blockcipher"
+	"github.com/containers/ocicrypt/keywrap/age"
+	"github.com/containers/ocicrypt/utils"
+	// keys created by openpgp.NewEntity do not state their preferred hashes
+	_ "golang.org/x/crypto/ripemd160"
+)
+
+var update = flag.Bool("update", false, "regenerate vectors.json")
+
+const vectorsFile = "vectors.json"
+
+// createPlaintext creates a plain layer of the given size that does not align
+// with the blocks of the ciphers
+func createPlaintext(size int) []byte {
+	plaintext := make([]byte, size)
+	for i := range plaintext {
+		plaintext[i] = byte(i % 251)
+	}
+	return plaintext
+}
+
+// marshalKeyPair returns the PKIX public key and the PKCS#8 private key
+func marshalKeyPair(pubKey, privKey interface{}) ([]byte, []byte, error) {
+	pubData, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	privData, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pubData, privData, nil
+}
+
+func generateVectors() ([]Vector, error) {
+	var vectors []Vector
+	plaintext := createPlaintext(4099)
+	// the layer keys and nonces come from a seeded generator; the keys and
+	// most keywrappers draw on crypto/rand
+	rand := mathrand.NewChaCha8([32]byte{'o', 'c', 'i', 'c', 'r', 'y', 'p', 't'})
+
+	add := func(name, scheme string, cipher blockcipher.LayerCipherType, ep, dp map[string][][]byte) error {
+		v, err := Generate(name, scheme, cipher, ep, dp, plaintext, rand)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		vectors = append(vectors, *v)
+		return nil
+	}
+
+	// JWE with RSA, EC and OKP keys, and with every block cipher
+	rsaPubKey, rsaPrivKey, err := utils.CreateRSATestKey(2048, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, cipher := range []blockcipher.LayerCipherType{blockcipher.AES256CTR, blockcipher.AES256GCMChunked, blockcipher.ChaCha20Poly1305Chunked} {
+		name := "jwe-rsa"
+		if cipher != blockcipher.AES256CTR {
+			name += "-" + strings.ToLower(strings.ReplaceAll(string(cipher), "_", "-"))
+		}
+		if err := add(name, "jwe", cipher, map[string][][]byte{
+			"pubkeys": {rsaPubKey},
+		}, map[string][][]byte{
+			"privkeys":           {rsaPrivKey},
+			"privkeys-passwords": {{}},
+		}); err != nil {
+			return nil, err
+		}
+	}
+	ecPubKey, ecPrivKey, err := utils.CreateECDSATestKey(elliptic.P256())
+	if err != nil {
+		return nil, err
+	}
+	if err := add("jwe-ec-p256", "jwe", blockcipher.AES256CTR, map[string][][]byte{
+		"pubkeys": {ecPubKey},
+	}, map[string][][]byte{
+		"privkeys":           {ecPrivKey},
+		"privkeys-passwords": {{}},
+	}); err != nil {
+		return nil, err
+	}
+	x25519Key, err := ecdh.X25519().GenerateKey(cryptorand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	x25519PubKey, x25519PrivKey, err := marshalKeyPair(x25519Key.PublicKey(), x25519Key)
+	if err != nil {
+		return nil, err
+	}
+	if err := add("jwe-x25519", "jwe", blockcipher.AES256CTR, map[string][][]byte{
+		"pubkeys": {x25519PubKey},
+	}, map[string][][]byte{
+		"privkeys":           {x25519PrivKey},
+		"privkeys-passwords": {{}},
+	}); err != nil {
+		return nil, err
+	}
+	edKey, err := utils.CreateEd25519Key()
+	if err != nil {
+		return nil, err
+	}
+	edPubKey, edPrivKey, err := marshalKeyPair(edKey.Public(), edKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := add("jwe-ed25519", "jwe", blockcipher.AES256CTR, map[string][][]byte{
+		"pubkeys": {edPubKey},
+	}, map[string][][]byte{
+		"privkeys":           {edPrivKey},
+		"privkeys-passwords": {{}},
+	}); err != nil {
+		return nil, err
+	}
+
+	// PKCS7 with an RSA certificate and CMS with RSA and EC certificates
+	caKey, caCert, err := utils.CreateTestCA()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := utils.CertifyKey(rsaPubKey, nil, caKey, caCert)
+	if err != nil {
+		return nil, err
+	}
+	if err := add("pkcs7-rsa", "pkcs7", blockcipher.AES256CTR, map[string][][]byte{
+		"x509s": {cert.Raw},
+	}, map[string][][]byte{
+		"privkeys":           {rsaPrivKey},
+		"privkeys-passwords": {{}},
+		"x509s":              {cert.Raw},
+	}); err != nil {
+		return nil, err
+	}
+	if err := add("cms-rsa", "pkcs7", blockcipher.AES256CTR, map[string][][]byte{
+		"x509s":      {cert.Raw},
+		"pkcs7-mode": {[]byte("cms")},
+	}, map[string][][]byte{
+		"privkeys":           {rsaPrivKey},
+		"privkeys-passwords": {{}},
+		"x509s":              {cert.Raw},
+	}); err != nil {
+		return nil, err
+	}
+	ecCert, err := utils.CertifyKey(ecPubKey, nil, caKey, caCert)
+	if err != nil {
+		return nil, err
+	}
+	if err := add("cms-ec-p256", "pkcs7", blockcipher.AES256CTR, map[string][][]byte{
+		"x509s":      {ecCert.Raw},
+		"pkcs7-mode": {[]byte("cms")},
+	}, map[string][][]byte{
+		"privkeys":           {ecPrivKey},
+		"privkeys-passwords": {{}},
+		"x509s":              {ecCert.Raw},
+	}); err != nil {
+		return nil, err
+	}
+
+	// OpenPGP
+	entity, err := openpgp.NewEntity("testkey", "", "testkey@example.com", nil)
+	if err != nil {
+		return nil, err
+	}
+	var pubKeyRing, privKeyRing bytes.Buffer
+	if err := entity.Serialize(&pubKeyRing); err != nil {
+		return nil, err
+	}
+	if err := entity.SerializePrivate(&privKeyRing, nil); err != nil {
+		return nil, err
+	}
+	if err := add("pgp-rsa", "pgp", blockcipher.AES256CTR, map[string][][]byte{
+		"gpg-pubkeyringfile": {pubKeyRing.Bytes()},
+		"gpg-recipients":     {[]byte("testkey@example.com")},
+	}, map[string][][]byte{
+		"gpg-privatekeys": {privKeyRing.Bytes()},
+	}); err != nil {
+		return nil, err
+	}
+
+	// age with an X25519 identity
+	identity, recipient, err := age.GenerateIdentity(cryptorand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := add("age-x25519", "age", blockcipher.AES256CTR, map[string][][]byte{
+		"age-recipients": {[]byte(recipient)},
+	}, map[string][][]byte{
+		"age-identities": {[]byte(identity)},
+	}); err != nil {
+		return nil, err
+	}
+
+	// HPKE with X25519 and MLKEM768-X25519 keys
+	hpkeKey, err := ecdh.X25519().GenerateKey(cryptorand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hpkePubKey, hpkePrivKey, err := marshalKeyPair(hpkeKey.PublicKey(), hpkeKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := add("hpke-x25519", "hpke", blockcipher.AES256CTR, map[string][][]byte{
+		"hpke-pubkeys": {hpkePubKey},
+	}, map[string][][]byte{
+		"hpke-privkeys":           {hpkePrivKey},
+		"hpke-privkeys-passwords": {{}},
+	}); err != nil {
+		return nil, err
+	}
+	mlkemPubKey, mlkemPrivKey, err := utils.GenerateMLKEM768X25519Key()
+	if err != nil {
+		return nil, err
+	}
+	if err := add("mlkem768x25519", "mlkem768x25519", blockcipher.AES256CTR, map[string][][]byte{
+		"mlkem768x25519-pubkeys": {mlkemPubKey},
+	}, map[string][][]byte{
+		"mlkem768x25519-privkeys": {mlkemPrivKey},
+	}); err != nil {
+		return nil, err
+	}
+
+	// the layer key split among three EC keys, two of which decrypt
+	var thresholdPubKeys, thresholdPrivKeys [][]byte
+	for i := 0; i < 3; i++ {
+		pubKey, privKey, err := utils.CreateECDSATestKey(elliptic.P256())
+		if err != nil {
+			return nil, err
+		}
+		thresholdPubKeys = append(thresholdPubKeys, pubKey)
+		thresholdPrivKeys = append(thresholdPrivKeys, privKey)
+	}
+	if err := add("threshold-2-of-3", "threshold", blockcipher.AES256CTR, map[string][][]byte{
+		"threshold-pubkeys": thresholdPubKeys,
+		"threshold-k":       {[]byte("2")},
+	}, map[string][][]byte{
+		"privkeys":           thresholdPrivKeys[1:],
+		"privkeys-passwords": {{}, {}},
+	}); err != nil {
+		return nil, err
+	}
+
+	return vectors, nil
+}
+
+func TestVectors(t *testing.T) {
+	utils.SkipInFIPSOnlyMode(t, "decrypting the test vectors")
+
+	if *update {
+		vectors, err := generateVectors()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(vectorsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := Store(f, vectors); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(vectorsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	vectors, err := Load(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) == 0 {
+		t.Fatal("No test vectors found")
+	}
+	schemes := map[string]bool{}
+	ciphers := map[blockcipher.LayerCipherType]bool{}
+	for _, v := range vectors {
+		if err := v.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		schemes[v.Scheme] = true
+		ciphers[v.Cipher] = true
+	}
+	// every scheme that needs neither hardware nor a key service and every
+	// block cipher is covered
+	for _, scheme := range []string{"jwe", "pkcs7", "pgp", "age", "hpke", "mlkem768x25519", "threshold"} {
+		if !schemes[scheme] {
+			t.Errorf("No test vector for scheme %s", scheme)
+		}
+	}
+	for _, cipher := range []blockcipher.LayerCipherType{blockcipher.AES256CTR, blockcipher.AES256GCMChunked, blockcipher.ChaCha20Poly1305Chunked} {
+		if !ciphers[cipher] {
+			t.Errorf("No test vector for block cipher %s", cipher)
+		}
+	}
+}
+
+func TestVectorsTampered(t *testing.T) {
+	f, err := os.Open(vectorsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	vectors, err := Load(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vectors {
+		v.Ciphertext = append([]byte{}, v.Ciphertext...)
+		v.Ciphertext[0] ^= 1
+		if err := v.Verify(); err == nil {
+			t.Fatalf("%s: tampered ciphertext was not detected", v.Name)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package otel binds the tracing hooks of ocicrypt to OpenTelemetry, for
+// example
+//
+//	tracing.SetTracer(otel.NewTracer(otelapi.GetTracerProvider()))
+package otel
+
+import (
+	"context"
+
+	"github.com/containers/ocicrypt/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ScopeName is the name of the instrumentation scope of the spans of ocicrypt
+const ScopeName = "github.com/containers/ocicrypt"
+
+type tracer struct {
+	t trace.Tracer
+}
+
+// NewTracer returns a tracing.Tracer that starts the spans of ocicrypt with a
+// tracer of the OpenTelemetry tracer provider
+func NewTracer(tp trace.TracerProvider) tracing.Tracer {
+	return &tracer{t: tp.Tracer(ScopeName)}
+}
+
+func (t *tracer) Start(ctx context.Context, name string, attrs ...tracing.Attribute) (context.Context, tracing.Span) {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		kvs = append(kvs, attribute.String(attr.Key, attr.Value))
+	}
+	ctx, s := t.t.Start(ctx, name, trace.WithAttributes(kvs...))
+	return ctx, span{s}
+}
+
+type span struct {
+	s trace.Span
+}
+
+// End records the error, if any, on the span and ends it
+func (s span) End(err error) {
+	if err != nil {
+		s.s.RecordError(err)
+		s.s.SetStatus(codes.Error, err.Error())
+	}
+	s.s.End()
+}
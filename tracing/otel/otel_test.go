@@ -0,0 +1,65 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/containers/ocicrypt/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracer := NewTracer(tp)
+
+	ctx, parent := tracer.Start(context.Background(), tracing.SpanDecryptLayer, tracing.String(tracing.KeyLayerDigest, "sha256:abc"))
+	_, child := tracer.Start(ctx, tracing.SpanUnwrapKey, tracing.String(tracing.KeyKeyWrapper, "jwe"))
+	child.End(errors.New("no key"))
+	parent.End(nil)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	c, p := spans[0], spans[1]
+	if p.Name != tracing.SpanDecryptLayer || c.Name != tracing.SpanUnwrapKey {
+		t.Fatalf("unexpected spans %s and %s", p.Name, c.Name)
+	}
+	if c.Parent.SpanID() != p.SpanContext.SpanID() {
+		t.Fatal("span of the keywrapper is not a child of the span of the layer")
+	}
+	if p.InstrumentationScope.Name != ScopeName {
+		t.Fatalf("unexpected instrumentation scope %q", p.InstrumentationScope.Name)
+	}
+	want := attribute.String(tracing.KeyLayerDigest, "sha256:abc")
+	if len(p.Attributes) != 1 || p.Attributes[0] != want {
+		t.Fatalf("unexpected attributes %v", p.Attributes)
+	}
+	if p.Status.Code != codes.Unset {
+		t.Fatalf("unexpected status %v of the successful span", p.Status)
+	}
+	if c.Status.Code != codes.Error || c.Status.Description != "no key" || len(c.Events) != 1 {
+		t.Fatalf("error was not recorded on the span: %v %v", c.Status, c.Events)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package tracing defines the hooks for tracing the encryption and decryption
+// of layers. The tracing/otel package binds a Tracer to OpenTelemetry and
+// embedders can bind one to any other tracing system; by default no spans are
+// recorded.
+package tracing
+
+import (
+	"context"
+	"sync"
+)
+
+// The names of the spans started by ocicrypt
+const (
+	// SpanEncryptLayer covers EncryptLayer up to the return of its finalizer
+	SpanEncryptLayer = "ocicrypt.EncryptLayer"
+	// SpanDecryptLayer covers DecryptLayer, which unwraps the layer key and
+	// sets up the decryption of the layer
+	SpanDecryptLayer = "ocicrypt.DecryptLayer"
+	// SpanWrapKeys covers the wrapping of a layer key by a keywrapper
+	SpanWrapKeys = "ocicrypt.WrapKeys"
+	// SpanUnwrapKey covers the unwrapping of a layer key by a keywrapper
+	SpanUnwrapKey = "ocicrypt.UnwrapKey"
+)
+
+// The keys of the attributes of spans
+const (
+	KeyLayerDigest = "ocicrypt.layer.digest"
+	KeyKeyWrapper  = "ocicrypt.keywrapper"
+)
+
+// Attribute is a key-value pair describing a span
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// String returns an Attribute with the given key and value
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Tracer starts spans. Implementations must be safe for concurrent use.
+type Tracer interface {
+	// Start starts a span as a child of the span in ctx, if any, and returns
+	// a context holding the new span
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	// End ends the span; err is the error the traced operation failed with
+	// or nil on success
+	End(err error)
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, _ string, _ ...Attribute) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End(error) {}
+
+var (
+	tracerLock sync.RWMutex
+	tracer     Tracer = noopTracer{}
+)
+
+// SetTracer sets the Tracer used for starting spans; passing nil restores the
+// default that does not record any spans
+func SetTracer(t Tracer) {
+	tracerLock.Lock()
+	defer tracerLock.Unlock()
+
+	if t == nil {
+		t = noopTracer{}
+	}
+	tracer = t
+}
+
+// T returns the Tracer currently used for starting spans
+func T() Tracer {
+	tracerLock.RLock()
+	defer tracerLock.RUnlock()
+
+	return tracer
+}
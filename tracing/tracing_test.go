@@ -0,0 +1,39 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"testing"
+)
+
+type testTracer struct{}
+
+func (testTracer) Start(ctx context.Context, _ string, _ ...Attribute) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func TestSetTracer(t *testing.T) {
+	SetTracer(testTracer{})
+	if _, ok := T().(testTracer); !ok {
+		t.Fatal("Tracer was not set")
+	}
+	SetTracer(nil)
+	if _, ok := T().(noopTracer); !ok {
+		t.Fatal("Tracer was not reset")
+	}
+}
@@ -0,0 +1,48 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package utils
+
+import (
+	"sync"
+)
+
+// bufferPools holds a sync.Pool of buffers for every buffer size in use, so
+// that readers of many layers do not allocate a new buffer for each of them
+var bufferPools sync.Map
+
+// getBuffer returns a buffer of size bytes, reusing a pooled one if possible
+func getBuffer(size int) []byte {
+	p, ok := bufferPools.Load(size)
+	if !ok {
+		p, _ = bufferPools.LoadOrStore(size, &sync.Pool{})
+	}
+	if b, ok := p.(*sync.Pool).Get().(*[]byte); ok {
+		return *b
+	}
+	return make([]byte, size)
+}
+
+// putBuffer clears the buffer, so no data lingers in the pool, and returns it
+// to the pool of its size
+func putBuffer(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	if p, ok := bufferPools.Load(len(b)); ok {
+		p.(*sync.Pool).Put(&b)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package utils
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/opencontainers/go-digest"
+)
+
+// ParseCertificates parses one or more x.509 certificates in DER format, or
+// a PEM bundle holding a certificate chain
+func ParseCertificates(certBytes []byte, prefix string) ([]*x509.Certificate, error) {
+	if err := checkKeyDataSize(certBytes, prefix); err != nil {
+		return nil, err
+	}
+	if certs, err := x509.ParseCertificates(certBytes); err == nil && len(certs) > 0 {
+		return certs, nil
+	}
+	return parsePEMCertificates(certBytes, prefix)
+}
+
+// parsePEMCertificates parses all CERTIFICATE blocks of a PEM bundle
+func parsePEMCertificates(certBytes []byte, prefix string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, certBytes = pem.Decode(certBytes)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("%s: Could not parse x509 certificate: %w", prefix, err))
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: Could not PEM decode x509 certificate: %w", prefix, errdefs.ErrKeyMaterial)
+	}
+	return certs, nil
+}
+
+// SelectLeaf returns the leaf certificate of a certificate chain, which is the
+// first certificate that did not issue any of the other ones, and the other
+// certificates as intermediates in their original order
+func SelectLeaf(certs []*x509.Certificate) (*x509.Certificate, []*x509.Certificate) {
+	isIssuer := func(c *x509.Certificate) bool {
+		for _, other := range certs {
+			if other != c && !bytes.Equal(other.Raw, c.Raw) && bytes.Equal(other.RawIssuer, c.RawSubject) {
+				return true
+			}
+		}
+		return false
+	}
+	for i, c := range certs {
+		if !isIssuer(c) {
+			intermediates := make([]*x509.Certificate, 0, len(certs)-1)
+			intermediates = append(intermediates, certs[:i]...)
+			return c, append(intermediates, certs[i+1:]...)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, nil
+	}
+	// a cycle of cross-signed certificates; fall back to the first one
+	return certs[0], certs[1:]
+}
+
+// CertificateFingerprint returns the SHA-256 digest of the DER encoding of a
+// certificate
+func CertificateFingerprint(cert *x509.Certificate) digest.Digest {
+	return digest.FromBytes(cert.Raw)
+}
@@ -31,79 +31,133 @@ func min(a, b int) int {
 // interface. The DelayedReader holds back some buffer to the client
 // so that it can report any error that occurred on the Reader it wraps
 // early to the client while it may still have held some data back.
+// The memory it uses is bounded by twice the size of the delay buffer,
+// independent of the size of the buffers passed to Read(). The buffer is
+// used as a ring so that the held back bytes never need to be moved, and
+// WriteTo() hands the bytes to the writer without copying them first. The
+// buffer is taken from a pool and returned to it once the reader is drained
+// or fails.
 type DelayedReader struct {
-	reader   io.Reader // Reader to Read() bytes from and delay them
-	err      error     // error that occurred on the reader
-	buffer   []byte    // delay buffer
-	bufbytes int       // number of bytes in the delay buffer to give to Read(); on '0' we return 'EOF' to caller
-	bufoff   int       // offset in the delay buffer to give to Read()
+	reader io.Reader // Reader to Read() bytes from and delay them
+	err    error     // error that occurred on the reader
+	buffer []byte    // ring buffer holding the delayed bytes and the bytes read ahead
+	delay  int       // number of bytes to hold back until EOF
+	start  int       // offset in the buffer of the first byte to give to Read()
+	count  int       // number of bytes in the buffer; on '0' after EOF we return 'EOF' to caller
 }
 
 // NewDelayedReader wraps a io.Reader and allocates a delay buffer of bufsize bytes
 func NewDelayedReader(reader io.Reader, bufsize uint) io.Reader {
+	size := 2 * int(bufsize)
+	if size == 0 {
+		size = 1
+	}
 	return &DelayedReader{
 		reader: reader,
-		buffer: make([]byte, bufsize),
+		buffer: getBuffer(size),
+		delay:  int(bufsize),
 	}
 }
 
-// Read implements the io.Reader interface
-func (dr *DelayedReader) Read(p []byte) (int, error) {
-	if dr.err != nil && dr.err != io.EOF {
-		return 0, dr.err
-	}
-
-	// if we are completely drained, return io.EOF
-	if dr.err == io.EOF && dr.bufbytes == 0 {
-		return 0, io.EOF
+// release returns the buffer to the pool once no more bytes can be read
+func (dr *DelayedReader) release() {
+	if dr.buffer != nil && dr.err != nil && (dr.err != io.EOF || dr.count == 0) {
+		putBuffer(dr.buffer)
+		dr.buffer = nil
+		dr.start = 0
 	}
+}
 
-	// only at the beginning we fill our delay buffer in an extra step
-	if dr.bufbytes < len(dr.buffer) && dr.err == nil {
-		dr.bufbytes, dr.err = FillBuffer(dr.reader, dr.buffer)
-		if dr.err != nil && dr.err != io.EOF {
-			return 0, dr.err
+// fill fills up the free space of the ring buffer as long as we have not seen
+// EOF on the reader
+func (dr *DelayedReader) fill() error {
+	for dr.err == nil && dr.count < len(dr.buffer) {
+		off := (dr.start + dr.count) % len(dr.buffer)
+		end := len(dr.buffer)
+		if off < dr.start {
+			end = dr.start
 		}
+		n, err := FillBuffer(dr.reader, dr.buffer[off:end])
+		dr.count += n
+		dr.err = err
+	}
+	if dr.err != nil && dr.err != io.EOF {
+		return dr.err
 	}
-	// dr.err != nil means we have EOF and can drain the delay buffer
-	// otherwise we need to still read from the reader
+	return nil
+}
 
-	var tmpbuf []byte
-	tmpbufbytes := 0
+// next returns the contiguous bytes at the start of the ring buffer that may
+// be given out; before EOF we need to hold back the delay, after it we drain
+func (dr *DelayedReader) next() []byte {
+	avail := dr.count
 	if dr.err == nil {
-		tmpbuf = make([]byte, len(p))
-		tmpbufbytes, dr.err = FillBuffer(dr.reader, tmpbuf)
-		if dr.err != nil && dr.err != io.EOF {
-			return 0, dr.err
-		}
+		avail -= dr.delay
 	}
+	return dr.buffer[dr.start:min(len(dr.buffer), dr.start+avail)]
+}
 
-	// copy out of the delay buffer into 'p'
-	tocopy1 := min(len(p), dr.bufbytes)
-	c1 := copy(p[:tocopy1], dr.buffer[dr.bufoff:])
-	dr.bufoff += c1
-	dr.bufbytes -= c1
-
-	c2 := 0
-	// can p still hold more data?
-	if c1 < len(p) {
-		// copy out of the tmpbuf into 'p'
-		c2 = copy(p[tocopy1:], tmpbuf[:tmpbufbytes])
+// advance consumes n bytes at the start of the ring buffer
+func (dr *DelayedReader) advance(n int) {
+	dr.start = (dr.start + n) % len(dr.buffer)
+	dr.count -= n
+}
+
+// Read implements the io.Reader interface
+func (dr *DelayedReader) Read(p []byte) (int, error) {
+	if dr.err != nil && dr.err != io.EOF {
+		return 0, dr.err
+	}
+	if err := dr.fill(); err != nil {
+		dr.release()
+		return 0, err
 	}
 
-	// if tmpbuf holds data we need to hold onto, copy them
-	// into the delay buffer
-	if tmpbufbytes-c2 > 0 {
-		// left-shift the delay buffer and append the tmpbuf's remaining data
-		dr.buffer = dr.buffer[dr.bufoff : dr.bufoff+dr.bufbytes]
-		dr.buffer = append(dr.buffer, tmpbuf[c2:tmpbufbytes]...)
-		dr.bufoff = 0
-		dr.bufbytes = len(dr.buffer)
+	c := 0
+	for c < len(p) {
+		b := dr.next()
+		if len(b) == 0 {
+			break
+		}
+		n := copy(p[c:], b)
+		dr.advance(n)
+		c += n
 	}
 
-	var err error
-	if dr.bufbytes == 0 {
-		err = io.EOF
+	if dr.err == io.EOF && dr.count == 0 {
+		dr.release()
+		return c, io.EOF
+	}
+	return c, nil
+}
+
+// WriteTo implements the io.WriterTo interface and writes the bytes straight
+// from the delay buffer to w
+func (dr *DelayedReader) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for {
+		if dr.err != nil && dr.err != io.EOF {
+			return written, dr.err
+		}
+		if err := dr.fill(); err != nil {
+			dr.release()
+			return written, err
+		}
+		for {
+			b := dr.next()
+			if len(b) == 0 {
+				break
+			}
+			n, err := w.Write(b)
+			dr.advance(n)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+		if dr.err == io.EOF && dr.count == 0 {
+			dr.release()
+			return written, nil
+		}
 	}
-	return c1 + c2, err
 }
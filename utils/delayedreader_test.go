@@ -70,3 +70,65 @@ func TestDelayedReader(t *testing.T) {
 		}
 	}
 }
+
+func TestDelayedReaderBoundedMemory(t *testing.T) {
+	obuf := make([]byte, 1<<20)
+	for i := range obuf {
+		obuf[i] = byte(i)
+	}
+	dr := NewDelayedReader(bytes.NewReader(obuf), 1024).(*DelayedReader)
+
+	// reading with a large buffer must not grow the delay buffer
+	buf := make([]byte, len(obuf))
+	var ibuf []byte
+	for {
+		n, err := dr.Read(buf)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		ibuf = append(ibuf, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if cap(dr.buffer) != 2*1024 {
+			t.Fatalf("delay buffer grew to %d bytes", cap(dr.buffer))
+		}
+	}
+	// the drained reader returned its buffer to the pool
+	if dr.buffer != nil {
+		t.Fatal("delay buffer was not released")
+	}
+	if n, err := dr.Read(buf); n != 0 || err != io.EOF {
+		t.Fatalf("expected EOF after the end, got %d and %v", n, err)
+	}
+	if !reflect.DeepEqual(ibuf, obuf) {
+		t.Fatalf("original buffer (len=%d) != received buffer (len=%d)", len(obuf), len(ibuf))
+	}
+}
+
+func TestDelayedReaderWriteTo(t *testing.T) {
+	obuf := make([]byte, 100000)
+	for i := range obuf {
+		obuf[i] = byte(i % 251)
+	}
+
+	for _, bufsize := range makeRange(1, 40) {
+		dr := NewDelayedReader(bytes.NewReader(obuf), uint(bufsize))
+
+		// an odd sized Read() first so that the ring buffer wraps around
+		buf := make([]byte, 7)
+		n, err := dr.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ibuf bytes.Buffer
+		ibuf.Write(buf[:n])
+		if _, err := io.Copy(&ibuf, dr); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ibuf.Bytes(), obuf) {
+			t.Fatalf("original buffer (len=%d) != received buffer (len=%d) for bufsize %d", len(obuf), ibuf.Len(), bufsize)
+		}
+	}
+}
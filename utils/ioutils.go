@@ -18,6 +18,8 @@ package utils
 
 import (
 	"io"
+
+	"github.com/opencontainers/go-digest"
 )
 
 // FillBuffer fills the given buffer with as many bytes from the reader as possible. It returns
@@ -29,3 +31,36 @@ func FillBuffer(reader io.Reader, buffer []byte) (int, error) {
 	}
 	return n, err
 }
+
+// DigestingReader computes the digest and counts the bytes of the data read
+// through it
+type DigestingReader struct {
+	r        io.Reader
+	digester digest.Digester
+	n        int64
+}
+
+// NewDigestingReader returns a DigestingReader reading from r
+func NewDigestingReader(r io.Reader) *DigestingReader {
+	return &DigestingReader{
+		r:        r,
+		digester: digest.Canonical.Digester(),
+	}
+}
+
+func (dr *DigestingReader) Read(p []byte) (int, error) {
+	n, err := dr.r.Read(p)
+	dr.digester.Hash().Write(p[:n])
+	dr.n += int64(n)
+	return n, err
+}
+
+// Digest returns the digest of the data read so far
+func (dr *DigestingReader) Digest() digest.Digest {
+	return dr.digester.Digest()
+}
+
+// Size returns the number of bytes read so far
+func (dr *DigestingReader) Size() int64 {
+	return dr.n
+}
@@ -0,0 +1,73 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+// keybox blob types, see kbx/keybox-blob.c of GnuPG
+const (
+	keyboxBlobEmpty   = 0
+	keyboxBlobHeader  = 1
+	keyboxBlobOpenPGP = 2
+	keyboxBlobX509    = 3
+)
+
+// isKeybox returns true if the data starts with the header blob of a keybox
+// file, which gpg uses for pubring.kbx since GnuPG 2.1
+func isKeybox(data []byte) bool {
+	return len(data) >= 32 && data[4] == keyboxBlobHeader && string(data[8:12]) == "KBXf"
+}
+
+// readKeybox returns the OpenPGP keyblocks of all keys in a keybox file
+// concatenated into a key ring in binary format; X.509 certificates stored
+// by gpgsm are skipped
+func readKeybox(data []byte) ([]byte, error) {
+	var keyRing []byte
+	for len(data) > 0 {
+		if len(data) < 6 {
+			return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("keybox: truncated blob"))
+		}
+		length := binary.BigEndian.Uint32(data)
+		if length < 6 || uint64(length) > uint64(len(data)) {
+			return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("keybox: invalid blob length %d", length))
+		}
+		blob := data[:length]
+		data = data[length:]
+
+		switch blob[4] {
+		case keyboxBlobOpenPGP:
+			if len(blob) < 16 {
+				return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("keybox: truncated OpenPGP blob"))
+			}
+			offset := uint64(binary.BigEndian.Uint32(blob[8:]))
+			size := uint64(binary.BigEndian.Uint32(blob[12:]))
+			if offset+size > uint64(len(blob)) {
+				return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("keybox: keyblock exceeds its blob"))
+			}
+			keyRing = append(keyRing, blob[offset:offset+size]...)
+		case keyboxBlobEmpty, keyboxBlobHeader, keyboxBlobX509:
+		default:
+			return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("keybox: unknown blob type %d", blob[4]))
+		}
+	}
+	return keyRing, nil
+}
@@ -0,0 +1,45 @@
+//go:build !go1.26
+// +build !go1.26
+
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+var errMLKEM768X25519Unavailable = fmt.Errorf("MLKEM768-X25519 keys require Go 1.26 or later: %w", errdefs.ErrUnsupportedKey)
+
+// ParseMLKEM768X25519PublicKey needs crypto/hpke, which is available since
+// Go 1.26
+func ParseMLKEM768X25519PublicKey(pubKey []byte, prefix string) (interface{}, error) {
+	return nil, errMLKEM768X25519Unavailable
+}
+
+// ParseMLKEM768X25519PrivateKey needs crypto/hpke, which is available since
+// Go 1.26
+func ParseMLKEM768X25519PrivateKey(privKey []byte, prefix string) (interface{}, error) {
+	return nil, errMLKEM768X25519Unavailable
+}
+
+// GenerateMLKEM768X25519Key needs crypto/hpke, which is available since Go 1.26
+func GenerateMLKEM768X25519Key() ([]byte, []byte, error) {
+	return nil, nil, errMLKEM768X25519Unavailable
+}
@@ -0,0 +1,82 @@
+//go:build go1.26
+// +build go1.26
+
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package utils
+
+import (
+	"crypto/hpke"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/containers/ocicrypt/errdefs"
+)
+
+// ParseMLKEM768X25519PublicKey parses a PEM encoded MLKEM768-X25519 public key
+// and returns it as hpke.PublicKey
+func ParseMLKEM768X25519PublicKey(pubKey []byte, prefix string) (interface{}, error) {
+	der, err := decodeMLKEM768X25519PEM(pubKey, MLKEM768X25519PublicKeyType, prefix)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hpke.MLKEM768X25519().NewPublicKey(der)
+	if err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("%s: Could not parse MLKEM768-X25519 public key: %w", prefix, err))
+	}
+	return key, nil
+}
+
+// ParseMLKEM768X25519PrivateKey parses a PEM encoded MLKEM768-X25519 private
+// key and returns it as hpke.PrivateKey
+func ParseMLKEM768X25519PrivateKey(privKey []byte, prefix string) (interface{}, error) {
+	der, err := decodeMLKEM768X25519PEM(privKey, MLKEM768X25519PrivateKeyType, prefix)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hpke.MLKEM768X25519().NewPrivateKey(der)
+	if err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("%s: Could not parse MLKEM768-X25519 private key: %w", prefix, err))
+	}
+	return key, nil
+}
+
+// GenerateMLKEM768X25519Key generates a new MLKEM768-X25519 key pair and
+// returns its PEM encoded public and private key
+func GenerateMLKEM768X25519Key() ([]byte, []byte, error) {
+	key, err := hpke.MLKEM768X25519().GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	privDER, err := key.Bytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: MLKEM768X25519PublicKeyType, Bytes: key.PublicKey().Bytes()}),
+		pem.EncodeToMemory(&pem.Block{Type: MLKEM768X25519PrivateKeyType, Bytes: privDER}), nil
+}
+
+func decodeMLKEM768X25519PEM(data []byte, pemType, prefix string) ([]byte, error) {
+	if err := checkKeyDataSize(data, prefix); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != pemType {
+		return nil, fmt.Errorf("%s: Not a PEM encoded %s: %w", prefix, pemType, errdefs.ErrKeyMaterial)
+	}
+	return block.Bytes, nil
+}
@@ -0,0 +1,62 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
+	"golang.org/x/crypto/ssh"
+)
+
+// openSSHPrivateKeyType is the PEM block type of private keys written by
+// ssh-keygen since OpenSSH 7.8
+const openSSHPrivateKeyType = "OPENSSH PRIVATE KEY"
+
+// parseOpenSSHPrivateKey parses an RSA, ECDSA or ed25519 private key in the
+// OpenSSH format, decrypting it with the given password if it is encrypted
+func parseOpenSSHPrivateKey(block *pem.Block, password []byte, prefix string) (interface{}, error) {
+	data := pem.EncodeToMemory(block)
+	key, err := ssh.ParseRawPrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if password == nil {
+			return nil, fmt.Errorf("%s: Missing password for encrypted private key: %w", prefix, errdefs.ErrWrongPassword)
+		}
+		if fips.Enforced() {
+			// the key derivation uses bcrypt_pbkdf
+			return nil, fmt.Errorf("%s: Encrypted OpenSSH private keys are not available in FIPS 140-only mode: %w", prefix, errdefs.ErrDisallowedAlgorithm)
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(data, password)
+		if err == x509.IncorrectPasswordError {
+			return nil, fmt.Errorf("%s: Wrong password: could not decrypt private key: %w", prefix, errdefs.ErrWrongPassword)
+		}
+	}
+	if err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("%s: Could not parse OpenSSH private key: %w", prefix, err))
+	}
+	// return ed25519 keys by value as x509.ParsePKCS8PrivateKey does
+	if k, ok := key.(*ed25519.PrivateKey); ok {
+		return *k, nil
+	}
+	return key, nil
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package utils
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// pfxVersion is the version of the PFX PDU of PKCS#12 (RFC 7292)
+const pfxVersion = 3
+
+// IsPKCS12 returns true in case the given byte array is a PKCS#12 bundle
+// (.p12/.pfx); it does not need the password
+func IsPKCS12(data []byte) bool {
+	var pfx struct {
+		Version  int
+		AuthSafe asn1.RawValue
+		MacData  asn1.RawValue `asn1:"optional"`
+	}
+	rest, err := asn1.Unmarshal(data, &pfx)
+	return err == nil && len(rest) == 0 && pfx.Version == pfxVersion
+}
+
+// ParsePKCS12 parses a PKCS#12 bundle (.p12/.pfx) protected by the given
+// password and returns its private key and its certificates, the certificate
+// of the private key first. Bundles using PBES2 with AES, as exported by
+// OpenSSL 3, and the legacy PKCS#12 algorithms are supported.
+func ParsePKCS12(data, password []byte, prefix string) (interface{}, []*x509.Certificate, error) {
+	if err := checkKeyDataSize(data, prefix); err != nil {
+		return nil, nil, err
+	}
+	if fips.Enforced() {
+		// the PKCS#12 MAC and the legacy encryption use the PKCS#12 key
+		// derivation, which is not an approved algorithm
+		return nil, nil, fmt.Errorf("%s: PKCS#12 bundles are not available in FIPS 140-only mode: %w", prefix, errdefs.ErrDisallowedAlgorithm)
+	}
+	key, cert, caCerts, err := pkcs12.DecodeChain(data, string(password))
+	if err != nil {
+		if errors.Is(err, pkcs12.ErrIncorrectPassword) {
+			if password == nil {
+				return nil, nil, fmt.Errorf("%s: Missing password for PKCS#12 bundle: %w", prefix, errdefs.ErrWrongPassword)
+			}
+			return nil, nil, fmt.Errorf("%s: Wrong password: could not decrypt PKCS#12 bundle: %w", prefix, errdefs.ErrWrongPassword)
+		}
+		var notImplementedErr pkcs12.NotImplementedError
+		if errors.As(err, &notImplementedErr) {
+			return nil, nil, fmt.Errorf("%s: PKCS#12 bundle uses unsupported algorithms: %v: %w", prefix, err, errdefs.ErrKeyMaterial)
+		}
+		return nil, nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("%s: Could not parse PKCS#12 bundle: %w", prefix, err))
+	}
+
+	// the certificate of the key comes first, followed by its chain; bundles
+	// do not always hold it first
+	certs := append([]*x509.Certificate{cert}, caCerts...)
+	keyID := KeyID(key)
+	for i, cert := range certs {
+		if KeyID(cert.PublicKey) == keyID {
+			certs[0], certs[i] = certs[i], certs[0]
+			break
+		}
+	}
+	return key, certs, nil
+}
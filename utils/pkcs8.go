@@ -0,0 +1,175 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"hash"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// encryptedPKCS8Type is the PEM block type of encrypted PKCS#8 private keys
+// as written by 'openssl genpkey' and 'openssl pkcs8 -topk8'
+const encryptedPKCS8Type = "ENCRYPTED PRIVATE KEY"
+
+// maxPBKDF2Iterations limits the work spent on deriving the key of an
+// encrypted PKCS#8 private key
+const maxPBKDF2Iterations = 10000000
+
+var (
+	oidPBES2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA224 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 8}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// encryptedPrivateKeyInfo is the EncryptedPrivateKeyInfo of RFC 5208
+type encryptedPrivateKeyInfo struct {
+	EncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+// pbes2Params are the PBES2-params of RFC 8018
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params are the PBKDF2-params of RFC 8018
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// pbkdf2PRF returns the hash function of the PRF of PBKDF2; hmacWithSHA1 is
+// the default
+func pbkdf2PRF(prf pkix.AlgorithmIdentifier) (func() hash.Hash, error) {
+	switch {
+	case len(prf.Algorithm) == 0, prf.Algorithm.Equal(oidHMACWithSHA1):
+		return sha1.New, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA224):
+		return sha256.New224, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA256):
+		return sha256.New, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA384):
+		return sha512.New384, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA512):
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported PBKDF2 PRF %s", prf.Algorithm)
+}
+
+// pbes2Cipher returns the block cipher constructor and key length of the
+// PBES2 encryption scheme
+func pbes2Cipher(scheme pkix.AlgorithmIdentifier) (func([]byte) (cipher.Block, error), int, error) {
+	switch {
+	case scheme.Algorithm.Equal(oidAES128CBC):
+		return aes.NewCipher, 16, nil
+	case scheme.Algorithm.Equal(oidAES192CBC):
+		return aes.NewCipher, 24, nil
+	case scheme.Algorithm.Equal(oidAES256CBC):
+		return aes.NewCipher, 32, nil
+	case scheme.Algorithm.Equal(oidDESEDE3CBC):
+		return des.NewTripleDESCipher, 24, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported PBES2 encryption scheme %s", scheme.Algorithm)
+}
+
+// decryptPKCS8PrivateKey decrypts a PBES2-encrypted PKCS#8 private key and
+// returns the DER of the unencrypted PKCS#8 private key
+func decryptPKCS8PrivateKey(der, password []byte, prefix string) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("%s: Could not parse encrypted PKCS#8 private key: %w", prefix, err))
+	}
+	if !info.EncryptionAlgorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("%s: Unsupported encryption %s of PKCS#8 private key, only PBES2 is supported: %w", prefix, info.EncryptionAlgorithm.Algorithm, errdefs.ErrKeyMaterial)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.EncryptionAlgorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("%s: Could not parse PBES2 parameters: %w", prefix, err))
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("%s: Unsupported key derivation %s of PKCS#8 private key, only PBKDF2 is supported: %w", prefix, params.KeyDerivationFunc.Algorithm, errdefs.ErrKeyMaterial)
+	}
+	var kdfParams pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("%s: Could not parse PBKDF2 parameters: %w", prefix, err))
+	}
+	if kdfParams.IterationCount <= 0 || kdfParams.IterationCount > maxPBKDF2Iterations {
+		return nil, fmt.Errorf("%s: PBKDF2 iteration count %d is out of range: %w", prefix, kdfParams.IterationCount, errdefs.ErrLimitExceeded)
+	}
+	prf, err := pbkdf2PRF(kdfParams.PRF)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v: %w", prefix, err, errdefs.ErrKeyMaterial)
+	}
+	newCipher, keyLen, err := pbes2Cipher(params.EncryptionScheme)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v: %w", prefix, err, errdefs.ErrKeyMaterial)
+	}
+	if kdfParams.KeyLength != 0 && kdfParams.KeyLength != keyLen {
+		return nil, fmt.Errorf("%s: PBKDF2 key length %d does not match the encryption scheme: %w", prefix, kdfParams.KeyLength, errdefs.ErrKeyMaterial)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("%s: Could not parse IV of encrypted PKCS#8 private key: %w", prefix, err))
+	}
+
+	if fips.Enforced() && (len(password) < 112/8 || len(kdfParams.PRF.Algorithm) == 0 || kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA1)) {
+		// HMAC keys of less than 112 bits and SHA-1 are not approved
+		return nil, fmt.Errorf("%s: Encrypted PKCS#8 private keys with passwords of less than 14 bytes or hmacWithSHA1 are not available in FIPS 140-only mode: %w", prefix, errdefs.ErrDisallowedAlgorithm)
+	}
+	block, err := newCipher(pbkdf2.Key(password, kdfParams.Salt, kdfParams.IterationCount, keyLen, prf))
+	if err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("%s: %w", prefix, err))
+	}
+	if len(iv) != block.BlockSize() || len(info.EncryptedData) == 0 || len(info.EncryptedData)%block.BlockSize() != 0 {
+		return nil, fmt.Errorf("%s: Invalid IV or length of encrypted PKCS#8 private key: %w", prefix, errdefs.ErrKeyMaterial)
+	}
+	plain := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, info.EncryptedData)
+
+	// a wrong password shows as invalid padding most of the time
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > block.BlockSize() || !bytes.Equal(plain[len(plain)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, fmt.Errorf("%s: Wrong password: could not decrypt private key: %w", prefix, errdefs.ErrWrongPassword)
+	}
+	return plain[:len(plain)-pad], nil
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package securemem provides buffers for secrets such as private keys,
+// passwords and PINs. On Linux the buffers are allocated outside of the Go
+// heap, locked into memory so they are not swapped out, excluded from core
+// dumps and surrounded by inaccessible guard pages. On other platforms the
+// buffers are ordinary heap allocations that are wiped when destroyed.
+package securemem
+
+import (
+	"sync"
+)
+
+// Buffer holds a secret
+type Buffer struct {
+	lock sync.Mutex
+	data []byte
+	mem  []byte // the whole allocation including guard pages; nil for heap allocations
+}
+
+// New allocates a Buffer that can hold size bytes
+func New(size int) (*Buffer, error) {
+	if size == 0 {
+		return &Buffer{data: []byte{}}, nil
+	}
+	return alloc(size)
+}
+
+// NewFromBytes allocates a Buffer, copies the given secret into it and wipes
+// the given byte slice
+func NewFromBytes(secret []byte) (*Buffer, error) {
+	b, err := New(len(secret))
+	if err != nil {
+		return nil, err
+	}
+	copy(b.data, secret)
+	Wipe(secret)
+	return b, nil
+}
+
+// Bytes returns the secret held by the Buffer; the returned slice must not be
+// used after Destroy was called
+func (b *Buffer) Bytes() []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.data
+}
+
+// Destroy wipes the secret and releases the memory of the Buffer
+func (b *Buffer) Destroy() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	Wipe(b.data)
+	b.data = nil
+	if b.mem == nil {
+		return nil
+	}
+	err := free(b.mem)
+	b.mem = nil
+	return err
+}
+
+// Wipe overwrites the given byte slice with zeros
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
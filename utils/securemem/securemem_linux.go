@@ -0,0 +1,65 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package securemem
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// alloc maps the pages for the secret with an inaccessible guard page before
+// and after them; the pages holding the secret are locked into memory and
+// excluded from core dumps. The secret is placed at the end of its pages so
+// that an overflow hits the trailing guard page.
+func alloc(size int) (*Buffer, error) {
+	pagesize := os.Getpagesize()
+	datapages := (size + pagesize - 1) / pagesize
+	total := (datapages + 2) * pagesize
+
+	mem, err := unix.Mmap(-1, 0, total, unix.PROT_NONE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, fmt.Errorf("could not mmap memory: %w", err)
+	}
+
+	inner := mem[pagesize : total-pagesize]
+	if err := unix.Mprotect(inner, unix.PROT_READ|unix.PROT_WRITE); err != nil {
+		_ = unix.Munmap(mem)
+		return nil, fmt.Errorf("could not mprotect memory: %w", err)
+	}
+	if err := unix.Mlock(inner); err != nil {
+		_ = unix.Munmap(mem)
+		return nil, fmt.Errorf("could not mlock memory; RLIMIT_MEMLOCK may be too low: %w", err)
+	}
+	// not being able to exclude the memory from core dumps is not fatal
+	_ = unix.Madvise(inner, unix.MADV_DONTDUMP)
+
+	return &Buffer{
+		data: inner[len(inner)-size:],
+		mem:  mem,
+	}, nil
+}
+
+func free(mem []byte) error {
+	pagesize := os.Getpagesize()
+	inner := mem[pagesize : len(mem)-pagesize]
+
+	Wipe(inner)
+	_ = unix.Munlock(inner)
+	return unix.Munmap(mem)
+}
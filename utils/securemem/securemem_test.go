@@ -0,0 +1,46 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package securemem
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNewFromBytes(t *testing.T) {
+	for _, size := range []int{0, 1, 31, 4096, 10000} {
+		secret := bytes.Repeat([]byte{0xaa}, size)
+		orig := append([]byte{}, secret...)
+
+		b, err := NewFromBytes(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), orig) {
+			t.Fatalf("Buffer of size %d does not hold the secret", size)
+		}
+		if !bytes.Equal(secret, make([]byte, size)) {
+			t.Fatalf("Source of size %d was not wiped", size)
+		}
+		if err := b.Destroy(); err != nil {
+			t.Fatal(err)
+		}
+		if b.Bytes() != nil {
+			t.Fatal("Bytes() must return nil after Destroy()")
+		}
+	}
+}
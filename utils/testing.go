@@ -18,23 +18,36 @@ package utils
 
 import (
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
 	"math/big"
+	"testing"
 	"time"
 
-	"github.com/pkg/errors"
+	"github.com/containers/ocicrypt/fips"
 )
 
+// SkipInFIPSOnlyMode skips a test in FIPS 140-only mode, in which what it
+// tests needs algorithms that are not allowed
+func SkipInFIPSOnlyMode(t testing.TB, what string) {
+	t.Helper()
+	if fips.Enforced() {
+		t.Skipf("%s is not available in FIPS 140-only mode", what)
+	}
+}
+
 // CreateRSAKey creates an RSA key
 func CreateRSAKey(bits int) (*rsa.PrivateKey, error) {
 	key, err := rsa.GenerateKey(rand.Reader, bits)
 	if err != nil {
-		return nil, errors.Wrap(err, "rsa.GenerateKey failed")
+		return nil, fmt.Errorf("rsa.GenerateKey failed: %w", err)
 	}
 	return key, nil
 }
@@ -49,7 +62,7 @@ func CreateRSATestKey(bits int, password []byte, pemencode bool) ([]byte, []byte
 
 	pubData, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "x509.MarshalPKIXPublicKey failed")
+		return nil, nil, fmt.Errorf("x509.MarshalPKIXPublicKey failed: %w", err)
 	}
 	privData := x509.MarshalPKCS1PrivateKey(key)
 
@@ -69,7 +82,7 @@ func CreateRSATestKey(bits int, password []byte, pemencode bool) ([]byte, []byte
 	if len(password) > 0 {
 		block, err = x509.EncryptPEMBlock(rand.Reader, typ, privData, password, x509.PEMCipherAES256)
 		if err != nil {
-			return nil, nil, errors.Wrap(err, "x509.EncryptPEMBlock failed")
+			return nil, nil, fmt.Errorf("x509.EncryptPEMBlock failed: %w", err)
 		}
 	} else {
 		block = &pem.Block{
@@ -83,22 +96,40 @@ func CreateRSATestKey(bits int, password []byte, pemencode bool) ([]byte, []byte
 	return publicKey, privateKey, nil
 }
 
+// CreateECDSAKey creates an elliptic curve key for the given curve
+func CreateECDSAKey(curve elliptic.Curve) (*ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("ecdsa.GenerateKey failed: %w", err)
+	}
+	return key, nil
+}
+
+// CreateEd25519Key creates an Ed25519 key
+func CreateEd25519Key() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("ed25519.GenerateKey failed: %w", err)
+	}
+	return key, nil
+}
+
 // CreateECDSATestKey creates and elliptic curve key for the given curve and returns
 // the public and private key in DER format
 func CreateECDSATestKey(curve elliptic.Curve) ([]byte, []byte, error) {
-	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	key, err := CreateECDSAKey(curve)
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "ecdsa.GenerateKey failed")
+		return nil, nil, err
 	}
 
 	pubData, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "x509.MarshalPKIXPublicKey failed")
+		return nil, nil, fmt.Errorf("x509.MarshalPKIXPublicKey failed: %w", err)
 	}
 
 	privData, err := x509.MarshalECPrivateKey(key)
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "x509.MarshalECPrivateKey failed")
+		return nil, nil, fmt.Errorf("x509.MarshalECPrivateKey failed: %w", err)
 	}
 
 	return pubData, privData, nil
@@ -108,7 +139,7 @@ func CreateECDSATestKey(curve elliptic.Curve) ([]byte, []byte, error) {
 func CreateTestCA() (*rsa.PrivateKey, *x509.Certificate, error) {
 	key, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "rsa.GenerateKey failed")
+		return nil, nil, fmt.Errorf("rsa.GenerateKey failed: %w", err)
 	}
 
 	ca := &x509.Certificate{
@@ -127,6 +158,60 @@ func CreateTestCA() (*rsa.PrivateKey, *x509.Certificate, error) {
 	return key, caCert, err
 }
 
+// CreateCertificateChain creates a root CA, an intermediate CA issued by it
+// and a leaf certificate for an RSA key issued by the intermediate CA. It
+// returns the private key of the leaf certificate and the chain starting with
+// the leaf certificate and ending with the root CA.
+func CreateCertificateChain() (*rsa.PrivateKey, []*x509.Certificate, error) {
+	caKey, caCert, err := CreateTestCA()
+	if err != nil {
+		return nil, nil, err
+	}
+	intermediateKey, err := CreateRSAKey(2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	intermediateCert, err := certifyKey(&intermediateKey.PublicKey, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject: pkix.Name{
+			CommonName: "test-intermediate-ca",
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, caKey, caCert)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := CreateRSAKey(2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	leafCert, err := certifyKey(&key.PublicKey, nil, intermediateKey, intermediateCert)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, []*x509.Certificate{leafCert, intermediateCert, caCert}, nil
+}
+
+// CreateExpiredCert certifies a public key using the given CA's private key
+// and cert with a certificate that expired an hour ago
+func CreateExpiredCert(pubbytes []byte, caKey *rsa.PrivateKey, caCert *x509.Certificate) (*x509.Certificate, error) {
+	return CertifyKey(pubbytes, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: "testkey",
+		},
+		NotBefore:             time.Now().Add(-2 * time.Hour),
+		NotAfter:              time.Now().Add(-time.Hour),
+		IsCA:                  false,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}, caKey, caCert)
+}
+
 // CertifyKey certifies a public key using the given CA's private key and cert;
 // The certificate template for the public key is optional
 func CertifyKey(pubbytes []byte, template *x509.Certificate, caKey *rsa.PrivateKey, caCert *x509.Certificate) (*x509.Certificate, error) {
@@ -152,14 +237,27 @@ func certifyKey(pub interface{}, template *x509.Certificate, caKey *rsa.PrivateK
 		}
 	}
 
+	if template.IsCA && len(template.SubjectKeyId) == 0 {
+		// x509.CreateCertificate derives the subject key ID of CAs with
+		// SHA-1, which is not allowed in FIPS 140-only mode
+		pubData, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return nil, fmt.Errorf("x509.MarshalPKIXPublicKey failed: %w", err)
+		}
+		skid := sha256.Sum256(pubData)
+		t := *template
+		t.SubjectKeyId = skid[:20]
+		template = &t
+	}
+
 	certDER, err := x509.CreateCertificate(rand.Reader, template, caCert, pub, caKey)
 	if err != nil {
-		return nil, errors.Wrap(err, "x509.CreateCertificate failed")
+		return nil, fmt.Errorf("x509.CreateCertificate failed: %w", err)
 	}
 
 	cert, err := x509.ParseCertificate(certDER)
 	if err != nil {
-		return nil, errors.Wrap(err, "x509.ParseCertificate failed")
+		return nil, fmt.Errorf("x509.ParseCertificate failed: %w", err)
 	}
 
 	return cert, nil
@@ -0,0 +1,52 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package unixgrpc connects to local plugins and agents listening on unix
+// sockets, such as Kubernetes KMS plugins, with gRPC.
+package unixgrpc
+
+import (
+	"fmt"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Dial returns a client connection to the gRPC server listening on the unix
+// socket at path; the connection is only established by the first call
+func Dial(path string) (*grpc.ClientConn, error) {
+	conn, err := grpc.NewClient("unix://"+path, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, errdefs.WithCategory(errdefs.ErrConfiguration, fmt.Errorf("could not connect to the gRPC server at %s: %w", path, err))
+	}
+	return conn, nil
+}
+
+// Error describes the failure of a call of method of the gRPC server at path.
+// Servers that cannot be reached or did not respond in time cause an error
+// wrapping ErrProviderUnreachable.
+func Error(err error, path, method string) error {
+	s := status.Convert(err)
+	err = fmt.Errorf("%s at %s failed with gRPC status %s: %s", method, path, s.Code(), s.Message())
+	switch s.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return errdefs.WithCategory(errdefs.ErrProviderUnreachable, err)
+	}
+	return err
+}
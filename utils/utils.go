@@ -18,25 +18,54 @@ package utils
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/containers/ocicrypt/crypto/pkcs11"
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/containers/ocicrypt/fips"
+	"github.com/opencontainers/go-digest"
 
-	"github.com/pkg/errors"
-	"golang.org/x/crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
 	json "gopkg.in/square/go-jose.v2"
 )
 
+const (
+	// MLKEM768X25519PublicKeyType is the PEM type of MLKEM768-X25519 (X-Wing)
+	// public keys, which hold the 1216 byte encapsulation key
+	MLKEM768X25519PublicKeyType = "MLKEM768-X25519 PUBLIC KEY"
+	// MLKEM768X25519PrivateKeyType is the PEM type of MLKEM768-X25519 private
+	// keys, which hold the 32 byte seed
+	MLKEM768X25519PrivateKeyType = "MLKEM768-X25519 PRIVATE KEY"
+)
+
+// MaxKeyDataSize is the maximum size in bytes of a key, a certificate or a GPG
+// keyring that is parsed; larger ones are rejected before parsing
+const MaxKeyDataSize = 1024 * 1024
+
+// checkKeyDataSize checks that data does not exceed MaxKeyDataSize
+func checkKeyDataSize(data []byte, prefix string) error {
+	if len(data) > MaxKeyDataSize {
+		return fmt.Errorf("%s: key data of %d bytes is larger than the maximum of %d bytes: %w", prefix, len(data), MaxKeyDataSize, errdefs.ErrLimitExceeded)
+	}
+	return nil
+}
+
 // parseJWKPrivateKey parses the input byte array as a JWK and makes sure it's a private key
 func parseJWKPrivateKey(privKey []byte, prefix string) (interface{}, error) {
 	jwk := json.JSONWebKey{}
 	err := jwk.UnmarshalJSON(privKey)
 	if err != nil {
-		return nil, errors.Wrapf(err, "%s: Could not parse input as JWK", prefix)
+		return nil, fmt.Errorf("%s: Could not parse input as JWK: %w", prefix, err)
 	}
 	if jwk.IsPublic() {
 		return nil, fmt.Errorf("%s: JWK is not a private key", prefix)
@@ -49,7 +78,7 @@ func parseJWKPublicKey(privKey []byte, prefix string) (interface{}, error) {
 	jwk := json.JSONWebKey{}
 	err := jwk.UnmarshalJSON(privKey)
 	if err != nil {
-		return nil, errors.Wrapf(err, "%s: Could not parse input as JWK", prefix)
+		return nil, fmt.Errorf("%s: Could not parse input as JWK: %w", prefix, err)
 	}
 	if !jwk.IsPublic() {
 		return nil, fmt.Errorf("%s: JWK is not a public key", prefix)
@@ -69,12 +98,55 @@ func parsePkcs11PublicKeyYaml(yaml []byte, prefix string) (*pkcs11.Pkcs11KeyFile
 	return pkcs11.ParsePkcs11KeyFile(yaml)
 }
 
+// KeyID returns an identifier of a public or private key, which is the
+// SHA-256 digest of the public key in DER encoded PKIX format, such as
+// 'sha256:<hex>'. An empty string is returned for unsupported keys.
+func KeyID(key interface{}) string {
+	if jwk, ok := key.(*json.JSONWebKey); ok {
+		key = jwk.Key
+	}
+	if privKey, ok := key.(interface{ Public() crypto.PublicKey }); ok {
+		key = privKey.Public()
+	}
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return ""
+	}
+	return digest.FromBytes(der).String()
+}
+
+// KeyType returns a description of the type of a public or private key, such
+// as "RSA", "ECDSA P-256" or "Ed25519", for use in error messages
+func KeyType(key interface{}) string {
+	if jwk, ok := key.(*json.JSONWebKey); ok {
+		key = jwk.Key
+	}
+	if privKey, ok := key.(interface{ Public() crypto.PublicKey }); ok {
+		key = privKey.Public()
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return "RSA"
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	if isX25519Key(key) {
+		return "X25519"
+	}
+	return fmt.Sprintf("%T", key)
+}
+
 // IsPasswordError checks whether an error is related to a missing or wrong
 // password
 func IsPasswordError(err error) bool {
 	if err == nil {
 		return false
 	}
+	if errors.Is(err, errdefs.ErrWrongPassword) {
+		return true
+	}
 	msg := strings.ToLower(err.Error())
 
 	return strings.Contains(msg, "password") &&
@@ -82,8 +154,13 @@ func IsPasswordError(err error) bool {
 }
 
 // ParsePrivateKey tries to parse a private key in DER format first and
-// PEM format after, returning an error if the parsing failed
+// PEM format after, including encrypted PKCS#8 and the OpenSSH format, then
+// as PKCS#12 bundle, JWK and pkcs11 key file, returning an error if the
+// parsing failed
 func ParsePrivateKey(privKey, privKeyPassword []byte, prefix string) (interface{}, error) {
+	if err := checkKeyDataSize(privKey, prefix); err != nil {
+		return nil, err
+	}
 	key, err := x509.ParsePKCS8PrivateKey(privKey)
 	if err != nil {
 		key, err = x509.ParsePKCS1PrivateKey(privKey)
@@ -93,16 +170,35 @@ func ParsePrivateKey(privKey, privKeyPassword []byte, prefix string) (interface{
 	}
 	if err != nil {
 		block, _ := pem.Decode(privKey)
-		if block != nil {
+		if block != nil && block.Type == openSSHPrivateKeyType {
+			key, err = parseOpenSSHPrivateKey(block, privKeyPassword, prefix)
+		} else if block != nil {
 			var der []byte
 			if x509.IsEncryptedPEMBlock(block) {
 				if privKeyPassword == nil {
-					return nil, errors.Errorf("%s: Missing password for encrypted private key", prefix)
+					return nil, fmt.Errorf("%s: Missing password for encrypted private key: %w", prefix, errdefs.ErrWrongPassword)
+				}
+				if fips.Enforced() {
+					// the legacy PEM encryption uses MD5
+					return nil, fmt.Errorf("%s: Encrypted PEM private keys are not available in FIPS 140-only mode: %w", prefix, errdefs.ErrDisallowedAlgorithm)
 				}
 				der, err = x509.DecryptPEMBlock(block, privKeyPassword)
 				if err != nil {
-					return nil, errors.Errorf("%s: Wrong password: could not decrypt private key", prefix)
+					return nil, fmt.Errorf("%s: Wrong password: could not decrypt private key: %w", prefix, errdefs.ErrWrongPassword)
+				}
+			} else if block.Type == encryptedPKCS8Type {
+				if privKeyPassword == nil {
+					return nil, fmt.Errorf("%s: Missing password for encrypted private key: %w", prefix, errdefs.ErrWrongPassword)
+				}
+				der, err = decryptPKCS8PrivateKey(block.Bytes, privKeyPassword, prefix)
+				if err != nil {
+					return nil, err
+				}
+				if key, err = x509.ParsePKCS8PrivateKey(der); err != nil {
+					// the padding may be valid by chance with a wrong password
+					return nil, fmt.Errorf("%s: Wrong password: could not decrypt private key: %w", prefix, errdefs.ErrWrongPassword)
 				}
+				return key, nil
 			} else {
 				der = block.Bytes
 			}
@@ -111,9 +207,11 @@ func ParsePrivateKey(privKey, privKeyPassword []byte, prefix string) (interface{
 			if err != nil {
 				key, err = x509.ParsePKCS1PrivateKey(der)
 				if err != nil {
-					return nil, errors.Wrapf(err, "%s: Could not parse private key", prefix)
+					return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("%s: Could not parse private key: %w", prefix, err))
 				}
 			}
+		} else if IsPKCS12(privKey) {
+			key, _, err = ParsePKCS12(privKey, privKeyPassword, prefix)
 		} else {
 			key, err = parseJWKPrivateKey(privKey, prefix)
 			if err != nil {
@@ -139,13 +237,16 @@ func IsPkcs11PrivateKey(data []byte) bool {
 // ParsePublicKey tries to parse a public key in DER format first and
 // PEM format after, returning an error if the parsing failed
 func ParsePublicKey(pubKey []byte, prefix string) (interface{}, error) {
+	if err := checkKeyDataSize(pubKey, prefix); err != nil {
+		return nil, err
+	}
 	key, err := x509.ParsePKIXPublicKey(pubKey)
 	if err != nil {
 		block, _ := pem.Decode(pubKey)
 		if block != nil {
 			key, err = x509.ParsePKIXPublicKey(block.Bytes)
 			if err != nil {
-				return nil, errors.Wrapf(err, "%s: Could not parse public key", prefix)
+				return nil, errdefs.WithCategory(errdefs.ErrKeyMaterial, fmt.Errorf("%s: Could not parse public key: %w", prefix, err))
 			}
 		} else {
 			key, err = parseJWKPublicKey(pubKey, prefix)
@@ -163,26 +264,55 @@ func IsPublicKey(data []byte) bool {
 	return err == nil
 }
 
+// IsX25519PublicKey returns true in case the given byte array represents an
+// X25519 public key, which requires Go 1.20 or later
+func IsX25519PublicKey(data []byte) bool {
+	key, err := ParsePublicKey(data, "")
+	return err == nil && isX25519Key(key)
+}
+
+// IsX25519PrivateKey returns true in case the given byte array represents an
+// X25519 private key, which requires Go 1.20 or later
+func IsX25519PrivateKey(data []byte, password []byte) bool {
+	key, err := ParsePrivateKey(data, password, "")
+	return err == nil && isX25519Key(key)
+}
+
+// IsMLKEM768X25519PublicKey returns true in case the given byte array
+// represents an MLKEM768-X25519 public key, which requires Go 1.26 or later
+func IsMLKEM768X25519PublicKey(data []byte) bool {
+	_, err := ParseMLKEM768X25519PublicKey(data, "")
+	return err == nil
+}
+
+// IsMLKEM768X25519PrivateKey returns true in case the given byte array
+// represents an MLKEM768-X25519 private key, which requires Go 1.26 or later
+func IsMLKEM768X25519PrivateKey(data []byte) bool {
+	_, err := ParseMLKEM768X25519PrivateKey(data, "")
+	return err == nil
+}
+
 // IsPkcs11PublicKey returns true in case the given byte array represents a pkcs11 public key
 func IsPkcs11PublicKey(data []byte) bool {
 	return pkcs11.IsPkcs11PublicKey(data)
 }
 
 // ParseCertificate tries to parse a public key in DER format first and
-// PEM format after, returning an error if the parsing failed
+// PEM format after, returning an error if the parsing failed. Of a PEM bundle
+// holding a certificate chain the leaf certificate is returned.
 func ParseCertificate(certBytes []byte, prefix string) (*x509.Certificate, error) {
+	if err := checkKeyDataSize(certBytes, prefix); err != nil {
+		return nil, err
+	}
 	x509Cert, err := x509.ParseCertificate(certBytes)
 	if err != nil {
-		block, _ := pem.Decode(certBytes)
-		if block == nil {
-			return nil, fmt.Errorf("%s: Could not PEM decode x509 certificate", prefix)
-		}
-		x509Cert, err = x509.ParseCertificate(block.Bytes)
+		certs, err := parsePEMCertificates(certBytes, prefix)
 		if err != nil {
-			return nil, errors.Wrapf(err, "%s: Could not parse x509 certificate", prefix)
+			return nil, err
 		}
+		x509Cert, _ = SelectLeaf(certs)
 	}
-	return x509Cert, err
+	return x509Cert, nil
 }
 
 // IsCertificate returns true in case the given byte array represents an x.509 certificate
@@ -193,11 +323,61 @@ func IsCertificate(data []byte) bool {
 
 // IsGPGPrivateKeyRing returns true in case the given byte array represents a GPG private key ring file
 func IsGPGPrivateKeyRing(data []byte) bool {
-	r := bytes.NewBuffer(data)
-	_, err := openpgp.ReadKeyRing(r)
+	// parsing a keyring needs SHA-1
+	if checkKeyDataSize(data, "") != nil || fips.Enforced() {
+		return false
+	}
+	_, err := ReadGPGKeyRing(data)
 	return err == nil
 }
 
+// ReadGPGKeyRing reads a key ring in binary format, in one or more ASCII
+// armored blocks as exported by gpg --export --armor or
+// gpg --export-secret-keys --armor, or in the keybox format of the
+// pubring.kbx of GnuPG 2.1 and later
+func ReadGPGKeyRing(data []byte) (openpgp.EntityList, error) {
+	if isKeybox(data) {
+		keyRing, err := readKeybox(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(keyRing) == 0 {
+			return nil, errors.New("no keys found in the keybox")
+		}
+		return openpgp.ReadKeyRing(bytes.NewReader(keyRing))
+	}
+	begin := []byte("-----BEGIN PGP ")
+	if !bytes.HasPrefix(bytes.TrimSpace(data), begin) {
+		return openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	var entityList openpgp.EntityList
+	// armor.Decode buffers its input, so every block is decoded on its own
+	data = bytes.TrimSpace(data)
+	for len(data) > 0 {
+		end := bytes.Index(data[1:], begin) + 1
+		if end == 0 {
+			end = len(data)
+		}
+		block, err := armor.Decode(bytes.NewReader(data[:end]))
+		if err != nil {
+			return nil, err
+		}
+		data = data[end:]
+		if block.Type != openpgp.PublicKeyType && block.Type != openpgp.PrivateKeyType {
+			return nil, fmt.Errorf("unexpected armored block of type %s instead of a key block", block.Type)
+		}
+		el, err := openpgp.ReadKeyRing(block.Body)
+		if err != nil {
+			return nil, err
+		}
+		entityList = append(entityList, el...)
+	}
+	if len(entityList) == 0 {
+		return nil, errors.New("no keys found in the armored key ring")
+	}
+	return entityList, nil
+}
+
 // SortDecryptionKeys parses a list of comma separated base64 entries and sorts the data into
 // a map. Each entry in the list may be either a GPG private key ring, private key, or x.509
 // certificate
@@ -242,7 +422,7 @@ func SortDecryptionKeys(b64ItemList string) (map[string][][]byte, error) {
 				dcparameters[key] = append(dcparameters[key], keyData)
 			}
 		} else {
-			return nil, errors.New("Unknown decryption key type")
+			return nil, fmt.Errorf("Unknown decryption key type: %w", errdefs.ErrKeyMaterial)
 		}
 	}
 
@@ -0,0 +1,35 @@
+//go:build go1.20
+// +build go1.20
+
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package utils
+
+import (
+	"crypto/ecdh"
+)
+
+// isX25519Key returns true if the key is an X25519 public or private key
+func isX25519Key(key interface{}) bool {
+	switch k := key.(type) {
+	case *ecdh.PublicKey:
+		return k.Curve() == ecdh.X25519()
+	case *ecdh.PrivateKey:
+		return k.Curve() == ecdh.X25519()
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package verify provides the integration point for verifying the signature
+// of an image before the keys of its layers are unwrapped, so that only images
+// that pass a trust policy, for example of Notation, are decrypted.
+package verify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/ocicrypt/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DefaultTimeout is the time a NotationVerifier waits for notation to finish
+const DefaultTimeout = 2 * time.Minute
+
+// Verifier verifies the signature of an image
+type Verifier interface {
+	// Verify returns an error unless the image with the given manifest
+	// passes verification; reference is the repository of the image, such
+	// as registry.example.com/app
+	Verify(ctx context.Context, reference string, manifest ocispec.Descriptor) error
+}
+
+// Verification verifies an image once before the keys of its layers are
+// unwrapped; it is set per image in the DecryptConfig
+type Verification struct {
+	// Verifier verifies the image
+	Verifier Verifier
+	// Reference is the repository of the image
+	Reference string
+	// Manifest is the descriptor of the manifest of the image
+	Manifest ocispec.Descriptor
+
+	mu   sync.Mutex
+	done bool
+	err  error
+}
+
+// Verify runs the Verifier the first time it is called and returns its result
+// on every call. Failures wrap ErrVerificationFailed. Errors that do not
+// decide the verification, because the context was done or the Verifier could
+// not be reached, are not kept, so the next call runs the Verifier again.
+func (v *Verification) Verify(ctx context.Context) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.done {
+		return v.err
+	}
+	if v.Verifier == nil {
+		v.done, v.err = true, fmt.Errorf("no verifier set: %w", errdefs.ErrConfiguration)
+		return v.err
+	}
+	if err := v.Verifier.Verify(ctx, v.Reference, v.Manifest); err != nil {
+		err = errdefs.WithCategory(errdefs.ErrVerificationFailed, fmt.Errorf("image %s@%s failed verification: %w", v.Reference, v.Manifest.Digest, err))
+		if isTransient(err) {
+			return err
+		}
+		v.err = err
+	}
+	v.done = true
+	return v.err
+}
+
+// isTransient returns true if err does not decide a verification
+func isTransient(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errdefs.ErrProviderUnreachable)
+}
+
+// NotationVerifier verifies images by running 'notation verify', which applies
+// the trust policy of the notation configuration
+type NotationVerifier struct {
+	// Path is the path of the notation binary; if empty, notation is looked
+	// up in the PATH
+	Path string
+	// Args are additional arguments, such as --plugin-config
+	Args []string
+	// Env is the environment of notation, for example to set its
+	// configuration directory; if nil, the environment of the process is used
+	Env []string
+	// Timeout is the time notation has for the verification; if 0,
+	// DefaultTimeout is used
+	Timeout time.Duration
+}
+
+// Verify runs 'notation verify' for reference@digest of the manifest
+func (nv *NotationVerifier) Verify(ctx context.Context, reference string, manifest ocispec.Descriptor) error {
+	if reference == "" || manifest.Digest == "" {
+		return fmt.Errorf("reference and manifest digest are needed for verification: %w", errdefs.ErrConfiguration)
+	}
+	timeout := nv.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	path := nv.Path
+	if path == "" {
+		path = "notation"
+	}
+	args := append([]string{"verify"}, nv.Args...)
+	args = append(args, reference+"@"+manifest.Digest.String())
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Env = nv.Env
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return errdefs.WithCategory(errdefs.ErrProviderUnreachable, fmt.Errorf("notation did not finish: %w", ctx.Err()))
+		}
+		if _, ok := err.(*exec.ExitError); !ok {
+			return errdefs.WithCategory(errdefs.ErrProviderUnreachable, fmt.Errorf("could not run notation: %w", err))
+		}
+		return fmt.Errorf("notation verify failed: %s", strings.TrimSpace(output.String()))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package verify
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containers/ocicrypt/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// writeNotation writes a fake notation binary that succeeds for the given
+// target only
+func writeNotation(t *testing.T, target string) string {
+	path := filepath.Join(t.TempDir(), "notation")
+	script := `#!/bin/sh
+[ "$1" = verify ] || exit 2
+[ "$2" = "` + target + `" ] && exit 0
+echo "signature verification failed for $2" >&2
+exit 1
+`
+	if err := os.WriteFile(path, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+type countingVerifier struct {
+	calls int
+	err   error
+}
+
+func (cv *countingVerifier) Verify(context.Context, string, ocispec.Descriptor) error {
+	cv.calls++
+	return cv.err
+}
+
+func TestNotationVerifier(t *testing.T) {
+	manifest := ocispec.Descriptor{Digest: digest.FromString("manifest")}
+	nv := &NotationVerifier{
+		Path: writeNotation(t, "registry.example.com/app@"+manifest.Digest.String()),
+	}
+	ctx := context.Background()
+
+	if err := nv.Verify(ctx, "registry.example.com/app", manifest); err != nil {
+		t.Fatal(err)
+	}
+	err := nv.Verify(ctx, "registry.example.com/other", manifest)
+	if err == nil || !strings.Contains(err.Error(), "signature verification failed") {
+		t.Fatalf("expected the output of notation in the error, got %v", err)
+	}
+	if err := nv.Verify(ctx, "", manifest); !errors.Is(err, errdefs.ErrConfiguration) {
+		t.Fatalf("expected ErrConfiguration, got %v", err)
+	}
+
+	nv.Path = filepath.Join(t.TempDir(), "missing")
+	if err := nv.Verify(ctx, "registry.example.com/app", manifest); !errors.Is(err, errdefs.ErrProviderUnreachable) {
+		t.Fatalf("expected ErrProviderUnreachable, got %v", err)
+	}
+
+	nv.Path = filepath.Join(t.TempDir(), "notation")
+	if err := os.WriteFile(nv.Path, []byte("#!/bin/sh\nexec sleep 60\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	nv.Timeout = 100 * time.Millisecond
+	if err := nv.Verify(ctx, "registry.example.com/app", manifest); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestVerification(t *testing.T) {
+	ctx := context.Background()
+	cv := &countingVerifier{}
+	v := &Verification{Verifier: cv, Reference: "registry.example.com/app"}
+	for i := 0; i < 3; i++ {
+		if err := v.Verify(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cv.calls != 1 {
+		t.Fatalf("verifier was called %d times, expected once", cv.calls)
+	}
+
+	cv = &countingVerifier{err: errors.New("untrusted")}
+	v = &Verification{Verifier: cv, Reference: "registry.example.com/app"}
+	for i := 0; i < 2; i++ {
+		if err := v.Verify(ctx); !errors.Is(err, errdefs.ErrVerificationFailed) || !errors.Is(err, errdefs.ErrIntegrity) {
+			t.Fatalf("expected ErrVerificationFailed, got %v", err)
+		}
+	}
+	if cv.calls != 1 {
+		t.Fatalf("verifier was called %d times, expected once", cv.calls)
+	}
+	for _, err := range []error{context.Canceled, context.DeadlineExceeded, errdefs.WithCategory(errdefs.ErrProviderUnreachable, errors.New("could not run notation"))} {
+		cv = &countingVerifier{err: err}
+		v = &Verification{Verifier: cv, Reference: "registry.example.com/app"}
+		if err := v.Verify(ctx); !errors.Is(err, cv.err) {
+			t.Fatalf("expected %v, got %v", cv.err, err)
+		}
+		cv.err = nil
+		if err := v.Verify(ctx); err != nil {
+			t.Fatalf("transient error was kept: %v", err)
+		}
+		if err := v.Verify(ctx); err != nil || cv.calls != 2 {
+			t.Fatalf("verifier was called %d times, expected twice: %v", cv.calls, err)
+		}
+	}
+}